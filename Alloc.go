@@ -0,0 +1,58 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kanzi
+
+import (
+	"errors"
+
+	"github.com/flanglet/kanzi-go/internal/alloc"
+)
+
+// AllocatorConfig the configuration of the allocator of the temporary
+// buffers of the transforms and entropy codecs. The buffers are pooled by
+// size class and reused across blocks.
+type AllocatorConfig = alloc.Config
+
+// AllocatorStats the statistics of the allocator of the temporary buffers
+type AllocatorStats = alloc.Stats
+
+// SetAllocatorConfig updates the configuration of the allocator of the
+// temporary buffers (EG. to lower the memory retained between blocks or to
+// disable pooling)
+func SetAllocatorConfig(cfg AllocatorConfig) error {
+	if cfg.MinSize < 0 || cfg.MaxSize < cfg.MinSize {
+		return errors.New("Invalid allocator configuration: the size range is invalid")
+	}
+
+	if cfg.MaxPooledBytes < 0 {
+		return errors.New("Invalid allocator configuration: the maximum pooled size must be positive")
+	}
+
+	alloc.SetConfig(cfg)
+	return nil
+}
+
+// GetAllocatorConfig returns the current configuration of the allocator of
+// the temporary buffers
+func GetAllocatorConfig() AllocatorConfig {
+	return alloc.GetConfig()
+}
+
+// GetAllocatorStats returns the statistics of the allocator of the temporary
+// buffers
+func GetAllocatorStats() AllocatorStats {
+	return alloc.GetStats()
+}
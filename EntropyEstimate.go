@@ -0,0 +1,189 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kanzi
+
+const (
+	// ENTROPY_RANDOM_THRESHOLD Randomness score (*1024) above which a block
+	// is considered incompressible (same scale as the entropy: 1024 means 8
+	// bits per byte)
+	ENTROPY_RANDOM_THRESHOLD = 973
+
+	_ESTIMATE_MAX_SAMPLE_SIZE = 64 * 1024
+	_ESTIMATE_CHUNKS          = 4
+	_ESTIMATE_LOG_HASH        = 14
+	_ESTIMATE_MATCH_LEN       = 8
+)
+
+// EntropyStats the statistics of a block returned by EntropyEstimate. The
+// entropies are scaled by 1024 (1024 means 8 bits per byte).
+type EntropyStats struct {
+	Size       int // number of bytes analyzed (a sample of big blocks)
+	Distinct   int // number of distinct byte values
+	Order0     int // order 0 entropy*1024
+	Order1     int // order 1 (previous byte context) entropy*1024, corrected for the sample size
+	MatchRatio int // bytes*1024 starting a repeat of 8 bytes seen before in the sample
+	Randomness int // lowest entropy estimate scaled down by the repeats (in [0..1024])
+}
+
+// IsIncompressible returns true if the block is not worth transforming nor
+// compressing
+func (this EntropyStats) IsIncompressible() bool {
+	return this.Randomness >= ENTROPY_RANDOM_THRESHOLD
+}
+
+// Return a sample of the block: the whole block or chunks spread over the
+// block
+func estimateSample(block []byte) []byte {
+	if len(block) <= _ESTIMATE_MAX_SAMPLE_SIZE {
+		return block
+	}
+
+	chunkSize := _ESTIMATE_MAX_SAMPLE_SIZE / _ESTIMATE_CHUNKS
+	step := (len(block) - chunkSize) / (_ESTIMATE_CHUNKS - 1)
+	res := make([]byte, 0, _ESTIMATE_MAX_SAMPLE_SIZE)
+
+	for i := 0; i < _ESTIMATE_CHUNKS; i++ {
+		res = append(res, block[i*step:i*step+chunkSize]...)
+	}
+
+	return res
+}
+
+// Return the order 1 entropy*1024 of 'length' symbols given their
+// histograms per context
+func computeOrder1Entropy1024(freqs *[256][256]int32, length int) int {
+	sum := uint64(0)
+
+	for c := range freqs {
+		total := 0
+
+		for _, f := range freqs[c] {
+			total += int(f)
+		}
+
+		if total == 0 {
+			continue
+		}
+
+		logTotal1024, _ := Log2_1024(uint32(total))
+
+		for _, f := range freqs[c] {
+			if f != 0 {
+				log1024, _ := Log2_1024(uint32(f))
+				sum += (uint64(f) * uint64(logTotal1024-log1024)) >> 3
+			}
+		}
+	}
+
+	return int(sum / uint64(length))
+}
+
+// EntropyEstimate computes the order 0 and order 1 entropies of the block
+// and a randomness score that also accounts for repeated strings (which
+// the entropies do not see). Big blocks are sampled (64 KB in 4 chunks).
+// The order 1 entropy of a sample is biased low (most contexts are seen a
+// few times): the bias is measured on a permutation of the sample and
+// removed.
+func EntropyEstimate(block []byte) EntropyStats {
+	var res EntropyStats
+	sample := estimateSample(block)
+	res.Size = len(sample)
+
+	if len(sample) == 0 {
+		return res
+	}
+
+	var freqs [256][256]int32
+	var freqs0 [256]int
+	prv := byte(0)
+
+	for _, cur := range sample {
+		freqs0[cur]++
+		freqs[prv][cur]++
+		prv = cur
+	}
+
+	for _, f := range freqs0 {
+		if f != 0 {
+			res.Distinct++
+		}
+	}
+
+	res.Order0 = ComputeEntropy1024(freqs0[:], len(sample))
+	res.Order1 = computeOrder1Entropy1024(&freqs, len(sample))
+
+	// Same statistics with the contexts taken from a permutation of the
+	// sample: what is left is the bias (the data has no order 1 structure
+	// after the permutation). P is a prime larger than the sample size.
+	const P = 1000003
+	step := P % len(sample)
+	j := 0
+
+	for i := range freqs {
+		for k := range freqs[i] {
+			freqs[i][k] = 0
+		}
+	}
+
+	for _, cur := range sample {
+		freqs[sample[j]][cur]++
+
+		if j += step; j >= len(sample) {
+			j -= len(sample)
+		}
+	}
+
+	if bias := res.Order0 - computeOrder1Entropy1024(&freqs, len(sample)); bias > 0 {
+		res.Order1 += bias
+	}
+
+	// Context cannot increase the entropy
+	if res.Order1 > res.Order0 {
+		res.Order1 = res.Order0
+	}
+
+	// Repeats of 8 bytes (hash of the next 8 bytes, checked)
+	if len(sample) > 2*_ESTIMATE_MATCH_LEN {
+		var positions [1 << _ESTIMATE_LOG_HASH]int32
+		matches := 0
+		end := len(sample) - _ESTIMATE_MATCH_LEN
+
+		for i := 0; i < end; {
+			h := uint32(0)
+
+			for j := 0; j < _ESTIMATE_MATCH_LEN; j++ {
+				h = h*0x2F0F1F7 + uint32(sample[i+j])
+			}
+
+			h = (h * 0x9E3779B1) >> (32 - _ESTIMATE_LOG_HASH)
+			ref := int(positions[h]) - 1
+			positions[h] = int32(i + 1)
+
+			if ref >= 0 && string(sample[ref:ref+_ESTIMATE_MATCH_LEN]) == string(sample[i:i+_ESTIMATE_MATCH_LEN]) {
+				matches += _ESTIMATE_MATCH_LEN
+				i += _ESTIMATE_MATCH_LEN
+				continue
+			}
+
+			i++
+		}
+
+		res.MatchRatio = (matches << 10) / len(sample)
+	}
+
+	res.Randomness = res.Order1 * (1024 - res.MatchRatio) >> 10
+	return res
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kanzi
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrOutputTooSmall the output buffer of a transform or of an entropy codec
+// is too small for the result. The errors of this kind match it with
+// errors.Is.
+var ErrOutputTooSmall = errors.New("Output buffer too small")
+
+// ErrNotApplicable a transform does not apply to the data (EG. text transform
+// and binary data, no gain): the stage is skipped, the data is not
+// corrupted. The errors of this kind match it with errors.Is.
+var ErrNotApplicable = errors.New("Transform not applicable")
+
+// ErrBlockTooLarge the block exceeds the max block size of a transform. The
+// transform sequences skip the stage (forward) when a transform returns it.
+// The errors of this kind match it with errors.Is.
+var ErrBlockTooLarge = errors.New("Block too large")
+
+// ErrBufferOverlap the input and output buffers of a transform share memory
+// (see CheckOverlap). The errors of this kind (*OverlapError) match it with
+// errors.Is.
+var ErrBufferOverlap = errors.New("Input and output buffers overlap")
+
+// ErrOneShotUnavailable the error returned by Compress and Decompress when
+// the package github.com/flanglet/kanzi-go/io, which implements them, is not
+// imported by the program.
+var ErrOneShotUnavailable = errors.New("One-shot blocks not available: the package github.com/flanglet/kanzi-go/io " +
+	"is not imported (add import _ \"github.com/flanglet/kanzi-go/io\")")
+
+// ErrCorruptStream the error returned when the compressed data cannot be
+// decoded (invalid code, bitstream or checksum). The block and the offset
+// are known when the error is reported by a compressed stream (see
+// errors.As). All the errors of this type match &ErrCorruptStream{} with
+// errors.Is.
+type ErrCorruptStream struct {
+	Block  int    // ID of the damaged block (-1 if unknown)
+	Offset int64  // offset of the damaged block in the compressed stream (-1 if unknown)
+	Msg    string // description of the error
+	Err    error  // underlying error (nil if none)
+}
+
+// NewCorruptStreamError creates a new instance of ErrCorruptStream with an
+// unknown block and offset (the error of a codec)
+func NewCorruptStreamError(msg string) *ErrCorruptStream {
+	return &ErrCorruptStream{Block: -1, Offset: -1, Msg: msg}
+}
+
+// Error returns the description of the error
+func (this *ErrCorruptStream) Error() string {
+	if this.Block < 0 {
+		return this.Msg
+	}
+
+	return fmt.Sprintf("%v (block %d at offset %d)", this.Msg, this.Block, this.Offset)
+}
+
+// Unwrap returns the underlying error (nil if none)
+func (this *ErrCorruptStream) Unwrap() error {
+	return this.Err
+}
+
+// Is returns true if the target is an ErrCorruptStream
+func (this *ErrCorruptStream) Is(target error) bool {
+	_, ok := target.(*ErrCorruptStream)
+	return ok
+}
+
+// An error message of a given kind (ErrOutputTooSmall, ErrNotApplicable or
+// ErrBlockTooLarge)
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (this *kindError) Error() string {
+	return this.msg
+}
+
+func (this *kindError) Unwrap() error {
+	return this.kind
+}
+
+// NewOutputTooSmallError returns an error with the given message matching
+// ErrOutputTooSmall
+func NewOutputTooSmallError(msg string) error {
+	return &kindError{msg: msg, kind: ErrOutputTooSmall}
+}
+
+// NewNotApplicableError returns an error with the given message matching
+// ErrNotApplicable
+func NewNotApplicableError(msg string) error {
+	return &kindError{msg: msg, kind: ErrNotApplicable}
+}
+
+// NewBlockTooLargeError returns an error with the given message matching
+// ErrBlockTooLarge
+func NewBlockTooLargeError(msg string) error {
+	return &kindError{msg: msg, kind: ErrBlockTooLarge}
+}
@@ -16,7 +16,10 @@ limitations under the License.
 package kanzi
 
 import (
+	"encoding/binary"
 	"errors"
+
+	"github.com/flanglet/kanzi-go/internal/cpuinfo"
 )
 
 // LOG2 is an array with 256 elements: int(Math.log2(x-1))
@@ -106,6 +109,20 @@ func init() {
 	}
 
 	STRETCH[4095] = 2047
+
+	cpuinfo.Register(selectKernels)
+}
+
+// Order 0 histogram kernel selected at startup based on the CPU features
+var computeHistogram0 func(block []byte, freqs []int)
+
+// Select the fastest kernels for the features of the host CPU
+func selectKernels(f cpuinfo.Features) {
+	if f.UnalignedLoads == true {
+		computeHistogram0 = computeHistogram0Wide
+	} else {
+		computeHistogram0 = computeHistogram0Default
+	}
 }
 
 // Squash returns p = 1/(1 + exp(-d)), d scaled by 8 bits, p scaled by 12 bits
@@ -241,26 +258,7 @@ func ComputeHistogram(block []byte, freqs []int, isOrder0, withTotal bool) {
 			freqs[256] = len(block)
 		}
 
-		f0 := [256]int{}
-		f1 := [256]int{}
-		f2 := [256]int{}
-		f3 := [256]int{}
-		end4 := len(block) & -4
-
-		for i := 0; i < end4; i += 4 {
-			f0[block[i]]++
-			f1[block[i+1]]++
-			f2[block[i+2]]++
-			f3[block[i+3]]++
-		}
-
-		for i := end4; i < len(block); i++ {
-			freqs[block[i]]++
-		}
-
-		for i := 0; i < 256; i++ {
-			freqs[i] += (f0[i] + f1[i] + f2[i] + f3[i])
-		}
+		computeHistogram0(block, freqs)
 	} else { // Order 1
 		prv := int(0)
 
@@ -279,6 +277,59 @@ func ComputeHistogram(block []byte, freqs []int, isOrder0, withTotal bool) {
 	}
 }
 
+// Portable kernel: 4 interleaved tables to hide store to load latencies
+func computeHistogram0Default(block []byte, freqs []int) {
+	f0 := [256]int{}
+	f1 := [256]int{}
+	f2 := [256]int{}
+	f3 := [256]int{}
+	end4 := len(block) & -4
+
+	for i := 0; i < end4; i += 4 {
+		f0[block[i]]++
+		f1[block[i+1]]++
+		f2[block[i+2]]++
+		f3[block[i+3]]++
+	}
+
+	for i := end4; i < len(block); i++ {
+		freqs[block[i]]++
+	}
+
+	for i := 0; i < 256; i++ {
+		freqs[i] += (f0[i] + f1[i] + f2[i] + f3[i])
+	}
+}
+
+// Kernel for CPUs with fast unaligned loads: read 8 bytes at a time
+func computeHistogram0Wide(block []byte, freqs []int) {
+	f0 := [256]int32{}
+	f1 := [256]int32{}
+	f2 := [256]int32{}
+	f3 := [256]int32{}
+	end8 := len(block) & -8
+
+	for i := 0; i < end8; i += 8 {
+		v := binary.LittleEndian.Uint64(block[i:])
+		f0[byte(v)]++
+		f1[byte(v>>8)]++
+		f2[byte(v>>16)]++
+		f3[byte(v>>24)]++
+		f0[byte(v>>32)]++
+		f1[byte(v>>40)]++
+		f2[byte(v>>48)]++
+		f3[byte(v>>56)]++
+	}
+
+	for i := end8; i < len(block); i++ {
+		freqs[block[i]]++
+	}
+
+	for i := 0; i < 256; i++ {
+		freqs[i] += int(f0[i]) + int(f1[i]) + int(f2[i]) + int(f3[i])
+	}
+}
+
 // ComputeJobsPerTask computes the number of jobs associated with each task
 // given a number of jobs available and a number of tasks to perform.
 // The provided 'jobsPerTask' slice is returned as result.
@@ -102,6 +102,20 @@ type ByteFunction interface {
 	MaxEncodedLen(srcLen int) int
 }
 
+// ThreadSafety describes how a transform or function instance can be used.
+// A transform without this interface must be assumed reusable but not safe
+// for concurrent use.
+type ThreadSafety interface {
+	// IsReusable returns true if the instance can process other blocks
+	// after an Inverse call returned an error. Forward errors only mean
+	// that the transform does not apply to the block.
+	IsReusable() bool
+
+	// IsConcurrentSafe returns true if Forward and Inverse can be called
+	// concurrently on the same instance
+	IsConcurrentSafe() bool
+}
+
 // InputBitStream is a bitstream reader
 type InputBitStream interface {
 	// ReadBit returns the next bit in the bitstream. Panics if closed or EOS is reached.
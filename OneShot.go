@@ -0,0 +1,59 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kanzi
+
+// The one-shot helpers are implemented by the package io (the codecs import
+// this package, so it cannot import them): it registers them when it is
+// imported. The programs that use Compress and Decompress without the package
+// io must import it for its side effect:
+//
+//	import _ "github.com/flanglet/kanzi-go/io"
+//
+// Otherwise both return ErrOneShotUnavailable.
+var (
+	oneShotCompress   func(dst, src []byte, ctx map[string]interface{}) ([]byte, error)
+	oneShotDecompress func(dst, src []byte) ([]byte, error)
+)
+
+// RegisterOneShot registers the implementation of Compress and Decompress
+// (called by the package io)
+func RegisterOneShot(compress func(dst, src []byte, ctx map[string]interface{}) ([]byte, error),
+	decompress func(dst, src []byte) ([]byte, error)) {
+	oneShotCompress = compress
+	oneShotDecompress = decompress
+}
+
+// Compress compresses 'src' to a one-shot block (see io.Compress). Returns
+// ErrOneShotUnavailable if the package github.com/flanglet/kanzi-go/io is
+// not imported.
+func Compress(dst, src []byte, ctx map[string]interface{}) ([]byte, error) {
+	if oneShotCompress == nil {
+		return nil, ErrOneShotUnavailable
+	}
+
+	return oneShotCompress(dst, src, ctx)
+}
+
+// Decompress decodes the one-shot block 'src' (see io.Decompress). Returns
+// ErrOneShotUnavailable if the package github.com/flanglet/kanzi-go/io is
+// not imported.
+func Decompress(dst, src []byte) ([]byte, error) {
+	if oneShotDecompress == nil {
+		return nil, ErrOneShotUnavailable
+	}
+
+	return oneShotDecompress(dst, src)
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kanzi
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// OverlapError the error returned by the transforms when the input and
+// output buffers share memory (the transforms cannot run in place). It
+// matches ErrBufferOverlap with errors.Is.
+type OverlapError struct {
+	SrcLen int
+	DstLen int
+	Offset int // start of the output buffer minus start of the input buffer
+}
+
+// Error returns the description of the error
+func (this *OverlapError) Error() string {
+	if this.Offset == 0 {
+		return "Input and output buffers cannot be equal"
+	}
+
+	return fmt.Sprintf("Input and output buffers cannot overlap (output starts at offset %d of input)", this.Offset)
+}
+
+// Unwrap returns ErrBufferOverlap
+func (this *OverlapError) Unwrap() error {
+	return ErrBufferOverlap
+}
+
+// Is returns true if the target is an OverlapError
+func (this *OverlapError) Is(target error) bool {
+	_, ok := target.(*OverlapError)
+	return ok
+}
+
+// SlicesOverlap returns true if the memory ranges [0..len) of the two slices
+// intersect. Empty slices never overlap. The addresses are obtained with
+// reflect (the package unsafe is not used in this module).
+func SlicesOverlap(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+
+	pa := reflect.ValueOf(a).Pointer()
+	pb := reflect.ValueOf(b).Pointer()
+	return pa < pb+uintptr(len(b)) && pb < pa+uintptr(len(a))
+}
+
+// CheckOverlap returns an *OverlapError if the input and output buffers of
+// a transform overlap, nil otherwise
+func CheckOverlap(src, dst []byte) error {
+	if SlicesOverlap(src, dst) == false {
+		return nil
+	}
+
+	pSrc := reflect.ValueOf(src).Pointer()
+	pDst := reflect.ValueOf(dst).Pointer()
+	return &OverlapError{SrcLen: len(src), DstLen: len(dst), Offset: int(pDst) - int(pSrc)}
+}
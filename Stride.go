@@ -0,0 +1,231 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kanzi
+
+import (
+	"math"
+)
+
+const (
+	_STRIDE_SAMPLE_SIZE = 64 * 1024
+	_STRIDE_MIN_GAIN    = 90 // a stride must lower the entropy by 10% at least
+	_STRIDE_MIN_STEP    = 95 // a larger stride must beat a smaller one by 5% at least
+)
+
+// STRIDE_CANDIDATES the strides tested by DetectStride (in increasing order)
+var STRIDE_CANDIDATES = []int{1, 2, 3, 4, 8, 16}
+
+// StrideStats the statistics of a block for a given stride
+type StrideStats struct {
+	Stride          int
+	LaneEntropy     int     // mean order 0 entropy*1024 of the 'stride' interleaved byte lanes
+	DeltaEntropy    int     // order 0 entropy*1024 of the deltas block[i]-block[i-stride]
+	Autocorrelation float64 // correlation of block[i] and block[i-stride] in [-1..1]
+}
+
+// Score returns the lowest entropy (*1024) achievable with this stride
+// (either by splitting the lanes or by coding the deltas)
+func (this StrideStats) Score() int {
+	if this.LaneEntropy < this.DeltaEntropy {
+		return this.LaneEntropy
+	}
+
+	return this.DeltaEntropy
+}
+
+// ComputeEntropy1024 returns the order 0 entropy scaled by 1024 of 'length'
+// symbols given their histogram (256 entries)
+func ComputeEntropy1024(histo []int, length int) int {
+	if length == 0 {
+		return 0
+	}
+
+	sum := uint64(0)
+	logLength1024, _ := Log2_1024(uint32(length))
+
+	for i := 0; i < 256; i++ {
+		if histo[i] == 0 {
+			continue
+		}
+
+		log1024, _ := Log2_1024(uint32(histo[i]))
+		sum += ((uint64(histo[i]) * uint64(logLength1024-log1024)) >> 3)
+	}
+
+	return int(sum / uint64(length))
+}
+
+// ComputeLaneHistograms computes the histograms of the bytes of the block at
+// positions i, i+stride, i+2*stride ... for each i in [0..stride[ and
+// returns them in 'freqs' (one slice of 256 entries per lane).
+func ComputeLaneHistograms(block []byte, stride int, freqs [][]int) {
+	for l := 0; l < stride; l++ {
+		f := freqs[l]
+
+		for i := range f[0:256] {
+			f[i] = 0
+		}
+
+		for i := l; i < len(block); i += stride {
+			f[block[i]]++
+		}
+	}
+}
+
+// ComputeDeltaHistogram computes the histogram of the differences between
+// each byte and the byte 'stride' positions before (mod 256) and returns it
+// in 'freqs' (256 entries). The first 'stride' bytes are counted as is.
+func ComputeDeltaHistogram(block []byte, stride int, freqs []int) {
+	for i := range freqs[0:256] {
+		freqs[i] = 0
+	}
+
+	n := stride
+
+	if n > len(block) {
+		n = len(block)
+	}
+
+	for i := 0; i < n; i++ {
+		freqs[block[i]]++
+	}
+
+	for i := n; i < len(block); i++ {
+		freqs[byte(block[i]-block[i-stride])]++
+	}
+}
+
+// ComputeAutocorrelation returns the correlation coefficient of the bytes
+// of the block and the bytes 'stride' positions before (0 if undefined)
+func ComputeAutocorrelation(block []byte, stride int) float64 {
+	if stride <= 0 || stride >= len(block) {
+		return 0
+	}
+
+	var sumX, sumY, sumXY, sumX2, sumY2 int64
+	n := int64(len(block) - stride)
+
+	for i := stride; i < len(block); i++ {
+		x := int64(block[i-stride])
+		y := int64(block[i])
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumX2 += x * x
+		sumY2 += y * y
+	}
+
+	cov := float64(n*sumXY - sumX*sumY)
+	varX := float64(n*sumX2 - sumX*sumX)
+	varY := float64(n*sumY2 - sumY*sumY)
+
+	if varX <= 0 || varY <= 0 {
+		return 0
+	}
+
+	return cov / math.Sqrt(varX*varY)
+}
+
+// ComputeStrideStats computes the statistics of the block for each of the
+// provided strides
+func ComputeStrideStats(block []byte, strides []int) []StrideStats {
+	res := make([]StrideStats, len(strides))
+	histo := [256]int{}
+	maxStride := 1
+
+	for _, s := range strides {
+		if s > maxStride {
+			maxStride = s
+		}
+	}
+
+	lanes := make([][]int, maxStride)
+	buf := make([]int, 256*maxStride)
+
+	for l := range lanes {
+		lanes[l] = buf[l*256 : (l+1)*256]
+	}
+
+	for i, s := range strides {
+		res[i].Stride = s
+
+		if s <= 0 || len(block) == 0 {
+			continue
+		}
+
+		ComputeLaneHistograms(block, s, lanes[0:s])
+		sum := 0
+
+		for l := 0; l < s; l++ {
+			n := (len(block) - l + s - 1) / s
+
+			if n > 0 {
+				sum += ComputeEntropy1024(lanes[l], n) * n
+			}
+		}
+
+		res[i].LaneEntropy = sum / len(block)
+		ComputeDeltaHistogram(block, s, histo[:])
+		res[i].DeltaEntropy = ComputeEntropy1024(histo[:], len(block))
+		res[i].Autocorrelation = ComputeAutocorrelation(block, s)
+	}
+
+	return res
+}
+
+// DetectStride analyzes a sample of the block and returns the stride (one of
+// STRIDE_CANDIDATES) that lowers the entropy the most when the bytes are
+// split in lanes or delta coded. Returns false if no stride improves
+// significantly on the order 0 entropy of the block. The smallest stride is
+// preferred when several strides perform similarly (multiples of the actual
+// stride of the data perform well too).
+func DetectStride(block []byte) (int, bool) {
+	if len(block) < 4*STRIDE_CANDIDATES[len(STRIDE_CANDIDATES)-1] {
+		return 1, false
+	}
+
+	sample := block
+
+	// Sample the middle of the block (avoid headers)
+	if len(sample) > _STRIDE_SAMPLE_SIZE {
+		start := (len(block) - _STRIDE_SAMPLE_SIZE) / 2
+		sample = block[start : start+_STRIDE_SAMPLE_SIZE]
+	}
+
+	histo := [256]int{}
+	ComputeHistogram(sample, histo[:], true, false)
+	baseline := ComputeEntropy1024(histo[:], len(sample))
+	stats := ComputeStrideStats(sample, STRIDE_CANDIDATES)
+	best := -1
+
+	for i := range stats {
+		score := stats[i].Score()
+
+		if score*100 >= baseline*_STRIDE_MIN_GAIN {
+			continue
+		}
+
+		if best < 0 || score*100 < stats[best].Score()*_STRIDE_MIN_STEP {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return 1, false
+	}
+
+	return stats[best].Stride, true
+}
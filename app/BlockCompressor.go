@@ -45,16 +45,26 @@ type BlockCompressor struct {
 	verbosity    uint
 	overwrite    bool
 	checksum     bool
+	checksumType string // block checksum algorithm (empty means default)
+	streamDigest bool   // SHA-256 of the input stored in the stream
+	parityShards uint   // parity shards of each block (0 if none)
+	dictionary   string // file of the preset LZ dictionary (empty if none)
+	embedDict    bool   // preset dictionary stored in the stream
 	skipBlocks   bool
 	inputName    string
 	outputName   string
 	entropyCodec string
 	transform    string
+	race         string // alternate transform chain of the level (if any)
 	blockSize    uint
-	level        int // command line compression level
+	level        string // command line compression level
 	jobs         uint
 	listeners    []kanzi.Listener
 	cpuProf      string
+	digest       string // digest of the compressed output (if any)
+	importMode   bool   // decompress gzip/bzip2 input files before compression
+	archiveMode  bool   // compress the input file or directory to one archive
+	mapInput     bool   // map the input files in memory (see kio.OpenMappedFile)
 }
 
 type fileCompressResult struct {
@@ -68,7 +78,7 @@ type fileCompressResult struct {
 func NewBlockCompressor(argsMap map[string]interface{}) (*BlockCompressor, error) {
 	this := new(BlockCompressor)
 	this.listeners = make([]kanzi.Listener, 0)
-	this.level = argsMap["level"].(int)
+	this.level = argsMap["level"].(string)
 	delete(argsMap, "level")
 
 	if force, prst := argsMap["overwrite"]; prst == true {
@@ -92,11 +102,19 @@ func NewBlockCompressor(argsMap map[string]interface{}) (*BlockCompressor, error
 	strTransf := ""
 	strCodec := ""
 
-	if this.level >= 0 {
-		tranformAndCodec := getTransformAndCodec(this.level)
-		tokens := strings.Split(tranformAndCodec, "&")
-		strTransf = tokens[0]
-		strCodec = tokens[1]
+	levelBlockSize := uint(0)
+
+	if len(this.level) != 0 {
+		lvl, exists := kio.GetLevel(this.level)
+
+		if exists == false {
+			return nil, fmt.Errorf("Unknown compression level: '%v'", this.level)
+		}
+
+		strTransf = lvl.Transform()
+		strCodec = lvl.Codec()
+		levelBlockSize = lvl.BlockSize()
+		this.race = lvl.Race()
 	} else {
 		if codec, prst := argsMap["entropy"]; prst == true {
 			strCodec = codec.(string)
@@ -117,6 +135,8 @@ func NewBlockCompressor(argsMap map[string]interface{}) (*BlockCompressor, error
 			return nil, fmt.Errorf("Maximum block size is 1 GB (1073741824 bytes), got %v bytes", this.blockSize)
 		}
 
+	} else if levelBlockSize != 0 {
+		this.blockSize = levelBlockSize
 	} else {
 		this.blockSize = _COMP_DEFAULT_BLOCK_SIZE
 	}
@@ -140,6 +160,31 @@ func NewBlockCompressor(argsMap map[string]interface{}) (*BlockCompressor, error
 		this.checksum = false
 	}
 
+	if name, prst := argsMap["checksumType"]; prst == true {
+		this.checksumType = name.(string)
+		delete(argsMap, "checksumType")
+	}
+
+	if digest, prst := argsMap["streamDigest"]; prst == true {
+		this.streamDigest = digest.(bool)
+		delete(argsMap, "streamDigest")
+	}
+
+	if shards, prst := argsMap["parityShards"]; prst == true {
+		this.parityShards = shards.(uint)
+		delete(argsMap, "parityShards")
+	}
+
+	if name, prst := argsMap["dictionary"]; prst == true {
+		this.dictionary = name.(string)
+		delete(argsMap, "dictionary")
+	}
+
+	if embed, prst := argsMap["embedDictionary"]; prst == true {
+		this.embedDict = embed.(bool)
+		delete(argsMap, "embedDictionary")
+	}
+
 	this.verbosity = argsMap["verbose"].(uint)
 	delete(argsMap, "verbose")
 	concurrency := argsMap["jobs"].(uint)
@@ -159,6 +204,30 @@ func NewBlockCompressor(argsMap map[string]interface{}) (*BlockCompressor, error
 		this.jobs = concurrency
 	}
 
+	if digest, prst := argsMap["outputDigest"]; prst == true {
+		this.digest = digest.(string)
+		delete(argsMap, "outputDigest")
+	}
+
+	if imp, prst := argsMap["import"]; prst == true {
+		this.importMode = imp.(bool)
+		delete(argsMap, "import")
+	}
+
+	if arc, prst := argsMap["archive"]; prst == true {
+		this.archiveMode = arc.(bool)
+		delete(argsMap, "archive")
+	}
+
+	if this.importMode == true && this.archiveMode == true {
+		return nil, fmt.Errorf("The import and archive options are incompatible")
+	}
+
+	if mmap, prst := argsMap["mapInput"]; prst == true {
+		this.mapInput = mmap.(bool)
+		delete(argsMap, "mapInput")
+	}
+
 	if prof, prst := argsMap["cpuProf"]; prst == true {
 		this.cpuProf = prof.(string)
 		delete(argsMap, "cpuProf")
@@ -275,6 +344,29 @@ func (this *BlockCompressor) Compress() (int, uint64) {
 	msg = fmt.Sprintf("Checksum set to %t", this.checksum)
 	log.Println(msg, printFlag)
 
+	if len(this.checksumType) != 0 {
+		msg = fmt.Sprintf("Block checksum set to %s", this.checksumType)
+		log.Println(msg, printFlag)
+	}
+
+	if this.streamDigest == true {
+		log.Println("Digest of the input set to true", printFlag)
+	}
+
+	if this.parityShards != 0 {
+		msg = fmt.Sprintf("Parity shards per block set to %d", this.parityShards)
+		log.Println(msg, printFlag)
+	}
+
+	if len(this.dictionary) != 0 {
+		msg = fmt.Sprintf("Preset dictionary set to %s (embedded: %t)", this.dictionary, this.embedDict)
+		log.Println(msg, printFlag)
+	}
+
+	if this.mapInput == true {
+		log.Println("Memory mapped input set to true", printFlag)
+	}
+
 	if printFlag == true {
 		w1 := "no"
 
@@ -346,7 +438,7 @@ func (this *BlockCompressor) Compress() (int, uint64) {
 				formattedInName = formattedInName + string([]byte{os.PathSeparator})
 			}
 
-			if len(formattedOutName) > 0 && specialOutput == false {
+			if len(formattedOutName) > 0 && specialOutput == false && this.archiveMode == false {
 				fi, err = os.Stat(formattedOutName)
 
 				if err != nil {
@@ -382,28 +474,85 @@ func (this *BlockCompressor) Compress() (int, uint64) {
 	ctx["blockSize"] = this.blockSize
 	ctx["checksum"] = this.checksum
 	ctx["codec"] = this.entropyCodec
+
+	if len(this.checksumType) != 0 {
+		ctx["checksumType"] = this.checksumType
+	}
+
+	if this.streamDigest == true {
+		ctx["streamDigest"] = true
+	}
+
+	if this.parityShards != 0 {
+		ctx["parityShards"] = this.parityShards
+	}
+
+	if len(this.dictionary) != 0 {
+		dict, code := loadLZDictionary(this.dictionary)
+
+		if code != 0 {
+			return code, 0
+		}
+
+		ctx["lzDictionary"] = dict
+		ctx["dictionaryMode"] = kio.DICTIONARY_MODE_REFERENCE
+
+		if this.embedDict == true {
+			ctx["dictionaryMode"] = kio.DICTIONARY_MODE_EMBED
+		}
+	}
 	ctx["transform"] = this.transform
 	ctx["extra"] = this.entropyCodec == "TPAQX"
 
+	if len(this.race) != 0 {
+		ctx["raceTransform"] = this.race
+	}
+
+	if len(this.digest) != 0 {
+		ctx["outputDigest"] = this.digest
+	}
+
+	// Report the inconsistent parameters before processing any file
+	cfg := kio.NewConfigWithCtx(ctx)
+	cfg.Set("jobs", this.jobs)
+
+	// The size of an imported file is not the size of its content
+	if nbFiles == 1 && strings.ToUpper(this.inputName) != _COMP_STDIN && this.importMode == false && this.archiveMode == false {
+		cfg.Set("fileSize", files[0].Size)
+	}
+
+	diagnostics := cfg.Validate()
+
+	for _, d := range diagnostics {
+		log.Println(d.String(), d.Severity == kio.DIAGNOSTIC_ERROR || this.verbosity > 1)
+	}
+
+	if kio.HasErrors(diagnostics) == true {
+		return kanzi.ERR_INVALID_PARAM, 0
+	}
+
+	if this.archiveMode == true {
+		return this.compressArchive(ctx, before)
+	}
+
 	if nbFiles == 1 {
 		oName := formattedOutName
 		iName := _COMP_STDIN
 
 		if strings.ToUpper(this.inputName) != _COMP_STDIN {
 			iName = files[0].FullPath
-			ctx["fileSize"] = files[0].Size
 
-			if len(oName) == 0 {
-				oName = iName + ".knz"
-			} else if inputIsDir == true && specialOutput == false {
-				oName = formattedOutName + iName[len(formattedInName):] + ".knz"
+			if this.importMode == false {
+				ctx["fileSize"] = files[0].Size
 			}
+
+			oName = this.getOutputName(iName, formattedInName, formattedOutName, inputIsDir && !specialOutput)
 		}
 
 		ctx["inputName"] = iName
 		ctx["outputName"] = oName
 		ctx["jobs"] = this.jobs
-		task := fileCompressTask{ctx: ctx, listeners: this.listeners}
+		task := fileCompressTask{ctx: ctx, listeners: this.listeners, importMode: this.importMode, mapInput: this.mapInput}
 		res, read, written = task.call()
 	} else {
 		// Create channels for task synchronization
@@ -417,13 +566,7 @@ func (this *BlockCompressor) Compress() (int, uint64) {
 		// Create one task per file
 		for i, f := range files {
 			iName := f.FullPath
-			oName := formattedOutName
-
-			if len(oName) == 0 {
-				oName = iName + ".knz"
-			} else if inputIsDir == true && specialOutput == false {
-				oName = formattedOutName + iName[len(formattedInName):] + ".knz"
-			}
+			oName := this.getOutputName(iName, formattedInName, formattedOutName, inputIsDir && !specialOutput)
 
 			taskCtx := make(map[string]interface{})
 
@@ -431,11 +574,15 @@ func (this *BlockCompressor) Compress() (int, uint64) {
 				taskCtx[k] = v
 			}
 
-			taskCtx["fileSize"] = f.Size
+			if this.importMode == false {
+				taskCtx["fileSize"] = f.Size
+			}
+
 			taskCtx["inputName"] = iName
 			taskCtx["outputName"] = oName
 			taskCtx["jobs"] = jobsPerTask[i]
-			task := fileCompressTask{ctx: taskCtx, listeners: this.listeners}
+			task := fileCompressTask{ctx: taskCtx, listeners: this.listeners, importMode: this.importMode,
+				mapInput: this.mapInput}
 
 			// Push task to channel. The workers are the consumers.
 			tasks <- task
@@ -498,56 +645,158 @@ func (this *BlockCompressor) Compress() (int, uint64) {
 	return res, written
 }
 
-func notifyBCListeners(listeners []kanzi.Listener, evt *kanzi.Event) {
-	defer func() {
-		//lint:ignore SA9003 ignore panics in listeners
-		if r := recover(); r != nil {
-			// Ignore panics in listeners
+// Compress the input file or directory (with all its files) to one archive
+// named after the input (unless an output name is provided).
+// Returns exit code, number of bytes written.
+func (this *BlockCompressor) compressArchive(ctx map[string]interface{}, before time.Time) (int, uint64) {
+	if strings.ToUpper(this.inputName) == _COMP_STDIN {
+		fmt.Println("Cannot archive STDIN")
+		return kanzi.ERR_INVALID_PARAM, 0
+	}
+
+	inputName := filepath.Clean(this.inputName)
+	outputName := this.outputName
+
+	if len(outputName) == 0 {
+		outputName = inputName + ".knz"
+	}
+
+	log.Println("Output file name set to '"+outputName+"'", this.verbosity > 2)
+	var output io.WriteCloser
+
+	if strings.ToUpper(outputName) == _COMP_NONE {
+		output, _ = kio.NewNullOutputStream()
+	} else if strings.ToUpper(outputName) == _COMP_STDOUT {
+		output = os.Stdout
+	} else {
+		if _, err := os.Stat(outputName); err == nil && this.overwrite == false {
+			fmt.Printf("File '%v' exists and the 'force' command ", outputName)
+			fmt.Println("line option has not been provided")
+			return kanzi.ERR_OVERWRITE_FILE, 0
 		}
-	}()
 
-	for _, bl := range listeners {
-		bl.ProcessEvent(evt)
+		var err error
+
+		if output, err = os.Create(outputName); err != nil {
+			fmt.Printf("Cannot open output file '%v' for writing: %v\n", outputName, err)
+			return kanzi.ERR_CREATE_FILE, 0
+		}
+
+		defer func() {
+			output.Close()
+		}()
+	}
+
+	cfg := kio.NewConfigWithCtx(ctx)
+	cfg.Set("jobs", this.jobs)
+	aw, err := kio.NewArchiveWriter(output, cfg)
+
+	if err != nil {
+		fmt.Printf("Cannot create compressed stream: %s\n", err.Error())
+
+		if ioerr, isIOErr := err.(*kio.IOError); isIOErr == true {
+			return ioerr.ErrorCode(), 0
+		}
+
+		return kanzi.ERR_CREATE_COMPRESSOR, 0
+	}
+
+	log.Println("\nArchiving "+inputName+" ...", this.verbosity > 1)
+	count := 1
+
+	if fi, err2 := os.Stat(inputName); err2 == nil && fi.IsDir() == true {
+		count, err = aw.AddDirectory(inputName)
+	} else {
+		err = aw.AddFile(inputName, "")
+	}
+
+	if err2 := aw.Close(); err == nil {
+		err = err2
 	}
+
+	if err != nil {
+		fmt.Printf("%v\n", err)
+
+		if ioerr, isIOErr := err.(*kio.IOError); isIOErr == true {
+			return ioerr.ErrorCode(), aw.GetWritten()
+		}
+
+		return kanzi.ERR_PROCESS_BLOCK, aw.GetWritten()
+	}
+
+	delta := time.Now().Sub(before).Nanoseconds() / 1000000 // convert to ms
+	var msg string
+
+	if delta >= 100000 {
+		msg = fmt.Sprintf("%.1f s", float64(delta)/1000)
+	} else {
+		msg = fmt.Sprintf("%.0f ms", float64(delta))
+	}
+
+	msg = fmt.Sprintf("Archiving %v: %v entries => %v bytes in %v", inputName, count, aw.GetWritten(), msg)
+	log.Println(msg, this.verbosity > 0)
+	return 0, aw.GetWritten()
 }
 
-func getTransformAndCodec(level int) string {
-	switch level {
-	case 0:
-		return "NONE&NONE"
+// Return the name of the output file for the input file. Imported files lose
+// their compression extension (EG. foo.txt.gz => foo.txt.knz).
+func (this *BlockCompressor) getOutputName(iName, formattedInName, formattedOutName string, mirrorDir bool) string {
+	oName := formattedOutName
 
-	case 1:
-		return "TEXT+LZ&HUFFMAN"
+	if len(oName) != 0 && mirrorDir == false {
+		return oName
+	}
 
-	case 2:
-		return "TEXT+ROLZ&NONE"
+	if len(oName) != 0 {
+		// Same path relative to the output directory
+		iName = formattedOutName + iName[len(formattedInName):]
+	}
 
-	case 3:
-		return "TEXT+ROLZX&NONE"
+	if this.importMode == true {
+		return kio.ImportOutputName(iName, nil)
+	}
 
-	case 4:
-		return "TEXT+BWT+RANK+ZRLT&ANS0"
+	return iName + ".knz"
+}
 
-	case 5:
-		return "TEXT+BWT+SRT+ZRLT&FPAQ"
+// Load the preset LZ dictionary from a file. Returns an error code if the
+// dictionary cannot be loaded.
+func loadLZDictionary(name string) (*function.LZDictionary, int) {
+	data, err := os.ReadFile(name)
 
-	case 6:
-		return "BWT&CM"
+	if err != nil {
+		fmt.Printf("Cannot read dictionary %v: %v\n", name, err)
+		return nil, kanzi.ERR_OPEN_FILE
+	}
 
-	case 7:
-		return "X86+RLT+TEXT&TPAQ"
+	dict, err := function.NewLZDictionary(data)
 
-	case 8:
-		return "X86+RLT+TEXT&TPAQX"
+	if err != nil {
+		fmt.Printf("Invalid dictionary %v: %v\n", name, err)
+		return nil, kanzi.ERR_INVALID_PARAM
+	}
+
+	return dict, 0
+}
 
-	default:
-		return "Unknown&Unknown"
+func notifyBCListeners(listeners []kanzi.Listener, evt *kanzi.Event) {
+	defer func() {
+		//lint:ignore SA9003 ignore panics in listeners
+		if r := recover(); r != nil {
+			// Ignore panics in listeners
+		}
+	}()
+
+	for _, bl := range listeners {
+		bl.ProcessEvent(evt)
 	}
 }
 
 type fileCompressTask struct {
-	ctx       map[string]interface{}
-	listeners []kanzi.Listener
+	ctx        map[string]interface{}
+	listeners  []kanzi.Listener
+	importMode bool
+	mapInput   bool
 }
 
 func (this *fileCompressTask) call() (int, uint64, uint64) {
@@ -559,6 +808,18 @@ func (this *fileCompressTask) call() (int, uint64, uint64) {
 	log.Println("Input file name set to '"+inputName+"'", printFlag)
 	log.Println("Output file name set to '"+outputName+"'", printFlag)
 	overwrite := this.ctx["overwrite"].(bool)
+	var modTime time.Time
+
+	if this.importMode == true {
+		// Deferred first to run after the output file is closed
+		defer func() {
+			if modTime.IsZero() == false {
+				if err := os.Chtimes(outputName, modTime, modTime); err != nil {
+					log.Println(fmt.Sprintf("Warning: cannot set the modification time of '%v': %v", outputName, err), verbosity > 0)
+				}
+			}
+		}()
+	}
 
 	var output io.WriteCloser
 
@@ -630,10 +891,23 @@ func (this *fileCompressTask) call() (int, uint64, uint64) {
 	}()
 
 	var input io.ReadCloser
+	var mapped *kio.MappedFile
+
+	if this.mapInput == true && this.importMode == false && strings.ToUpper(inputName) != _COMP_STDIN {
+		if mapped, err = kio.OpenMappedFile(inputName); err == nil {
+			defer func() {
+				mapped.Close()
+			}()
+		} else {
+			// Read the file instead
+			log.Println(fmt.Sprintf("Warning: %v", err), verbosity > 1)
+			mapped = nil
+		}
+	}
 
 	if strings.ToUpper(inputName) == _COMP_STDIN {
 		input = os.Stdin
-	} else {
+	} else if mapped == nil {
 		var err error
 
 		if input, err = os.Open(inputName); err != nil {
@@ -646,6 +920,36 @@ func (this *fileCompressTask) call() (int, uint64, uint64) {
 		}()
 	}
 
+	var is io.Reader = input
+
+	if this.importMode == true {
+		ir, err := kio.NewImportReader(input)
+
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+
+			if ioerr, isIOErr := err.(*kio.IOError); isIOErr == true {
+				return ioerr.ErrorCode(), 0, 0
+			}
+
+			return kanzi.ERR_INVALID_FILE, 0, 0
+		}
+
+		log.Println("Importing "+strings.ToLower(ir.Format())+" file "+inputName, printFlag)
+		modTime = ir.ModTime()
+
+		// Keep the modification time of the input file if absent from the stream
+		if fi, err := os.Stat(inputName); modTime.IsZero() == true && err == nil {
+			modTime = fi.ModTime()
+		}
+
+		if strings.ToUpper(outputName) == _COMP_NONE || strings.ToUpper(outputName) == _COMP_STDOUT {
+			modTime = time.Time{}
+		}
+
+		is = ir
+	}
+
 	for _, bl := range this.listeners {
 		cos.AddListener(bl)
 	}
@@ -665,7 +969,24 @@ func (this *fileCompressTask) call() (int, uint64, uint64) {
 	}
 
 	before := time.Now()
-	length, err = input.Read(buffer)
+
+	if mapped != nil {
+		// The blocks are sliced from the mapping
+		if length, err = cos.WriteMapped(mapped); err != nil {
+			if ioerr, isIOErr := err.(*kio.IOError); isIOErr == true {
+				fmt.Printf("%s\n", ioerr.Error())
+				return ioerr.ErrorCode(), uint64(length), cos.GetWritten()
+			}
+
+			fmt.Printf("An unexpected condition happened. Exiting ...\n%v\n", err.Error())
+			return kanzi.ERR_PROCESS_BLOCK, uint64(length), cos.GetWritten()
+		}
+
+		read = uint64(length)
+		length = 0
+	} else {
+		length, err = is.Read(buffer)
+	}
 
 	for length > 0 {
 		if err != nil {
@@ -685,7 +1006,7 @@ func (this *fileCompressTask) call() (int, uint64, uint64) {
 			return kanzi.ERR_PROCESS_BLOCK, read, cos.GetWritten()
 		}
 
-		length, err = input.Read(buffer)
+		length, err = is.Read(buffer)
 	}
 
 	if read == 0 {
@@ -729,6 +1050,11 @@ func (this *fileCompressTask) call() (int, uint64, uint64) {
 	msg = fmt.Sprintf("Encoding %v: %v => %v bytes in %v", inputName, read, cos.GetWritten(), msg)
 	log.Println(msg, verbosity == 1)
 
+	if name, digest, err := cos.Digest(); err == nil {
+		msg = fmt.Sprintf("Output digest (%s): %x", name, digest)
+		log.Println(msg, verbosity > 0)
+	}
+
 	if delta > 0 {
 		msg = fmt.Sprintf("Throughput (KB/s): %d", ((int64(read*1000))>>10)/delta)
 		log.Println(msg, printFlag)
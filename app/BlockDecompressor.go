@@ -26,6 +26,7 @@ import (
 	"time"
 
 	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/function"
 	kio "github.com/flanglet/kanzi-go/io"
 )
 
@@ -45,6 +46,9 @@ type BlockDecompressor struct {
 	inputName  string
 	outputName string
 	jobs       uint
+	verify     bool
+	archive    bool   // extract the files of an archive
+	dictionary string // file of the preset LZ dictionary (empty if none)
 	listeners  []kanzi.Listener
 	cpuProf    string
 }
@@ -90,6 +94,34 @@ func NewBlockDecompressor(argsMap map[string]interface{}) (*BlockDecompressor, e
 		this.jobs = concurrency
 	}
 
+	if verify, prst := argsMap["verify"]; prst == true {
+		this.verify = verify.(bool)
+		delete(argsMap, "verify")
+	}
+
+	if arc, prst := argsMap["archive"]; prst == true {
+		this.archive = arc.(bool)
+		delete(argsMap, "archive")
+	}
+
+	if name, prst := argsMap["dictionary"]; prst == true {
+		this.dictionary = name.(string)
+		delete(argsMap, "dictionary")
+	}
+
+	if test, prst := argsMap["test"]; prst == true {
+		// Integrity check only: the data is decoded and discarded
+		if test.(bool) == true {
+			if len(this.outputName) != 0 && strings.ToUpper(this.outputName) != "NONE" {
+				log.Println("Warning: the 'test' option ignores the output ["+this.outputName+"]", this.verbosity > 0)
+			}
+
+			this.outputName = "NONE"
+		}
+
+		delete(argsMap, "test")
+	}
+
 	if prof, prst := argsMap["cpuProf"]; prst == true {
 		this.cpuProf = prof.(string)
 		delete(argsMap, "cpuProf")
@@ -163,6 +195,22 @@ func fileDecompressWorker(tasks <-chan fileDecompressTask, cancel <-chan bool, r
 func (this *BlockDecompressor) Decompress() (int, uint64) {
 	var err error
 	before := time.Now()
+
+	if len(this.dictionary) != 0 {
+		// Registered: also available to the archive reader
+		dict, code := loadLZDictionary(this.dictionary)
+
+		if code != 0 {
+			return code, 0
+		}
+
+		function.RegisterLZDictionary(dict)
+	}
+
+	if this.archive == true {
+		return this.extractArchive(before)
+	}
+
 	files := make([]FileData, 0, 256)
 	files, err = createFileList(this.inputName, files)
 
@@ -279,6 +327,7 @@ func (this *BlockDecompressor) Decompress() (int, uint64) {
 	ctx := make(map[string]interface{})
 	ctx["verbosity"] = this.verbosity
 	ctx["overwrite"] = this.overwrite
+	ctx["verify"] = this.verify
 
 	if nbFiles == 1 {
 		oName := formattedOutName
@@ -383,6 +432,92 @@ func (this *BlockDecompressor) Decompress() (int, uint64) {
 	return res, read
 }
 
+// Extract the files of the input archive to the output directory (the
+// directory of the input by default). With 'NONE' output, the archive is
+// decoded and checked but nothing is written.
+// Returns exit code, number of bytes read.
+func (this *BlockDecompressor) extractArchive(before time.Time) (int, uint64) {
+	input, err := os.Open(this.inputName)
+
+	if err != nil {
+		fmt.Printf("Cannot open input file '%v': %v\n", this.inputName, err)
+		return kanzi.ERR_OPEN_FILE, 0
+	}
+
+	defer input.Close()
+	ar, err := kio.NewArchiveReader(input, this.jobs)
+
+	if err != nil {
+		fmt.Printf("%v\n", err)
+
+		if ioerr, isIOErr := err.(*kio.IOError); isIOErr == true {
+			return ioerr.ErrorCode(), 0
+		}
+
+		return kanzi.ERR_CREATE_DECOMPRESSOR, 0
+	}
+
+	defer ar.Close()
+	outputName := this.outputName
+
+	if len(outputName) == 0 {
+		outputName = filepath.Dir(this.inputName)
+	}
+
+	log.Println("\nExtracting "+this.inputName+" to "+outputName+" ...", this.verbosity > 1)
+	count := 0
+
+	if strings.ToUpper(outputName) == _DECOMP_NONE {
+		for {
+			var entry *kio.ArchiveEntry
+
+			if entry, err = ar.Next(); err != nil {
+				break
+			}
+
+			log.Println(entry.Name, this.verbosity > 2)
+
+			if _, err = io.Copy(io.Discard, ar); err != nil {
+				break
+			}
+
+			count++
+		}
+
+		if err == io.EOF {
+			err = nil
+		}
+	} else if strings.ToUpper(outputName) == _DECOMP_STDOUT {
+		fmt.Println("Cannot extract an archive to STDOUT")
+		return kanzi.ERR_CREATE_FILE, 0
+	} else {
+		count, err = ar.Extract(outputName)
+	}
+
+	if err != nil {
+		fmt.Printf("%v\n", err)
+
+		if ioerr, isIOErr := err.(*kio.IOError); isIOErr == true {
+			return ioerr.ErrorCode(), ar.GetRead()
+		}
+
+		return kanzi.ERR_PROCESS_BLOCK, ar.GetRead()
+	}
+
+	delta := time.Now().Sub(before).Nanoseconds() / 1000000 // convert to ms
+	var msg string
+
+	if delta >= 100000 {
+		msg = fmt.Sprintf("%.1f s", float64(delta)/1000)
+	} else {
+		msg = fmt.Sprintf("%.0f ms", float64(delta))
+	}
+
+	msg = fmt.Sprintf("Extracting %v: %v bytes => %v entries in %v", this.inputName, ar.GetRead(), count, msg)
+	log.Println(msg, this.verbosity > 0)
+	return 0, ar.GetRead()
+}
+
 func notifyBDListeners(listeners []kanzi.Listener, evt *kanzi.Event) {
 	defer func() {
 		//lint:ignore SA9003 ignore panics in listeners
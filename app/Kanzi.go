@@ -28,6 +28,7 @@ import (
 	"sync"
 
 	kanzi "github.com/flanglet/kanzi-go"
+	kio "github.com/flanglet/kanzi-go/io"
 )
 
 const (
@@ -169,15 +170,26 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 	verbose := 1
 	overwrite := false
 	checksum := false
+	checksumType := ""
+	streamDigest := false
+	parityShards := -1
+	dictionary := ""
+	embedDictionary := false
+	test := false
 	skip := false
+	verify := false
+	imports := false
+	archive := false
+	mapInput := false
 	inputName := ""
 	outputName := ""
 	codec := ""
 	transform := ""
 	tasks := 0
 	cpuProf := ""
+	digest := ""
 	ctx := -1
-	level := -1
+	level := ""
 	mode := " "
 
 	for i, arg := range args {
@@ -218,6 +230,16 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 			continue
 		}
 
+		if arg == "--import" {
+			if mode == "d" {
+				fmt.Println("Both import and decompression options were provided.")
+				return kanzi.ERR_INVALID_PARAM
+			}
+
+			mode = "c"
+			continue
+		}
+
 		if strings.HasPrefix(arg, "--verbose=") || ctx == _ARG_IDX_VERBOSE {
 			var verboseLevel string
 			var err error
@@ -310,22 +332,68 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 				log.Println("   -b, --block=<size>", true)
 				log.Println("        size of blocks, multiple of 16 (default 1 MB, max 1 GB, min 1 KB).\n", true)
 				log.Println("   -l, --level=<compression>", true)
-				log.Println("        set the compression level [0..6]", true)
+				log.Println("        set the compression level [0..8] or the name of a registered level", true)
 				log.Println("        Providing this option forces entropy and transform.", true)
-				log.Println("        0=None&None (store), 1=TEXT+LZ&HUFFMAN, 2=TEXT+ROLZ", true)
-				log.Println("        3=TEXT+ROLZX, 4=TEXT+BWT+RANK+ZRLT&ANS0, 5=TEXT+BWT+SRT+ZRLT&FPAQ", true)
-				log.Println("        6=BWT&CM, 7=X86+RLT+TEXT&TPAQ, 8=X86+RLT+TEXT&TPAQX\n", true)
+
+				for _, l := range kio.GetLevels() {
+					log.Println("        "+l.String(), true)
+				}
+
+				log.Println("", true)
 				log.Println("   -e, --entropy=<codec>", true)
-				log.Println("        entropy codec [None|Huffman|ANS0|ANS1|Range|FPAQ|TPAQ|TPAQX|CM]", true)
+				log.Println("        entropy codec [None|Huffman|AHuffman|ANS0|ANS1|RANS0|RANS1|Range|FPAQ|TPAQ|TPAQX|CM|CMX|RLE|Auto]", true)
 				log.Println("        (default is ANS0)\n", true)
 				log.Println("   -t, --transform=<codec>", true)
-				log.Println("        transform [None|BWT|BWTS|LZ|ROLZ|ROLZX|RLT|ZRLT|MTFT]", true)
-				log.Println("                  [RANK|SRT|TEXT|X86]", true)
-				log.Println("        EG: BWT+RANK or BWTS+MTFT (default is BWT+RANK+ZRLT)\n", true)
-				log.Println("   -x, --checksum", true)
-				log.Println("        enable block checksum\n", true)
+				log.Println("        transform [None|BWT|BWTS|AUTOBWT|LZ|ROLZ|ROLZX|RLT|ZRLT|MTFT]", true)
+				log.Println("                  [RANK|SRT|TEXT|X86|EXE|PATH|FP|LOG|SOA|UTF16|B64|STRUCT|IMG|COLOR|META|PLANE]", true)
+				log.Println("        EG: BWT+RANK or BWTS+MTFT (default is BWT+RANK+ZRLT)", true)
+				log.Println("        META selects the pre-transforms for each block (EG. META+BWT+RANK+ZRLT)\n", true)
+				log.Println("   -x, --checksum[=<algorithm>]", true)
+				log.Println("        enable block checksum [XXHASH32|XXHASH64|SHA256]", true)
+				log.Println("        (default is XXHASH32)\n", true)
+				log.Println("   --stream-digest", true)
+				log.Println("        store the SHA-256 of the input in the compressed stream", true)
+				log.Println("        (checked when decompressing).\n", true)
+				log.Println("   --parity=<shards>", true)
+				log.Println("        add parity shards to each block [0|2|4|8] to repair", true)
+				log.Println("        damaged blocks when decompressing (default is 0).\n", true)
+				log.Println("   --dictionary=<file>", true)
+				log.Println("        preset dictionary of the LZ transform (content expected in the", true)
+				log.Println("        input, EG. common fields of small JSON files). The stream references", true)
+				log.Println("        it: the same file must be provided when decompressing.\n", true)
+				log.Println("   --embed-dictionary", true)
+				log.Println("        store the preset dictionary in the compressed stream.\n", true)
 				log.Println("   -s, --skip", true)
 				log.Println("        copy blocks with high entropy instead of compressing them.\n", true)
+				log.Println("   --digest=<algorithm>", true)
+				log.Println("        print the digest of the compressed output", true)
+				log.Println("        [CRC32|MD5|SHA1|SHA256|SHA512]\n", true)
+				log.Println("   --import", true)
+				log.Println("        compress the content of gzip or bzip2 files (implies --compress).", true)
+				log.Println("        The output file is named after the input file without the", true)
+				log.Println("        compression extension and keeps its modification time.\n", true)
+				log.Println("   --archive", true)
+				log.Println("        compress the input file or directory (with all its files and", true)
+				log.Println("        sub-directories) to a single archive keeping the names, modes", true)
+				log.Println("        and modification times of the files (default output is <input>.knz).\n", true)
+				log.Println("   --mmap", true)
+				log.Println("        map the input files in memory instead of reading them (if supported", true)
+				log.Println("        by the platform). Saves a copy of each block with huge files.\n", true)
+			} else {
+				log.Println("   --test", true)
+				log.Println("        check the integrity of the compressed data (block checksums", true)
+				log.Println("        and digest of the original data) without writing the output.\n", true)
+				log.Println("   --verify", true)
+				log.Println("        cross-check each block with the portable reference decoder", true)
+				log.Println("        (slower, validates the portability of the compressed data).", true)
+				log.Println("        Only the BWT, BWTS, AUTOBWT, LZ, RLT, ZRLT, MTFT and RANK stages", true)
+				log.Println("        are cross-checked (streams without any of them are rejected).\n", true)
+				log.Println("   --archive", true)
+				log.Println("        extract the files of an archive to the output directory", true)
+				log.Println("        (default is the directory of the input). Existing files are", true)
+				log.Println("        not overwritten. With 'NONE' output, the archive is only checked.\n", true)
+				log.Println("   --dictionary=<file>", true)
+				log.Println("        preset dictionary referenced by the compressed streams.\n", true)
 			}
 
 			log.Println("   -j, --jobs=<jobs>", true)
@@ -338,11 +406,15 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 				log.Println("EG. Kanzi -c -i foo.txt -f -t BWT+MTFT+ZRLT -b 4m -e FPAQ -v 3 -j 4\n", true)
 				log.Println("EG. Kanzi --compress --input=foo.txt --output=foo.knz --block=4m --force", true)
 				log.Println("          --transform=BWT+MTFT+ZRLT --entropy=FPAQ --verbose=3 --jobs=4\n", true)
+				log.Println("EG. Kanzi --import -i foo.txt.gz -l 2 (creates foo.txt.knz)\n", true)
+				log.Println("EG. Kanzi -c --archive -i foo -l 3 (creates foo.knz from directory foo)\n", true)
 			}
 
 			if mode != "c" {
 				log.Println("EG. Kanzi -d -i foo.knz -f -v 2 -j 2\n", true)
 				log.Println("EG. Kanzi --decompress --input=foo.knz --force --verbose=2 --jobs=2\n", true)
+				log.Println("EG. Kanzi -d --test -i foo.knz\n", true)
+				log.Println("EG. Kanzi -d --archive -i foo.knz -o bar (extracts foo.knz to directory bar)\n", true)
 			}
 
 			return 0
@@ -357,6 +429,36 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 			continue
 		}
 
+		if arg == "--import" {
+			if ctx != -1 {
+				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
+			}
+
+			imports = true
+			ctx = -1
+			continue
+		}
+
+		if arg == "--archive" {
+			if ctx != -1 {
+				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
+			}
+
+			archive = true
+			ctx = -1
+			continue
+		}
+
+		if arg == "--mmap" {
+			if ctx != -1 {
+				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
+			}
+
+			mapInput = true
+			ctx = -1
+			continue
+		}
+
 		if arg == "--force" || arg == "-f" {
 			if ctx != -1 {
 				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
@@ -377,6 +479,16 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 			continue
 		}
 
+		if arg == "--verify" {
+			if ctx != -1 {
+				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
+			}
+
+			verify = true
+			ctx = -1
+			continue
+		}
+
 		if arg == "--checksum" || arg == "-x" {
 			if ctx != -1 {
 				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
@@ -387,6 +499,57 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 			continue
 		}
 
+		if strings.HasPrefix(arg, "--checksum=") && ctx == -1 {
+			name := strings.ToUpper(strings.TrimPrefix(arg, "--checksum="))
+
+			if checksumType != "" {
+				fmt.Printf("Warning: ignoring duplicate checksum: %v\n", name)
+			} else {
+				checksumType = name
+			}
+
+			checksum = true
+			continue
+		}
+
+		if strings.HasPrefix(arg, "--parity=") && ctx == -1 {
+			strParity := strings.TrimPrefix(arg, "--parity=")
+
+			if parityShards != -1 {
+				fmt.Printf("Warning: ignoring duplicate parity: %v\n", strParity)
+				continue
+			}
+
+			var err error
+
+			if parityShards, err = strconv.Atoi(strParity); err != nil || parityShards < 0 {
+				fmt.Printf("Invalid number of parity shards provided on command line: %v\n", strParity)
+				return kanzi.ERR_INVALID_PARAM
+			}
+
+			continue
+		}
+
+		if arg == "--stream-digest" {
+			if ctx != -1 {
+				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
+			}
+
+			streamDigest = true
+			ctx = -1
+			continue
+		}
+
+		if arg == "--test" {
+			if ctx != -1 {
+				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
+			}
+
+			test = true
+			ctx = -1
+			continue
+		}
+
 		if ctx == -1 {
 			idx := -1
 
@@ -489,7 +652,6 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 
 		if strings.HasPrefix(arg, "--level=") || ctx == _ARG_IDX_LEVEL {
 			var str string
-			var err error
 
 			if strings.HasPrefix(arg, "--level=") {
 				str = strings.TrimPrefix(arg, "--level=")
@@ -499,22 +661,18 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 
 			str = strings.TrimSpace(str)
 
-			if level != -1 {
+			if len(level) != 0 {
 				fmt.Printf("Warning: ignoring duplicate level: %v\n", str)
 				ctx = -1
 				continue
 			}
 
-			if level, err = strconv.Atoi(str); err != nil {
-				fmt.Printf("Invalid compression level provided on command line: %v\n", arg)
-				return kanzi.ERR_INVALID_PARAM
-			}
-
-			if level < 0 || level > 8 {
+			if _, exists := kio.GetLevel(str); exists == false {
 				fmt.Printf("Invalid compression level provided on command line: %v\n", arg)
 				return kanzi.ERR_INVALID_PARAM
 			}
 
+			level = str
 			ctx = -1
 			continue
 		}
@@ -538,6 +696,40 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 			continue
 		}
 
+		if strings.HasPrefix(arg, "--dictionary=") && ctx == -1 {
+			name := strings.TrimPrefix(arg, "--dictionary=")
+
+			if dictionary != "" {
+				fmt.Printf("Warning: ignoring duplicate dictionary: %v\n", name)
+			} else {
+				dictionary = name
+			}
+
+			continue
+		}
+
+		if arg == "--embed-dictionary" {
+			if ctx != -1 {
+				log.Println("Warning: ignoring option ["+_CMD_LINE_ARGS[ctx]+"] with no value.", verbose > 0)
+			}
+
+			embedDictionary = true
+			ctx = -1
+			continue
+		}
+
+		if strings.HasPrefix(arg, "--digest=") && ctx == -1 {
+			name := strings.ToUpper(strings.TrimPrefix(arg, "--digest="))
+
+			if digest != "" {
+				fmt.Printf("Warning: ignoring duplicate digest: %v\n", name)
+			} else {
+				digest = name
+			}
+
+			continue
+		}
+
 		if strings.HasPrefix(arg, "--block=") || ctx == _ARG_IDX_BLOCK {
 			var strBlockSize string
 
@@ -628,7 +820,7 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 		log.Println("Warning: ignoring option with missing value ["+_CMD_LINE_ARGS[ctx]+"]", verbose > 0)
 	}
 
-	if level >= 0 {
+	if len(level) != 0 {
 		if len(codec) != 0 {
 			log.Println("Warning: providing the 'level' option forces the entropy codec. Ignoring ["+codec+"]", verbose > 0)
 		}
@@ -652,7 +844,7 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 	argsMap["inputName"] = inputName
 	argsMap["outputName"] = outputName
 
-	if mode == "c" || level != -1 {
+	if mode == "c" || len(level) != 0 {
 		argsMap["level"] = level
 	}
 
@@ -668,10 +860,54 @@ func processCommandLine(args []string, argsMap map[string]interface{}) int {
 		argsMap["checksum"] = checksum
 	}
 
+	if len(checksumType) > 0 && mode == "c" {
+		argsMap["checksumType"] = checksumType
+	}
+
+	if streamDigest == true && mode == "c" {
+		argsMap["streamDigest"] = streamDigest
+	}
+
+	if parityShards > 0 && mode == "c" {
+		argsMap["parityShards"] = uint(parityShards)
+	}
+
+	if test == true && mode == "d" {
+		argsMap["test"] = test
+	}
+
 	if skip == true {
 		argsMap["skipBlocks"] = skip
 	}
 
+	if len(digest) > 0 && mode == "c" {
+		argsMap["outputDigest"] = digest
+	}
+
+	if len(dictionary) > 0 {
+		argsMap["dictionary"] = dictionary
+	}
+
+	if embedDictionary == true && mode == "c" {
+		argsMap["embedDictionary"] = embedDictionary
+	}
+
+	if verify == true && mode == "d" {
+		argsMap["verify"] = verify
+	}
+
+	if imports == true {
+		argsMap["import"] = imports
+	}
+
+	if archive == true {
+		argsMap["archive"] = archive
+	}
+
+	if mapInput == true && mode == "c" {
+		argsMap["mapInput"] = mapInput
+	}
+
 	argsMap["jobs"] = uint(tasks)
 
 	if len(cpuProf) > 0 {
@@ -0,0 +1,101 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package benchmark
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	kio "github.com/flanglet/kanzi-go/io"
+	"github.com/flanglet/kanzi-go/util/corpus"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Compress and decompress each kind of dataset of the corpus with the
+// default compression levels
+func BenchmarkCorpus(b *testing.B) {
+	const size = 1 << 20
+
+	for _, kind := range corpus.Kinds() {
+		input, _ := corpus.Generate(kind, size, 1)
+
+		for _, level := range []string{"2", "5"} {
+			lvl, _ := kio.GetLevel(level)
+
+			b.Run(kind+"/level"+level, func(b *testing.B) {
+				var buf bytes.Buffer
+				b.SetBytes(size)
+
+				for ii := 0; ii < b.N; ii++ {
+					buf.Reset()
+					cos, err := kio.NewCompressedOutputStream(nopWriteCloser{&buf}, lvl.Codec(), lvl.Transform(), size, 1, false)
+
+					if err != nil {
+						b.Fatalf("Cannot create compressed stream: %v", err)
+					}
+
+					if _, err = cos.Write(input); err != nil {
+						b.Fatalf("Encoding error: %v", err)
+					}
+
+					if err = cos.Close(); err != nil {
+						b.Fatalf("Encoding error: %v", err)
+					}
+
+					cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 1)
+
+					if err != nil {
+						b.Fatalf("Cannot create decompressed stream: %v", err)
+					}
+
+					// The stream returns 0 bytes at the end (no io.EOF)
+					output := make([]byte, size+1)
+					read := 0
+
+					for read < len(output) {
+						n, err := cis.Read(output[read:])
+
+						if err != nil {
+							b.Fatalf("Decoding error: %v", err)
+						}
+
+						if n == 0 {
+							break
+						}
+
+						read += n
+					}
+
+					if bytes.Equal(input, output[0:read]) == false {
+						b.Fatalf("Decoding error: the decompressed data differs from the input")
+					}
+
+					cis.Close()
+				}
+
+				b.ReportMetric(float64(buf.Len())/size, "ratio")
+			})
+		}
+	}
+}
@@ -142,16 +142,7 @@ func (this *DefaultInputBitStream) ReadArray(bits []byte, count uint) uint {
 		}
 	} else {
 		// Not byte aligned
-		r := 64 - this.availBits
-
-		for remaining >= 64 {
-			v := this.current & ((uint64(1) << this.availBits) - 1)
-			this.pullCurrent()
-			this.availBits -= r
-			binary.BigEndian.PutUint64(bits[start:start+8], (v<<uint(r))|(this.current>>uint(this.availBits)))
-			start += 8
-			remaining -= 64
-		}
+		start, remaining = readUnaligned(this, bits, start, remaining)
 	}
 
 	// Last bytes
@@ -168,6 +159,34 @@ func (this *DefaultInputBitStream) ReadArray(bits []byte, count uint) uint {
 	return count
 }
 
+// Kernel for a cursor not byte aligned: read 64 bits at a time and store
+// them with one (unaligned) 64 bit write
+func (this *DefaultInputBitStream) readWords(bits []byte, start, remaining int) (int, int) {
+	r := 64 - this.availBits
+
+	for remaining >= 64 {
+		v := this.current & ((uint64(1) << this.availBits) - 1)
+		this.pullCurrent()
+		this.availBits -= r
+		binary.BigEndian.PutUint64(bits[start:start+8], (v<<uint(r))|(this.current>>uint(this.availBits)))
+		start += 8
+		remaining -= 64
+	}
+
+	return start, remaining
+}
+
+// Portable kernel for a cursor not byte aligned: read one byte at a time
+func (this *DefaultInputBitStream) readBytes(bits []byte, start, remaining int) (int, int) {
+	for remaining >= 8 {
+		bits[start] = byte(this.ReadBits(8))
+		start++
+		remaining -= 8
+	}
+
+	return start, remaining
+}
+
 func (this *DefaultInputBitStream) readFromInputStream(count int) (int, error) {
 	if this.Closed() {
 		return 0, errors.New("Stream closed")
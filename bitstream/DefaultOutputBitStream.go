@@ -212,17 +212,7 @@ func (this *DefaultOutputBitStream) WriteArray(bits []byte, count uint) uint {
 		}
 	} else {
 		// Not byte aligned
-		r := 64 - this.availBits
-
-		for remaining >= 64 {
-			value := binary.BigEndian.Uint64(bits[start : start+8])
-			this.current |= (value >> r)
-			this.pushCurrent()
-			this.current = (value << (64 - r))
-			this.availBits -= r
-			start += 8
-			remaining -= 64
-		}
+		start, remaining = writeUnaligned(this, bits, start, remaining)
 	}
 
 	// Last bytes
@@ -239,6 +229,35 @@ func (this *DefaultOutputBitStream) WriteArray(bits []byte, count uint) uint {
 	return count
 }
 
+// Kernel for a cursor not byte aligned: load 64 bits at a time with one
+// (unaligned) 64 bit read
+func (this *DefaultOutputBitStream) writeWords(bits []byte, start, remaining int) (int, int) {
+	r := 64 - this.availBits
+
+	for remaining >= 64 {
+		value := binary.BigEndian.Uint64(bits[start : start+8])
+		this.current |= (value >> r)
+		this.pushCurrent()
+		this.current = (value << (64 - r))
+		this.availBits -= r
+		start += 8
+		remaining -= 64
+	}
+
+	return start, remaining
+}
+
+// Portable kernel for a cursor not byte aligned: write one byte at a time
+func (this *DefaultOutputBitStream) writeBytes(bits []byte, start, remaining int) (int, int) {
+	for remaining >= 8 {
+		this.WriteBits(uint64(bits[start]), 8)
+		start++
+		remaining -= 8
+	}
+
+	return start, remaining
+}
+
 // Push 64 bits of current value into buffer.
 func (this *DefaultOutputBitStream) pushCurrent() {
 	binary.BigEndian.PutUint64(this.buffer[this.position:this.position+8], this.current)
@@ -271,6 +290,32 @@ func (this *DefaultOutputBitStream) flush() error {
 	return nil
 }
 
+// Flush writes the buffered bits to the underlying stream. The number of
+// bits written so far must be a multiple of 8 (no partial byte).
+func (this *DefaultOutputBitStream) Flush() error {
+	if this.Closed() {
+		return errors.New("Stream closed")
+	}
+
+	if this.availBits&7 != 0 {
+		return errors.New("Cannot flush the bitstream: the last byte is incomplete")
+	}
+
+	// The buffer size is a multiple of 8 and the buffer is flushed when full
+	size := int(64-this.availBits) >> 3
+	binary.BigEndian.PutUint64(this.buffer[this.position:this.position+8], this.current)
+	this.position += size
+
+	if err := this.flush(); err != nil {
+		this.position -= size
+		return err
+	}
+
+	this.availBits = 64
+	this.current = 0
+	return nil
+}
+
 // Close prevents further writes
 func (this *DefaultOutputBitStream) Close() (bool, error) {
 	if this.Closed() {
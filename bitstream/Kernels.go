@@ -0,0 +1,41 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bitstream
+
+import (
+	"github.com/flanglet/kanzi-go/internal/cpuinfo"
+)
+
+// Kernels copying arrays when the cursor is not byte aligned, selected at
+// startup based on the CPU features
+var (
+	readUnaligned  func(this *DefaultInputBitStream, bits []byte, start, remaining int) (int, int)
+	writeUnaligned func(this *DefaultOutputBitStream, bits []byte, start, remaining int) (int, int)
+)
+
+func init() {
+	cpuinfo.Register(selectKernels)
+}
+
+func selectKernels(f cpuinfo.Features) {
+	if f.UnalignedLoads == true {
+		readUnaligned = (*DefaultInputBitStream).readWords
+		writeUnaligned = (*DefaultOutputBitStream).writeWords
+	} else {
+		readUnaligned = (*DefaultInputBitStream).readBytes
+		writeUnaligned = (*DefaultOutputBitStream).writeBytes
+	}
+}
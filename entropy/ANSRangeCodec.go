@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
 )
 
 // Implementation of an Asymmetric Numeral System codec.
@@ -36,14 +37,15 @@ const (
 
 // ANSRangeEncoder Asymmetric Numeral System Encoder
 type ANSRangeEncoder struct {
-	bitstream kanzi.OutputBitStream
-	alphabet  []int
-	freqs     []int
-	symbols   []encSymbol
-	buffer    []byte
-	chunkSize int
-	order     uint
-	logRange  uint
+	bitstream   kanzi.OutputBitStream
+	alphabet    []int
+	freqs       []int
+	symbols     []encSymbol
+	buffer      []byte
+	chunkSize   int
+	order       uint
+	logRange    uint
+	interleaved bool // 4 interleaved states (see NewRANSEncoder)
 }
 
 // NewANSRangeEncoder creates an instance of ANS encoder.
@@ -110,6 +112,17 @@ func NewANSRangeEncoder(bs kanzi.OutputBitStream, args ...uint) (*ANSRangeEncode
 	return this, nil
 }
 
+// Reset prepares the encoder to write a new block to the provided bitstream.
+// The frequency and symbol tables are kept (they are rebuilt for each chunk).
+func (this *ANSRangeEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("ANS codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
 // Compute cumulated frequencies and encode header
 func (this *ANSRangeEncoder) updateFrequencies(frequencies []int, lr uint) (int, error) {
 	res := 0
@@ -231,7 +244,8 @@ func (this *ANSRangeEncoder) Write(block []byte) (int, error) {
 
 	// Add some padding
 	if len(this.buffer) < sizeChunk+(sizeChunk>>3) {
-		this.buffer = make([]byte, sizeChunk+(sizeChunk>>3))
+		alloc.PutBytes(this.buffer)
+		this.buffer = alloc.Bytes(sizeChunk + (sizeChunk >> 3))
 	}
 
 	end := len(block)
@@ -256,7 +270,12 @@ func (this *ANSRangeEncoder) Write(block []byte) (int, error) {
 			return end, err
 		}
 
-		this.encodeChunk(block[startChunk:endChunk])
+		if this.interleaved == true {
+			this.encodeChunk4(block[startChunk:endChunk])
+		} else {
+			this.encodeChunk(block[startChunk:endChunk])
+		}
+
 		startChunk = endChunk
 	}
 
@@ -342,12 +361,19 @@ func (this *ANSRangeEncoder) encodeChunk(block []byte) {
 
 // Compute chunk frequencies, cumulated frequencies and encode chunk header
 func (this *ANSRangeEncoder) rebuildStatistics(block []byte, lr uint) (int, error) {
-	kanzi.ComputeHistogram(block, this.freqs, this.order == 0, true)
+	if this.interleaved == true && this.order == 1 {
+		computeHistogram4(block, this.freqs)
+	} else {
+		kanzi.ComputeHistogram(block, this.freqs, this.order == 0, true)
+	}
+
 	return this.updateFrequencies(this.freqs, lr)
 }
 
-// Dispose this implementation does nothing
+// Dispose this implementation releases the chunk buffer
 func (this *ANSRangeEncoder) Dispose() {
+	alloc.PutBytes(this.buffer)
+	this.buffer = nil
 }
 
 // BitStream returns the underlying bitstream
@@ -392,15 +418,16 @@ func (this *encSymbol) reset(cumFreq, freq int, logRange uint) {
 
 // ANSRangeDecoder Asymmetric Numeral System Decoder
 type ANSRangeDecoder struct {
-	bitstream kanzi.InputBitStream
-	freqs     []int
-	symbols   []decSymbol
-	f2s       []byte // mapping frequency -> symbol
-	alphabet  []int
-	buffer    []byte
-	chunkSize int
-	logRange  uint
-	order     uint
+	bitstream   kanzi.InputBitStream
+	freqs       []int
+	symbols     []decSymbol
+	f2s         []byte // mapping frequency -> symbol
+	alphabet    []int
+	buffer      []byte
+	chunkSize   int
+	logRange    uint
+	order       uint
+	interleaved bool // 4 interleaved states (see NewRANSDecoder)
 }
 
 // NewANSRangeDecoder creates an instance of ANS decoder.
@@ -457,6 +484,17 @@ func NewANSRangeDecoder(bs kanzi.InputBitStream, args ...uint) (*ANSRangeDecoder
 	return this, nil
 }
 
+// Reset prepares the decoder to read a new block from the provided bitstream.
+// The frequency and symbol tables are kept (they are rebuilt for each chunk).
+func (this *ANSRangeDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("ANS codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
 // Decodes alphabet and frequencies from the bitstream
 func (this *ANSRangeDecoder) decodeHeader(frequencies []int) (int, error) {
 	this.logRange = uint(8 + this.bitstream.ReadBits(3))
@@ -512,7 +550,7 @@ func (this *ANSRangeDecoder) decodeHeader(frequencies []int) (int, error) {
 			logMax := uint(1 + this.bitstream.ReadBits(llr))
 
 			if 1<<logMax > scale {
-				err := fmt.Errorf("Invalid bitstream: incorrect frequency size %v in ANS range decoder", logMax)
+				err := kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect frequency size %v in ANS range decoder", logMax))
 				return alphabetSize, err
 			}
 
@@ -527,7 +565,7 @@ func (this *ANSRangeDecoder) decodeHeader(frequencies []int) (int, error) {
 				freq := int(this.bitstream.ReadBits(logMax))
 
 				if freq <= 0 || freq >= scale {
-					err := fmt.Errorf("Invalid bitstream: incorrect frequency %v for symbol '%v' in ANS range decoder", freq, alphabet[j])
+					err := kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect frequency %v for symbol '%v' in ANS range decoder", freq, alphabet[j]))
 					return alphabetSize, err
 				}
 
@@ -538,7 +576,7 @@ func (this *ANSRangeDecoder) decodeHeader(frequencies []int) (int, error) {
 
 		// Infer first frequency
 		if scale <= sum {
-			err := fmt.Errorf("Invalid bitstream: incorrect frequency %v for symbol '%v' in ANS range decoder", frequencies[alphabet[0]], this.alphabet[0])
+			err := kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect frequency %v for symbol '%v' in ANS range decoder", frequencies[alphabet[0]], this.alphabet[0]))
 			return alphabetSize, err
 		}
 
@@ -597,16 +635,22 @@ func (this *ANSRangeDecoder) Read(block []byte) (int, error) {
 
 	// Add some padding
 	if len(this.buffer) < sizeChunk+(sizeChunk>>3) {
-		this.buffer = make([]byte, sizeChunk+(sizeChunk>>3))
+		alloc.PutBytes(this.buffer)
+		this.buffer = alloc.Bytes(sizeChunk + (sizeChunk >> 3))
 	}
 
 	for startChunk < end {
 		alphabetSize, err := this.decodeHeader(this.freqs)
 
-		if err != nil || alphabetSize == 0 {
+		if err != nil {
 			return startChunk, err
 		}
 
+		if alphabetSize == 0 {
+			// Symbols are still expected for this block
+			return startChunk, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: empty alphabet in ANS range decoder, %d symbols missing", end-startChunk))
+		}
+
 		endChunk := startChunk + sizeChunk
 
 		if endChunk >= end {
@@ -614,16 +658,35 @@ func (this *ANSRangeDecoder) Read(block []byte) (int, error) {
 			sizeChunk = end - startChunk
 		}
 
-		this.decodeChunk(block[startChunk:endChunk])
+		if this.interleaved == true {
+			err = this.decodeChunk4(block[startChunk:endChunk])
+		} else {
+			err = this.decodeChunk(block[startChunk:endChunk])
+		}
+
+		if err != nil {
+			return startChunk, err
+		}
+
 		startChunk = endChunk
 	}
 
 	return len(block), nil
 }
 
-func (this *ANSRangeDecoder) decodeChunk(block []byte) {
+func (this *ANSRangeDecoder) decodeChunk(block []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: corrupted data in ANS range decoder (%v)", r))
+		}
+	}()
+
 	// Read chunk size
-	sz := ReadVarInt(this.bitstream) & (_ANS_MAX_CHUNK_SIZE - 1)
+	sz := int(ReadVarInt(this.bitstream) & (_ANS_MAX_CHUNK_SIZE - 1))
+
+	if sz > len(this.buffer) {
+		return kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect chunk size %d in ANS range decoder", sz))
+	}
 
 	// Read initial ANS state
 	st := int(this.bitstream.ReadBits(32))
@@ -633,6 +696,11 @@ func (this *ANSRangeDecoder) decodeChunk(block []byte) {
 		this.bitstream.ReadArray(this.buffer[0:sz], uint(8*sz))
 	}
 
+	// Clear padding to avoid reading stale data on corrupted input
+	for i := sz; i < len(this.buffer) && i < sz+16; i++ {
+		this.buffer[i] = 0
+	}
+
 	n := 0
 	lr := this.logRange
 	mask := (1 << lr) - 1
@@ -666,6 +734,10 @@ func (this *ANSRangeDecoder) decodeChunk(block []byte) {
 			block[i] = cur
 			sym := symb[(prv<<8)|int(cur)]
 
+			if sym.freq == 0 {
+				return kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: unexpected symbol %d in context %d in ANS range decoder", cur, prv))
+			}
+
 			// Compute next ANS state
 			// D(x) = (s, q_s (x/M) + mod(x,M) - b_s) where s is such b_s <= x mod M < b_{s+1}
 			st = sym.freq*(st>>lr) + (st & mask) - sym.cumFreq
@@ -680,6 +752,13 @@ func (this *ANSRangeDecoder) decodeChunk(block []byte) {
 			prv = int(cur)
 		}
 	}
+
+	// Cross check the number of bytes consumed with the chunk size
+	if n > sz {
+		return kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: read %d bytes, chunk size is %d in ANS range decoder", n, sz))
+	}
+
+	return nil
 }
 
 // BitStream returns the underlying bitstream
@@ -687,8 +766,10 @@ func (this *ANSRangeDecoder) BitStream() kanzi.InputBitStream {
 	return this.bitstream
 }
 
-// Dispose this implementation does nothing
+// Dispose this implementation releases the chunk buffer
 func (this *ANSRangeDecoder) Dispose() {
+	alloc.PutBytes(this.buffer)
+	this.buffer = nil
 }
 
 type decSymbol struct {
@@ -0,0 +1,99 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// APMPredictor binary predictor refining the probabilities of another
+// predictor with an adaptive probability map. The context of the map is the
+// bits of the current byte (order 0) or the bits of the current byte and the
+// previous byte (order 1). The output is the average of the input (1/4) and
+// of the refined probability (3/4).
+type APMPredictor struct {
+	predictor kanzi.Predictor
+	apm       *LogisticAdaptiveProbMap
+	order     uint
+	c0        int // bits of the current byte (with a leading 1)
+	c1        int // previous byte
+	pr        int
+}
+
+// NewAPMPredictor creates an APMPredictor on top of the provided predictor
+// with an order 0 (256 contexts) or order 1 (65536 contexts) map
+func NewAPMPredictor(predictor kanzi.Predictor, order uint) (*APMPredictor, error) {
+	if predictor == nil {
+		return nil, errors.New("APM predictor: Invalid null predictor parameter")
+	}
+
+	if order > 1 {
+		return nil, errors.New("APM predictor: The order must be 0 or 1")
+	}
+
+	var err error
+	this := &APMPredictor{}
+	this.predictor = predictor
+	this.order = order
+
+	if this.apm, err = NewLogisticAdaptiveProbMap(256<<(8*order), 7); err != nil {
+		return nil, err
+	}
+
+	this.Reset()
+	return this, nil
+}
+
+// Reset restores the initial state of the map and of the underlying
+// predictor (if it can be reset)
+func (this *APMPredictor) Reset() {
+	if rp, ok := this.predictor.(resettablePredictor); ok == true {
+		rp.Reset()
+	}
+
+	this.apm.Reset()
+	this.c0 = 1
+	this.c1 = 0
+	this.pr = this.predictor.Get()
+}
+
+// Update updates the underlying predictor and the map with the observed bit
+func (this *APMPredictor) Update(bit byte) {
+	this.predictor.Update(bit)
+	this.c0 = (this.c0 << 1) | int(bit)
+
+	if this.c0 > 255 {
+		this.c1 = this.c0 & 0xFF
+		this.c0 = 1
+	}
+
+	ctx := this.c0
+
+	if this.order == 1 {
+		ctx |= this.c1 << 8
+	}
+
+	p := this.predictor.Get()
+	this.pr = (p + 3*this.apm.Get(int(bit), p, ctx)) >> 2
+}
+
+// Get returns the value representing the probability of the next bit being 1
+// in the [0..4095] range.
+func (this *APMPredictor) Get() int {
+	return this.pr
+}
@@ -0,0 +1,419 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Rice-Golomb and Exp-Golomb codecs selecting the parameter of the code for
+// each block (Write call) from the histogram of the block: the parameter
+// minimizing the size of the coded block is written (4 bits) before the
+// codes. Suited to residuals (EG. output of the image and plane transforms)
+// whose magnitude varies from block to block.
+
+const (
+	_GOLOMB_PARAM_BITS  = 4
+	_RICE_MAX_LOG_BASE  = 8 // larger values never help for bytes
+	_EXPG_MAX_ORDER     = 8
+	_EXPG_MAX_CODE_BITS = 2*9 + 1
+)
+
+// Return the histogram of the magnitudes of the values (the sign is coded
+// separately if signed)
+func golombHistogram(block []byte, signed bool, freqs *[256]int) {
+	for _, val := range block {
+		if signed == true && val&0x80 != 0 {
+			val = ^val + 1
+		}
+
+		freqs[val]++
+	}
+}
+
+// RiceGolombParameter returns the Rice-Golomb log base (in [1..8]) coding
+// the block with the fewest bits
+func RiceGolombParameter(block []byte, signed bool) uint {
+	var freqs [256]int
+	golombHistogram(block, signed, &freqs)
+	best := uint(1)
+	bestCost := -1
+
+	for k := uint(1); k <= _RICE_MAX_LOG_BASE; k++ {
+		cost := 0
+
+		for m, f := range &freqs {
+			if f == 0 {
+				continue
+			}
+
+			n := (m >> k) + int(k) + 1
+
+			if signed == true && m != 0 {
+				n++
+			}
+
+			cost += f * n
+		}
+
+		if bestCost < 0 || cost < bestCost {
+			best = k
+			bestCost = cost
+		}
+	}
+
+	return best
+}
+
+// Number of bits of the Exp-Golomb code of order k of m (sign excluded)
+func expGolombCodeBits(m int, k uint) int {
+	n := bits.Len(uint(m) + (1 << k))
+	return 2*n - 1 - int(k)
+}
+
+// ExpGolombOrder returns the order (in [0..8]) of the Exp-Golomb code
+// coding the block with the fewest bits
+func ExpGolombOrder(block []byte, signed bool) uint {
+	var freqs [256]int
+	golombHistogram(block, signed, &freqs)
+	best := uint(0)
+	bestCost := -1
+
+	for k := uint(0); k <= _EXPG_MAX_ORDER; k++ {
+		cost := 0
+
+		for m, f := range &freqs {
+			if f == 0 {
+				continue
+			}
+
+			n := expGolombCodeBits(m, k)
+
+			if signed == true && m != 0 {
+				n++
+			}
+
+			cost += f * n
+		}
+
+		if bestCost < 0 || cost < bestCost {
+			best = k
+			bestCost = cost
+		}
+	}
+
+	return best
+}
+
+// AdaptiveRiceGolombEncoder Rice-Golomb encoder selecting the log base of
+// each block
+type AdaptiveRiceGolombEncoder struct {
+	signed    bool
+	bitstream kanzi.OutputBitStream
+}
+
+// NewAdaptiveRiceGolombEncoder creates a new instance of
+// AdaptiveRiceGolombEncoder. If sgn is true, values are encoded as signed
+// (int8) in the bitstream (see NewRiceGolombEncoder).
+func NewAdaptiveRiceGolombEncoder(bs kanzi.OutputBitStream, sgn bool) (*AdaptiveRiceGolombEncoder, error) {
+	if bs == nil {
+		return nil, errors.New("Adaptive RiceGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this := new(AdaptiveRiceGolombEncoder)
+	this.signed = sgn
+	this.bitstream = bs
+	return this, nil
+}
+
+// Reset prepares the encoder to write a new block to the provided bitstream
+func (this *AdaptiveRiceGolombEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("Adaptive RiceGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Write encodes the data provided into the bitstream. Return the number of
+// bytes written to the bitstream
+func (this *AdaptiveRiceGolombEncoder) Write(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("Adaptive RiceGolomb codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	logBase := RiceGolombParameter(block, this.signed)
+	this.bitstream.WriteBits(uint64(logBase), _GOLOMB_PARAM_BITS)
+	ee := RiceGolombEncoder{signed: this.signed, logBase: logBase, base: uint64(1) << logBase,
+		bitstream: this.bitstream}
+	return ee.Write(block)
+}
+
+// Dispose this implementation does nothing
+func (this *AdaptiveRiceGolombEncoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *AdaptiveRiceGolombEncoder) BitStream() kanzi.OutputBitStream {
+	return this.bitstream
+}
+
+// AdaptiveRiceGolombDecoder decoder of the blocks coded by
+// AdaptiveRiceGolombEncoder
+type AdaptiveRiceGolombDecoder struct {
+	signed    bool
+	bitstream kanzi.InputBitStream
+}
+
+// NewAdaptiveRiceGolombDecoder creates a new instance of
+// AdaptiveRiceGolombDecoder. If sgn is true, values from the bitstream are
+// decoded as signed (int8).
+func NewAdaptiveRiceGolombDecoder(bs kanzi.InputBitStream, sgn bool) (*AdaptiveRiceGolombDecoder, error) {
+	if bs == nil {
+		return nil, errors.New("Adaptive RiceGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this := new(AdaptiveRiceGolombDecoder)
+	this.signed = sgn
+	this.bitstream = bs
+	return this, nil
+}
+
+// Reset prepares the decoder to read a new block from the provided bitstream
+func (this *AdaptiveRiceGolombDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("Adaptive RiceGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Read decodes data from the bitstream and return it in the provided buffer.
+// Return the number of bytes read from the bitstream
+func (this *AdaptiveRiceGolombDecoder) Read(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("Adaptive RiceGolomb codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	logBase := uint(this.bitstream.ReadBits(_GOLOMB_PARAM_BITS))
+
+	if logBase < 1 || logBase > _RICE_MAX_LOG_BASE {
+		return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect RiceGolomb log base %d", logBase))
+	}
+
+	ed := RiceGolombDecoder{signed: this.signed, logBase: logBase, bitstream: this.bitstream}
+	return ed.Read(block)
+}
+
+// Dispose this implementation does nothing
+func (this *AdaptiveRiceGolombDecoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *AdaptiveRiceGolombDecoder) BitStream() kanzi.InputBitStream {
+	return this.bitstream
+}
+
+// AdaptiveExpGolombEncoder Exp-Golomb encoder selecting the order of the
+// code for each block. The code of order k of m is the code of order 0 of
+// m + 2^k - 1 without its k leading zeros.
+type AdaptiveExpGolombEncoder struct {
+	signed    bool
+	bitstream kanzi.OutputBitStream
+}
+
+// NewAdaptiveExpGolombEncoder creates a new instance of
+// AdaptiveExpGolombEncoder. If sgn is true, values are encoded as signed
+// (int8) in the bitstream (see NewExpGolombEncoder).
+func NewAdaptiveExpGolombEncoder(bs kanzi.OutputBitStream, sgn bool) (*AdaptiveExpGolombEncoder, error) {
+	if bs == nil {
+		return nil, errors.New("Adaptive ExpGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this := new(AdaptiveExpGolombEncoder)
+	this.signed = sgn
+	this.bitstream = bs
+	return this, nil
+}
+
+// Reset prepares the encoder to write a new block to the provided bitstream
+func (this *AdaptiveExpGolombEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("Adaptive ExpGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Write encodes the data provided into the bitstream. Return the number of
+// bytes written to the bitstream
+func (this *AdaptiveExpGolombEncoder) Write(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("Adaptive ExpGolomb codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	order := ExpGolombOrder(block, this.signed)
+	this.bitstream.WriteBits(uint64(order), _GOLOMB_PARAM_BITS)
+	bs := this.bitstream
+
+	for _, val := range block {
+		m := val
+		sign := uint64(0)
+
+		if this.signed == true && val&0x80 != 0 {
+			m = ^val + 1
+			sign = 1
+		}
+
+		// Leading zeros then m + 2^k (n bits)
+		u := uint64(m) + (uint64(1) << order)
+		n := uint(bits.Len64(u))
+		emit := u
+		length := 2*n - 1 - order
+
+		if this.signed == true && m != 0 {
+			emit = (emit << 1) | sign
+			length++
+		}
+
+		bs.WriteBits(emit, length)
+	}
+
+	return len(block), nil
+}
+
+// Dispose this implementation does nothing
+func (this *AdaptiveExpGolombEncoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *AdaptiveExpGolombEncoder) BitStream() kanzi.OutputBitStream {
+	return this.bitstream
+}
+
+// AdaptiveExpGolombDecoder decoder of the blocks coded by
+// AdaptiveExpGolombEncoder
+type AdaptiveExpGolombDecoder struct {
+	signed    bool
+	bitstream kanzi.InputBitStream
+}
+
+// NewAdaptiveExpGolombDecoder creates a new instance of
+// AdaptiveExpGolombDecoder. If sgn is true, values from the bitstream are
+// decoded as signed (int8).
+func NewAdaptiveExpGolombDecoder(bs kanzi.InputBitStream, sgn bool) (*AdaptiveExpGolombDecoder, error) {
+	if bs == nil {
+		return nil, errors.New("Adaptive ExpGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this := new(AdaptiveExpGolombDecoder)
+	this.signed = sgn
+	this.bitstream = bs
+	return this, nil
+}
+
+// Reset prepares the decoder to read a new block from the provided bitstream
+func (this *AdaptiveExpGolombDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("Adaptive ExpGolomb codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Read decodes data from the bitstream and return it in the provided buffer.
+// Return the number of bytes read from the bitstream
+func (this *AdaptiveExpGolombDecoder) Read(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("Adaptive ExpGolomb codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	order := uint(this.bitstream.ReadBits(_GOLOMB_PARAM_BITS))
+
+	if order > _EXPG_MAX_ORDER {
+		return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect ExpGolomb order %d", order))
+	}
+
+	bs := this.bitstream
+
+	for i := range block {
+		zeros := uint(0)
+
+		for bs.ReadBit() == 0 {
+			zeros++
+
+			// The magnitudes are at most 255
+			if 2*(zeros+order)+1 > _EXPG_MAX_CODE_BITS {
+				return i, kanzi.NewCorruptStreamError("Invalid bitstream: incorrect ExpGolomb code")
+			}
+		}
+
+		u := uint64(1) << (zeros + order)
+
+		if zeros+order > 0 {
+			u |= bs.ReadBits(zeros + order)
+		}
+
+		m := u - (uint64(1) << order)
+
+		if m > 255 {
+			return i, kanzi.NewCorruptStreamError("Invalid bitstream: incorrect ExpGolomb code")
+		}
+
+		val := byte(m)
+
+		if this.signed == true && m != 0 && bs.ReadBit() == 1 {
+			val = ^val + 1
+		}
+
+		block[i] = val
+	}
+
+	return len(block), nil
+}
+
+// Dispose this implementation does nothing
+func (this *AdaptiveExpGolombDecoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *AdaptiveExpGolombDecoder) BitStream() kanzi.InputBitStream {
+	return this.bitstream
+}
@@ -0,0 +1,431 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Adaptive Huffman codec: no code table is transmitted. The encoder and the
+// decoder start with the same flat codes (8 bits per symbol), count the
+// symbols as they are coded and periodically rebuild the canonical codes
+// from the counts. The period doubles after each rebuild (up to a maximum)
+// and the counts are halved regularly so that the codes follow the changes
+// in the statistics of the data.
+
+const (
+	_AHUF_FIRST_PERIOD          = 32
+	_AHUF_MIN_MAX_PERIOD        = uint(256)
+	_AHUF_DEFAULT_MAX_PERIOD    = uint(1024)
+	_AHUF_INCREMENT             = 16      // count of a coded symbol (unseen symbols have a count of 1)
+	_AHUF_MAX_TOTAL             = 1 << 17 // halve the counts above this total
+	_AHUF_DECODING_BATCH_SIZE   = 12      // in bits
+	_AHUF_FAST_DECODING_PADDING = 64      // symbols decoded bit by bit at the end of a block
+)
+
+type adaptiveHuffmanModel struct {
+	freqs      [256]int
+	sizes      [256]byte
+	codes      [256]uint // size << 24 | code
+	symbols    [256]int  // sorted by increasing code size, then increasing value
+	ranks      [256]int  // symbols sorted by increasing frequency at the last rebuild
+	total      int
+	period     int
+	maxPeriod  int
+	nextUpdate int
+}
+
+func (this *adaptiveHuffmanModel) reset() {
+	for i := range &this.freqs {
+		this.freqs[i] = 1
+		this.sizes[i] = 8
+		this.codes[i] = (8 << 24) | uint(i)
+		this.symbols[i] = i
+		this.ranks[i] = i
+	}
+
+	this.total = 256
+	this.period = _AHUF_FIRST_PERIOD
+	this.nextUpdate = this.period
+}
+
+// Count the symbol. Return true if the codes have been rebuilt.
+func (this *adaptiveHuffmanModel) update(val byte) bool {
+	this.freqs[val] += _AHUF_INCREMENT
+	this.total += _AHUF_INCREMENT
+	this.nextUpdate--
+
+	if this.nextUpdate != 0 {
+		return false
+	}
+
+	if this.total > _AHUF_MAX_TOTAL {
+		this.total = 0
+
+		for i := range &this.freqs {
+			this.freqs[i] = (this.freqs[i] + 1) >> 1
+			this.total += this.freqs[i]
+		}
+	}
+
+	if this.period < this.maxPeriod {
+		this.period <<= 1
+	}
+
+	this.nextUpdate = this.period
+	this.rebuild()
+	return true
+}
+
+// Compute the code sizes from the counts (all symbols get a code) and
+// generate the canonical codes
+func (this *adaptiveHuffmanModel) rebuild() {
+	freqs := this.freqs
+	var buf [256]int
+
+	for {
+		// Sort ranks by increasing frequencies (first key) and increasing value
+		// (second key). The order changes little from one rebuild to the next:
+		// start from the previous order and use an insertion sort.
+		for i := range &this.ranks {
+			s := this.ranks[i] & 0xFF
+			this.ranks[i] = (freqs[s] << 8) | s
+		}
+
+		for i := 1; i < len(this.ranks); i++ {
+			r := this.ranks[i]
+			j := i
+
+			for j > 0 && this.ranks[j-1] > r {
+				this.ranks[j] = this.ranks[j-1]
+				j--
+			}
+
+			this.ranks[j] = r
+		}
+
+		for i := range &buf {
+			buf[i] = this.ranks[i] >> 8
+		}
+
+		computeInPlaceSizesPhase1(buf[:])
+		computeInPlaceSizesPhase2(buf[:])
+
+		// The least frequent symbol has the longest code
+		if buf[0] <= _HUF_MAX_SYMBOL_SIZE {
+			break
+		}
+
+		// Flatten the distribution until the max code size is respected
+		for i := range &freqs {
+			freqs[i] = (freqs[i] + 1) >> 1
+		}
+	}
+
+	for i := range &buf {
+		this.ranks[i] &= 0xFF
+		this.sizes[this.ranks[i]] = byte(buf[i])
+		this.symbols[i] = i
+	}
+
+	generateCanonicalCodes(this.sizes[:], this.codes[:], this.symbols[:])
+
+	for s := range &this.codes {
+		this.codes[s] |= uint(this.sizes[s]) << 24
+	}
+}
+
+func checkAdaptiveHuffmanArgs(args []uint) (int, error) {
+	if len(args) > 1 {
+		return 0, errors.New("Adaptive Huffman codec: At most one update period can be provided")
+	}
+
+	period := _AHUF_DEFAULT_MAX_PERIOD
+
+	if len(args) == 1 {
+		period = args[0]
+
+		if period < _AHUF_MIN_MAX_PERIOD || period > 1<<16 || period&(period-1) != 0 {
+			return 0, fmt.Errorf("Adaptive Huffman codec: The update period must be a power of 2 in [%d..%d]", _AHUF_MIN_MAX_PERIOD, 1<<16)
+		}
+	}
+
+	return int(period), nil
+}
+
+// AdaptiveHuffmanEncoder Huffman encoder that does not transmit the code
+// tables (see the adaptive Huffman decoder)
+type AdaptiveHuffmanEncoder struct {
+	bitstream kanzi.OutputBitStream
+	model     adaptiveHuffmanModel
+}
+
+// NewAdaptiveHuffmanEncoder creates an instance of AdaptiveHuffmanEncoder.
+// Since the number of args is variable, this function can be called like this:
+// NewAdaptiveHuffmanEncoder(bs) or NewAdaptiveHuffmanEncoder(bs, 8192) (the
+// second argument being the maximum number of symbols between two updates of
+// the codes, a power of 2). The decoder must use the same value.
+func NewAdaptiveHuffmanEncoder(bs kanzi.OutputBitStream, args ...uint) (*AdaptiveHuffmanEncoder, error) {
+	if bs == nil {
+		return nil, errors.New("Adaptive Huffman codec: Invalid null bitstream parameter")
+	}
+
+	period, err := checkAdaptiveHuffmanArgs(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := new(AdaptiveHuffmanEncoder)
+	this.bitstream = bs
+	this.model.maxPeriod = period
+	this.model.reset()
+	return this, nil
+}
+
+// Reset prepares the encoder to write a new block to the provided bitstream
+// (the codes are back to the initial flat codes)
+func (this *AdaptiveHuffmanEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("Adaptive Huffman codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	this.model.reset()
+	return nil
+}
+
+// Write encodes the data provided into the bitstream. Return the number of
+// bytes written to the bitstream. The codes are carried over from one call to
+// the next (the decoder must read the data with the same sequence of calls).
+func (this *AdaptiveHuffmanEncoder) Write(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("Adaptive Huffman codec: Invalid null block parameter")
+	}
+
+	bs := this.bitstream
+	m := &this.model
+
+	for _, val := range block {
+		code := m.codes[val]
+		bs.WriteBits(uint64(code), code>>24)
+		m.update(val)
+	}
+
+	return len(block), nil
+}
+
+// Dispose this implementation does nothing
+func (this *AdaptiveHuffmanEncoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *AdaptiveHuffmanEncoder) BitStream() kanzi.OutputBitStream {
+	return this.bitstream
+}
+
+// AdaptiveHuffmanDecoder Huffman decoder that rebuilds the codes from the
+// counts of the decoded symbols. The short codes are decoded with a table,
+// the long ones using the canonical code ranges.
+type AdaptiveHuffmanDecoder struct {
+	bitstream kanzi.InputBitStream
+	model     adaptiveHuffmanModel
+	table     [1 << _AHUF_DECODING_BATCH_SIZE]uint16 // code -> size, symbol
+	firstCode [_HUF_MAX_SYMBOL_SIZE + 1]uint         // first canonical code of each size
+	firstIdx  [_HUF_MAX_SYMBOL_SIZE + 1]int          // index of this code in symbols
+	counts    [_HUF_MAX_SYMBOL_SIZE + 1]uint         // number of codes of each size
+	state     uint64                                 // holds bits read from bitstream
+	bits      uint                                   // holds number of unused bits in 'state'
+}
+
+// NewAdaptiveHuffmanDecoder creates an instance of AdaptiveHuffmanDecoder.
+// Since the number of args is variable, this function can be called like this:
+// NewAdaptiveHuffmanDecoder(bs) or NewAdaptiveHuffmanDecoder(bs, 8192) (the
+// second argument being the maximum number of symbols between two updates of
+// the codes, see NewAdaptiveHuffmanEncoder)
+func NewAdaptiveHuffmanDecoder(bs kanzi.InputBitStream, args ...uint) (*AdaptiveHuffmanDecoder, error) {
+	if bs == nil {
+		return nil, errors.New("Adaptive Huffman codec: Invalid null bitstream parameter")
+	}
+
+	period, err := checkAdaptiveHuffmanArgs(args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := new(AdaptiveHuffmanDecoder)
+	this.bitstream = bs
+	this.model.maxPeriod = period
+	this.model.reset()
+	this.buildDecodingTables()
+	return this, nil
+}
+
+// Reset prepares the decoder to read a new block from the provided bitstream
+// (the codes are back to the initial flat codes)
+func (this *AdaptiveHuffmanDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("Adaptive Huffman codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	this.state = 0
+	this.bits = 0
+	this.model.reset()
+	this.buildDecodingTables()
+	return nil
+}
+
+func (this *AdaptiveHuffmanDecoder) buildDecodingTables() {
+	m := &this.model
+	tableEnd := uint(0)
+
+	for i := range &this.counts {
+		this.counts[i] = 0
+	}
+
+	for i, s := range &m.symbols {
+		size := m.sizes[s]
+		code := m.codes[s] & 0xFFFFFF
+
+		if this.counts[size] == 0 {
+			this.firstCode[size] = code
+			this.firstIdx[size] = i
+		}
+
+		this.counts[size]++
+
+		// All the batch size bit values starting with the code point to
+		// the symbol
+		if size <= _AHUF_DECODING_BATCH_SIZE {
+			val := uint16(size)<<8 | uint16(s)
+			idx := code << (_AHUF_DECODING_BATCH_SIZE - size)
+			end := (code + 1) << (_AHUF_DECODING_BATCH_SIZE - size)
+
+			for idx < end {
+				this.table[idx] = val
+				idx++
+			}
+
+			tableEnd = end
+		}
+	}
+
+	// The canonical codes are sorted: the remaining values are prefixes
+	// of long codes
+	for i := tableEnd; i < uint(len(this.table)); i++ {
+		this.table[i] = 0
+	}
+}
+
+// Read decodes data from the bitstream and return it in the provided buffer.
+// Return the number of bytes read from the bitstream
+func (this *AdaptiveHuffmanDecoder) Read(block []byte) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n = 0
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: corrupted data in adaptive Huffman decoder (%v)", r))
+		}
+	}()
+
+	if block == nil {
+		return 0, errors.New("Adaptive Huffman codec: Invalid null block parameter")
+	}
+
+	// Each code has at least 1 bit: the bitstream can be read 64 bits at a
+	// time as long as enough symbols remain
+	end := len(block) - _AHUF_FAST_DECODING_PADDING
+	i := 0
+
+	for ; i < end; i++ {
+		block[i] = this.fastDecodeByte()
+
+		if this.model.update(block[i]) == true {
+			this.buildDecodingTables()
+		}
+	}
+
+	for ; i < len(block); i++ {
+		block[i] = this.slowDecodeByte()
+
+		if this.model.update(block[i]) == true {
+			this.buildDecodingTables()
+		}
+	}
+
+	return len(block), nil
+}
+
+func (this *AdaptiveHuffmanDecoder) fastDecodeByte() byte {
+	if this.bits < _HUF_MAX_SYMBOL_SIZE {
+		read := this.bitstream.ReadBits(64 - this.bits)
+		this.state = (this.state << (64 - this.bits)) | read
+		this.bits = 64
+	}
+
+	peek := uint(this.state>>(this.bits-_HUF_MAX_SYMBOL_SIZE)) & ((1 << _HUF_MAX_SYMBOL_SIZE) - 1)
+	val := this.table[peek>>(_HUF_MAX_SYMBOL_SIZE-_AHUF_DECODING_BATCH_SIZE)]
+
+	if val != 0 {
+		this.bits -= uint(val >> 8)
+		return byte(val)
+	}
+
+	// Long code: find the size such that the code is in the range of the
+	// canonical codes of this size
+	for size := uint(_AHUF_DECODING_BATCH_SIZE + 1); size <= _HUF_MAX_SYMBOL_SIZE; size++ {
+		if offset := (peek >> (_HUF_MAX_SYMBOL_SIZE - size)) - this.firstCode[size]; offset < this.counts[size] {
+			this.bits -= size
+			return byte(this.model.symbols[this.firstIdx[size]+int(offset)])
+		}
+	}
+
+	panic(kanzi.NewCorruptStreamError("Invalid bitstream: incorrect adaptive Huffman code"))
+}
+
+func (this *AdaptiveHuffmanDecoder) slowDecodeByte() byte {
+	code := uint(0)
+
+	for size := uint(1); size <= _HUF_MAX_SYMBOL_SIZE; size++ {
+		code <<= 1
+
+		if this.bits == 0 {
+			code |= uint(this.bitstream.ReadBit())
+		} else {
+			this.bits--
+			code |= uint(this.state>>this.bits) & 1
+		}
+
+		if offset := code - this.firstCode[size]; offset < this.counts[size] {
+			return byte(this.model.symbols[this.firstIdx[size]+int(offset)])
+		}
+	}
+
+	panic(kanzi.NewCorruptStreamError("Invalid bitstream: incorrect adaptive Huffman code"))
+}
+
+// BitStream returns the underlying bitstream
+func (this *AdaptiveHuffmanDecoder) BitStream() kanzi.InputBitStream {
+	return this.bitstream
+}
+
+// Dispose this implementation does nothing
+func (this *AdaptiveHuffmanDecoder) Dispose() {
+}
@@ -16,9 +16,38 @@ limitations under the License.
 package entropy
 
 import (
+	"errors"
+
 	kanzi "github.com/flanglet/kanzi-go"
 )
 
+// The adaptive probability maps (APM, also known as SSE: secondary symbol
+// estimation) refine the output of a binary predictor given a context. They
+// can be composed in custom predictors:
+//
+//   apm, _ := NewLogisticAdaptiveProbMap(256, 7)
+//   ...
+//   p = (p + 3*apm.Get(bit, p, c0)) >> 2 // after each bit
+//
+// Get updates the map with the bit that follows the previous prediction, so
+// it must be called exactly once per bit.
+
+const (
+	_APM_MAX_CONTEXTS = 1 << 24
+	_APM_MAX_RATE     = 15
+)
+
+// ProbMap is implemented by the adaptive probability maps
+type ProbMap interface {
+	// Get updates the map with the bit following the previous prediction and
+	// returns the refined probability (in [0..4095]) of the next bit being 1
+	// given the probability pr (in [0..4095]) and the context ctx
+	Get(bit int, pr int, ctx int) int
+
+	// Reset restores the initial state of the map
+	Reset()
+}
+
 // AdaptiveProbMap maps a probability and a context to a new probability
 // that the next bit will be 1. After each guess, it updates
 // its state to improve future predictions.
@@ -40,24 +69,60 @@ type LogisticAdaptiveProbMap AdaptiveProbMap
 // faster at the expense of some accuracy
 type FastLogisticAdaptiveProbMap AdaptiveProbMap
 
-func newLogisticAdaptiveProbMap(n, rate uint) (*LogisticAdaptiveProbMap, error) {
-	this := &LogisticAdaptiveProbMap{}
-	this.data = make([]uint16, n*33)
+// FastAdaptiveProbMap is similar to LinearAdaptiveProbMap without
+// interpolation (the cheapest map: one lookup and one update per bit)
+type FastAdaptiveProbMap AdaptiveProbMap
+
+// Allocate n contexts of the provided number of buckets
+func newAdaptiveProbMap(n, rate uint, buckets int) (*AdaptiveProbMap, error) {
+	if n == 0 || n > _APM_MAX_CONTEXTS {
+		return nil, errors.New("The number of contexts of the adaptive probability map must be in [1..16777216]")
+	}
+
+	if rate == 0 || rate > _APM_MAX_RATE {
+		return nil, errors.New("The update rate of the adaptive probability map must be in [1..15]")
+	}
+
+	this := &AdaptiveProbMap{}
+	this.data = make([]uint16, int(n)*buckets)
 	this.rate = rate
+	return this, nil
+}
 
-	for j := 0; j <= 32; j++ {
-		this.data[j] = uint16(kanzi.Squash((j-16)<<7) << 4)
+// Copy the buckets of the first context to all the other contexts
+func (this *AdaptiveProbMap) fill(buckets int) {
+	for i := buckets; i < len(this.data); i += buckets {
+		copy(this.data[i:], this.data[0:buckets])
 	}
 
-	for i := uint(1); i < n; i++ {
-		copy(this.data[i*33:], this.data[0:33])
+	this.index = 0
+}
+
+// NewLogisticAdaptiveProbMap creates a LogisticAdaptiveProbMap with n
+// contexts and the provided update rate (in [1..15], higher is slower)
+func NewLogisticAdaptiveProbMap(n, rate uint) (*LogisticAdaptiveProbMap, error) {
+	apm, err := newAdaptiveProbMap(n, rate, 33)
+
+	if err != nil {
+		return nil, err
 	}
 
+	this := (*LogisticAdaptiveProbMap)(apm)
+	this.Reset()
 	return this, nil
 }
 
-// get returns improved prediction given current bit, prediction and context
-func (this *LogisticAdaptiveProbMap) get(bit int, pr int, ctx int) int {
+// Reset restores the initial state of the map
+func (this *LogisticAdaptiveProbMap) Reset() {
+	for j := 0; j <= 32; j++ {
+		this.data[j] = uint16(kanzi.Squash((j-16)<<7) << 4)
+	}
+
+	(*AdaptiveProbMap)(this).fill(33)
+}
+
+// Get returns improved prediction given current bit, prediction and context
+func (this *LogisticAdaptiveProbMap) Get(bit int, pr int, ctx int) int {
 	// Update probability based on error and learning rate
 	g := (-bit & 65528) + (bit << this.rate)
 	this.data[this.index+1] += uint16((g - int(this.data[this.index+1])) >> this.rate)
@@ -72,24 +137,31 @@ func (this *LogisticAdaptiveProbMap) get(bit int, pr int, ctx int) int {
 	return (int(this.data[this.index+1])*w + int(this.data[this.index])*(128-w)) >> 11
 }
 
-func newFastLogisticAdaptiveProbMap(n, rate uint) (*FastLogisticAdaptiveProbMap, error) {
-	this := &FastLogisticAdaptiveProbMap{}
-	this.data = make([]uint16, n*32)
-	this.rate = rate
+// NewFastLogisticAdaptiveProbMap creates a FastLogisticAdaptiveProbMap with
+// n contexts and the provided update rate (in [1..15], higher is slower)
+func NewFastLogisticAdaptiveProbMap(n, rate uint) (*FastLogisticAdaptiveProbMap, error) {
+	apm, err := newAdaptiveProbMap(n, rate, 32)
 
-	for j := 0; j < 32; j++ {
-		this.data[j] = uint16(kanzi.Squash((j-16)<<7) << 4)
+	if err != nil {
+		return nil, err
 	}
 
-	for i := uint(1); i < n; i++ {
-		copy(this.data[i*32:], this.data[0:32])
+	this := (*FastLogisticAdaptiveProbMap)(apm)
+	this.Reset()
+	return this, nil
+}
+
+// Reset restores the initial state of the map
+func (this *FastLogisticAdaptiveProbMap) Reset() {
+	for j := 0; j < 32; j++ {
+		this.data[j] = uint16(kanzi.Squash((j-16)<<7) << 4)
 	}
 
-	return this, nil
+	(*AdaptiveProbMap)(this).fill(32)
 }
 
-// get returns improved prediction given current bit, prediction and context
-func (this *FastLogisticAdaptiveProbMap) get(bit int, pr int, ctx int) int {
+// Get returns improved prediction given current bit, prediction and context
+func (this *FastLogisticAdaptiveProbMap) Get(bit int, pr int, ctx int) int {
 	// Update probability based on error and learning rate
 	g := (-bit & 65528) + (bit << this.rate)
 	this.data[this.index] += uint16((g - int(this.data[this.index])) >> this.rate)
@@ -97,24 +169,31 @@ func (this *FastLogisticAdaptiveProbMap) get(bit int, pr int, ctx int) int {
 	return int(this.data[this.index]) >> 4
 }
 
-func newLinearAdaptiveProbMap(n, rate uint) (*LinearAdaptiveProbMap, error) {
-	this := &LinearAdaptiveProbMap{}
-	this.data = make([]uint16, n*65)
-	this.rate = rate
+// NewLinearAdaptiveProbMap creates a LinearAdaptiveProbMap with n contexts
+// and the provided update rate (in [1..15], higher is slower)
+func NewLinearAdaptiveProbMap(n, rate uint) (*LinearAdaptiveProbMap, error) {
+	apm, err := newAdaptiveProbMap(n, rate, 65)
 
-	for j := 0; j <= 64; j++ {
-		this.data[j] = uint16(j<<6) << 4
+	if err != nil {
+		return nil, err
 	}
 
-	for i := uint(1); i < n; i++ {
-		copy(this.data[i*65:], this.data[0:65])
+	this := (*LinearAdaptiveProbMap)(apm)
+	this.Reset()
+	return this, nil
+}
+
+// Reset restores the initial state of the map
+func (this *LinearAdaptiveProbMap) Reset() {
+	for j := 0; j <= 64; j++ {
+		this.data[j] = uint16(j<<6) << 4
 	}
 
-	return this, nil
+	(*AdaptiveProbMap)(this).fill(65)
 }
 
-// get returns improved prediction given current bit, prediction and context
-func (this *LinearAdaptiveProbMap) get(bit int, pr int, ctx int) int {
+// Get returns improved prediction given current bit, prediction and context
+func (this *LinearAdaptiveProbMap) Get(bit int, pr int, ctx int) int {
 	// Update probability based on error and learning rate
 	g := (-bit & 65528) + (bit << this.rate)
 	this.data[this.index+1] += uint16((g - int(this.data[this.index+1])) >> this.rate)
@@ -124,6 +203,39 @@ func (this *LinearAdaptiveProbMap) get(bit int, pr int, ctx int) int {
 	this.index = (pr >> 6) + 65*ctx
 
 	// Return interpolated probability
-	w := pr & 127
-	return (int(this.data[this.index+1])*w + int(this.data[this.index])*(128-w)) >> 11
+	w := pr & 63
+	return (int(this.data[this.index+1])*w + int(this.data[this.index])*(64-w)) >> 10
+}
+
+// NewFastAdaptiveProbMap creates a FastAdaptiveProbMap with n contexts and
+// the provided update rate (in [1..15], higher is slower)
+func NewFastAdaptiveProbMap(n, rate uint) (*FastAdaptiveProbMap, error) {
+	apm, err := newAdaptiveProbMap(n, rate, 64)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := (*FastAdaptiveProbMap)(apm)
+	this.Reset()
+	return this, nil
+}
+
+// Reset restores the initial state of the map
+func (this *FastAdaptiveProbMap) Reset() {
+	// Middle of each bucket
+	for j := 0; j < 64; j++ {
+		this.data[j] = uint16((j<<6)+32) << 4
+	}
+
+	(*AdaptiveProbMap)(this).fill(64)
+}
+
+// Get returns improved prediction given current bit, prediction and context
+func (this *FastAdaptiveProbMap) Get(bit int, pr int, ctx int) int {
+	// Update probability based on error and learning rate
+	g := (-bit & 65528) + (bit << this.rate)
+	this.data[this.index] += uint16((g - int(this.data[this.index])) >> this.rate)
+	this.index = (pr >> 6) + 64*ctx
+	return int(this.data[this.index]) >> 4
 }
@@ -0,0 +1,196 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// The AUTO entropy codec selects the codec of each block with SelectBest.
+// The type of the selected codec (8 bits) is written before the block,
+// which is then coded without any codec option.
+
+// Return a copy of the map without the codec options (never written by the
+// blocks of the AUTO codec) and without the stats collector (the blocks are
+// registered by the AUTO encoder)
+func autoBlockContext(ctx map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(ctx))
+
+	for k, v := range ctx {
+		res[k] = v
+	}
+
+	for _, key := range [...]string{"tpaqModels", "tpaq:extra", "tpaq:mix2", "tpaq:warm", "cm:order2", "entropy:lanes", "entropyStats"} {
+		delete(res, key)
+	}
+
+	return res
+}
+
+// AutoEncoder entropy encoder delegating each block to the best codec
+type AutoEncoder struct {
+	bitstream kanzi.OutputBitStream
+	ctx       map[string]interface{}
+	collector *StatsCollector
+}
+
+// NewAutoEncoder creates an instance of AutoEncoder. The map is passed to
+// the selected encoders (see NewEntropyEncoder).
+func NewAutoEncoder(bs kanzi.OutputBitStream, ctx map[string]interface{}) (*AutoEncoder, error) {
+	if bs == nil {
+		return nil, errors.New("AUTO codec: Invalid null bitstream parameter")
+	}
+
+	collector, err := getStatsCollector(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := new(AutoEncoder)
+	this.bitstream = bs
+	this.ctx = autoBlockContext(ctx)
+	this.collector = collector
+	return this, nil
+}
+
+// Reset prepares the encoder to write a new block to the provided bitstream
+func (this *AutoEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("AUTO codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Write encodes the data provided into the bitstream. Return the number of
+// bytes written to the bitstream.
+func (this *AutoEncoder) Write(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("AUTO codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	entropyType, err := SelectBest(block, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if this.collector != nil {
+		this.collector.addSelection(GetName(entropyType))
+	}
+
+	this.bitstream.WriteBits(uint64(entropyType), 8)
+	ee, err := NewEntropyEncoder(this.bitstream, this.ctx, entropyType)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer ee.Dispose()
+	return ee.Write(block)
+}
+
+// Dispose this implementation does nothing
+func (this *AutoEncoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *AutoEncoder) BitStream() kanzi.OutputBitStream {
+	return this.bitstream
+}
+
+// AutoDecoder entropy decoder of the blocks coded by AutoEncoder
+type AutoDecoder struct {
+	bitstream kanzi.InputBitStream
+	ctx       map[string]interface{}
+}
+
+// NewAutoDecoder creates an instance of AutoDecoder. The map is passed to
+// the decoders of the blocks (see NewEntropyDecoder).
+func NewAutoDecoder(bs kanzi.InputBitStream, ctx map[string]interface{}) (*AutoDecoder, error) {
+	if bs == nil {
+		return nil, errors.New("AUTO codec: Invalid null bitstream parameter")
+	}
+
+	this := new(AutoDecoder)
+	this.bitstream = bs
+	this.ctx = autoBlockContext(ctx)
+	return this, nil
+}
+
+// Reset prepares the decoder to read a new block from the provided bitstream
+func (this *AutoDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("AUTO codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Read decodes data from the bitstream and return it in the provided buffer.
+// Return the number of bytes read from the bitstream
+func (this *AutoDecoder) Read(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("AUTO codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	entropyType := uint32(this.bitstream.ReadBits(8))
+	valid := false
+
+	// The encoder only selects one of the default candidates
+	for _, t := range _AUTO_CANDIDATES {
+		if t == entropyType {
+			valid = true
+			break
+		}
+	}
+
+	if valid == false {
+		return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect entropy codec type %d in AUTO decoder", entropyType))
+	}
+
+	ed, err := NewEntropyDecoder(this.bitstream, this.ctx, entropyType)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer ed.Dispose()
+	return ed.Read(block)
+}
+
+// Dispose this implementation does nothing
+func (this *AutoDecoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *AutoDecoder) BitStream() kanzi.InputBitStream {
+	return this.bitstream
+}
@@ -18,8 +18,10 @@ package entropy
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 
 	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
 )
 
 const (
@@ -29,10 +31,31 @@ const (
 	_MASK_0_32          = uint64(0x00000000FFFFFFFF)
 )
 
+// BytePredictor is implemented by the binary predictors providing a byte
+// level API on top of Predictor. The binary entropy codecs use it (instead
+// of a Get and an Update call per bit) to code whole bytes: the predictor
+// unrolls the 8 bits internally and updates its partial byte context
+// without call overhead.
+// The methods may be called after bits coded one by one (EncodeBit or
+// DecodeBit), not at a byte boundary.
+type BytePredictor interface {
+	kanzi.Predictor
+
+	// PredictByte stores the probabilities (in [0..4095]) of the 8 bits of
+	// val being 1 (MSB first) in probs and updates the model with these bits.
+	// Same as 8 calls to Get and Update.
+	PredictByte(val byte, probs *[8]int)
+
+	// DecodeByte decodes the next 8 bits (see DecodeBitWithProb) with the
+	// probabilities of the model, updates the model and returns the byte.
+	DecodeByte(ed *BinaryEntropyDecoder) byte
+}
+
 // BinaryEntropyEncoder entropy encoder based on arithmetic coding and
 // using an external probability predictor.
 type BinaryEntropyEncoder struct {
 	predictor kanzi.Predictor
+	bytePred  BytePredictor // predictor with a byte level API or nil
 	low       uint64
 	high      uint64
 	bitstream kanzi.OutputBitStream
@@ -55,6 +78,7 @@ func NewBinaryEntropyEncoder(bs kanzi.OutputBitStream, predictor kanzi.Predictor
 
 	this := new(BinaryEntropyEncoder)
 	this.predictor = predictor
+	this.bytePred, _ = predictor.(BytePredictor)
 	this.low = 0
 	this.high = _BINARY_ENTROPY_TOP
 	this.bitstream = bs
@@ -63,8 +87,42 @@ func NewBinaryEntropyEncoder(bs kanzi.OutputBitStream, predictor kanzi.Predictor
 	return this, nil
 }
 
+// Reset prepares the encoder to write a new block to the provided bitstream.
+// The predictor is reset to its initial state (it must implement a Reset()
+// method) and the chunk buffer is kept.
+func (this *BinaryEntropyEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("Binary entropy codec: Invalid null bitstream parameter")
+	}
+
+	p, isResettable := this.predictor.(resettablePredictor)
+
+	if isResettable == false {
+		return errors.New("Binary entropy codec: The predictor cannot be reset")
+	}
+
+	p.Reset()
+	this.low = 0
+	this.high = _BINARY_ENTROPY_TOP
+	this.bitstream = bs
+	this.disposed = false
+	this.index = 0
+	return nil
+}
+
 // EncodeByte encodes the given value into the bitstream bit by bit
 func (this *BinaryEntropyEncoder) EncodeByte(val byte) {
+	if this.bytePred != nil {
+		var probs [8]int
+		this.bytePred.PredictByte(val, &probs)
+
+		for i := range probs {
+			this.EncodeBitWithProb((val>>uint(7-i))&1, probs[i])
+		}
+
+		return
+	}
+
 	this.EncodeBit((val >> 7) & 1)
 	this.EncodeBit((val >> 6) & 1)
 	this.EncodeBit((val >> 5) & 1)
@@ -78,9 +136,19 @@ func (this *BinaryEntropyEncoder) EncodeByte(val byte) {
 // EncodeBit encodes one bit into the bitstream using arithmetic coding
 // and the probability predictor provided at creation time.
 func (this *BinaryEntropyEncoder) EncodeBit(bit byte) {
+	this.EncodeBitWithProb(bit, this.predictor.Get())
+
+	// Update predictor
+	this.predictor.Update(bit)
+}
+
+// EncodeBitWithProb encodes one bit into the bitstream using arithmetic
+// coding and the provided probability (in [0..4095]) of the bit being 1.
+// The predictor is not used.
+func (this *BinaryEntropyEncoder) EncodeBitWithProb(bit byte, p int) {
 	// Calculate interval split
 	// Written in a way to maximize accuracy of multiplication/division
-	split := (((this.high - this.low) >> 4) * uint64(this.predictor.Get())) >> 8
+	split := (((this.high - this.low) >> 4) * uint64(p)) >> 8
 
 	// Update fields with new interval bounds
 	if bit == 0 {
@@ -89,9 +157,6 @@ func (this *BinaryEntropyEncoder) EncodeBit(bit byte) {
 		this.high = this.low + split
 	}
 
-	// Update predictor
-	this.predictor.Update(bit)
-
 	// Write unchanged first 32 bits to bitstream
 	for (this.low^this.high)>>24 == 0 {
 		this.flush()
@@ -134,7 +199,8 @@ func (this *BinaryEntropyEncoder) Write(block []byte) (int, error) {
 		}
 
 		if len(this.buffer) < (chunkSize + (chunkSize >> 3)) {
-			this.buffer = make([]byte, chunkSize+(chunkSize>>3))
+			alloc.PutBytes(this.buffer)
+			this.buffer = alloc.Bytes(chunkSize + (chunkSize >> 3))
 		}
 
 		this.index = 0
@@ -178,12 +244,22 @@ func (this *BinaryEntropyEncoder) Dispose() {
 
 	this.disposed = true
 	this.bitstream.WriteBits(this.low|_MASK_0_24, 56)
+	alloc.PutBytes(this.buffer)
+	this.buffer = nil
+
+	// Recycle the predictor (if obtained from the pool)
+	if p, ok := this.predictor.(*TPAQPredictor); ok == true {
+		releaseTPAQPredictor(p)
+		this.predictor = nil
+		this.bytePred = nil
+	}
 }
 
 // BinaryEntropyDecoder entropy decoder based on arithmetic coding and
 // using an external probability predictor.
 type BinaryEntropyDecoder struct {
 	predictor   kanzi.Predictor
+	bytePred    BytePredictor // predictor with a byte level API or nil
 	low         uint64
 	high        uint64
 	current     uint64
@@ -208,6 +284,7 @@ func NewBinaryEntropyDecoder(bs kanzi.InputBitStream, predictor kanzi.Predictor)
 	// Defer stream reading. We are creating the object, we should not do any I/O
 	this := new(BinaryEntropyDecoder)
 	this.predictor = predictor
+	this.bytePred, _ = predictor.(BytePredictor)
 	this.low = 0
 	this.high = _BINARY_ENTROPY_TOP
 	this.bitstream = bs
@@ -216,8 +293,36 @@ func NewBinaryEntropyDecoder(bs kanzi.InputBitStream, predictor kanzi.Predictor)
 	return this, nil
 }
 
+// Reset prepares the decoder to read a new block from the provided bitstream.
+// The predictor is reset to its initial state (it must implement a Reset()
+// method) and the chunk buffer is kept.
+func (this *BinaryEntropyDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("Binary entropy codec: Invalid null bitstream parameter")
+	}
+
+	p, isResettable := this.predictor.(resettablePredictor)
+
+	if isResettable == false {
+		return errors.New("Binary entropy codec: The predictor cannot be reset")
+	}
+
+	p.Reset()
+	this.low = 0
+	this.high = _BINARY_ENTROPY_TOP
+	this.current = 0
+	this.initialized = false
+	this.bitstream = bs
+	this.index = 0
+	return nil
+}
+
 // DecodeByte decodes the given value from the bitstream bit by bit
 func (this *BinaryEntropyDecoder) DecodeByte() byte {
+	if this.bytePred != nil {
+		return this.bytePred.DecodeByte(this)
+	}
+
 	return (this.DecodeBit() << 7) |
 		(this.DecodeBit() << 6) |
 		(this.DecodeBit() << 5) |
@@ -271,6 +376,43 @@ func (this *BinaryEntropyDecoder) DecodeBit() byte {
 	return bit
 }
 
+// DecodeBitWithProb decodes one bit from the bitstream using arithmetic
+// coding and the provided probability (in [0..4095]) of the bit being 1.
+// The predictor is not used.
+func (this *BinaryEntropyDecoder) DecodeBitWithProb(p int) byte {
+	// Calculate interval split
+	// Written in a way to maximize accuracy of multiplication/division
+	split := ((((this.high - this.low) >> 4) * uint64(p)) >> 8) + this.low
+	var bit byte
+
+	if split >= this.current {
+		bit = 1
+		this.high = split
+	} else {
+		bit = 0
+		this.low = -^split
+	}
+
+	// Read 32 bits from bitstream
+	for (this.low^this.high)>>24 == 0 {
+		this.read()
+	}
+
+	return bit
+}
+
+// Read 32 bits from the bitstream for the interval provided (the predictors
+// decoding whole bytes keep the interval in local variables)
+func (this *BinaryEntropyDecoder) refill(low, high, current uint64) (uint64, uint64, uint64) {
+	this.low, this.high, this.current = low, high, current
+
+	for (this.low^this.high)>>24 == 0 {
+		this.read()
+	}
+
+	return this.low, this.high, this.current
+}
+
 func (this *BinaryEntropyDecoder) read() {
 	this.low = (this.low << 32) & _MASK_0_56
 	this.high = ((this.high << 32) | _MASK_0_32) & _MASK_0_56
@@ -315,10 +457,16 @@ func (this *BinaryEntropyDecoder) Read(block []byte) (int, error) {
 		}
 
 		if len(this.buffer) < (chunkSize*9)>>3 {
-			this.buffer = make([]byte, (chunkSize*9)>>3)
+			alloc.PutBytes(this.buffer)
+			this.buffer = alloc.Bytes((chunkSize * 9) >> 3)
 		}
 
 		szBytes := ReadVarInt(this.bitstream)
+
+		if int(szBytes) > len(this.buffer) {
+			return startChunk, kanzi.NewCorruptStreamError(fmt.Sprintf("Binary entropy codec: Invalid bitstream, incorrect chunk size %d", szBytes))
+		}
+
 		this.current = this.bitstream.ReadBits(56)
 		this.initialized = true
 
@@ -327,10 +475,9 @@ func (this *BinaryEntropyDecoder) Read(block []byte) (int, error) {
 		}
 
 		this.index = 0
-		buf := block[startChunk : startChunk+chunkSize]
 
-		for i := range buf {
-			buf[i] = this.DecodeByte()
+		if err = this.decodeChunk(block[startChunk : startChunk+chunkSize]); err != nil {
+			return startChunk, err
 		}
 
 		startChunk += chunkSize
@@ -339,12 +486,35 @@ func (this *BinaryEntropyDecoder) Read(block []byte) (int, error) {
 	return count, err
 }
 
+func (this *BinaryEntropyDecoder) decodeChunk(buf []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Binary entropy codec: Invalid bitstream, corrupted data (%v)", r))
+		}
+	}()
+
+	for i := range buf {
+		buf[i] = this.DecodeByte()
+	}
+
+	return nil
+}
+
 // BitStream returns the underlying bitstream
 func (this *BinaryEntropyDecoder) BitStream() kanzi.InputBitStream {
 	return this.bitstream
 }
 
 // Dispose must be called before getting rid of the entropy decoder
-// This implementation does nothing.
+// This implementation releases the chunk buffer and recycles the predictor
+// (if obtained from the pool).
 func (this *BinaryEntropyDecoder) Dispose() {
+	alloc.PutBytes(this.buffer)
+	this.buffer = nil
+
+	if p, ok := this.predictor.(*TPAQPredictor); ok == true {
+		releaseTPAQPredictor(p)
+		this.predictor = nil
+		this.bytePred = nil
+	}
 }
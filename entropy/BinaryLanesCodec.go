@@ -0,0 +1,363 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/bitstream"
+)
+
+// The binary entropy codecs (FPAQ, CM, CMX, TPAQ) decode one bit at a time
+// with a model updated after each bit: the decoding of a block is serial.
+// The lanes codec splits the block into N contiguous lanes coded with N
+// independent predictors, so that the lanes can be decoded (and encoded)
+// concurrently, at the cost of some compression (each lane starts with an
+// empty model).
+//
+// Block format:
+// lanes-1 (4 bits) | coded size of each lane (varint) | coded lanes
+// The lanes have the same length (the last one may be shorter). Each lane
+// is coded like a block of the BinaryEntropyEncoder.
+
+const (
+	LANES_MAX      = 16        // max number of lanes per block
+	_LANES_MIN_LEN = 64 * 1024 // min number of bytes per lane
+	_LANES_BITS    = 4
+)
+
+// PredictorFactory returns a new predictor (one per lane)
+type PredictorFactory func() (kanzi.Predictor, error)
+
+// In memory bitstream buffer of a lane
+type laneBuffer struct {
+	buf []byte
+	off int
+}
+
+func (this *laneBuffer) Write(b []byte) (int, error) {
+	this.buf = append(this.buf, b...)
+	return len(b), nil
+}
+
+func (this *laneBuffer) Read(b []byte) (int, error) {
+	n := copy(b, this.buf[this.off:])
+	this.off += n
+	return n, nil
+}
+
+func (this *laneBuffer) Close() error {
+	return nil
+}
+
+// Return the number of lanes used for a block of the provided length: the
+// lanes are at least 64 KB long
+func laneCount(length int, lanes uint) int {
+	n := length / _LANES_MIN_LEN
+
+	if n > int(lanes) {
+		n = int(lanes)
+	}
+
+	if n < 1 {
+		n = 1
+	}
+
+	return n
+}
+
+// Write (or read) big arrays to (from) the bitstream by chunks
+func writeLane(bs kanzi.OutputBitStream, buf []byte) {
+	for len(buf) > 0 {
+		n := len(buf)
+
+		if n > 1<<23 {
+			n = 1 << 23
+		}
+
+		bs.WriteArray(buf, uint(8*n))
+		buf = buf[n:]
+	}
+}
+
+func readLane(bs kanzi.InputBitStream, buf []byte) {
+	for len(buf) > 0 {
+		n := len(buf)
+
+		if n > 1<<23 {
+			n = 1 << 23
+		}
+
+		bs.ReadArray(buf, uint(8*n))
+		buf = buf[n:]
+	}
+}
+
+// BinaryLanesEncoder entropy encoder coding each block as independent lanes
+// with binary entropy encoders
+type BinaryLanesEncoder struct {
+	bitstream    kanzi.OutputBitStream
+	newPredictor PredictorFactory
+	lanes        uint
+}
+
+// NewBinaryLanesEncoder creates an instance of BinaryLanesEncoder coding the
+// blocks with up to 'lanes' lanes (in [1..16]). The lanes of each block are
+// coded with new predictors provided by the factory.
+func NewBinaryLanesEncoder(bs kanzi.OutputBitStream, newPredictor PredictorFactory, lanes uint) (*BinaryLanesEncoder, error) {
+	if bs == nil {
+		return nil, errors.New("Binary lanes codec: Invalid null bitstream parameter")
+	}
+
+	if newPredictor == nil {
+		return nil, errors.New("Binary lanes codec: Invalid null predictor factory parameter")
+	}
+
+	if lanes < 1 || lanes > LANES_MAX {
+		return nil, fmt.Errorf("Binary lanes codec: Invalid number of lanes: %d (must be in [1..%d])", lanes, LANES_MAX)
+	}
+
+	this := new(BinaryLanesEncoder)
+	this.bitstream = bs
+	this.newPredictor = newPredictor
+	this.lanes = lanes
+	return this, nil
+}
+
+// Write encodes the data provided into the bitstream. Return the number of
+// bytes written to the bitstream. The lanes are encoded concurrently.
+func (this *BinaryLanesEncoder) Write(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("Binary lanes codec: Invalid null block parameter")
+	}
+
+	n := laneCount(len(block), this.lanes)
+	laneLen := (len(block) + n - 1) / n
+	predictors := make([]kanzi.Predictor, n)
+
+	for i := range predictors {
+		var err error
+
+		if predictors[i], err = this.newPredictor(); err != nil {
+			return 0, err
+		}
+	}
+
+	outputs := make([]laneBuffer, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			end := (i + 1) * laneLen
+
+			if end > len(block) {
+				end = len(block)
+			}
+
+			errs[i] = encodeLane(&outputs[i], predictors[i], block[i*laneLen:end])
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	this.bitstream.WriteBits(uint64(n-1), _LANES_BITS)
+
+	for i := range outputs {
+		WriteVarInt(this.bitstream, uint32(len(outputs[i].buf)))
+	}
+
+	for i := range outputs {
+		writeLane(this.bitstream, outputs[i].buf)
+	}
+
+	return len(block), nil
+}
+
+// Encode one lane to the provided buffer
+func encodeLane(buf *laneBuffer, predictor kanzi.Predictor, lane []byte) error {
+	obs, err := bitstream.NewDefaultOutputBitStream(buf, 65536)
+
+	if err != nil {
+		return err
+	}
+
+	ee, err := NewBinaryEntropyEncoder(obs, predictor)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = ee.Write(lane)
+	ee.Dispose()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = obs.Close()
+	return err
+}
+
+// Dispose this implementation does nothing
+func (this *BinaryLanesEncoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *BinaryLanesEncoder) BitStream() kanzi.OutputBitStream {
+	return this.bitstream
+}
+
+// BinaryLanesDecoder entropy decoder of the blocks coded by BinaryLanesEncoder
+type BinaryLanesDecoder struct {
+	bitstream    kanzi.InputBitStream
+	newPredictor PredictorFactory
+}
+
+// NewBinaryLanesDecoder creates an instance of BinaryLanesDecoder. The
+// predictors provided by the factory must match the predictors of the
+// encoder. The number of lanes is read from each block.
+func NewBinaryLanesDecoder(bs kanzi.InputBitStream, newPredictor PredictorFactory) (*BinaryLanesDecoder, error) {
+	if bs == nil {
+		return nil, errors.New("Binary lanes codec: Invalid null bitstream parameter")
+	}
+
+	if newPredictor == nil {
+		return nil, errors.New("Binary lanes codec: Invalid null predictor factory parameter")
+	}
+
+	this := new(BinaryLanesDecoder)
+	this.bitstream = bs
+	this.newPredictor = newPredictor
+	return this, nil
+}
+
+// Read decodes data from the bitstream and return it in the provided buffer.
+// Return the number of bytes read from the bitstream. The lanes are decoded
+// concurrently.
+func (this *BinaryLanesDecoder) Read(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("Binary lanes codec: Invalid null block parameter")
+	}
+
+	n := int(this.bitstream.ReadBits(_LANES_BITS)) + 1
+
+	if n > 1 && n > len(block)/_LANES_MIN_LEN {
+		return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect number of lanes %d for a block of %d bytes", n, len(block)))
+	}
+
+	laneLen := (len(block) + n - 1) / n
+	inputs := make([]laneBuffer, n)
+
+	for i := range inputs {
+		// Upper bound of the size of a lane coded by the binary entropy encoder
+		size := ReadVarInt(this.bitstream)
+
+		if uint64(size) > uint64(laneLen)+uint64(laneLen>>3)+1024 {
+			return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect coded size %d of lane %d", size, i))
+		}
+
+		inputs[i].buf = make([]byte, size)
+	}
+
+	for i := range inputs {
+		readLane(this.bitstream, inputs[i].buf)
+	}
+
+	predictors := make([]kanzi.Predictor, n)
+
+	for i := range predictors {
+		var err error
+
+		if predictors[i], err = this.newPredictor(); err != nil {
+			return 0, err
+		}
+	}
+
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			end := (i + 1) * laneLen
+
+			if end > len(block) {
+				end = len(block)
+			}
+
+			errs[i] = decodeLane(&inputs[i], predictors[i], block[i*laneLen:end])
+		}(i)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(block), nil
+}
+
+// Decode one lane from the provided buffer
+func decodeLane(buf *laneBuffer, predictor kanzi.Predictor, lane []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: corrupted lane (%v)", r))
+		}
+	}()
+
+	ibs, err := bitstream.NewDefaultInputBitStream(buf, 65536)
+
+	if err != nil {
+		return err
+	}
+
+	ed, err := NewBinaryEntropyDecoder(ibs, predictor)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = ed.Read(lane)
+	ed.Dispose()
+	return err
+}
+
+// Dispose this implementation does nothing
+func (this *BinaryLanesDecoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *BinaryLanesDecoder) BitStream() kanzi.InputBitStream {
+	return this.bitstream
+}
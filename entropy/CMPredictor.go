@@ -15,10 +15,16 @@ limitations under the License.
 
 package entropy
 
+import (
+	"fmt"
+)
+
 const (
-	_FAST_RATE   = 2
-	_MEDIUM_RATE = 4
-	_SLOW_RATE   = 6
+	_FAST_RATE     = 2
+	_MEDIUM_RATE   = 4
+	_SLOW_RATE     = 6
+	_CM_ORDER2_LOG = 12 // number of order 2 hash buckets (log)
+	_CM_ORDER2     = 1  // option flag: order 2 context
 )
 
 // CMPredictor context model predictor based on BCM by Ilya Muravyov.
@@ -32,22 +38,72 @@ type CMPredictor struct {
 	runMask  int32
 	counter1 [256][]int32
 	counter2 [512][]int32
+	order2   []int32 // optional hashed order 2 counters (256 per bucket)
+	h2       int     // bucket of the current order 2 context
 	p        int
+	probe    *modelProbe // optional instrumentation
 }
 
 // NewCMPredictor creates a new instance of CMPredictor
 func NewCMPredictor() (*CMPredictor, error) {
 	this := new(CMPredictor)
-	this.ctx = 1
-	this.run = 1
-	this.runMask = 0
-	this.idx = 8
 
 	for i := 0; i < 256; i++ {
 		this.counter1[i] = make([]int32, 257)
 		this.counter2[i+i] = make([]int32, 17)
 		this.counter2[i+i+1] = make([]int32, 17)
+	}
+
+	this.Reset()
+	return this, nil
+}
+
+// NewCMPredictorWithCtx creates a new instance of CMPredictor using a
+// configuration map as parameter. If the map contains a "cm:order2" entry
+// set to true, a hashed order 2 context is added to the model: better ratio
+// on text (not after a BWT), 4 MB more memory.
+func NewCMPredictorWithCtx(ctx *map[string]interface{}) (*CMPredictor, error) {
+	order2 := false
+
+	if ctx != nil {
+		if val, containsKey := (*ctx)["cm:order2"]; containsKey {
+			b, ok := val.(bool)
+
+			if ok == false {
+				return nil, fmt.Errorf("Invalid CM order 2 option: %v (must be a boolean)", val)
+			}
+
+			order2 = b
+		}
+	}
+
+	this, err := NewCMPredictor()
+
+	if err != nil || order2 == false {
+		return this, err
+	}
+
+	this.order2 = make([]int32, 256<<_CM_ORDER2_LOG)
+	this.Reset()
+	return this, nil
+}
 
+// Reset restores the initial probabilities without allocating the counters
+// again (EG. to reuse the predictor for a new block)
+func (this *CMPredictor) Reset() {
+	this.c1 = 0
+	this.c2 = 0
+	this.ctx = 1
+	this.run = 1
+	this.runMask = 0
+	this.idx = 8
+	this.h2 = 0
+
+	for i := range this.order2 {
+		this.order2[i] = 32768
+	}
+
+	for i := 0; i < 256; i++ {
 		for j := 0; j <= 256; j++ {
 			this.counter1[i][j] = 32768
 		}
@@ -61,15 +117,59 @@ func NewCMPredictor() (*CMPredictor, error) {
 		this.counter2[i+i+1][16] = 65520
 	}
 
-	pc1 := this.counter1[this.ctx]
-	this.p = int(13*pc1[256]+14*pc1[this.c1]+5*pc1[this.c2]) >> 5
-	return this, nil
+	this.p = this.mix()
+
+	if this.probe != nil {
+		this.probe.reset()
+	}
+}
+
+// SetModelSink instruments the predictor: the probabilities and counter
+// predictions of 1 byte out of 'sampling' are sent to the sink (for offline
+// analysis). Slows down the predictor.
+func (this *CMPredictor) SetModelSink(sink ModelSink, sampling uint) error {
+	probe, err := newModelProbe(sink, sampling, "CM")
+
+	if err != nil {
+		return err
+	}
+
+	this.probe = probe
+	return nil
 }
 
 // Update updates the probability model based on the internal bit counters
 func (this *CMPredictor) Update(bit byte) {
+	if this.probe != nil {
+		if this.probe.update(bit, this.Get()) == true {
+			pc := this.counter1[this.ctx]
+
+			if this.order2 == nil {
+				this.probe.sample.Inputs = append(this.probe.sample.Inputs[:0], pc[256]>>4, pc[this.c1]>>4, pc[this.c2]>>4)
+				this.probe.sample.Weights = append(this.probe.sample.Weights[:0], 13, 14, 5)
+			} else {
+				this.probe.sample.Inputs = append(this.probe.sample.Inputs[:0], pc[256]>>4, pc[this.c1]>>4, pc[this.c2]>>4,
+					this.order2[this.h2|int(this.ctx)]>>4)
+				this.probe.sample.Weights = append(this.probe.sample.Weights[:0], 8, 10, 2, 12)
+			}
+		}
+
+		this.probe.next()
+	}
+
 	pc1 := this.counter1[this.ctx]
 	pc2 := this.counter2[this.ctx|this.runMask]
+
+	if this.order2 != nil {
+		pc3 := &this.order2[this.h2|int(this.ctx)]
+
+		if bit == 0 {
+			*pc3 -= (*pc3 >> _MEDIUM_RATE)
+		} else {
+			*pc3 += ((0xFFFF - *pc3) >> _MEDIUM_RATE)
+		}
+	}
+
 	this.ctx += (this.ctx + int32(bit))
 
 	if bit == 0 {
@@ -85,24 +185,44 @@ func (this *CMPredictor) Update(bit byte) {
 	}
 
 	if this.ctx > 255 {
-		this.c2 = this.c1
-		this.c1 = byte(this.ctx)
-		this.ctx = 1
-
-		if this.c1 == this.c2 {
-			this.run++
-			this.runMask = int32((2-this.run)>>31) << 8
-		} else {
-			this.run = 0
-			this.runMask = 0
-		}
+		this.nextByte(byte(this.ctx))
 	}
 
-	pc1 = this.counter1[this.ctx]
-	this.p = int(13*pc1[256]+14*pc1[this.c1]+5*pc1[this.c2]) >> 5
+	this.p = this.mix()
 	this.idx = this.p >> 12
 }
 
+// Register the last byte (the context of the partial byte restarts)
+func (this *CMPredictor) nextByte(val byte) {
+	this.c2 = this.c1
+	this.c1 = val
+	this.ctx = 1
+
+	if this.c1 == this.c2 {
+		this.run++
+		this.runMask = int32((2-this.run)>>31) << 8
+	} else {
+		this.run = 0
+		this.runMask = 0
+	}
+
+	if this.order2 != nil {
+		h := (uint32(this.c2)<<8 | uint32(this.c1)) * 0x9E3779B1
+		this.h2 = int(h>>(32-_CM_ORDER2_LOG)) << 8
+	}
+}
+
+// Mix the predictions of the counters of the current contexts (fixed weights)
+func (this *CMPredictor) mix() int {
+	pc1 := this.counter1[this.ctx]
+
+	if this.order2 == nil {
+		return int(13*pc1[256]+14*pc1[this.c1]+5*pc1[this.c2]) >> 5
+	}
+
+	return int(8*pc1[256]+10*pc1[this.c1]+2*pc1[this.c2]+12*this.order2[this.h2|int(this.ctx)]) >> 5
+}
+
 // Get returns the value representing the probability of the next bit being 1
 // in the [0..4095] range. The probability is computed from the internal
 // bit counters.
@@ -113,3 +233,146 @@ func (this *CMPredictor) Get() int {
 	ssep := x1 + (((x2 - x1) * (this.p & 4095)) >> 12)
 	return (this.p + 3*ssep + 32) >> 6 // rescale to [0..4095]
 }
+
+// PredictByte stores the probabilities of the 8 bits of val in probs and
+// updates the model with these bits
+func (this *CMPredictor) PredictByte(val byte, probs *[8]int) {
+	this.codeByte(val, probs, nil)
+}
+
+// DecodeByte decodes the next 8 bits with the provided decoder and updates
+// the model with these bits
+func (this *CMPredictor) DecodeByte(ed *BinaryEntropyDecoder) byte {
+	return this.codeByte(0, nil, ed)
+}
+
+// Encode (probabilities of the bits of val) or decode (bits from ed) a byte.
+// Same as Get and Update for each bit, with the contexts of the byte and the
+// interval of the decoder kept in registers.
+func (this *CMPredictor) codeByte(val byte, probs *[8]int, ed *BinaryEntropyDecoder) byte {
+	if this.probe != nil || this.ctx != 1 {
+		// Bit by bit (instrumented predictor or not at a byte boundary)
+		res := byte(0)
+
+		for i := uint(0); i < 8; i++ {
+			bit := (val >> (7 - i)) & 1
+
+			if ed != nil {
+				bit = ed.DecodeBitWithProb(this.Get())
+			} else {
+				probs[i] = this.Get()
+			}
+
+			this.Update(bit)
+			res = (res << 1) | bit
+		}
+
+		return res
+	}
+
+	c1 := this.c1
+	c2 := this.c2
+	order2 := this.order2
+	h2 := this.h2
+	runMask := this.runMask
+	p := this.p
+	idx := this.idx
+	ctx := int32(1)
+	var low, high, current uint64
+
+	if ed != nil {
+		low, high, current = ed.low, ed.high, ed.current
+	}
+
+	for i := uint(0); i < 8; i++ {
+		// The masks do not change the indexes (they remove bound checks)
+		pc1 := (*[257]int32)(this.counter1[ctx&255])
+		pc2 := (*[17]int32)(this.counter2[(ctx|runMask)&511])
+		idx &= 15
+		x2 := int(pc2[idx+1])
+		x1 := int(pc2[idx])
+		ssep := x1 + (((x2 - x1) * (p & 4095)) >> 12)
+		pr := (p + 3*ssep + 32) >> 6
+		var bit int32
+
+		if ed != nil {
+			split := ((((high - low) >> 4) * uint64(pr)) >> 8) + low
+
+			// Update the counters in the branches: a real branch (instead
+			// of a conditional move) lets the CPU speculate on the bit
+			if split >= current {
+				bit = 1
+				high = split
+				cmUpdate1(pc1, pc2, c1, idx)
+			} else {
+				low = split + 1
+				cmUpdate0(pc1, pc2, c1, idx)
+			}
+
+			if (low^high)>>24 == 0 {
+				low, high, current = ed.refill(low, high, current)
+			}
+		} else {
+			probs[i] = pr
+			bit = int32(val>>(7-i)) & 1
+
+			if bit == 0 {
+				cmUpdate0(pc1, pc2, c1, idx)
+			} else {
+				cmUpdate1(pc1, pc2, c1, idx)
+			}
+		}
+
+		if order2 != nil {
+			pc3 := &order2[h2|int(ctx)]
+
+			if bit == 0 {
+				*pc3 -= (*pc3 >> _MEDIUM_RATE)
+			} else {
+				*pc3 += ((0xFFFF - *pc3) >> _MEDIUM_RATE)
+			}
+		}
+
+		ctx += ctx + bit
+
+		if ctx > 255 {
+			break
+		}
+
+		// Same as mix() for the partial byte
+		pc1 = (*[257]int32)(this.counter1[ctx])
+
+		if order2 == nil {
+			p = int(13*pc1[256]+14*pc1[c1]+5*pc1[c2]) >> 5
+		} else {
+			p = int(8*pc1[256]+10*pc1[c1]+2*pc1[c2]+12*order2[h2|int(ctx)]) >> 5
+		}
+
+		idx = p >> 12
+	}
+
+	if ed != nil {
+		ed.low, ed.high, ed.current = low, high, current
+	}
+
+	this.nextByte(byte(ctx))
+	this.p = this.mix()
+	this.idx = this.p >> 12
+	return this.c1
+}
+
+// Counter updates of Update for a 0 bit
+func cmUpdate0(pc1 *[257]int32, pc2 *[17]int32, c1 byte, idx int) {
+	pc1[256] -= (pc1[256] >> _FAST_RATE)
+	pc1[c1] -= (pc1[c1] >> _MEDIUM_RATE)
+	pc2[idx+1] -= (pc2[idx+1] >> _SLOW_RATE)
+	pc2[idx] -= (pc2[idx] >> _SLOW_RATE)
+}
+
+// Counter updates of Update for a 1 bit
+func cmUpdate1(pc1 *[257]int32, pc2 *[17]int32, c1 byte, idx int) {
+	pc1[256] += ((0xFFFF - pc1[256]) >> _FAST_RATE)
+	pc1[c1] += ((0xFFFF - pc1[c1]) >> _MEDIUM_RATE)
+	pc2[idx+1] += ((0xFFFF - pc2[idx+1]) >> _SLOW_RATE)
+	pc2[idx] += ((0xFFFF - pc2[idx]) >> _SLOW_RATE)
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	_CMX_ORDER2_LOG  = 21 // 4 MB
+	_CMX_ORDER4_LOG  = 22 // 8 MB
+	_CMX_ORDER2_MASK = (1 << _CMX_ORDER2_LOG) - 1
+	_CMX_ORDER4_MASK = (1 << _CMX_ORDER4_LOG) - 1
+	_CMX_RATE        = 4
+	_CMX_INPUTS      = 4
+	_CMX_LEARN_RATE  = 6
+	_CMX_HASH        = int32(0x7FEB352D)
+)
+
+// CMXPredictor context mixing predictor between CMPredictor and
+// TPAQPredictor: the probabilities of the order 0, 1, 2 and 4 contexts
+// (16 bit counters, the order 2 and 4 contexts are hashed) are mixed in
+// the logistic domain by a mixer selected by the bits of the current byte,
+// then refined by an APM over the order 1 context. About 16 MB of state.
+type CMXPredictor struct {
+	c0      int32 // bitwise context: last 0-7 bits with a leading 1 (1-255)
+	c4      int32 // last 4 whole bytes, last is in low 8 bits
+	h2      int32 // slot of the order 2 context (256 aligned)
+	h4      int32 // slot of the order 4 context (256 aligned)
+	order0  []uint16
+	order1  []uint16
+	order2  []uint16
+	order4  []uint16
+	slots   [_CMX_INPUTS]*uint16 // counters of the current contexts
+	inputs  [_CMX_INPUTS]int32   // stretched predictions of the counters
+	weights []int32              // 256 sets of weights selected by c0 (65536 means 1)
+	mixed   int                  // output of the mixer
+	apm     *LogisticAdaptiveProbMap
+	pr      int
+	probe   *modelProbe // optional instrumentation
+}
+
+// NewCMXPredictor creates a new instance of CMXPredictor
+func NewCMXPredictor() (*CMXPredictor, error) {
+	this := new(CMXPredictor)
+	this.order0 = make([]uint16, 256)
+	this.order1 = make([]uint16, 65536)
+	this.order2 = make([]uint16, 1<<_CMX_ORDER2_LOG)
+	this.order4 = make([]uint16, 1<<_CMX_ORDER4_LOG)
+	this.weights = make([]int32, 256*_CMX_INPUTS)
+	this.apm, _ = NewLogisticAdaptiveProbMap(65536, 7)
+	this.Reset()
+	return this, nil
+}
+
+// Reset restores the initial probabilities without allocating the tables
+// again (EG. to reuse the predictor for a new block)
+func (this *CMXPredictor) Reset() {
+	for _, t := range [...][]uint16{this.order0, this.order1, this.order2, this.order4} {
+		for i := range t {
+			t[i] = 32768
+		}
+	}
+
+	for i := range this.weights {
+		this.weights[i] = 1 << 14
+	}
+
+	this.c0 = 1
+	this.c4 = 0
+	this.h2 = 0
+	this.h4 = 0
+	this.apm.Reset()
+	this.predict()
+	this.pr = this.mixed
+
+	if this.probe != nil {
+		this.probe.reset()
+	}
+}
+
+// SetModelSink instruments the predictor: the probabilities, counter
+// predictions and mixer weights of 1 byte out of 'sampling' are sent to the
+// sink (for offline analysis). Slows down the predictor.
+func (this *CMXPredictor) SetModelSink(sink ModelSink, sampling uint) error {
+	probe, err := newModelProbe(sink, sampling, "CMX")
+
+	if err != nil {
+		return err
+	}
+
+	this.probe = probe
+	return nil
+}
+
+// Update updates the probability model based on the observed bit
+func (this *CMXPredictor) Update(bit byte) {
+	if this.probe != nil {
+		if this.probe.update(bit, this.pr) == true {
+			w := this.weights[int(this.c0)*_CMX_INPUTS:]
+			this.probe.sample.Inputs = append(this.probe.sample.Inputs[:0], this.inputs[:]...)
+			this.probe.sample.Weights = append(this.probe.sample.Weights[:0], w[0:_CMX_INPUTS]...)
+		}
+
+		this.probe.next()
+	}
+
+	y := int32(bit)
+
+	// Update the counters
+	target := (y << 16) - y
+
+	for _, s := range this.slots {
+		*s = uint16(int32(*s) + ((target - int32(*s)) >> _CMX_RATE))
+	}
+
+	// Train the mixer
+	err := ((y << 12) - int32(this.mixed)) * _CMX_LEARN_RATE
+	w := this.weights[int(this.c0)*_CMX_INPUTS:]
+
+	cmxTrain(w[0:_CMX_INPUTS], &this.inputs, err)
+
+	this.c0 = (this.c0 << 1) | y
+
+	if this.c0 > 255 {
+		this.c4 = (this.c4 << 8) | (this.c0 & 0xFF)
+		this.h2 = (((this.c4 & 0xFFFF) * _CMX_HASH) >> 8 << 8) & _CMX_ORDER2_MASK
+		this.h4 = ((this.c4 * _CMX_HASH) >> 8 << 8) & _CMX_ORDER4_MASK
+		this.c0 = 1
+	}
+
+	this.predict()
+	p := (this.mixed + 3*this.apm.Get(int(bit), this.mixed, int(this.c0|(this.c4&0xFF)<<8))) >> 2
+	this.pr = p + int(uint32(p-2048)>>31)
+}
+
+// Select the counters of the current contexts and mix their predictions
+func (this *CMXPredictor) predict() {
+	c := this.c0
+	this.slots[0] = &this.order0[c]
+	this.slots[1] = &this.order1[(this.c4&0xFF)<<8|c]
+	this.slots[2] = &this.order2[this.h2|c]
+	this.slots[3] = &this.order4[this.h4|c]
+	w := this.weights[int(c)*_CMX_INPUTS:]
+
+	for i, s := range this.slots {
+		this.inputs[i] = int32(kanzi.STRETCH[*s>>4])
+	}
+
+	this.mixed = kanzi.Squash(int(cmxDot(w[0:_CMX_INPUTS], &this.inputs) >> 16))
+}
+
+// Portable mixer kernels
+func cmxDotDefault(w []int32, inputs *[_CMX_INPUTS]int32) int64 {
+	dot := int64(0)
+
+	for i := range inputs {
+		dot += int64(w[i]) * int64(inputs[i])
+	}
+
+	return dot
+}
+
+func cmxTrainDefault(w []int32, inputs *[_CMX_INPUTS]int32, err int32) {
+	for i := range inputs {
+		w[i] += (inputs[i]*err + 0x8000) >> 16
+	}
+}
+
+// Mixer kernels for wide cores: process the inputs in pairs with two
+// independent accumulators (one bounds check per pair)
+func cmxDotWide(w []int32, inputs *[_CMX_INPUTS]int32) int64 {
+	dot0, dot1 := int64(0), int64(0)
+	i := 0
+
+	for ; i+1 < len(inputs); i += 2 {
+		ww := w[i : i+2 : i+2]
+		dot0 += int64(ww[0]) * int64(inputs[i])
+		dot1 += int64(ww[1]) * int64(inputs[i+1])
+	}
+
+	if i < len(inputs) {
+		dot0 += int64(w[i]) * int64(inputs[i])
+	}
+
+	return dot0 + dot1
+}
+
+func cmxTrainWide(w []int32, inputs *[_CMX_INPUTS]int32, err int32) {
+	i := 0
+
+	for ; i+1 < len(inputs); i += 2 {
+		ww := w[i : i+2 : i+2]
+		ww[0] += (inputs[i]*err + 0x8000) >> 16
+		ww[1] += (inputs[i+1]*err + 0x8000) >> 16
+	}
+
+	if i < len(inputs) {
+		w[i] += (inputs[i]*err + 0x8000) >> 16
+	}
+}
+
+// Get returns the value representing the probability of the next bit being
+// 1 (in the [0..4095] range).
+func (this *CMXPredictor) Get() int {
+	return this.pr
+}
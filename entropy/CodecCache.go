@@ -0,0 +1,157 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// ResettableEncoder an entropy encoder that can be reused to encode a new
+// block without allocating its tables again
+type ResettableEncoder interface {
+	kanzi.EntropyEncoder
+
+	// Reset restores the state of a new encoder writing to the provided
+	// bitstream. Must be called after Dispose (if the previous block was
+	// encoded).
+	Reset(bs kanzi.OutputBitStream) error
+}
+
+// ResettableDecoder an entropy decoder that can be reused to decode a new
+// block without allocating its tables again
+type ResettableDecoder interface {
+	kanzi.EntropyDecoder
+
+	// Reset restores the state of a new decoder reading from the provided
+	// bitstream. Must be called after Dispose (if the previous block was
+	// decoded).
+	Reset(bs kanzi.InputBitStream) error
+}
+
+// A predictor that can restore its initial probabilities
+type resettablePredictor interface {
+	kanzi.Predictor
+	Reset()
+}
+
+// EncoderCache keeps the entropy encoders used by a worker (one per entropy
+// type) to reuse them from block to block. The encoders that cannot be reset
+// (EG. the TPAQ encoders which depend on the block size) are created for
+// each block, as well as the encoders of the blocks that start with the
+// options of the codec (see HasEntropyOptions). A cache must not be used by
+// concurrent goroutines.
+type EncoderCache struct {
+	encoders map[uint32]ResettableEncoder
+}
+
+// NewEncoderCache creates a new empty instance of EncoderCache
+func NewEncoderCache() *EncoderCache {
+	return &EncoderCache{encoders: make(map[uint32]ResettableEncoder)}
+}
+
+// Get returns an entropy encoder of the provided type writing to the
+// bitstream: the cached instance reset for a new block if possible, a new
+// instance otherwise.
+func (this *EncoderCache) Get(obs kanzi.OutputBitStream, ctx map[string]interface{},
+	entropyType uint32) (kanzi.EntropyEncoder, error) {
+	if ee, exists := this.encoders[entropyType]; exists == true {
+		if err := ee.Reset(obs); err == nil {
+			return ee, nil
+		}
+
+		delete(this.encoders, entropyType)
+	}
+
+	ee, err := NewEntropyEncoder(obs, ctx, entropyType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// A reset encoder would not write the options of the block
+	if isResettable(entropyType) == true && HasEntropyOptions(ctx, entropyType) == false {
+		if ree, ok := ee.(ResettableEncoder); ok == true {
+			this.encoders[entropyType] = ree
+		}
+	}
+
+	return ee, nil
+}
+
+// Clear releases the cached encoders
+func (this *EncoderCache) Clear() {
+	this.encoders = make(map[uint32]ResettableEncoder)
+}
+
+// DecoderCache keeps the entropy decoders used by a worker (one per entropy
+// type) to reuse them from block to block. The decoders that cannot be reset
+// (EG. the TPAQ decoders which depend on the block size) are created for
+// each block, as well as the decoders of the blocks that start with the
+// options of the codec. A cache must not be used by concurrent goroutines.
+type DecoderCache struct {
+	decoders map[uint32]ResettableDecoder
+}
+
+// NewDecoderCache creates a new empty instance of DecoderCache
+func NewDecoderCache() *DecoderCache {
+	return &DecoderCache{decoders: make(map[uint32]ResettableDecoder)}
+}
+
+// Get returns an entropy decoder of the provided type reading from the
+// bitstream: the cached instance reset for a new block if possible, a new
+// instance otherwise.
+func (this *DecoderCache) Get(ibs kanzi.InputBitStream, ctx map[string]interface{},
+	entropyType uint32) (kanzi.EntropyDecoder, error) {
+	if ed, exists := this.decoders[entropyType]; exists == true {
+		if err := ed.Reset(ibs); err == nil {
+			return ed, nil
+		}
+
+		delete(this.decoders, entropyType)
+	}
+
+	ed, err := NewEntropyDecoder(ibs, ctx, entropyType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if isResettable(entropyType) == true && HasEntropyOptions(ctx, entropyType) == false {
+		if red, ok := ed.(ResettableDecoder); ok == true {
+			this.decoders[entropyType] = red
+		}
+	}
+
+	return ed, nil
+}
+
+// Clear releases the cached decoders
+func (this *DecoderCache) Clear() {
+	this.decoders = make(map[uint32]ResettableDecoder)
+}
+
+// Return true if the codecs of the provided type do not depend on the
+// block parameters (other than the bitstream) and can be reset
+func isResettable(entropyType uint32) bool {
+	switch entropyType {
+	case HUFFMAN_TYPE, ANS0_TYPE, ANS1_TYPE, RANGE_TYPE, FPAQ_TYPE, CM_TYPE, CMX_TYPE,
+		RANS0_TYPE, RANS1_TYPE, AHUFFMAN_TYPE, RLE_TYPE, AUTO_TYPE:
+		return true
+
+	default:
+		return false
+	}
+}
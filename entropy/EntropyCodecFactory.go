@@ -16,6 +16,7 @@ limitations under the License.
 package entropy
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
@@ -23,19 +24,35 @@ import (
 )
 
 const (
-	NONE_TYPE    = uint32(0) // No compression
-	HUFFMAN_TYPE = uint32(1) // Huffman
-	FPAQ_TYPE    = uint32(2) // Fast PAQ (order 0)
-	PAQ_TYPE     = uint32(3) // Obsolete
-	RANGE_TYPE   = uint32(4) // Range
-	ANS0_TYPE    = uint32(5) // Asymmetric Numerical System order 0
-	CM_TYPE      = uint32(6) // Context Model
-	TPAQ_TYPE    = uint32(7) // Tangelo PAQ
-	ANS1_TYPE    = uint32(8) // Asymmetric Numerical System order 1
-	TPAQX_TYPE   = uint32(9) // Tangelo PAQ Extra
+	NONE_TYPE     = uint32(0)  // No compression
+	HUFFMAN_TYPE  = uint32(1)  // Huffman
+	FPAQ_TYPE     = uint32(2)  // Fast PAQ (order 0)
+	PAQ_TYPE      = uint32(3)  // Obsolete
+	RANGE_TYPE    = uint32(4)  // Range
+	ANS0_TYPE     = uint32(5)  // Asymmetric Numerical System order 0
+	CM_TYPE       = uint32(6)  // Context Model
+	TPAQ_TYPE     = uint32(7)  // Tangelo PAQ
+	ANS1_TYPE     = uint32(8)  // Asymmetric Numerical System order 1
+	TPAQX_TYPE    = uint32(9)  // Tangelo PAQ Extra
+	CMX_TYPE      = uint32(10) // Context Mixing (between CM and TPAQ)
+	RANS0_TYPE    = uint32(11) // Interleaved Asymmetric Numerical System order 0
+	RANS1_TYPE    = uint32(12) // Interleaved Asymmetric Numerical System order 1
+	AHUFFMAN_TYPE = uint32(13) // Adaptive Huffman
+	RLE_TYPE      = uint32(14) // Run length of the most probable symbol
+	AUTO_TYPE     = uint32(15) // Best of AutoCandidates, selected for each block
 )
 
 // NewEntropyDecoder creates a new entropy decoder using the provided type and bitstream
+// The CM, CMX and TPAQ predictors are instrumented if the map contains a
+// "modelSink" entry (see ModelSink and the optional "modelSampling" entry).
+// If the map contains a "tpaqModels", "tpaq:extra", "tpaq:mix2" or
+// "tpaq:warm" entry, the TPAQ options of the block are read from the
+// bitstream (the values of the entries are ignored). The blocks coded with
+// a warm model require the shared model ("tpaqShared" entry, see
+// TPAQSharedModel). Likewise, the CM options are read from the bitstream if
+// the map contains a "cm:order2" entry.
+// If the map contains an "entropy:lanes" entry, the blocks of the binary
+// codecs are decoded as lanes (see BinaryLanesDecoder).
 func NewEntropyDecoder(ibs kanzi.InputBitStream, ctx map[string]interface{},
 	entropyType uint32) (kanzi.EntropyDecoder, error) {
 	switch entropyType {
@@ -43,30 +60,104 @@ func NewEntropyDecoder(ibs kanzi.InputBitStream, ctx map[string]interface{},
 	case HUFFMAN_TYPE:
 		return NewHuffmanDecoder(ibs)
 
+	case AHUFFMAN_TYPE:
+		return NewAdaptiveHuffmanDecoder(ibs)
+
+	case RLE_TYPE:
+		return NewRLEDecoder(ibs)
+
+	case AUTO_TYPE:
+		return NewAutoDecoder(ibs, ctx)
+
 	case ANS0_TYPE:
 		return NewANSRangeDecoder(ibs, 0)
 
 	case ANS1_TYPE:
 		return NewANSRangeDecoder(ibs, 1)
 
+	case RANS0_TYPE:
+		return NewRANSDecoder(ibs, 0)
+
+	case RANS1_TYPE:
+		return NewRANSDecoder(ibs, 1)
+
 	case RANGE_TYPE:
 		return NewRangeDecoder(ibs)
 
 	case FPAQ_TYPE:
 		predictor, _ := NewFPAQPredictor()
-		return NewBinaryEntropyDecoder(ibs, predictor)
+		return newBinaryDecoder(ibs, ctx, predictor, newFPAQLanePredictor)
 
 	case CM_TYPE:
-		predictor, _ := NewCMPredictor()
-		return NewBinaryEntropyDecoder(ibs, predictor)
+		if HasCMOptions(ctx) == true {
+			// Options selected by the encoder (do not modify the caller's map)
+			blockCtx := make(map[string]interface{}, len(ctx))
 
-	case TPAQ_TYPE:
-		predictor, _ := NewTPAQPredictor(&ctx)
-		return NewBinaryEntropyDecoder(ibs, predictor)
+			for k, v := range ctx {
+				blockCtx[k] = v
+			}
 
-	case TPAQX_TYPE:
-		predictor, _ := NewTPAQPredictor(&ctx)
-		return NewBinaryEntropyDecoder(ibs, predictor)
+			blockCtx["cm:order2"] = ibs.ReadBits(8)&_CM_ORDER2 != 0
+			ctx = blockCtx
+		}
+
+		predictor, err := NewCMPredictorWithCtx(&ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err = setModelSink(predictor, ctx); err != nil {
+			return nil, err
+		}
+
+		return newBinaryDecoder(ibs, ctx, predictor, newCMLanePredictor(ctx))
+
+	case CMX_TYPE:
+		predictor, _ := NewCMXPredictor()
+
+		if err := setModelSink(predictor, ctx); err != nil {
+			return nil, err
+		}
+
+		return newBinaryDecoder(ibs, ctx, predictor, newCMXLanePredictor)
+
+	case TPAQ_TYPE, TPAQX_TYPE:
+		if HasTPAQOptions(ctx) == true {
+			// Options selected by the encoder (do not modify the caller's map)
+			blockCtx := make(map[string]interface{}, len(ctx))
+
+			for k, v := range ctx {
+				blockCtx[k] = v
+			}
+
+			blockCtx["tpaqModels"] = int(ibs.ReadBits(8))
+			options := ibs.ReadBits(8)
+			blockCtx["tpaq:extra"] = options&_TPAQ_EXTRA_MODELS != 0
+			blockCtx["tpaq:mix2"] = options&_TPAQ_MIX2 != 0
+			blockCtx["tpaq:warm"] = options&_TPAQ_WARM != 0
+			ctx = blockCtx
+
+			if _, ok := ctx["tpaqShared"].(*TPAQSharedModel); ok == false && options&_TPAQ_WARM != 0 {
+				return nil, errors.New("Cannot decode a TPAQ block coded with the model of the previous blocks: no shared model")
+			}
+		}
+
+		predictor, warm, err := getBlockTPAQPredictor(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if warm == true && HasEntropyLanes(ctx, entropyType) == true {
+			return nil, kanzi.NewCorruptStreamError("Invalid bitstream: TPAQ block coded with lanes and the model of the previous blocks")
+		}
+
+		if err = setModelSink(predictor, ctx); err != nil {
+			return nil, err
+		}
+
+		return newBinaryDecoder(ibs, ctx, predictor, newTPAQLanePredictor(ctx))
 
 	case NONE_TYPE:
 		return NewNullEntropyDecoder(ibs)
@@ -77,37 +168,147 @@ func NewEntropyDecoder(ibs kanzi.InputBitStream, ctx map[string]interface{},
 }
 
 // NewEntropyEncoder creates a new entropy encoder using the provided type and bitstream
+// The CM, CMX and TPAQ predictors are instrumented if the map contains a
+// "modelSink" entry (see ModelSink and the optional "modelSampling" entry).
+// If the map contains a "tpaqModels", "tpaq:extra", "tpaq:mix2" or
+// "tpaq:warm" entry, the TPAQ options (models mask and option flags, 8 bits
+// each) are written to the bitstream before the block. With "tpaq:warm",
+// the block is coded with the shared model if the map contains one
+// ("tpaqShared" entry, see TPAQSharedModel).
+// If the map contains a "cm:order2" entry, the CM options (8 bits: 1 means
+// order 2 context) are written to the bitstream before the block.
+// If the map contains an "entropy:lanes" entry (uint in [1..16]), the blocks
+// of the binary codecs are coded as up to that many lanes, decoded
+// concurrently (see BinaryLanesEncoder).
+// If the map contains an "entropyStats" entry (see StatsCollector), the
+// blocks written by the encoder are registered in the collector.
 func NewEntropyEncoder(obs kanzi.OutputBitStream, ctx map[string]interface{},
+	entropyType uint32) (kanzi.EntropyEncoder, error) {
+	collector, err := getStatsCollector(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ee, err := newEntropyEncoder(obs, ctx, entropyType)
+
+	if err != nil || collector == nil {
+		return ee, err
+	}
+
+	codec := GetName(entropyType)
+
+	// The AUTO encoder registers the codec selected for each block
+	if entropyType == AUTO_TYPE {
+		codec = ""
+	}
+
+	return &statsEncoder{EntropyEncoder: ee, collector: collector, codec: codec}, nil
+}
+
+func newEntropyEncoder(obs kanzi.OutputBitStream, ctx map[string]interface{},
 	entropyType uint32) (kanzi.EntropyEncoder, error) {
 	switch entropyType {
 
 	case HUFFMAN_TYPE:
 		return NewHuffmanEncoder(obs)
 
+	case AHUFFMAN_TYPE:
+		return NewAdaptiveHuffmanEncoder(obs)
+
+	case RLE_TYPE:
+		return NewRLEEncoder(obs)
+
+	case AUTO_TYPE:
+		return NewAutoEncoder(obs, ctx)
+
 	case ANS0_TYPE:
 		return NewANSRangeEncoder(obs, 0)
 
 	case ANS1_TYPE:
 		return NewANSRangeEncoder(obs, 1)
 
+	case RANS0_TYPE:
+		return NewRANSEncoder(obs, 0)
+
+	case RANS1_TYPE:
+		return NewRANSEncoder(obs, 1)
+
 	case RANGE_TYPE:
 		return NewRangeEncoder(obs)
 
 	case FPAQ_TYPE:
 		predictor, _ := NewFPAQPredictor()
-		return NewBinaryEntropyEncoder(obs, predictor)
+		return newBinaryEncoder(obs, ctx, predictor, newFPAQLanePredictor)
 
 	case CM_TYPE:
-		predictor, _ := NewCMPredictor()
-		return NewBinaryEntropyEncoder(obs, predictor)
+		predictor, err := NewCMPredictorWithCtx(&ctx)
 
-	case TPAQ_TYPE:
-		predictor, _ := NewTPAQPredictor(&ctx)
-		return NewBinaryEntropyEncoder(obs, predictor)
+		if err != nil {
+			return nil, err
+		}
 
-	case TPAQX_TYPE:
-		predictor, _ := NewTPAQPredictor(&ctx)
-		return NewBinaryEntropyEncoder(obs, predictor)
+		if err = setModelSink(predictor, ctx); err != nil {
+			return nil, err
+		}
+
+		if HasCMOptions(ctx) == true {
+			options := uint64(0)
+
+			if predictor.order2 != nil {
+				options |= _CM_ORDER2
+			}
+
+			obs.WriteBits(options, 8)
+		}
+
+		return newBinaryEncoder(obs, ctx, predictor, newCMLanePredictor(ctx))
+
+	case CMX_TYPE:
+		predictor, _ := NewCMXPredictor()
+
+		if err := setModelSink(predictor, ctx); err != nil {
+			return nil, err
+		}
+
+		return newBinaryEncoder(obs, ctx, predictor, newCMXLanePredictor)
+
+	case TPAQ_TYPE, TPAQX_TYPE:
+		predictor, warm, err := getBlockTPAQPredictor(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The lanes of a block cannot share a model
+		if warm == true && HasEntropyLanes(ctx, entropyType) == true {
+			return nil, errors.New("The TPAQ blocks coded with lanes cannot use the model of the previous blocks")
+		}
+
+		if err = setModelSink(predictor, ctx); err != nil {
+			return nil, err
+		}
+
+		if HasTPAQOptions(ctx) == true {
+			options := uint64(0)
+
+			if predictor.extraModels == true {
+				options |= _TPAQ_EXTRA_MODELS
+			}
+
+			if predictor.mix2 == true {
+				options |= _TPAQ_MIX2
+			}
+
+			if warm == true {
+				options |= _TPAQ_WARM
+			}
+
+			obs.WriteBits(uint64(predictor.models), 8)
+			obs.WriteBits(options, 8)
+		}
+
+		return newBinaryEncoder(obs, ctx, predictor, newTPAQLanePredictor(ctx))
 
 	case NONE_TYPE:
 		return NewNullEntropyEncoder(obs)
@@ -139,6 +340,24 @@ func GetName(entropyType uint32) string {
 	case CM_TYPE:
 		return "CM"
 
+	case CMX_TYPE:
+		return "CMX"
+
+	case RANS0_TYPE:
+		return "RANS0"
+
+	case RANS1_TYPE:
+		return "RANS1"
+
+	case AHUFFMAN_TYPE:
+		return "AHUFFMAN"
+
+	case RLE_TYPE:
+		return "RLE"
+
+	case AUTO_TYPE:
+		return "AUTO"
+
 	case TPAQ_TYPE:
 		return "TPAQ"
 
@@ -175,6 +394,24 @@ func GetType(entropyName string) uint32 {
 	case "CM":
 		return CM_TYPE
 
+	case "CMX":
+		return CMX_TYPE
+
+	case "RANS0":
+		return RANS0_TYPE
+
+	case "RANS1":
+		return RANS1_TYPE
+
+	case "AHUFFMAN":
+		return AHUFFMAN_TYPE
+
+	case "RLE":
+		return RLE_TYPE
+
+	case "AUTO":
+		return AUTO_TYPE
+
 	case "TPAQ":
 		return TPAQ_TYPE
 
@@ -188,3 +425,122 @@ func GetType(entropyName string) uint32 {
 		panic(fmt.Errorf("Unsupported entropy codec type: '%s'", entropyName))
 	}
 }
+
+// HasTPAQOptions returns true if the map selects TPAQ options (stored in
+// the bitstream before each TPAQ block)
+func HasTPAQOptions(ctx map[string]interface{}) bool {
+	for _, key := range [...]string{"tpaqModels", "tpaq:extra", "tpaq:mix2", "tpaq:warm"} {
+		if _, containsKey := ctx[key]; containsKey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasCMOptions returns true if the map selects CM options (stored in the
+// bitstream before each CM block)
+func HasCMOptions(ctx map[string]interface{}) bool {
+	_, containsKey := ctx["cm:order2"]
+	return containsKey
+}
+
+// HasEntropyOptions returns true if the blocks coded with the provided
+// entropy codec start with the options of the codec selected by the map
+func HasEntropyOptions(ctx map[string]interface{}, entropyType uint32) bool {
+	switch entropyType {
+	case TPAQ_TYPE, TPAQX_TYPE:
+		return HasTPAQOptions(ctx)
+
+	case CM_TYPE:
+		return HasCMOptions(ctx)
+
+	default:
+		return false
+	}
+}
+
+// HasEntropyLanes returns true if the blocks coded with the provided entropy
+// codec are split into lanes ("entropy:lanes" entry of the map, see
+// BinaryLanesEncoder). Only the binary entropy codecs support lanes.
+func HasEntropyLanes(ctx map[string]interface{}, entropyType uint32) bool {
+	switch entropyType {
+	case FPAQ_TYPE, CM_TYPE, CMX_TYPE, TPAQ_TYPE, TPAQX_TYPE:
+		_, containsKey := ctx["entropy:lanes"]
+		return containsKey
+
+	default:
+		return false
+	}
+}
+
+// Return the predictors of the lanes of a block: the provided predictor
+// (already configured for the block) first, then new ones
+func lanePredictors(first kanzi.Predictor, newPredictor PredictorFactory) PredictorFactory {
+	return func() (kanzi.Predictor, error) {
+		if first != nil {
+			p := first
+			first = nil
+			return p, nil
+		}
+
+		return newPredictor()
+	}
+}
+
+func newFPAQLanePredictor() (kanzi.Predictor, error) {
+	return NewFPAQPredictor()
+}
+
+func newCMXLanePredictor() (kanzi.Predictor, error) {
+	return NewCMXPredictor()
+}
+
+func newCMLanePredictor(ctx map[string]interface{}) PredictorFactory {
+	return func() (kanzi.Predictor, error) {
+		return NewCMPredictorWithCtx(&ctx)
+	}
+}
+
+func newTPAQLanePredictor(ctx map[string]interface{}) PredictorFactory {
+	return func() (kanzi.Predictor, error) {
+		return acquireTPAQPredictor(&ctx)
+	}
+}
+
+// Return a binary entropy encoder, coding the blocks as lanes if the map
+// selects lanes
+func newBinaryEncoder(obs kanzi.OutputBitStream, ctx map[string]interface{},
+	predictor kanzi.Predictor, newPredictor PredictorFactory) (kanzi.EntropyEncoder, error) {
+	val, containsKey := ctx["entropy:lanes"]
+
+	if containsKey == false {
+		return NewBinaryEntropyEncoder(obs, predictor)
+	}
+
+	lanes, _ := val.(uint)
+	ee, err := NewBinaryLanesEncoder(obs, lanePredictors(predictor, newPredictor), lanes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ee, nil
+}
+
+// Return a binary entropy decoder, decoding the blocks as lanes if the map
+// selects lanes (the number of lanes is read from the bitstream)
+func newBinaryDecoder(ibs kanzi.InputBitStream, ctx map[string]interface{},
+	predictor kanzi.Predictor, newPredictor PredictorFactory) (kanzi.EntropyDecoder, error) {
+	if _, containsKey := ctx["entropy:lanes"]; containsKey == false {
+		return NewBinaryEntropyDecoder(ibs, predictor)
+	}
+
+	ed, err := NewBinaryLanesDecoder(ibs, lanePredictors(predictor, newPredictor))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ed, nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/flanglet/kanzi-go/bitstream"
+)
+
+const (
+	_SELECT_MAX_SAMPLE_SIZE = 64 * 1024
+	_SELECT_CHUNKS          = 4
+)
+
+// Entropy codecs tried by SelectBest by default. TPAQ and TPAQX are left
+// out: too slow and too big to be trial-encoded for every block.
+var _AUTO_CANDIDATES = []uint32{NONE_TYPE, HUFFMAN_TYPE, ANS0_TYPE, ANS1_TYPE,
+	RANGE_TYPE, FPAQ_TYPE, CM_TYPE, RLE_TYPE}
+
+// AutoCandidates returns the entropy codecs tried by SelectBest by default
+// (and by the AUTO codec)
+func AutoCandidates() []uint32 {
+	res := make([]uint32, len(_AUTO_CANDIDATES))
+	copy(res, _AUTO_CANDIDATES)
+	return res
+}
+
+// Sink discarding the data written (only the size of the trial output matters)
+type discardStream struct {
+}
+
+func (this discardStream) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (this discardStream) Close() error {
+	return nil
+}
+
+// Return a sample of the block: the whole block or chunks spread over the
+// block
+func selectSample(block []byte) []byte {
+	if len(block) <= _SELECT_MAX_SAMPLE_SIZE {
+		return block
+	}
+
+	chunkSize := _SELECT_MAX_SAMPLE_SIZE / _SELECT_CHUNKS
+	step := (len(block) - chunkSize) / (_SELECT_CHUNKS - 1)
+	res := make([]byte, 0, _SELECT_MAX_SAMPLE_SIZE)
+
+	for i := 0; i < _SELECT_CHUNKS; i++ {
+		res = append(res, block[i*step:i*step+chunkSize]...)
+	}
+
+	return res
+}
+
+// TrialEncode returns the number of bits written by the entropy codec of the
+// provided type to encode the block
+func TrialEncode(block []byte, entropyType uint32) (uint64, error) {
+	if entropyType == AUTO_TYPE {
+		return 0, errors.New("Cannot trial-encode with the AUTO entropy codec")
+	}
+
+	obs, err := bitstream.NewDefaultOutputBitStream(discardStream{}, 16384)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := make(map[string]interface{})
+	ctx["size"] = uint(len(block))
+	ctx["blockSize"] = uint(len(block))
+	ee, err := NewEntropyEncoder(obs, ctx, entropyType)
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = ee.Write(block)
+	ee.Dispose()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = obs.Close(); err != nil {
+		return 0, err
+	}
+
+	return obs.Written(), nil
+}
+
+// SelectBest trial-encodes a sample of the block (at most 64 KB) with each
+// candidate entropy codec and returns the type of the codec producing the
+// smallest output (the first one in case of tie). If candidates is nil, the
+// codecs returned by AutoCandidates are tried.
+func SelectBest(block []byte, candidates []uint32) (uint32, error) {
+	if candidates == nil {
+		candidates = _AUTO_CANDIDATES
+	}
+
+	if len(candidates) == 0 {
+		return 0, errors.New("No entropy codec to select from")
+	}
+
+	if block == nil {
+		return 0, errors.New("Invalid null block parameter")
+	}
+
+	sample := selectSample(block)
+	best := candidates[0]
+	bestSize := uint64(0)
+
+	for i, t := range candidates {
+		size, err := TrialEncode(sample, t)
+
+		if err != nil {
+			return 0, fmt.Errorf("Trial encoding failed for entropy codec %d: %v", t, err)
+		}
+
+		if i == 0 || size < bestSize {
+			best = t
+			bestSize = size
+		}
+	}
+
+	return best, nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"math"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// EntropyStats statistics of the blocks coded by the entropy encoders
+// attached to a StatsCollector
+type EntropyStats struct {
+	Blocks        uint64            // number of blocks (Write calls)
+	Symbols       uint64            // number of bytes coded
+	Counts        [256]uint64       // occurrences of each byte
+	EstimatedBits float64           // sum of the order 0 entropies of the blocks
+	ActualBits    uint64            // bits written by the encoders
+	ModelBits     uint64            // bits sampled from the models (CM, CMX, TPAQ)
+	ModelHits     uint64            // sampled bits predicted correctly (probability > 1/2)
+	Codecs        map[string]uint64 // number of blocks per codec (codec selected by AUTO)
+}
+
+// BitsPerSymbol returns the average number of bits written per byte
+func (this EntropyStats) BitsPerSymbol() float64 {
+	if this.Symbols == 0 {
+		return 0
+	}
+
+	return float64(this.ActualBits) / float64(this.Symbols)
+}
+
+// HitRate returns the ratio of the sampled bits predicted correctly by the
+// models (0 if no sample)
+func (this EntropyStats) HitRate() float64 {
+	if this.ModelBits == 0 {
+		return 0
+	}
+
+	return float64(this.ModelHits) / float64(this.ModelBits)
+}
+
+// StatsCollector accumulates the statistics of the entropy encoders created
+// with the collector in the context map ("entropyStats" entry, see
+// NewEntropyEncoder). The encoders of concurrent blocks may share a
+// collector. The collector is also the model sink of the CM, CMX and TPAQ
+// predictors unless the map contains a "modelSink" entry.
+type StatsCollector struct {
+	mutex sync.Mutex
+	stats EntropyStats
+}
+
+// NewStatsCollector creates a new empty instance of StatsCollector
+func NewStatsCollector() *StatsCollector {
+	this := &StatsCollector{}
+	this.stats.Codecs = make(map[string]uint64)
+	return this
+}
+
+// Stats returns a copy of the statistics collected so far
+func (this *StatsCollector) Stats() EntropyStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	res := this.stats
+	res.Codecs = make(map[string]uint64, len(this.stats.Codecs))
+
+	for k, v := range this.stats.Codecs {
+		res.Codecs[k] = v
+	}
+
+	return res
+}
+
+// Reset clears the statistics
+func (this *StatsCollector) Reset() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stats = EntropyStats{Codecs: make(map[string]uint64)}
+}
+
+// Sample registers the predictions of a model (see ModelSink)
+func (this *StatsCollector) Sample(sample *ModelSample) {
+	hits := uint64(0)
+
+	for i, p := range sample.Probs {
+		bit := int(sample.Value>>uint(7-i)) & 1
+
+		if (p >= 2048) == (bit == 1) {
+			hits++
+		}
+	}
+
+	this.mutex.Lock()
+	this.stats.ModelBits += 8
+	this.stats.ModelHits += hits
+	this.mutex.Unlock()
+}
+
+// Register the block coded by the named codec
+func (this *StatsCollector) addBlock(codec string, block []byte, bits uint64) {
+	var freqs [256]int
+	kanzi.ComputeHistogram(block, freqs[:], true, false)
+	estimate := 0.0
+	n := float64(len(block))
+
+	for _, f := range &freqs {
+		if f > 0 {
+			estimate -= float64(f) * math.Log2(float64(f)/n)
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stats.Blocks++
+	this.stats.Symbols += uint64(len(block))
+	this.stats.EstimatedBits += estimate
+	this.stats.ActualBits += bits
+
+	if codec != "" {
+		this.stats.Codecs[codec]++
+	}
+
+	for i, f := range &freqs {
+		this.stats.Counts[i] += uint64(f)
+	}
+}
+
+// Register the bits written by an encoder after the blocks (EG. flush of the
+// binary entropy encoders)
+func (this *StatsCollector) addBits(bits uint64) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stats.ActualBits += bits
+}
+
+// Register the codec selected for a block by the AUTO encoder
+func (this *StatsCollector) addSelection(codec string) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.stats.Codecs[codec]++
+}
+
+// Return the collector of the context map (nil if none)
+func getStatsCollector(ctx map[string]interface{}) (*StatsCollector, error) {
+	val, containsKey := ctx["entropyStats"]
+
+	if containsKey == false || val == nil {
+		return nil, nil
+	}
+
+	collector, ok := val.(*StatsCollector)
+
+	if ok == false || collector == nil {
+		return nil, errors.New("Invalid entropy stats: expected a *StatsCollector")
+	}
+
+	return collector, nil
+}
+
+// Entropy encoder registering the blocks written by another encoder
+type statsEncoder struct {
+	kanzi.EntropyEncoder
+	collector *StatsCollector
+	codec     string
+}
+
+func (this *statsEncoder) Write(block []byte) (int, error) {
+	written := this.BitStream().Written()
+	n, err := this.EntropyEncoder.Write(block)
+
+	if err == nil {
+		this.collector.addBlock(this.codec, block, this.BitStream().Written()-written)
+	}
+
+	return n, err
+}
+
+func (this *statsEncoder) Dispose() {
+	written := this.BitStream().Written()
+	this.EntropyEncoder.Dispose()
+	this.collector.addBits(this.BitStream().Written() - written)
+}
@@ -261,7 +261,7 @@ func DecodeAlphabet(ibs kanzi.InputBitStream, alphabet []int) (int, error) {
 		}
 
 		if alphabetSize > len(alphabet) {
-			return alphabetSize, fmt.Errorf("Invalid bitstream: incorrect alphabet size: %v", alphabetSize)
+			return alphabetSize, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect alphabet size: %v", alphabetSize))
 		}
 
 		// Full alphabet
@@ -307,7 +307,7 @@ func DecodeAlphabet(ibs kanzi.InputBitStream, alphabet []int) (int, error) {
 		alphabetSize := 1 << uint(ibs.ReadBits(4))
 
 		if alphabetSize > len(alphabet) {
-			return alphabetSize, fmt.Errorf("Invalid bitstream: incorrect alphabet size: %v", alphabetSize)
+			return alphabetSize, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect alphabet size: %v", alphabetSize))
 		}
 
 		// Read missing symbols
@@ -362,19 +362,12 @@ func ComputeFirstOrderEntropy1024(block []byte, histo []int) int {
 	}
 
 	kanzi.ComputeHistogram(block, histo, true, false)
-	sum := uint64(0)
-	logLength1024, _ := kanzi.Log2_1024(uint32(len(block)))
-
-	for i := 0; i < 256; i++ {
-		if histo[i] == 0 {
-			continue
-		}
-
-		log1024, _ := kanzi.Log2_1024(uint32(histo[i]))
-		sum += ((uint64(histo[i]) * uint64(logLength1024-log1024)) >> 3)
-	}
+	return computeEntropy1024(histo, len(block))
+}
 
-	return int(sum / uint64(len(block)))
+// Order 0 entropy scaled by 1024 from the histogram of 'length' symbols
+func computeEntropy1024(histo []int, length int) int {
+	return kanzi.ComputeEntropy1024(histo, length)
 }
 
 // NormalizeFrequencies scales the frequencies so that their sum equals 'scale'.
@@ -31,13 +31,18 @@ type FPAQPredictor struct {
 // NewFPAQPredictor creates a new instance of FPAQPredictor
 func NewFPAQPredictor() (*FPAQPredictor, error) {
 	this := &FPAQPredictor{}
+	this.Reset()
+	return this, nil
+}
+
+// Reset restores the initial probabilities (EG. to reuse the predictor for
+// a new block)
+func (this *FPAQPredictor) Reset() {
 	this.ctxIdx = 1
 
 	for i := range this.probs {
 		this.probs[i] = _PSCALE >> 1
 	}
-
-	return this, nil
 }
 
 // Update updates the internal probability model based on the observed bit
@@ -60,3 +65,81 @@ func (this *FPAQPredictor) Update(bit byte) {
 func (this *FPAQPredictor) Get() int {
 	return this.probs[this.ctxIdx] >> 4
 }
+
+// PredictByte stores the probabilities of the 8 bits of val in probs and
+// updates the model with these bits
+func (this *FPAQPredictor) PredictByte(val byte, probs *[8]int) {
+	this.codeByte(val, probs, nil)
+}
+
+// DecodeByte decodes the next 8 bits with the provided decoder and updates
+// the model with these bits
+func (this *FPAQPredictor) DecodeByte(ed *BinaryEntropyDecoder) byte {
+	return this.codeByte(0, nil, ed)
+}
+
+// Encode (probabilities of the bits of val) or decode (bits from ed) a byte.
+// The context of the partial byte and the interval of the decoder stay in
+// registers.
+func (this *FPAQPredictor) codeByte(val byte, probs *[8]int, ed *BinaryEntropyDecoder) byte {
+	if this.ctxIdx != 1 {
+		// Bit by bit (not at a byte boundary)
+		res := byte(0)
+
+		for i := uint(0); i < 8; i++ {
+			bit := (val >> (7 - i)) & 1
+
+			if ed != nil {
+				bit = ed.DecodeBitWithProb(this.Get())
+			} else {
+				probs[i] = this.Get()
+			}
+
+			this.Update(bit)
+			res = (res << 1) | bit
+		}
+
+		return res
+	}
+
+	ctx := 1
+
+	if ed == nil {
+		for i := uint(0); i < 8; i++ {
+			p := &this.probs[ctx]
+			bit := int(val>>(7-i)) & 1
+			probs[i] = *p >> 4
+			*p -= ((*p - (-bit & _PSCALE)) >> 6) + bit
+			ctx = (ctx << 1) + bit
+		}
+
+		this.ctxIdx = 1
+		return val
+	}
+
+	low, high, current := ed.low, ed.high, ed.current
+
+	for ctx < 256 {
+		p := &this.probs[ctx]
+		split := ((((high - low) >> 4) * uint64(*p>>4)) >> 8) + low
+
+		// Update the probability in the branches (real branch, see CMPredictor)
+		if split >= current {
+			high = split
+			*p -= ((*p - _PSCALE) >> 6) + 1
+			ctx = (ctx << 1) + 1
+		} else {
+			low = split + 1
+			*p -= *p >> 6
+			ctx <<= 1
+		}
+
+		if (low^high)>>24 == 0 {
+			low, high, current = ed.refill(low, high, current)
+		}
+	}
+
+	ed.low, ed.high, ed.current = low, high, current
+	this.ctxIdx = 1
+	return byte(ctx)
+}
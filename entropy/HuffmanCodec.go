@@ -18,7 +18,6 @@ package entropy
 import (
 	"errors"
 	"fmt"
-	"sort"
 
 	kanzi "github.com/flanglet/kanzi-go"
 )
@@ -84,30 +83,31 @@ func generateCanonicalCodes(sizes []byte, codes []uint, symbols []int) int {
 // HuffmanEncoder  Implementation of a static Huffman encoder.
 // Uses in place generation of canonical codes instead of a tree
 type HuffmanEncoder struct {
-	bitstream     kanzi.OutputBitStream
-	codes         [256]uint
-	alphabet      [256]int
-	sranks        [256]int
-	chunkSize     int
-	maxCodeLength int
+	bitstream       kanzi.OutputBitStream
+	codes           [256]uint
+	alphabet        [256]int
+	chunkSize       int
+	maxCodeLength   int  // longest code of the current chunk
+	codeLengthLimit uint // max code length allowed
 }
 
 // NewHuffmanEncoder creates an instance of HuffmanEncoder.
 // Since the number of args is variable, this function can be called like this:
-// NewHuffmanEncoder(bs) or NewHuffmanEncoder(bs, 16384) (the second argument
-// being the chunk size)
+// NewHuffmanEncoder(bs), NewHuffmanEncoder(bs, 16384) (the second argument
+// being the chunk size) or NewHuffmanEncoder(bs, 16384, 12) (the third
+// argument being the max code length, in [8..18], 18 by default)
 func NewHuffmanEncoder(bs kanzi.OutputBitStream, args ...uint) (*HuffmanEncoder, error) {
 	if bs == nil {
 		return nil, errors.New("Huffman codec: Invalid null bitstream parameter")
 	}
 
-	if len(args) > 1 {
-		return nil, errors.New("Huffman codec: At most one chunk size can be provided")
+	if len(args) > 2 {
+		return nil, errors.New("Huffman codec: At most one chunk size and one max code length can be provided")
 	}
 
 	chkSize := _HUF_MAX_CHUNK_SIZE
 
-	if len(args) == 1 {
+	if len(args) >= 1 {
 		chkSize = args[0]
 
 		if chkSize < 1024 {
@@ -119,9 +119,21 @@ func NewHuffmanEncoder(bs kanzi.OutputBitStream, args ...uint) (*HuffmanEncoder,
 		}
 	}
 
+	maxLength := uint(HUF_MAX_CODE_LENGTH)
+
+	if len(args) == 2 {
+		maxLength = args[1]
+
+		if maxLength < HUF_MIN_MAX_CODE_LENGTH || maxLength > HUF_MAX_CODE_LENGTH {
+			return nil, fmt.Errorf("Huffman codec: The max code length must be in [%d..%d]",
+				HUF_MIN_MAX_CODE_LENGTH, HUF_MAX_CODE_LENGTH)
+		}
+	}
+
 	this := new(HuffmanEncoder)
 	this.bitstream = bs
 	this.chunkSize = int(chkSize)
+	this.codeLengthLimit = maxLength
 
 	// Default frequencies, sizes and codes
 	for i := 0; i < 256; i++ {
@@ -131,56 +143,62 @@ func NewHuffmanEncoder(bs kanzi.OutputBitStream, args ...uint) (*HuffmanEncoder,
 	return this, nil
 }
 
+// Reset prepares the encoder to write a new block to the provided bitstream
+// (the codes are rebuilt for each chunk)
+func (this *HuffmanEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("Huffman codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+
+	for i := 0; i < 256; i++ {
+		this.codes[i] = uint(i)
+	}
+
+	return nil
+}
+
 // Rebuild Huffman codes
 func (this *HuffmanEncoder) updateFrequencies(frequencies []int) (int, error) {
 	if frequencies == nil || len(frequencies) != 256 {
 		return 0, errors.New("Huffman codec: Invalid frequencies parameter")
 	}
 
-	count := 0
 	var sizes [256]byte
+	count, err := ComputeHuffmanCodeLengths(frequencies, sizes[:], this.codeLengthLimit)
 
-	for i := range &this.codes {
-		this.codes[i] = 0
-
-		if frequencies[i] > 0 {
-			this.alphabet[count] = i
-			count++
-		}
-	}
-
-	symbols := this.alphabet[0:count]
-
-	if _, err := EncodeAlphabet(this.bitstream, symbols); err != nil {
+	if err != nil {
 		return count, err
 	}
 
 	// Transmit code lengths only, frequencies and codes do not matter
-	// Unary encode the length differences
-	if err := this.computeCodeLengths(frequencies, sizes[:], count); err != nil {
+	if _, err = WriteHuffmanLengths(this.bitstream, sizes[:]); err != nil {
 		return count, err
 	}
 
-	egenc, err := NewExpGolombEncoder(this.bitstream, true)
+	n := 0
+	this.maxCodeLength = 0
 
-	if err != nil {
-		return count, err
-	}
+	for i := range &this.codes {
+		this.codes[i] = 0
 
-	prevSize := byte(2)
+		if sizes[i] > 0 {
+			this.alphabet[n] = i
+			n++
 
-	for _, s := range symbols {
-		currSize := sizes[s]
-		egenc.EncodeByte(currSize - prevSize)
-		prevSize = currSize
+			if this.maxCodeLength < int(sizes[i]) {
+				this.maxCodeLength = int(sizes[i])
+			}
+		}
 	}
 
-	if generateCanonicalCodes(sizes[:], this.codes[:], this.sranks[0:count]) < 0 {
+	if generateCanonicalCodes(sizes[:], this.codes[:], this.alphabet[0:count]) < 0 {
 		return count, fmt.Errorf("Could not generate Huffman codes: max code length (%v bits) exceeded", _HUF_MAX_SYMBOL_SIZE)
 	}
 
 	// Pack size and code (size <= _HUF_MAX_SYMBOL_SIZE bits)
-	for _, s := range symbols {
+	for _, s := range this.alphabet[0:count] {
 		this.codes[s] |= (uint(sizes[s]) << 24)
 	}
 
@@ -189,49 +207,6 @@ func (this *HuffmanEncoder) updateFrequencies(frequencies []int) (int, error) {
 
 // See [In-Place Calculation of Minimum-Redundancy Codes]
 // by Alistair Moffat & Jyrki Katajainen
-func (this *HuffmanEncoder) computeCodeLengths(frequencies []int, sizes []byte, count int) error {
-	if count == 1 {
-		this.sranks[0] = this.alphabet[0]
-		sizes[this.alphabet[0]] = 1
-		return nil
-	}
-
-	// Sort ranks by increasing frequencies (first key) and increasing value (second key)
-	for i := 0; i < count; i++ {
-		this.sranks[i] = (frequencies[this.alphabet[i]] << 8) | this.alphabet[i]
-	}
-
-	sort.Ints(this.sranks[0:count])
-	buf := make([]int, count)
-
-	for i := range buf {
-		buf[i] = this.sranks[i] >> 8
-		this.sranks[i] &= 0xFF
-	}
-
-	computeInPlaceSizesPhase1(buf)
-	computeInPlaceSizesPhase2(buf)
-	var err error
-	this.maxCodeLength = 0
-
-	for i := range buf {
-		codeLen := byte(buf[i])
-
-		if codeLen == 0 || codeLen > _HUF_MAX_SYMBOL_SIZE {
-			err = fmt.Errorf("Could not generate Huffman codes: max code length (%v bits) exceeded", _HUF_MAX_SYMBOL_SIZE)
-			break
-		}
-
-		if this.maxCodeLength > buf[i] {
-			this.maxCodeLength = buf[i]
-		}
-
-		sizes[this.sranks[i]] = codeLen
-	}
-
-	return err
-}
-
 func computeInPlaceSizesPhase1(data []int) {
 	n := len(data)
 
@@ -388,7 +363,7 @@ type HuffmanDecoder struct {
 	codes      [256]uint
 	alphabet   [256]int
 	sizes      [256]byte
-	table0     []uint16 // small decoding table: code -> size, symbol
+	table0     []uint32 // small decoding table: code -> total size, count, 1 or 2 symbols
 	table1     []uint16 // big decoding table: code -> size, symbol
 	chunkSize  int
 	state      uint64 // holds bits read from bitstream
@@ -425,7 +400,7 @@ func NewHuffmanDecoder(bs kanzi.InputBitStream, args ...uint) (*HuffmanDecoder,
 
 	this := new(HuffmanDecoder)
 	this.bitstream = bs
-	this.table0 = make([]uint16, 1<<_HUF_DECODING_BATCH_SIZE)
+	this.table0 = make([]uint32, 1<<_HUF_DECODING_BATCH_SIZE)
 	this.table1 = make([]uint16, 1<<(_HUF_MAX_SYMBOL_SIZE+1))
 	this.chunkSize = int(chkSize)
 	this.minCodeLen = 8
@@ -439,42 +414,47 @@ func NewHuffmanDecoder(bs kanzi.InputBitStream, args ...uint) (*HuffmanDecoder,
 	return this, nil
 }
 
+// Reset prepares the decoder to read a new block from the provided bitstream.
+// The decoding tables are kept (they are rebuilt for each chunk).
+func (this *HuffmanDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("Huffman codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	this.state = 0
+	this.bits = 0
+	this.minCodeLen = 8
+
+	for i := 0; i < 256; i++ {
+		this.sizes[i] = 8
+		this.codes[i] = uint(i)
+	}
+
+	return nil
+}
+
 // ReadLengths decodes the code lengths from the bitstream and generates
 // the Huffman codes for decoding.
 func (this *HuffmanDecoder) ReadLengths() (int, error) {
-	count, err := DecodeAlphabet(this.bitstream, this.alphabet[:])
+	count, err := ReadHuffmanLengths(this.bitstream, this.sizes[:])
 
 	if count == 0 || err != nil {
 		return count, err
 	}
 
-	egdec, err := NewExpGolombDecoder(this.bitstream, true)
-
-	if err != nil {
-		return 0, err
-	}
-
-	prevSize := int8(2)
-	symbols := this.alphabet[0:count]
-
-	// Read lengths
-	for i, s := range symbols {
-		if s > len(this.codes) {
-			return 0, fmt.Errorf("Invalid bitstream: incorrect Huffman symbol %v", s)
-		}
+	n := 0
 
+	for s := range &this.codes {
 		this.codes[s] = 0
-		currSize := prevSize + int8(egdec.DecodeByte())
 
-		if currSize <= 0 || currSize > _HUF_MAX_SYMBOL_SIZE {
-			return 0, fmt.Errorf("Invalid bitstream: incorrect size %v for Huffman symbol %v", currSize, i)
+		if this.sizes[s] > 0 {
+			this.alphabet[n] = s
+			n++
 		}
-
-		this.sizes[s] = byte(currSize)
-		prevSize = currSize
 	}
 
-	if generateCanonicalCodes(this.sizes[:], this.codes[:], symbols) < 0 {
+	if generateCanonicalCodes(this.sizes[:], this.codes[:], this.alphabet[0:count]) < 0 {
 		return count, fmt.Errorf("Could not generate Huffman codes: max code length (%v bits) exceeded", _HUF_MAX_SYMBOL_SIZE)
 	}
 
@@ -483,10 +463,8 @@ func (this *HuffmanDecoder) ReadLengths() (int, error) {
 }
 
 func (this *HuffmanDecoder) buildDecodingTables(count int) {
-	for i := range this.table0 {
-		this.table0[i] = 0
-	}
-
+	// Single symbol table of the codes of at most DECODING_BATCH_SIZE bits
+	var single [1 << _HUF_DECODING_BATCH_SIZE]uint16
 	this.minCodeLen = this.sizes[this.alphabet[0]]
 	maxSize := this.sizes[this.alphabet[count-1]]
 	t1 := this.table1[0 : 2<<maxSize]
@@ -516,7 +494,7 @@ func (this *HuffmanDecoder) buildDecodingTables(count int) {
 			end := (code + 1) << (_HUF_DECODING_BATCH_SIZE - length)
 
 			for idx < end {
-				this.table0[idx] = uint16(val)
+				single[idx] = uint16(val)
 				idx++
 			}
 		} else {
@@ -530,11 +508,39 @@ func (this *HuffmanDecoder) buildDecodingTables(count int) {
 		}
 
 	}
+
+	// Multi-symbol table: a second symbol is decoded with the same lookup if
+	// its code fits in the bits left by the first one
+	for idx := range this.table0 {
+		val1 := uint32(single[idx])
+
+		if val1 == 0 {
+			this.table0[idx] = 0
+			continue
+		}
+
+		len1 := val1 >> 8
+		entry := (1 << 24) | (len1 << 16) | (val1 & 0xFF)
+		val2 := uint32(single[(idx<<len1)&_HUF_DECODING_MASK0])
+
+		if val2 != 0 && len1+(val2>>8) <= _HUF_DECODING_BATCH_SIZE {
+			entry = (2 << 24) | ((len1 + (val2 >> 8)) << 16) | ((val2 & 0xFF) << 8) | (val1 & 0xFF)
+		}
+
+		this.table0[idx] = entry
+	}
 }
 
 // Read decodes data from the bitstream and return it in the provided buffer.
 // Return the number of bytes read from the bitstream
-func (this *HuffmanDecoder) Read(block []byte) (int, error) {
+func (this *HuffmanDecoder) Read(block []byte) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n = 0
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: corrupted data in Huffman decoder (%v)", r))
+		}
+	}()
+
 	if block == nil {
 		return 0, errors.New("Huffman codec: Invalid null block parameter")
 	}
@@ -552,10 +558,17 @@ func (this *HuffmanDecoder) Read(block []byte) (int, error) {
 
 	for startChunk < end {
 		// Reinitialize the Huffman tables
-		if r, err := this.ReadLengths(); r == 0 || err != nil {
+		r, err := this.ReadLengths()
+
+		if err != nil {
 			return startChunk, err
 		}
 
+		if r == 0 {
+			// Symbols are still expected for this block
+			return startChunk, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: empty alphabet in Huffman decoder, %d symbols missing", end-startChunk))
+		}
+
 		endChunk := startChunk + this.chunkSize
 
 		if endChunk > end {
@@ -569,26 +582,39 @@ func (this *HuffmanDecoder) Read(block []byte) (int, error) {
 			endPaddingSize++
 		}
 
-		endChunk8 := startChunk
+		endChunkFast := startChunk
 
 		if endChunk > startChunk+endPaddingSize {
-			endChunk8 += ((endChunk - endPaddingSize - startChunk) & -8)
+			endChunkFast = endChunk - endPaddingSize
 		}
 
-		// Fast decoding
-		for i := startChunk; i < endChunk8; i += 8 {
-			block[i] = this.fastDecodeByte()
-			block[i+1] = this.fastDecodeByte()
-			block[i+2] = this.fastDecodeByte()
-			block[i+3] = this.fastDecodeByte()
-			block[i+4] = this.fastDecodeByte()
-			block[i+5] = this.fastDecodeByte()
-			block[i+6] = this.fastDecodeByte()
-			block[i+7] = this.fastDecodeByte()
+		i := startChunk
+
+		// Fast decoding: 1 or 2 symbols per lookup in the small table (the
+		// second byte written is overwritten by the next symbol if unused)
+		for i < endChunkFast {
+			if this.bits < _HUF_DECODING_BATCH_SIZE {
+				read := this.bitstream.ReadBits(uint(64 - this.bits))
+				this.state = (this.state << (64 - this.bits)) | read
+				this.bits = 64
+			}
+
+			val := this.table0[int(this.state>>(this.bits-_HUF_DECODING_BATCH_SIZE))&_HUF_DECODING_MASK0]
+
+			if val == 0 {
+				block[i] = this.decodeLongCode()
+				i++
+				continue
+			}
+
+			block[i] = byte(val)
+			block[i+1] = byte(val >> 8)
+			this.bits -= uint16(val>>16) & 0xFF
+			i += int(val >> 24)
 		}
 
 		// Fallback to regular decoding (read one bit at a time)
-		for i := endChunk8; i < endChunk; i++ {
+		for ; i < endChunk; i++ {
 			block[i] = this.slowDecodeByte()
 		}
 
@@ -618,30 +644,18 @@ func (this *HuffmanDecoder) slowDecodeByte() byte {
 		}
 	}
 
-	panic(errors.New("Invalid bitstream: incorrect Huffman code"))
+	panic(kanzi.NewCorruptStreamError("Invalid bitstream: incorrect Huffman code"))
 }
 
-func (this *HuffmanDecoder) fastDecodeByte() byte {
-	if this.bits < _HUF_DECODING_BATCH_SIZE {
+// Decode a code longer than DECODING_BATCH_SIZE bits with the big table
+func (this *HuffmanDecoder) decodeLongCode() byte {
+	if this.bits < _HUF_MAX_SYMBOL_SIZE+1 {
 		read := this.bitstream.ReadBits(uint(64 - this.bits))
 		this.state = (this.state << (64 - this.bits)) | read
 		this.bits = 64
 	}
 
-	// Use small table
-	val := this.table0[int(this.state>>(this.bits-_HUF_DECODING_BATCH_SIZE))&_HUF_DECODING_MASK0]
-
-	if val == 0 {
-		if this.bits < _HUF_MAX_SYMBOL_SIZE+1 {
-			read := this.bitstream.ReadBits(uint(64 - this.bits))
-			this.state = (this.state << (64 - this.bits)) | read
-			this.bits = 64
-		}
-
-		// Fallback to big table
-		val = this.table1[int(this.state>>(this.bits-_HUF_MAX_SYMBOL_SIZE-1))&_HUF_DECODING_MASK1]
-	}
-
+	val := this.table1[int(this.state>>(this.bits-_HUF_MAX_SYMBOL_SIZE-1))&_HUF_DECODING_MASK1]
 	this.bits -= (val >> 8)
 	return byte(val)
 }
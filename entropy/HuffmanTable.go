@@ -0,0 +1,258 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Canonical Huffman tables of byte symbols: code lengths limited to a max
+// length, canonical codes and serialization of the code lengths (as used by
+// the Huffman codec).
+
+const (
+	HUF_MIN_MAX_CODE_LENGTH = 8                    // 256 symbols need codes of 8 bits
+	HUF_MAX_CODE_LENGTH     = _HUF_MAX_SYMBOL_SIZE // max code length supported by the codec
+)
+
+// ComputeHuffmanCodeLengths computes the Huffman code lengths of the symbols
+// with a positive frequency (frequencies and sizes have 256 entries). The
+// lengths do not exceed maxLength (in [8..18]): the distribution is
+// flattened until they fit. The size of the absent symbols is 0. Return the
+// number of symbols with a code.
+func ComputeHuffmanCodeLengths(frequencies []int, sizes []byte, maxLength uint) (int, error) {
+	if len(frequencies) != 256 || len(sizes) != 256 {
+		return 0, errors.New("Huffman table: The frequencies and sizes must have 256 entries")
+	}
+
+	if maxLength < HUF_MIN_MAX_CODE_LENGTH || maxLength > HUF_MAX_CODE_LENGTH {
+		return 0, fmt.Errorf("Huffman table: The max code length must be in [%d..%d]",
+			HUF_MIN_MAX_CODE_LENGTH, HUF_MAX_CODE_LENGTH)
+	}
+
+	var freqs [256]int
+	var ranks [256]int
+	count := 0
+
+	for i, f := range frequencies {
+		sizes[i] = 0
+
+		if f < 0 {
+			return 0, fmt.Errorf("Huffman table: Invalid negative frequency for symbol %d", i)
+		}
+
+		if f > 0 {
+			freqs[count] = f
+			ranks[count] = i
+			count++
+		}
+	}
+
+	if count <= 1 {
+		if count == 1 {
+			sizes[ranks[0]] = 1
+		}
+
+		return count, nil
+	}
+
+	symbols := ranks[0:count]
+	buf := make([]int, count)
+
+	for {
+		// Sort ranks by increasing frequencies (first key) and increasing value
+		// (second key)
+		for i := range symbols {
+			symbols[i] = (freqs[i] << 8) | (symbols[i] & 0xFF)
+		}
+
+		sort.Ints(symbols)
+
+		for i := range symbols {
+			freqs[i] = symbols[i] >> 8
+			symbols[i] &= 0xFF
+			buf[i] = freqs[i]
+		}
+
+		computeInPlaceSizesPhase1(buf)
+		computeInPlaceSizesPhase2(buf)
+
+		// The least frequent symbol has the longest code
+		if uint(buf[0]) <= maxLength {
+			break
+		}
+
+		for i := range symbols {
+			freqs[i] = (freqs[i] + 1) >> 1
+		}
+	}
+
+	for i, s := range symbols {
+		sizes[s] = byte(buf[i])
+	}
+
+	return count, nil
+}
+
+// GenerateHuffmanCodes generates the canonical codes of the symbols from the
+// code lengths (sizes and codes have 256 entries, the code of a symbol of
+// size 0 is 0). Return the number of codes generated.
+func GenerateHuffmanCodes(sizes []byte, codes []uint) (int, error) {
+	if len(sizes) != 256 || len(codes) != 256 {
+		return 0, errors.New("Huffman table: The sizes and codes must have 256 entries")
+	}
+
+	var buf [256]int
+	count := 0
+
+	for s := range codes {
+		codes[s] = 0
+
+		if sizes[s] > HUF_MAX_CODE_LENGTH {
+			return 0, fmt.Errorf("Huffman table: Invalid code length %d for symbol %d", sizes[s], s)
+		}
+
+		if sizes[s] > 0 {
+			buf[count] = s
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	if checkKraft(sizes, buf[0:count]) == false {
+		return 0, errors.New("Huffman table: The code lengths do not describe a prefix code")
+	}
+
+	return generateCanonicalCodes(sizes, codes, buf[0:count]), nil
+}
+
+// Return true if the code lengths of the symbols verify the Kraft
+// inequality: sum(2^-len) <= 1
+func checkKraft(sizes []byte, symbols []int) bool {
+	kraft := uint64(0)
+
+	for _, s := range symbols {
+		kraft += uint64(1) << (_HUF_MAX_SYMBOL_SIZE - uint(sizes[s]))
+	}
+
+	return kraft <= uint64(1)<<_HUF_MAX_SYMBOL_SIZE
+}
+
+// WriteHuffmanLengths writes the code lengths of the symbols (256 entries,
+// 0 for the absent symbols) to the bitstream: the alphabet followed by the
+// differences of consecutive lengths (Exp-Golomb coded). Return the number
+// of symbols written.
+func WriteHuffmanLengths(obs kanzi.OutputBitStream, sizes []byte) (int, error) {
+	if len(sizes) != 256 {
+		return 0, errors.New("Huffman table: The sizes must have 256 entries")
+	}
+
+	var alphabet [256]int
+	count := 0
+
+	for s := range alphabet {
+		if sizes[s] > HUF_MAX_CODE_LENGTH {
+			return 0, fmt.Errorf("Huffman table: Invalid code length %d for symbol %d", sizes[s], s)
+		}
+
+		if sizes[s] > 0 {
+			alphabet[count] = s
+			count++
+		}
+	}
+
+	symbols := alphabet[0:count]
+
+	if _, err := EncodeAlphabet(obs, symbols); err != nil {
+		return 0, err
+	}
+
+	egenc, err := NewExpGolombEncoder(obs, true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	prevSize := byte(2)
+
+	for _, s := range symbols {
+		egenc.EncodeByte(sizes[s] - prevSize)
+		prevSize = sizes[s]
+	}
+
+	return count, nil
+}
+
+// ReadHuffmanLengths reads the code lengths written by WriteHuffmanLengths
+// (sizes has 256 entries, set to 0 for the absent symbols). The lengths are
+// checked (prefix code). Return the number of symbols read.
+func ReadHuffmanLengths(ibs kanzi.InputBitStream, sizes []byte) (int, error) {
+	if len(sizes) != 256 {
+		return 0, errors.New("Huffman table: The sizes must have 256 entries")
+	}
+
+	var alphabet [256]int
+	count, err := DecodeAlphabet(ibs, alphabet[:])
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range sizes {
+		sizes[i] = 0
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	egdec, err := NewExpGolombDecoder(ibs, true)
+
+	if err != nil {
+		return 0, err
+	}
+
+	prevSize := int8(2)
+	symbols := alphabet[0:count]
+
+	for i, s := range symbols {
+		if s >= len(sizes) {
+			return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect Huffman symbol %v", s))
+		}
+
+		currSize := prevSize + int8(egdec.DecodeByte())
+
+		if currSize <= 0 || currSize > _HUF_MAX_SYMBOL_SIZE {
+			return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect size %v for Huffman symbol %v", currSize, i))
+		}
+
+		sizes[s] = byte(currSize)
+		prevSize = currSize
+	}
+
+	if checkKraft(sizes, symbols) == false {
+		return 0, kanzi.NewCorruptStreamError("Invalid bitstream: incorrect Huffman code lengths")
+	}
+
+	return count, nil
+}
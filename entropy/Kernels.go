@@ -0,0 +1,42 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"github.com/flanglet/kanzi-go/internal/cpuinfo"
+)
+
+// Mixer kernels of the CMX predictor, selected at startup based on the CPU
+// features
+var (
+	cmxDot   func(w []int32, inputs *[_CMX_INPUTS]int32) int64
+	cmxTrain func(w []int32, inputs *[_CMX_INPUTS]int32, err int32)
+)
+
+func init() {
+	cpuinfo.Register(selectKernels)
+}
+
+func selectKernels(f cpuinfo.Features) {
+	// AVX2 capable cores can retire the two multiply chains in parallel
+	if f.AVX2 == true {
+		cmxDot = cmxDotWide
+		cmxTrain = cmxTrainWide
+	} else {
+		cmxDot = cmxDotDefault
+		cmxTrain = cmxTrainDefault
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ModelSample the decisions of a context model predictor (TPAQ, CM) for one
+// coded byte. Used for offline analysis of the models (EG. to find the
+// contexts that predict poorly on a given corpus).
+type ModelSample struct {
+	Predictor string  // "TPAQ", "TPAQX", "CM" or "CMX"
+	Position  int64   // index of the byte since the creation (or reset) of the predictor
+	Value     byte    // coded byte
+	Probs     [8]int  // predicted probability of a 1 for each bit (msb first) in [0..4095]
+	Cost      float64 // coding cost of the byte in bits
+	Inputs    []int32 // predictions of the models for the last bit (TPAQ, CMX: stretched, CM: in [0..4095])
+	Weights   []int32 // weights of the model predictions for the last bit
+}
+
+// ModelSink receives the samples of an instrumented predictor. The sample
+// is reused by the predictor after the call: it must be copied if retained.
+// The tasks of a compressed stream encode (or decode) blocks concurrently:
+// Sample may be called concurrently by the predictors of different blocks.
+type ModelSink interface {
+	Sample(sample *ModelSample)
+}
+
+// Collect the probabilities predicted for the bits of the sampled bytes
+type modelProbe struct {
+	sink     ModelSink
+	sampling int64 // 1 byte out of 'sampling' is sampled
+	sample   ModelSample
+	bitPos   uint
+}
+
+func newModelProbe(sink ModelSink, sampling uint, predictor string) (*modelProbe, error) {
+	if sink == nil {
+		return nil, errors.New("Invalid null model sink parameter")
+	}
+
+	if sampling == 0 {
+		return nil, errors.New("Invalid model sampling parameter: must be at least 1")
+	}
+
+	this := &modelProbe{sink: sink, sampling: int64(sampling)}
+	this.sample.Predictor = predictor
+	return this, nil
+}
+
+// Register the probability of a 1 predicted for the next bit and the actual
+// bit. Returns true when the last bit of a sampled byte has been registered.
+func (this *modelProbe) update(bit byte, p int) bool {
+	sampled := this.sample.Position%this.sampling == 0
+
+	if sampled == true {
+		this.sample.Probs[this.bitPos] = p
+		this.sample.Value = (this.sample.Value << 1) | bit
+
+		if bit == 0 {
+			p = 4096 - p
+		}
+
+		if p < 1 {
+			p = 1
+		}
+
+		this.sample.Cost -= math.Log2(float64(p) / 4096)
+	}
+
+	this.bitPos++
+	return sampled == true && this.bitPos == 8
+}
+
+// Send the sample of the current byte (if sampled) and move to the next byte
+func (this *modelProbe) next() {
+	if this.bitPos != 8 {
+		return
+	}
+
+	if this.sample.Position%this.sampling == 0 {
+		this.sink.Sample(&this.sample)
+	}
+
+	this.bitPos = 0
+	this.sample.Position++
+	this.sample.Value = 0
+	this.sample.Cost = 0
+}
+
+func (this *modelProbe) reset() {
+	this.bitPos = 0
+	this.sample.Position = 0
+	this.sample.Value = 0
+	this.sample.Cost = 0
+}
+
+// An instrumentable predictor
+type sampledPredictor interface {
+	SetModelSink(sink ModelSink, sampling uint) error
+}
+
+// Attach the model sink provided in the context map ("modelSink" with an
+// optional "modelSampling", 1 by default) to the predictor. The stats
+// collector ("entropyStats") is the default sink.
+func setModelSink(predictor sampledPredictor, ctx map[string]interface{}) error {
+	val, containsKey := ctx["modelSink"]
+
+	if containsKey == false || val == nil {
+		collector, err := getStatsCollector(ctx)
+
+		if collector == nil || err != nil {
+			return err
+		}
+
+		val = collector
+	}
+
+	sink, ok := val.(ModelSink)
+
+	if ok == false {
+		return fmt.Errorf("Invalid model sink: %T does not implement ModelSink", val)
+	}
+
+	sampling := uint(1)
+
+	if val, containsKey := ctx["modelSampling"]; containsKey {
+		sampling = val.(uint)
+	}
+
+	return predictor.SetModelSink(sink, sampling)
+}
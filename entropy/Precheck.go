@@ -0,0 +1,216 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"bytes"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	// FORMAT_INCOMPRESSIBLE_THRESHOLD Entropy*1024 threshold used instead of
+	// INCOMPRESSIBLE_THRESHOLD when the data starts with the magic number of
+	// a compressed format (headers and metadata lower the sampled entropy)
+	FORMAT_INCOMPRESSIBLE_THRESHOLD = 900
+
+	_PRECHECK_MIN_SAMPLE_SIZE = 4 * 1024
+	_PRECHECK_MAX_SAMPLE_SIZE = 64 * 1024
+	_PRECHECK_CHUNKS          = 4
+)
+
+// A magic number shorter than 3 bytes is too easily matched by chance: the
+// header fields following it must be checked as well.
+type magicNumber struct {
+	name   string
+	offset int
+	magic  []byte
+	check  func(block []byte) bool // validates the header (may be nil)
+}
+
+// Magic numbers of common compressed formats
+var _COMPRESSED_FORMATS = []magicNumber{
+	{"KANZI", 0, []byte{0x4B, 0x41, 0x4E, 0x5A}, nil},
+	{"GZIP", 0, []byte{0x1F, 0x8B, 0x08}, checkGzipHeader},
+	{"COMPRESS", 0, []byte{0x1F, 0x9D}, checkCompressHeader},
+	{"BZIP2", 0, []byte("BZh"), checkBzip2Header},
+	{"XZ", 0, []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}, nil},
+	{"LZMA", 0, []byte{0x5D, 0x00, 0x00}, nil},
+	{"LZIP", 0, []byte("LZIP"), nil},
+	{"LZOP", 0, []byte{0x89, 0x4C, 0x5A, 0x4F}, nil},
+	{"LZ4", 0, []byte{0x04, 0x22, 0x4D, 0x18}, nil},
+	{"ZSTD", 0, []byte{0x28, 0xB5, 0x2F, 0xFD}, nil},
+	{"SNAPPY", 0, []byte{0xFF, 0x06, 0x00, 0x00, 0x73, 0x4E, 0x61, 0x50, 0x70, 0x59}, nil},
+	{"ZIP", 0, []byte{0x50, 0x4B, 0x03, 0x04}, nil},
+	{"7Z", 0, []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}, nil},
+	{"RAR", 0, []byte{0x52, 0x61, 0x72, 0x21, 0x1A, 0x07}, nil},
+	{"CAB", 0, []byte("MSCF"), nil},
+	{"ARJ", 0, []byte{0x60, 0xEA}, checkArjHeader},
+	{"JPEG", 0, []byte{0xFF, 0xD8, 0xFF}, nil},
+	{"JPEG2000", 0, []byte{0x00, 0x00, 0x00, 0x0C, 0x6A, 0x50, 0x20, 0x20}, nil},
+	{"JPEGXL", 0, []byte{0x00, 0x00, 0x00, 0x0C, 0x4A, 0x58, 0x4C, 0x20}, nil},
+	{"PNG", 0, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}, nil},
+	{"GIF", 0, []byte("GIF8"), nil},
+	{"WEBP", 8, []byte("WEBP"), nil},
+	{"MP4", 4, []byte("ftyp"), nil},                 // also MOV, HEIC, AVIF, M4A
+	{"MKV", 0, []byte{0x1A, 0x45, 0xDF, 0xA3}, nil}, // also WEBM
+	{"MP3", 0, []byte("ID3"), nil},
+	{"MP3", 0, []byte{0xFF, 0xFB}, checkMP3Frames},
+	{"AAC", 0, []byte{0xFF, 0xF1}, checkADTSFrames},
+	{"OGG", 0, []byte("OggS"), nil},
+	{"FLAC", 0, []byte("fLaC"), nil},
+	{"WOFF2", 0, []byte("wOF2"), nil},
+	{"SWF", 0, []byte("CWS"), nil},
+	{"SWF", 0, []byte("ZWS"), nil},
+}
+
+// DetectCompressedFormat returns the name of the compressed format identified
+// by the magic number at the start of the block or an empty string.
+func DetectCompressedFormat(block []byte) string {
+	for _, f := range _COMPRESSED_FORMATS {
+		end := f.offset + len(f.magic)
+
+		if end <= len(block) && bytes.Equal(block[f.offset:end], f.magic) {
+			if f.check == nil || f.check(block) == true {
+				return f.name
+			}
+		}
+	}
+
+	return ""
+}
+
+// Reserved flags must be 0
+func checkGzipHeader(block []byte) bool {
+	return len(block) >= 10 && block[3]&0xE0 == 0
+}
+
+// Max code size in [9..16] bits, reserved bits must be 0
+func checkCompressHeader(block []byte) bool {
+	return len(block) >= 3 && block[2]&0x60 == 0 && block[2]&0x1F >= 9 && block[2]&0x1F <= 16
+}
+
+// Block size in [1..9] (x 100 KB)
+func checkBzip2Header(block []byte) bool {
+	return len(block) >= 4 && block[3] >= '1' && block[3] <= '9'
+}
+
+// Main header: size of the basic header at most 2600 bytes, file type 2
+func checkArjHeader(block []byte) bool {
+	if len(block) < 11 {
+		return false
+	}
+
+	size := int(block[2]) | int(block[3])<<8
+	return size > 0 && size <= 2600 && block[10] == 2
+}
+
+// MPEG-1 layer III: the first frame header is valid and the next frame
+// starts where the first one ends
+func checkMP3Frames(block []byte) bool {
+	bitrates := [...]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	sampleRates := [...]int{44100, 48000, 32000, 0}
+
+	if len(block) < 4 {
+		return false
+	}
+
+	bitrate := bitrates[block[2]>>4] * 1000
+	sampleRate := sampleRates[(block[2]>>2)&0x03]
+
+	if bitrate == 0 || sampleRate == 0 {
+		return false
+	}
+
+	next := 144*bitrate/sampleRate + int(block[2]>>1)&0x01
+	return next+2 <= len(block) && block[next] == 0xFF && block[next+1]&0xE0 == 0xE0
+}
+
+// ADTS (AAC): the first frame header is valid and the next frame starts
+// where the first one ends
+func checkADTSFrames(block []byte) bool {
+	if len(block) < 7 || (block[2]>>2)&0x0F > 12 {
+		return false
+	}
+
+	next := int(block[3]&0x03)<<11 | int(block[4])<<3 | int(block[5]>>5)
+	return next >= 7 && next+2 <= len(block) && block[next] == 0xFF && block[next+1]&0xF6 == 0xF0
+}
+
+// PrecheckSampleSize returns the number of bytes sampled by IsIncompressible
+// for a block of the provided size: 1/16 of the block in the [4 KB..64 KB]
+// range (the whole block if it is smaller than 4 KB).
+func PrecheckSampleSize(blockSize int) int {
+	res := blockSize >> 4
+
+	if res < _PRECHECK_MIN_SAMPLE_SIZE {
+		res = _PRECHECK_MIN_SAMPLE_SIZE
+	} else if res > _PRECHECK_MAX_SAMPLE_SIZE {
+		res = _PRECHECK_MAX_SAMPLE_SIZE
+	}
+
+	if res > blockSize {
+		res = blockSize
+	}
+
+	return res
+}
+
+// IsIncompressible estimates the order 0 entropy of the block from
+// sampleSize bytes (taken from chunks spread over the block) and returns
+// true if the block is not worth compressing.
+// The format parameter is the compressed format of the block (as returned
+// by DetectCompressedFormat on the block) or an empty string. A known format
+// lowers the entropy threshold.
+func IsIncompressible(block []byte, sampleSize int, format string) bool {
+	if len(block) == 0 {
+		return false
+	}
+
+	if sampleSize <= 0 || sampleSize > len(block) {
+		sampleSize = len(block)
+	}
+
+	threshold := INCOMPRESSIBLE_THRESHOLD
+
+	if len(format) != 0 {
+		threshold = FORMAT_INCOMPRESSIBLE_THRESHOLD
+	}
+
+	histo := [256]int{}
+	chunkSize := sampleSize / _PRECHECK_CHUNKS
+
+	if sampleSize == len(block) || chunkSize == 0 {
+		return ComputeFirstOrderEntropy1024(block, histo[:]) >= threshold
+	}
+
+	step := (len(block) - chunkSize) / (_PRECHECK_CHUNKS - 1)
+	h := [256]int{}
+	total := 0
+
+	for i := 0; i < _PRECHECK_CHUNKS; i++ {
+		start := i * step
+		kanzi.ComputeHistogram(block[start:start+chunkSize], h[:], true, false)
+
+		for j := range h {
+			histo[j] += h[j]
+		}
+
+		total += chunkSize
+	}
+
+	return computeEntropy1024(histo[:], total) >= threshold
+}
@@ -0,0 +1,251 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Interleaved rANS: each chunk is split in 4 streams of (almost) equal size,
+// each coded with its own ANS state. The 4 states are independent so the
+// streams can be decoded in lockstep (the CPU can overlap the 4 dependency
+// chains and the loop maps to 4 SIMD lanes). The bytes emitted by the 4
+// states share a single buffer. The order 1 context is reset at the start
+// of each stream. The header and frequency tables are the same as the ones
+// of the ANS codec.
+
+// NewRANSEncoder creates an ANS encoder that interleaves 4 states.
+// The arguments are the same as the ones of NewANSRangeEncoder.
+func NewRANSEncoder(bs kanzi.OutputBitStream, args ...uint) (*ANSRangeEncoder, error) {
+	this, err := NewANSRangeEncoder(bs, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.interleaved = true
+	return this, nil
+}
+
+// Order 1 histogram (with totals) where the context of the first symbol of
+// each stream is 0
+func computeHistogram4(block []byte, freqs []int) {
+	for i := range freqs {
+		freqs[i] = 0
+	}
+
+	q := len(block) >> 2
+
+	for k := 0; k < 4; k++ {
+		end := (k + 1) * q
+
+		if k == 3 {
+			end = len(block)
+		}
+
+		prv := 0
+
+		for _, cur := range block[k*q : end] {
+			freqs[prv+int(cur)]++
+			freqs[prv+256]++
+			prv = 257 * int(cur)
+		}
+	}
+}
+
+func (this *ANSRangeEncoder) encodeChunk4(block []byte) {
+	var st [4]int
+	n := len(this.buffer) - 1
+	q := len(block) >> 2
+
+	for k := range st {
+		st[k] = _ANS_TOP
+	}
+
+	// Encode backwards: the tail of the last stream first, then the 4
+	// streams in lockstep
+	for i := len(block) - 1; i >= 4*q; i-- {
+		st[3], n = this.encodeSymbol(block, i, 3*q, st[3], n)
+	}
+
+	for j := q - 1; j >= 0; j-- {
+		for k := 3; k >= 0; k-- {
+			st[k], n = this.encodeSymbol(block, k*q+j, k*q, st[k], n)
+		}
+	}
+
+	n++
+
+	// Write chunk size
+	WriteVarInt(this.bitstream, uint32(len(this.buffer)-n))
+
+	// Write final ANS states
+	for k := range st {
+		this.bitstream.WriteBits(uint64(st[k]), 32)
+	}
+
+	if len(this.buffer) != n {
+		// Write encoded data to bitstream
+		this.bitstream.WriteArray(this.buffer[n:], 8*uint(len(this.buffer)-n))
+	}
+}
+
+// Encode the symbol at index i of the stream starting at index 'start'.
+// Return the new state and buffer index.
+func (this *ANSRangeEncoder) encodeSymbol(block []byte, i, start, st, n int) (int, int) {
+	ctx := 0
+
+	if this.order == 1 && i != start {
+		ctx = int(block[i-1]) << 8
+	}
+
+	sym := &this.symbols[ctx|int(block[i])]
+
+	for st >= sym.xMax {
+		this.buffer[n] = byte(st)
+		st >>= 8
+		this.buffer[n-1] = byte(st)
+		st >>= 8
+		n -= 2
+	}
+
+	// C(s,x) = M floor(x/q_s) + mod(x,q_s) + b_s where b_s = q_0 + ... + q_{s-1}
+	return st + sym.bias + int((uint64(st)*sym.invFreq)>>sym.invShift)*sym.cmplFreq, n
+}
+
+// NewRANSDecoder creates an ANS decoder that interleaves 4 states.
+// The arguments are the same as the ones of NewANSRangeDecoder.
+func NewRANSDecoder(bs kanzi.InputBitStream, args ...uint) (*ANSRangeDecoder, error) {
+	this, err := NewANSRangeDecoder(bs, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.interleaved = true
+	return this, nil
+}
+
+func (this *ANSRangeDecoder) decodeChunk4(block []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: corrupted data in ANS range decoder (%v)", r))
+		}
+	}()
+
+	// Read chunk size
+	sz := int(ReadVarInt(this.bitstream) & (_ANS_MAX_CHUNK_SIZE - 1))
+
+	if sz > len(this.buffer) {
+		return kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect chunk size %d in ANS range decoder", sz))
+	}
+
+	// Read initial ANS states
+	var st [4]int
+
+	for k := range st {
+		st[k] = int(this.bitstream.ReadBits(32))
+	}
+
+	// Read encoded data
+	if sz != 0 {
+		this.bitstream.ReadArray(this.buffer[0:sz], uint(8*sz))
+	}
+
+	// Clear padding to avoid reading stale data on corrupted input
+	for i := sz; i < len(this.buffer) && i < sz+16; i++ {
+		this.buffer[i] = 0
+	}
+
+	var prv [4]int
+	n := 0
+	q := len(block) >> 2
+	lr := this.logRange
+	mask := (1 << lr) - 1
+	shift := 8 * this.order // context shift (the context is always 0 for order 0)
+	f2s, symb, buf := this.f2s, this.symbols, this.buffer
+
+	for j := 0; j < q; j++ {
+		for k := range st {
+			ctx := prv[k]
+			cur := f2s[(ctx<<lr)|(st[k]&mask)]
+			sym := &symb[(ctx<<8)|int(cur)]
+
+			if sym.freq == 0 {
+				return kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: unexpected symbol %d in context %d in ANS range decoder", cur, ctx))
+			}
+
+			block[k*q+j] = cur
+
+			// D(x) = (s, q_s (x/M) + mod(x,M) - b_s) where s is such b_s <= x mod M < b_{s+1}
+			x := sym.freq*(st[k]>>lr) + (st[k] & mask) - sym.cumFreq
+
+			// Normalize
+			for x < _ANS_TOP {
+				x = (x << 16) | int(buf[n])<<8 | int(buf[n+1])
+				n += 2
+			}
+
+			st[k] = x
+			prv[k] = int(cur) << shift >> 8
+		}
+	}
+
+	// Tail of the last stream
+	for i := 4 * q; i < len(block); i++ {
+		if block[i], st[3], n, err = this.decodeSymbol(prv[3], st[3], n); err != nil {
+			return err
+		}
+
+		if this.order == 1 {
+			prv[3] = int(block[i])
+		}
+	}
+
+	// Cross check the number of bytes consumed with the chunk size
+	if n > sz {
+		return kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: read %d bytes, chunk size is %d in ANS range decoder", n, sz))
+	}
+
+	return nil
+}
+
+// Decode the next symbol in context 'ctx' (always 0 for order 0).
+// Return the symbol, the new state and buffer index.
+func (this *ANSRangeDecoder) decodeSymbol(ctx, st, n int) (byte, int, int, error) {
+	lr := this.logRange
+	mask := (1 << lr) - 1
+	cur := this.f2s[(ctx<<lr)|(st&mask)]
+	sym := &this.symbols[(ctx<<8)|int(cur)]
+
+	if sym.freq == 0 {
+		return cur, st, n, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: unexpected symbol %d in context %d in ANS range decoder", cur, ctx))
+	}
+
+	// D(x) = (s, q_s (x/M) + mod(x,M) - b_s) where s is such b_s <= x mod M < b_{s+1}
+	st = sym.freq*(st>>lr) + (st & mask) - sym.cumFreq
+
+	// Normalize
+	for st < _ANS_TOP {
+		st = (st << 8) | int(this.buffer[n])
+		st = (st << 8) | int(this.buffer[n+1])
+		n += 2
+	}
+
+	return cur, st, n, nil
+}
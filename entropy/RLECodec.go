@@ -0,0 +1,265 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Run length entropy codec for near constant data (EG. the output of ZRLT
+// on very redundant data). The block is coded as runs of its most probable
+// symbol (MPS), each run being followed by one escaped symbol (any other
+// value). There is no per symbol modeling: a block of n MPS costs about
+// 2*log2(n) bits.
+//
+// Block format:
+// MPS (8) | literal mode (1) | run (gamma) | literal | run (gamma) | literal ...
+// A run is the number of MPS before the next literal, coded as the Elias
+// gamma code of run+1. The last run of the block is not followed by a
+// literal (and is omitted if the block ends with a literal). The literals
+// are stored either as bytes (mode 0) or as the gamma code of the
+// difference with the MPS (mode 1, small differences are cheaper).
+
+const (
+	_RLE_MAX_GAMMA_BITS = 32 // max number of bits of a value coded with gamma
+)
+
+// RLEEncoder run length entropy encoder
+type RLEEncoder struct {
+	bitstream kanzi.OutputBitStream
+}
+
+// NewRLEEncoder creates an instance of RLEEncoder
+func NewRLEEncoder(bs kanzi.OutputBitStream) (*RLEEncoder, error) {
+	if bs == nil {
+		return nil, errors.New("RLE codec: Invalid null bitstream parameter")
+	}
+
+	this := new(RLEEncoder)
+	this.bitstream = bs
+	return this, nil
+}
+
+// Reset prepares the encoder to write a new block to the provided bitstream
+func (this *RLEEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("RLE codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Write a value >= 1 as an Elias gamma code
+func (this *RLEEncoder) writeGamma(val uint64) {
+	n := uint(bits.Len64(val))
+	this.bitstream.WriteBits(val, 2*n-1) // n-1 leading zeros, then the value
+}
+
+// Write encodes the data provided into the bitstream. Return the number of
+// bytes written to the bitstream.
+func (this *RLEEncoder) Write(block []byte) (int, error) {
+	if block == nil {
+		return 0, errors.New("RLE codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	var freqs [256]int
+	kanzi.ComputeHistogram(block, freqs[:], true, false)
+	mps := 0
+
+	for i := range &freqs {
+		if freqs[i] > freqs[mps] {
+			mps = i
+		}
+	}
+
+	// Select the cheapest literal mode
+	gammaCost := 0
+
+	for i := range &freqs {
+		if i != mps {
+			delta := uint64(byte(i-mps-1)) + 1
+			gammaCost += freqs[i] * (2*bits.Len64(delta) - 1)
+		}
+	}
+
+	gammaMode := gammaCost < 8*(len(block)-freqs[mps])
+	this.bitstream.WriteBits(uint64(mps), 8)
+
+	if gammaMode == true {
+		this.bitstream.WriteBit(1)
+	} else {
+		this.bitstream.WriteBit(0)
+	}
+
+	run := uint64(0)
+
+	for _, val := range block {
+		if int(val) == mps {
+			run++
+			continue
+		}
+
+		this.writeGamma(run + 1)
+		run = 0
+
+		if gammaMode == true {
+			this.writeGamma(uint64(byte(int(val)-mps-1)) + 1)
+		} else {
+			this.bitstream.WriteBits(uint64(val), 8)
+		}
+	}
+
+	if run > 0 {
+		this.writeGamma(run + 1)
+	}
+
+	return len(block), nil
+}
+
+// Dispose this implementation does nothing
+func (this *RLEEncoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *RLEEncoder) BitStream() kanzi.OutputBitStream {
+	return this.bitstream
+}
+
+// RLEDecoder run length entropy decoder
+type RLEDecoder struct {
+	bitstream kanzi.InputBitStream
+}
+
+// NewRLEDecoder creates an instance of RLEDecoder
+func NewRLEDecoder(bs kanzi.InputBitStream) (*RLEDecoder, error) {
+	if bs == nil {
+		return nil, errors.New("RLE codec: Invalid null bitstream parameter")
+	}
+
+	this := new(RLEDecoder)
+	this.bitstream = bs
+	return this, nil
+}
+
+// Reset prepares the decoder to read a new block from the provided bitstream
+func (this *RLEDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("RLE codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
+// Read a value coded as an Elias gamma code
+func (this *RLEDecoder) readGamma() (uint64, error) {
+	n := uint(0)
+
+	for this.bitstream.ReadBit() == 0 {
+		n++
+
+		if n >= _RLE_MAX_GAMMA_BITS {
+			return 0, kanzi.NewCorruptStreamError("Invalid bitstream: incorrect gamma code in RLE decoder")
+		}
+	}
+
+	if n == 0 {
+		return 1, nil
+	}
+
+	return (1 << n) | this.bitstream.ReadBits(n), nil
+}
+
+// Read decodes data from the bitstream and return it in the provided buffer.
+// Return the number of bytes read from the bitstream
+func (this *RLEDecoder) Read(block []byte) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n = 0
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: corrupted data in RLE decoder (%v)", r))
+		}
+	}()
+
+	if block == nil {
+		return 0, errors.New("RLE codec: Invalid null block parameter")
+	}
+
+	if len(block) == 0 {
+		return 0, nil
+	}
+
+	mps := byte(this.bitstream.ReadBits(8))
+	gammaMode := this.bitstream.ReadBit() == 1
+	i := 0
+
+	for i < len(block) {
+		run, err := this.readGamma()
+
+		if err != nil {
+			return i, err
+		}
+
+		if run-1 > uint64(len(block)-i) {
+			return i, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect run length %d in RLE decoder", run-1))
+		}
+
+		for end := i + int(run-1); i < end; i++ {
+			block[i] = mps
+		}
+
+		if i == len(block) {
+			break
+		}
+
+		if gammaMode == true {
+			delta, err := this.readGamma()
+
+			if err != nil {
+				return i, err
+			}
+
+			if delta > 255 {
+				return i, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect literal in RLE decoder"))
+			}
+
+			block[i] = mps + byte(delta)
+		} else {
+			block[i] = byte(this.bitstream.ReadBits(8))
+		}
+
+		i++
+	}
+
+	return len(block), nil
+}
+
+// Dispose this implementation does nothing
+func (this *RLEDecoder) Dispose() {
+}
+
+// BitStream returns the underlying bitstream
+func (this *RLEDecoder) BitStream() kanzi.InputBitStream {
+	return this.bitstream
+}
@@ -91,6 +91,17 @@ func NewRangeEncoder(bs kanzi.OutputBitStream, args ...uint) (*RangeEncoder, err
 	return this, nil
 }
 
+// Reset prepares the encoder to write a new block to the provided bitstream
+// (the statistics are rebuilt for each chunk)
+func (this *RangeEncoder) Reset(bs kanzi.OutputBitStream) error {
+	if bs == nil {
+		return errors.New("Range codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
 func (this *RangeEncoder) updateFrequencies(frequencies []int, size int, lr uint) (int, error) {
 	if frequencies == nil || len(frequencies) != 256 {
 		return 0, errors.New("Range codec: Invalid frequencies parameter")
@@ -318,11 +329,22 @@ func NewRangeDecoder(bs kanzi.InputBitStream, args ...uint) (*RangeDecoder, erro
 	return this, nil
 }
 
+// Reset prepares the decoder to read a new block from the provided bitstream.
+// The mapping frequency -> symbol is kept (it is rebuilt for each chunk).
+func (this *RangeDecoder) Reset(bs kanzi.InputBitStream) error {
+	if bs == nil {
+		return errors.New("Range codec: Invalid null bitstream parameter")
+	}
+
+	this.bitstream = bs
+	return nil
+}
+
 func (this *RangeDecoder) decodeHeader(frequencies []int) (int, error) {
 	alphabetSize, err := DecodeAlphabet(this.bitstream, this.alphabet[:])
 
 	if err != nil || alphabetSize == 0 {
-		return alphabetSize, nil
+		return alphabetSize, err
 	}
 
 	if alphabetSize != 256 {
@@ -351,6 +373,12 @@ func (this *RangeDecoder) decodeHeader(frequencies []int) (int, error) {
 	// Decode all frequencies (but the first one)
 	for i := 1; i < alphabetSize; i += chkSize {
 		logMax := uint(1 + this.bitstream.ReadBits(llr))
+
+		if 1<<logMax > scale {
+			err := kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect frequency size %v in range decoder", logMax))
+			return alphabetSize, err
+		}
+
 		endj := i + chkSize
 
 		if endj > alphabetSize {
@@ -362,7 +390,7 @@ func (this *RangeDecoder) decodeHeader(frequencies []int) (int, error) {
 			val := int(this.bitstream.ReadBits(logMax))
 
 			if val <= 0 || val >= scale {
-				err := fmt.Errorf("Invalid bitstream: incorrect frequency %v for symbol '%v' in range decoder", val, this.alphabet[j])
+				err := kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect frequency %v for symbol '%v' in range decoder", val, this.alphabet[j]))
 				return alphabetSize, err
 			}
 
@@ -373,7 +401,7 @@ func (this *RangeDecoder) decodeHeader(frequencies []int) (int, error) {
 
 	// Infer first frequency
 	if scale <= sum {
-		err := fmt.Errorf("Invalid bitstream: incorrect frequency %v for symbol '%v' in range decoder", frequencies[this.alphabet[0]], this.alphabet[0])
+		err := kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: incorrect frequency %v for symbol '%v' in range decoder", frequencies[this.alphabet[0]], this.alphabet[0]))
 		return alphabetSize, err
 	}
 
@@ -416,10 +444,15 @@ func (this *RangeDecoder) Read(block []byte) (int, error) {
 	for startChunk < end {
 		alphabetSize, err := this.decodeHeader(this.freqs[:])
 
-		if err != nil || alphabetSize == 0 {
+		if err != nil {
 			return startChunk, err
 		}
 
+		if alphabetSize == 0 {
+			// Symbols are still expected for this block
+			return startChunk, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: empty alphabet in range decoder, %d symbols missing", end-startChunk))
+		}
+
 		this.rng = _TOP_RANGE
 		this.low = 0
 		this.code = this.bitstream.ReadBits(60)
@@ -429,10 +462,8 @@ func (this *RangeDecoder) Read(block []byte) (int, error) {
 			endChunk = end
 		}
 
-		buf := block[startChunk:endChunk]
-
-		for i := range buf {
-			buf[i] = this.decodeByte()
+		if err = this.decodeChunk(block[startChunk:endChunk]); err != nil {
+			return startChunk, err
 		}
 
 		startChunk = endChunk
@@ -441,10 +472,34 @@ func (this *RangeDecoder) Read(block []byte) (int, error) {
 	return len(block), nil
 }
 
+func (this *RangeDecoder) decodeChunk(buf []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid bitstream: corrupted data in range decoder (%v)", r))
+		}
+	}()
+
+	for i := range buf {
+		buf[i] = this.decodeByte()
+	}
+
+	return nil
+}
+
 func (this *RangeDecoder) decodeByte() byte {
 	// Compute next low and range
 	this.rng >>= this.shift
+
+	if this.rng == 0 || this.code < this.low {
+		panic(kanzi.NewCorruptStreamError("invalid range state"))
+	}
+
 	count := int((this.code - this.low) / this.rng)
+
+	if count >= 1<<this.shift {
+		panic(kanzi.NewCorruptStreamError(fmt.Sprintf("invalid cumulated frequency %d", count)))
+	}
+
 	symbol := this.f2s[count]
 	cumFreq := this.cumFreqs[symbol]
 	this.low += (cumFreq * this.rng)
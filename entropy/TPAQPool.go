@@ -0,0 +1,255 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package entropy
+
+import (
+	"sync"
+)
+
+// TPAQ_POOL_DEFAULT_MAX_BYTES default maximum memory retained by the pool of
+// TPAQ predictors (0: the pool is disabled unless SetTPAQPoolLimit is called)
+const TPAQ_POOL_DEFAULT_MAX_BYTES = int64(0)
+
+// TPAQPoolStats the statistics of the pool of TPAQ predictors
+type TPAQPoolStats struct {
+	Hits        int64 // predictors recycled
+	Misses      int64 // predictors allocated
+	Drops       int64 // predictors not retained because of the memory limit
+	Pooled      int   // predictors currently in the pool
+	PooledBytes int64 // memory retained by the pool
+}
+
+// The sizes of the tables and the context models of a predictor
+type tpaqPoolKey struct {
+	statesSize  int
+	mixersSize  int
+	hashSize    int
+	bufferSize  int
+	extra       bool
+	models      int
+	extraModels bool // word and sparse models
+	mix2        bool // 2 mixing layers
+}
+
+// The pool of TPAQ predictors used by the entropy codec factory. Allocating
+// and clearing the tables of a predictor (hundreds of MB) dominates the
+// startup time of each block: the predictors of the completed blocks are
+// recycled by the next blocks (of any stream) with the same table sizes.
+// The big tables of a recycled predictor are cleared lazily, page by page.
+// The pool is opt-in (see SetTPAQPoolLimit): the idle predictors retain a
+// lot of memory.
+type tpaqPool struct {
+	mutex    sync.Mutex
+	free     map[tpaqPoolKey][]*TPAQPredictor
+	maxBytes int64
+	stats    TPAQPoolStats
+}
+
+var _TPAQ_POOL = &tpaqPool{
+	free:     make(map[tpaqPoolKey][]*TPAQPredictor),
+	maxBytes: TPAQ_POOL_DEFAULT_MAX_BYTES,
+}
+
+// Approximate memory used by a predictor
+func (this tpaqPoolKey) size() int64 {
+	res := int64(0)
+
+	if this.mix2 == true {
+		res = (1024+256)*104 + 65536*33*2
+	}
+
+	return res + int64(this.statesSize) + int64(this.hashSize)*4 + int64(this.mixersSize)*104 +
+		(1 << 24) + (1 << 16) + int64(this.bufferSize)
+}
+
+// SetTPAQPoolLimit sets the maximum memory retained by the pool of TPAQ
+// predictors (0 disables the pool). Returns the previous limit.
+func SetTPAQPoolLimit(maxBytes int64) int64 {
+	if maxBytes < 0 {
+		maxBytes = 0
+	}
+
+	this := _TPAQ_POOL
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	res := this.maxBytes
+	this.maxBytes = maxBytes
+	this.trim()
+	return res
+}
+
+// GetTPAQPoolStats returns the statistics of the pool of TPAQ predictors
+func GetTPAQPoolStats() TPAQPoolStats {
+	this := _TPAQ_POOL
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.stats
+}
+
+// PurgeTPAQPool releases the predictors retained by the pool
+func PurgeTPAQPool() {
+	this := _TPAQ_POOL
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	maxBytes := this.maxBytes
+	this.maxBytes = 0
+	this.trim()
+	this.maxBytes = maxBytes
+}
+
+// Drop predictors until the pool fits in the memory limit
+func (this *tpaqPool) trim() {
+	for key, list := range this.free {
+		for len(list) > 0 && this.stats.PooledBytes > this.maxBytes {
+			list[len(list)-1] = nil
+			list = list[0 : len(list)-1]
+			this.stats.Pooled--
+			this.stats.PooledBytes -= key.size()
+		}
+
+		if len(list) == 0 {
+			delete(this.free, key)
+		} else {
+			this.free[key] = list
+		}
+	}
+}
+
+// Return a predictor (recycled if possible) with the table sizes selected
+// by the context
+func acquireTPAQPredictor(ctx *map[string]interface{}) (*TPAQPredictor, error) {
+	key, err := getTPAQPoolKey(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := _TPAQ_POOL
+	this.mutex.Lock()
+	list := this.free[key]
+	var res *TPAQPredictor
+
+	if len(list) > 0 {
+		res = list[len(list)-1]
+		list[len(list)-1] = nil
+		this.free[key] = list[0 : len(list)-1]
+		this.stats.Hits++
+		this.stats.Pooled--
+		this.stats.PooledBytes -= key.size()
+	} else {
+		this.stats.Misses++
+	}
+
+	this.mutex.Unlock()
+
+	if res == nil {
+		if res, err = newTPAQPredictor(key); err != nil {
+			return nil, err
+		}
+	} else {
+		res.pooled = false
+		res.setLazy()
+
+		if err := res.reset(); err != nil {
+			return nil, err
+		}
+	}
+
+	res.recyclable = true
+	return res, nil
+}
+
+// TPAQSharedModel a TPAQ predictor kept warm across the consecutive blocks
+// of a stream (option 'tpaq:warm'): each block starts with the model learnt
+// from the previous blocks instead of an empty model, which helps a lot
+// with many small blocks. The blocks must be entropy coded sequentially, in
+// the order of the stream. The table sizes are selected by the first block.
+type TPAQSharedModel struct {
+	predictor *TPAQPredictor
+}
+
+// NewTPAQSharedModel creates a new instance of TPAQSharedModel (the
+// predictor is acquired by the first block)
+func NewTPAQSharedModel() *TPAQSharedModel {
+	return &TPAQSharedModel{}
+}
+
+// Return the shared predictor (acquired with the context of the first block)
+func (this *TPAQSharedModel) get(ctx *map[string]interface{}) (*TPAQPredictor, error) {
+	if this.predictor == nil {
+		p, err := acquireTPAQPredictor(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Not released by the entropy codecs
+		p.recyclable = false
+		this.predictor = p
+	}
+
+	return this.predictor, nil
+}
+
+// Release returns the predictor to the pool. The model must not be used
+// afterwards.
+func (this *TPAQSharedModel) Release() {
+	if this.predictor == nil {
+		return
+	}
+
+	this.predictor.recyclable = true
+	releaseTPAQPredictor(this.predictor)
+	this.predictor = nil
+}
+
+// Return the predictor of a block and whether it is the predictor of the
+// shared model (block coded with a warm model)
+func getBlockTPAQPredictor(ctx map[string]interface{}) (*TPAQPredictor, bool, error) {
+	if warm, _ := ctx["tpaq:warm"].(bool); warm == true {
+		if shared, ok := ctx["tpaqShared"].(*TPAQSharedModel); ok == true && shared != nil {
+			p, err := shared.get(&ctx)
+			return p, err == nil, err
+		}
+	}
+
+	p, err := acquireTPAQPredictor(&ctx)
+	return p, false, err
+}
+
+// Return the predictor to the pool (if it was obtained from the pool and
+// the pool has room for it). The predictor must not be used afterwards.
+func releaseTPAQPredictor(p *TPAQPredictor) {
+	if p.recyclable == false || p.pooled == true {
+		return
+	}
+
+	this := _TPAQ_POOL
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	size := p.key.size()
+
+	if this.stats.PooledBytes+size > this.maxBytes {
+		this.stats.Drops++
+		return
+	}
+
+	p.pooled = true
+	p.probe = nil
+	this.free[p.key] = append(this.free[p.key], p)
+	this.stats.Pooled++
+	this.stats.PooledBytes += size
+}
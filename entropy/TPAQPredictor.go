@@ -16,6 +16,7 @@ limitations under the License.
 package entropy
 
 import (
+	"fmt"
 	"math/bits"
 
 	kanzi "github.com/flanglet/kanzi-go"
@@ -33,8 +34,40 @@ const (
 	_TPAQ_HASH             = int32(0x7FEB352D)
 	_TPAQ_BEGIN_LEARN_RATE = 60 << 7
 	_TPAQ_END_LEARN_RATE   = 11 << 7
+	_TPAQ_PAGE_LOG         = 12 // pages of the tables reset lazily (recycled predictors)
+	_TPAQ_EXTRA_MODELS     = 1  // TPAQ option: word and sparse models
+	_TPAQ_MIX2             = 2  // TPAQ option: 2 mixing layers and final APM
+	_TPAQ_WARM             = 4  // TPAQ option: block coded with the model of the previous blocks
+	_TPAQ_BIG_MODELS       = TPAQ_MODEL_ORDER3 | TPAQ_MODEL_ORDER4 | TPAQ_MODEL_ORDER6 |
+		TPAQ_MODEL_SPARSE | TPAQ_MODEL_MASKED
 )
 
+// The context models of the TPAQ predictor (bit mask provided in the
+// context with the 'tpaqModels' key). Disabling models saves memory and
+// time at the expense of compression.
+const (
+	TPAQ_MODEL_ORDER1 = 1   // previous byte
+	TPAQ_MODEL_ORDER2 = 2   // previous 2 bytes
+	TPAQ_MODEL_ORDER3 = 4   // previous 3 bytes
+	TPAQ_MODEL_ORDER4 = 8   // previous 4 bytes
+	TPAQ_MODEL_ORDER6 = 16  // previous 6 bytes (text) or high bits of previous 4 bytes (binary)
+	TPAQ_MODEL_SPARSE = 32  // nibbles of previous 8 bytes (text) or skipped bytes (binary)
+	TPAQ_MODEL_MASKED = 64  // masked previous 8 bytes (TPAQX only)
+	TPAQ_MODEL_MATCH  = 128 // longest match in the history
+	TPAQ_MODEL_ALL    = 255
+)
+
+// The extra context models (enabled with the 'tpaq:extra' key of the
+// context) are not part of the mask: a word model (current and previous
+// words, case insensitive) and 2 sparse models (previous bytes 2-3 and
+// previous bytes 1 and 4). They improve the compression of text.
+//
+// With 2 mixing layers (enabled with the 'tpaq:mix2' key of the context),
+// the predictions are also mixed by a mixer selected by the match length
+// and the bits of the current byte, the outputs of both mixers are mixed
+// by a final mixer and the prediction after SSE is refined by an APM over
+// the order 1 context.
+
 // States represent a bit history within some context.
 // State 0 is the starting state (no bits seen).
 // States 1-30 represent all possible sequences of 1-4 bits.
@@ -171,7 +204,12 @@ type TPAQPredictor struct {
 	sse0            *LogisticAdaptiveProbMap
 	sse1            *LogisticAdaptiveProbMap
 	mixers          []TPAQMixer
-	mixer           *TPAQMixer // current mixer
+	mixer           *TPAQMixer  // current mixer
+	mixers2         []TPAQMixer // 2 mixing layers: mixers selected by match length and c0
+	mixer2          *TPAQMixer
+	finalMixers     []TPAQMixer // 2 mixing layers: mixers of the first layer outputs
+	finalMixer      *TPAQMixer
+	apm             *LogisticAdaptiveProbMap // 2 mixing layers: order 1 APM
 	buffer          []int8
 	hashes          []int32 // hash table(context, buffer position)
 	bigStatesMap    []uint8 // hash table(context, prediction)
@@ -191,28 +229,65 @@ type TPAQPredictor struct {
 	ctx4            int32
 	ctx5            int32
 	ctx6            int32
+	cp7             *uint8 // extra models
+	cp8             *uint8
+	cp9             *uint8
+	ctx7            int32
+	ctx8            int32
+	ctx9            int32
+	word0           int32 // hash of the current word
+	word1           int32 // hash of the previous word
 	extra           bool
+	models          int  // enabled context models
+	extraModels     bool // word and sparse models
+	mix2            bool // 2 mixing layers
+	bufferMask      int32
+	probe           *modelProbe // optional instrumentation
+	key             tpaqPoolKey
+	recyclable      bool     // obtained from the pool of predictors
+	pooled          bool     // currently in the pool of predictors
+	lazy            bool     // the pages of the big tables are reset lazily
+	epoch           uint32   // current epoch of the pages
+	statesEpochs    []uint32 // epoch of each page of bigStatesMap
+	map1Epochs      []uint32 // epoch of each page of smallStatesMap1
+	hashesEpochs    []uint32 // epoch of each page of hashes
 }
 
 // NewTPAQPredictor creates a new instance of TPAQPredictor using the provided
 // map of options to select the sizes of internal structures.
+// The optional 'tpaqModels' entry selects the context models (see
+// TPAQ_MODEL_ALL).
 func NewTPAQPredictor(ctx *map[string]interface{}) (*TPAQPredictor, error) {
-	this := new(TPAQPredictor)
+	key, err := getTPAQPoolKey(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newTPAQPredictor(key)
+}
+
+// Select the context models and the sizes of the internal structures
+func getTPAQPoolKey(ctx *map[string]interface{}) (tpaqPoolKey, error) {
 	statesSize := 1 << 28
 	mixersSize := 1 << 12
 	hashSize := _TPAQ_HASH_SIZE
-	this.extra = false
+	bufferSize := _TPAQ_BUFFER_SIZE
+	extra := false
 	extraMem := uint(0)
+	models := TPAQ_MODEL_ALL
+	extraModels := false
+	mix2 := false
 
 	if ctx != nil {
 		// If extra mode, add more memory for states table, hash table
 		// and add second SSE
 		if val, containsKey := (*ctx)["codec"]; containsKey {
 			codec := val.(string)
-			this.extra = codec == "TPAQX"
+			extra = codec == "TPAQX"
 		}
 
-		if this.extra == true {
+		if extra == true {
 			extraMem = 1
 		}
 
@@ -248,30 +323,113 @@ func NewTPAQPredictor(ctx *map[string]interface{}) (*TPAQPredictor, error) {
 		} else {
 			mixersSize = 1 << 9
 		}
+
+		if val, containsKey := (*ctx)["tpaqModels"]; containsKey {
+			models = val.(int)
+
+			if models < 0 || models > TPAQ_MODEL_ALL {
+				return tpaqPoolKey{}, fmt.Errorf("Invalid TPAQ models: %v (must be in [0..%d])", models, TPAQ_MODEL_ALL)
+			}
+		}
+
+		if val, containsKey := (*ctx)["tpaq:extra"]; containsKey {
+			extraModels = val.(bool)
+		}
+
+		if val, containsKey := (*ctx)["tpaq:mix2"]; containsKey {
+			mix2 = val.(bool)
+		}
 	}
 
-	mixersSize <<= extraMem
-	statesSize <<= extraMem
-	hashSize <<= (2 * extraMem)
+	if extra == false {
+		models &= ^TPAQ_MODEL_MASKED
+	}
+
+	key := tpaqPoolKey{
+		statesSize:  statesSize << extraMem,
+		mixersSize:  mixersSize << extraMem,
+		hashSize:    hashSize << (2 * extraMem),
+		bufferSize:  bufferSize,
+		extra:       extra,
+		models:      models,
+		extraModels: extraModels,
+		mix2:        mix2,
+	}
+
+	// The tables of the disabled models are reduced to one page
+	if models&_TPAQ_BIG_MODELS == 0 && extraModels == false {
+		key.statesSize = 1 << _TPAQ_PAGE_LOG
+	}
+
+	if models&TPAQ_MODEL_MATCH == 0 {
+		key.hashSize = 1 << _TPAQ_PAGE_LOG
+		key.bufferSize = 1 << _TPAQ_PAGE_LOG
+	}
+
+	return key, nil
+}
 
-	this.mixers = make([]TPAQMixer, mixersSize)
+func newTPAQPredictor(key tpaqPoolKey) (*TPAQPredictor, error) {
+	this := new(TPAQPredictor)
+	this.key = key
+	this.extra = key.extra
+	this.models = key.models
+	this.extraModels = key.extraModels
+	this.mix2 = key.mix2
+	this.mixers = make([]TPAQMixer, key.mixersSize)
+
+	if this.mix2 == true {
+		this.mixers2 = make([]TPAQMixer, 1024)
+		this.finalMixers = make([]TPAQMixer, 256)
+	}
+	this.bigStatesMap = make([]uint8, key.statesSize)
+	this.smallStatesMap0 = make([]uint8, 1<<16)
+	this.smallStatesMap1 = make([]uint8, 1<<24)
+	this.hashes = make([]int32, key.hashSize)
+	this.buffer = make([]int8, key.bufferSize)
+	this.statesMask = int32(key.statesSize - 1)
+	this.mixersMask = int32(key.mixersSize - 1)
+	this.hashMask = int32(key.hashSize - 1)
+	this.bufferMask = int32(key.bufferSize - 1)
+	return this, this.reset()
+}
 
+// Reset the state of the predictor. The big tables of a recycled predictor
+// are not cleared: their pages are cleared when first accessed (lazy mode).
+func (this *TPAQPredictor) reset() error {
 	for i := range this.mixers {
 		this.mixers[i].init()
 	}
 
 	this.mixer = &this.mixers[0]
+
+	if this.mix2 == true {
+		for i := range this.mixers2 {
+			this.mixers2[i].init()
+		}
+
+		for i := range this.finalMixers {
+			this.finalMixers[i].initFinal()
+		}
+
+		this.mixer2 = &this.mixers2[0]
+		this.finalMixer = &this.finalMixers[0]
+	}
 	this.pr = 2048
 	this.c0 = 1
+	this.c4 = 0
+	this.c8 = 0
 	this.bpos = 8
-	this.bigStatesMap = make([]uint8, statesSize)
-	this.smallStatesMap0 = make([]uint8, 1<<16)
-	this.smallStatesMap1 = make([]uint8, 1<<24)
-	this.hashes = make([]int32, hashSize)
-	this.buffer = make([]int8, _TPAQ_BUFFER_SIZE)
-	this.statesMask = int32(statesSize - 1)
-	this.mixersMask = int32(mixersSize - 1)
-	this.hashMask = int32(hashSize - 1)
+	this.pos = 0
+	this.binCount = 0
+	this.matchLen = 0
+	this.matchPos = 0
+	this.hash = 0
+	this.ctx0, this.ctx1, this.ctx2, this.ctx3 = 0, 0, 0, 0
+	this.ctx4, this.ctx5, this.ctx6 = 0, 0, 0
+	this.ctx7, this.ctx8, this.ctx9 = 0, 0, 0
+	this.word0, this.word1 = 0, 0
+	this.probe = nil
 	this.cp0 = &this.smallStatesMap0[0]
 	this.cp1 = &this.smallStatesMap1[0]
 	this.cp2 = &this.bigStatesMap[0]
@@ -279,31 +437,149 @@ func NewTPAQPredictor(ctx *map[string]interface{}) (*TPAQPredictor, error) {
 	this.cp4 = &this.bigStatesMap[0]
 	this.cp5 = &this.bigStatesMap[0]
 	this.cp6 = &this.bigStatesMap[0]
+	this.cp7 = &this.bigStatesMap[0]
+	this.cp8 = &this.bigStatesMap[0]
+	this.cp9 = &this.bigStatesMap[0]
+
+	if this.lazy == true {
+		this.epoch++
+
+		// Wrapped epoch: all the pages become stale
+		if this.epoch == 0 {
+			clear(this.statesEpochs)
+			clear(this.map1Epochs)
+			clear(this.hashesEpochs)
+			this.epoch = 1
+		}
+
+		clear(this.smallStatesMap0)
+
+		// The match model may read the start and the end of the buffer
+		// before they are written
+		clear(this.buffer[0 : 1<<_TPAQ_PAGE_LOG])
+		clear(this.buffer[len(this.buffer)-(1<<_TPAQ_PAGE_LOG):])
+
+		// The first update uses the first slots of the tables
+		this.cleanPages(0, 0, 0)
+	}
 
 	var err error
 
 	if this.extra == true {
-		this.sse0, err = newLogisticAdaptiveProbMap(256, 6)
+		this.sse0, err = NewLogisticAdaptiveProbMap(256, 6)
 
 		if err == nil {
-			this.sse1, err = newLogisticAdaptiveProbMap(65536, 7)
+			this.sse1, err = NewLogisticAdaptiveProbMap(65536, 7)
 		}
 	} else {
-		this.sse0, err = newLogisticAdaptiveProbMap(256, 7)
+		this.sse0, err = NewLogisticAdaptiveProbMap(256, 7)
+	}
+
+	if err == nil && this.mix2 == true {
+		this.apm, err = NewLogisticAdaptiveProbMap(65536, 7)
+	}
+
+	return err
+}
+
+// Switch to lazy reset of the big tables (recycled predictor)
+func (this *TPAQPredictor) setLazy() {
+	if this.lazy == true {
+		return
+	}
+
+	this.lazy = true
+	this.statesEpochs = make([]uint32, len(this.bigStatesMap)>>_TPAQ_PAGE_LOG)
+	this.map1Epochs = make([]uint32, len(this.smallStatesMap1)>>_TPAQ_PAGE_LOG)
+	this.hashesEpochs = make([]uint32, len(this.hashes)>>_TPAQ_PAGE_LOG)
+}
+
+// Clear the stale pages of the tables accessed with the provided indexes
+func (this *TPAQPredictor) cleanPages(states int32, map1 int32, hash int32) {
+	cleanTPAQPage(this.bigStatesMap, this.statesEpochs, states, this.epoch)
+	cleanTPAQPage(this.smallStatesMap1, this.map1Epochs, map1, this.epoch)
+	cleanTPAQPage(this.hashes, this.hashesEpochs, hash, this.epoch)
+}
+
+// Clear the pages of the big tables accessed with the current contexts
+// (ctx+c or ctx^c with c < 256)
+func (this *TPAQPredictor) cleanContextPages() {
+	mask := this.statesMask
+	cleanTPAQPage(this.smallStatesMap1, this.map1Epochs, this.ctx1, this.epoch) // 256 aligned
+	cleanTPAQPage(this.hashes, this.hashesEpochs, this.hash, this.epoch)
+
+	for _, ctx := range [...]int32{this.ctx2, this.ctx3, this.ctx4, this.ctx5, this.ctx6} {
+		cleanTPAQPage(this.bigStatesMap, this.statesEpochs, ctx&mask, this.epoch)
+		cleanTPAQPage(this.bigStatesMap, this.statesEpochs, (ctx+255)&mask, this.epoch)
+	}
+
+	if this.extraModels == true {
+		for _, ctx := range [...]int32{this.ctx7, this.ctx8, this.ctx9} {
+			cleanTPAQPage(this.bigStatesMap, this.statesEpochs, ctx&mask, this.epoch)
+			cleanTPAQPage(this.bigStatesMap, this.statesEpochs, (ctx+255)&mask, this.epoch)
+		}
+	}
+}
+
+func cleanTPAQPage[T uint8 | int32](table []T, epochs []uint32, idx int32, epoch uint32) {
+	p := int(idx) >> _TPAQ_PAGE_LOG
+
+	if epochs[p] != epoch {
+		clear(table[p<<_TPAQ_PAGE_LOG : (p+1)<<_TPAQ_PAGE_LOG])
+		epochs[p] = epoch
+	}
+}
+
+// SetModelSink instruments the predictor: the probabilities, model
+// predictions and mixer weights of 1 byte out of 'sampling' are sent to
+// the sink (for offline analysis). Slows down the predictor.
+func (this *TPAQPredictor) SetModelSink(sink ModelSink, sampling uint) error {
+	name := "TPAQ"
+
+	if this.extra == true {
+		name = "TPAQX"
 	}
 
-	return this, err
+	probe, err := newModelProbe(sink, sampling, name)
+
+	if err != nil {
+		return err
+	}
+
+	this.probe = probe
+	return nil
 }
 
 // Update updates the internal probability model based on the observed bit
 func (this *TPAQPredictor) Update(bit byte) {
 	y := int(bit)
+
+	if this.probe != nil {
+		if this.probe.update(bit, this.pr) == true {
+			m := this.mixer
+			this.probe.sample.Inputs = append(this.probe.sample.Inputs[:0], m.p0, m.p1, m.p2, m.p3, m.p4, m.p5, m.p6, m.p7)
+			this.probe.sample.Weights = append(this.probe.sample.Weights[:0], m.w0, m.w1, m.w2, m.w3, m.w4, m.w5, m.w6, m.w7)
+
+			if this.extraModels == true {
+				this.probe.sample.Inputs = append(this.probe.sample.Inputs, m.p8, m.p9, m.p10)
+				this.probe.sample.Weights = append(this.probe.sample.Weights, m.w8, m.w9, m.w10)
+			}
+		}
+
+		this.probe.next()
+	}
+
 	this.mixer.update(y)
+
+	if this.mix2 == true {
+		this.mixer2.update(y)
+		this.finalMixer.update(y)
+	}
 	this.bpos--
 	this.c0 = (this.c0 << 1) | int32(bit)
 
 	if this.c0 > 255 {
-		this.buffer[this.pos&_TPAQ_MASK_BUFFER] = int8(this.c0)
+		this.buffer[this.pos&this.bufferMask] = int8(this.c0)
 		this.pos++
 		this.c8 = (this.c8 << 8) | ((this.c4 >> 24) & 0xFF)
 		this.c4 = (this.c4 << 8) | (this.c0 & 0xFF)
@@ -353,7 +629,17 @@ func (this *TPAQPredictor) Update(bit byte) {
 			}
 		}
 
-		this.findMatch()
+		if this.extraModels == true {
+			this.updateExtraContexts()
+		}
+
+		if this.lazy == true {
+			this.cleanContextPages()
+		}
+
+		if this.models&TPAQ_MODEL_MATCH != 0 {
+			this.findMatch()
+		}
 
 		// Keep track of current position
 		this.hashes[this.hash] = this.pos
@@ -364,67 +650,186 @@ func (this *TPAQPredictor) Update(bit byte) {
 	// on SandyBridge/Windows and slower on SkyLake/Linux except when [ctx & 255 == 0]
 	// (with c < 256). Hence, use XOR for _ctx5 which is the only context that fullfills
 	// the condition.
+	// Disabled models predict 0 and their states are left unchanged
 	c := this.c0
 	table := _TPAQ_STATE_TRANSITIONS[bit]
-	*this.cp0 = table[*this.cp0]
-	*this.cp1 = table[*this.cp1]
-	*this.cp2 = table[*this.cp2]
-	*this.cp3 = table[*this.cp3]
-	*this.cp4 = table[*this.cp4]
-	*this.cp5 = table[*this.cp5]
-	this.cp0 = &this.smallStatesMap0[this.ctx0+c]
-	p0 := _TPAQ_STATE_MAP[*this.cp0]
-	this.cp1 = &this.smallStatesMap1[this.ctx1+c]
-	p1 := _TPAQ_STATE_MAP[*this.cp1]
-	this.cp2 = &this.bigStatesMap[(this.ctx2+c)&this.statesMask]
-	p2 := _TPAQ_STATE_MAP[*this.cp2]
-	this.cp3 = &this.bigStatesMap[(this.ctx3+c)&this.statesMask]
-	p3 := _TPAQ_STATE_MAP[*this.cp3]
-	this.cp4 = &this.bigStatesMap[(this.ctx4+c)&this.statesMask]
-	p4 := _TPAQ_STATE_MAP[*this.cp4]
-	this.cp5 = &this.bigStatesMap[(this.ctx5^c)&this.statesMask]
-	p5 := _TPAQ_STATE_MAP[*this.cp5]
-
-	p7 := int32(0)
+	models := this.models
+
+	if models == TPAQ_MODEL_ALL || models == TPAQ_MODEL_ALL&^TPAQ_MODEL_MASKED {
+		*this.cp0 = table[*this.cp0]
+		*this.cp1 = table[*this.cp1]
+		*this.cp2 = table[*this.cp2]
+		*this.cp3 = table[*this.cp3]
+		*this.cp4 = table[*this.cp4]
+		*this.cp5 = table[*this.cp5]
+	} else {
+		this.updateStates(table, models)
+	}
+
+	var p0, p1, p2, p3, p4, p5, p7 int32
+
+	if models&TPAQ_MODEL_ORDER1 != 0 {
+		this.cp0 = &this.smallStatesMap0[this.ctx0+c]
+		p0 = _TPAQ_STATE_MAP[*this.cp0]
+	}
+
+	if models&TPAQ_MODEL_ORDER2 != 0 {
+		this.cp1 = &this.smallStatesMap1[this.ctx1+c]
+		p1 = _TPAQ_STATE_MAP[*this.cp1]
+	}
+
+	if models&TPAQ_MODEL_ORDER3 != 0 {
+		this.cp2 = &this.bigStatesMap[(this.ctx2+c)&this.statesMask]
+		p2 = _TPAQ_STATE_MAP[*this.cp2]
+	}
+
+	if models&TPAQ_MODEL_ORDER4 != 0 {
+		this.cp3 = &this.bigStatesMap[(this.ctx3+c)&this.statesMask]
+		p3 = _TPAQ_STATE_MAP[*this.cp3]
+	}
+
+	if models&TPAQ_MODEL_ORDER6 != 0 {
+		this.cp4 = &this.bigStatesMap[(this.ctx4+c)&this.statesMask]
+		p4 = _TPAQ_STATE_MAP[*this.cp4]
+	}
+
+	if models&TPAQ_MODEL_SPARSE != 0 {
+		this.cp5 = &this.bigStatesMap[(this.ctx5^c)&this.statesMask]
+		p5 = _TPAQ_STATE_MAP[*this.cp5]
+	}
 
 	if this.matchLen != 0 {
 		p7 = this.getMatchContextPred()
 	}
 
+	if this.extraModels == true {
+		this.mixer.setExtra(this.getExtraPredictions(table, c))
+	}
+
 	var p int
 
 	if this.extra == false {
 		// Mix predictions using NN
-		p = this.mixer.get(p0, p1, p2, p3, p4, p5, p7, p7)
+		p = this.mix(p0, p1, p2, p3, p4, p5, p7, p7)
 
 		// SSE (Secondary Symbol Estimation)
 		if this.binCount < (this.pos >> 3) {
-			p = this.sse0.get(y, p, int(this.c0))
+			p = this.sse0.Get(y, p, int(this.c0))
 		}
 	} else {
 		// One more prediction
-		*this.cp6 = table[*this.cp6]
-		this.cp6 = &this.bigStatesMap[(this.ctx6+c)&this.statesMask]
-		p6 := _TPAQ_STATE_MAP[*this.cp6]
+		p6 := int32(0)
+
+		if models&TPAQ_MODEL_MASKED != 0 {
+			*this.cp6 = table[*this.cp6]
+			this.cp6 = &this.bigStatesMap[(this.ctx6+c)&this.statesMask]
+			p6 = _TPAQ_STATE_MAP[*this.cp6]
+		}
 
 		// Mix predictions using NN
-		p = this.mixer.get(p0, p1, p2, p3, p4, p5, p6, p7)
+		p = this.mix(p0, p1, p2, p3, p4, p5, p6, p7)
 
 		// SSE (Secondary Symbol Estimation)
 		if this.binCount < (this.pos >> 3) {
-			p = this.sse1.get(y, p, int(this.ctx0+c))
+			p = this.sse1.Get(y, p, int(this.ctx0+c))
 		} else {
 			if this.binCount >= (this.pos >> 2) {
-				p = (3*this.sse0.get(y, p, int(this.c0)) + p) >> 2
+				p = (3*this.sse0.Get(y, p, int(this.c0)) + p) >> 2
 			}
 
-			p = (3*this.sse1.get(y, p, int(this.ctx0+c)) + p) >> 2
+			p = (3*this.sse1.Get(y, p, int(this.ctx0+c)) + p) >> 2
 		}
 	}
 
+	if this.mix2 == true {
+		p = (3*this.apm.Get(y, p, int(this.ctx0+c)) + p) >> 2
+	}
+
 	this.pr = p + int(uint32(p-2048)>>31)
 }
 
+// Mix the predictions of the models (with 1 or 2 layers of mixers)
+func (this *TPAQPredictor) mix(p0, p1, p2, p3, p4, p5, p6, p7 int32) int {
+	p := this.mixer.get(p0, p1, p2, p3, p4, p5, p6, p7)
+
+	if this.mix2 == false {
+		return p
+	}
+
+	bucket := this.matchLen
+
+	if bucket > 31 {
+		bucket = 31
+	}
+
+	m := this.mixer
+	this.mixer2 = &this.mixers2[this.c0|(bucket>>3)<<8]
+	this.mixer2.setExtra(m.p8, m.p9, m.p10)
+	q := this.mixer2.get(p0, p1, p2, p3, p4, p5, p6, p7)
+	this.finalMixer = &this.finalMixers[this.c0]
+	return this.finalMixer.get(int32(kanzi.STRETCH[p]), int32(kanzi.STRETCH[q]), 0, 0, 0, 0, 0, 0)
+}
+
+// Update the states of the enabled models (all the states are updated
+// before the new context pointers are computed: they may alias)
+func (this *TPAQPredictor) updateStates(table []uint8, models int) {
+	if models&TPAQ_MODEL_ORDER1 != 0 {
+		*this.cp0 = table[*this.cp0]
+	}
+
+	if models&TPAQ_MODEL_ORDER2 != 0 {
+		*this.cp1 = table[*this.cp1]
+	}
+
+	if models&TPAQ_MODEL_ORDER3 != 0 {
+		*this.cp2 = table[*this.cp2]
+	}
+
+	if models&TPAQ_MODEL_ORDER4 != 0 {
+		*this.cp3 = table[*this.cp3]
+	}
+
+	if models&TPAQ_MODEL_ORDER6 != 0 {
+		*this.cp4 = table[*this.cp4]
+	}
+
+	if models&TPAQ_MODEL_SPARSE != 0 {
+		*this.cp5 = table[*this.cp5]
+	}
+}
+
+// Compute the contexts of the word and sparse models
+func (this *TPAQPredictor) updateExtraContexts() {
+	c := this.c4 & 0xFF
+
+	if c >= 'A' && c <= 'Z' {
+		c += 32
+	}
+
+	if (c >= 'a' && c <= 'z') || c >= 128 {
+		this.word0 = (this.word0 + c) * _TPAQ_HASH
+	} else if this.word0 != 0 {
+		this.word1 = this.word0
+		this.word0 = 0
+	}
+
+	this.ctx7 = createContext(this.word1^c, this.word0)
+	this.ctx8 = createContext(8, this.c4&0x00FFFF00)
+	this.ctx9 = createContext(9, this.c4&-16776961) // 0xFF0000FF
+}
+
+// Update the states of the word and sparse models and return their
+// predictions for the next bit
+func (this *TPAQPredictor) getExtraPredictions(table []uint8, c int32) (int32, int32, int32) {
+	*this.cp7 = table[*this.cp7]
+	*this.cp8 = table[*this.cp8]
+	*this.cp9 = table[*this.cp9]
+	this.cp7 = &this.bigStatesMap[(this.ctx7+c)&this.statesMask]
+	this.cp8 = &this.bigStatesMap[(this.ctx8+c)&this.statesMask]
+	this.cp9 = &this.bigStatesMap[(this.ctx9+c)&this.statesMask]
+	return _TPAQ_STATE_MAP[*this.cp7], _TPAQ_STATE_MAP[*this.cp8], _TPAQ_STATE_MAP[*this.cp9]
+}
+
 // Get returns the value representing the probability of the next bit being
 // 1 (in the [0..4095] range).
 func (this *TPAQPredictor) Get() int {
@@ -496,12 +901,15 @@ func createContext(ctxID, cx int32) int32 {
 	return int32(c*123456791) + ctxID
 }
 
-// TPAQMixer a mixer that combines models using neural networks with 8 inputs.
+// TPAQMixer a mixer that combines models using neural networks with 8 inputs
+// (plus 3 inputs for the extra models).
 type TPAQMixer struct {
 	pr                             int // squashed prediction
 	skew                           int32
 	w0, w1, w2, w3, w4, w5, w6, w7 int32
 	p0, p1, p2, p3, p4, p5, p6, p7 int32
+	w8, w9, w10                    int32
+	p8, p9, p10                    int32 // 0 without extra models
 	learnRate                      int32
 }
 
@@ -516,6 +924,10 @@ func (this *TPAQMixer) init() {
 	this.w5 = 32768
 	this.w6 = 32768
 	this.w7 = 32768
+	this.w8, this.w9, this.w10 = 32768, 32768, 32768
+	this.p0, this.p1, this.p2, this.p3 = 0, 0, 0, 0
+	this.p4, this.p5, this.p6, this.p7 = 0, 0, 0, 0
+	this.p8, this.p9, this.p10 = 0, 0, 0
 	this.learnRate = _TPAQ_BEGIN_LEARN_RATE
 }
 
@@ -540,6 +952,25 @@ func (this *TPAQMixer) update(bit int) {
 	this.w5 += ((this.p5*err + 0) >> 12)
 	this.w6 += ((this.p6*err + 0) >> 12)
 	this.w7 += ((this.p7*err + 0) >> 12)
+	this.w8 += ((this.p8*err + 0) >> 12)
+	this.w9 += ((this.p9*err + 0) >> 12)
+	this.w10 += ((this.p10*err + 0) >> 12)
+}
+
+// Initialize a mixer of the final layer (2 inputs: the outputs of the
+// mixers of the first layer, averaged at first)
+func (this *TPAQMixer) initFinal() {
+	this.init()
+	this.w0, this.w1 = 65536, 65536
+	this.w2, this.w3, this.w4, this.w5 = 0, 0, 0, 0
+	this.w6, this.w7, this.w8, this.w9, this.w10 = 0, 0, 0, 0, 0
+}
+
+// Set the predictions of the extra models for the next call to get
+func (this *TPAQMixer) setExtra(p8, p9, p10 int32) {
+	this.p8 = p8
+	this.p9 = p9
+	this.p10 = p10
 }
 
 // Returns a prediction by mixing the predictions provided as input
@@ -556,6 +987,7 @@ func (this *TPAQMixer) get(p0, p1, p2, p3, p4, p5, p6, p7 int32) int {
 	// Neural Network dot product (sum weights*inputs)
 	this.pr = kanzi.Squash(int((this.w0*p0 + this.w1*p1 + this.w2*p2 + this.w3*p3 +
 		this.w4*p4 + this.w5*p5 + this.w6*p6 + this.w7*p7 +
+		this.w8*this.p8 + this.w9*this.p9 + this.w10*this.p10 +
 		this.skew + 65536) >> 17))
 
 	return this.pr
@@ -0,0 +1,176 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// ARMCodec is a codec that replaces relative call addresses with absolute
+// ones in ARM64 (AArch64) code (to improve entropy coding). Calls to the
+// same function then share the same encoded address.
+// Only BL instructions (4 byte aligned, 100101 + 26 bit word offset) are
+// modified and the opcode bits are kept, so the transform is bijective.
+
+const (
+	_ARM_BL_MASK     = 0xFC000000
+	_ARM_BL_OPCODE   = 0x94000000
+	_ARM_ADDR_MASK   = 0x03FFFFFF
+	_ARM_RET         = 0xD65F03C0
+	_ARM_MIN_BL_LOG  = 5  // at least 1 BL every 32 instructions
+	_ARM_MIN_RET_LOG = 10 // at least 1 RET every 1024 instructions
+)
+
+// ARMCodec a codec for ARM64 code
+type ARMCodec struct {
+}
+
+// NewARMCodec creates a new instance of ARMCodec
+func NewARMCodec() (*ARMCodec, error) {
+	this := &ARMCodec{}
+	return this, nil
+}
+
+// NewARMCodecWithCtx creates a new instance of ARMCodec using a
+// configuration map as parameter.
+func NewARMCodecWithCtx(ctx *map[string]interface{}) (*ARMCodec, error) {
+	this := &ARMCodec{}
+	return this, nil
+}
+
+// Count BL and RET instructions (4 byte aligned, little endian)
+func countARMCalls(src []byte) (int, int) {
+	calls := 0
+	rets := 0
+	end := len(src) &^ 3
+
+	for i := 0; i < end; i += 4 {
+		w := binary.LittleEndian.Uint32(src[i:])
+
+		if w&_ARM_BL_MASK == _ARM_BL_OPCODE {
+			calls++
+		} else if w == _ARM_RET {
+			rets++
+		}
+	}
+
+	return calls, rets
+}
+
+// isARMCode returns true if the instruction statistics of the block look
+// like ARM64 code. Random data has 1 BL every 64 words and no RET.
+func isARMCode(src []byte) bool {
+	words := len(src) >> 2
+	calls, rets := countARMCalls(src)
+	return calls > 0 && rets > 0 && calls >= words>>_ARM_MIN_BL_LOG && rets >= words>>_ARM_MIN_RET_LOG
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error. If the source data does not represent
+// ARM64 code, an error is returned.
+func (this *ARMCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	if isARMCode(src) == false {
+		return 0, 0, kanzi.NewNotApplicableError("Not an ARM64 binary or not enough calls")
+	}
+
+	return this.forward(src, dst)
+}
+
+// Convert the relative call addresses without checking the statistics
+func (this *ARMCodec) forward(src, dst []byte) (uint, uint, error) {
+	count := len(src)
+	end := count &^ 3
+
+	for i := 0; i < end; i += 4 {
+		w := binary.LittleEndian.Uint32(src[i:])
+
+		if w&_ARM_BL_MASK == _ARM_BL_OPCODE {
+			addr := (w + uint32(i>>2)) & _ARM_ADDR_MASK
+			w = _ARM_BL_OPCODE | addr
+		}
+
+		binary.LittleEndian.PutUint32(dst[i:], w)
+	}
+
+	copy(dst[end:count], src[end:count])
+	return uint(count), uint(count), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *ARMCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	count := len(src)
+
+	if len(dst) < count {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), count))
+	}
+
+	end := count &^ 3
+
+	for i := 0; i < end; i += 4 {
+		w := binary.LittleEndian.Uint32(src[i:])
+
+		if w&_ARM_BL_MASK == _ARM_BL_OPCODE {
+			addr := (w - uint32(i>>2)) & _ARM_ADDR_MASK
+			w = _ARM_BL_OPCODE | addr
+		}
+
+		binary.LittleEndian.PutUint32(dst[i:], w)
+	}
+
+	copy(dst[end:count], src[end:count])
+	return uint(count), uint(count), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this ARMCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen
+}
+
+// IsReusable returns true
+func (this *ARMCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (no state)
+func (this *ARMCodec) IsConcurrentSafe() bool {
+	return true
+}
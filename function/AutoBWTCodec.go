@@ -0,0 +1,218 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/transform"
+)
+
+const (
+	_AUTOBWT_MODE_BWT       = 0
+	_AUTOBWT_MODE_BWTS      = 1
+	_AUTOBWT_BWTS_THRESHOLD = 256 * 1024 // max block size for BWTS
+	_AUTOBWT_SAMPLE_SIZE    = 4096
+)
+
+// AutoBWT stream format: mode (1 byte) + BWT block or BWTS block
+//   mode: 0 => BWT, 1 => BWTS
+
+// AutoBWTCodec a codec that selects, for each block, either the regular BWT
+// (with primary indexes) or the bijective BWTS (no index). BWTS saves the
+// index bytes which matter on small blocks while BWT is faster on big blocks.
+// The choice is recorded in the first byte of the output.
+type AutoBWTCodec struct {
+	bwt  *BWTBlockCodec
+	bwts *transform.BWTS
+	ctx  *map[string]interface{}
+}
+
+// NewAutoBWTCodec creates a new instance of AutoBWTCodec
+func NewAutoBWTCodec() (*AutoBWTCodec, error) {
+	this := &AutoBWTCodec{}
+	return this, nil
+}
+
+// NewAutoBWTCodecWithCtx creates a new instance of AutoBWTCodec using a
+// configuration map as parameter.
+func NewAutoBWTCodecWithCtx(ctx *map[string]interface{}) (*AutoBWTCodec, error) {
+	this := &AutoBWTCodec{}
+	this.ctx = ctx
+	return this, nil
+}
+
+// selectMode returns the BWT variant to apply to the block: BWTS for
+// small blocks unless the data is very repetitive (BWTS is slow on long runs
+// of Lyndon words), BWT otherwise.
+func (this *AutoBWTCodec) selectMode(block []byte) int {
+	if len(block) > _AUTOBWT_BWTS_THRESHOLD {
+		return _AUTOBWT_MODE_BWT
+	}
+
+	// Sample the beginning of the block and count runs
+	end := len(block)
+
+	if end > _AUTOBWT_SAMPLE_SIZE {
+		end = _AUTOBWT_SAMPLE_SIZE
+	}
+
+	runs := 1
+
+	for i := 1; i < end; i++ {
+		if block[i] != block[i-1] {
+			runs++
+		}
+	}
+
+	if runs < end>>5 {
+		return _AUTOBWT_MODE_BWT
+	}
+
+	return _AUTOBWT_MODE_BWTS
+}
+
+func (this *AutoBWTCodec) getBWT() (*BWTBlockCodec, error) {
+	if this.bwt != nil {
+		return this.bwt, nil
+	}
+
+	var err error
+
+	if this.ctx != nil {
+		this.bwt, err = NewBWTBlockCodecWithCtx(this.ctx)
+	} else {
+		this.bwt, err = NewBWTBlockCodec()
+	}
+
+	return this.bwt, err
+}
+
+func (this *AutoBWTCodec) getBWTS() (*transform.BWTS, error) {
+	if this.bwts != nil {
+		return this.bwts, nil
+	}
+
+	var err error
+
+	if this.ctx != nil {
+		this.bwts, err = transform.NewBWTSWithCtx(this.ctx)
+	} else {
+		this.bwts, err = transform.NewBWTS()
+	}
+
+	return this.bwts, err
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *AutoBWTCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(dst) < this.MaxEncodedLen(len(src)) {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d",
+			len(dst), this.MaxEncodedLen(len(src))))
+	}
+
+	mode := this.selectMode(src)
+	dst[0] = byte(mode)
+	var iIdx, oIdx uint
+	var err error
+
+	if mode == _AUTOBWT_MODE_BWTS {
+		var t *transform.BWTS
+
+		if t, err = this.getBWTS(); err != nil {
+			return 0, 0, err
+		}
+
+		iIdx, oIdx, err = t.Forward(src, dst[1:])
+	} else {
+		var t *BWTBlockCodec
+
+		if t, err = this.getBWT(); err != nil {
+			return 0, 0, err
+		}
+
+		iIdx, oIdx, err = t.Forward(src, dst[1:])
+	}
+
+	return iIdx, oIdx + 1, err
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *AutoBWTCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	var iIdx, oIdx uint
+	var err error
+
+	switch src[0] {
+	case _AUTOBWT_MODE_BWTS:
+		var t *transform.BWTS
+
+		if t, err = this.getBWTS(); err != nil {
+			return 0, 0, err
+		}
+
+		iIdx, oIdx, err = t.Inverse(src[1:], dst)
+
+	case _AUTOBWT_MODE_BWT:
+		var t *BWTBlockCodec
+
+		if t, err = this.getBWT(); err != nil {
+			return 0, 0, err
+		}
+
+		iIdx, oIdx, err = t.Inverse(src[1:], dst)
+
+	default:
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid BWT mode in bitstream: %d", src[0]))
+	}
+
+	return iIdx + 1, oIdx, err
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this AutoBWTCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen + 1 + BWT_MAX_HEADER_SIZE
+}
+
+// IsReusable returns true
+func (this *AutoBWTCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns false (the BWT and BWTS are created on first use)
+func (this *AutoBWTCodec) IsConcurrentSafe() bool {
+	return false
+}
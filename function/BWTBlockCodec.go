@@ -16,9 +16,9 @@ limitations under the License.
 package function
 
 import (
-	"errors"
 	"fmt"
 
+	kanzi "github.com/flanglet/kanzi-go"
 	"github.com/flanglet/kanzi-go/transform"
 )
 
@@ -69,15 +69,15 @@ func (this *BWTBlockCodec) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	blockSize := len(src)
 
 	if len(dst) < this.MaxEncodedLen(blockSize) {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d",
-			len(dst), this.MaxEncodedLen(blockSize))
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d",
+			len(dst), this.MaxEncodedLen(blockSize)))
 	}
 
 	chunks := transform.GetBWTChunks(blockSize)
@@ -156,8 +156,8 @@ func (this *BWTBlockCodec) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	srcIdx := uint(0)
@@ -171,7 +171,7 @@ func (this *BWTBlockCodec) Inverse(src, dst []byte) (uint, uint, error) {
 		pIndexSizeBytes := 1 + ((blockMode >> 6) & 0x03)
 
 		if blockSize < pIndexSizeBytes {
-			return 0, 0, errors.New("Invalid compressed length in bitstream")
+			return 0, 0, kanzi.NewCorruptStreamError("Invalid compressed length in bitstream")
 		}
 
 		blockSize -= pIndexSizeBytes
@@ -186,7 +186,7 @@ func (this *BWTBlockCodec) Inverse(src, dst []byte) (uint, uint, error) {
 		}
 
 		if this.bwt.SetPrimaryIndex(i, primaryIndex) == false {
-			return 0, 0, errors.New("Invalid primary index in bitstream")
+			return 0, 0, kanzi.NewCorruptStreamError("Invalid primary index in bitstream")
 		}
 	}
 
@@ -198,3 +198,13 @@ func (this *BWTBlockCodec) Inverse(src, dst []byte) (uint, uint, error) {
 func (this BWTBlockCodec) MaxEncodedLen(srcLen int) int {
 	return srcLen + BWT_MAX_HEADER_SIZE
 }
+
+// IsReusable returns true
+func (this *BWTBlockCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns false (the BWT buffers are shared by the calls)
+func (this *BWTBlockCodec) IsConcurrentSafe() bool {
+	return false
+}
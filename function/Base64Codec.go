@@ -0,0 +1,584 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
+)
+
+const (
+	_B64_HEX_LOWER = 0    // lower case hex digits
+	_B64_HEX_UPPER = 1    // upper case hex digits
+	_B64_STD       = 2    // base64 with '+' and '/'
+	_B64_URL       = 3    // base64 with '-' and '_'
+	_B64_MASK_KIND = 0x03 // kind of region
+	_B64_FLAG_PAD  = 0x04 // base64 with '=' padding
+	_B64_FLAG_CRLF = 0x08 // lines separated by CR LF (else LF)
+
+	_B64_MIN_BLOCK_SIZE = 128
+	_B64_MIN_REGION     = 64 // encoded characters
+	_B64_MIN_LINE       = 16 // encoded characters
+)
+
+// Classes of characters (bit masks indexed by kind of region)
+const (
+	_B64_CLASS_HEX_LOWER = 1 << _B64_HEX_LOWER
+	_B64_CLASS_HEX_UPPER = 1 << _B64_HEX_UPPER
+	_B64_CLASS_STD       = 1 << _B64_STD
+	_B64_CLASS_URL       = 1 << _B64_URL
+)
+
+// Base64 stream format: number of regions (varint) + for each region: kind
+// and flags (1 byte), size of the text before the region (varint), size of
+// the decoded payload (varint), encoded characters per line (varint, 0 for a
+// single line) + text before region 0 + payload 0 + text before region 1 +
+// payload 1 + ... + text after the last region.
+
+// Base64Codec a transform for text embedding long base64 or hex encoded
+// payloads (EG. email attachments, data URIs, certificates, JSON or XML
+// documents with binary fields, hex dumps). The encoded regions are decoded
+// to raw bytes so that the following stages see the binary data, 25% (base64)
+// or 50% (hex) smaller. The alphabet, padding, line length and line separator
+// of each region are kept to re-encode the text exactly: a region is only
+// decoded if re-encoding the payload yields the same text. Blocks without
+// encoded regions are rejected (the transform is skipped).
+type Base64Codec struct {
+}
+
+type b64Region struct {
+	start   int  // offset of the region in the block
+	end     int  // offset of the end of the region in the block
+	mode    byte // kind and flags
+	lineLen int  // encoded characters per line (0 => single line)
+	payload []byte
+}
+
+// NewBase64Codec creates a new instance of Base64Codec
+func NewBase64Codec() (*Base64Codec, error) {
+	return &Base64Codec{}, nil
+}
+
+// NewBase64CodecWithCtx creates a new instance of Base64Codec using a
+// configuration map as parameter.
+func NewBase64CodecWithCtx(ctx *map[string]interface{}) (*Base64Codec, error) {
+	return &Base64Codec{}, nil
+}
+
+// Return the kinds of region the character can belong to
+func b64Classes(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return _B64_CLASS_HEX_LOWER | _B64_CLASS_HEX_UPPER | _B64_CLASS_STD | _B64_CLASS_URL
+	case c >= 'a' && c <= 'f':
+		return _B64_CLASS_HEX_LOWER | _B64_CLASS_STD | _B64_CLASS_URL
+	case c >= 'A' && c <= 'F':
+		return _B64_CLASS_HEX_UPPER | _B64_CLASS_STD | _B64_CLASS_URL
+	case (c >= 'g' && c <= 'z') || (c >= 'G' && c <= 'Z'):
+		return _B64_CLASS_STD | _B64_CLASS_URL
+	case c == '+' || c == '/':
+		return _B64_CLASS_STD
+	case c == '-' || c == '_':
+		return _B64_CLASS_URL
+	default:
+		return 0
+	}
+}
+
+func b64Encoding(mode byte) *base64.Encoding {
+	if mode&_B64_MASK_KIND == _B64_URL {
+		if mode&_B64_FLAG_PAD != 0 {
+			return base64.URLEncoding
+		}
+
+		return base64.RawURLEncoding
+	}
+
+	if mode&_B64_FLAG_PAD != 0 {
+		return base64.StdEncoding
+	}
+
+	return base64.RawStdEncoding
+}
+
+// Return the number of encoded characters of a payload
+func b64EncodedLen(mode byte, n int) int {
+	if mode&_B64_MASK_KIND <= _B64_HEX_UPPER {
+		return 2 * n
+	}
+
+	return b64Encoding(mode).EncodedLen(n)
+}
+
+// Encode the payload into dst (which must be big enough). Returns the number
+// of characters written.
+func b64Encode(mode byte, payload []byte, dst []byte) int {
+	switch mode & _B64_MASK_KIND {
+	case _B64_HEX_LOWER:
+		return len(appendLogHex(dst[0:0], payload, false))
+	case _B64_HEX_UPPER:
+		return len(appendLogHex(dst[0:0], payload, true))
+	default:
+		enc := b64Encoding(mode)
+		enc.Encode(dst, payload)
+		return enc.EncodedLen(len(payload))
+	}
+}
+
+// Size of the line separator following src[pos] (0 if none)
+func b64LineBreak(src []byte, pos int) int {
+	if pos < len(src) && src[pos] == LF {
+		return 1
+	}
+
+	if pos+1 < len(src) && src[pos] == CR && src[pos+1] == LF {
+		return 2
+	}
+
+	return 0
+}
+
+// Return the number of characters of the kind starting at src[pos] and the
+// number of padding characters following them (base64 only)
+func b64Line(src []byte, pos int, kind int) (int, int) {
+	n := 0
+
+	for pos+n < len(src) && b64Classes(src[pos+n])&(1<<uint(kind)) != 0 {
+		n++
+	}
+
+	pad := 0
+
+	if kind >= _B64_STD {
+		for pad < 2 && pos+n+pad < len(src) && src[pos+n+pad] == '=' {
+			pad++
+		}
+	}
+
+	return n, pad
+}
+
+// Return true if the characters look like random data (rather than long
+// identifiers, paths or numbers)
+func b64LooksRandom(text []byte, kind int) bool {
+	var digits, lower, upper int
+
+	for _, c := range text {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c >= 'a' && c <= 'z':
+			lower++
+		case c >= 'A' && c <= 'Z':
+			upper++
+		}
+	}
+
+	if kind <= _B64_HEX_UPPER {
+		return 8*digits >= len(text) && 16*(lower+upper) >= len(text)
+	}
+
+	return 32*digits >= len(text) && 16*lower >= len(text) && 16*upper >= len(text)
+}
+
+// Try to decode the region of the kind starting at src[start]. Returns the
+// region (end == 0 if none). The payload is stored in buf.
+func (this *Base64Codec) scanRegion(src []byte, start int, kind int, text, buf []byte) b64Region {
+	res := b64Region{}
+	n, pad := b64Line(src, start, kind)
+	lineLen := n + pad
+
+	if lineLen < _B64_MIN_LINE {
+		return res
+	}
+
+	lines := 1
+	lastLen := lineLen
+	eol := 0
+
+	if pad == 0 {
+		eol = b64LineBreak(src, start+lineLen)
+	}
+
+	// Following lines: same length (the last one may be shorter)
+	for pos := start + lineLen + eol; eol != 0; pos += lineLen + eol {
+		n2, pad2 := b64Line(src, pos, kind)
+		len2 := n2 + pad2
+
+		if len2 == 0 || len2 > lineLen {
+			break
+		}
+
+		if len2 == lineLen && pad2 == 0 && b64LineBreak(src, pos+len2) == eol {
+			lines++
+			continue
+		}
+
+		// Last line: must end with the padding, a line break or the block
+		if pad2 > 0 || b64LineBreak(src, pos+len2) != 0 || pos+len2 == len(src) {
+			lines++
+			lastLen = len2
+		}
+
+		break
+	}
+
+	for lines > 0 {
+		total := (lines-1)*lineLen + lastLen
+
+		if total < _B64_MIN_REGION {
+			return res
+		}
+
+		// Gather the characters of the region (without line breaks)
+		t := text[0:0]
+
+		for i := 0; i < lines; i++ {
+			pos := start + i*(lineLen+eol)
+
+			if i == lines-1 {
+				t = append(t, src[pos:pos+lastLen]...)
+			} else {
+				t = append(t, src[pos:pos+lineLen]...)
+			}
+		}
+
+		mode := byte(kind)
+
+		if lines > 1 && eol == 2 {
+			mode |= _B64_FLAG_CRLF
+		}
+
+		if kind >= _B64_STD && (t[len(t)-1] == '=' || len(t)&3 == 0) {
+			mode |= _B64_FLAG_PAD
+		}
+
+		if payload := this.decode(t, mode, buf); payload != nil {
+			if b64LooksRandom(t, kind) == false {
+				return res
+			}
+
+			res.start = start
+			res.end = start + (lines-1)*(lineLen+eol) + lastLen
+			res.mode = mode
+			res.payload = payload
+
+			if lines > 1 {
+				res.lineLen = lineLen
+			}
+
+			return res
+		}
+
+		// Invalid text: drop the last line or shorten a single line
+		if lines > 1 {
+			lines--
+			lastLen = lineLen
+		} else if kind <= _B64_HEX_UPPER && lastLen&1 != 0 {
+			lastLen--
+		} else if kind >= _B64_STD && lastLen&3 != 0 {
+			lastLen &= -4
+		} else {
+			return res
+		}
+	}
+
+	return res
+}
+
+// Decode the text into buf. Returns the payload or nil if the text cannot
+// be restored exactly from the payload.
+func (this *Base64Codec) decode(text []byte, mode byte, buf []byte) []byte {
+	var payload []byte
+
+	if mode&_B64_MASK_KIND <= _B64_HEX_UPPER {
+		if len(text)&1 != 0 {
+			return nil
+		}
+
+		payload = buf[0 : len(text)>>1]
+
+		if decodeLogHex(text, payload) < 0 {
+			return nil
+		}
+	} else {
+		n, err := b64Encoding(mode).Strict().Decode(buf, text)
+
+		if err != nil {
+			return nil
+		}
+
+		payload = buf[0:n]
+	}
+
+	// Check the round trip
+	if b64EncodedLen(mode, len(payload)) != len(text) {
+		return nil
+	}
+
+	check := alloc.Bytes(len(text))
+	defer alloc.PutBytes(check)
+	b64Encode(mode, payload, check)
+
+	if bytes.Equal(check[0:len(text)], text) == false {
+		return nil
+	}
+
+	return payload
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *Base64Codec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(dst) < this.MaxEncodedLen(len(src)) {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d",
+			len(dst), this.MaxEncodedLen(len(src))))
+	}
+
+	count := len(src)
+
+	if count < _B64_MIN_BLOCK_SIZE {
+		return 0, 0, kanzi.NewNotApplicableError("Base64 transform failed: input too small")
+	}
+
+	// The payloads are smaller than the encoded text
+	text := alloc.Bytes(count)
+	defer alloc.PutBytes(text)
+	scratch := alloc.Bytes(count)
+	defer alloc.PutBytes(scratch)
+	payloads := alloc.Bytes(count)
+	defer alloc.PutBytes(payloads)
+	regions := make([]b64Region, 0)
+	used := 0
+
+	for i := 0; i < count; {
+		// Regions start at the beginning of a run of characters
+		if b64Classes(src[i]) == 0 || (i > 0 && b64Classes(src[i-1]) != 0) {
+			i++
+			continue
+		}
+
+		// Select the kind of region with the best gain
+		var best b64Region
+
+		for kind := _B64_HEX_LOWER; kind <= _B64_URL; kind++ {
+			r := this.scanRegion(src, i, kind, text, scratch)
+
+			if r.end == 0 {
+				continue
+			}
+
+			if best.end == 0 || r.end-r.start-len(r.payload) > best.end-best.start-len(best.payload) {
+				r.payload = payloads[used : used+copy(payloads[used:], r.payload)]
+				best = r
+			}
+		}
+
+		if best.end == 0 {
+			// Skip the rest of the run
+			for i < count && b64Classes(src[i]) != 0 {
+				i++
+			}
+
+			continue
+		}
+
+		regions = append(regions, best)
+		used += len(best.payload)
+		i = best.end
+	}
+
+	if len(regions) == 0 {
+		return 0, 0, kanzi.NewNotApplicableError("Base64 transform failed: no encoded region found")
+	}
+
+	// Header
+	var buf [16]byte
+	hdr := make([]byte, 0, 16*len(regions)+5)
+	hdr = append(hdr, buf[0:emitPathVarInt(buf[:], len(regions))]...)
+	prev := 0
+	size := 0
+
+	for _, r := range regions {
+		hdr = append(hdr, r.mode)
+		hdr = append(hdr, buf[0:emitPathVarInt(buf[:], r.start-prev)]...)
+		hdr = append(hdr, buf[0:emitPathVarInt(buf[:], len(r.payload))]...)
+		hdr = append(hdr, buf[0:emitPathVarInt(buf[:], r.lineLen)]...)
+		size += r.start - prev + len(r.payload)
+		prev = r.end
+	}
+
+	size += len(hdr) + count - prev
+
+	if size >= count {
+		return 0, 0, kanzi.NewNotApplicableError("Base64 transform failed: output not smaller than input")
+	}
+
+	dstIdx := copy(dst, hdr)
+	prev = 0
+
+	for _, r := range regions {
+		dstIdx += copy(dst[dstIdx:], src[prev:r.start])
+		dstIdx += copy(dst[dstIdx:], r.payload)
+		prev = r.end
+	}
+
+	dstIdx += copy(dst[dstIdx:], src[prev:])
+	return uint(count), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *Base64Codec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	nbRegions, srcIdx, err := readPathVarInt(src)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Each region takes at least 4 bytes in the header
+	if nbRegions == 0 || nbRegions > (len(src)-srcIdx)/4 {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Base64 codec: invalid number of regions in bitstream: %d", nbRegions))
+	}
+
+	// Text size, payload size and line length of each region
+	modes := make([]byte, nbRegions)
+	sizes := make([][3]int, nbRegions)
+
+	for i := range sizes {
+		if srcIdx >= len(src) {
+			return 0, 0, kanzi.NewCorruptStreamError("Base64 codec: invalid header in bitstream")
+		}
+
+		modes[i] = src[srcIdx]
+		srcIdx++
+
+		if modes[i]&^(_B64_MASK_KIND|_B64_FLAG_PAD|_B64_FLAG_CRLF) != 0 {
+			return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid base64 codec mode in bitstream: %d", modes[i]))
+		}
+
+		for j := range sizes[i] {
+			n := 0
+
+			if sizes[i][j], n, err = readPathVarInt(src[srcIdx:]); err != nil {
+				return 0, 0, err
+			}
+
+			srcIdx += n
+		}
+	}
+
+	dstIdx := 0
+
+	for i, mode := range modes {
+		literal, payload, lineLen := sizes[i][0], sizes[i][1], sizes[i][2]
+
+		if literal > len(src)-srcIdx || payload > len(src)-srcIdx-literal {
+			return 0, 0, kanzi.NewCorruptStreamError("Base64 codec: invalid region size in bitstream")
+		}
+
+		if literal > len(dst)-dstIdx {
+			return 0, 0, kanzi.NewOutputTooSmallError("Base64 codec: output buffer is too small")
+		}
+
+		dstIdx += copy(dst[dstIdx:], src[srcIdx:srcIdx+literal])
+		srcIdx += literal
+		total := b64EncodedLen(mode, payload)
+		lines := 1
+		eol := 1
+
+		if mode&_B64_FLAG_CRLF != 0 {
+			eol = 2
+		}
+
+		if lineLen > 0 {
+			lines = (total + lineLen - 1) / lineLen
+		}
+
+		if total+(lines-1)*eol > len(dst)-dstIdx {
+			return 0, 0, kanzi.NewOutputTooSmallError("Base64 codec: output buffer is too small")
+		}
+
+		b64Encode(mode, src[srcIdx:srcIdx+payload], dst[dstIdx:])
+		srcIdx += payload
+
+		// Spread the lines (from the last one) and insert the line breaks
+		for k := lines - 1; k > 0; k-- {
+			from := dstIdx + k*lineLen
+			to := dstIdx + k*(lineLen+eol)
+			end := from + lineLen
+
+			if k == lines-1 {
+				end = dstIdx + total
+			}
+
+			copy(dst[to:], dst[from:end])
+
+			if eol == 2 {
+				dst[to-2] = CR
+			}
+
+			dst[to-1] = LF
+		}
+
+		dstIdx += total + (lines-1)*eol
+	}
+
+	if len(src)-srcIdx > len(dst)-dstIdx {
+		return 0, 0, kanzi.NewOutputTooSmallError("Base64 codec: output buffer is too small")
+	}
+
+	dstIdx += copy(dst[dstIdx:], src[srcIdx:])
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer.
+// The transform fails if the output is not smaller than the input.
+func (this Base64Codec) MaxEncodedLen(srcLen int) int {
+	return srcLen
+}
+
+// IsReusable returns true
+func (this *Base64Codec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the regions are allocated per call)
+func (this *Base64Codec) IsConcurrentSafe() bool {
+	return true
+}
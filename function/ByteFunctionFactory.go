@@ -29,20 +29,33 @@ const (
 	_BFF_MASK      = (1 << _BFF_ONE_SHIFT) - 1
 
 	// Up to 64 transforms can be declared (6 bit index)
-	NONE_TYPE   = uint64(0)  // copy
-	BWT_TYPE    = uint64(1)  // Burrows Wheeler
-	BWTS_TYPE   = uint64(2)  // Burrows Wheeler Scott
-	LZ_TYPE     = uint64(3)  // Lempel Ziv
-	SNAPPY_TYPE = uint64(4)  // Snappy (obsolete)
-	RLT_TYPE    = uint64(5)  // Run Length
-	ZRLT_TYPE   = uint64(6)  // Zero Run Length
-	MTFT_TYPE   = uint64(7)  // Move To Front
-	RANK_TYPE   = uint64(8)  // Rank
-	X86_TYPE    = uint64(9)  // X86 codec
-	DICT_TYPE   = uint64(10) // Text codec
-	ROLZ_TYPE   = uint64(11) // ROLZ codec
-	ROLZX_TYPE  = uint64(12) // ROLZ Extra codec
-	SRT_TYPE    = uint64(13) // Sorted Rank
+	NONE_TYPE    = uint64(0)  // copy
+	BWT_TYPE     = uint64(1)  // Burrows Wheeler
+	BWTS_TYPE    = uint64(2)  // Burrows Wheeler Scott
+	LZ_TYPE      = uint64(3)  // Lempel Ziv
+	SNAPPY_TYPE  = uint64(4)  // Snappy (obsolete)
+	RLT_TYPE     = uint64(5)  // Run Length
+	ZRLT_TYPE    = uint64(6)  // Zero Run Length
+	MTFT_TYPE    = uint64(7)  // Move To Front
+	RANK_TYPE    = uint64(8)  // Rank
+	X86_TYPE     = uint64(9)  // X86 codec
+	DICT_TYPE    = uint64(10) // Text codec
+	ROLZ_TYPE    = uint64(11) // ROLZ codec
+	ROLZX_TYPE   = uint64(12) // ROLZ Extra codec
+	SRT_TYPE     = uint64(13) // Sorted Rank
+	AUTOBWT_TYPE = uint64(14) // BWT or BWTS selected per block
+	PATH_TYPE    = uint64(15) // File names/paths codec
+	EXE_TYPE     = uint64(16) // X86 or ARM64 codec selected per block
+	FP_TYPE      = uint64(17) // Floating point arrays codec
+	LOG_TYPE     = uint64(18) // Log tokens (addresses, UUIDs, digests) codec
+	SOA_TYPE     = uint64(19) // Fixed size records deinterleaving
+	UTF16_TYPE   = uint64(20) // UTF-16 text codec
+	B64_TYPE     = uint64(21) // Base64/hex encoded payloads codec
+	STRUCT_TYPE  = uint64(22) // JSON/CSV structure codec
+	IMG_TYPE     = uint64(23) // Uncompressed images codec
+	COLOR_TYPE   = uint64(24) // Reversible color transform (RGB pixels)
+	META_TYPE    = uint64(25) // Pre-transforms selected by content sniffing
+	PLANE_TYPE   = uint64(26) // Bit planes run length coding (sparse bitmaps)
 )
 
 // NewByteFunction creates a new instance of ByteTransformSequence based on the provided
@@ -81,24 +94,58 @@ func NewByteFunction(ctx *map[string]interface{}, functionType uint64) (*ByteTra
 	return NewByteTransformSequence(transforms)
 }
 
+// HasExtensions returns true if the transforms of the provided function type
+// may emit blocks with the extensions selected by the map (see
+// HasTextExtensions, HasROLZExtensions and HasRLTExtensions). The decoders of
+// stream version 8 cannot decode these blocks.
+func HasExtensions(ctx map[string]interface{}, functionType uint64) bool {
+	return HasTextExtensions(ctx, functionType) == true || HasROLZExtensions(ctx, functionType) == true ||
+		HasRLTExtensions(ctx, functionType) == true
+}
+
+// NewStreamTextCodec creates the text codec shared by the blocks of a stream
+// in retain mode ("textRetain" entry of the map). The TEXT stage of the
+// functions created with the map is the shared codec if the map contains it
+// ("textShared" entry): the dynamic dictionary of a block seeds the next
+// block. The blocks must then be processed one at a time, in block order.
+func NewStreamTextCodec(ctx map[string]interface{}) (*TextCodec, error) {
+	copyCtx := make(map[string]interface{}, len(ctx))
+
+	for k, v := range ctx {
+		copyCtx[k] = v
+	}
+
+	copyCtx["textRetain"] = true
+	return newTextCodecToken(&copyCtx)
+}
+
+func newTextCodecToken(ctx *map[string]interface{}) (*TextCodec, error) {
+	textCodecType := 1
+
+	if val, containsKey := (*ctx)["codec"]; containsKey {
+		entropyType := strings.ToUpper(val.(string))
+
+		// Select text encoding based on entropy codec.
+		if entropyType == "NONE" || entropyType == "ANS0" ||
+			entropyType == "HUFFMAN" || entropyType == "RANGE" {
+			textCodecType = 2
+		}
+	}
+
+	(*ctx)["textcodec"] = textCodecType
+	return NewTextCodecWithCtx(ctx)
+}
+
 func newByteFunctionToken(ctx *map[string]interface{}, functionType uint64) (kanzi.ByteTransform, error) {
 	switch functionType {
 
 	case DICT_TYPE:
-		textCodecType := 1
-
-		if val, containsKey := (*ctx)["codec"]; containsKey {
-			entropyType := strings.ToUpper(val.(string))
-
-			// Select text encoding based on entropy codec.
-			if entropyType == "NONE" || entropyType == "ANS0" ||
-				entropyType == "HUFFMAN" || entropyType == "RANGE" {
-				textCodecType = 2
-			}
+		// Text codec shared by the blocks of a stream (see NewStreamTextCodec)
+		if tc, ok := (*ctx)["textShared"].(*TextCodec); ok == true && tc != nil {
+			return tc, nil
 		}
 
-		(*ctx)["textcodec"] = textCodecType
-		return NewTextCodecWithCtx(ctx)
+		return newTextCodecToken(ctx)
 
 	case ROLZ_TYPE:
 		return NewROLZCodecWithCtx(ctx)
@@ -112,6 +159,12 @@ func newByteFunctionToken(ctx *map[string]interface{}, functionType uint64) (kan
 	case BWTS_TYPE:
 		return transform.NewBWTSWithCtx(ctx)
 
+	case AUTOBWT_TYPE:
+		return NewAutoBWTCodecWithCtx(ctx)
+
+	case PATH_TYPE:
+		return NewPathCodecWithCtx(ctx)
+
 	case SRT_TYPE:
 		return NewSRTWithCtx(ctx)
 
@@ -135,6 +188,39 @@ func newByteFunctionToken(ctx *map[string]interface{}, functionType uint64) (kan
 	case X86_TYPE:
 		return NewX86CodecWithCtx(ctx)
 
+	case EXE_TYPE:
+		return NewExeCodecWithCtx(ctx)
+
+	case FP_TYPE:
+		return NewFPCodecWithCtx(ctx)
+
+	case LOG_TYPE:
+		return NewLogCodecWithCtx(ctx)
+
+	case SOA_TYPE:
+		return NewSoACodecWithCtx(ctx)
+
+	case UTF16_TYPE:
+		return NewUTF16CodecWithCtx(ctx)
+
+	case B64_TYPE:
+		return NewBase64CodecWithCtx(ctx)
+
+	case STRUCT_TYPE:
+		return NewStructCodecWithCtx(ctx)
+
+	case IMG_TYPE:
+		return NewImageCodecWithCtx(ctx)
+
+	case COLOR_TYPE:
+		return NewColorCodecWithCtx(ctx)
+
+	case META_TYPE:
+		return NewMetaCodecWithCtx(ctx)
+
+	case PLANE_TYPE:
+		return NewPlaneCodecWithCtx(ctx)
+
 	case NONE_TYPE:
 		return NewNullFunctionWithCtx(ctx)
 
@@ -170,6 +256,32 @@ func GetName(functionType uint64) string {
 	return s
 }
 
+// GetTypes returns the individual transform types (non null) contained in
+// the function type, in the order of application. A function type made of
+// null transforms only returns NONE_TYPE.
+func GetTypes(functionType uint64) []uint64 {
+	res := make([]uint64, 0, 8)
+
+	for i := uint(0); i < 8; i++ {
+		t := (functionType >> (_BFF_MAX_SHIFT - _BFF_ONE_SHIFT*i)) & _BFF_MASK
+
+		if t != NONE_TYPE {
+			res = append(res, t)
+		}
+	}
+
+	if len(res) == 0 {
+		res = append(res, NONE_TYPE)
+	}
+
+	return res
+}
+
+// GetTypeName returns the name of a single transform type (as returned by GetTypes)
+func GetTypeName(transformType uint64) string {
+	return getByteFunctionNameToken(transformType)
+}
+
 func getByteFunctionNameToken(functionType uint64) string {
 	switch functionType {
 
@@ -188,6 +300,12 @@ func getByteFunctionNameToken(functionType uint64) string {
 	case BWTS_TYPE:
 		return "BWTS"
 
+	case AUTOBWT_TYPE:
+		return "AUTOBWT"
+
+	case PATH_TYPE:
+		return "PATH"
+
 	case ZRLT_TYPE:
 		return "ZRLT"
 
@@ -209,6 +327,39 @@ func getByteFunctionNameToken(functionType uint64) string {
 	case X86_TYPE:
 		return "X86"
 
+	case EXE_TYPE:
+		return "EXE"
+
+	case FP_TYPE:
+		return "FP"
+
+	case LOG_TYPE:
+		return "LOG"
+
+	case SOA_TYPE:
+		return "SOA"
+
+	case UTF16_TYPE:
+		return "UTF16"
+
+	case B64_TYPE:
+		return "B64"
+
+	case STRUCT_TYPE:
+		return "STRUCT"
+
+	case IMG_TYPE:
+		return "IMG"
+
+	case COLOR_TYPE:
+		return "COLOR"
+
+	case META_TYPE:
+		return "META"
+
+	case PLANE_TYPE:
+		return "PLANE"
+
 	case NONE_TYPE:
 		return "NONE"
 
@@ -264,6 +415,12 @@ func getByteFunctionTypeToken(name string) uint64 {
 	case "BWTS":
 		return BWTS_TYPE
 
+	case "AUTOBWT":
+		return AUTOBWT_TYPE
+
+	case "PATH":
+		return PATH_TYPE
+
 	case "ROLZ":
 		return ROLZ_TYPE
 
@@ -288,6 +445,39 @@ func getByteFunctionTypeToken(name string) uint64 {
 	case "X86":
 		return X86_TYPE
 
+	case "EXE":
+		return EXE_TYPE
+
+	case "FP":
+		return FP_TYPE
+
+	case "LOG":
+		return LOG_TYPE
+
+	case "SOA":
+		return SOA_TYPE
+
+	case "UTF16":
+		return UTF16_TYPE
+
+	case "B64":
+		return B64_TYPE
+
+	case "STRUCT":
+		return STRUCT_TYPE
+
+	case "IMG":
+		return IMG_TYPE
+
+	case "COLOR":
+		return COLOR_TYPE
+
+	case "META":
+		return META_TYPE
+
+	case "PLANE":
+		return PLANE_TYPE
+
 	case "LZ":
 		return LZ_TYPE
 
@@ -25,10 +25,22 @@ const (
 	_TRANSFORM_SKIP_MASK = 0xFF
 )
 
-// ByteTransformSequence encapsulates a sequence of transforms or functions in a function
+// ByteTransformSequence encapsulates a sequence of transforms or functions in a function.
+// A stage that fails (EG. the text codec on binary data) is skipped and
+// recorded in the skip flags (bit 7-i for stage i). By default, the caller
+// stores the skip flags with the block (see SkipFlags and SetSkipFlags) and
+// Forward returns an error if all the stages were skipped. A sequence created
+// with NewByteTransformSequenceWithHeader writes the skip flags in the first
+// byte of its output instead, so Inverse knows which stages ran and skipping
+// all the stages is not an error (the block is copied).
+// A sequence is not safe for concurrent use (the skip flags of the last block
+// are shared): concurrent calls return a GuardError. After an Inverse error
+// in a transform that is not reusable, all calls return a GuardError.
 type ByteTransformSequence struct {
 	transforms []kanzi.ByteTransform // transforms or functions
 	skipFlags  byte                  // skip transforms
+	header     bool                  // skip flags in the first byte of the output
+	guard      transformGuard
 }
 
 // NewByteTransformSequence creates a new instance of NewByteTransformSequence
@@ -48,6 +60,20 @@ func NewByteTransformSequence(transforms []kanzi.ByteTransform) (*ByteTransformS
 	return this, nil
 }
 
+// NewByteTransformSequenceWithHeader creates a new instance of
+// ByteTransformSequence containing the transforms provided as parameter.
+// The skip flags of each block are written in the first byte of the output.
+func NewByteTransformSequenceWithHeader(transforms []kanzi.ByteTransform) (*ByteTransformSequence, error) {
+	this, err := NewByteTransformSequence(transforms)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.header = true
+	return this, nil
+}
+
 // Forward applies the function to the src and writes the result
 // to the destination. Runs Forward on each transform in the sequence.
 // Returns number of bytes read, number of bytes
@@ -57,9 +83,24 @@ func (this *ByteTransformSequence) Forward(src, dst []byte) (uint, uint, error)
 		return 0, 0, nil
 	}
 
+	if err := this.guard.enter("Forward"); err != nil {
+		return 0, 0, err
+	}
+
+	defer this.guard.leave(false)
+	flags := dst
+
+	if this.header == true {
+		if len(dst) == 0 {
+			return 0, 0, kanzi.NewOutputTooSmallError("Output buffer is too small")
+		}
+
+		dst = dst[1:]
+	}
+
 	blockSize := len(src)
 	length := uint(blockSize)
-	requiredSize := this.MaxEncodedLen(blockSize)
+	requiredSize := this.maxEncodedLen(blockSize)
 	this.skipFlags = 0
 	sa := [2]*[]byte{&src, &dst}
 	saIdx := 0
@@ -109,6 +150,11 @@ func (this *ByteTransformSequence) Forward(src, dst []byte) (uint, uint, error)
 		copy(out, in[0:length])
 	}
 
+	if this.header == true {
+		flags[0] = this.skipFlags
+		return uint(blockSize), length + 1, nil
+	}
+
 	if this.skipFlags != _TRANSFORM_SKIP_MASK {
 		err = nil
 	}
@@ -125,15 +171,41 @@ func (this *ByteTransformSequence) Inverse(src, dst []byte) (uint, uint, error)
 		return 0, 0, nil
 	}
 
+	if err := this.guard.enter("Inverse"); err != nil {
+		return 0, 0, err
+	}
+
+	// Set if a transform that is not reusable fails. A panic leaves the
+	// sequence failed.
+	failed := true
+
+	defer func() {
+		this.guard.leave(failed)
+	}()
+
+	read := uint(len(src))
+
+	if this.header == true {
+		this.skipFlags = src[0]
+		src = src[1:]
+
+		if len(src) == 0 {
+			failed = false
+			return read, 0, nil
+		}
+	}
+
 	blockSize := len(src)
 	length := uint(blockSize)
 
 	if this.skipFlags == _TRANSFORM_SKIP_MASK {
+		failed = false
+
 		if &src[0] != &dst[0] {
 			copy(dst, src)
 		}
 
-		return length, length, nil
+		return read, length, nil
 	}
 
 	sa := [2]*[]byte{&src, &dst}
@@ -155,21 +227,36 @@ func (this *ByteTransformSequence) Inverse(src, dst []byte) (uint, uint, error)
 		_, length, res = t.Inverse(in[0:length], out[0:cap(out)])
 
 		if res != nil {
+			reusable, _ := transformSafety(t)
+			failed = reusable == false
 			break
 		}
 	}
 
+	if res == nil {
+		failed = false
+	}
+
 	if saIdx != 1 {
 		in := *sa[0]
 		out := *sa[1]
 		copy(out, in[0:length])
 	}
 
-	return uint(blockSize), length, res
+	return read, length, res
 }
 
 // MaxEncodedLen returns the max size required for the encoding output buffer
 func (this ByteTransformSequence) MaxEncodedLen(srcLen int) int {
+	if this.header == true {
+		return this.maxEncodedLen(srcLen) + 1
+	}
+
+	return this.maxEncodedLen(srcLen)
+}
+
+// Return the max size of the output of the transforms
+func (this ByteTransformSequence) maxEncodedLen(srcLen int) int {
 	requiredSize := srcLen
 
 	for _, t := range this.transforms {
@@ -185,6 +272,22 @@ func (this ByteTransformSequence) MaxEncodedLen(srcLen int) int {
 	return requiredSize
 }
 
+// IsReusable returns true if all the transforms of the sequence are reusable
+func (this *ByteTransformSequence) IsReusable() bool {
+	for _, t := range this.transforms {
+		if reusable, _ := transformSafety(t); reusable == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsConcurrentSafe returns false: the skip flags are shared by the calls
+func (this *ByteTransformSequence) IsConcurrentSafe() bool {
+	return false
+}
+
 // Len returns the number of functions in the sequence (in [0..8])
 func (this *ByteTransformSequence) Len() int {
 	return len(this.transforms)
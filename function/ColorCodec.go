@@ -0,0 +1,382 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	_COLOR_AUTO       = 0
+	_COLOR_RCT        = 1 // JPEG 2000 reversible color transform
+	_COLOR_YCOCG      = 2 // YCoCg-R
+	_COLOR_MIN_PIXELS = 64
+	_COLOR_MIN_GAIN   = 95 // the planes must lower the entropy by 5% at least
+	_COLOR_MAX_HEADER = 1 + 4*5
+)
+
+// Color stream format: transform (1 byte) + width, channels, stride and
+// number of rows (varints) + luma plane + first chroma plane + second
+// chroma plane + alpha plane (4 channels only) + row padding bytes + bytes
+// after the last complete row (copied).
+
+// ColorCodec a transform for interleaved RGB (or RGBA) pixels. Each pixel
+// is converted with a reversible color transform: the RCT of JPEG 2000
+// (Y = G + (U+V)/4, U = B-G, V = R-G) or YCoCg-R. Both are computed with
+// lifting steps modulo 256, so the transform is lossless with 8 bit
+// components. The output is planar (luma plane then chroma planes, the
+// chroma planes are not subsampled) which helps the following transforms
+// and entropy coders.
+// The geometry is provided in the context ('imageWidth', 'imageChannels'
+// and 'imageStride' for rows with padding) or else the block is tested as
+// a stream of RGB triplets and RGBA quadruplets. The color transform is
+// provided in the context ('colorTransform' = RCT, YCOCG or AUTO) or else
+// selected per block. Blocks where the planes are not more compressible
+// than the raw channels are rejected.
+type ColorCodec struct {
+	width     int // 0 => auto
+	channels  int
+	stride    int
+	transform int
+}
+
+type colorGeometry struct {
+	width    int // pixels per row
+	channels int // bytes per pixel (3 or 4)
+	stride   int // bytes per row (including padding)
+	rows     int
+}
+
+// NewColorCodec creates a new instance of ColorCodec
+func NewColorCodec() (*ColorCodec, error) {
+	return &ColorCodec{}, nil
+}
+
+// NewColorCodecWithCtx creates a new instance of ColorCodec using a
+// configuration map as parameter.
+func NewColorCodecWithCtx(ctx *map[string]interface{}) (*ColorCodec, error) {
+	this := &ColorCodec{}
+
+	if val, containsKey := (*ctx)["colorTransform"]; containsKey {
+		switch strings.ToUpper(val.(string)) {
+		case "AUTO":
+			this.transform = _COLOR_AUTO
+
+		case "RCT":
+			this.transform = _COLOR_RCT
+
+		case "YCOCG":
+			this.transform = _COLOR_YCOCG
+
+		default:
+			return nil, fmt.Errorf("Invalid color transform: '%v' (must be RCT, YCOCG or AUTO)", val)
+		}
+	}
+
+	if val, containsKey := (*ctx)["imageWidth"]; containsKey {
+		this.width = val.(int)
+		this.channels = 3
+
+		if this.width < 1 || this.width > IMG_MAX_WIDTH {
+			return nil, fmt.Errorf("Invalid image width: %v (must be in [1..%d])", this.width, IMG_MAX_WIDTH)
+		}
+
+		if val, containsKey := (*ctx)["imageChannels"]; containsKey {
+			this.channels = val.(int)
+
+			if this.channels != 3 && this.channels != 4 {
+				return nil, fmt.Errorf("Invalid number of color channels: %v (must be 3 or 4)", this.channels)
+			}
+		}
+
+		this.stride = this.width * this.channels
+
+		if val, containsKey := (*ctx)["imageStride"]; containsKey {
+			this.stride = val.(int)
+
+			if this.stride < this.width*this.channels {
+				return nil, fmt.Errorf("Invalid image stride: %v (must be at least %d)", this.stride, this.width*this.channels)
+			}
+		}
+	} else if _, containsKey := (*ctx)["imageStride"]; containsKey {
+		return nil, errors.New("The image stride requires the image width")
+	}
+
+	return this, nil
+}
+
+// Return the candidate geometries for the block
+func (this *ColorCodec) geometries(count int) []colorGeometry {
+	if this.width != 0 {
+		return []colorGeometry{{width: this.width, channels: this.channels, stride: this.stride, rows: count / this.stride}}
+	}
+
+	// One row of triplets or quadruplets
+	return []colorGeometry{
+		{width: count / 3, channels: 3, stride: count / 3 * 3, rows: 1},
+		{width: count / 4, channels: 4, stride: count / 4 * 4, rows: 1},
+	}
+}
+
+// Convert a pixel to luma and chroma (identity if the transform is not
+// known)
+func colorForward(transform int, r, g, b byte) (byte, byte, byte) {
+	switch transform {
+	case _COLOR_RCT:
+		u := b - g
+		v := r - g
+		return g + byte((int(int8(u))+int(int8(v)))>>2), u, v
+
+	case _COLOR_YCOCG:
+		co := r - b
+		t := b + byte(int8(co)>>1)
+		cg := g - t
+		return t + byte(int8(cg)>>1), co, cg
+
+	default:
+		return r, g, b
+	}
+}
+
+// Convert luma and chroma back to a pixel
+func colorInverse(transform int, y, c1, c2 byte) (byte, byte, byte) {
+	if transform == _COLOR_RCT {
+		g := y - byte((int(int8(c1))+int(int8(c2)))>>2)
+		return c2 + g, g, c1 + g
+	}
+
+	t := y - byte(int8(c2)>>1)
+	g := c2 + t
+	b := t - byte(int8(c1)>>1)
+	return b + c1, g, b
+}
+
+// Return the sum of the order 0 entropies of the planes produced by the
+// transform (the raw channels for the identity)
+func colorCost(block []byte, g colorGeometry, transform int) int {
+	var histos [4][256]int
+
+	for r := 0; r < g.rows; r++ {
+		idx := r * g.stride
+
+		for i := 0; i < g.width; i++ {
+			y, c1, c2 := colorForward(transform, block[idx], block[idx+1], block[idx+2])
+			histos[0][y]++
+			histos[1][c1]++
+			histos[2][c2]++
+
+			if g.channels == 4 {
+				histos[3][block[idx+3]]++
+			}
+
+			idx += g.channels
+		}
+	}
+
+	cost := 0
+	count := g.width * g.rows
+
+	for p := 0; p < g.channels; p++ {
+		cost += kanzi.ComputeEntropy1024(histos[p][:], count) * count
+	}
+
+	return cost
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *ColorCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	transforms := []int{_COLOR_RCT, _COLOR_YCOCG}
+
+	if this.transform != _COLOR_AUTO {
+		transforms = []int{this.transform}
+	}
+
+	var best colorGeometry
+	bestTransform := _COLOR_AUTO
+	bestGain := 0
+
+	for _, g := range this.geometries(len(src)) {
+		if g.width*g.rows < _COLOR_MIN_PIXELS {
+			continue
+		}
+
+		baseline := colorCost(src, g, _COLOR_AUTO)
+
+		for _, t := range transforms {
+			cost := colorCost(src, g, t)
+
+			if cost*100 >= baseline*_COLOR_MIN_GAIN {
+				continue
+			}
+
+			// Gain in thousandths (comparable across geometries)
+			if gain := int((int64(baseline-cost) * 1000) / int64(baseline)); gain > bestGain {
+				best, bestTransform, bestGain = g, t, gain
+			}
+		}
+	}
+
+	if bestTransform == _COLOR_AUTO {
+		return 0, 0, kanzi.NewNotApplicableError("No gain from color transform")
+	}
+
+	g := best
+	dst[0] = byte(bestTransform)
+	dstIdx := 1
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.width)
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.channels)
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.stride)
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.rows)
+	planeSize := g.width * g.rows
+	pIdx := dstIdx
+
+	for r := 0; r < g.rows; r++ {
+		idx := r * g.stride
+
+		for i := 0; i < g.width; i++ {
+			dst[pIdx], dst[pIdx+planeSize], dst[pIdx+2*planeSize] =
+				colorForward(bestTransform, src[idx], src[idx+1], src[idx+2])
+
+			if g.channels == 4 {
+				dst[pIdx+3*planeSize] = src[idx+3]
+			}
+
+			pIdx++
+			idx += g.channels
+		}
+	}
+
+	dstIdx += g.channels * planeSize
+
+	// Row padding then tail
+	if pad := g.stride - g.width*g.channels; pad > 0 {
+		for r := 0; r < g.rows; r++ {
+			start := r*g.stride + g.width*g.channels
+			dstIdx += copy(dst[dstIdx:], src[start:start+pad])
+		}
+	}
+
+	dstIdx += copy(dst[dstIdx:], src[g.rows*g.stride:])
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *ColorCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	transform := int(src[0])
+	srcIdx := 1
+	var vals [4]int
+
+	for i := range vals {
+		val, n, err := readPathVarInt(src[srcIdx:])
+
+		if err != nil {
+			return 0, 0, kanzi.NewCorruptStreamError("Invalid color header in bitstream")
+		}
+
+		vals[i] = val
+		srcIdx += n
+	}
+
+	g := colorGeometry{width: vals[0], channels: vals[1], stride: vals[2], rows: vals[3]}
+
+	if (transform != _COLOR_RCT && transform != _COLOR_YCOCG) || g.width < 1 || g.width > IMG_MAX_WIDTH ||
+		(g.channels != 3 && g.channels != 4) || g.stride < g.width*g.channels || g.rows < 1 {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid color geometry in bitstream")
+	}
+
+	count := len(src) - srcIdx
+
+	if g.rows > count/g.stride {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid color size in bitstream")
+	}
+
+	if len(dst) < count {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), count))
+	}
+
+	planeSize := g.width * g.rows
+
+	for r := 0; r < g.rows; r++ {
+		idx := r * g.stride
+
+		for i := 0; i < g.width; i++ {
+			dst[idx], dst[idx+1], dst[idx+2] =
+				colorInverse(transform, src[srcIdx], src[srcIdx+planeSize], src[srcIdx+2*planeSize])
+
+			if g.channels == 4 {
+				dst[idx+3] = src[srcIdx+3*planeSize]
+			}
+
+			srcIdx++
+			idx += g.channels
+		}
+	}
+
+	srcIdx += (g.channels - 1) * planeSize
+
+	if pad := g.stride - g.width*g.channels; pad > 0 {
+		for r := 0; r < g.rows; r++ {
+			start := r*g.stride + g.width*g.channels
+			srcIdx += copy(dst[start:start+pad], src[srcIdx:])
+		}
+	}
+
+	srcIdx += copy(dst[g.rows*g.stride:count], src[srcIdx:])
+	return uint(srcIdx), uint(count), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this ColorCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen + _COLOR_MAX_HEADER
+}
+
+// IsReusable returns true
+func (this *ColorCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the geometry is set at creation)
+func (this *ColorCodec) IsConcurrentSafe() bool {
+	return true
+}
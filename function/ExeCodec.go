@@ -0,0 +1,242 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	_EXE_ARCH_NONE  = 0 // not an executable or unsupported architecture
+	_EXE_ARCH_X86   = 1
+	_EXE_ARCH_ARM64 = 2
+
+	_EXE_ELF_MACHINE_386     = 3
+	_EXE_ELF_MACHINE_X86_64  = 62
+	_EXE_ELF_MACHINE_AARCH64 = 183
+	_EXE_PE_MACHINE_I386     = 0x014C
+	_EXE_PE_MACHINE_AMD64    = 0x8664
+	_EXE_PE_MACHINE_ARM64    = 0xAA64
+	_EXE_MACHO_MAGIC32       = 0xFEEDFACE
+	_EXE_MACHO_MAGIC64       = 0xFEEDFACF
+	_EXE_MACHO_CPU_X86       = 7
+	_EXE_MACHO_CPU_X86_64    = 0x01000007
+	_EXE_MACHO_CPU_ARM64     = 0x0100000C
+)
+
+// Exe stream format: architecture (1 byte) + X86 block or ARM64 block
+//   architecture: 1 => X86, 2 => ARM64
+
+// ExeCodec a codec for executables that selects, for each block, the
+// X86 codec or the ARM64 codec. The architecture is read from the ELF, PE
+// or Mach-O header at the start of the block if any (first block of a file)
+// or guessed from instruction statistics. The choice is recorded in the
+// first byte of the output. Blocks that do not look like code of a
+// supported architecture are rejected (the transform is skipped).
+type ExeCodec struct {
+	x86 *X86Codec
+	arm *ARMCodec
+}
+
+// NewExeCodec creates a new instance of ExeCodec
+func NewExeCodec() (*ExeCodec, error) {
+	this := &ExeCodec{}
+	this.x86, _ = NewX86Codec()
+	this.arm, _ = NewARMCodec()
+	return this, nil
+}
+
+// NewExeCodecWithCtx creates a new instance of ExeCodec using a
+// configuration map as parameter.
+func NewExeCodecWithCtx(ctx *map[string]interface{}) (*ExeCodec, error) {
+	this := &ExeCodec{}
+	this.x86, _ = NewX86CodecWithCtx(ctx)
+	this.arm, _ = NewARMCodecWithCtx(ctx)
+	return this, nil
+}
+
+// Return the architecture declared in the executable header at the start
+// of the block and true, or false if there is no (known) header.
+func sniffExeHeader(block []byte) (int, bool) {
+	// ELF
+	if len(block) >= 20 && string(block[0:4]) == "\x7FELF" {
+		var machine uint16
+
+		if block[5] == 2 {
+			machine = binary.BigEndian.Uint16(block[18:])
+		} else {
+			machine = binary.LittleEndian.Uint16(block[18:])
+		}
+
+		switch machine {
+		case _EXE_ELF_MACHINE_386, _EXE_ELF_MACHINE_X86_64:
+			return _EXE_ARCH_X86, true
+
+		case _EXE_ELF_MACHINE_AARCH64:
+			return _EXE_ARCH_ARM64, true
+
+		default:
+			return _EXE_ARCH_NONE, true
+		}
+	}
+
+	// PE (the DOS stub points to the PE header)
+	if len(block) >= 64 && string(block[0:2]) == "MZ" {
+		offset := int(binary.LittleEndian.Uint32(block[60:]))
+
+		if offset >= 64 && offset+6 <= len(block) && string(block[offset:offset+4]) == "PE\x00\x00" {
+			switch binary.LittleEndian.Uint16(block[offset+4:]) {
+			case _EXE_PE_MACHINE_I386, _EXE_PE_MACHINE_AMD64:
+				return _EXE_ARCH_X86, true
+
+			case _EXE_PE_MACHINE_ARM64:
+				return _EXE_ARCH_ARM64, true
+
+			default:
+				return _EXE_ARCH_NONE, true
+			}
+		}
+	}
+
+	// Mach-O (little endian hosts)
+	if len(block) >= 8 {
+		magic := binary.LittleEndian.Uint32(block[0:])
+
+		if magic == _EXE_MACHO_MAGIC32 || magic == _EXE_MACHO_MAGIC64 {
+			switch binary.LittleEndian.Uint32(block[4:]) {
+			case _EXE_MACHO_CPU_X86, _EXE_MACHO_CPU_X86_64:
+				return _EXE_ARCH_X86, true
+
+			case _EXE_MACHO_CPU_ARM64:
+				return _EXE_ARCH_ARM64, true
+
+			default:
+				return _EXE_ARCH_NONE, true
+			}
+		}
+	}
+
+	return _EXE_ARCH_NONE, false
+}
+
+// Return the architecture of the code in the block (header or statistics)
+func detectExeArch(block []byte) int {
+	if arch, found := sniffExeHeader(block); found == true {
+		return arch
+	}
+
+	// The ARM64 statistics are stricter (aligned BL and RET instructions)
+	if isARMCode(block) == true {
+		return _EXE_ARCH_ARM64
+	}
+
+	if countX86Jumps(block) >= len(block)>>7 {
+		return _EXE_ARCH_X86
+	}
+
+	return _EXE_ARCH_NONE
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error. If the source data does not represent
+// code of a supported architecture, an error is returned.
+func (this *ExeCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	arch := detectExeArch(src)
+	var iIdx, oIdx uint
+	var err error
+
+	switch arch {
+	case _EXE_ARCH_X86:
+		iIdx, oIdx, err = this.x86.Forward(src, dst[1:])
+
+	case _EXE_ARCH_ARM64:
+		iIdx, oIdx, err = this.arm.forward(src, dst[1:])
+
+	default:
+		return 0, 0, kanzi.NewNotApplicableError("Not an executable or unsupported architecture")
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dst[0] = byte(arch)
+	return iIdx, oIdx + 1, nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *ExeCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(src) == 1 {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid executable block: missing data")
+	}
+
+	var iIdx, oIdx uint
+	var err error
+
+	switch src[0] {
+	case _EXE_ARCH_X86:
+		iIdx, oIdx, err = this.x86.Inverse(src[1:], dst)
+
+	case _EXE_ARCH_ARM64:
+		iIdx, oIdx, err = this.arm.Inverse(src[1:], dst)
+
+	default:
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid executable architecture in bitstream: %d", src[0]))
+	}
+
+	return iIdx + 1, oIdx, err
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this ExeCodec) MaxEncodedLen(srcLen int) int {
+	return X86Codec{}.MaxEncodedLen(srcLen) + 1
+}
+
+// IsReusable returns true
+func (this *ExeCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the x86 and ARM codecs have no state)
+func (this *ExeCodec) IsConcurrentSafe() bool {
+	return true
+}
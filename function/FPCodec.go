@@ -0,0 +1,508 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	// FP_ENDIAN_AUTO byte order detected for each block (default)
+	FP_ENDIAN_AUTO = 0
+	// FP_ENDIAN_LITTLE values stored in little endian order
+	FP_ENDIAN_LITTLE = 1
+	// FP_ENDIAN_BIG values stored in big endian order
+	FP_ENDIAN_BIG = 2
+)
+
+const (
+	_FP_FLOAT32        = 1
+	_FP_FLOAT64        = 2
+	_FP_BIG_ENDIAN     = 0x80 // flag of the type byte
+	_FP_HEADER_SIZE    = 6    // type, stride, number of values (4 bytes)
+	_FP_MIN_BLOCK_SIZE = 64
+	_FP_MAX_STRIDE     = 4    // interleaved arrays of up to 4 components (EG. x, y, z)
+	_FP_SAMPLE_SIZE    = 4096 // number of values used to detect the format
+	_FP_MIN_ZERO_BITS  = 8    // average leading zero bits of the residuals to apply the transform
+
+	_FP_EXPONENT_BITS_32 = 8
+	_FP_EXPONENT_BITS_64 = 11
+)
+
+// FP stream format: header + sign stream + exponent flags + exponent
+// streams + mantissa streams + trailing bytes
+//   header: type (1 byte: 1 => float32, 2 => float64, bit 7 set => big
+//           endian), stride (1 byte), number of values (4 bytes)
+//   sign stream: 1 bit per value
+//   exponent flags: 1 bit per value, set if the exponent is not null
+//   float32: exponent (8 bits), mantissa (7 + 8 + 8 bits): 1 byte per value each
+//   float64: exponent (3 + 8 bits), mantissa (4 + 6 x 8 bits): 1 byte per value each
+//   (the exponent streams only hold the values with an exponent flag)
+//   trailing bytes: the last len%width bytes of the block (raw)
+
+// A field of the values (bits [shift..shift+popcount(mask)[)
+type fpField struct {
+	shift uint
+	mask  uint64
+}
+
+var (
+	_FP_FIELDS_32 = []fpField{
+		{23, 0xFF},                       // exponent
+		{16, 0x7F}, {8, 0xFF}, {0, 0xFF}, // mantissa
+	}
+
+	_FP_FIELDS_64 = []fpField{
+		{60, 0x07}, {52, 0xFF}, // exponent
+		{48, 0x0F}, {40, 0xFF}, {32, 0xFF}, {24, 0xFF}, {16, 0xFF}, {8, 0xFF}, {0, 0xFF}, // mantissa
+	}
+)
+
+// FPCodec a transform for arrays of IEEE 754 floating point numbers
+// (float32 or float64, little or big endian). Each value is predicted by
+// the value 'stride' positions before (XOR) and the bits of the residuals
+// are split in separate streams (sign, exponent, mantissa) so that the
+// entropy coder sees the (similar) exponents and the (noisy) low mantissa
+// bits apart. The width, byte order and stride are detected for each block
+// unless provided in the context ('fpWidth': 4 or 8, 'fpEndian': one of the
+// FP_ENDIAN_* values, 'fpStride': 1 to 4). They are stored in the block
+// header: the decoder does not depend on the context or on the platform.
+// Blocks that do not look like floating point arrays are rejected (the
+// transform is skipped) unless all the parameters are provided. Blocks that
+// would not shrink are always rejected.
+type FPCodec struct {
+	width  int // 0 => auto
+	endian int
+	stride int // 0 => auto
+}
+
+// NewFPCodec creates a new instance of FPCodec
+func NewFPCodec() (*FPCodec, error) {
+	return &FPCodec{}, nil
+}
+
+// NewFPCodecWithCtx creates a new instance of FPCodec using a
+// configuration map as parameter.
+func NewFPCodecWithCtx(ctx *map[string]interface{}) (*FPCodec, error) {
+	this := &FPCodec{}
+
+	if val, containsKey := (*ctx)["fpWidth"]; containsKey {
+		this.width = val.(int)
+
+		if this.width != 0 && this.width != 4 && this.width != 8 {
+			return nil, fmt.Errorf("Invalid floating point width: %v (must be 4 or 8)", this.width)
+		}
+	}
+
+	if val, containsKey := (*ctx)["fpEndian"]; containsKey {
+		this.endian = val.(int)
+
+		if this.endian != FP_ENDIAN_AUTO && this.endian != FP_ENDIAN_LITTLE && this.endian != FP_ENDIAN_BIG {
+			return nil, fmt.Errorf("Invalid floating point byte order: %v", this.endian)
+		}
+	}
+
+	if val, containsKey := (*ctx)["fpStride"]; containsKey {
+		this.stride = val.(int)
+
+		if this.stride < 0 || this.stride > _FP_MAX_STRIDE {
+			return nil, fmt.Errorf("Invalid floating point stride: %v (must be in [1..%d])", this.stride, _FP_MAX_STRIDE)
+		}
+	}
+
+	return this, nil
+}
+
+// Return the value of width bytes at index i
+func fpValue(block []byte, i, width int, bigEndian bool) uint64 {
+	if bigEndian == true {
+		if width == 4 {
+			return uint64(binary.BigEndian.Uint32(block[i*4:]))
+		}
+
+		return binary.BigEndian.Uint64(block[i*8:])
+	}
+
+	if width == 4 {
+		return uint64(binary.LittleEndian.Uint32(block[i*4:]))
+	}
+
+	return binary.LittleEndian.Uint64(block[i*8:])
+}
+
+// Return the start of each field stream (and the end of the last one): the
+// exponent streams hold 'm' values, the mantissa streams 'n' values
+func fpStreamOffsets(fields []fpField, exponents, n, m, start int) []int {
+	offsets := make([]int, len(fields)+1)
+	offsets[0] = start
+
+	for f := range fields {
+		if f < exponents {
+			offsets[f+1] = offsets[f] + m
+		} else {
+			offsets[f+1] = offsets[f] + n
+		}
+	}
+
+	return offsets
+}
+
+// Return the mask of the exponent bits (the first fields)
+func fpExponentMask(fields []fpField, exponents int) uint64 {
+	mask := uint64(0)
+
+	for _, fld := range fields[0:exponents] {
+		mask |= fld.mask << fld.shift
+	}
+
+	return mask
+}
+
+func putFPValue(block []byte, i, width int, bigEndian bool, val uint64) {
+	if bigEndian == true {
+		if width == 4 {
+			binary.BigEndian.PutUint32(block[i*4:], uint32(val))
+		} else {
+			binary.BigEndian.PutUint64(block[i*8:], val)
+		}
+	} else {
+		if width == 4 {
+			binary.LittleEndian.PutUint32(block[i*4:], uint32(val))
+		} else {
+			binary.LittleEndian.PutUint64(block[i*8:], val)
+		}
+	}
+}
+
+// Return true if most values of the block (float32 or float64, in either
+// byte order) are normal numbers: the exponent of zeros and denormals
+// (EG. the words of sparse bitmaps) is null, the exponent of infinities and
+// NaNs is all ones
+func hasFPValues(block []byte) bool {
+	for _, width := range []int{8, 4} {
+		n := len(block) / width
+
+		if n > _FP_SAMPLE_SIZE {
+			n = _FP_SAMPLE_SIZE
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		expBits := uint(_FP_EXPONENT_BITS_32)
+
+		if width == 8 {
+			expBits = _FP_EXPONENT_BITS_64
+		}
+
+		expMax := uint64(1)<<expBits - 1
+
+		for _, bigEndian := range []bool{false, true} {
+			normals := 0
+
+			for i := 0; i < n; i++ {
+				e := (fpValue(block, i, width, bigEndian) >> uint(8*width-1-int(expBits))) & expMax
+
+				if e != 0 && e != expMax {
+					normals++
+				}
+			}
+
+			if 4*normals >= 3*n {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Return the type of the values in the block (0 if not a floating point
+// array), the byte order and the stride of the best predictor among the
+// parameters allowed by the codec configuration
+func (this *FPCodec) detectFPType(block []byte) (int, bool, int) {
+	types := []int{_FP_FLOAT64, _FP_FLOAT32}
+	orders := []bool{false, true}
+	strides := []int{1, 2, 3, 4}
+
+	if this.width != 0 {
+		types = []int{this.width / 4}
+	}
+
+	if this.endian != FP_ENDIAN_AUTO {
+		orders = []bool{this.endian == FP_ENDIAN_BIG}
+	}
+
+	if this.stride != 0 {
+		strides = []int{this.stride}
+	}
+
+	// Fully specified: no detection
+	if len(types) == 1 && len(orders) == 1 && len(strides) == 1 {
+		return types[0], orders[0], strides[0]
+	}
+
+	bestType, bestBigEndian, bestStride := 0, false, 0
+	bestCost := 0
+
+	for _, fpType := range types {
+		width := 4 * fpType
+		n := len(block) / width
+
+		if n > _FP_SAMPLE_SIZE {
+			n = _FP_SAMPLE_SIZE
+		}
+
+		for _, bigEndian := range orders {
+			for _, stride := range strides {
+				if n <= 2*stride {
+					continue
+				}
+
+				zeros := 0
+
+				for i := stride; i < n; i++ {
+					r := fpValue(block, i, width, bigEndian) ^ fpValue(block, i-stride, width, bigEndian)
+					zeros += bits.LeadingZeros64(r) - 64 + 8*width
+				}
+
+				if zeros < _FP_MIN_ZERO_BITS*(n-stride) {
+					continue
+				}
+
+				// Significant bits per 8 bytes of input. Prefer float64 when the
+				// costs are close (the float32 view of float64 values splits
+				// the random low halves as if they were exponents).
+				cost := (8*width*(n-stride) - zeros) * 8 / (width * (n - stride))
+
+				if fpType == _FP_FLOAT32 {
+					cost += 2
+				}
+
+				if bestType == 0 || cost < bestCost {
+					bestType, bestBigEndian, bestStride, bestCost = fpType, bigEndian, stride, cost
+				}
+			}
+		}
+	}
+
+	return bestType, bestBigEndian, bestStride
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error. If the source data does not represent
+// an array of floating point numbers, an error is returned.
+func (this *FPCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	if len(src) < _FP_MIN_BLOCK_SIZE {
+		return 0, 0, kanzi.NewNotApplicableError("Block too small, skip")
+	}
+
+	fpType, bigEndian, stride := this.detectFPType(src)
+
+	if fpType == 0 {
+		return 0, 0, kanzi.NewNotApplicableError("Not an array of floating point numbers")
+	}
+
+	width := 4 * fpType
+	fields, exponents := _FP_FIELDS_32, 1
+
+	if fpType == _FP_FLOAT64 {
+		fields, exponents = _FP_FIELDS_64, 2
+	}
+
+	n := len(src) / width
+	signs := dst[_FP_HEADER_SIZE : _FP_HEADER_SIZE+(n+7)>>3]
+	flags := dst[_FP_HEADER_SIZE+len(signs) : _FP_HEADER_SIZE+2*len(signs)]
+	signShift := uint(8*width - 1)
+	expMask := fpExponentMask(fields, exponents)
+	m := 0
+
+	for i := range signs {
+		signs[i] = 0
+		flags[i] = 0
+	}
+
+	for i := 0; i < n; i++ {
+		r := fpValue(src, i, width, bigEndian)
+
+		if i >= stride {
+			r ^= fpValue(src, i-stride, width, bigEndian)
+		}
+
+		signs[i>>3] |= byte((r>>signShift)&1) << uint(7-i&7)
+
+		if r&expMask != 0 {
+			flags[i>>3] |= 1 << uint(7-i&7)
+			m++
+		}
+	}
+
+	offsets := fpStreamOffsets(fields, exponents, n, m, _FP_HEADER_SIZE+len(signs)+len(flags))
+	dstIdx := offsets[len(fields)] + len(src) - n*width
+
+	if dstIdx >= len(src) {
+		return 0, 0, kanzi.NewNotApplicableError("No gain from floating point transform")
+	}
+
+	dst[0] = byte(fpType)
+
+	if bigEndian == true {
+		dst[0] |= _FP_BIG_ENDIAN
+	}
+
+	dst[1] = byte(stride)
+	binary.BigEndian.PutUint32(dst[2:], uint32(n))
+
+	for i := 0; i < n; i++ {
+		r := fpValue(src, i, width, bigEndian)
+
+		if i >= stride {
+			r ^= fpValue(src, i-stride, width, bigEndian)
+		}
+
+		for f, fld := range fields {
+			if f < exponents && r&expMask == 0 {
+				continue
+			}
+
+			dst[offsets[f]] = byte((r >> fld.shift) & fld.mask)
+			offsets[f]++
+		}
+	}
+
+	copy(dst[dstIdx-len(src)+n*width:], src[n*width:])
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *FPCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(src) < _FP_HEADER_SIZE {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid floating point block: missing header")
+	}
+
+	fpType := int(src[0] &^ _FP_BIG_ENDIAN)
+	bigEndian := src[0]&_FP_BIG_ENDIAN != 0
+	stride := int(src[1])
+	n := int(binary.BigEndian.Uint32(src[2:]))
+
+	if fpType != _FP_FLOAT32 && fpType != _FP_FLOAT64 {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid floating point type in bitstream: %d", fpType))
+	}
+
+	if stride < 1 || stride > _FP_MAX_STRIDE {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid floating point stride in bitstream: %d", stride))
+	}
+
+	width := 4 * fpType
+	fields, exponents := _FP_FIELDS_32, 1
+
+	if fpType == _FP_FLOAT64 {
+		fields, exponents = _FP_FIELDS_64, 2
+	}
+
+	if n > len(src) || _FP_HEADER_SIZE+2*((n+7)>>3) > len(src) {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid floating point block: invalid number of values")
+	}
+
+	signs := src[_FP_HEADER_SIZE : _FP_HEADER_SIZE+(n+7)>>3]
+	flags := src[_FP_HEADER_SIZE+len(signs) : _FP_HEADER_SIZE+2*len(signs)]
+	m := 0
+
+	for i := 0; i < n; i++ {
+		m += int(flags[i>>3]>>uint(7-i&7)) & 1
+	}
+
+	offsets := fpStreamOffsets(fields, exponents, n, m, _FP_HEADER_SIZE+len(signs)+len(flags))
+	size := offsets[len(fields)]
+	tail := len(src) - size
+
+	if tail < 0 || tail >= width {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid floating point block: invalid number of values")
+	}
+
+	if len(dst) < n*width+tail {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n*width+tail))
+	}
+
+	signShift := uint(8*width - 1)
+
+	for i := 0; i < n; i++ {
+		r := uint64((signs[i>>3]>>uint(7-i&7))&1) << signShift
+		exponent := (flags[i>>3]>>uint(7-i&7))&1 != 0
+
+		for f, fld := range fields {
+			if f < exponents && exponent == false {
+				continue
+			}
+
+			r |= uint64(src[offsets[f]]) << fld.shift
+			offsets[f]++
+		}
+
+		if i >= stride {
+			r ^= fpValue(dst, i-stride, width, bigEndian)
+		}
+
+		putFPValue(dst, i, width, bigEndian, r)
+	}
+
+	copy(dst[n*width:], src[size:])
+	return uint(len(src)), uint(n*width + tail), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+// (the sign and exponent bits of float64 values use more than 1 byte)
+func (this FPCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen + srcLen/8 + srcLen/64 + 16
+}
+
+// IsReusable returns true
+func (this *FPCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the parameters are set at creation)
+func (this *FPCodec) IsConcurrentSafe() bool {
+	return true
+}
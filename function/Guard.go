@@ -0,0 +1,184 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Reasons of a GuardError
+const (
+	GUARD_CONCURRENT_CALL   = 1 // Forward or Inverse called while another call is running
+	GUARD_REUSE_AFTER_ERROR = 2 // instance used after a failed Inverse call
+
+	_GUARD_IDLE   = int32(0)
+	_GUARD_BUSY   = int32(1)
+	_GUARD_FAILED = int32(2)
+)
+
+// GuardError the error returned when a transform instance is misused
+// (concurrent calls or reuse after a fatal error). The call is rejected
+// before any data is processed.
+type GuardError struct {
+	Op     string // "Forward" or "Inverse"
+	Reason int    // GUARD_CONCURRENT_CALL or GUARD_REUSE_AFTER_ERROR
+}
+
+// Error returns the description of the misuse
+func (this GuardError) Error() string {
+	if this.Reason == GUARD_CONCURRENT_CALL {
+		return fmt.Sprintf("%s rejected: the transform instance is already in use by another goroutine", this.Op)
+	}
+
+	return fmt.Sprintf("%s rejected: the transform instance failed to decode a previous block and cannot be reused", this.Op)
+}
+
+// transformGuard tracks the state of a transform instance: idle, busy (a
+// call is running) or failed (a fatal error occurred)
+type transformGuard struct {
+	state int32
+}
+
+// Mark the instance busy. Returns an error if it is busy or failed.
+func (this *transformGuard) enter(op string) error {
+	if atomic.CompareAndSwapInt32(&this.state, _GUARD_IDLE, _GUARD_BUSY) == true {
+		return nil
+	}
+
+	if atomic.LoadInt32(&this.state) == _GUARD_FAILED {
+		return &GuardError{Op: op, Reason: GUARD_REUSE_AFTER_ERROR}
+	}
+
+	return &GuardError{Op: op, Reason: GUARD_CONCURRENT_CALL}
+}
+
+// Mark the instance idle (or failed for good)
+func (this *transformGuard) leave(failed bool) {
+	if failed == true {
+		atomic.StoreInt32(&this.state, _GUARD_FAILED)
+	} else {
+		atomic.StoreInt32(&this.state, _GUARD_IDLE)
+	}
+}
+
+// Return the capabilities of a transform (reusable and not safe for
+// concurrent use if it does not implement kanzi.ThreadSafety)
+func transformSafety(t kanzi.ByteTransform) (reusable bool, concurrent bool) {
+	if ts, ok := t.(kanzi.ThreadSafety); ok == true {
+		return ts.IsReusable(), ts.IsConcurrentSafe()
+	}
+
+	return true, false
+}
+
+// GuardedTransform enforces the contract of a transform instance declared
+// with kanzi.ThreadSafety: concurrent calls on an instance that is not safe
+// for concurrent use and calls after a failed Inverse on an instance that
+// is not reusable return a GuardError instead of racing on shared state.
+type GuardedTransform struct {
+	transform  kanzi.ByteTransform
+	reusable   bool
+	concurrent bool
+	guard      transformGuard
+}
+
+// NewGuardedTransform creates a new instance of GuardedTransform wrapping
+// the provided transform
+func NewGuardedTransform(t kanzi.ByteTransform) (*GuardedTransform, error) {
+	if t == nil {
+		return nil, fmt.Errorf("Invalid null transform parameter")
+	}
+
+	this := &GuardedTransform{transform: t}
+	this.reusable, this.concurrent = transformSafety(t)
+	return this, nil
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *GuardedTransform) Forward(src, dst []byte) (uint, uint, error) {
+	if this.concurrent == true {
+		if atomic.LoadInt32(&this.guard.state) == _GUARD_FAILED {
+			return 0, 0, &GuardError{Op: "Forward", Reason: GUARD_REUSE_AFTER_ERROR}
+		}
+
+		return this.transform.Forward(src, dst)
+	}
+
+	if err := this.guard.enter("Forward"); err != nil {
+		return 0, 0, err
+	}
+
+	defer this.guard.leave(false)
+	return this.transform.Forward(src, dst)
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *GuardedTransform) Inverse(src, dst []byte) (uint, uint, error) {
+	if this.concurrent == true {
+		if atomic.LoadInt32(&this.guard.state) == _GUARD_FAILED {
+			return 0, 0, &GuardError{Op: "Inverse", Reason: GUARD_REUSE_AFTER_ERROR}
+		}
+
+		srcIdx, dstIdx, err := this.transform.Inverse(src, dst)
+
+		if err != nil && this.reusable == false {
+			atomic.StoreInt32(&this.guard.state, _GUARD_FAILED)
+		}
+
+		return srcIdx, dstIdx, err
+	}
+
+	if err := this.guard.enter("Inverse"); err != nil {
+		return 0, 0, err
+	}
+
+	// A panic in the transform also counts as a failure
+	failed := true
+
+	defer func() {
+		this.guard.leave(failed == true && this.reusable == false)
+	}()
+
+	srcIdx, dstIdx, err := this.transform.Inverse(src, dst)
+	failed = err != nil
+	return srcIdx, dstIdx, err
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this *GuardedTransform) MaxEncodedLen(srcLen int) int {
+	if f, isFunction := this.transform.(kanzi.ByteFunction); isFunction == true {
+		return f.MaxEncodedLen(srcLen)
+	}
+
+	return srcLen
+}
+
+// IsReusable returns the capability of the wrapped transform
+func (this *GuardedTransform) IsReusable() bool {
+	return this.reusable
+}
+
+// IsConcurrentSafe returns the capability of the wrapped transform
+func (this *GuardedTransform) IsConcurrentSafe() bool {
+	return this.concurrent
+}
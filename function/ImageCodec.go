@@ -0,0 +1,516 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	IMG_MAX_WIDTH    = 1 << 20 // max image width (pixels)
+	IMG_MAX_CHANNELS = 4       // max bytes per pixel
+
+	_IMG_MIN_WIDTH      = 16
+	_IMG_MIN_ROWS       = 2
+	_IMG_MIN_GAIN       = 95 // the residuals must lower the entropy by 5% at least
+	_IMG_MAX_HEADER     = 1 + 5*5
+	_IMG_MODE_BMP       = 1
+	_IMG_MODE_PNM       = 2
+	_IMG_MODE_RAW       = 3
+	_IMG_MODE_MASK      = 0x0F
+	_IMG_DECORRELATE    = 0x80 // R-G and B-G planes
+	_IMG_FILTER_NONE    = 0
+	_IMG_FILTER_LEFT    = 1
+	_IMG_FILTER_UP      = 2
+	_IMG_FILTER_AVERAGE = 3
+	_IMG_FILTER_PAETH   = 4
+	_IMG_FILTER_LINEAR  = 5
+	_IMG_NB_FILTERS     = 6
+)
+
+// Image stream format: mode (1 byte) + header size, width, channels, stride
+// and number of rows (varints) + image header (copied) + one filter per row
+// and plane + residuals of plane 0 + residuals of plane 1 + ... + row
+// padding bytes + bytes after the last complete row (copied).
+
+// ImageCodec a transform for uncompressed images (BMP, PGM/PPM or raw
+// pixels). The header of the image is detected at the start of the block
+// (24/32 bit uncompressed BMP or binary PGM/PPM with 8 bit samples) or the
+// geometry is provided in the context ('imageWidth' and 'imageChannels')
+// for raw pixels. The pixels are deinterleaved into color planes (the green
+// plane is subtracted from the red and blue planes) and each row of each
+// plane is replaced with the residuals of the best of a set of predictors
+// (left, up, average, Paeth, linear), like the PNG filters. Blocks without
+// image header (EG. the blocks after the first one) are rejected unless the
+// geometry is provided.
+type ImageCodec struct {
+	width    int // 0 => auto
+	channels int
+}
+
+type imageGeometry struct {
+	mode     int
+	header   int // size of the image header
+	width    int // pixels per row
+	channels int // bytes per pixel
+	stride   int // bytes per row (including padding)
+}
+
+// NewImageCodec creates a new instance of ImageCodec
+func NewImageCodec() (*ImageCodec, error) {
+	return &ImageCodec{}, nil
+}
+
+// NewImageCodecWithCtx creates a new instance of ImageCodec using a
+// configuration map as parameter.
+func NewImageCodecWithCtx(ctx *map[string]interface{}) (*ImageCodec, error) {
+	this := &ImageCodec{}
+
+	if val, containsKey := (*ctx)["imageWidth"]; containsKey {
+		this.width = val.(int)
+		this.channels = 3
+
+		if this.width < _IMG_MIN_WIDTH || this.width > IMG_MAX_WIDTH {
+			return nil, fmt.Errorf("Invalid image width: %v (must be in [%d..%d])", this.width, _IMG_MIN_WIDTH, IMG_MAX_WIDTH)
+		}
+
+		if val, containsKey := (*ctx)["imageChannels"]; containsKey {
+			this.channels = val.(int)
+
+			if this.channels < 1 || this.channels > IMG_MAX_CHANNELS {
+				return nil, fmt.Errorf("Invalid number of image channels: %v (must be in [1..%d])", this.channels, IMG_MAX_CHANNELS)
+			}
+		}
+	}
+
+	return this, nil
+}
+
+// Detect an uncompressed BMP image with 24 or 32 bits per pixel
+func detectBMP(block []byte) (imageGeometry, bool) {
+	g := imageGeometry{mode: _IMG_MODE_BMP}
+
+	if len(block) < 54 || block[0] != 'B' || block[1] != 'M' {
+		return g, false
+	}
+
+	offset := int(binary.LittleEndian.Uint32(block[10:]))
+	dibSize := int(binary.LittleEndian.Uint32(block[14:]))
+	width := int(int32(binary.LittleEndian.Uint32(block[18:])))
+	planes := binary.LittleEndian.Uint16(block[26:])
+	bpp := int(binary.LittleEndian.Uint16(block[28:]))
+	compression := binary.LittleEndian.Uint32(block[30:])
+
+	if dibSize < 40 || offset < 14+dibSize || offset > len(block) || planes != 1 || compression != 0 {
+		return g, false
+	}
+
+	if bpp != 24 && bpp != 32 {
+		return g, false
+	}
+
+	g.header = offset
+	g.width = width
+	g.channels = bpp >> 3
+	g.stride = ((width*bpp + 31) >> 5) << 2
+	return g, true
+}
+
+// Read a decimal value of a PNM header (after white spaces and comments)
+func readPNMValue(block []byte, idx int) (int, int) {
+	for idx < len(block) {
+		if block[idx] == '#' {
+			for idx < len(block) && block[idx] != '\n' {
+				idx++
+			}
+		} else if block[idx] == ' ' || block[idx] == '\t' || block[idx] == '\r' || block[idx] == '\n' {
+			idx++
+		} else {
+			break
+		}
+	}
+
+	val := 0
+	start := idx
+
+	for idx < len(block) && block[idx] >= '0' && block[idx] <= '9' && idx-start < 8 {
+		val = 10*val + int(block[idx]-'0')
+		idx++
+	}
+
+	if idx == start {
+		return -1, idx
+	}
+
+	return val, idx
+}
+
+// Detect a binary PGM (P5) or PPM (P6) image with 8 bit samples
+func detectPNM(block []byte) (imageGeometry, bool) {
+	g := imageGeometry{mode: _IMG_MODE_PNM}
+
+	if len(block) < 16 || block[0] != 'P' || (block[1] != '5' && block[1] != '6') {
+		return g, false
+	}
+
+	width, idx := readPNMValue(block, 2)
+	height, idx := readPNMValue(block, idx)
+	maxVal, idx := readPNMValue(block, idx)
+
+	// A single white space follows the max value
+	if width <= 0 || height <= 0 || maxVal <= 0 || maxVal > 255 || idx >= len(block) {
+		return g, false
+	}
+
+	if c := block[idx]; c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+		return g, false
+	}
+
+	g.header = idx + 1
+	g.width = width
+	g.channels = 1
+
+	if block[1] == '6' {
+		g.channels = 3
+	}
+
+	g.stride = width * g.channels
+	return g, true
+}
+
+func (this *ImageCodec) geometry(block []byte) (imageGeometry, bool) {
+	if this.width != 0 {
+		return imageGeometry{mode: _IMG_MODE_RAW, width: this.width, channels: this.channels,
+			stride: this.width * this.channels}, true
+	}
+
+	if g, ok := detectBMP(block); ok == true {
+		return g, true
+	}
+
+	return detectPNM(block)
+}
+
+// Return the prediction of the filter given the left, up and upper left
+// values
+func imagePredict(filter int, a, b, c int) int {
+	switch filter {
+	case _IMG_FILTER_LEFT:
+		return a
+
+	case _IMG_FILTER_UP:
+		return b
+
+	case _IMG_FILTER_AVERAGE:
+		return (a + b) >> 1
+
+	case _IMG_FILTER_PAETH:
+		p := a + b - c
+		pa := p - a
+		pb := p - b
+		pc := p - c
+		pa = (pa + (pa >> 31)) ^ (pa >> 31)
+		pb = (pb + (pb >> 31)) ^ (pb >> 31)
+		pc = (pc + (pc >> 31)) ^ (pc >> 31)
+
+		if pa <= pb && pa <= pc {
+			return a
+		}
+
+		if pb <= pc {
+			return b
+		}
+
+		return c
+
+	case _IMG_FILTER_LINEAR:
+		p := a + b - c
+
+		if p < 0 {
+			return 0
+		}
+
+		if p > 255 {
+			return 255
+		}
+
+		return p
+
+	default:
+		return 0
+	}
+}
+
+// Load the values of the plane for a row (minus the green value if the
+// planes are decorrelated)
+func loadImageRow(block []byte, g imageGeometry, decorrelate bool, c int, row []byte) {
+	idx := c
+
+	if decorrelate == true && c != 1 && c < 3 {
+		for i := range row {
+			row[i] = block[idx] - block[idx-c+1]
+			idx += g.channels
+		}
+
+		return
+	}
+
+	for i := range row {
+		row[i] = block[idx]
+		idx += g.channels
+	}
+}
+
+// Select the filter with the smallest sum of absolute residuals
+func selectImageFilter(cur, prev []byte) int {
+	best := _IMG_FILTER_NONE
+	bestCost := -1
+
+	for f := 0; f < _IMG_NB_FILTERS; f++ {
+		cost := 0
+		a, c := 0, 0
+
+		for i := range cur {
+			b := int(prev[i])
+			r := int(int8(cur[i] - byte(imagePredict(f, a, b, c))))
+			cost += (r + (r >> 31)) ^ (r >> 31)
+			a, c = int(cur[i]), b
+		}
+
+		if bestCost < 0 || cost < bestCost {
+			best, bestCost = f, cost
+		}
+	}
+
+	return best
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *ImageCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	g, ok := this.geometry(src)
+
+	if ok == false {
+		return 0, 0, kanzi.NewNotApplicableError("No image header found")
+	}
+
+	if g.width < _IMG_MIN_WIDTH || g.width > IMG_MAX_WIDTH || g.stride > len(src) {
+		return 0, 0, kanzi.NewNotApplicableError("Image size not supported")
+	}
+
+	rows := (len(src) - g.header) / g.stride
+
+	if rows < _IMG_MIN_ROWS {
+		return 0, 0, kanzi.NewNotApplicableError("Image too small, skip")
+	}
+
+	mode := g.mode
+	decorrelate := g.channels >= 3
+
+	if decorrelate == true {
+		mode |= _IMG_DECORRELATE
+	}
+
+	dst[0] = byte(mode)
+	dstIdx := 1
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.header)
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.width)
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.channels)
+	dstIdx += emitPathVarInt(dst[dstIdx:], g.stride)
+	dstIdx += emitPathVarInt(dst[dstIdx:], rows)
+	dstIdx += copy(dst[dstIdx:], src[0:g.header])
+	filterIdx := dstIdx
+	dstIdx += rows * g.channels
+	resStart := dstIdx
+	prev := make([]byte, g.width)
+	cur := make([]byte, g.width)
+
+	for c := 0; c < g.channels; c++ {
+		for i := range prev {
+			prev[i] = 0
+		}
+
+		for r := 0; r < rows; r++ {
+			loadImageRow(src[g.header+r*g.stride:], g, decorrelate, c, cur)
+			f := selectImageFilter(cur, prev)
+			dst[filterIdx+r*g.channels+c] = byte(f)
+			a, cc := 0, 0
+
+			for i := range cur {
+				b := int(prev[i])
+				dst[dstIdx] = cur[i] - byte(imagePredict(f, a, b, cc))
+				dstIdx++
+				a, cc = int(cur[i]), b
+			}
+
+			prev, cur = cur, prev
+		}
+	}
+
+	// The residuals must be more compressible than the pixels
+	histo := [256]int{}
+	kanzi.ComputeHistogram(src[g.header:g.header+rows*g.stride], histo[:], true, false)
+	baseline := kanzi.ComputeEntropy1024(histo[:], rows*g.stride)
+	kanzi.ComputeHistogram(dst[resStart:dstIdx], histo[:], true, false)
+
+	if kanzi.ComputeEntropy1024(histo[:], dstIdx-resStart)*100 >= baseline*_IMG_MIN_GAIN {
+		return 0, 0, kanzi.NewNotApplicableError("No gain from image prediction")
+	}
+
+	// Row padding then tail
+	if pad := g.stride - g.width*g.channels; pad > 0 {
+		for r := 0; r < rows; r++ {
+			start := g.header + r*g.stride + g.width*g.channels
+			dstIdx += copy(dst[dstIdx:], src[start:start+pad])
+		}
+	}
+
+	dstIdx += copy(dst[dstIdx:], src[g.header+rows*g.stride:])
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *ImageCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	mode := int(src[0])
+	srcIdx := 1
+	var vals [5]int
+
+	for i := range vals {
+		val, n, err := readPathVarInt(src[srcIdx:])
+
+		if err != nil {
+			return 0, 0, kanzi.NewCorruptStreamError("Invalid image header in bitstream")
+		}
+
+		vals[i] = val
+		srcIdx += n
+	}
+
+	g := imageGeometry{mode: mode & _IMG_MODE_MASK, header: vals[0], width: vals[1], channels: vals[2], stride: vals[3]}
+	rows := vals[4]
+	decorrelate := mode&_IMG_DECORRELATE != 0
+
+	if g.mode < _IMG_MODE_BMP || g.mode > _IMG_MODE_RAW || g.width < _IMG_MIN_WIDTH || g.width > IMG_MAX_WIDTH ||
+		g.channels < 1 || g.channels > IMG_MAX_CHANNELS || g.stride < g.width*g.channels ||
+		rows < _IMG_MIN_ROWS || decorrelate != (g.channels >= 3) {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid image geometry in bitstream")
+	}
+
+	// The filters are the only extra bytes
+	if g.header > len(src) || rows > len(src)/g.stride || srcIdx+g.header+rows*g.channels+rows*g.stride > len(src) {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid image size in bitstream")
+	}
+
+	count := len(src) - srcIdx - rows*g.channels
+
+	if len(dst) < count {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), count))
+	}
+
+	srcIdx += copy(dst, src[srcIdx:srcIdx+g.header])
+	filterIdx := srcIdx
+	srcIdx += rows * g.channels
+
+	for c := 0; c < g.channels; c++ {
+		for r := 0; r < rows; r++ {
+			f := int(src[filterIdx+r*g.channels+c])
+
+			if f >= _IMG_NB_FILTERS {
+				return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid image filter in bitstream: %d", f))
+			}
+
+			idx := g.header + r*g.stride + c
+			a, cc := 0, 0
+
+			for i := 0; i < g.width; i++ {
+				b := 0
+
+				if r > 0 {
+					b = int(dst[idx-g.stride])
+				}
+
+				dst[idx] = src[srcIdx] + byte(imagePredict(f, a, b, cc))
+				srcIdx++
+				a, cc = int(dst[idx]), b
+				idx += g.channels
+			}
+		}
+	}
+
+	if decorrelate == true {
+		for r := 0; r < rows; r++ {
+			idx := g.header + r*g.stride
+
+			for i := 0; i < g.width; i++ {
+				dst[idx] += dst[idx+1]
+				dst[idx+2] += dst[idx+1]
+				idx += g.channels
+			}
+		}
+	}
+
+	if pad := g.stride - g.width*g.channels; pad > 0 {
+		for r := 0; r < rows; r++ {
+			start := g.header + r*g.stride + g.width*g.channels
+			srcIdx += copy(dst[start:start+pad], src[srcIdx:])
+		}
+	}
+
+	srcIdx += copy(dst[g.header+rows*g.stride:count], src[srcIdx:])
+	return uint(srcIdx), uint(count), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this ImageCodec) MaxEncodedLen(srcLen int) int {
+	// One filter per row and plane (at least _IMG_MIN_WIDTH bytes per row)
+	return srcLen + srcLen/_IMG_MIN_WIDTH + _IMG_MAX_HEADER
+}
+
+// IsReusable returns true
+func (this *ImageCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the geometry is set at creation)
+func (this *ImageCodec) IsConcurrentSafe() bool {
+	return true
+}
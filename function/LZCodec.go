@@ -17,12 +17,32 @@ package function
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
 )
 
 // Simple byte oriented LZ77 codec implementation.
 // It is just LZ4 modified to use a bigger hash map.
+// Three match finders produce the same format (the decoder is shared):
+// - fast (default): one position per hash, skips ahead in incompressible
+//   regions (LZ4 acceleration)
+// - greedy: hash chains, the longest match at each position is emitted
+// - lazy: hash chains, a match is deferred if the next position starts a
+//   longer one
+// The mode is selected with ctx["lzMode"].
+// A preset dictionary (see LZDictionary) can be provided with
+// ctx["lzDictionary"]: the block is then preceded by the dictionary id.
+
+const (
+	// LZ_MODE_FAST mode: single entry hash table (default)
+	LZ_MODE_FAST = 0
+	// LZ_MODE_GREEDY mode: hash chains and greedy parsing
+	LZ_MODE_GREEDY = 1
+	// LZ_MODE_LAZY mode: hash chains and lazy parsing
+	LZ_MODE_LAZY = 2
+)
 
 const (
 	_LZ_HASH_SEED    = 0x7FEB352D
@@ -41,11 +61,17 @@ const (
 	_MIN_LENGTH      = 14
 	_MAX_LENGTH      = (32 * 1024 * 1024) - 4 - _MIN_MATCH
 	_SEARCH_MATCH_NB = 1 << 6
+	_LZ_CHAIN_LOG    = 16 // window of the hash chains (_MAX_DISTANCE+1)
+	_LZ_CHAIN_MASK   = (1 << _LZ_CHAIN_LOG) - 1
+	_LZ_CHAIN_DEPTH  = 32 // max number of candidates per position
 )
 
 // LZCodec Lempel Ziv (LZ77) codec based on LZ4
 type LZCodec struct {
-	buffer []int32
+	buffer    []int32
+	reference bool // byte by byte match copy in Inverse
+	mode      int
+	dict      *LZDictionary
 }
 
 // NewLZCodec creates a new instance of LZCodec
@@ -60,6 +86,25 @@ func NewLZCodec() (*LZCodec, error) {
 func NewLZCodecWithCtx(ctx *map[string]interface{}) (*LZCodec, error) {
 	this := &LZCodec{}
 	this.buffer = make([]int32, 0)
+
+	if val, containsKey := (*ctx)["reference"]; containsKey {
+		this.reference = val.(bool)
+	}
+
+	if val, containsKey := (*ctx)["lzMode"]; containsKey {
+		this.mode = val.(int)
+
+		if this.mode != LZ_MODE_FAST && this.mode != LZ_MODE_GREEDY && this.mode != LZ_MODE_LAZY {
+			return nil, fmt.Errorf("Invalid LZ mode: %v", this.mode)
+		}
+	}
+
+	var err error
+
+	if this.dict, err = lzDictionaryFromCtx(ctx); err != nil {
+		return nil, err
+	}
+
 	return this, nil
 }
 
@@ -106,43 +151,81 @@ func (this *LZCodec) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 
 	if n := this.MaxEncodedLen(count); len(dst) < n {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
+	if this.dict == nil {
+		if this.mode != LZ_MODE_FAST {
+			return this.forwardChains(src, 0, dst)
+		}
+
+		return this.forwardFast(src, 0, dst)
+	}
+
+	// The block follows the dictionary: the matches can reference it
+	dict := this.dict.data
+	buf := alloc.Bytes(len(dict) + count)
+	defer alloc.PutBytes(buf)
+	copy(buf, dict)
+	copy(buf[len(dict):], src)
+	binary.BigEndian.PutUint32(dst, this.dict.id)
+	var srcIdx, dstIdx uint
+	var err error
+
+	if this.mode != LZ_MODE_FAST {
+		srcIdx, dstIdx, err = this.forwardChains(buf, len(dict), dst[4:])
+	} else {
+		srcIdx, dstIdx, err = this.forwardFast(buf, len(dict), dst[4:])
+	}
+
+	return srcIdx, dstIdx + 4, err
+}
+
+// Encode src[start:] (src[0:start] is the dictionary)
+func (this *LZCodec) forwardFast(src []byte, start int, dst []byte) (uint, uint, error) {
+	srcEnd := len(src)
+	count := srcEnd - start
 	var hashLog uint
 
-	if count < _MAX_DISTANCE {
+	if srcEnd < _MAX_DISTANCE {
 		hashLog = _HASH_LOG_SMALL
 	} else {
 		hashLog = _HASH_LOG_BIG
 	}
 
 	hashShift := 32 - hashLog
-	srcEnd := count
 	matchLimit := srcEnd - _LAST_LITERALS
 	mfLimit := srcEnd - _MF_LIMIT
-	srcIdx := 0
+	srcIdx := start
 	dstIdx := 0
-	anchor := 0
+	anchor := start
 
 	if count > _MIN_LENGTH {
+		// Hash table returned to the pool on exit
 		if len(this.buffer) < 1<<hashLog {
-			this.buffer = make([]int32, 1<<hashLog)
+			alloc.PutInt32s(this.buffer)
+			this.buffer = alloc.Int32s(1 << hashLog)
+			defer this.releaseBuffer()
 		} else {
 			for i := range this.buffer {
 				this.buffer[i] = 0
 			}
 		}
 
-		// First byte
 		table := this.buffer
+
+		for i := 0; i < start; i++ {
+			table[(binary.LittleEndian.Uint32(src[i:])*_LZ_HASH_SEED)>>hashShift] = int32(i)
+		}
+
+		// First byte
 		h32 := (binary.LittleEndian.Uint32(src[srcIdx:]) * _LZ_HASH_SEED) >> hashShift
 		table[h32] = int32(srcIdx)
 		srcIdx++
@@ -162,7 +245,7 @@ func (this *LZCodec) Forward(src, dst []byte) (uint, uint, error) {
 				if fwdIdx > mfLimit {
 					// Emit last literals
 					dstIdx += emitLastLiterals(src[anchor:srcEnd], dst[dstIdx:])
-					return uint(srcEnd), uint(dstIdx), error(nil)
+					return uint(count), uint(dstIdx), error(nil)
 				}
 
 				step = searchMatchNb >> _SKIP_STRENGTH
@@ -229,7 +312,7 @@ func (this *LZCodec) Forward(src, dst []byte) (uint, uint, error) {
 
 				if srcIdx > mfLimit {
 					dstIdx += emitLastLiterals(src[anchor:srcEnd], dst[dstIdx:])
-					return uint(srcEnd), uint(dstIdx), error(nil)
+					return uint(count), uint(dstIdx), error(nil)
 				}
 
 				// Fill table
@@ -258,7 +341,166 @@ func (this *LZCodec) Forward(src, dst []byte) (uint, uint, error) {
 
 	// Emit last literals
 	dstIdx += emitLastLiterals(src[anchor:srcEnd], dst[dstIdx:])
-	return uint(srcEnd), uint(dstIdx), error(nil)
+	return uint(count), uint(dstIdx), error(nil)
+}
+
+// Emit literals and match (token, literal length, literals, offset, match length)
+func emitSequence(literals []byte, distance, matchLength int, dst []byte) int {
+	litLength := len(literals)
+	dstIdx := 1
+
+	if litLength >= _RUN_MASK {
+		dst[0] = byte(_RUN_MASK << _ML_BITS)
+		dstIdx += emitLength(dst[dstIdx:], litLength-_RUN_MASK)
+	} else {
+		dst[0] = byte(litLength << _ML_BITS)
+	}
+
+	dstIdx += copy(dst[dstIdx:], literals)
+	dst[dstIdx] = byte(distance)
+	dst[dstIdx+1] = byte(distance >> 8)
+	dstIdx += 2
+	matchLength -= _MIN_MATCH
+
+	if matchLength >= _ML_MASK {
+		dst[0] += byte(_ML_MASK)
+		dstIdx += emitLength(dst[dstIdx:], matchLength-_ML_MASK)
+	} else {
+		dst[0] += byte(matchLength)
+	}
+
+	return dstIdx
+}
+
+// Hash chains match finder (greedy or lazy parsing)
+type lzChains struct {
+	src      []byte
+	heads    []int32 // last position+1 for each hash
+	chain    []int32 // previous position+1 with the same hash (sliding window)
+	inserted int     // next position to insert
+	limit    int     // last position that can be inserted
+	maxMatch int     // end of the data available for matches
+}
+
+func (this *lzChains) hash(pos int) uint32 {
+	return (binary.LittleEndian.Uint32(this.src[pos:]) * _LZ_HASH_SEED) >> (32 - _HASH_LOG_BIG)
+}
+
+// Insert all the positions before 'pos' in the chains
+func (this *lzChains) update(pos int) {
+	if pos > this.limit+1 {
+		pos = this.limit + 1
+	}
+
+	for ; this.inserted < pos; this.inserted++ {
+		h := this.hash(this.inserted)
+		this.chain[this.inserted&_LZ_CHAIN_MASK] = this.heads[h]
+		this.heads[h] = int32(this.inserted + 1)
+	}
+}
+
+// Return the position and length of the longest match for 'pos' (length 0
+// if no match of at least _MIN_MATCH bytes)
+func (this *lzChains) find(pos int) (int, int) {
+	this.update(pos)
+	src := this.src
+	maxLength := this.maxMatch - pos
+
+	if maxLength > _MAX_LENGTH {
+		maxLength = _MAX_LENGTH
+	}
+
+	bestPos, bestLength := 0, _MIN_MATCH-1
+	cand := int(this.heads[this.hash(pos)]) - 1
+
+	for depth := _LZ_CHAIN_DEPTH; depth > 0 && cand >= 0 && pos-cand <= _MAX_DISTANCE; depth-- {
+		// Quick rejection: the candidate must improve on the best length
+		if src[cand+bestLength] == src[pos+bestLength] {
+			n := 0
+
+			for n < maxLength && src[cand+n] == src[pos+n] {
+				n++
+			}
+
+			if n > bestLength {
+				bestPos, bestLength = cand, n
+
+				if n >= maxLength {
+					break
+				}
+			}
+		}
+
+		next := int(this.chain[cand&_LZ_CHAIN_MASK]) - 1
+
+		if next >= cand {
+			break
+		}
+
+		cand = next
+	}
+
+	if bestLength < _MIN_MATCH {
+		return 0, 0
+	}
+
+	return bestPos, bestLength
+}
+
+// Encode src[start:] (src[0:start] is the dictionary)
+func (this *LZCodec) forwardChains(src []byte, start int, dst []byte) (uint, uint, error) {
+	count := len(src)
+	dstIdx := 0
+	anchor := start
+
+	if count-start > _MIN_LENGTH {
+		mfLimit := count - _MF_LIMIT
+		mf := &lzChains{
+			src:      src,
+			heads:    alloc.Int32s(1 << _HASH_LOG_BIG),
+			chain:    alloc.Int32s(1 << _LZ_CHAIN_LOG),
+			limit:    mfLimit,
+			maxMatch: count - _LAST_LITERALS,
+		}
+
+		defer func() {
+			alloc.PutInt32s(mf.heads)
+			alloc.PutInt32s(mf.chain)
+		}()
+
+		pos := start
+
+		for pos <= mfLimit {
+			match, length := mf.find(pos)
+
+			if length == 0 {
+				pos++
+				continue
+			}
+
+			if this.mode == LZ_MODE_LAZY {
+				// Defer the match while the next position starts a longer one
+				for pos < mfLimit {
+					match2, length2 := mf.find(pos + 1)
+
+					if length2 <= length {
+						break
+					}
+
+					pos++
+					match, length = match2, length2
+				}
+			}
+
+			dstIdx += emitSequence(src[anchor:pos], pos-match, length, dst[dstIdx:])
+			pos += length
+			anchor = pos
+		}
+	}
+
+	// Emit last literals
+	dstIdx += emitLastLiterals(src[anchor:count], dst[dstIdx:])
+	return uint(count - start), uint(dstIdx), nil
 }
 
 // Inverse applies the reverse function to the src and writes the result
@@ -269,15 +511,42 @@ func (this *LZCodec) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if this.dict == nil {
+		return this.inverse(src, dst, 0)
+	}
+
+	dict, err := readLZDictHeader(src, this.dict)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Decode after the dictionary: the matches can reference it
+	start := len(dict.data)
+	buf := alloc.Bytes(start + len(dst))
+	defer alloc.PutBytes(buf)
+	copy(buf, dict.data)
+	srcIdx, dstIdx, err := this.inverse(src[4:], buf, start)
+
+	if err != nil {
+		return 0, 0, err
 	}
 
+	copy(dst, buf[start:start+int(dstIdx)])
+	return srcIdx + 4, dstIdx, nil
+}
+
+// Decode to dst[start:] (dst[0:start] is the dictionary)
+func (this *LZCodec) inverse(src, dst []byte, start int) (uint, uint, error) {
 	count := len(src)
 	srcEnd := count - _COPY_LENGTH
 	dstEnd := len(dst) - _COPY_LENGTH
 	srcIdx := 0
-	dstIdx := 0
+	dstIdx := start
 
 	for {
 		// Get literal length
@@ -295,7 +564,7 @@ func (this *LZCodec) Inverse(src, dst []byte) (uint, uint, error) {
 			srcIdx++
 
 			if length > _MAX_LENGTH {
-				return 0, 0, fmt.Errorf("Invalid length decoded: %d", length)
+				return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid length decoded: %d", length))
 			}
 		}
 
@@ -342,14 +611,14 @@ func (this *LZCodec) Inverse(src, dst []byte) (uint, uint, error) {
 			}
 
 			if length > _MAX_LENGTH || srcIdx == count {
-				return 0, 0, fmt.Errorf("Invalid length decoded: %d", length)
+				return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid length decoded: %d", length))
 			}
 		}
 
 		length += _MIN_MATCH
 		cpy := dstIdx + length
 
-		if cpy > dstEnd {
+		if cpy > dstEnd || this.reference == true {
 			// Do not use copy on (potentially) overlapping slices
 			for i := 0; i < length; i++ {
 				dst[dstIdx+i] = dst[match+i]
@@ -392,14 +661,36 @@ func (this *LZCodec) Inverse(src, dst []byte) (uint, uint, error) {
 		dstIdx = cpy
 	}
 
-	return uint(srcIdx), uint(dstIdx), nil
+	return uint(srcIdx), uint(dstIdx - start), nil
+}
+
+// Return the hash table to the pool
+func (this *LZCodec) releaseBuffer() {
+	alloc.PutInt32s(this.buffer)
+	this.buffer = this.buffer[:0:0]
 }
 
 // MaxEncodedLen returns the max size required for the encoding output buffer
 func (this LZCodec) MaxEncodedLen(srcLen int) int {
+	res := srcLen + srcLen/64
+
 	if srcLen <= 1024 {
-		return srcLen + 16
+		res = srcLen + 16
+	}
+
+	if this.dict != nil {
+		res += 4
 	}
 
-	return srcLen + srcLen/64
+	return res
+}
+
+// IsReusable returns true (the preset dictionary is read only)
+func (this *LZCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns false (the hash table is shared by the calls)
+func (this *LZCodec) IsConcurrentSafe() bool {
+	return false
 }
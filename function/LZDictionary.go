@@ -0,0 +1,336 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	khash "github.com/flanglet/kanzi-go/util/hash"
+)
+
+const (
+	LZ_MIN_DICT_SIZE = 256           // minimum size of a preset dictionary
+	LZ_MAX_DICT_SIZE = _MAX_DISTANCE // the whole dictionary must be reachable
+
+	_LZ_TRAIN_DMER     = 8   // length of the substrings counted by the trainer
+	_LZ_TRAIN_SEGMENT  = 256 // length of the segments selected by the trainer
+	_LZ_TRAIN_HASH_LOG = 20
+)
+
+// LZDictionary a preset dictionary for the LZ codec: content expected to
+// occur in the blocks (EG. common fields of small JSON messages). The
+// dictionary precedes each block: the matches can reference it and the
+// small blocks compress as if they were part of a bigger one.
+//
+// The dictionary must be provided to both the encoder and the decoder
+// (ctx["lzDictionary"]). A block encoded with a dictionary starts with the
+// dictionary id. If it differs from the id of the dictionary of the decoder,
+// the dictionary with this id must be registered (see RegisterLZDictionary).
+type LZDictionary struct {
+	id   uint32
+	data []byte
+}
+
+var (
+	_LZ_DICTIONARIES     = make(map[uint32]*LZDictionary)
+	_LZ_DICTIONARIES_MTX sync.RWMutex
+)
+
+// NewLZDictionary creates a new instance of LZDictionary with a copy of the
+// provided content. The most frequent content should be at the end (closest
+// to the data, hence encoded with the smallest distances).
+func NewLZDictionary(data []byte) (*LZDictionary, error) {
+	if len(data) < LZ_MIN_DICT_SIZE || len(data) > LZ_MAX_DICT_SIZE {
+		return nil, fmt.Errorf("Invalid LZ dictionary size: %d (must be in [%d..%d])",
+			len(data), LZ_MIN_DICT_SIZE, LZ_MAX_DICT_SIZE)
+	}
+
+	this := &LZDictionary{data: make([]byte, len(data))}
+	copy(this.data, data)
+	hasher, _ := khash.NewXXHash32(0)
+	this.id = hasher.Hash(this.data)
+	return this, nil
+}
+
+// ID returns the identifier of the dictionary (hash of its content)
+func (this *LZDictionary) ID() uint32 {
+	return this.id
+}
+
+// Bytes returns the content of the dictionary (EG. to save it). The slice
+// must not be modified.
+func (this *LZDictionary) Bytes() []byte {
+	return this.data
+}
+
+// RegisterLZDictionary makes a dictionary available to the LZ decoders
+// (needed to decode blocks encoded with a dictionary other than the one
+// provided to the decoder)
+func RegisterLZDictionary(dict *LZDictionary) error {
+	if dict == nil {
+		return errors.New("Invalid null LZ dictionary")
+	}
+
+	_LZ_DICTIONARIES_MTX.Lock()
+	defer _LZ_DICTIONARIES_MTX.Unlock()
+	_LZ_DICTIONARIES[dict.id] = dict
+	return nil
+}
+
+// GetLZDictionary returns the registered dictionary with the provided id
+// or nil
+func GetLZDictionary(id uint32) *LZDictionary {
+	_LZ_DICTIONARIES_MTX.RLock()
+	defer _LZ_DICTIONARIES_MTX.RUnlock()
+	return _LZ_DICTIONARIES[id]
+}
+
+// Return the LZ dictionary in the context (if any)
+func lzDictionaryFromCtx(ctx *map[string]interface{}) (*LZDictionary, error) {
+	val, containsKey := (*ctx)["lzDictionary"]
+
+	if containsKey == false || val == nil {
+		return nil, nil
+	}
+
+	dict, ok := val.(*LZDictionary)
+
+	if ok == false {
+		return nil, fmt.Errorf("Invalid LZ dictionary: expected *LZDictionary, got %T", val)
+	}
+
+	return dict, nil
+}
+
+// Read the dictionary id at the start of a block. Returns the dictionary
+// used to encode the block.
+func readLZDictHeader(src []byte, current *LZDictionary) (*LZDictionary, error) {
+	if len(src) < 4 {
+		return nil, kanzi.NewCorruptStreamError("LZ inverse failed: invalid dictionary header")
+	}
+
+	id := binary.BigEndian.Uint32(src)
+
+	if id == current.id {
+		return current, nil
+	}
+
+	if dict := GetLZDictionary(id); dict != nil {
+		return dict, nil
+	}
+
+	return nil, fmt.Errorf("LZ inverse failed: unknown dictionary id %x (not registered)", id)
+}
+
+// A segment of the samples selected by the trainer
+type lzSegment struct {
+	start int
+	end   int
+	score int
+}
+
+// TrainLZDictionary builds a dictionary of at most 'size' bytes from a set of
+// samples representative of the data to compress (cover algorithm: the
+// samples are split in epochs and the segment of each epoch containing the
+// most frequent substrings of 8 bytes is selected. A substring is counted
+// once per sample and once per dictionary).
+// The best segments are placed at the end of the dictionary.
+func TrainLZDictionary(samples [][]byte, size int) (*LZDictionary, error) {
+	if size < LZ_MIN_DICT_SIZE || size > LZ_MAX_DICT_SIZE {
+		return nil, fmt.Errorf("Invalid LZ dictionary size: %d (must be in [%d..%d])",
+			size, LZ_MIN_DICT_SIZE, LZ_MAX_DICT_SIZE)
+	}
+
+	total := 0
+
+	for _, s := range samples {
+		total += len(s)
+	}
+
+	if total < LZ_MIN_DICT_SIZE {
+		return nil, fmt.Errorf("Not enough sample data to train a LZ dictionary: %d bytes (at least %d required)",
+			total, LZ_MIN_DICT_SIZE)
+	}
+
+	data := make([]byte, 0, total)
+	starts := make([]int, 0, len(samples)+1)
+
+	for _, s := range samples {
+		starts = append(starts, len(data))
+		data = append(data, s...)
+	}
+
+	starts = append(starts, len(data))
+
+	// Number of samples containing each substring (hashed)
+	freqs := make([]uint32, 1<<_LZ_TRAIN_HASH_LOG)
+	lastSample := make([]int32, 1<<_LZ_TRAIN_HASH_LOG)
+
+	for i := range lastSample {
+		lastSample[i] = -1
+	}
+
+	for n := 0; n+1 < len(starts); n++ {
+		for i := starts[n]; i+_LZ_TRAIN_DMER <= starts[n+1]; i++ {
+			h := lzTrainHash(data[i:])
+
+			if lastSample[h] != int32(n) {
+				lastSample[h] = int32(n)
+				freqs[h]++
+			}
+		}
+	}
+
+	// Substrings seen in one sample only do not help
+	for i := range freqs {
+		if freqs[i] < 2 {
+			freqs[i] = 0
+		}
+	}
+
+	segLen := _LZ_TRAIN_SEGMENT
+
+	if segLen > len(data) {
+		segLen = len(data)
+	}
+
+	nbEpochs := size / segLen
+
+	if nbEpochs < 1 {
+		nbEpochs = 1
+	}
+
+	epochSize := len(data) / nbEpochs
+
+	if epochSize < segLen {
+		epochSize = segLen
+		nbEpochs = len(data) / segLen
+	}
+
+	// Number of occurrences of each substring in the current window
+	active := make([]uint16, 1<<_LZ_TRAIN_HASH_LOG)
+	segments := make([]lzSegment, 0, nbEpochs)
+	selected := 0
+
+	// Iterate until the dictionary is full or no useful segment remains
+	for selected < size {
+		found := false
+
+		for e := 0; e < nbEpochs && selected < size; e++ {
+			start := e * epochSize
+			end := start + epochSize
+
+			if e == nbEpochs-1 {
+				end = len(data)
+			}
+
+			seg := lzBestSegment(data, start, end, segLen, freqs, active)
+
+			if seg.score == 0 {
+				continue
+			}
+
+			// Do not select the same substrings again
+			for i := seg.start; i+_LZ_TRAIN_DMER <= seg.end; i++ {
+				freqs[lzTrainHash(data[i:])] = 0
+			}
+
+			found = true
+			segments = append(segments, seg)
+			selected += seg.end - seg.start
+		}
+
+		if found == false {
+			break
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, errors.New("Cannot train a LZ dictionary: no content shared by the samples")
+	}
+
+	// Keep the best segments, the best one at the end of the dictionary
+	sort.SliceStable(segments, func(i, j int) bool { return segments[i].score > segments[j].score })
+	n, length := 0, 0
+
+	for n < len(segments) && length+segments[n].end-segments[n].start <= size {
+		length += segments[n].end - segments[n].start
+		n++
+	}
+
+	buf := make([]byte, 0, length)
+
+	for i := n - 1; i >= 0; i-- {
+		buf = append(buf, data[segments[i].start:segments[i].end]...)
+	}
+
+	if len(buf) < LZ_MIN_DICT_SIZE {
+		return nil, fmt.Errorf("Cannot train a LZ dictionary: only %d bytes of content shared by the samples", len(buf))
+	}
+
+	return NewLZDictionary(buf)
+}
+
+// Return the segment of the range with the highest score (sum of the
+// frequencies of the distinct substrings in the segment)
+func lzBestSegment(data []byte, start, end, segLen int, freqs []uint32, active []uint16) lzSegment {
+	best := lzSegment{start: start, end: start}
+	dmers := segLen - _LZ_TRAIN_DMER + 1
+	score := 0
+	head := start
+
+	for tail := start; tail+_LZ_TRAIN_DMER <= end; tail++ {
+		h := lzTrainHash(data[tail:])
+
+		if active[h] == 0 {
+			score += int(freqs[h])
+		}
+
+		active[h]++
+
+		// Slide the window
+		if tail-head+1 > dmers {
+			h2 := lzTrainHash(data[head:])
+			active[h2]--
+
+			if active[h2] == 0 {
+				score -= int(freqs[h2])
+			}
+
+			head++
+		}
+
+		if score > best.score {
+			best = lzSegment{start: head, end: tail + _LZ_TRAIN_DMER, score: score}
+		}
+	}
+
+	// Clear the window
+	for i := head; i+_LZ_TRAIN_DMER <= end; i++ {
+		active[lzTrainHash(data[i:])] = 0
+	}
+
+	return best
+}
+
+func lzTrainHash(p []byte) uint32 {
+	return uint32((binary.LittleEndian.Uint64(p) * 0x9E3779B97F4A7C15) >> (64 - _LZ_TRAIN_HASH_LOG))
+}
@@ -0,0 +1,496 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	_LOG_IPV4       = 1 // dotted decimal, no leading zeros: 4 bytes
+	_LOG_IPV6       = 2 // canonical text (RFC 5952): 16 bytes
+	_LOG_IPV6_FULL  = 3 // 8 groups of 4 lower case hex digits: 16 bytes
+	_LOG_UUID_LOWER = 4 // 8-4-4-4-12 lower case hex digits: 16 bytes
+	_LOG_UUID_UPPER = 5 // 8-4-4-4-12 upper case hex digits: 16 bytes
+	_LOG_HEX_LOWER  = 6 // even number of lower case hex digits: length + bytes
+	_LOG_HEX_UPPER  = 7 // even number of upper case hex digits: length + bytes
+
+	_LOG_MIN_BLOCK_SIZE = 64
+	_LOG_MIN_HEX_BYTES  = 8   // 16 hex digits (EG. 64 bit ids)
+	_LOG_MAX_HEX_BYTES  = 255 // SHA-512 digests are 64 bytes
+	_LOG_UUID_LENGTH    = 36
+	_LOG_IPV6_MAX_TEXT  = 39
+)
+
+// Log stream format: escape byte + data. The escape byte does not occur
+// in the input. Each token is replaced by: escape, token type, binary value.
+
+// LogCodec a transform for text logs. IPv4 and IPv6 addresses, UUIDs and hex
+// digests (hashes, ids, ...) look random to the entropy coders (and break
+// the LZ matches) but are much smaller in binary. They are replaced with
+// typed tokens (fixed width binary values) and restored verbatim by the
+// inverse transform: only the tokens whose text can be regenerated exactly
+// (canonical addresses, single case hex digits) are replaced.
+type LogCodec struct {
+}
+
+// NewLogCodec creates a new instance of LogCodec
+func NewLogCodec() (*LogCodec, error) {
+	return &LogCodec{}, nil
+}
+
+// NewLogCodecWithCtx creates a new instance of LogCodec using a
+// configuration map as parameter.
+func NewLogCodecWithCtx(ctx *map[string]interface{}) (*LogCodec, error) {
+	return &LogCodec{}, nil
+}
+
+func isLogWordByte(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_'
+}
+
+// Return the value of a hex digit (or -1) and the case of the digit
+// (1 => lower, 2 => upper, 0 => decimal digit)
+func logHexValue(c byte) (int, int) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), 0
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10, 1
+	case c >= 'A' && c <= 'F':
+		return int(c-'A') + 10, 2
+	default:
+		return -1, 0
+	}
+}
+
+func appendLogHex(dst []byte, val []byte, upper bool) []byte {
+	digits := "0123456789abcdef"
+
+	if upper == true {
+		digits = "0123456789ABCDEF"
+	}
+
+	for _, b := range val {
+		dst = append(dst, digits[b>>4], digits[b&0x0F])
+	}
+
+	return dst
+}
+
+// Decode the hex digits of text into val. Returns the case of the digits
+// (1 => lower, 2 => upper, 0 => decimal digits only) or -1 if the text
+// contains other characters or mixes cases.
+func decodeLogHex(text []byte, val []byte) int {
+	res := 0
+
+	for i := range text {
+		v, c := logHexValue(text[i])
+
+		if v < 0 || (c != 0 && res != 0 && c != res) {
+			return -1
+		}
+
+		if c != 0 {
+			res = c
+		}
+
+		if i&1 == 0 {
+			val[i>>1] = byte(v << 4)
+		} else {
+			val[i>>1] |= byte(v)
+		}
+	}
+
+	return res
+}
+
+// Try to encode the token starting at src[0]. Returns the number of bytes of
+// text consumed (0 if no token) and the encoded token (type + value).
+func (this *LogCodec) encodeToken(src []byte, token []byte) (int, []byte) {
+	if n, t := this.encodeUUID(src, token); n > 0 {
+		return n, t
+	}
+
+	if n, t := this.encodeIPv6(src, token); n > 0 {
+		return n, t
+	}
+
+	if n, t := this.encodeIPv4(src, token); n > 0 {
+		return n, t
+	}
+
+	return this.encodeHex(src, token)
+}
+
+func (this *LogCodec) encodeUUID(src []byte, token []byte) (int, []byte) {
+	if len(src) < _LOG_UUID_LENGTH || (len(src) > _LOG_UUID_LENGTH && isLogWordByte(src[_LOG_UUID_LENGTH])) {
+		return 0, nil
+	}
+
+	if src[8] != '-' || src[13] != '-' || src[18] != '-' || src[23] != '-' {
+		return 0, nil
+	}
+
+	var hex [32]byte
+	n := copy(hex[:], src[0:8])
+	n += copy(hex[n:], src[9:13])
+	n += copy(hex[n:], src[14:18])
+	n += copy(hex[n:], src[19:23])
+	copy(hex[n:], src[24:36])
+	token = append(token[:0], _LOG_UUID_LOWER)
+	token = token[0 : 1+16]
+
+	switch decodeLogHex(hex[:], token[1:]) {
+	case 0, 1:
+		return _LOG_UUID_LENGTH, token
+
+	case 2:
+		token[0] = _LOG_UUID_UPPER
+		return _LOG_UUID_LENGTH, token
+
+	default:
+		return 0, nil
+	}
+}
+
+func (this *LogCodec) encodeIPv6(src []byte, token []byte) (int, []byte) {
+	end := 0
+
+	for end < len(src) && end < _LOG_IPV6_MAX_TEXT && (src[end] == ':' || isLogHexDigit(src[end])) {
+		end++
+	}
+
+	// The address may be followed by a colon (EG. 'fe80::1: message')
+	for ; end > 1+16; end-- {
+		if end < len(src) && (isLogWordByte(src[end]) || src[end] == '.') {
+			continue
+		}
+
+		text := string(src[0:end])
+		ip := net.ParseIP(text)
+
+		if ip == nil || ip.To4() != nil {
+			continue
+		}
+
+		token = append(token[:0], _LOG_IPV6)
+		token = append(token, ip.To16()...)
+
+		if ip.String() == text {
+			return end, token
+		}
+
+		if end == _LOG_IPV6_MAX_TEXT && text == string(appendLogIPv6Full(nil, ip)) {
+			token[0] = _LOG_IPV6_FULL
+			return end, token
+		}
+
+		return 0, nil
+	}
+
+	return 0, nil
+}
+
+func appendLogIPv6Full(dst []byte, ip []byte) []byte {
+	for i := 0; i < 16; i += 2 {
+		if i > 0 {
+			dst = append(dst, ':')
+		}
+
+		dst = appendLogHex(dst, ip[i:i+2], false)
+	}
+
+	return dst
+}
+
+func (this *LogCodec) encodeIPv4(src []byte, token []byte) (int, []byte) {
+	token = append(token[:0], _LOG_IPV4)
+	idx := 0
+
+	for k := 0; k < 4; k++ {
+		if k > 0 {
+			if idx >= len(src) || src[idx] != '.' {
+				return 0, nil
+			}
+
+			idx++
+		}
+
+		start := idx
+		val := 0
+
+		for idx < len(src) && idx-start < 3 && src[idx] >= '0' && src[idx] <= '9' {
+			val = 10*val + int(src[idx]-'0')
+			idx++
+		}
+
+		// No leading zeros (the text could not be restored)
+		if idx == start || val > 255 || (src[start] == '0' && idx-start > 1) {
+			return 0, nil
+		}
+
+		token = append(token, byte(val))
+	}
+
+	if idx < len(src) && isLogWordByte(src[idx]) {
+		return 0, nil
+	}
+
+	return idx, token
+}
+
+func (this *LogCodec) encodeHex(src []byte, token []byte) (int, []byte) {
+	end := 0
+
+	for end < len(src) && end < 2*_LOG_MAX_HEX_BYTES && isLogHexDigit(src[end]) {
+		end++
+	}
+
+	if end < 2*_LOG_MIN_HEX_BYTES || end&1 != 0 || (end < len(src) && isLogWordByte(src[end])) {
+		return 0, nil
+	}
+
+	n := end >> 1
+	token = append(token[:0], _LOG_HEX_LOWER, byte(n))
+	token = token[0 : 2+n]
+
+	switch decodeLogHex(src[0:end], token[2:]) {
+	case 0, 1:
+		return end, token
+
+	case 2:
+		token[0] = _LOG_HEX_UPPER
+		return end, token
+
+	default:
+		return 0, nil
+	}
+}
+
+func isLogHexDigit(c byte) bool {
+	v, _ := logHexValue(c)
+	return v >= 0
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *LogCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	count := len(src)
+
+	if count < _LOG_MIN_BLOCK_SIZE {
+		return 0, 0, kanzi.NewNotApplicableError("Log transform failed: input too small")
+	}
+
+	// Select an escape byte absent from the block
+	var freqs [256]int
+
+	for _, c := range src {
+		freqs[c]++
+	}
+
+	escape := -1
+
+	for i := range freqs {
+		if freqs[i] == 0 {
+			escape = i
+			break
+		}
+	}
+
+	if escape < 0 {
+		return 0, 0, kanzi.NewNotApplicableError("Log transform failed: no escape byte available")
+	}
+
+	dst[0] = byte(escape)
+	dstIdx := 1
+	token := make([]byte, 0, 2+_LOG_MAX_HEX_BYTES)
+	tokens := 0
+
+	for srcIdx := 0; srcIdx < count; {
+		c := src[srcIdx]
+
+		// A token starts a word
+		if (isLogHexDigit(c) || c == ':') && (srcIdx == 0 || isLogWordByte(src[srcIdx-1]) == false) {
+			if n, t := this.encodeToken(src[srcIdx:], token); n > 1+len(t) {
+				if dstIdx+1+len(t) > len(dst) {
+					return 0, 0, kanzi.NewNotApplicableError("Log transform failed: output not smaller than input")
+				}
+
+				dst[dstIdx] = byte(escape)
+				dstIdx++
+				dstIdx += copy(dst[dstIdx:], t)
+				srcIdx += n
+				tokens++
+				continue
+			}
+		}
+
+		if dstIdx >= len(dst) {
+			return 0, 0, kanzi.NewNotApplicableError("Log transform failed: output not smaller than input")
+		}
+
+		dst[dstIdx] = c
+		dstIdx++
+		srcIdx++
+	}
+
+	if tokens == 0 || dstIdx >= count {
+		return 0, 0, kanzi.NewNotApplicableError("Log transform failed: output not smaller than input")
+	}
+
+	return uint(count), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *LogCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	escape := src[0]
+	srcIdx := 1
+	dstIdx := 0
+	text := make([]byte, 0, 2*_LOG_MAX_HEX_BYTES)
+
+	for srcIdx < len(src) {
+		c := src[srcIdx]
+		srcIdx++
+
+		if c != escape {
+			if dstIdx >= len(dst) {
+				return 0, 0, kanzi.NewOutputTooSmallError("Log codec: output buffer is too small")
+			}
+
+			dst[dstIdx] = c
+			dstIdx++
+			continue
+		}
+
+		if srcIdx >= len(src) {
+			return 0, 0, kanzi.NewCorruptStreamError("Log codec: truncated token in bitstream")
+		}
+
+		tokenType := src[srcIdx]
+		srcIdx++
+		size := 16
+
+		switch tokenType {
+		case _LOG_IPV4:
+			size = 4
+
+		case _LOG_HEX_LOWER, _LOG_HEX_UPPER:
+			if srcIdx >= len(src) {
+				return 0, 0, kanzi.NewCorruptStreamError("Log codec: truncated token in bitstream")
+			}
+
+			size = int(src[srcIdx])
+			srcIdx++
+
+		case _LOG_IPV6, _LOG_IPV6_FULL, _LOG_UUID_LOWER, _LOG_UUID_UPPER:
+
+		default:
+			return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid log token type in bitstream: %d", tokenType))
+		}
+
+		if srcIdx+size > len(src) {
+			return 0, 0, kanzi.NewCorruptStreamError("Log codec: truncated token in bitstream")
+		}
+
+		val := src[srcIdx : srcIdx+size]
+		srcIdx += size
+		text = text[:0]
+
+		switch tokenType {
+		case _LOG_IPV4:
+			for i := range val {
+				if i > 0 {
+					text = append(text, '.')
+				}
+
+				text = strconv.AppendUint(text, uint64(val[i]), 10)
+			}
+
+		case _LOG_IPV6:
+			text = append(text, net.IP(val).String()...)
+
+		case _LOG_IPV6_FULL:
+			text = appendLogIPv6Full(text, val)
+
+		case _LOG_UUID_LOWER, _LOG_UUID_UPPER:
+			upper := tokenType == _LOG_UUID_UPPER
+			text = appendLogHex(text, val[0:4], upper)
+			text = append(text, '-')
+			text = appendLogHex(text, val[4:6], upper)
+			text = append(text, '-')
+			text = appendLogHex(text, val[6:8], upper)
+			text = append(text, '-')
+			text = appendLogHex(text, val[8:10], upper)
+			text = append(text, '-')
+			text = appendLogHex(text, val[10:16], upper)
+
+		default:
+			text = appendLogHex(text, val, tokenType == _LOG_HEX_UPPER)
+		}
+
+		if dstIdx+len(text) > len(dst) {
+			return 0, 0, kanzi.NewOutputTooSmallError("Log codec: output buffer is too small")
+		}
+
+		dstIdx += copy(dst[dstIdx:], text)
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer.
+// The transform fails if the output is not smaller than the input.
+func (this LogCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen
+}
+
+// IsReusable returns true
+func (this *LogCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (no state)
+func (this *LogCodec) IsConcurrentSafe() bool {
+	return true
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Pre-transform chains selected by the meta codec
+const (
+	META_CHAIN_TEXT    = 1 // TEXT
+	META_CHAIN_STRUCT  = 2 // STRUCT+TEXT
+	META_CHAIN_UTF16   = 3 // UTF16 (packed units encoded with the text codec)
+	META_CHAIN_EXE     = 4 // EXE
+	META_CHAIN_IMAGE   = 5 // IMG
+	META_CHAIN_FP      = 6 // FP
+	META_CHAIN_RECORDS = 7 // SOA (fixed size records)
+	META_CHAIN_AUDIO   = 8 // SOA (samples of a WAV file, block align from the header)
+
+	_META_NB_CHAINS   = 9
+	_META_SAMPLE_SIZE = 65536
+	_META_SKIP_MASK   = 0x03
+)
+
+// Meta stream format: header (1 byte) + block of the selected chain
+//   header: chain (bits 7-2) + skipped stages of the chain (bits 1-0)
+
+// MetaCodec a codec that selects, for each block, the pre-transform chain
+// matching the content of the block. Cheap detectors run on the block
+// (headers of images, WAV audio and executables, UTF-16, JSON/CSV, text, x86
+// code statistics, floating point arrays and fixed size records) and the
+// chains of the detected content types are tried in order until one of
+// them applies and shrinks the block. Random (incompressible) blocks, blocks
+// with no detected content type and blocks that no chain shrinks (EG. the
+// chains keeping the size of the block) are rejected (the transform is
+// skipped) so that the transforms following the meta codec process the raw
+// block.
+// The chain and its skipped stages are recorded in the first byte of the
+// output.
+type MetaCodec struct {
+	chains [_META_NB_CHAINS]*ByteTransformSequence
+	audio  *SoACodec // record size set for each WAV block
+	buf    []byte    // input of the chains with several stages
+}
+
+// NewMetaCodec creates a new instance of MetaCodec
+func NewMetaCodec() (*MetaCodec, error) {
+	ctx := make(map[string]interface{})
+	return NewMetaCodecWithCtx(&ctx)
+}
+
+// NewMetaCodecWithCtx creates a new instance of MetaCodec using a
+// configuration map as parameter. The context is passed to the codecs of
+// the chains.
+func NewMetaCodecWithCtx(ctx *map[string]interface{}) (*MetaCodec, error) {
+	this := &MetaCodec{}
+	stages := [_META_NB_CHAINS][]uint64{
+		META_CHAIN_TEXT:    {DICT_TYPE},
+		META_CHAIN_STRUCT:  {STRUCT_TYPE, DICT_TYPE},
+		META_CHAIN_UTF16:   {UTF16_TYPE},
+		META_CHAIN_EXE:     {EXE_TYPE},
+		META_CHAIN_IMAGE:   {IMG_TYPE},
+		META_CHAIN_FP:      {FP_TYPE},
+		META_CHAIN_RECORDS: {SOA_TYPE},
+		META_CHAIN_AUDIO:   {SOA_TYPE},
+	}
+
+	this.audio = &SoACodec{}
+
+	// The text codec is shared (one chain runs at a time)
+	text, err := newByteFunctionToken(ctx, DICT_TYPE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for c := range stages {
+		if len(stages[c]) == 0 {
+			continue
+		}
+
+		transforms := make([]kanzi.ByteTransform, len(stages[c]))
+
+		for i, t := range stages[c] {
+			if t == DICT_TYPE {
+				transforms[i] = text
+			} else if c == META_CHAIN_AUDIO {
+				transforms[i] = this.audio
+			} else if transforms[i], err = newByteFunctionToken(ctx, t); err != nil {
+				return nil, err
+			}
+		}
+
+		if this.chains[c], err = NewByteTransformSequence(transforms); err != nil {
+			return nil, err
+		}
+	}
+
+	return this, nil
+}
+
+// Return the block align (bytes per sample frame) of an uncompressed (PCM)
+// WAV header or 0
+func detectWAV(block []byte) int {
+	if len(block) < 44 || string(block[0:4]) != "RIFF" || string(block[8:12]) != "WAVE" ||
+		string(block[12:16]) != "fmt " || binary.LittleEndian.Uint16(block[20:]) != 1 {
+		return 0
+	}
+
+	if align := int(binary.LittleEndian.Uint16(block[32:])); align >= 2 && align <= SOA_MAX_RECORD_SIZE {
+		return align
+	}
+
+	return 0
+}
+
+// DetectMetaChains returns the pre-transform chains (see META_CHAIN_XXX)
+// matching the content of the block, in the order they should be tried.
+// Returns an empty slice for random blocks and blocks with no detected
+// content type.
+func DetectMetaChains(block []byte) []int {
+	// Headers (pixels and samples may have a high order 0 entropy)
+	if _, ok := detectBMP(block); ok == true {
+		return []int{META_CHAIN_IMAGE}
+	}
+
+	if _, ok := detectPNM(block); ok == true {
+		return []int{META_CHAIN_IMAGE}
+	}
+
+	if detectWAV(block) != 0 {
+		return []int{META_CHAIN_AUDIO}
+	}
+
+	if arch, found := sniffExeHeader(block); found == true && arch != _EXE_ARCH_NONE {
+		return []int{META_CHAIN_EXE, META_CHAIN_RECORDS}
+	}
+
+	// Statistics
+	if kanzi.EntropyEstimate(block).IsIncompressible() == true {
+		return []int{}
+	}
+
+	if isUTF16, _ := DetectUTF16(block); isUTF16 == true {
+		return []int{META_CHAIN_UTF16}
+	}
+
+	sample := block
+
+	if len(sample) > _META_SAMPLE_SIZE {
+		sample = sample[0:_META_SAMPLE_SIZE]
+	}
+
+	var freqs [256]int32
+
+	// JSON/CSV may have too few spaces to pass the text statistics
+	if mode, _ := detectStructMode(block); mode != 0 {
+		return []int{META_CHAIN_STRUCT, META_CHAIN_TEXT}
+	}
+
+	if computeStats(sample, freqs[:], false)&_TC_MASK_NOT_TEXT == 0 {
+		return []int{META_CHAIN_TEXT}
+	}
+
+	if detectExeArch(block) != _EXE_ARCH_NONE {
+		return []int{META_CHAIN_EXE}
+	}
+
+	if DetectRecordSize(block) != 0 {
+		// Sparse bitmaps also have fixed size records (and residuals with
+		// many leading zero bits) but no floating point values
+		if hasFPValues(block) == true {
+			return []int{META_CHAIN_FP, META_CHAIN_RECORDS}
+		}
+
+		return []int{META_CHAIN_RECORDS}
+	}
+
+	return []int{}
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *MetaCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	for _, c := range DetectMetaChains(src) {
+		seq := this.chains[c]
+		in := src
+
+		if c == META_CHAIN_AUDIO {
+			this.audio.recordSize = detectWAV(src)
+		}
+
+		// A sequence writes the output of its second stage to its input
+		if seq.Len() > 1 {
+			if len(this.buf) < len(src) {
+				this.buf = make([]byte, len(src))
+			}
+
+			in = this.buf[0:len(src)]
+			copy(in, src)
+		}
+
+		_, oIdx, err := seq.Forward(in, dst[1:])
+
+		// All the stages were skipped or the block does not shrink: try the
+		// next chain
+		if err != nil || int(oIdx)+1 >= len(src) {
+			continue
+		}
+
+		dst[0] = byte(c<<2) | (seq.SkipFlags() >> 6)
+		return uint(len(src)), oIdx + 1, nil
+	}
+
+	return 0, 0, kanzi.NewNotApplicableError("Meta transform failed: no pre-transform applies to the block")
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *MetaCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	c := int(src[0] >> 2)
+
+	if c >= _META_NB_CHAINS || this.chains[c] == nil {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid meta chain in bitstream: %d", c))
+	}
+
+	if len(src) == 1 {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid meta block: missing data")
+	}
+
+	seq := this.chains[c]
+	seq.SetSkipFlags((src[0]&_META_SKIP_MASK)<<6 | 0x3F)
+	in := src[1:]
+
+	// The intermediate block (at most the size of the output) goes to the
+	// input of the sequence
+	if seq.Len() > 1 {
+		size := len(in)
+
+		if size < cap(dst) {
+			size = cap(dst)
+		}
+
+		if len(this.buf) < size {
+			this.buf = make([]byte, size)
+		}
+
+		in = this.buf[0:len(in)]
+		copy(in, src[1:])
+	}
+
+	iIdx, oIdx, err := seq.Inverse(in, dst)
+	return iIdx + 1, oIdx, err
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this MetaCodec) MaxEncodedLen(srcLen int) int {
+	res := srcLen
+
+	for _, seq := range this.chains {
+		if seq != nil {
+			if n := seq.MaxEncodedLen(srcLen); n > res {
+				res = n
+			}
+		}
+	}
+
+	return res + 1
+}
+
+// IsReusable returns false if one of the chains is not reusable (EG. the
+// text codec in retain mode)
+func (this *MetaCodec) IsReusable() bool {
+	for _, seq := range this.chains {
+		if seq != nil && seq.IsReusable() == false {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsConcurrentSafe returns false (the chains are sequences)
+func (this *MetaCodec) IsConcurrentSafe() bool {
+	return false
+}
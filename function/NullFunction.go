@@ -16,7 +16,7 @@ limitations under the License.
 package function
 
 import (
-	"errors"
+	kanzi "github.com/flanglet/kanzi-go"
 )
 
 // NullFunction is a pass through byte function
@@ -42,7 +42,7 @@ func doCopy(src, dst []byte) (uint, uint, error) {
 	}
 
 	if len(src) > len(dst) {
-		return uint(0), uint(0), errors.New("Destination buffer too small")
+		return uint(0), uint(0), kanzi.NewOutputTooSmallError("Destination buffer too small")
 	}
 
 	if &src[0] != &dst[0] {
@@ -70,3 +70,13 @@ func (this *NullFunction) Inverse(src, dst []byte) (uint, uint, error) {
 func (this NullFunction) MaxEncodedLen(srcLen int) int {
 	return srcLen
 }
+
+// IsReusable returns true
+func (this *NullFunction) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true
+func (this *NullFunction) IsConcurrentSafe() bool {
+	return true
+}
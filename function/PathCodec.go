@@ -0,0 +1,369 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"fmt"
+	"strings"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
+)
+
+const (
+	_PATH_FLAG_NO_TRAILING_LF = 0x01 // last name not terminated by LF
+	_PATH_FLAG_TEXT1          = 0x02 // suffixes encoded with text codec 1
+	_PATH_FLAG_TEXT2          = 0x04 // suffixes encoded with text codec 2
+	_PATH_MAX_HEADER_SIZE     = 1 + 5 + 5
+)
+
+// Path stream format: mode (1 byte) + number of names (varint) +
+// size of suffix data (varint) + prefix lengths (1 varint per name) +
+// suffix data (raw or text encoded)
+
+// PathCodec a codec for lists of file names or paths separated by LF
+// (EG. the file table of an archive). Each name is front coded: only the
+// length of the prefix shared with the previous name and the remaining
+// suffix are emitted. The suffixes are then processed by the text codec
+// (with path separators swapped with spaces so that path components are
+// seen as words). The list should be sorted to get the most out of the
+// front coding, but any order is accepted.
+type PathCodec struct {
+	ctx *map[string]interface{}
+}
+
+// NewPathCodec creates a new instance of PathCodec
+func NewPathCodec() (*PathCodec, error) {
+	this := &PathCodec{}
+	return this, nil
+}
+
+// NewPathCodecWithCtx creates a new instance of PathCodec using a
+// configuration map as parameter.
+func NewPathCodecWithCtx(ctx *map[string]interface{}) (*PathCodec, error) {
+	this := &PathCodec{}
+	this.ctx = ctx
+	return this, nil
+}
+
+// Select text encoding based on entropy codec (same as the DICT transform)
+func (this *PathCodec) textCodecType() int {
+	if this.ctx != nil {
+		if val, containsKey := (*this.ctx)["codec"]; containsKey {
+			entropyType := strings.ToUpper(val.(string))
+
+			if entropyType == "NONE" || entropyType == "ANS0" ||
+				entropyType == "HUFFMAN" || entropyType == "RANGE" {
+				return 2
+			}
+		}
+	}
+
+	return 1
+}
+
+func newPathTextCodec(textCodecType int, size int) (*TextCodec, error) {
+	ctx := map[string]interface{}{"blockSize": uint(size), "textcodec": textCodecType}
+	tc, err := NewTextCodecWithCtx(&ctx)
+
+	if err == nil {
+		// Paths have few spaces and many digits: skip text detection
+		tc.setRelaxed(true)
+	}
+
+	return tc, err
+}
+
+// Swap path separators and spaces (involution)
+func swapPathSeparators(block []byte) {
+	for i := range block {
+		if block[i] == '/' {
+			block[i] = ' '
+		} else if block[i] == ' ' {
+			block[i] = '/'
+		}
+	}
+}
+
+func emitPathVarInt(dst []byte, val int) int {
+	n := 0
+
+	for val >= 0x80 {
+		dst[n] = byte(val | 0x80)
+		val >>= 7
+		n++
+	}
+
+	dst[n] = byte(val)
+	return n + 1
+}
+
+func readPathVarInt(src []byte) (int, int, error) {
+	res := 0
+
+	for i := 0; i < len(src) && i < 5; i++ {
+		res |= int(src[i]&0x7F) << (7 * uint(i))
+
+		if src[i] < 0x80 {
+			return res, i + 1, nil
+		}
+	}
+
+	return 0, 0, kanzi.NewCorruptStreamError("Path codec: invalid varint in bitstream")
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *PathCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(dst) < this.MaxEncodedLen(len(src)) {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d",
+			len(dst), this.MaxEncodedLen(len(src))))
+	}
+
+	count := len(src)
+
+	if count <= _PATH_MAX_HEADER_SIZE {
+		return 0, 0, kanzi.NewNotApplicableError("Path transform failed: input too small")
+	}
+
+	mode := byte(0)
+
+	if src[count-1] != LF {
+		mode |= _PATH_FLAG_NO_TRAILING_LF
+	}
+
+	lens := make([]byte, 0, count/8+16)
+	sfx := make([]byte, 0, count+1)
+	var buf [5]byte
+	prvStart, prvEnd := 0, 0
+	nbNames := 0
+
+	for start := 0; start < count; {
+		end := start
+
+		for end < count && src[end] != LF {
+			end++
+		}
+
+		// Length of prefix shared with the previous name
+		p := 0
+
+		for p < prvEnd-prvStart && start+p < end && src[prvStart+p] == src[start+p] {
+			p++
+		}
+
+		n := emitPathVarInt(buf[:], p)
+		lens = append(lens, buf[0:n]...)
+		sfx = append(sfx, src[start+p:end]...)
+		sfx = append(sfx, LF)
+		prvStart, prvEnd = start, end
+		start = end + 1
+		nbNames++
+	}
+
+	// Try to shrink the suffixes with the text codec
+	payload := sfx
+	tcType := this.textCodecType()
+
+	if tc, err := newPathTextCodec(tcType, len(sfx)); err == nil {
+		swapped := alloc.Bytes(len(sfx))
+		defer alloc.PutBytes(swapped)
+		copy(swapped, sfx)
+		swapPathSeparators(swapped)
+		out := alloc.Bytes(tc.MaxEncodedLen(len(swapped)))
+		defer alloc.PutBytes(out)
+
+		if _, oIdx, err := tc.Forward(swapped, out); err == nil && int(oIdx) < len(sfx) {
+			payload = out[0:oIdx]
+
+			if tcType == 2 {
+				mode |= _PATH_FLAG_TEXT2
+			} else {
+				mode |= _PATH_FLAG_TEXT1
+			}
+		}
+	}
+
+	var hdr [_PATH_MAX_HEADER_SIZE]byte
+	hdr[0] = mode
+	n := 1
+	n += emitPathVarInt(hdr[n:], nbNames)
+	n += emitPathVarInt(hdr[n:], len(sfx))
+
+	if n+len(lens)+len(payload) >= count {
+		return 0, 0, kanzi.NewNotApplicableError("Path transform failed: output not smaller than input")
+	}
+
+	dstIdx := copy(dst, hdr[0:n])
+	dstIdx += copy(dst[dstIdx:], lens)
+	dstIdx += copy(dst[dstIdx:], payload)
+	return uint(count), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *PathCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	mode := src[0]
+	srcIdx := 1
+	nbNames, n, err := readPathVarInt(src[srcIdx:])
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	srcIdx += n
+	sfxLen, n, err := readPathVarInt(src[srcIdx:])
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	srcIdx += n
+
+	// Each name takes at least one byte (LF) in the suffix data
+	if nbNames > sfxLen || sfxLen > len(dst)+1 {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Path codec: invalid header (names: %d, suffix size: %d)", nbNames, sfxLen))
+	}
+
+	lens := alloc.Ints(nbNames)
+	defer alloc.PutInts(lens)
+
+	for i := range lens {
+		if lens[i], n, err = readPathVarInt(src[srcIdx:]); err != nil {
+			return 0, 0, err
+		}
+
+		srcIdx += n
+	}
+
+	var sfx []byte
+
+	switch mode &^ _PATH_FLAG_NO_TRAILING_LF {
+	case 0:
+		sfx = src[srcIdx:]
+		srcIdx = len(src)
+
+	case _PATH_FLAG_TEXT1, _PATH_FLAG_TEXT2:
+		tcType := 1
+
+		if mode&_PATH_FLAG_TEXT2 != 0 {
+			tcType = 2
+		}
+
+		tc, err := newPathTextCodec(tcType, sfxLen)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		sfx = alloc.Bytes(sfxLen)
+		defer alloc.PutBytes(sfx)
+		_, oIdx, err := tc.Inverse(src[srcIdx:], sfx)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		sfx = sfx[0:oIdx]
+		swapPathSeparators(sfx)
+		srcIdx = len(src)
+
+	default:
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid path codec mode in bitstream: %d", mode))
+	}
+
+	if len(sfx) != sfxLen {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Path codec: invalid suffix data size: %d, expected %d", len(sfx), sfxLen))
+	}
+
+	dstIdx := 0
+	sfxIdx := 0
+	prvStart, prvEnd := 0, 0
+
+	for i, p := range lens {
+		if p > prvEnd-prvStart || dstIdx+p > len(dst) {
+			return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Path codec: invalid prefix length in bitstream: %d", p))
+		}
+
+		start := dstIdx
+		dstIdx += copy(dst[dstIdx:], dst[prvStart:prvStart+p])
+
+		for sfxIdx < len(sfx) && sfx[sfxIdx] != LF {
+			if dstIdx >= len(dst) {
+				return 0, 0, kanzi.NewOutputTooSmallError("Path codec: output buffer is too small")
+			}
+
+			dst[dstIdx] = sfx[sfxIdx]
+			dstIdx++
+			sfxIdx++
+		}
+
+		if sfxIdx >= len(sfx) {
+			return 0, 0, kanzi.NewCorruptStreamError("Path codec: missing name terminator in bitstream")
+		}
+
+		prvStart, prvEnd = start, dstIdx
+		sfxIdx++
+
+		// The last name may not be terminated
+		if i == nbNames-1 && mode&_PATH_FLAG_NO_TRAILING_LF != 0 {
+			break
+		}
+
+		if dstIdx >= len(dst) {
+			return 0, 0, kanzi.NewOutputTooSmallError("Path codec: output buffer is too small")
+		}
+
+		dst[dstIdx] = LF
+		dstIdx++
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer.
+// The transform fails if the output is not smaller than the input.
+func (this PathCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen
+}
+
+// IsReusable returns true
+func (this *PathCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (a text codec is created per call)
+func (this *PathCodec) IsConcurrentSafe() bool {
+	return true
+}
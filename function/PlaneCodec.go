@@ -0,0 +1,298 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	_PLANE_MIN_BLOCK  = 64
+	_PLANE_MAX_HEADER = 5 + 5 + 1
+	_PLANE_MAX_STRIDE = 1 << 16
+)
+
+// Plane stream format: block size, stride (varints) + inverted planes
+// (1 byte, bit k for plane k) + 8 bit planes (plane 0 first).
+// Each plane (one bit per byte of the block, 8 bytes per plane byte) is a
+// list of tokens: number of zero bytes, number of literal bytes (varints)
+// then the literal bytes.
+
+// PlaneCodec a transform for sparse bitmaps and index data. Each byte is
+// first XORed with the byte one stride before (the byte above in a bitmap
+// or the same field of the previous record) so that the vertical
+// correlation produces zero bits. The block is then split in 8 bit planes
+// and the planes are run length coded (runs of zero bytes). Planes with
+// more ones than zeros are inverted.
+// The stride is provided in the context ('planeStride', 0 means no XOR)
+// or else selected per block (no XOR or the detected record size).
+type PlaneCodec struct {
+	stride int // -1 => auto
+}
+
+// NewPlaneCodec creates a new instance of PlaneCodec
+func NewPlaneCodec() (*PlaneCodec, error) {
+	return &PlaneCodec{stride: -1}, nil
+}
+
+// NewPlaneCodecWithCtx creates a new instance of PlaneCodec using a
+// configuration map as parameter.
+func NewPlaneCodecWithCtx(ctx *map[string]interface{}) (*PlaneCodec, error) {
+	this := &PlaneCodec{stride: -1}
+
+	if val, containsKey := (*ctx)["planeStride"]; containsKey {
+		this.stride = val.(int)
+
+		if this.stride < 0 || this.stride > _PLANE_MAX_STRIDE {
+			return nil, fmt.Errorf("Invalid plane stride: %v (must be in [0..%d])", this.stride, _PLANE_MAX_STRIDE)
+		}
+	}
+
+	return this, nil
+}
+
+// Return the byte of the block XORed with the byte one stride before
+func planeResidual(block []byte, i, stride int) byte {
+	if stride == 0 || i < stride {
+		return block[i]
+	}
+
+	return block[i] ^ block[i-stride]
+}
+
+// Return the number of bits to code (minority bits of each plane) given
+// the stride
+func planeCost(block []byte, stride int) int {
+	var ones [8]int
+
+	for i := range block {
+		b := planeResidual(block, i, stride)
+
+		for k := range ones {
+			ones[k] += int(b>>uint(k)) & 1
+		}
+	}
+
+	cost := 0
+
+	for _, n := range ones {
+		if n > len(block)-n {
+			n = len(block) - n
+		}
+
+		cost += n
+	}
+
+	return cost
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *PlaneCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	if len(src) < _PLANE_MIN_BLOCK {
+		return 0, 0, kanzi.NewNotApplicableError("Input block is too small")
+	}
+
+	stride := this.stride
+
+	if stride < 0 {
+		stride = 0
+
+		if s := DetectRecordSize(src); s != 0 && planeCost(src, s) < planeCost(src, 0) {
+			stride = s
+		}
+	}
+
+	count := len(src)
+	planeLen := (count + 7) >> 3
+	planes := make([]byte, 8*planeLen)
+	var ones [8]int
+
+	// Bit k of byte i goes to bit 7-(i&7) of byte i/8 of plane k
+	for i := 0; i < count; i++ {
+		b := planeResidual(src, i, stride)
+		idx := i >> 3
+		shift := uint(7 - i&7)
+
+		for k := 0; k < 8; k++ {
+			bit := (b >> uint(k)) & 1
+			planes[k*planeLen+idx] |= bit << shift
+			ones[k] += int(bit)
+		}
+	}
+
+	inverted := byte(0)
+
+	for k := range ones {
+		if 2*ones[k] > count {
+			inverted |= 1 << uint(k)
+			plane := planes[k*planeLen : (k+1)*planeLen]
+
+			for i := range plane {
+				plane[i] = ^plane[i]
+			}
+		}
+	}
+
+	dstIdx := emitPathVarInt(dst, count)
+	dstIdx += emitPathVarInt(dst[dstIdx:], stride)
+	dst[dstIdx] = inverted
+	dstIdx++
+
+	// The output must be smaller than the input
+	limit := count
+
+	for k := 0; k < 8; k++ {
+		plane := planes[k*planeLen : (k+1)*planeLen]
+
+		for i := 0; i < len(plane); {
+			zeros := i
+
+			for i < len(plane) && plane[i] == 0 {
+				i++
+			}
+
+			zeros = i - zeros
+			start := i
+
+			// Literals up to the next run of 2 zero bytes (or the end)
+			for i < len(plane) && (plane[i] != 0 || (i+1 < len(plane) && plane[i+1] != 0)) {
+				i++
+			}
+
+			if dstIdx+10+i-start > limit {
+				return 0, 0, kanzi.NewNotApplicableError("No gain from plane transform")
+			}
+
+			dstIdx += emitPathVarInt(dst[dstIdx:], zeros)
+			dstIdx += emitPathVarInt(dst[dstIdx:], i-start)
+			dstIdx += copy(dst[dstIdx:], plane[start:i])
+		}
+	}
+
+	return uint(count), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *PlaneCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	count, n, err := readPathVarInt(src)
+
+	if err != nil {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid plane header in bitstream")
+	}
+
+	srcIdx := n
+	stride, n, err := readPathVarInt(src[srcIdx:])
+
+	if err != nil || count <= 0 || stride > _PLANE_MAX_STRIDE || srcIdx+n >= len(src) {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid plane header in bitstream")
+	}
+
+	srcIdx += n
+
+	if len(dst) < count {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), count))
+	}
+
+	inverted := src[srcIdx]
+	srcIdx++
+	planeLen := (count + 7) >> 3
+	planes := make([]byte, 8*planeLen)
+
+	for k := 0; k < 8; k++ {
+		plane := planes[k*planeLen : (k+1)*planeLen]
+
+		for i := 0; i < len(plane); {
+			zeros, n1, err1 := readPathVarInt(src[srcIdx:])
+			srcIdx += n1
+			literals, n2, err2 := readPathVarInt(src[srcIdx:])
+			srcIdx += n2
+
+			if err1 != nil || err2 != nil || i+zeros+literals > len(plane) || srcIdx+literals > len(src) ||
+				zeros+literals == 0 {
+				return uint(srcIdx), 0, kanzi.NewCorruptStreamError("Invalid plane data in bitstream")
+			}
+
+			i += zeros
+			i += copy(plane[i:i+literals], src[srcIdx:srcIdx+literals])
+			srcIdx += literals
+		}
+
+		if inverted&(1<<uint(k)) != 0 {
+			for i := range plane {
+				plane[i] = ^plane[i]
+			}
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		idx := i >> 3
+		shift := uint(7 - i&7)
+		b := byte(0)
+
+		for k := 0; k < 8; k++ {
+			b |= ((planes[k*planeLen+idx] >> shift) & 1) << uint(k)
+		}
+
+		if stride != 0 && i >= stride {
+			b ^= dst[i-stride]
+		}
+
+		dst[i] = b
+	}
+
+	return uint(srcIdx), uint(count), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this PlaneCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen + _PLANE_MAX_HEADER
+}
+
+// IsReusable returns true
+func (this *PlaneCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the stride is set at creation)
+func (this *PlaneCodec) IsConcurrentSafe() bool {
+	return true
+}
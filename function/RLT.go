@@ -21,9 +21,17 @@ package function
 // 4    <= runLen < 224+4      -> 1 byte
 // 228  <= runLen < 6944+228   -> 2 bytes
 // 7172 <= runLen < 65535+7172 -> 3 bytes
+//
+// With wide symbols (2 or 4 bytes), a run is a repeat of the previous
+// 2 (or 4) bytes, at any offset (EG. 00 FF 00 FF ... or a 32 bit value
+// repeated in a zero-initialized structure). The run lengths are encoded the
+// same way (number of repeats of the symbol). The block starts with a marker
+// (escape, escape, width) that cannot appear at the start of a block of
+// byte runs (the data cannot start with a run), so the decoder needs no
+// option. The decoders of stream version 8 cannot decode these blocks (see
+// HasRLTExtensions).
 
 import (
-	"errors"
 	"fmt"
 
 	kanzi "github.com/flanglet/kanzi-go"
@@ -35,22 +43,66 @@ const (
 	_RLT_RUN_THRESHOLD   = 3
 	_RLT_MAX_RUN         = 0xFFFF + _RLT_RUN_LEN_ENCODE2 + _RLT_RUN_THRESHOLD - 1
 	_RLT_MAX_RUN4        = _RLT_MAX_RUN - 4
+
+	// RLT_WIDTH_AUTO symbol width selected for each block
+	RLT_WIDTH_AUTO = 0
+	// RLT_WIDTH_BYTE runs of bytes (default)
+	RLT_WIDTH_BYTE = 1
+	// RLT_WIDTH_SHORT runs of 16 bit symbols
+	RLT_WIDTH_SHORT = 2
+	// RLT_WIDTH_INT runs of 32 bit symbols
+	RLT_WIDTH_INT = 4
 )
 
 // RLT a Run Length Transform with escape symbol
 type RLT struct {
+	width     int
+	reference bool // use the portable reference inverse
 }
 
 // NewRLT creates a new instance of RLT
 func NewRLT() (*RLT, error) {
-	this := &RLT{}
+	this := &RLT{width: RLT_WIDTH_BYTE}
+	return this, nil
+}
+
+// NewRLTWithWidth creates a new instance of RLT processing runs of symbols
+// of the provided width (see RLT_WIDTH_XXX)
+func NewRLTWithWidth(width int) (*RLT, error) {
+	if width != RLT_WIDTH_AUTO && width != RLT_WIDTH_BYTE && width != RLT_WIDTH_SHORT && width != RLT_WIDTH_INT {
+		return nil, fmt.Errorf("Invalid symbol width parameter: %v (must be 0, 1, 2 or 4)", width)
+	}
+
+	this := &RLT{width: width}
 	return this, nil
 }
 
 // NewRLTWithCtx creates a new instance of RLT using a
 // configuration map as parameter.
 func NewRLTWithCtx(ctx *map[string]interface{}) (*RLT, error) {
-	this := &RLT{}
+	width := RLT_WIDTH_BYTE
+
+	if val, containsKey := (*ctx)["rltWidth"]; containsKey {
+		switch v := val.(type) {
+		case int:
+			width = v
+		case uint:
+			width = int(v)
+		default:
+			return nil, fmt.Errorf("Invalid symbol width parameter type: %T (must be an int or a uint)", val)
+		}
+	}
+
+	this, err := NewRLTWithWidth(width)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if val, containsKey := (*ctx)["reference"]; containsKey {
+		this.reference = val.(bool)
+	}
+
 	return this, nil
 }
 
@@ -62,12 +114,12 @@ func (this *RLT) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
 	srcIdx := 0
@@ -94,6 +146,16 @@ func (this *RLT) Forward(src, dst []byte) (uint, uint, error) {
 	}
 
 	escape := byte(minIdx)
+	width := this.width
+
+	if width == RLT_WIDTH_AUTO {
+		width = selectRLTWidth(src)
+	}
+
+	if width != RLT_WIDTH_BYTE {
+		return forwardWide(src, dst, escape, width)
+	}
+
 	run := 0
 	var err error
 	prev := src[srcIdx]
@@ -145,7 +207,7 @@ func (this *RLT) Forward(src, dst []byte) (uint, uint, error) {
 			dstIdx += dIdx
 		} else if prev != escape {
 			if dstIdx+run >= dstEnd {
-				err = errors.New("Output buffer is too small")
+				err = kanzi.NewOutputTooSmallError("Output buffer is too small")
 				break
 			}
 
@@ -162,7 +224,7 @@ func (this *RLT) Forward(src, dst []byte) (uint, uint, error) {
 			}
 		} else { // escape literal
 			if dstIdx+2*run >= dstEnd {
-				err = errors.New("Output buffer is too small")
+				err = kanzi.NewOutputTooSmallError("Output buffer is too small")
 				break
 			}
 
@@ -216,15 +278,113 @@ func (this *RLT) Forward(src, dst []byte) (uint, uint, error) {
 		}
 
 		if srcIdx != srcEnd {
-			err = errors.New("Output buffer is too small")
+			err = kanzi.NewOutputTooSmallError("Output buffer is too small")
 		} else if dstIdx > srcIdx {
-			err = errors.New("Input not compressed")
+			err = kanzi.NewNotApplicableError("Input not compressed")
 		}
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
 }
 
+// Return the number of repeats of the symbol before idx (up to the max run)
+func rltRepeats(src []byte, idx, width int) int {
+	end := idx + _RLT_MAX_RUN4*width
+
+	if end > len(src) {
+		end = len(src)
+	}
+
+	n := idx
+
+	for n < end && src[n] == src[n-width] {
+		n++
+	}
+
+	return (n - idx) / width
+}
+
+// Return the symbol width saving the most bytes (the narrowest in case of
+// tie)
+func selectRLTWidth(src []byte) int {
+	best := RLT_WIDTH_BYTE
+	bestGain := 0
+
+	for _, width := range []int{RLT_WIDTH_BYTE, RLT_WIDTH_SHORT, RLT_WIDTH_INT} {
+		gain := 0
+
+		for i := width; i < len(src); {
+			if run := rltRepeats(src, i, width); run >= _RLT_RUN_THRESHOLD {
+				// Escape + run length (2 bytes on average)
+				gain += run*width - 3
+				i += run * width
+			} else {
+				i++
+			}
+		}
+
+		if gain > bestGain {
+			best = width
+			bestGain = gain
+		}
+	}
+
+	return best
+}
+
+// Encode the repeats of the previous 2 or 4 bytes
+func forwardWide(src, dst []byte, escape byte, width int) (uint, uint, error) {
+	dst[0] = escape
+	dst[1] = escape
+	dst[2] = byte(width)
+	srcIdx := 0
+	dstIdx := 3
+	srcEnd := len(src)
+	dstEnd := len(dst)
+
+	for srcIdx < srcEnd {
+		if srcIdx >= width {
+			if run := rltRepeats(src, srcIdx, width); run >= _RLT_RUN_THRESHOLD {
+				if dstIdx+4 > dstEnd {
+					return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Output buffer is too small")
+				}
+
+				dst[dstIdx] = escape
+				dstIdx++
+				dIdx, err := emitRunLengthValue(dst[dstIdx:dstEnd], run+1-_RLT_RUN_THRESHOLD)
+
+				if err != nil {
+					return uint(srcIdx), uint(dstIdx), err
+				}
+
+				dstIdx += dIdx
+				srcIdx += run * width
+				continue
+			}
+		}
+
+		if dstIdx+2 > dstEnd {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Output buffer is too small")
+		}
+
+		dst[dstIdx] = src[srcIdx]
+		dstIdx++
+
+		if src[srcIdx] == escape {
+			dst[dstIdx] = 0
+			dstIdx++
+		}
+
+		srcIdx++
+	}
+
+	if dstIdx > srcIdx {
+		return uint(srcIdx), uint(dstIdx), kanzi.NewNotApplicableError("Input not compressed")
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
 func emitRunLength(dst []byte, run int, escape, val byte) (int, error) {
 	dst[0] = val
 	dstIdx := 1
@@ -236,13 +396,18 @@ func emitRunLength(dst []byte, run int, escape, val byte) (int, error) {
 
 	dst[dstIdx] = escape
 	dstIdx++
-	run -= _RLT_RUN_THRESHOLD
+	n, err := emitRunLengthValue(dst[dstIdx:], run-_RLT_RUN_THRESHOLD)
+	return dstIdx + n, err
+}
+
+// Encode a run length (at least 1, 0 is an escape literal)
+func emitRunLengthValue(dst []byte, run int) (int, error) {
+	dstIdx := 0
 
-	// Encode run length
 	if run >= _RLT_RUN_LEN_ENCODE1 {
 		if run < _RLT_RUN_LEN_ENCODE2 {
 			if dstIdx >= len(dst)-2 {
-				return dstIdx, errors.New("Output buffer too small")
+				return dstIdx, kanzi.NewOutputTooSmallError("Output buffer too small")
 			}
 
 			run -= _RLT_RUN_LEN_ENCODE1
@@ -250,7 +415,7 @@ func emitRunLength(dst []byte, run int, escape, val byte) (int, error) {
 			dstIdx++
 		} else {
 			if dstIdx >= len(dst)-3 {
-				return dstIdx, errors.New("Output buffer too small")
+				return dstIdx, kanzi.NewOutputTooSmallError("Output buffer too small")
 			}
 
 			run -= _RLT_RUN_LEN_ENCODE2
@@ -272,8 +437,12 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if this.reference == true {
+		return this.inverseReference(src, dst)
 	}
 
 	srcIdx := 0
@@ -282,19 +451,26 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 	dstEnd := len(dst)
 	escape := src[srcIdx]
 	srcIdx++
+	width := RLT_WIDTH_BYTE
 	var err error
 
 	if src[srcIdx] == escape {
 		srcIdx++
 
-		// The data cannot start with a run but may start with an escape literal
-		if srcIdx < srcEnd && src[srcIdx] != 0 {
-			return uint(srcIdx), uint(dstIdx), errors.New("Invalid input data: input starts with a run")
-		}
+		if srcIdx < srcEnd && (src[srcIdx] == RLT_WIDTH_SHORT || src[srcIdx] == RLT_WIDTH_INT) {
+			// Runs of wide symbols
+			width = int(src[srcIdx])
+			srcIdx++
+		} else {
+			// The data cannot start with a run but may start with an escape literal
+			if srcIdx < srcEnd && src[srcIdx] != 0 {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid input data: input starts with a run")
+			}
 
-		srcIdx++
-		dst[dstIdx] = escape
-		dstIdx++
+			srcIdx++
+			dst[dstIdx] = escape
+			dstIdx++
+		}
 	}
 
 	// Main loop
@@ -302,7 +478,7 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 		if src[srcIdx] != escape {
 			// Literal
 			if dstIdx >= dstEnd {
-				err = errors.New("Invalid input data")
+				err = kanzi.NewCorruptStreamError("Invalid input data")
 				break
 			}
 
@@ -315,18 +491,17 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 		srcIdx++
 
 		if srcIdx >= srcEnd {
-			err = errors.New("Invalid input data")
+			err = kanzi.NewCorruptStreamError("Invalid input data")
 			break
 		}
 
-		val := dst[dstIdx-1]
 		run := int(src[srcIdx])
 		srcIdx++
 
 		if run == 0 {
 			// Just an escape symbol, not a run
 			if dstIdx >= dstEnd {
-				err = errors.New("Invalid input data")
+				err = kanzi.NewCorruptStreamError("Invalid input data")
 				break
 			}
 
@@ -338,7 +513,7 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 		// Decode the length
 		if run == 0xFF {
 			if srcIdx+1 >= srcEnd {
-				err = errors.New("Invalid input data")
+				err = kanzi.NewCorruptStreamError("Invalid input data")
 				break
 			}
 
@@ -347,7 +522,7 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 			run += _RLT_RUN_LEN_ENCODE2
 		} else if run >= _RLT_RUN_LEN_ENCODE1 {
 			if srcIdx >= srcEnd {
-				err = errors.New("Invalid input data")
+				err = kanzi.NewCorruptStreamError("Invalid input data")
 				break
 			}
 
@@ -358,9 +533,25 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 
 		run += (_RLT_RUN_THRESHOLD - 1)
 
+		if width != RLT_WIDTH_BYTE {
+			// Repeat the previous symbol (the run may end the block)
+			if dstIdx < width || dstIdx+run*width > dstEnd || run > _RLT_MAX_RUN {
+				err = kanzi.NewCorruptStreamError("Invalid run length")
+				break
+			}
+
+			for end := dstIdx + run*width; dstIdx < end; dstIdx++ {
+				dst[dstIdx] = dst[dstIdx-width]
+			}
+
+			continue
+		}
+
+		val := dst[dstIdx-1]
+
 		// Sanity check
 		if dstIdx+run >= dstEnd || run > _RLT_MAX_RUN {
-			err = errors.New("Invalid run length")
+			err = kanzi.NewCorruptStreamError("Invalid run length")
 			break
 		}
 
@@ -382,12 +573,98 @@ func (this *RLT) Inverse(src, dst []byte) (uint, uint, error) {
 	}
 
 	if srcIdx != srcEnd && err == nil {
-		err = errors.New("Invalid input data")
+		err = kanzi.NewCorruptStreamError("Invalid input data")
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
 }
 
+// Reference implementation used to validate the inverse: the header, the
+// literals and the runs are parsed one token at a time and each run copies
+// the previous symbol with a bounds checked copy.
+func (this *RLT) inverseReference(src, dst []byte) (uint, uint, error) {
+	escape := src[0]
+	srcIdx, dstIdx := 1, 0
+	width := RLT_WIDTH_BYTE
+
+	if srcIdx < len(src) && src[srcIdx] == escape {
+		if srcIdx+1 >= len(src) {
+			return uint(srcIdx), 0, kanzi.NewCorruptStreamError("Invalid input data")
+		}
+
+		switch src[srcIdx+1] {
+		case RLT_WIDTH_SHORT, RLT_WIDTH_INT:
+			width = int(src[srcIdx+1])
+			srcIdx += 2
+
+		case 0:
+			// Escape literal, decoded by the main loop
+		default:
+			return uint(srcIdx), 0, kanzi.NewCorruptStreamError("Invalid input data: input starts with a run")
+		}
+	}
+
+	for srcIdx < len(src) {
+		if src[srcIdx] != escape {
+			if dstIdx >= len(dst) {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid input data")
+			}
+
+			dst[dstIdx] = src[srcIdx]
+			srcIdx++
+			dstIdx++
+			continue
+		}
+
+		if srcIdx+1 >= len(src) {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid input data")
+		}
+
+		run := int(src[srcIdx+1])
+		srcIdx += 2
+
+		if run == 0 {
+			if dstIdx >= len(dst) {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid input data")
+			}
+
+			dst[dstIdx] = escape
+			dstIdx++
+			continue
+		}
+
+		switch {
+		case run == 0xFF:
+			if srcIdx+2 > len(src) {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid input data")
+			}
+
+			run = _RLT_RUN_LEN_ENCODE2 + int(src[srcIdx])<<8 + int(src[srcIdx+1])
+			srcIdx += 2
+
+		case run >= _RLT_RUN_LEN_ENCODE1:
+			if srcIdx+1 > len(src) {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid input data")
+			}
+
+			run = _RLT_RUN_LEN_ENCODE1 + (run-_RLT_RUN_LEN_ENCODE1)<<8 + int(src[srcIdx])
+			srcIdx++
+		}
+
+		run += _RLT_RUN_THRESHOLD - 1
+
+		if run > _RLT_MAX_RUN || dstIdx < width || dstIdx+run*width > len(dst) {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid run length")
+		}
+
+		for n := 0; n < run; n++ {
+			dstIdx += copy(dst[dstIdx:dstIdx+width], dst[dstIdx-width:dstIdx])
+		}
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
 // MaxEncodedLen returns the max size required for the encoding output buffer
 func (this RLT) MaxEncodedLen(srcLen int) int {
 	if srcLen <= 512 {
@@ -396,3 +673,40 @@ func (this RLT) MaxEncodedLen(srcLen int) int {
 
 	return srcLen
 }
+
+// IsReusable returns true
+func (this *RLT) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the width is set at creation)
+func (this *RLT) IsConcurrentSafe() bool {
+	return true
+}
+
+// HasRLTExtensions returns true if the RLT of the provided function type may
+// emit blocks of wide symbols ("rltWidth" entry of the map other than
+// RLT_WIDTH_BYTE). The decoders of stream version 8 cannot decode these
+// blocks.
+func HasRLTExtensions(ctx map[string]interface{}, functionType uint64) bool {
+	width := RLT_WIDTH_BYTE
+
+	switch v := ctx["rltWidth"].(type) {
+	case int:
+		width = v
+	case uint:
+		width = int(v)
+	}
+
+	if width == RLT_WIDTH_BYTE {
+		return false
+	}
+
+	for _, t := range GetTypes(functionType) {
+		if t == RLT_TYPE {
+			return true
+		}
+	}
+
+	return false
+}
@@ -17,13 +17,13 @@ package function
 
 import (
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"strings"
 
 	kanzi "github.com/flanglet/kanzi-go"
 	"github.com/flanglet/kanzi-go/bitstream"
 	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/internal/alloc"
 	"github.com/flanglet/kanzi-go/util"
 )
 
@@ -43,6 +43,10 @@ const (
 	_ROLZ_LITERAL_FLAG    = 1
 	_ROLZ_HASH            = uint32(200002979)
 	_ROLZ_MAX_BLOCK_SIZE  = 1 << 30 // 1 GB
+	_ROLZ_MIN_BLOCK_SIZE  = 64      // smaller blocks are not transformed (no gain)
+	_ROLZ_SPLIT_CODERS    = 0x80    // one entropy coder per stream (ids in the next 3 bytes)
+	_ROLZ_LOG_POS         = 0x40    // log of position checks in the next byte (after the coder ids)
+	_ROLZX_LOG_POS        = 1 << 31 // set in the ROLZX block size: log of position checks in the next byte
 	_ROLZ_TOP             = uint64(0x00FFFFFFFFFFFFFF)
 	_MASK_0_24            = uint64(0x0000000000FFFFFF)
 	_MASK_0_56            = uint64(0x00FFFFFFFFFFFFFF)
@@ -88,7 +92,8 @@ func emitCopy(buf []byte, dstIdx, ref, matchLen int) int {
 	return dstIdx
 }
 
-// ROLZCodec Reduced Offset Lempel Ziv codec
+// ROLZCodec Reduced Offset Lempel Ziv codec. The blocks smaller than 64 bytes
+// are not transformed (ErrNotApplicable).
 type ROLZCodec struct {
 	delegate kanzi.ByteFunction
 }
@@ -123,30 +128,147 @@ func NewROLZCodecWithFlag(extra bool) (*ROLZCodec, error) {
 
 // NewROLZCodecWithCtx creates a new instance of ROLZCodec providing a
 // context map. If the map contains a transform name set to "ROLZX"
-// encode literals and matches using ANS. Otherwise encode literals
-// and matches using CM and check more match positions.
+// encode literals and matches using CM and check more match positions.
+// Otherwise encode literals and matches using ANS. In the latter case,
+// the entropy coders of the literals, match lengths and match indexes can
+// be selected independently with a "lzCoders" entry (EG. "ANS1,HUFFMAN,ANS0").
+// The log of the number of positions checked per context (in [2..8]) can be
+// provided with a "rolzLogPosChecks" entry (more positions => better ratio,
+// slower encoding). It is recorded in the bitstream if not the default.
 func NewROLZCodecWithCtx(ctx *map[string]interface{}) (*ROLZCodec, error) {
 	this := &ROLZCodec{}
 	var err error
 	var d kanzi.ByteFunction
+	logPosChecks1 := uint(_ROLZ_LOG_POS_CHECKS1)
+	logPosChecks2 := uint(_ROLZ_LOG_POS_CHECKS2)
+
+	if val, containsKey := (*ctx)["rolzLogPosChecks"]; containsKey {
+		switch v := val.(type) {
+		case uint:
+			logPosChecks1 = v
+		case int:
+			if v < 0 {
+				return this, fmt.Errorf("ROLZ codec: Invalid logPosChecks parameter: %v (must be in [2..8])", v)
+			}
+
+			logPosChecks1 = uint(v)
+		default:
+			return this, fmt.Errorf("ROLZ codec: Invalid logPosChecks parameter type: %T (must be a uint or an int)", val)
+		}
+
+		logPosChecks2 = logPosChecks1
+	}
 
 	if val, containsKey := (*ctx)["transform"]; containsKey {
 		transform := val.(string)
 
 		if strings.Contains(transform, "ROLZX") {
-			d, err = newROLZCodec2(_ROLZ_LOG_POS_CHECKS2)
+			if d, err = newROLZCodec2(logPosChecks2); err != nil {
+				return this, err
+			}
+
 			this.delegate = d
 		}
 	}
 
 	if this.delegate == nil && err == nil {
-		d, err = newROLZCodec1(_ROLZ_LOG_POS_CHECKS1)
-		this.delegate = d
+		var d1 *rolzCodec1
+
+		if d1, err = newROLZCodec1(logPosChecks1); err != nil {
+			return this, err
+		}
+
+		if val, containsKey := (*ctx)["lzCoders"]; containsKey {
+			if d1.coders, err = parseROLZCoders(val.(string)); err != nil {
+				return this, err
+			}
+
+			d1.split = true
+		}
+
+		this.delegate = d1
 	}
 
 	return this, err
 }
 
+// Parse the names of the entropy coders of the literals, match lengths
+// and match indexes (comma separated)
+func parseROLZCoders(names string) ([3]uint32, error) {
+	var res [3]uint32
+	tokens := strings.Split(names, ",")
+
+	if len(tokens) != len(res) {
+		return res, fmt.Errorf("ROLZ codec: Invalid coders '%v': expected 3 entropy codec names (literals, lengths, indexes)", names)
+	}
+
+	for i := range tokens {
+		var err error
+
+		if res[i], err = getROLZCoderType(strings.TrimSpace(tokens[i])); err != nil {
+			return res, err
+		}
+	}
+
+	return res, nil
+}
+
+// Entropy coders supported for the literal, match length and match index streams
+var _ROLZ_CODERS = []uint32{entropy.NONE_TYPE, entropy.HUFFMAN_TYPE, entropy.FPAQ_TYPE, entropy.RANGE_TYPE,
+	entropy.ANS0_TYPE, entropy.CM_TYPE, entropy.TPAQ_TYPE, entropy.ANS1_TYPE, entropy.TPAQX_TYPE, entropy.CMX_TYPE,
+	entropy.RANS0_TYPE, entropy.RANS1_TYPE, entropy.AHUFFMAN_TYPE, entropy.RLE_TYPE}
+
+// Return the type of the entropy coder with the provided name
+func getROLZCoderType(name string) (uint32, error) {
+	for _, t := range _ROLZ_CODERS {
+		if strings.EqualFold(entropy.GetName(t), name) == true {
+			return t, nil
+		}
+	}
+
+	return 0, fmt.Errorf("ROLZ codec: Unsupported entropy codec: '%v'", name)
+}
+
+// HasROLZExtensions returns true if the ROLZ codecs of the provided function
+// type may emit blocks with the options selected by the map ("lzCoders"
+// entry and "rolzLogPosChecks" entry if not the default of the codec). The
+// decoders of stream version 8 cannot decode these blocks.
+func HasROLZExtensions(ctx map[string]interface{}, functionType uint64) bool {
+	_, coders := ctx["lzCoders"]
+	logPosChecks := -1
+
+	if val, containsKey := ctx["rolzLogPosChecks"]; containsKey {
+		switch v := val.(type) {
+		case uint:
+			logPosChecks = int(v)
+		case int:
+			logPosChecks = v
+		}
+	}
+
+	for _, t := range GetTypes(functionType) {
+		if t == ROLZ_TYPE && (coders == true || (logPosChecks >= 0 && logPosChecks != _ROLZ_LOG_POS_CHECKS1)) {
+			return true
+		}
+
+		if t == ROLZX_TYPE && logPosChecks >= 0 && logPosChecks != _ROLZ_LOG_POS_CHECKS2 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isROLZCoder(t uint32) bool {
+	for _, c := range _ROLZ_CODERS {
+		if c == t {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Forward applies the function to the src and writes the result
 // to the destination. Returns number of bytes read, number of bytes
 // written and possibly an error.
@@ -155,14 +277,18 @@ func (this *ROLZCodec) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("ROLZ codec: Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	if len(src) > _ROLZ_MAX_BLOCK_SIZE {
-		// Not a recoverable error: instead of a (silent) failure,
-		// issue a fatal error.
-		panic(fmt.Errorf("The max ROLZ codec block size is %v, got %v", _ROLZ_MAX_BLOCK_SIZE, len(src)))
+		errMsg := fmt.Sprintf("The max ROLZ codec block size is %v, got %v", _ROLZ_MAX_BLOCK_SIZE, len(src))
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
+	}
+
+	if len(src) < _ROLZ_MIN_BLOCK_SIZE {
+		errMsg := fmt.Sprintf("ROLZ codec: The block is too small (%v bytes, min %v)", len(src), _ROLZ_MIN_BLOCK_SIZE)
+		return 0, 0, kanzi.NewNotApplicableError(errMsg)
 	}
 
 	return this.delegate.Forward(src, dst)
@@ -176,14 +302,13 @@ func (this *ROLZCodec) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("ROLZ codec: Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	if len(src) > _ROLZ_MAX_BLOCK_SIZE {
-		// Not a recoverable error: instead of a (silent) failure,
-		// issue a fatal error.
-		panic(fmt.Errorf("The max ROLZ codec block size is %v, got %v", _ROLZ_MAX_BLOCK_SIZE, len(src)))
+		errMsg := fmt.Sprintf("The max ROLZ codec block size is %v, got %v", _ROLZ_MAX_BLOCK_SIZE, len(src))
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
 	}
 
 	return this.delegate.Inverse(src, dst)
@@ -194,28 +319,60 @@ func (this *ROLZCodec) MaxEncodedLen(srcLen int) int {
 	return this.delegate.MaxEncodedLen(srcLen)
 }
 
-// Use ANS to encode/decode literals and matches
+// IsReusable returns true
+func (this *ROLZCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns false (the match tables are shared by the calls)
+func (this *ROLZCodec) IsConcurrentSafe() bool {
+	return false
+}
+
+// MaxROLZBlockSize returns the maximum size of a block to transform
+func MaxROLZBlockSize() int {
+	return _ROLZ_MAX_BLOCK_SIZE
+}
+
+// Use ANS to encode/decode literals and matches (or one selected entropy
+// coder per stream)
 type rolzCodec1 struct {
 	matches      []uint32
 	counters     []int32
 	logPosChecks uint
 	maskChecks   int32
 	posChecks    int32
+	split        bool      // one entropy coder per stream
+	coders       [3]uint32 // entropy coders of literals, match lengths and match indexes
 }
 
 func newROLZCodec1(logPosChecks uint) (*rolzCodec1, error) {
 	this := &rolzCodec1{}
+	this.counters = make([]int32, 1<<16)
+
+	if err := this.setLogPosChecks(logPosChecks); err != nil {
+		return nil, err
+	}
 
+	return this, nil
+}
+
+// Set the number of positions checked per context (the match table is
+// reallocated if the number changes)
+func (this *rolzCodec1) setLogPosChecks(logPosChecks uint) error {
 	if (logPosChecks < 2) || (logPosChecks > 8) {
-		return nil, fmt.Errorf("ROLZ codec: Invalid logPosChecks parameter: %v (must be in [2..8])", logPosChecks)
+		return fmt.Errorf("ROLZ codec: Invalid logPosChecks parameter: %v (must be in [2..8])", logPosChecks)
+	}
+
+	if logPosChecks == this.logPosChecks {
+		return nil
 	}
 
 	this.logPosChecks = logPosChecks
 	this.posChecks = 1 << logPosChecks
 	this.maskChecks = this.posChecks - 1
-	this.counters = make([]int32, 1<<16)
 	this.matches = make([]uint32, _ROLZ_HASH_SIZE<<logPosChecks)
-	return this, nil
+	return nil
 }
 
 // findMatch returns match position index (logPosChecks bits) + length (8 bits) or -1
@@ -297,7 +454,7 @@ func (this *rolzCodec1) findMatch(buf []byte, pos int) (int, int) {
 // written and possibly an error.
 func (this *rolzCodec1) Forward(src, dst []byte) (uint, uint, error) {
 	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
-		return 0, 0, fmt.Errorf("ROLZ codec: Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("ROLZ codec: Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
 	srcIdx := 0
@@ -312,9 +469,12 @@ func (this *rolzCodec1) Forward(src, dst []byte) (uint, uint, error) {
 	}
 
 	startChunk := 0
-	litBuf := make([]byte, this.MaxEncodedLen(sizeChunk))
-	lenBuf := make([]byte, sizeChunk/2)
-	mIdxBuf := make([]byte, sizeChunk/2)
+	litBuf := alloc.Bytes(this.MaxEncodedLen(sizeChunk))
+	lenBuf := alloc.Bytes(sizeChunk / 2)
+	mIdxBuf := alloc.Bytes(sizeChunk / 2)
+	defer alloc.PutBytes(litBuf)
+	defer alloc.PutBytes(lenBuf)
+	defer alloc.PutBytes(mIdxBuf)
 	var err error
 
 	for i := range this.counters {
@@ -330,6 +490,21 @@ func (this *rolzCodec1) Forward(src, dst []byte) (uint, uint, error) {
 	dst[dstIdx] = byte(litOrder)
 	dstIdx++
 
+	if this.split == true {
+		dst[dstIdx-1] |= _ROLZ_SPLIT_CODERS
+
+		for i := range this.coders {
+			dst[dstIdx] = byte(this.coders[i])
+			dstIdx++
+		}
+	}
+
+	if this.logPosChecks != _ROLZ_LOG_POS_CHECKS1 {
+		dst[4] |= _ROLZ_LOG_POS
+		dst[dstIdx] = byte(this.logPosChecks)
+		dstIdx++
+	}
+
 	// Main loop
 	for startChunk < srcEnd {
 		litIdx := 0
@@ -411,32 +586,40 @@ func (this *rolzCodec1) Forward(src, dst []byte) (uint, uint, error) {
 			obs.WriteBits(uint64(litIdx), 32)
 			obs.WriteBits(uint64(lenIdx), 32)
 			obs.WriteBits(uint64(mIdx), 32)
-			var litEnc *entropy.ANSRangeEncoder
 
-			if litEnc, err = entropy.NewANSRangeEncoder(obs, litOrder); err != nil {
-				goto End
-			}
+			if this.split == true {
+				if err = this.encodeStreams(obs, [3][]byte{litBuf[0:litIdx], lenBuf[0:lenIdx], mIdxBuf[0:mIdx]}); err != nil {
+					goto End
+				}
+			} else {
+				var litEnc *entropy.ANSRangeEncoder
 
-			if _, err = litEnc.Write(litBuf[0:litIdx]); err != nil {
-				goto End
-			}
+				if litEnc, err = entropy.NewANSRangeEncoder(obs, litOrder); err != nil {
+					goto End
+				}
 
-			litEnc.Dispose()
-			var mEnc *entropy.ANSRangeEncoder
+				if _, err = litEnc.Write(litBuf[0:litIdx]); err != nil {
+					goto End
+				}
 
-			if mEnc, err = entropy.NewANSRangeEncoder(obs, 0); err != nil {
-				goto End
-			}
+				litEnc.Dispose()
+				var mEnc *entropy.ANSRangeEncoder
 
-			if _, err = mEnc.Write(lenBuf[0:lenIdx]); err != nil {
-				goto End
-			}
+				if mEnc, err = entropy.NewANSRangeEncoder(obs, 0); err != nil {
+					goto End
+				}
 
-			if _, err = mEnc.Write(mIdxBuf[0:mIdx]); err != nil {
-				goto End
+				if _, err = mEnc.Write(lenBuf[0:lenIdx]); err != nil {
+					goto End
+				}
+
+				if _, err = mEnc.Write(mIdxBuf[0:mIdx]); err != nil {
+					goto End
+				}
+
+				mEnc.Dispose()
 			}
 
-			mEnc.Dispose()
 			obs.Close()
 		}
 
@@ -444,7 +627,7 @@ func (this *rolzCodec1) Forward(src, dst []byte) (uint, uint, error) {
 		bufSize := os.Len()
 
 		if dstIdx+bufSize > len(dst) {
-			err = errors.New("ROLZ codec: Destination buffer too small")
+			err = kanzi.NewOutputTooSmallError("ROLZ codec: Destination buffer too small")
 			break
 		}
 
@@ -468,7 +651,7 @@ End:
 		dstIdx += 4
 
 		if srcIdx != len(src) {
-			err = errors.New("ROLZ codec: Destination buffer too small")
+			err = kanzi.NewOutputTooSmallError("ROLZ codec: Destination buffer too small")
 		}
 	}
 
@@ -495,17 +678,53 @@ func (this *rolzCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 
 	srcIdx := 4
 	dstIdx := 0
-	litBuf := make([]byte, this.MaxEncodedLen(sizeChunk))
-	lenBuf := make([]byte, sizeChunk/2)
-	mIdxBuf := make([]byte, sizeChunk/2)
+	litBuf := alloc.Bytes(this.MaxEncodedLen(sizeChunk))
+	lenBuf := alloc.Bytes(sizeChunk / 2)
+	mIdxBuf := alloc.Bytes(sizeChunk / 2)
+	defer alloc.PutBytes(litBuf)
+	defer alloc.PutBytes(lenBuf)
+	defer alloc.PutBytes(mIdxBuf)
 	var err error
 
 	for i := range this.counters {
 		this.counters[i] = 0
 	}
 
-	litOrder := uint(src[srcIdx])
+	litOrder := uint(src[srcIdx] &^ (_ROLZ_SPLIT_CODERS | _ROLZ_LOG_POS))
+	split := src[srcIdx]&_ROLZ_SPLIT_CODERS != 0
+	hasLogPos := src[srcIdx]&_ROLZ_LOG_POS != 0
 	srcIdx++
+	var coders [3]uint32
+
+	if split == true {
+		if srcIdx+len(coders) > len(src) {
+			return 0, 0, kanzi.NewCorruptStreamError("ROLZ codec: Invalid input data")
+		}
+
+		for i := range coders {
+			coders[i] = uint32(src[srcIdx])
+			srcIdx++
+
+			if isROLZCoder(coders[i]) == false {
+				return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("ROLZ codec: Invalid entropy codec type in bitstream: %d", coders[i]))
+			}
+		}
+	}
+
+	logPosChecks := uint(_ROLZ_LOG_POS_CHECKS1)
+
+	if hasLogPos == true {
+		if srcIdx >= len(src) {
+			return 0, 0, kanzi.NewCorruptStreamError("ROLZ codec: Invalid input data")
+		}
+
+		logPosChecks = uint(src[srcIdx])
+		srcIdx++
+	}
+
+	if err = this.setLogPosChecks(logPosChecks); err != nil {
+		return 0, 0, err
+	}
 
 	// Main loop
 	for startChunk < dstEnd {
@@ -544,46 +763,53 @@ func (this *rolzCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 			mIdxLen := int(ibs.ReadBits(32))
 
 			if litLen > sizeChunk {
-				err = fmt.Errorf("ROLZ codec: Invalid length: got %v, must be less than or equal to %v", litLen, sizeChunk)
+				err = kanzi.NewCorruptStreamError(fmt.Sprintf("ROLZ codec: Invalid length: got %v, must be less than or equal to %v", litLen, sizeChunk))
 				goto End
 			}
 
 			if mLenLen > sizeChunk {
-				err = fmt.Errorf("ROLZ codec: Invalid length: got %v, must be less than or equal to %v", mLenLen, sizeChunk)
+				err = kanzi.NewCorruptStreamError(fmt.Sprintf("ROLZ codec: Invalid length: got %v, must be less than or equal to %v", mLenLen, sizeChunk))
 				goto End
 			}
 
 			if mIdxLen > sizeChunk {
-				err = fmt.Errorf("ROLZ codec: Invalid length: got %v, must be less than or equal to %v", mIdxLen, sizeChunk)
+				err = kanzi.NewCorruptStreamError(fmt.Sprintf("ROLZ codec: Invalid length: got %v, must be less than or equal to %v", mIdxLen, sizeChunk))
 				goto End
 			}
 
-			var litDec *entropy.ANSRangeDecoder
+			if split == true {
+				if err = decodeStreams(ibs, coders, [3][]byte{litBuf[0:litLen], lenBuf[0:mLenLen], mIdxBuf[0:mIdxLen]}); err != nil {
+					goto End
+				}
+			} else {
+				var litDec *entropy.ANSRangeDecoder
+
+				if litDec, err = entropy.NewANSRangeDecoder(ibs, litOrder); err != nil {
+					goto End
+				}
 
-			if litDec, err = entropy.NewANSRangeDecoder(ibs, litOrder); err != nil {
-				goto End
-			}
+				if _, err = litDec.Read(litBuf[0:litLen]); err != nil {
+					goto End
+				}
 
-			if _, err = litDec.Read(litBuf[0:litLen]); err != nil {
-				goto End
-			}
+				litDec.Dispose()
+				var mDec *entropy.ANSRangeDecoder
 
-			litDec.Dispose()
-			var mDec *entropy.ANSRangeDecoder
+				if mDec, err = entropy.NewANSRangeDecoder(ibs, 0); err != nil {
+					goto End
+				}
 
-			if mDec, err = entropy.NewANSRangeDecoder(ibs, 0); err != nil {
-				goto End
-			}
+				if _, err = mDec.Read(lenBuf[0:mLenLen]); err != nil {
+					goto End
+				}
 
-			if _, err = mDec.Read(lenBuf[0:mLenLen]); err != nil {
-				goto End
-			}
+				if _, err = mDec.Read(mIdxBuf[0:mIdxLen]); err != nil {
+					goto End
+				}
 
-			if _, err = mDec.Read(mIdxBuf[0:mIdxLen]); err != nil {
-				goto End
+				mDec.Dispose()
 			}
 
-			mDec.Dispose()
 			srcIdx += int((ibs.Read() + 7) >> 3)
 			ibs.Close()
 		}
@@ -615,14 +841,14 @@ func (this *rolzCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 						break
 					}
 
-					err = errors.New("ROLZ codec: Invalid input data")
+					err = kanzi.NewCorruptStreamError("ROLZ codec: Invalid input data")
 					goto End
 				}
 			}
 
 			// Sanity check
 			if dstIdx+matchLen+_ROLZ_MIN_MATCH > dstEnd {
-				err = errors.New("ROLZ codec: Invalid input data")
+				err = kanzi.NewCorruptStreamError("ROLZ codec: Invalid input data")
 				goto End
 			}
 
@@ -652,13 +878,53 @@ End:
 		dstIdx += 4
 
 		if srcIdx != len(src) {
-			err = errors.New("ROLZ codec: Invalid input data")
+			err = kanzi.NewCorruptStreamError("ROLZ codec: Invalid input data")
 		}
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
 }
 
+// Encode the literal, match length and match index buffers, each with its
+// own entropy coder
+func (this *rolzCodec1) encodeStreams(obs kanzi.OutputBitStream, bufs [3][]byte) error {
+	for i := range bufs {
+		ee, err := entropy.NewEntropyEncoder(obs, nil, this.coders[i])
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = ee.Write(bufs[i]); err != nil {
+			return err
+		}
+
+		ee.Dispose()
+	}
+
+	return nil
+}
+
+// Decode the literal, match length and match index buffers, each with its
+// own entropy coder
+func decodeStreams(ibs kanzi.InputBitStream, coders [3]uint32, bufs [3][]byte) error {
+	for i := range bufs {
+		ed, err := entropy.NewEntropyDecoder(ibs, nil, coders[i])
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = ed.Read(bufs[i]); err != nil {
+			return err
+		}
+
+		ed.Dispose()
+	}
+
+	return nil
+}
+
 // MaxEncodedLen returns the max size required for the encoding output buffer
 func (this rolzCodec1) MaxEncodedLen(srcLen int) int {
 	if srcLen <= 512 {
@@ -780,19 +1046,33 @@ type rolzCodec2 struct {
 
 func newROLZCodec2(logPosChecks uint) (*rolzCodec2, error) {
 	this := &rolzCodec2{}
+	this.counters = make([]int32, 1<<16)
+	this.litPredictor, _ = newRolzPredictor(9)
+
+	if err := this.setLogPosChecks(logPosChecks); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
 
+// Set the number of positions checked per context (the match table and
+// the match predictor are reallocated if the number changes)
+func (this *rolzCodec2) setLogPosChecks(logPosChecks uint) error {
 	if (logPosChecks < 2) || (logPosChecks > 8) {
-		return nil, fmt.Errorf("ROLZX codec: Invalid logPosChecks parameter: %v (must be in [2..8])", logPosChecks)
+		return fmt.Errorf("ROLZX codec: Invalid logPosChecks parameter: %v (must be in [2..8])", logPosChecks)
+	}
+
+	if logPosChecks == this.logPosChecks {
+		return nil
 	}
 
 	this.logPosChecks = logPosChecks
 	this.posChecks = 1 << logPosChecks
 	this.maskChecks = this.posChecks - 1
-	this.counters = make([]int32, 1<<16)
 	this.matches = make([]uint32, _ROLZ_HASH_SIZE<<logPosChecks)
-	this.litPredictor, _ = newRolzPredictor(9)
 	this.matchPredictor, _ = newRolzPredictor(logPosChecks)
-	return this, nil
+	return nil
 }
 
 // findMatch returns match position index and length or -1
@@ -874,7 +1154,7 @@ func (this *rolzCodec2) findMatch(buf []byte, pos int) (int, int) {
 // written and possibly an error.
 func (this *rolzCodec2) Forward(src, dst []byte) (uint, uint, error) {
 	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
-		return 0, 0, fmt.Errorf("ROLZX codec: Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("ROLZX codec: Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
 	srcIdx := 0
@@ -887,8 +1167,16 @@ func (this *rolzCodec2) Forward(src, dst []byte) (uint, uint, error) {
 	}
 
 	startChunk := 0
-	binary.BigEndian.PutUint32(dst[dstIdx:], uint32(len(src)))
-	dstIdx += 4
+
+	if this.logPosChecks != _ROLZ_LOG_POS_CHECKS2 {
+		binary.BigEndian.PutUint32(dst[dstIdx:], uint32(len(src))|_ROLZX_LOG_POS)
+		dst[dstIdx+4] = byte(this.logPosChecks)
+		dstIdx += 5
+	} else {
+		binary.BigEndian.PutUint32(dst[dstIdx:], uint32(len(src)))
+		dstIdx += 4
+	}
+
 	this.litPredictor.reset()
 	this.matchPredictor.reset()
 	predictors := [2]kanzi.Predictor{this.matchPredictor, this.litPredictor}
@@ -971,7 +1259,7 @@ func (this *rolzCodec2) Forward(src, dst []byte) (uint, uint, error) {
 	var err error
 
 	if srcIdx != len(src) {
-		err = errors.New("ROLZX codec: Destination buffer too small")
+		err = kanzi.NewOutputTooSmallError("ROLZX codec: Destination buffer too small")
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
@@ -983,9 +1271,25 @@ func (this *rolzCodec2) Forward(src, dst []byte) (uint, uint, error) {
 func (this *rolzCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 	srcIdx := 0
 	dstIdx := 0
-	dstEnd := int(binary.BigEndian.Uint32(src[srcIdx:]))
-
+	size := binary.BigEndian.Uint32(src[srcIdx:])
 	srcIdx += 4
+	logPosChecks := uint(_ROLZ_LOG_POS_CHECKS2)
+
+	if size&_ROLZX_LOG_POS != 0 {
+		if srcIdx >= len(src) {
+			return 0, 0, kanzi.NewCorruptStreamError("ROLZX codec: Invalid input data")
+		}
+
+		size &^= _ROLZX_LOG_POS
+		logPosChecks = uint(src[srcIdx])
+		srcIdx++
+	}
+
+	if err := this.setLogPosChecks(logPosChecks); err != nil {
+		return 0, 0, err
+	}
+
+	dstEnd := int(size)
 	sizeChunk := len(dst)
 
 	if sizeChunk > _ROLZ_CHUNK_SIZE {
@@ -1090,7 +1394,7 @@ func (this *rolzCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 	dstIdx += (startChunk - sizeChunk)
 
 	if srcIdx != len(src) {
-		err = errors.New("ROLZX codec: Invalid input data")
+		err = kanzi.NewCorruptStreamError("ROLZX codec: Invalid input data")
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
@@ -18,6 +18,8 @@ package function
 import (
 	"errors"
 	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
 )
 
 const (
@@ -51,12 +53,12 @@ func (this *SRT) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
 	count := len(src)
@@ -188,8 +190,8 @@ func (this *SRT) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	// init arrays
@@ -271,7 +273,7 @@ func (this SRT) encodeHeader(freqs []int32, dst []byte) (int, error) {
 
 func (this SRT) decodeHeader(src []byte, freqs []int32) (int, error) {
 	if len(src) < _SRT_HEADER_SIZE {
-		return 0, errors.New("SRT inverse failed: cannot decode header")
+		return 0, kanzi.NewCorruptStreamError("SRT inverse failed: cannot decode header")
 	}
 
 	for i := range freqs {
@@ -289,3 +291,13 @@ func (this SRT) decodeHeader(src []byte, freqs []int32) (int, error) {
 func (this SRT) MaxEncodedLen(srcLen int) int {
 	return srcLen + _SRT_HEADER_SIZE
 }
+
+// IsReusable returns true
+func (this *SRT) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the buffers are allocated per call)
+func (this *SRT) IsConcurrentSafe() bool {
+	return true
+}
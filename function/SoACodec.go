@@ -0,0 +1,227 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	SOA_MAX_RECORD_SIZE = 4096 // max record size provided in the context
+
+	_SOA_HEADER_SIZE     = 2 // record size
+	_SOA_MIN_BLOCK_SIZE  = 256
+	_SOA_MAX_AUTO_RECORD = 64        // max record size detected
+	_SOA_SAMPLE_SIZE     = 64 * 1024 // bytes analyzed to detect the record size
+	_SOA_MIN_GAIN        = 90        // the columns must lower the entropy by 10% at least
+	_SOA_MIN_STEP        = 95        // a larger record must have 5% more matches than a smaller one
+)
+
+// SoA stream format: record size (2 bytes) + column 0 + column 1 + ...
+// Column c contains the bytes at positions c, c+size, c+2*size, ... (the
+// last record may be incomplete).
+
+// SoACodec a transform for arrays of fixed size records (binary tables,
+// pixels, network packets with fixed headers, ...). The records (array of
+// structures) are deinterleaved into one stream per byte of the record
+// (structure of arrays) so that the following stages see similar bytes
+// together. The record size is provided in the context ('recordSize') or
+// detected for each block: the smallest lag with (almost) the most repeated
+// bytes (autocorrelation) is selected if it lowers the entropy of the
+// columns. Blocks without detected structure are rejected (the transform
+// is skipped).
+type SoACodec struct {
+	recordSize int // 0 => auto
+}
+
+// NewSoACodec creates a new instance of SoACodec
+func NewSoACodec() (*SoACodec, error) {
+	return &SoACodec{}, nil
+}
+
+// NewSoACodecWithCtx creates a new instance of SoACodec using a
+// configuration map as parameter.
+func NewSoACodecWithCtx(ctx *map[string]interface{}) (*SoACodec, error) {
+	this := &SoACodec{}
+
+	if val, containsKey := (*ctx)["recordSize"]; containsKey {
+		this.recordSize = val.(int)
+
+		if this.recordSize != 0 && (this.recordSize < 2 || this.recordSize > SOA_MAX_RECORD_SIZE) {
+			return nil, fmt.Errorf("Invalid record size: %v (must be in [2..%d])", this.recordSize, SOA_MAX_RECORD_SIZE)
+		}
+	}
+
+	return this, nil
+}
+
+// DetectRecordSize returns the size of the records of the block (0 if no
+// record structure is found)
+func DetectRecordSize(block []byte) int {
+	sample := block
+
+	// Sample the middle of the block (avoid headers)
+	if len(sample) > _SOA_SAMPLE_SIZE {
+		start := (len(block) - _SOA_SAMPLE_SIZE) / 2
+		sample = block[start : start+_SOA_SAMPLE_SIZE]
+	}
+
+	if len(sample) < 4*_SOA_MAX_AUTO_RECORD {
+		return 0
+	}
+
+	// Number of bytes equal to the byte 'lag' positions before
+	var matches [_SOA_MAX_AUTO_RECORD + 1]int
+
+	for lag := 2; lag <= _SOA_MAX_AUTO_RECORD; lag++ {
+		n := 0
+
+		for i := lag; i < len(sample); i++ {
+			if sample[i] == sample[i-lag] {
+				n++
+			}
+		}
+
+		matches[lag] = n
+	}
+
+	best := 2
+
+	for lag := 3; lag <= _SOA_MAX_AUTO_RECORD; lag++ {
+		if matches[lag] > matches[best] {
+			best = lag
+		}
+	}
+
+	// The multiples of the record size have similar numbers of matches:
+	// select the smallest lag close to the best one
+	for lag := 2; lag < best; lag++ {
+		if matches[lag]*100 >= matches[best]*_SOA_MIN_STEP {
+			best = lag
+			break
+		}
+	}
+
+	// The columns must be more compressible than the block
+	histo := [256]int{}
+	kanzi.ComputeHistogram(sample, histo[:], true, false)
+	baseline := kanzi.ComputeEntropy1024(histo[:], len(sample))
+	stats := kanzi.ComputeStrideStats(sample, []int{best})
+
+	if stats[0].LaneEntropy*100 >= baseline*_SOA_MIN_GAIN {
+		return 0
+	}
+
+	return best
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *SoACodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	if len(src) < _SOA_MIN_BLOCK_SIZE {
+		return 0, 0, kanzi.NewNotApplicableError("Block too small, skip")
+	}
+
+	size := this.recordSize
+
+	if size == 0 {
+		if size = DetectRecordSize(src); size == 0 {
+			return 0, 0, kanzi.NewNotApplicableError("No record structure found")
+		}
+	}
+
+	binary.BigEndian.PutUint16(dst, uint16(size))
+	dstIdx := _SOA_HEADER_SIZE
+
+	for c := 0; c < size; c++ {
+		for i := c; i < len(src); i += size {
+			dst[dstIdx] = src[i]
+			dstIdx++
+		}
+	}
+
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *SoACodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(src) < _SOA_HEADER_SIZE {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid SoA block: missing header")
+	}
+
+	size := int(binary.BigEndian.Uint16(src))
+	count := len(src) - _SOA_HEADER_SIZE
+
+	if size < 2 || size > SOA_MAX_RECORD_SIZE {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid record size in bitstream: %d", size))
+	}
+
+	if len(dst) < count {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), count))
+	}
+
+	srcIdx := _SOA_HEADER_SIZE
+
+	for c := 0; c < size; c++ {
+		for i := c; i < count; i += size {
+			dst[i] = src[srcIdx]
+			srcIdx++
+		}
+	}
+
+	return uint(srcIdx), uint(count), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer
+func (this SoACodec) MaxEncodedLen(srcLen int) int {
+	return srcLen + _SOA_HEADER_SIZE
+}
+
+// IsReusable returns true
+func (this *SoACodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the record size is set at creation)
+func (this *SoACodec) IsConcurrentSafe() bool {
+	return true
+}
@@ -0,0 +1,393 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// StreamFunction applies a byte function to a stream, one chunk at a time,
+// so that big inputs can be transformed without allocating buffers the size
+// of the whole input. The state carried over from one chunk to the next
+// depends on the function:
+//   - TextCodec: the chunks are cut after a line feed (or a delimiter) and the
+//     dynamic dictionary is retained from one chunk to the next
+//   - RLT: the chunks are not cut inside a run (the run is carried over)
+//   - LZCodec: the last 64 KB of the previous chunks are a window the matches
+//     of the next chunk can reference (the preset dictionary of the codec, if
+//     any, is the initial window: the decoder must use the same dictionary)
+//
+// Other functions process independent chunks.
+//
+// Stream format: a sequence of chunks, each one with a header
+// (encoded size (31 bits) | raw flag (1 bit), 32 bits, big endian) followed
+// by the decoded size (32 bits, big endian) and the encoded data.
+// A chunk the function could not transform (or did not shrink) is stored
+// raw. A header equal to 0 marks the end of the stream.
+type StreamFunction struct {
+	fct       kanzi.ByteFunction
+	chunkSize int
+	in        []byte
+	out       []byte
+	window    []byte // LZ: end of the previous chunks
+}
+
+const (
+	// STREAM_MIN_CHUNK_SIZE minimum size of the chunks of a StreamFunction
+	STREAM_MIN_CHUNK_SIZE = 1024
+	// STREAM_MAX_CHUNK_SIZE maximum size of the chunks of a StreamFunction
+	STREAM_MAX_CHUNK_SIZE = 1 << 28
+	// STREAM_DEFAULT_CHUNK_SIZE default size of the chunks of a StreamFunction
+	STREAM_DEFAULT_CHUNK_SIZE = 4 * 1024 * 1024
+
+	_STREAM_CHUNK_RAW = uint32(1) << 31
+)
+
+// NewStreamFunction creates a new instance of StreamFunction applying the
+// provided function to chunks of at most 'chunkSize' bytes. The decoder
+// must use a chunk size at least as big as the one of the encoder.
+func NewStreamFunction(fct kanzi.ByteFunction, chunkSize int) (*StreamFunction, error) {
+	if fct == nil {
+		return nil, errors.New("Invalid null byte function parameter")
+	}
+
+	if chunkSize < STREAM_MIN_CHUNK_SIZE || chunkSize > STREAM_MAX_CHUNK_SIZE {
+		return nil, fmt.Errorf("Invalid chunk size parameter: %v (must be in [%v..%v])",
+			chunkSize, STREAM_MIN_CHUNK_SIZE, STREAM_MAX_CHUNK_SIZE)
+	}
+
+	if tc, isText := fct.(*TextCodec); isText && chunkSize > _TC_MAX_BLOCK_SIZE {
+		return nil, fmt.Errorf("Invalid chunk size parameter for %T: %v", tc, chunkSize)
+	}
+
+	this := &StreamFunction{fct: fct, chunkSize: chunkSize}
+	return this, nil
+}
+
+// ForwardStream reads the data from 'r' until EOF, applies the function to
+// each chunk and writes the stream of encoded chunks to 'w'. Returns number
+// of bytes read, number of bytes written and possibly an error.
+func (this *StreamFunction) ForwardStream(r io.Reader, w io.Writer) (int64, int64, error) {
+	defer this.begin()()
+
+	if len(this.in) < this.chunkSize {
+		this.in = make([]byte, this.chunkSize)
+	}
+
+	var read, written int64
+	pending := 0
+	eof := false
+	header := make([]byte, 8)
+
+	for eof == false {
+		n, err := io.ReadFull(r, this.in[pending:this.chunkSize])
+		read += int64(n)
+		pending += n
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return read, written, err
+		}
+
+		if pending == 0 {
+			break
+		}
+
+		end := pending
+
+		if eof == false {
+			end = this.chunkEnd(this.in[0:pending])
+		}
+
+		chunk := this.in[0:end]
+		size, err := this.forwardChunk(chunk)
+
+		if err != nil {
+			return read, written, err
+		}
+
+		payload := chunk
+
+		if size < 0 {
+			binary.BigEndian.PutUint32(header, _STREAM_CHUNK_RAW|uint32(len(chunk)))
+		} else {
+			binary.BigEndian.PutUint32(header, uint32(size))
+			payload = this.out[0:size]
+		}
+
+		binary.BigEndian.PutUint32(header[4:], uint32(len(chunk)))
+
+		if err = writeAll(w, header, payload); err != nil {
+			return read, written, err
+		}
+
+		written += int64(len(header) + len(payload))
+
+		// Carry over the rest of the input
+		pending = copy(this.in, this.in[end:pending])
+	}
+
+	// End of stream
+	binary.BigEndian.PutUint32(header, 0)
+
+	if _, err := w.Write(header[0:4]); err != nil {
+		return read, written, err
+	}
+
+	return read, written + 4, nil
+}
+
+// InverseStream reads a stream of encoded chunks from 'r' (up to the end
+// of stream marker), applies the reverse function to each chunk and writes
+// the decoded data to 'w'. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *StreamFunction) InverseStream(r io.Reader, w io.Writer) (int64, int64, error) {
+	defer this.begin()()
+
+	var read, written int64
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header[0:4]); err != nil {
+			return read, written, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid stream: missing chunk header (%v)", err))
+		}
+
+		read += 4
+		hdr := binary.BigEndian.Uint32(header)
+
+		if hdr == 0 {
+			break
+		}
+
+		if _, err := io.ReadFull(r, header[4:8]); err != nil {
+			return read, written, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid stream: missing chunk header (%v)", err))
+		}
+
+		read += 4
+		size := int(hdr &^ _STREAM_CHUNK_RAW)
+		decodedSize := int(binary.BigEndian.Uint32(header[4:]))
+
+		if decodedSize > this.chunkSize || size > decodedSize {
+			return read, written, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid chunk size: %v (decoded size %v, max %v)",
+				size, decodedSize, this.chunkSize))
+		}
+
+		if len(this.in) < size {
+			this.in = make([]byte, size)
+		}
+
+		if _, err := io.ReadFull(r, this.in[0:size]); err != nil {
+			return read, written, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid stream: missing chunk data (%v)", err))
+		}
+
+		read += int64(size)
+		chunk, err := this.inverseChunk(this.in[0:size], decodedSize, hdr&_STREAM_CHUNK_RAW != 0)
+
+		if err != nil {
+			return read, written, err
+		}
+
+		if _, err = w.Write(chunk); err != nil {
+			return read, written, err
+		}
+
+		written += int64(len(chunk))
+	}
+
+	return read, written, nil
+}
+
+// Reset the carried over state at the beginning of a stream. Returns the
+// function restoring the state of the byte function at the end.
+func (this *StreamFunction) begin() func() {
+	this.window = this.window[:0]
+
+	switch f := this.fct.(type) {
+	case *TextCodec:
+		retain := f.setRetain(true)
+		f.ResetDictionary()
+
+		return func() {
+			if retain == false {
+				f.setRetain(false)
+				f.ResetDictionary()
+			}
+		}
+
+	case *LZCodec:
+		if f.dict != nil {
+			this.window = append(this.window, f.dict.data...)
+		}
+	}
+
+	return func() {}
+}
+
+// Return the end of the next chunk in 'buf' (full chunk). The bytes after
+// the end are carried over to the next chunk.
+func (this *StreamFunction) chunkEnd(buf []byte) int {
+	end := len(buf)
+
+	switch this.fct.(type) {
+	case *TextCodec:
+		// Cut after the last line feed (or else delimiter) to avoid
+		// splitting words and lines
+		limit := end - end/16
+
+		for i := end - 1; i > limit; i-- {
+			if buf[i] == LF {
+				return i + 1
+			}
+		}
+
+		for i := end - 1; i > limit; i-- {
+			if isDelimiter(buf[i]) {
+				return i + 1
+			}
+		}
+
+	case *RLT:
+		// Do not split the last run
+		i := end - 1
+
+		for i > 0 && buf[i-1] == buf[end-1] && end-i < _RLT_MAX_RUN {
+			i--
+		}
+
+		if i > 0 {
+			return i
+		}
+	}
+
+	return end
+}
+
+// Encode the chunk to this.out. Returns the encoded size or -1 if the chunk
+// must be stored raw.
+func (this *StreamFunction) forwardChunk(chunk []byte) (int, error) {
+	required := this.fct.MaxEncodedLen(len(chunk))
+
+	if required < len(chunk) {
+		required = len(chunk)
+	}
+
+	if len(this.out) < required {
+		this.out = make([]byte, required)
+	}
+
+	var dstIdx uint
+	var err error
+
+	switch f := this.fct.(type) {
+	case *LZCodec:
+		buf := append(this.window, chunk...)
+
+		if f.mode != LZ_MODE_FAST {
+			_, dstIdx, err = f.forwardChains(buf, len(this.window), this.out)
+		} else {
+			_, dstIdx, err = f.forwardFast(buf, len(this.window), this.out)
+		}
+
+		this.slide(buf)
+
+	default:
+		_, dstIdx, err = this.fct.Forward(chunk, this.out)
+	}
+
+	if err == nil && int(dstIdx) < len(chunk) {
+		return int(dstIdx), nil
+	}
+
+	if tc, isText := this.fct.(*TextCodec); isText {
+		// The decoder does not see the dictionary of the failed attempt
+		tc.ResetDictionary()
+	}
+
+	return -1, nil
+}
+
+// Decode the chunk. Returns the decoded data.
+func (this *StreamFunction) inverseChunk(chunk []byte, decodedSize int, raw bool) ([]byte, error) {
+	if raw == true {
+		switch f := this.fct.(type) {
+		case *LZCodec:
+			this.slide(append(this.window, chunk...))
+
+		case *TextCodec:
+			f.ResetDictionary()
+		}
+
+		return chunk, nil
+	}
+
+	if len(this.out) < decodedSize {
+		this.out = make([]byte, decodedSize)
+	}
+
+	var dstIdx uint
+	var err error
+
+	switch f := this.fct.(type) {
+	case *LZCodec:
+		start := len(this.window)
+		buf := append(this.window, make([]byte, decodedSize)...)
+
+		if _, dstIdx, err = f.inverse(chunk, buf, start); err == nil {
+			copy(this.out, buf[start:start+int(dstIdx)])
+		}
+
+		this.slide(buf)
+
+	default:
+		_, dstIdx, err = this.fct.Inverse(chunk, this.out[0:decodedSize])
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if int(dstIdx) != decodedSize {
+		return nil, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid chunk: decoded %v bytes, expected %v", dstIdx, decodedSize))
+	}
+
+	return this.out[0:decodedSize], nil
+}
+
+// Keep the end of the data (within reach of the LZ matches) as window for
+// the next chunk
+func (this *StreamFunction) slide(buf []byte) {
+	if len(buf) > _MAX_DISTANCE {
+		buf = buf[len(buf)-_MAX_DISTANCE:]
+	}
+
+	this.window = append(this.window[:0], buf...)
+}
+
+func writeAll(w io.Writer, bufs ...[]byte) error {
+	for _, buf := range bufs {
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
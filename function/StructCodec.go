@@ -0,0 +1,575 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	_STRUCT_JSON = 1
+	_STRUCT_CSV  = 2
+
+	_STRUCT_HEADER_SIZE    = 4 // mode + 3 escapes (JSON) or 2 escapes + delimiter (CSV)
+	_STRUCT_MIN_BLOCK_SIZE = 64
+	_STRUCT_MAX_KEY_LENGTH = 64
+	_STRUCT_MAX_KEYS       = 1 << 14 // indexes encoded with at most 2 bytes
+	_STRUCT_MIN_FIELD      = 2
+	_STRUCT_MAX_FIELD      = 32
+	_STRUCT_MAX_COLUMNS    = 256
+	_STRUCT_MAX_INDENT     = 255
+	_STRUCT_SAMPLE_SIZE    = 4096
+)
+
+var _STRUCT_CSV_DELIMITERS = []byte{',', ';', '\t', '|'}
+
+// Struct stream format: mode, escape bytes (absent from the block) and
+// data. JSON mode: a key (EG. "name":) is replaced by escape 1 and its
+// index in the key dictionary, or by escape 2 and the key text the first
+// time it is seen. A line feed followed by spaces is replaced by escape 3
+// and the number of spaces. CSV mode: a field equal to the field of the
+// same column in the previous row is replaced by escape 1, a field found in
+// the field dictionary by escape 2 and its index. The decoder rebuilds the
+// field dictionary from the decoded fields.
+
+// StructCodec a transform for machine generated structured text (JSON
+// documents or lines, CSV tables). It is a sibling of the text codec
+// specialized in the structure of the data: the keys of JSON objects and
+// the repeated CSV fields are replaced with indexes in a dictionary learned
+// while processing the block and the indentation with a count.
+type StructCodec struct {
+}
+
+// NewStructCodec creates a new instance of StructCodec
+func NewStructCodec() (*StructCodec, error) {
+	return &StructCodec{}, nil
+}
+
+// NewStructCodecWithCtx creates a new instance of StructCodec using a
+// configuration map as parameter.
+func NewStructCodecWithCtx(ctx *map[string]interface{}) (*StructCodec, error) {
+	return &StructCodec{}, nil
+}
+
+// Return the mode of the block (and the CSV delimiter) or 0
+func detectStructMode(block []byte) (int, byte) {
+	sample := block
+
+	if len(sample) > _STRUCT_SAMPLE_SIZE {
+		sample = sample[0:_STRUCT_SAMPLE_SIZE]
+	}
+
+	for _, c := range sample {
+		if c == '{' || c == '[' {
+			return _STRUCT_JSON, 0
+		}
+
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			break
+		}
+	}
+
+	// CSV: same (non zero) number of delimiters in all the complete lines
+	lines := bytes.Split(sample, []byte{'\n'})
+
+	if len(lines) < 3 {
+		return 0, 0
+	}
+
+	lines = lines[0 : len(lines)-1]
+
+	for _, d := range _STRUCT_CSV_DELIMITERS {
+		n := bytes.Count(lines[0], []byte{d})
+
+		if n == 0 {
+			continue
+		}
+
+		i := 1
+
+		for i < len(lines) && bytes.Count(lines[i], []byte{d}) == n {
+			i++
+		}
+
+		if i == len(lines) {
+			return _STRUCT_CSV, d
+		}
+	}
+
+	return 0, 0
+}
+
+// Return the size of the JSON key ("key":) at the start of the block and
+// the key or 0
+func structJSONKey(block []byte) (int, []byte) {
+	end := len(block) - 1
+
+	if end > _STRUCT_MAX_KEY_LENGTH+1 {
+		end = _STRUCT_MAX_KEY_LENGTH + 1
+	}
+
+	for i := 1; i < end; i++ {
+		c := block[i]
+
+		if c == '"' {
+			if i == 1 || block[i+1] != ':' {
+				return 0, nil
+			}
+
+			return i + 2, block[1:i]
+		}
+
+		if c == '\\' || c < 0x20 {
+			return 0, nil
+		}
+	}
+
+	return 0, nil
+}
+
+func structVarIntLength(val int) int {
+	if val < 0x80 {
+		return 1
+	}
+
+	return 2
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *StructCodec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	if len(src) < _STRUCT_MIN_BLOCK_SIZE {
+		return 0, 0, kanzi.NewNotApplicableError("Struct transform failed: input too small")
+	}
+
+	mode, delimiter := detectStructMode(src)
+
+	if mode == 0 {
+		return 0, 0, kanzi.NewNotApplicableError("Struct transform failed: input is neither JSON nor CSV")
+	}
+
+	// Select the escape bytes absent from the block
+	var freqs [256]int
+	var escapes [3]byte
+
+	for _, c := range src {
+		freqs[c]++
+	}
+
+	nbEscapes := 0
+
+	for i := range freqs {
+		if freqs[i] == 0 && nbEscapes < len(escapes) {
+			escapes[nbEscapes] = byte(i)
+			nbEscapes++
+		}
+	}
+
+	if nbEscapes < len(escapes) {
+		return 0, 0, kanzi.NewNotApplicableError("Struct transform failed: no escape byte available")
+	}
+
+	dst[0] = byte(mode)
+	dst[1] = escapes[0]
+	dst[2] = escapes[1]
+	dst[3] = escapes[2]
+	var dstIdx, tokens int
+
+	if mode == _STRUCT_JSON {
+		dstIdx, tokens = this.forwardJSON(src, dst, escapes)
+	} else {
+		dst[3] = delimiter
+		dstIdx, tokens = this.forwardCSV(src, dst, escapes[0], escapes[1], delimiter)
+	}
+
+	if tokens == 0 || dstIdx >= len(src) {
+		return 0, 0, kanzi.NewNotApplicableError("Struct transform failed: output not smaller than input")
+	}
+
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+// Return the size of the output (or len(dst) if the output is too large)
+// and the number of tokens
+func (this *StructCodec) forwardJSON(src, dst []byte, escapes [3]byte) (int, int) {
+	keys := make(map[string]int)
+	dstIdx := _STRUCT_HEADER_SIZE
+	tokens := 0
+	count := len(src)
+
+	for srcIdx := 0; srcIdx < count; {
+		c := src[srcIdx]
+
+		if dstIdx+_STRUCT_MAX_KEY_LENGTH+2 >= len(dst) {
+			return len(dst), tokens
+		}
+
+		if c == '"' {
+			if n, key := structJSONKey(src[srcIdx:]); n > 0 {
+				if idx, exists := keys[string(key)]; exists == true {
+					dst[dstIdx] = escapes[0]
+					dstIdx += 1 + emitPathVarInt(dst[dstIdx+1:], idx)
+					srcIdx += n
+					tokens++
+					continue
+				}
+
+				if len(keys) < _STRUCT_MAX_KEYS {
+					// New key: escape, key and quote
+					keys[string(key)] = len(keys)
+					dst[dstIdx] = escapes[1]
+					dstIdx++
+					dstIdx += copy(dst[dstIdx:], key)
+					dst[dstIdx] = '"'
+					dstIdx++
+					srcIdx += n
+					tokens++
+					continue
+				}
+			}
+		} else if c == '\n' {
+			n := 0
+
+			for srcIdx+1+n < count && n < _STRUCT_MAX_INDENT && src[srcIdx+1+n] == ' ' {
+				n++
+			}
+
+			if n >= 2 {
+				dst[dstIdx] = escapes[2]
+				dst[dstIdx+1] = byte(n)
+				dstIdx += 2
+				srcIdx += 1 + n
+				tokens++
+				continue
+			}
+		}
+
+		dst[dstIdx] = c
+		dstIdx++
+		srcIdx++
+	}
+
+	return dstIdx, tokens
+}
+
+// structFields the dictionary of the CSV fields and the fields of the
+// previous row, updated the same way by the encoder and the decoder.
+type structFields struct {
+	dict     map[string]int
+	previous [_STRUCT_MAX_COLUMNS][]byte
+	column   int
+}
+
+func newStructFields() *structFields {
+	return &structFields{dict: make(map[string]int)}
+}
+
+func (this *structFields) add(field []byte) {
+	if len(field) >= _STRUCT_MIN_FIELD && len(field) <= _STRUCT_MAX_FIELD && len(this.dict) < _STRUCT_MAX_KEYS {
+		if _, exists := this.dict[string(field)]; exists == false {
+			this.dict[string(field)] = len(this.dict)
+		}
+	}
+
+	if this.column < _STRUCT_MAX_COLUMNS {
+		this.previous[this.column] = field
+	}
+}
+
+// Update the column given the separator following the field
+func (this *structFields) next(separator byte) {
+	if separator == '\n' {
+		this.column = 0
+	} else {
+		this.column++
+	}
+}
+
+func (this *StructCodec) forwardCSV(src, dst []byte, same, index, delimiter byte) (int, int) {
+	fields := newStructFields()
+	dstIdx := _STRUCT_HEADER_SIZE
+	tokens := 0
+	count := len(src)
+
+	for srcIdx := 0; srcIdx < count; {
+		end := srcIdx
+
+		for end < count && src[end] != delimiter && src[end] != '\n' {
+			end++
+		}
+
+		field := src[srcIdx:end]
+
+		if dstIdx+len(field)+1 >= len(dst) {
+			return len(dst), tokens
+		}
+
+		if fields.column < _STRUCT_MAX_COLUMNS && len(field) >= _STRUCT_MIN_FIELD &&
+			bytes.Equal(field, fields.previous[fields.column]) {
+			dst[dstIdx] = same
+			dstIdx++
+			tokens++
+		} else if idx, exists := fields.dict[string(field)]; exists == true && len(field) > 1+structVarIntLength(idx) {
+			dst[dstIdx] = index
+			dstIdx += 1 + emitPathVarInt(dst[dstIdx+1:], idx)
+			tokens++
+		} else {
+			dstIdx += copy(dst[dstIdx:], field)
+		}
+
+		fields.add(field)
+
+		if end < count {
+			dst[dstIdx] = src[end]
+			dstIdx++
+			fields.next(src[end])
+			end++
+		}
+
+		srcIdx = end
+	}
+
+	return dstIdx, tokens
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *StructCodec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(src) < _STRUCT_HEADER_SIZE {
+		return 0, 0, kanzi.NewCorruptStreamError("Struct codec: truncated header in bitstream")
+	}
+
+	var dstIdx int
+	var err error
+
+	switch src[0] {
+	case _STRUCT_JSON:
+		dstIdx, err = this.inverseJSON(src, dst)
+
+	case _STRUCT_CSV:
+		dstIdx, err = this.inverseCSV(src, dst)
+
+	default:
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid struct mode in bitstream: %d", src[0]))
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+func (this *StructCodec) inverseJSON(src, dst []byte) (int, error) {
+	keys := make([][]byte, 0)
+	srcIdx := _STRUCT_HEADER_SIZE
+	dstIdx := 0
+
+	for srcIdx < len(src) {
+		c := src[srcIdx]
+		srcIdx++
+		var key []byte
+
+		switch c {
+		case src[1]:
+			idx, n, err := readPathVarInt(src[srcIdx:])
+
+			if err != nil {
+				return 0, err
+			}
+
+			if idx >= len(keys) {
+				return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Struct codec: invalid key index in bitstream: %d", idx))
+			}
+
+			srcIdx += n
+			key = keys[idx]
+
+		case src[2]:
+			n := bytes.IndexByte(src[srcIdx:], '"')
+
+			if n <= 0 || len(keys) >= _STRUCT_MAX_KEYS {
+				return 0, kanzi.NewCorruptStreamError("Struct codec: invalid key in bitstream")
+			}
+
+			key = src[srcIdx : srcIdx+n]
+			keys = append(keys, key)
+			srcIdx += n + 1
+
+		case src[3]:
+			if srcIdx >= len(src) {
+				return 0, kanzi.NewCorruptStreamError("Struct codec: truncated indentation in bitstream")
+			}
+
+			n := int(src[srcIdx])
+			srcIdx++
+
+			if dstIdx+1+n > len(dst) {
+				return 0, kanzi.NewOutputTooSmallError("Struct codec: output buffer is too small")
+			}
+
+			dst[dstIdx] = '\n'
+			dstIdx++
+
+			for i := 0; i < n; i++ {
+				dst[dstIdx+i] = ' '
+			}
+
+			dstIdx += n
+			continue
+
+		default:
+			if dstIdx >= len(dst) {
+				return 0, kanzi.NewOutputTooSmallError("Struct codec: output buffer is too small")
+			}
+
+			dst[dstIdx] = c
+			dstIdx++
+			continue
+		}
+
+		if dstIdx+len(key)+3 > len(dst) {
+			return 0, kanzi.NewOutputTooSmallError("Struct codec: output buffer is too small")
+		}
+
+		dst[dstIdx] = '"'
+		dstIdx++
+		dstIdx += copy(dst[dstIdx:], key)
+		dst[dstIdx] = '"'
+		dst[dstIdx+1] = ':'
+		dstIdx += 2
+	}
+
+	return dstIdx, nil
+}
+
+func (this *StructCodec) inverseCSV(src, dst []byte) (int, error) {
+	same, index, delimiter := src[1], src[2], src[3]
+	fields := newStructFields()
+	values := make([][]byte, 0)
+	srcIdx := _STRUCT_HEADER_SIZE
+	dstIdx := 0
+
+	for srcIdx < len(src) {
+		var field []byte
+
+		if c := src[srcIdx]; c == same {
+			if fields.column >= _STRUCT_MAX_COLUMNS || fields.previous[fields.column] == nil {
+				return 0, kanzi.NewCorruptStreamError("Struct codec: invalid field reference in bitstream")
+			}
+
+			field = fields.previous[fields.column]
+			srcIdx++
+		} else if c == index {
+			idx, n, err := readPathVarInt(src[srcIdx+1:])
+
+			if err != nil {
+				return 0, err
+			}
+
+			if idx >= len(values) {
+				return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Struct codec: invalid field index in bitstream: %d", idx))
+			}
+
+			field = values[idx]
+			srcIdx += 1 + n
+		} else {
+			end := srcIdx
+
+			for end < len(src) && src[end] != delimiter && src[end] != '\n' {
+				end++
+			}
+
+			field = src[srcIdx:end]
+			srcIdx = end
+		}
+
+		if dstIdx+len(field) > len(dst) {
+			return 0, kanzi.NewOutputTooSmallError("Struct codec: output buffer is too small")
+		}
+
+		start := dstIdx
+		dstIdx += copy(dst[dstIdx:], field)
+		field = dst[start:dstIdx]
+
+		n := len(fields.dict)
+		fields.add(field)
+
+		if len(fields.dict) > n {
+			values = append(values, field)
+		}
+
+		if srcIdx < len(src) {
+			c := src[srcIdx]
+
+			if c != delimiter && c != '\n' {
+				return 0, kanzi.NewCorruptStreamError("Struct codec: missing field separator in bitstream")
+			}
+
+			if dstIdx >= len(dst) {
+				return 0, kanzi.NewOutputTooSmallError("Struct codec: output buffer is too small")
+			}
+
+			dst[dstIdx] = c
+			dstIdx++
+			srcIdx++
+			fields.next(c)
+		}
+	}
+
+	return dstIdx, nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer.
+// The transform fails if the output is not smaller than the input.
+func (this StructCodec) MaxEncodedLen(srcLen int) int {
+	return srcLen
+}
+
+// IsReusable returns true
+func (this *StructCodec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the dictionaries are allocated per call)
+func (this *StructCodec) IsConcurrentSafe() bool {
+	return true
+}
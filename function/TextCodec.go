@@ -16,6 +16,8 @@ limitations under the License.
 package function
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 
@@ -36,9 +38,15 @@ const (
 	_TC_MAX_WORD_LENGTH        = 31         // must be less than 128
 	_TC_LOG_HASHES_SIZE        = 24         // 16 MB
 	_TC_MAX_BLOCK_SIZE         = 1 << 30    // 1 GB
+	_TC_MIN_CHUNK_SIZE         = 1 << 10    // 1 KB
+	_TC_CHUNK_RAW              = 0x80000000 // chunk header: chunk stored as is (not text)
 	_TC_ESCAPE_TOKEN1          = byte(0x0F) // dictionary word preceded by space symbol
 	_TC_ESCAPE_TOKEN2          = byte(0x0E) // toggle upper/lower case of first word char
+	_TC_ESCAPE_RUN_BASE        = 0x10       // textcodec2 (escape runs): ESC1 + (base+run-min) + run of high bit symbols
+	_TC_MIN_ESCAPE_RUN         = 3
+	_TC_MAX_ESCAPE_RUN         = 0x7F - _TC_ESCAPE_RUN_BASE + _TC_MIN_ESCAPE_RUN
 	_TC_MASK_NOT_TEXT          = 0x80
+	_TC_MASK_CHUNKED           = 0x40 // block split in chunks (each with its own mode byte)
 	_TC_MASK_ALMOST_FULL_ASCII = 0x08
 	_TC_MASK_FULL_ASCII        = 0x04
 	_TC_MASK_XML_HTML          = 0x02
@@ -56,8 +64,37 @@ type dictEntry struct {
 
 // TextCodec is a simple one-pass text codec that replaces words with indexes.
 // Uses a default (small) static dictionary. Generates a dynamic dictionary.
+// In retain mode (ctx["textRetain"] = true), the dynamic dictionary of a
+// block seeds the next block. The same instance must then process all the
+// blocks in order (both when encoding and decoding): the compressed streams
+// share one instance between the blocks (see NewStreamTextCodec) and the
+// decoders of stream version 8 cannot decode these blocks (see
+// HasTextExtensions).
+// If ctx["textChunkSize"] (int or uint) is set, blocks bigger than the chunk
+// size are split in chunks, each with its own mode byte, so that the text flags
+// (EG. CR+LF) of a part of a big mixed block do not apply to the whole block.
+// Chunks that are not text are stored as is. The dynamic dictionary carries
+// over from one chunk to the next. The decoders of stream version 8 cannot
+// decode chunked blocks (see HasTextExtensions).
+//
+// Chunked block format: _TC_MASK_CHUNKED (1 byte) + chunks
+// Chunk: header (4 bytes: raw flag (1 bit) + chunk size (31 bits)) + data
+//
+// With ctx["textEscapeRuns"] = true, the second encoding groups the runs of
+// bytes with the high bit set (EG. UTF-8 sequences) under one escape token.
+// The decoders of stream version 8 cannot decode these blocks (see
+// HasTextExtensions).
+//
+// With ctx["textMarkup"] = true, XML/HTML text (or chunk) is first
+// processed by a markup pass: entities and closing tags matching the
+// innermost open tag are replaced with short tokens (see TextMarkup.go)
+// before the words are replaced. The decoders of stream version 8 cannot
+// decode these blocks (see HasTextExtensions).
 type TextCodec struct {
-	delegate kanzi.ByteFunction
+	delegate  kanzi.ByteFunction
+	chunkSize int
+	markup    bool   // apply the markup pass to XML/HTML text
+	buffer    []byte // output of the markup pass
 }
 
 type textCodec1 struct {
@@ -67,7 +104,13 @@ type textCodec1 struct {
 	dictSize       int
 	logHashSize    uint
 	hashMask       int32
-	isCRLF         bool // EOL = CR+LF ?
+	isCRLF         bool            // EOL = CR+LF ?
+	relaxed        bool            // skip crude text detection thresholds
+	dict           *TextDictionary // custom dictionary (nil means default)
+	active         *TextDictionary // dictionary loaded in dictList
+	retain         bool            // dynamic dictionary of a block seeds the next block
+	retained       bool            // dynamic dictionary of the previous block available
+	words          int             // next dynamic dictionary index
 }
 
 type textCodec2 struct {
@@ -77,7 +120,14 @@ type textCodec2 struct {
 	dictSize       int
 	logHashSize    uint
 	hashMask       int32
-	isCRLF         bool // EOL = CR+LF ?
+	isCRLF         bool            // EOL = CR+LF ?
+	relaxed        bool            // skip crude text detection thresholds
+	dict           *TextDictionary // custom dictionary (nil means default)
+	active         *TextDictionary // dictionary loaded in dictList
+	retain         bool            // dynamic dictionary of a block seeds the next block
+	retained       bool            // dynamic dictionary of the previous block available
+	words          int             // next dynamic dictionary index
+	escapeRuns     bool            // group runs of high bit symbols under one escape
 }
 
 var (
@@ -176,7 +226,9 @@ var (
 )
 
 // return 8-bit status (see MASK flags constants)
-func computeStats(block []byte, freqs0 []int32) byte {
+// In relaxed mode, the letter and space thresholds are not enforced (EG.
+// for lists of file names) but the binary data threshold still applies.
+func computeStats(block []byte, freqs0 []int32, relaxed bool) byte {
 	var freqs [256][256]int32
 	freqs1 := freqs[0:256]
 	length := len(block)
@@ -216,7 +268,7 @@ func computeStats(block []byte, freqs0 []int32) byte {
 	}
 
 	// Not text (crude threshold)
-	if 2*nbTextChars < length {
+	if relaxed == false && 2*nbTextChars < length {
 		return _TC_MASK_NOT_TEXT
 	}
 
@@ -232,7 +284,7 @@ func computeStats(block []byte, freqs0 []int32) byte {
 	}
 
 	// Not text (crude threshold)
-	if int(16*freqs0[32]) < length {
+	if relaxed == false && int(16*freqs0[32]) < length {
 		return _TC_MASK_NOT_TEXT
 	}
 
@@ -292,6 +344,38 @@ func computeStats(block []byte, freqs0 []int32) byte {
 	return res
 }
 
+// Copy the words of the dynamic dictionary entries (which point to the block
+// data) to owned memory so that the dictionary remains valid once the block
+// buffers are reused. The hash map entries left pointing to copies of the
+// entries made before a dictionary expansion are redirected to the entries.
+func retainDictWords(dictMap []*dictEntry, entries []dictEntry, hashMask int32) {
+	size := 0
+
+	for i := range entries {
+		if entries[i].ptr != nil {
+			size += int(entries[i].data >> 24)
+		}
+	}
+
+	buf := make([]byte, 0, size)
+
+	for i := range entries {
+		e := &entries[i]
+
+		if e.ptr == nil {
+			continue
+		}
+
+		start := len(buf)
+		buf = append(buf, e.ptr[0:e.data>>24]...)
+		e.ptr = buf[start:len(buf):len(buf)]
+
+		if pe := dictMap[e.hash&hashMask]; pe != nil && pe != e && pe.hash == e.hash && pe.data == e.data {
+			dictMap[e.hash&hashMask] = e
+		}
+	}
+}
+
 func sameWords(buf1, buf2 []byte) bool {
 	for i := range buf1[1:] {
 		if buf1[i] != buf2[i] {
@@ -403,7 +487,7 @@ func isDelimiter(val byte) bool {
 
 // NewTextCodec creates a new instance of TextCodec
 func NewTextCodec() (*TextCodec, error) {
-	this := &TextCodec{}
+	this := new(TextCodec)
 	d, err := newTextCodec1()
 	this.delegate = d
 	return this, err
@@ -414,6 +498,25 @@ func NewTextCodec() (*TextCodec, error) {
 func NewTextCodecWithCtx(ctx *map[string]interface{}) (*TextCodec, error) {
 	this := new(TextCodec)
 
+	if val, containsKey := (*ctx)["textChunkSize"]; containsKey {
+		switch v := val.(type) {
+		case int:
+			this.chunkSize = v
+		case uint:
+			this.chunkSize = int(v)
+		default:
+			return nil, fmt.Errorf("Invalid text chunk size type: %T (must be an int or a uint)", val)
+		}
+
+		if this.chunkSize < _TC_MIN_CHUNK_SIZE || this.chunkSize > _TC_MAX_BLOCK_SIZE {
+			return nil, fmt.Errorf("Invalid text chunk size: %v (must be in [%v..%v])", this.chunkSize, _TC_MIN_CHUNK_SIZE, _TC_MAX_BLOCK_SIZE)
+		}
+	}
+
+	if val, containsKey := (*ctx)["textMarkup"]; containsKey {
+		this.markup = val.(bool)
+	}
+
 	var err error
 	var d kanzi.ByteFunction
 
@@ -442,17 +545,20 @@ func (this *TextCodec) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	if len(src) > _TC_MAX_BLOCK_SIZE {
-		// Not a recoverable error: instead of silently fail the transform,
-		// issue a fatal error.
-		panic(fmt.Errorf("The max text transform block size is %v, got %v", _TC_MAX_BLOCK_SIZE, len(src)))
+		errMsg := fmt.Sprintf("The max text transform block size is %v, got %v", _TC_MAX_BLOCK_SIZE, len(src))
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
 	}
 
-	return this.delegate.Forward(src, dst)
+	if this.chunkSize > 0 && len(src) > this.chunkSize {
+		return this.forwardChunks(src, dst)
+	}
+
+	return this.forwardText(src, dst)
 }
 
 // Inverse applies the reverse function to the src and writes the result
@@ -463,17 +569,239 @@ func (this *TextCodec) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	if len(src) > _TC_MAX_BLOCK_SIZE {
-		// Not a recoverable error: instead of silently fail the transform,
-		// issue a fatal error.
-		panic(fmt.Errorf("The max text transform block size is %v, got %v", _TC_MAX_BLOCK_SIZE, len(src)))
+		errMsg := fmt.Sprintf("The max text transform block size is %v, got %v", _TC_MAX_BLOCK_SIZE, len(src))
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
+	}
+
+	if src[0]&_TC_MASK_CHUNKED != 0 {
+		return this.inverseChunks(src, dst)
+	}
+
+	return this.inverseText(src, dst)
+}
+
+// Apply the markup pass before the delegate if enabled and the text looks
+// like XML/HTML
+func (this *TextCodec) forwardText(src, dst []byte) (uint, uint, error) {
+	if this.markup == true && bytes.IndexByte(src, '<') >= 0 {
+		freqs0 := [256]int32{}
+
+		if computeStats(src, freqs0[:], false)&_TC_MASK_XML_HTML != 0 {
+			if len(this.buffer) < len(src) {
+				this.buffer = make([]byte, len(src))
+			}
+
+			if n := forwardMarkup(src, this.buffer); n > 0 {
+				if _, dstIdx, err := this.delegate.Forward(this.buffer[0:n], dst); err == nil {
+					dst[0] |= _TC_MASK_XML_MARKUP
+					return uint(len(src)), dstIdx, nil
+				}
+			}
+		}
+	}
+
+	return this.delegate.Forward(src, dst)
+}
+
+func (this *TextCodec) inverseText(src, dst []byte) (uint, uint, error) {
+	if src[0]&_TC_MASK_XML_MARKUP != _TC_MASK_XML_MARKUP {
+		return this.delegate.Inverse(src, dst)
+	}
+
+	if len(this.buffer) < len(dst) {
+		this.buffer = make([]byte, len(dst))
+	}
+
+	srcIdx, n, err := this.delegate.Inverse(src, this.buffer)
+
+	if err != nil {
+		return srcIdx, 0, err
+	}
+
+	dstIdx, err := inverseMarkup(this.buffer[0:n], dst)
+	return srcIdx, uint(dstIdx), err
+}
+
+// Return the end of the chunk starting at 'start': cut after the last line
+// feed of the chunk if any (to avoid splitting words and lines)
+func (this *TextCodec) chunkEnd(src []byte, start int) int {
+	end := start + this.chunkSize
+
+	if end >= len(src) {
+		return len(src)
+	}
+
+	for i := end - 1; i > end-this.chunkSize/16; i-- {
+		if src[i] == LF {
+			return i + 1
+		}
+	}
+
+	return end
+}
+
+func (this *TextCodec) forwardChunks(src, dst []byte) (uint, uint, error) {
+	count := len(src)
+
+	if len(dst) < count {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), count))
+	}
+
+	// The dynamic dictionary carries over from one chunk to the next
+	retain := this.setRetain(true)
+
+	defer func() {
+		if retain == false {
+			this.setRetain(false)
+			this.ResetDictionary()
+		}
+	}()
+
+	dst[0] = _TC_MASK_CHUNKED
+	srcIdx := 0
+	dstIdx := 1
+	textChunks := 0
+
+	for srcIdx < count {
+		end := this.chunkEnd(src, srcIdx)
+		size := end - srcIdx
+
+		if dstIdx+4+size > count {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
+		}
+
+		header := uint32(_TC_CHUNK_RAW)
+		chunk := dst[dstIdx+4 : dstIdx+4+size]
+		_, oIdx, err := this.forwardText(src[srcIdx:end], chunk)
+
+		if err == nil {
+			header = uint32(oIdx)
+			textChunks++
+		} else {
+			// Not text (or not compressible): store the chunk as is
+			header |= uint32(copy(chunk, src[srcIdx:end]))
+		}
+
+		binary.BigEndian.PutUint32(dst[dstIdx:], header)
+		dstIdx += 4 + int(header&^_TC_CHUNK_RAW)
+		srcIdx = end
+	}
+
+	if textChunks == 0 {
+		return uint(srcIdx), uint(dstIdx), kanzi.NewNotApplicableError("Input is not text, skipping")
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
+func (this *TextCodec) inverseChunks(src, dst []byte) (uint, uint, error) {
+	retain := this.setRetain(true)
+
+	defer func() {
+		if retain == false {
+			this.setRetain(false)
+			this.ResetDictionary()
+		}
+	}()
+
+	srcIdx := 1
+	dstIdx := 0
+
+	for srcIdx < len(src) {
+		if srcIdx+4 > len(src) {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid text chunk header: missing data")
+		}
+
+		header := binary.BigEndian.Uint32(src[srcIdx:])
+		size := int(header &^ _TC_CHUNK_RAW)
+		srcIdx += 4
+
+		if size == 0 || size > len(src)-srcIdx {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid text chunk size: %v", size))
+		}
+
+		chunk := src[srcIdx : srcIdx+size]
+
+		if header&_TC_CHUNK_RAW != 0 {
+			if size > len(dst)-dstIdx {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
+			}
+
+			dstIdx += copy(dst[dstIdx:], chunk)
+		} else {
+			_, oIdx, err := this.inverseText(chunk, dst[dstIdx:])
+
+			if err != nil {
+				return uint(srcIdx), uint(dstIdx), err
+			}
+
+			dstIdx += int(oIdx)
+		}
+
+		srcIdx += size
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
+// setRetain enables or disables the retain mode of the delegate and returns
+// the previous value
+func (this *TextCodec) setRetain(retain bool) bool {
+	prev := false
+
+	switch d := this.delegate.(type) {
+	case *textCodec1:
+		prev, d.retain = d.retain, retain
+	case *textCodec2:
+		prev, d.retain = d.retain, retain
+	}
+
+	return prev
+}
+
+// IsReusable returns false in retain mode: after a decoding error, the
+// dictionary retained for the next block is not consistent with the encoder
+func (this *TextCodec) IsReusable() bool {
+	switch d := this.delegate.(type) {
+	case *textCodec1:
+		return d.retain == false
+	case *textCodec2:
+		return d.retain == false
+	}
+
+	return true
+}
+
+// IsConcurrentSafe returns false (the dictionaries and buffers are shared
+// by the calls)
+func (this *TextCodec) IsConcurrentSafe() bool {
+	return false
+}
+
+// ResetDictionary discards the dynamic dictionary retained from the previous
+// block (retain mode): the next block starts with a fresh dictionary.
+func (this *TextCodec) ResetDictionary() {
+	switch d := this.delegate.(type) {
+	case *textCodec1:
+		d.retained = false
+	case *textCodec2:
+		d.retained = false
 	}
+}
 
-	return this.delegate.Inverse(src, dst)
+// setRelaxed disables the letter and space thresholds used to detect text
+func (this *TextCodec) setRelaxed(relaxed bool) {
+	switch d := this.delegate.(type) {
+	case *textCodec1:
+		d.relaxed = relaxed
+	case *textCodec2:
+		d.relaxed = relaxed
+	}
 }
 
 // MaxEncodedLen returns the max size required for the encoding output buffer
@@ -481,6 +809,34 @@ func (this *TextCodec) MaxEncodedLen(srcLen int) int {
 	return this.delegate.MaxEncodedLen(srcLen)
 }
 
+// MaxTextBlockSize returns the maximum size of a block to transform
+func MaxTextBlockSize() int {
+	return _TC_MAX_BLOCK_SIZE
+}
+
+// HasTextExtensions returns true if the text codec of the provided function
+// type (TEXT or META transform) may emit blocks with the extensions selected
+// by the map ("textEscapeRuns", "textMarkup", "textRetain" and "textChunkSize"
+// entries). The decoders of stream version 8 cannot decode these blocks.
+func HasTextExtensions(ctx map[string]interface{}, functionType uint64) bool {
+	escapeRuns, _ := ctx["textEscapeRuns"].(bool)
+	markup, _ := ctx["textMarkup"].(bool)
+	retain, _ := ctx["textRetain"].(bool)
+	_, chunks := ctx["textChunkSize"]
+
+	if escapeRuns == false && markup == false && retain == false && chunks == false {
+		return false
+	}
+
+	for _, t := range GetTypes(functionType) {
+		if t == DICT_TYPE || t == META_TYPE {
+			return true
+		}
+	}
+
+	return false
+}
+
 func newTextCodec1() (*textCodec1, error) {
 	this := new(textCodec1)
 	this.logHashSize = _TC_LOG_HASHES_SIZE
@@ -534,10 +890,16 @@ func newTextCodec1WithCtx(ctx *map[string]interface{}) (*textCodec1, error) {
 	this.dictList = make([]dictEntry, 0)
 	this.hashMask = int32(1<<this.logHashSize) - 1
 	this.staticDictSize = _TC_STATIC_DICT_WORDS
+	this.dict = textDictionaryFromCtx(ctx)
+
+	if val, containsKey := (*ctx)["textRetain"]; containsKey {
+		this.retain = val.(bool)
+	}
+
 	return this, nil
 }
 
-func (this *textCodec1) reset() {
+func (this *textCodec1) reset(dict *TextDictionary) {
 	// Allocate lazily (only if text input detected)
 	if len(this.dictMap) == 0 {
 		this.dictMap = make([]*dictEntry, 1<<this.logHashSize)
@@ -547,20 +909,26 @@ func (this *textCodec1) reset() {
 		}
 	}
 
-	if len(this.dictList) == 0 {
-		this.dictList = make([]dictEntry, this.dictSize)
-		size := len(_TC_STATIC_DICTIONARY)
+	if len(this.dictList) == 0 || dict != this.active {
+		static := staticDictEntries(dict)
+		nbWords := len(static)
 
-		if size >= this.dictSize {
-			size = this.dictSize
+		// Keep room for the dynamic entries
+		for this.dictSize < 2*(nbWords+2) {
+			this.dictSize <<= 1
 		}
 
-		copy(this.dictList, _TC_STATIC_DICTIONARY[0:size])
+		if len(this.dictList) < this.dictSize {
+			this.dictList = make([]dictEntry, this.dictSize)
+		}
+
+		copy(this.dictList, static)
 
 		// Add special entries at end of static dictionary
-		this.dictList[_TC_STATIC_DICT_WORDS] = dictEntry{ptr: []byte{_TC_ESCAPE_TOKEN2}, hash: 0, data: int32((1 << 24) | (_TC_STATIC_DICT_WORDS))}
-		this.dictList[_TC_STATIC_DICT_WORDS+1] = dictEntry{ptr: []byte{_TC_ESCAPE_TOKEN1}, hash: 0, data: int32((1 << 24) | (_TC_STATIC_DICT_WORDS + 1))}
-		this.staticDictSize = _TC_STATIC_DICT_WORDS + 2
+		this.dictList[nbWords] = dictEntry{ptr: []byte{_TC_ESCAPE_TOKEN2}, hash: 0, data: int32((1 << 24) | nbWords)}
+		this.dictList[nbWords+1] = dictEntry{ptr: []byte{_TC_ESCAPE_TOKEN1}, hash: 0, data: int32((1 << 24) | (nbWords + 1))}
+		this.staticDictSize = nbWords + 2
+		this.active = dict
 	}
 
 	// Update map
@@ -579,29 +947,49 @@ func (this *textCodec1) Forward(src, dst []byte) (uint, uint, error) {
 	count := len(src)
 
 	if n := this.MaxEncodedLen(count); len(dst) < n {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
 	srcIdx := 0
 	dstIdx := 0
 	freqs0 := [256]int32{}
-	mode := computeStats(src[0:count], freqs0[:])
+	mode := computeStats(src[0:count], freqs0[:], this.relaxed)
 
 	// Not text ?
 	if mode&_TC_MASK_NOT_TEXT != 0 {
-		return uint(srcIdx), uint(dstIdx), errors.New("Input is not text, skipping")
+		return uint(srcIdx), uint(dstIdx), kanzi.NewNotApplicableError("Input is not text, skipping")
+	}
+
+	if 1+textDictHeaderSize(this.dict) >= count {
+		return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
+	}
+
+	// Continue with the dynamic dictionary of the previous block if possible
+	retained := this.retain == true && this.retained == true && this.dict == this.active
+	this.retained = false
+
+	if retained == false {
+		this.reset(this.dict)
+		this.words = this.staticDictSize
 	}
 
-	this.reset()
 	srcEnd := count
 	dstEnd := this.MaxEncodedLen(count)
 	dstEnd4 := dstEnd - 4
 	emitAnchor := 0 // never negative
-	words := this.staticDictSize
+	words := this.words
 
 	// DOS encoded end of line (CR+LF) ?
 	this.isCRLF = mode&_TC_MASK_CRLF != 0
-	dst[dstIdx] = mode
+
+	if retained == true {
+		// The dictionary of the previous block applies: no dictionary header
+		mode |= _TC_MASK_RETAINED
+	} else {
+		mode, dstIdx = writeTextDictHeader(this.dict, mode, dst[1:])
+	}
+
+	dst[0] = mode
 	dstIdx++
 	var err error
 
@@ -701,7 +1089,7 @@ func (this *textCodec1) Forward(src, dst []byte) (uint, uint, error) {
 						dIdx := this.emitSymbols(src[emitAnchor:delimAnchor+1], dst[dstIdx:dstEnd])
 
 						if dIdx < 0 {
-							err = errors.New("Text transform failed. Output buffer too small")
+							err = kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
 							break
 						}
 
@@ -709,7 +1097,7 @@ func (this *textCodec1) Forward(src, dst []byte) (uint, uint, error) {
 					}
 
 					if dstIdx >= dstEnd4 {
-						err = errors.New("Text transform failed. Output buffer too small")
+						err = kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
 						break
 					}
 
@@ -736,19 +1124,30 @@ func (this *textCodec1) Forward(src, dst []byte) (uint, uint, error) {
 		dIdx := this.emitSymbols(src[emitAnchor:srcEnd], dst[dstIdx:dstEnd])
 
 		if dIdx < 0 {
-			err = errors.New("Text transform failed. Output buffer too small")
+			err = kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
 		} else {
 			dstIdx += dIdx
 		}
 	}
 
 	if err == nil && srcIdx != srcEnd {
-		err = fmt.Errorf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd)
+		err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd))
+	}
+
+	if err == nil && this.retain == true {
+		this.retainWords(words)
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
 }
 
+// Keep the dynamic dictionary to seed the next block
+func (this *textCodec1) retainWords(words int) {
+	retainDictWords(this.dictMap, this.dictList[this.staticDictSize:this.dictSize], this.hashMask)
+	this.words = words
+	this.retained = true
+}
+
 func (this *textCodec1) expandDictionary() bool {
 	if this.dictSize >= _TC_MAX_DICT_SIZE {
 		return false
@@ -838,7 +1237,23 @@ func emitWordIndex1(dst []byte, val int) int {
 func (this *textCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 	srcIdx := 0
 	dstIdx := 0
-	this.reset()
+	dict, hdrSize, dErr := readTextDictHeader(src, this.active, this.dict)
+
+	if dErr != nil {
+		return 0, 0, dErr
+	}
+
+	if src[0]&_TC_MASK_RETAINED == _TC_MASK_RETAINED {
+		// The block continues the dynamic dictionary of the previous block
+		if this.retained == false || dict != this.active {
+			return 0, 0, errors.New("Text transform failed: the dictionary of the previous block is not available")
+		}
+	} else {
+		this.reset(dict)
+		this.words = this.staticDictSize
+	}
+
+	this.retained = false
 	srcEnd := len(src)
 	dstEnd := len(dst)
 	var delimAnchor int // previous delimiter
@@ -849,11 +1264,11 @@ func (this *textCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 		delimAnchor = srcIdx
 	}
 
-	words := this.staticDictSize
+	words := this.words
 	wordRun := false
 	err := error(nil)
 	this.isCRLF = src[srcIdx]&_TC_MASK_CRLF != 0
-	srcIdx++
+	srcIdx += hdrSize
 
 	for srcIdx < srcEnd && dstIdx < dstEnd {
 		cur := src[srcIdx]
@@ -933,7 +1348,7 @@ func (this *textCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 				idx = (idx << 7) | (idx2 & 0x7F)
 
 				if idx >= this.dictSize {
-					err = fmt.Errorf("Text transform failed. Invalid index")
+					err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Invalid index"))
 					break
 				}
 			}
@@ -943,7 +1358,7 @@ func (this *textCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 
 			// Sanity check
 			if pe.ptr == nil || length > _TC_MAX_WORD_LENGTH || dstIdx+length >= dstEnd {
-				err = fmt.Errorf("Text transform failed. Invalid input data")
+				err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Invalid input data"))
 				break
 			}
 
@@ -987,7 +1402,11 @@ func (this *textCodec1) Inverse(src, dst []byte) (uint, uint, error) {
 	}
 
 	if err == nil && srcIdx != srcEnd {
-		err = fmt.Errorf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd)
+		err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd))
+	}
+
+	if err == nil && this.retain == true {
+		this.retainWords(words)
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
@@ -1052,10 +1471,20 @@ func newTextCodec2WithCtx(ctx *map[string]interface{}) (*textCodec2, error) {
 	this.dictList = make([]dictEntry, 0)
 	this.hashMask = int32(1<<this.logHashSize) - 1
 	this.staticDictSize = _TC_STATIC_DICT_WORDS
+	this.dict = textDictionaryFromCtx(ctx)
+
+	if val, containsKey := (*ctx)["textRetain"]; containsKey {
+		this.retain = val.(bool)
+	}
+
+	if val, containsKey := (*ctx)["textEscapeRuns"]; containsKey {
+		this.escapeRuns = val.(bool)
+	}
+
 	return this, nil
 }
 
-func (this *textCodec2) reset() {
+func (this *textCodec2) reset(dict *TextDictionary) {
 	// Allocate lazily (only if text input detected)
 	if len(this.dictMap) == 0 {
 		this.dictMap = make([]*dictEntry, 1<<this.logHashSize)
@@ -1065,15 +1494,21 @@ func (this *textCodec2) reset() {
 		}
 	}
 
-	if len(this.dictList) == 0 {
-		this.dictList = make([]dictEntry, this.dictSize)
-		size := len(_TC_STATIC_DICTIONARY)
+	if len(this.dictList) == 0 || dict != this.active {
+		static := staticDictEntries(dict)
+
+		// Keep room for the dynamic entries
+		for this.dictSize < 2*len(static) {
+			this.dictSize <<= 1
+		}
 
-		if size >= this.dictSize {
-			size = this.dictSize
+		if len(this.dictList) < this.dictSize {
+			this.dictList = make([]dictEntry, this.dictSize)
 		}
 
-		copy(this.dictList, _TC_STATIC_DICTIONARY[0:size])
+		copy(this.dictList, static)
+		this.staticDictSize = len(static)
+		this.active = dict
 	}
 
 	// Update map
@@ -1092,29 +1527,49 @@ func (this *textCodec2) Forward(src, dst []byte) (uint, uint, error) {
 	count := len(src)
 
 	if n := this.MaxEncodedLen(count); len(dst) < n {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
 	srcIdx := 0
 	dstIdx := 0
 	freqs0 := [256]int32{}
-	mode := computeStats(src[0:count], freqs0[:])
+	mode := computeStats(src[0:count], freqs0[:], this.relaxed)
 
 	// Not text ?
 	if mode&_TC_MASK_NOT_TEXT != 0 {
-		return uint(srcIdx), uint(dstIdx), errors.New("Input is not text, skipping")
+		return uint(srcIdx), uint(dstIdx), kanzi.NewNotApplicableError("Input is not text, skipping")
+	}
+
+	if 1+textDictHeaderSize(this.dict) >= count {
+		return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
+	}
+
+	// Continue with the dynamic dictionary of the previous block if possible
+	retained := this.retain == true && this.retained == true && this.dict == this.active
+	this.retained = false
+
+	if retained == false {
+		this.reset(this.dict)
+		this.words = this.staticDictSize
 	}
 
-	this.reset()
 	srcEnd := count
 	dstEnd := this.MaxEncodedLen(count)
 	dstEnd3 := dstEnd - 3
 	emitAnchor := 0 // never negative
-	words := this.staticDictSize
+	words := this.words
 
 	// DOS encoded end of line (CR+LF) ?
 	this.isCRLF = mode&_TC_MASK_CRLF != 0
-	dst[dstIdx] = mode
+
+	if retained == true {
+		// The dictionary of the previous block applies: no dictionary header
+		mode |= _TC_MASK_RETAINED
+	} else {
+		mode, dstIdx = writeTextDictHeader(this.dict, mode, dst[1:])
+	}
+
+	dst[0] = mode
 	dstIdx++
 	var err error
 
@@ -1215,7 +1670,7 @@ func (this *textCodec2) Forward(src, dst []byte) (uint, uint, error) {
 						dIdx := this.emitSymbols(src[emitAnchor:delimAnchor+1], dst[dstIdx:dstEnd])
 
 						if dIdx < 0 {
-							err = errors.New("Text transform failed. Output buffer too small")
+							err = kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
 							break
 						}
 
@@ -1223,7 +1678,7 @@ func (this *textCodec2) Forward(src, dst []byte) (uint, uint, error) {
 					}
 
 					if dstIdx >= dstEnd3 {
-						err = errors.New("Text transform failed. Output buffer too small")
+						err = kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
 						break
 					}
 
@@ -1248,19 +1703,30 @@ func (this *textCodec2) Forward(src, dst []byte) (uint, uint, error) {
 		dIdx := this.emitSymbols(src[emitAnchor:srcEnd], dst[dstIdx:dstEnd])
 
 		if dIdx < 0 {
-			err = errors.New("Text transform failed. Output buffer too small")
+			err = kanzi.NewOutputTooSmallError("Text transform failed. Output buffer too small")
 		} else {
 			dstIdx += dIdx
 		}
 	}
 
 	if err == nil && srcIdx != srcEnd {
-		err = fmt.Errorf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd)
+		err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd))
+	}
+
+	if err == nil && this.retain == true {
+		this.retainWords(words)
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
 }
 
+// Keep the dynamic dictionary to seed the next block
+func (this *textCodec2) retainWords(words int) {
+	retainDictWords(this.dictMap, this.dictList[this.staticDictSize:this.dictSize], this.hashMask)
+	this.words = words
+	this.retained = true
+}
+
 func (this *textCodec2) expandDictionary() bool {
 	if this.dictSize >= _TC_MAX_DICT_SIZE {
 		return false
@@ -1276,11 +1742,34 @@ func (this *textCodec2) expandDictionary() bool {
 	return true
 }
 
+// Length of the run of bytes with the high bit set starting at src[0]
+func highBitRunLength(src []byte) int {
+	n := 0
+
+	for n < len(src) && n < _TC_MAX_ESCAPE_RUN && src[n] >= 0x80 {
+		n++
+	}
+
+	return n
+}
+
+// Length of the run of bytes with high bit set to group under one escape
+// (0 unless the escape runs are enabled)
+func (this *textCodec2) escapeRun(src []byte) int {
+	if this.escapeRuns == false {
+		return 0
+	}
+
+	return highBitRunLength(src)
+}
+
 func (this *textCodec2) emitSymbols(src, dst []byte) int {
 	dstIdx := 0
 
 	if 2*len(src) < len(dst) {
-		for _, cur := range src {
+		for i := 0; i < len(src); i++ {
+			cur := src[i]
+
 			switch cur {
 			case _TC_ESCAPE_TOKEN1:
 				dst[dstIdx] = _TC_ESCAPE_TOKEN1
@@ -1298,6 +1787,15 @@ func (this *textCodec2) emitSymbols(src, dst []byte) int {
 				if cur >= 0x80 {
 					dst[dstIdx] = _TC_ESCAPE_TOKEN1
 					dstIdx++
+
+					// Group runs of bytes with high bit set (EG. UTF-8 sequences)
+					if run := this.escapeRun(src[i:]); run >= _TC_MIN_ESCAPE_RUN {
+						dst[dstIdx] = byte(_TC_ESCAPE_RUN_BASE + run - _TC_MIN_ESCAPE_RUN)
+						dstIdx++
+						dstIdx += copy(dst[dstIdx:], src[i:i+run])
+						i += run - 1
+						continue
+					}
 				}
 
 				dst[dstIdx] = cur
@@ -1305,7 +1803,9 @@ func (this *textCodec2) emitSymbols(src, dst []byte) int {
 			}
 		}
 	} else {
-		for _, cur := range src {
+		for i := 0; i < len(src); i++ {
+			cur := src[i]
+
 			switch cur {
 			case _TC_ESCAPE_TOKEN1:
 				if dstIdx+1 >= len(dst) {
@@ -1335,6 +1835,19 @@ func (this *textCodec2) emitSymbols(src, dst []byte) int {
 
 					dst[dstIdx] = _TC_ESCAPE_TOKEN1
 					dstIdx++
+
+					// Group runs of bytes with high bit set (EG. UTF-8 sequences)
+					if run := this.escapeRun(src[i:]); run >= _TC_MIN_ESCAPE_RUN {
+						if dstIdx+run >= len(dst) {
+							return -1
+						}
+
+						dst[dstIdx] = byte(_TC_ESCAPE_RUN_BASE + run - _TC_MIN_ESCAPE_RUN)
+						dstIdx++
+						dstIdx += copy(dst[dstIdx:], src[i:i+run])
+						i += run - 1
+						continue
+					}
 				}
 
 				if dstIdx >= len(dst) {
@@ -1376,7 +1889,23 @@ func emitWordIndex2(dst []byte, val, mask int) int {
 func (this *textCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 	srcIdx := 0
 	dstIdx := 0
-	this.reset()
+	dict, hdrSize, dErr := readTextDictHeader(src, this.active, this.dict)
+
+	if dErr != nil {
+		return 0, 0, dErr
+	}
+
+	if src[0]&_TC_MASK_RETAINED == _TC_MASK_RETAINED {
+		// The block continues the dynamic dictionary of the previous block
+		if this.retained == false || dict != this.active {
+			return 0, 0, errors.New("Text transform failed: the dictionary of the previous block is not available")
+		}
+	} else {
+		this.reset(dict)
+		this.words = this.staticDictSize
+	}
+
+	this.retained = false
 	srcEnd := len(src)
 	dstEnd := len(dst)
 	var delimAnchor int // previous delimiter
@@ -1387,11 +1916,11 @@ func (this *textCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 		delimAnchor = srcIdx
 	}
 
-	words := this.staticDictSize
+	words := this.words
 	wordRun := false
 	err := error(nil)
 	this.isCRLF = src[srcIdx]&_TC_MASK_CRLF != 0
-	srcIdx++
+	srcIdx += hdrSize
 
 	for srcIdx < srcEnd && dstIdx < dstEnd {
 		cur := src[srcIdx]
@@ -1469,7 +1998,7 @@ func (this *textCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 				idx = (idx << 7) | (idx2 & 0x7F)
 
 				if idx >= this.dictSize {
-					err = fmt.Errorf("Text transform failed. Invalid index")
+					err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Invalid index"))
 					break
 				}
 			}
@@ -1479,7 +2008,7 @@ func (this *textCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 
 			// Sanity check
 			if pe.ptr == nil || length > _TC_MAX_WORD_LENGTH || dstIdx+length >= dstEnd {
-				err = fmt.Errorf("Text transform failed. Invalid input data")
+				err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Invalid input data"))
 				break
 			}
 
@@ -1510,9 +2039,31 @@ func (this *textCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 			}
 		} else {
 			if cur == _TC_ESCAPE_TOKEN1 {
-				dst[dstIdx] = src[srcIdx]
+				if srcIdx >= srcEnd {
+					err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Invalid input data"))
+					break
+				}
+
+				val := src[srcIdx]
 				srcIdx++
-				dstIdx++
+
+				if val == _TC_ESCAPE_TOKEN1 || val >= 0x80 {
+					// Single escaped symbol
+					dst[dstIdx] = val
+					dstIdx++
+				} else {
+					// Run of symbols with high bit set
+					run := int(val) - _TC_ESCAPE_RUN_BASE + _TC_MIN_ESCAPE_RUN
+
+					if val < _TC_ESCAPE_RUN_BASE || srcIdx+run > srcEnd || dstIdx+run > dstEnd {
+						err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Invalid input data"))
+						break
+					}
+
+					copy(dst[dstIdx:], src[srcIdx:srcIdx+run])
+					srcIdx += run
+					dstIdx += run
+				}
 			} else {
 				if (this.isCRLF == true) && (cur == LF) {
 					dst[dstIdx] = CR
@@ -1529,7 +2080,11 @@ func (this *textCodec2) Inverse(src, dst []byte) (uint, uint, error) {
 	}
 
 	if err == nil && srcIdx != srcEnd {
-		err = fmt.Errorf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd)
+		err = kanzi.NewCorruptStreamError(fmt.Sprintf("Text transform failed. Source index: %v, expected: %v", srcIdx, srcEnd))
+	}
+
+	if err == nil && this.retain == true {
+		this.retainWords(words)
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
@@ -0,0 +1,362 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	khash "github.com/flanglet/kanzi-go/util/hash"
+)
+
+const (
+	_TC_MASK_DICT_REF      = 0x10 // custom dictionary referenced by id (4 bytes)
+	_TC_MASK_DICT_EMBEDDED = 0x20 // custom dictionary serialized in the block
+	_TC_MASK_RETAINED      = 0x30 // both flags: dynamic dictionary of the previous block retained (no dictionary header)
+	_TC_MAX_USER_WORDS     = 1 << 14
+	_TC_DICT_FLAG_EXTEND   = 0x01
+)
+
+// TextDictionary a list of words used by the text codec instead of (or in
+// addition to) the default English dictionary (EG. log tokens, JSON keys or
+// source code identifiers).
+// Only words made of 2 to 31 ASCII letters can be matched by the text codec.
+// The first letter is case insensitive, the other letters are case sensitive.
+//
+// A block encoded with a custom dictionary either embeds the serialized
+// dictionary or references it by id. In the latter case, the dictionary
+// must be provided to the decoder (ctx["textDictionary"]) or registered
+// (see RegisterTextDictionary) before decoding.
+type TextDictionary struct {
+	id      uint32
+	data    []byte // serialized dictionary: flags + words separated by spaces
+	entries []dictEntry
+	embed   bool
+}
+
+var (
+	_TC_DICTIONARIES     = make(map[uint32]*TextDictionary)
+	_TC_DICTIONARIES_MTX sync.RWMutex
+)
+
+// NewTextDictionary creates a new instance of TextDictionary. If extend is
+// true, the words are added to the default English dictionary, otherwise
+// they replace it. If embed is true, the dictionary is serialized in each
+// block (no registration needed to decode), otherwise only the dictionary
+// id is emitted.
+func NewTextDictionary(words [][]byte, extend, embed bool) (*TextDictionary, error) {
+	data := make([]byte, 1, 1024)
+
+	if extend == true {
+		data[0] = _TC_DICT_FLAG_EXTEND
+	}
+
+	seen := make(map[string]bool, len(words))
+
+	for _, w := range words {
+		if len(w) < 2 || len(w) > _TC_MAX_WORD_LENGTH {
+			return nil, fmt.Errorf("Invalid dictionary word '%s': length must be in [2..%d]", w, _TC_MAX_WORD_LENGTH)
+		}
+
+		for _, c := range w {
+			if isText(c) == false {
+				return nil, fmt.Errorf("Invalid dictionary word '%s': only ASCII letters are allowed", w)
+			}
+		}
+
+		// The first letter is stored in lower case (case handled by the codec)
+		key := string(w[0]|0x20) + string(w[1:])
+
+		if seen[key] == true {
+			continue
+		}
+
+		seen[key] = true
+
+		if len(data) > 1 {
+			data = append(data, ' ')
+		}
+
+		data = append(data, key...)
+	}
+
+	if len(seen) == 0 {
+		return nil, errors.New("Invalid empty text dictionary")
+	}
+
+	this, err := decodeTextDictionary(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.embed = embed
+	return this, nil
+}
+
+// LoadTextDictionary creates a new instance of TextDictionary from a
+// serialized dictionary (see Bytes). The embed flag has the same meaning
+// as for NewTextDictionary.
+func LoadTextDictionary(data []byte, embed bool) (*TextDictionary, error) {
+	// Copy: the entries reference the serialized dictionary
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	this, err := decodeTextDictionary(buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.embed = embed
+	return this, nil
+}
+
+// Build the dictionary entries from the serialized dictionary
+func decodeTextDictionary(data []byte) (*TextDictionary, error) {
+	if len(data) < 3 || data[0]&^_TC_DICT_FLAG_EXTEND != 0 {
+		return nil, errors.New("Invalid text dictionary data")
+	}
+
+	this := &TextDictionary{}
+	this.data = data
+	hasher, _ := khash.NewXXHash32(0)
+	this.id = hasher.Hash(data)
+	nbWords := 0
+	this.entries = make([]dictEntry, 0, len(data)/4+_TC_STATIC_DICT_WORDS)
+
+	for anchor := 1; anchor < len(data); {
+		end := anchor
+
+		for end < len(data) && data[end] != ' ' {
+			end++
+		}
+
+		length := end - anchor
+
+		if length < 2 || length > _TC_MAX_WORD_LENGTH || nbWords >= _TC_MAX_USER_WORDS-_TC_STATIC_DICT_WORDS {
+			return nil, errors.New("Invalid text dictionary data")
+		}
+
+		h := _TC_HASH1
+
+		for _, c := range data[anchor:end] {
+			if isText(c) == false {
+				return nil, errors.New("Invalid text dictionary data")
+			}
+
+			h = h*_TC_HASH1 ^ int32(c)*_TC_HASH2
+		}
+
+		this.entries = append(this.entries, dictEntry{ptr: data[anchor:], hash: h, data: int32((length << 24) | nbWords)})
+		nbWords++
+		anchor = end + 1
+	}
+
+	// The default words follow the custom words (which get the smallest
+	// indexes). Skip the default words overridden by custom words.
+	if data[0]&_TC_DICT_FLAG_EXTEND != 0 {
+		custom := make(map[int32]bool, nbWords)
+
+		for _, e := range this.entries {
+			custom[e.hash] = true
+		}
+
+		for _, e := range _TC_STATIC_DICTIONARY[0:_TC_STATIC_DICT_WORDS] {
+			if custom[e.hash] == true {
+				continue
+			}
+
+			e.data = (e.data &^ _TC_MASK_LENGTH) | int32(nbWords)
+			this.entries = append(this.entries, e)
+			nbWords++
+		}
+	}
+
+	return this, nil
+}
+
+// ID returns the identifier of the dictionary (hash of its content)
+func (this *TextDictionary) ID() uint32 {
+	return this.id
+}
+
+// Bytes returns the serialized dictionary (EG. to save it). The slice must
+// not be modified.
+func (this *TextDictionary) Bytes() []byte {
+	return this.data
+}
+
+// Len returns the number of words in the dictionary (including the words
+// of the default dictionary if it is extended)
+func (this *TextDictionary) Len() int {
+	return len(this.entries)
+}
+
+// RegisterTextDictionary makes a dictionary available to the text decoders
+// (needed to decode blocks that reference the dictionary by id)
+func RegisterTextDictionary(dict *TextDictionary) error {
+	if dict == nil {
+		return errors.New("Invalid null text dictionary")
+	}
+
+	_TC_DICTIONARIES_MTX.Lock()
+	defer _TC_DICTIONARIES_MTX.Unlock()
+	_TC_DICTIONARIES[dict.id] = dict
+	return nil
+}
+
+// GetTextDictionary returns the registered dictionary with the provided id
+// or nil
+func GetTextDictionary(id uint32) *TextDictionary {
+	_TC_DICTIONARIES_MTX.RLock()
+	defer _TC_DICTIONARIES_MTX.RUnlock()
+	return _TC_DICTIONARIES[id]
+}
+
+// NewTextCodecWithDictionary creates a new instance of TextCodec (type 1)
+// using a custom dictionary
+func NewTextCodecWithDictionary(dict *TextDictionary) (*TextCodec, error) {
+	ctx := map[string]interface{}{"textDictionary": dict}
+	return NewTextCodecWithCtx(&ctx)
+}
+
+// DefaultDictionaryWords returns a copy of the words of the default static
+// dictionary (lower case English words, most frequent first)
+func DefaultDictionaryWords() [][]byte {
+	res := make([][]byte, _TC_STATIC_DICT_WORDS)
+
+	for i, e := range _TC_STATIC_DICTIONARY[0:_TC_STATIC_DICT_WORDS] {
+		length := int(e.data >> 24)
+		res[i] = make([]byte, length)
+		copy(res[i], e.ptr[0:length])
+	}
+
+	return res
+}
+
+// Return the custom dictionary in the context (if any)
+func textDictionaryFromCtx(ctx *map[string]interface{}) *TextDictionary {
+	if val, containsKey := (*ctx)["textDictionary"]; containsKey {
+		if dict, ok := val.(*TextDictionary); ok == true {
+			return dict
+		}
+	}
+
+	return nil
+}
+
+// Return the entries of the static part of the dictionary
+func staticDictEntries(dict *TextDictionary) []dictEntry {
+	if dict == nil {
+		return _TC_STATIC_DICTIONARY[0:_TC_STATIC_DICT_WORDS]
+	}
+
+	return dict.entries
+}
+
+// Size of the dictionary header following the mode byte
+func textDictHeaderSize(dict *TextDictionary) int {
+	if dict == nil {
+		return 0
+	}
+
+	if dict.embed == true {
+		return 4 + len(dict.data)
+	}
+
+	return 4
+}
+
+// Write the dictionary header after the mode byte. Returns the updated mode
+// and the number of bytes written
+func writeTextDictHeader(dict *TextDictionary, mode byte, dst []byte) (byte, int) {
+	if dict == nil {
+		return mode, 0
+	}
+
+	if dict.embed == true {
+		binary.BigEndian.PutUint32(dst, uint32(len(dict.data)))
+		return mode | _TC_MASK_DICT_EMBEDDED, 4 + copy(dst[4:], dict.data)
+	}
+
+	binary.BigEndian.PutUint32(dst, dict.id)
+	return mode | _TC_MASK_DICT_REF, 4
+}
+
+// Read the dictionary header after the mode byte (src[0]). Returns the
+// dictionary (nil for the default one) and the size of the header
+// (mode byte included). A dictionary referenced by id is looked up in the
+// current dictionary, the dictionary of the context then the registered
+// dictionaries. A block retaining the dynamic dictionary of the previous
+// block (both flags set) has no dictionary header: the current dictionary
+// applies.
+func readTextDictHeader(src []byte, current, provided *TextDictionary) (*TextDictionary, int, error) {
+	mode := src[0]
+
+	if mode&(_TC_MASK_DICT_REF|_TC_MASK_DICT_EMBEDDED) == 0 {
+		return nil, 1, nil
+	}
+
+	if mode&_TC_MASK_RETAINED == _TC_MASK_RETAINED {
+		return current, 1, nil
+	}
+
+	if len(src) < 5 {
+		return nil, 0, kanzi.NewCorruptStreamError("Text transform failed: invalid dictionary header")
+	}
+
+	val := binary.BigEndian.Uint32(src[1:5])
+
+	if mode&_TC_MASK_DICT_EMBEDDED != 0 {
+		if uint64(val) > uint64(len(src)-5) {
+			return nil, 0, kanzi.NewCorruptStreamError("Text transform failed: invalid embedded dictionary size")
+		}
+
+		data := src[5 : 5+val]
+
+		if current != nil && current.embed == true && string(current.data) == string(data) {
+			return current, 5 + int(val), nil
+		}
+
+		// Copy: the source buffer may be reused by the caller
+		buf := make([]byte, len(data))
+		copy(buf, data)
+		dict, err := decodeTextDictionary(buf)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return dict, 5 + int(val), nil
+	}
+
+	if current != nil && current.id == val {
+		return current, 5, nil
+	}
+
+	if provided != nil && provided.id == val {
+		return provided, 5, nil
+	}
+
+	if dict := GetTextDictionary(val); dict != nil {
+		return dict, 5, nil
+	}
+
+	return nil, 0, fmt.Errorf("Text transform failed: unknown dictionary id %x (not registered)", val)
+}
@@ -0,0 +1,316 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"bytes"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	// Mode byte of a block processed by the markup pass. The full ASCII and
+	// almost full ASCII flags are exclusive, so the combination is free.
+	_TC_MASK_XML_MARKUP = _TC_MASK_FULL_ASCII | _TC_MASK_ALMOST_FULL_ASCII
+
+	_TC_MARKUP_MAX_NAME  = 32
+	_TC_MARKUP_MAX_DEPTH = 256
+
+	// States of the tag tracker
+	_TC_MARKUP_TEXT       = 0
+	_TC_MARKUP_TAG_START  = 1 // after '<'
+	_TC_MARKUP_OPEN_NAME  = 2 // name of an opening tag
+	_TC_MARKUP_ATTRIBUTES = 3 // attributes of an opening tag
+	_TC_MARKUP_CLOSE_NAME = 4 // name of a closing tag
+	_TC_MARKUP_SKIP       = 5 // comment, declaration or processing instruction
+)
+
+var (
+	// Entities replaced with '&', the index of the entity and ';' (in this order)
+	_TC_MARKUP_ENTITIES = [][]byte{[]byte("&amp;"), []byte("&lt;"), []byte("&gt;"),
+		[]byte("&quot;"), []byte("&apos;"), []byte("&nbsp;"), []byte("&#39;")}
+
+	// Closing tag matching the innermost open tag
+	_TC_MARKUP_CLOSE_TAG = []byte("</>")
+)
+
+// Markup pass format: text where a closing tag matching the innermost open
+// tag (EG. </div>) is replaced with "</>" and an entity (EG. &amp;) with '&',
+// the index of the entity (one digit) and ';'. The tokens are made of word
+// delimiters so that the text codecs still see the same words. The pass is
+// only applied to blocks without such sequences. The decoder tracks the open
+// tags in the decoded text the same way as the encoder.
+
+// markupTracker tracks the stack of open XML/HTML tags in a text fed byte by
+// byte. Unclosed tags (EG. HTML void elements) are popped by the closing tag
+// of an enclosing element.
+type markupTracker struct {
+	stack     [][]byte
+	name      []byte
+	state     int
+	quote     byte
+	prev      byte
+	truncated bool
+}
+
+func newMarkupTracker() *markupTracker {
+	return &markupTracker{stack: make([][]byte, 0, 16), name: make([]byte, 0, _TC_MARKUP_MAX_NAME)}
+}
+
+func isMarkupNameByte(c byte) bool {
+	return isText(c) || (c >= '0' && c <= '9') || c == '_' || c == ':' || c == '-' || c == '.'
+}
+
+// Return the innermost open tag (or nil)
+func (this *markupTracker) top() []byte {
+	if len(this.stack) == 0 {
+		return nil
+	}
+
+	return this.stack[len(this.stack)-1]
+}
+
+func (this *markupTracker) push() {
+	if this.truncated == false && len(this.stack) < _TC_MARKUP_MAX_DEPTH {
+		name := make([]byte, len(this.name))
+		copy(name, this.name)
+		this.stack = append(this.stack, name)
+	}
+}
+
+func (this *markupTracker) pop() {
+	for i := len(this.stack) - 1; i >= 0; i-- {
+		if bytes.Equal(this.stack[i], this.name) {
+			this.stack = this.stack[0:i]
+			return
+		}
+	}
+}
+
+func (this *markupTracker) addNameByte(c byte) {
+	if len(this.name) < _TC_MARKUP_MAX_NAME {
+		this.name = append(this.name, c)
+	} else {
+		this.truncated = true
+	}
+}
+
+func (this *markupTracker) feed(text []byte) {
+	for _, c := range text {
+		switch this.state {
+		case _TC_MARKUP_TEXT:
+			if c == '<' {
+				this.state = _TC_MARKUP_TAG_START
+				this.name = this.name[:0]
+				this.truncated = false
+			}
+
+		case _TC_MARKUP_TAG_START:
+			if c == '/' {
+				this.state = _TC_MARKUP_CLOSE_NAME
+			} else if c == '!' || c == '?' {
+				this.state = _TC_MARKUP_SKIP
+			} else if isText(c) || c == '_' {
+				this.addNameByte(c)
+				this.state = _TC_MARKUP_OPEN_NAME
+			} else if c != '<' {
+				this.state = _TC_MARKUP_TEXT
+			}
+
+		case _TC_MARKUP_OPEN_NAME:
+			if isMarkupNameByte(c) {
+				this.addNameByte(c)
+			} else if c == '>' {
+				this.push()
+				this.state = _TC_MARKUP_TEXT
+			} else {
+				this.state = _TC_MARKUP_ATTRIBUTES
+				this.quote = 0
+			}
+
+		case _TC_MARKUP_ATTRIBUTES:
+			if this.quote != 0 {
+				if c == this.quote {
+					this.quote = 0
+				}
+			} else if c == '"' || c == '\'' {
+				this.quote = c
+			} else if c == '>' {
+				// Self closing tag ?
+				if this.prev != '/' {
+					this.push()
+				}
+
+				this.state = _TC_MARKUP_TEXT
+			}
+
+		case _TC_MARKUP_CLOSE_NAME:
+			if c == '>' {
+				this.pop()
+				this.state = _TC_MARKUP_TEXT
+			} else if isMarkupNameByte(c) {
+				this.addNameByte(c)
+			}
+
+		case _TC_MARKUP_SKIP:
+			if c == '>' {
+				this.state = _TC_MARKUP_TEXT
+			}
+		}
+
+		this.prev = c
+	}
+}
+
+// Return the size of the entity at the start of the block and its index
+// (or -1)
+func findMarkupEntity(block []byte) (int, int) {
+	for i, e := range _TC_MARKUP_ENTITIES {
+		if bytes.HasPrefix(block, e) {
+			return len(e), i
+		}
+	}
+
+	return 0, -1
+}
+
+// Return the index of the entity token ('&', digit, ';') at the start of
+// the block (or -1)
+func findMarkupEntityToken(block []byte) int {
+	if len(block) < 3 || block[0] != '&' || block[2] != ';' || block[1] < '0' {
+		return -1
+	}
+
+	if idx := int(block[1] - '0'); idx < len(_TC_MARKUP_ENTITIES) {
+		return idx
+	}
+
+	return -1
+}
+
+// Apply the markup pass to src. Returns the size of the output (0 if the
+// pass cannot be applied or does not make the text smaller).
+func forwardMarkup(src, dst []byte) int {
+	if len(dst) < len(src) || bytes.Index(src, _TC_MARKUP_CLOSE_TAG) >= 0 {
+		return 0
+	}
+
+	for i := bytes.IndexByte(src, '&'); i >= 0; {
+		if findMarkupEntityToken(src[i:]) >= 0 {
+			return 0
+		}
+
+		j := bytes.IndexByte(src[i+1:], '&')
+
+		if j < 0 {
+			break
+		}
+
+		i += j + 1
+	}
+
+	tracker := newMarkupTracker()
+	count := len(src)
+	srcIdx := 0
+	dstIdx := 0
+
+	for srcIdx < count {
+		switch src[srcIdx] {
+		case '<':
+			if top := tracker.top(); top != nil && srcIdx+3+len(top) <= count && src[srcIdx+1] == '/' &&
+				bytes.Equal(src[srcIdx+2:srcIdx+2+len(top)], top) && src[srcIdx+2+len(top)] == '>' {
+				n := 3 + len(top)
+				tracker.feed(src[srcIdx : srcIdx+n])
+				dstIdx += copy(dst[dstIdx:], _TC_MARKUP_CLOSE_TAG)
+				srcIdx += n
+				continue
+			}
+
+		case '&':
+			if n, idx := findMarkupEntity(src[srcIdx:]); idx >= 0 {
+				tracker.feed(src[srcIdx : srcIdx+n])
+				dst[dstIdx] = '&'
+				dst[dstIdx+1] = byte('0' + idx)
+				dst[dstIdx+2] = ';'
+				dstIdx += 3
+				srcIdx += n
+				continue
+			}
+		}
+
+		tracker.feed(src[srcIdx : srcIdx+1])
+		dst[dstIdx] = src[srcIdx]
+		dstIdx++
+		srcIdx++
+	}
+
+	if dstIdx >= count {
+		return 0
+	}
+
+	return dstIdx
+}
+
+// Revert the markup pass. Returns the size of the output.
+func inverseMarkup(src, dst []byte) (int, error) {
+	tracker := newMarkupTracker()
+	dstIdx := 0
+
+	for srcIdx := 0; srcIdx < len(src); {
+		start := dstIdx
+
+		if src[srcIdx] == '<' && bytes.HasPrefix(src[srcIdx:], _TC_MARKUP_CLOSE_TAG) {
+			top := tracker.top()
+
+			if top == nil {
+				return 0, kanzi.NewCorruptStreamError("Text transform failed: invalid closing tag reference")
+			}
+
+			if dstIdx+3+len(top) > len(dst) {
+				return 0, kanzi.NewOutputTooSmallError("Text transform failed: output buffer too small")
+			}
+
+			dst[dstIdx] = '<'
+			dst[dstIdx+1] = '/'
+			dstIdx += 2
+			dstIdx += copy(dst[dstIdx:], top)
+			dst[dstIdx] = '>'
+			dstIdx++
+			srcIdx += len(_TC_MARKUP_CLOSE_TAG)
+		} else if idx := findMarkupEntityToken(src[srcIdx:]); idx >= 0 {
+			e := _TC_MARKUP_ENTITIES[idx]
+
+			if dstIdx+len(e) > len(dst) {
+				return 0, kanzi.NewOutputTooSmallError("Text transform failed: output buffer too small")
+			}
+
+			dstIdx += copy(dst[dstIdx:], e)
+			srcIdx += 3
+		} else {
+			if dstIdx >= len(dst) {
+				return 0, kanzi.NewOutputTooSmallError("Text transform failed: output buffer too small")
+			}
+
+			dst[dstIdx] = src[srcIdx]
+			dstIdx++
+			srcIdx++
+		}
+
+		tracker.feed(dst[start:dstIdx])
+	}
+
+	return dstIdx, nil
+}
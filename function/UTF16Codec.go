@@ -0,0 +1,390 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package function
+
+import (
+	"fmt"
+	"strings"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
+)
+
+const (
+	_UTF16_FLAG_BIG_ENDIAN = 0x01 // code units in big endian order
+	_UTF16_FLAG_ODD        = 0x02 // odd block size: last byte in the header
+	_UTF16_FLAG_TEXT1      = 0x04 // packed units encoded with text codec 1
+	_UTF16_FLAG_TEXT2      = 0x08 // packed units encoded with text codec 2
+	_UTF16_MAX_HEADER_SIZE = 1 + 5 + 1
+	_UTF16_MIN_BLOCK_SIZE  = 64
+	_UTF16_SAMPLE_SIZE     = 32768 // code units analyzed to detect UTF-16
+)
+
+// UTF-16 stream format: mode (1 byte) + size of packed units (varint) +
+// last byte (if odd block size) + packed units (raw or text encoded)
+
+// UTF16Codec a codec for UTF-16 text (EG. generated on Windows). In UTF-16
+// text, every other byte is (mostly) zero and the text codec does not see
+// words. Each 16 bit code unit is packed like a UTF-8 code point (1 byte
+// below 0x80, 2 bytes below 0x800, 3 bytes otherwise; surrogates are
+// packed separately so that any sequence of units is restored exactly).
+// The packed units are then processed by the text codec. The byte order
+// is detected for each block. Blocks that do not look like UTF-16 text
+// are rejected (the transform is skipped).
+type UTF16Codec struct {
+	ctx *map[string]interface{}
+}
+
+// NewUTF16Codec creates a new instance of UTF16Codec
+func NewUTF16Codec() (*UTF16Codec, error) {
+	this := &UTF16Codec{}
+	return this, nil
+}
+
+// NewUTF16CodecWithCtx creates a new instance of UTF16Codec using a
+// configuration map as parameter.
+func NewUTF16CodecWithCtx(ctx *map[string]interface{}) (*UTF16Codec, error) {
+	this := &UTF16Codec{}
+	this.ctx = ctx
+	return this, nil
+}
+
+// Select text encoding based on entropy codec (same as the DICT transform)
+func (this *UTF16Codec) textCodecType() int {
+	if this.ctx != nil {
+		if val, containsKey := (*this.ctx)["codec"]; containsKey {
+			entropyType := strings.ToUpper(val.(string))
+
+			if entropyType == "NONE" || entropyType == "ANS0" ||
+				entropyType == "HUFFMAN" || entropyType == "RANGE" {
+				return 2
+			}
+		}
+	}
+
+	return 1
+}
+
+// DetectUTF16 returns true if the block looks like UTF-16 text (mostly
+// ASCII code units) and the byte order of the code units
+func DetectUTF16(block []byte) (bool, bool) {
+	n := len(block) >> 1
+
+	if n > _UTF16_SAMPLE_SIZE {
+		n = _UTF16_SAMPLE_SIZE
+	}
+
+	if n == 0 {
+		return false, false
+	}
+
+	// Number of ASCII units and of text characters among them in each order
+	var ascii, text [2]int
+
+	for i := 0; i < n; i++ {
+		for order := 0; order < 2; order++ {
+			lo, hi := block[2*i+order], block[2*i+1-order]
+
+			if hi != 0 || lo >= 0x80 {
+				continue
+			}
+
+			ascii[order]++
+
+			if (lo >= 0x20 && lo < 0x7F) || lo == '\t' || lo == CR || lo == LF {
+				text[order]++
+			}
+		}
+	}
+
+	for order := 0; order < 2; order++ {
+		// Mostly ASCII units, mostly text characters, spaces
+		if 2*ascii[order] >= n && 10*text[order] >= 9*ascii[order] && ascii[1-order] < ascii[order]/4 {
+			return true, order == 1
+		}
+	}
+
+	return false, false
+}
+
+func newUTF16TextCodec(textCodecType int, size int) (*TextCodec, error) {
+	ctx := map[string]interface{}{"blockSize": uint(size), "textcodec": textCodecType}
+	return NewTextCodecWithCtx(&ctx)
+}
+
+// Pack the 16 bit code units of src into dst (which must be 3/2 times as
+// big as src). Returns the size of the packed data.
+func packUTF16(src, dst []byte, bigEndian bool) int {
+	dstIdx := 0
+
+	for i := 0; i+1 < len(src); i += 2 {
+		var u int
+
+		if bigEndian == true {
+			u = int(src[i])<<8 | int(src[i+1])
+		} else {
+			u = int(src[i+1])<<8 | int(src[i])
+		}
+
+		if u < 0x80 {
+			dst[dstIdx] = byte(u)
+			dstIdx++
+		} else if u < 0x800 {
+			dst[dstIdx] = byte(0xC0 | u>>6)
+			dst[dstIdx+1] = byte(0x80 | u&0x3F)
+			dstIdx += 2
+		} else {
+			dst[dstIdx] = byte(0xE0 | u>>12)
+			dst[dstIdx+1] = byte(0x80 | (u>>6)&0x3F)
+			dst[dstIdx+2] = byte(0x80 | u&0x3F)
+			dstIdx += 3
+		}
+	}
+
+	return dstIdx
+}
+
+// Unpack the code units of src into dst. Returns the number of bytes
+// written.
+func unpackUTF16(src, dst []byte, bigEndian bool) (int, error) {
+	dstIdx := 0
+
+	for srcIdx := 0; srcIdx < len(src); {
+		b := int(src[srcIdx])
+		var u int
+
+		switch {
+		case b < 0x80:
+			u = b
+			srcIdx++
+
+		case b >= 0xC0 && b < 0xE0 && srcIdx+1 < len(src):
+			u = (b&0x1F)<<6 | int(src[srcIdx+1]&0x3F)
+			srcIdx += 2
+
+		case b >= 0xE0 && b < 0xF0 && srcIdx+2 < len(src):
+			u = (b&0x0F)<<12 | int(src[srcIdx+1]&0x3F)<<6 | int(src[srcIdx+2]&0x3F)
+			srcIdx += 3
+
+		default:
+			return 0, kanzi.NewCorruptStreamError(fmt.Sprintf("UTF-16 codec: invalid packed unit in bitstream at offset %d", srcIdx))
+		}
+
+		if dstIdx+2 > len(dst) {
+			return 0, kanzi.NewOutputTooSmallError("UTF-16 codec: output buffer is too small")
+		}
+
+		if bigEndian == true {
+			dst[dstIdx], dst[dstIdx+1] = byte(u>>8), byte(u)
+		} else {
+			dst[dstIdx], dst[dstIdx+1] = byte(u), byte(u>>8)
+		}
+
+		dstIdx += 2
+	}
+
+	return dstIdx, nil
+}
+
+// Forward applies the function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *UTF16Codec) Forward(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(dst) < this.MaxEncodedLen(len(src)) {
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d",
+			len(dst), this.MaxEncodedLen(len(src))))
+	}
+
+	count := len(src)
+
+	if count < _UTF16_MIN_BLOCK_SIZE {
+		return 0, 0, kanzi.NewNotApplicableError("UTF-16 transform failed: input too small")
+	}
+
+	isUTF16, bigEndian := DetectUTF16(src)
+
+	if isUTF16 == false {
+		return 0, 0, kanzi.NewNotApplicableError("UTF-16 transform failed: not UTF-16 text")
+	}
+
+	mode := byte(0)
+
+	if bigEndian == true {
+		mode |= _UTF16_FLAG_BIG_ENDIAN
+	}
+
+	if count&1 != 0 {
+		mode |= _UTF16_FLAG_ODD
+	}
+
+	packed := alloc.Bytes(3 * (count >> 1))
+	defer alloc.PutBytes(packed)
+	packed = packed[0:packUTF16(src, packed, bigEndian)]
+	payload := packed
+
+	// Try to shrink the packed units with the text codec
+	tcType := this.textCodecType()
+
+	if tc, err := newUTF16TextCodec(tcType, len(packed)); err == nil {
+		out := alloc.Bytes(tc.MaxEncodedLen(len(packed)))
+		defer alloc.PutBytes(out)
+
+		if _, oIdx, err := tc.Forward(packed, out); err == nil && int(oIdx) < len(packed) {
+			payload = out[0:oIdx]
+
+			if tcType == 2 {
+				mode |= _UTF16_FLAG_TEXT2
+			} else {
+				mode |= _UTF16_FLAG_TEXT1
+			}
+		}
+	}
+
+	var hdr [_UTF16_MAX_HEADER_SIZE]byte
+	hdr[0] = mode
+	n := 1
+	n += emitPathVarInt(hdr[n:], len(packed))
+
+	if mode&_UTF16_FLAG_ODD != 0 {
+		hdr[n] = src[count-1]
+		n++
+	}
+
+	if n+len(payload) >= count {
+		return 0, 0, kanzi.NewNotApplicableError("UTF-16 transform failed: output not smaller than input")
+	}
+
+	dstIdx := copy(dst, hdr[0:n])
+	dstIdx += copy(dst[dstIdx:], payload)
+	return uint(count), uint(dstIdx), nil
+}
+
+// Inverse applies the reverse function to the src and writes the result
+// to the destination. Returns number of bytes read, number of bytes
+// written and possibly an error.
+func (this *UTF16Codec) Inverse(src, dst []byte) (uint, uint, error) {
+	if len(src) == 0 {
+		return 0, 0, nil
+	}
+
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	mode := src[0]
+	srcIdx := 1
+	packedLen, n, err := readPathVarInt(src[srcIdx:])
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	srcIdx += n
+
+	// Each unit takes at least one byte once packed
+	if packedLen > 3*(len(dst)>>1) {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("UTF-16 codec: invalid packed data size: %d", packedLen))
+	}
+
+	last := -1
+
+	if mode&_UTF16_FLAG_ODD != 0 {
+		if srcIdx >= len(src) {
+			return 0, 0, kanzi.NewCorruptStreamError("UTF-16 codec: missing last byte in bitstream")
+		}
+
+		last = int(src[srcIdx])
+		srcIdx++
+	}
+
+	var packed []byte
+
+	switch mode &^ (_UTF16_FLAG_BIG_ENDIAN | _UTF16_FLAG_ODD) {
+	case 0:
+		packed = src[srcIdx:]
+
+	case _UTF16_FLAG_TEXT1, _UTF16_FLAG_TEXT2:
+		tcType := 1
+
+		if mode&_UTF16_FLAG_TEXT2 != 0 {
+			tcType = 2
+		}
+
+		tc, err := newUTF16TextCodec(tcType, packedLen)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		packed = alloc.Bytes(packedLen)
+		defer alloc.PutBytes(packed)
+		_, oIdx, err := tc.Inverse(src[srcIdx:], packed)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		packed = packed[0:oIdx]
+
+	default:
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("Invalid UTF-16 codec mode in bitstream: %d", mode))
+	}
+
+	if len(packed) != packedLen {
+		return 0, 0, kanzi.NewCorruptStreamError(fmt.Sprintf("UTF-16 codec: invalid packed data size: %d, expected %d", len(packed), packedLen))
+	}
+
+	dstIdx, err := unpackUTF16(packed, dst, mode&_UTF16_FLAG_BIG_ENDIAN != 0)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if last >= 0 {
+		if dstIdx >= len(dst) {
+			return 0, 0, kanzi.NewOutputTooSmallError("UTF-16 codec: output buffer is too small")
+		}
+
+		dst[dstIdx] = byte(last)
+		dstIdx++
+	}
+
+	return uint(len(src)), uint(dstIdx), nil
+}
+
+// MaxEncodedLen returns the max size required for the encoding output buffer.
+// The transform fails if the output is not smaller than the input.
+func (this UTF16Codec) MaxEncodedLen(srcLen int) int {
+	return srcLen
+}
+
+// IsReusable returns true
+func (this *UTF16Codec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (a text codec is created per call)
+func (this *UTF16Codec) IsConcurrentSafe() bool {
+	return true
+}
@@ -16,8 +16,9 @@ limitations under the License.
 package function
 
 import (
-	"errors"
 	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
 )
 
 // X86Codec is a codec that replaces relative jumps addresses with
@@ -53,36 +54,23 @@ func NewX86CodecWithCtx(ctx *map[string]interface{}) (*X86Codec, error) {
 // written and possibly an error. If the source data does not represent
 // X86 code, an error is returned.
 func (this *X86Codec) Forward(src, dst []byte) (uint, uint, error) {
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 
 	if n := this.MaxEncodedLen(count); len(dst) < n {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
 	}
 
-	jumps := 0
 	end := count - 8
 
-	for i := 0; i < end; i++ {
-		if src[i]&_X86_INSTRUCTION_MASK == _X86_INSTRUCTION_JUMP {
-			// Count valid relative jumps (E8/E9 .. .. .. 00/FF)
-			if src[i+4] == 0 || src[i+4] == 255 {
-				// No encoding conflict ?
-				if src[i] != 0 && src[i] != 1 && src[i] != _X86_ESCAPE {
-					jumps++
-				}
-			}
-		}
-	}
-
-	if jumps < (count >> 7) {
+	if countX86Jumps(src) < (count >> 7) {
 		// Number of jump instructions too small => either not a binary
 		// or not worth the change => skip. Very crude filter obviously.
 		// Also, binaries usually have a lot of 0x88..0x8C (MOV) instructions.
-		return 0, 0, errors.New("Not a binary or not enough jumps")
+		return 0, 0, kanzi.NewNotApplicableError("Not a binary or not enough jumps")
 	}
 
 	srcIdx := 0
@@ -137,12 +125,31 @@ func (this *X86Codec) Forward(src, dst []byte) (uint, uint, error) {
 	return uint(srcIdx), uint(dstIdx), nil
 }
 
+// Count valid relative jumps (E8/E9 .. .. .. 00/FF)
+func countX86Jumps(src []byte) int {
+	jumps := 0
+	end := len(src) - 8
+
+	for i := 0; i < end; i++ {
+		if src[i]&_X86_INSTRUCTION_MASK == _X86_INSTRUCTION_JUMP {
+			if src[i+4] == 0 || src[i+4] == 255 {
+				// No encoding conflict ?
+				if src[i] != 0 && src[i] != 1 && src[i] != _X86_ESCAPE {
+					jumps++
+				}
+			}
+		}
+	}
+
+	return jumps
+}
+
 // Inverse applies the reverse function to the src and writes the result
 // to the destination. Returns number of bytes read, number of bytes
 // written and possibly an error.
 func (this *X86Codec) Inverse(src, dst []byte) (uint, uint, error) {
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
@@ -210,3 +217,13 @@ func (this X86Codec) MaxEncodedLen(srcLen int) int {
 
 	return srcLen + srcLen/16
 }
+
+// IsReusable returns true
+func (this *X86Codec) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (no state)
+func (this *X86Codec) IsConcurrentSafe() bool {
+	return true
+}
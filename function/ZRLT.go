@@ -22,25 +22,75 @@ import (
 	kanzi "github.com/flanglet/kanzi-go"
 )
 
-// ZRLT Zero Run Length Transform
+// Zero Run Length Transform
 // Zero Length Encoding is a simple encoding algorithm by Wheeler
 // closely related to Run Length Encoding. The main difference is
 // that only runs of 0 values are processed. Also, the length is
 // encoded in a different way (each digit in a different byte)
 // This algorithm is well adapted to process post BWT/MTFT data
+//
+// In bit mode (default), the run length is encoded like an Elias gamma code
+// with each bit in a different byte (symbols 0 and 1). It keeps the alphabet
+// small for the entropy coder but long runs require many symbols.
+// In byte mode, a single 0 is emitted as is and longer runs are encoded as
+// an escape symbol (1) followed by the run length as a varint (7 bits per
+// byte). The block starts with a marker (0xFF 0x02) that cannot appear at
+// the start of a block encoded in bit mode, so the decoder needs no option.
+// Non zero values are encoded the same way in both modes (shifted by 1, with
+// an escape for 0xFE and 0xFF).
+
+const (
+	// ZRLT_MODE_BIT mode: one byte per bit of the run length (default)
+	ZRLT_MODE_BIT = 1
+	// ZRLT_MODE_BYTE mode: run length encoded as a varint
+	ZRLT_MODE_BYTE = 2
+
+	_ZRLT_BYTE_MARKER = 0x02 // after 0xFF: only 0 or 1 in bit mode
+	_ZRLT_BYTE_RUN    = 0x01
+)
+
+// ZRLT Zero Run Length Transform
 type ZRLT struct {
+	mode      int
+	reference bool // use the portable reference inverse
 }
 
 // NewZRLT creates a new instance of ZRLT
 func NewZRLT() (*ZRLT, error) {
-	this := &ZRLT{}
+	this := &ZRLT{mode: ZRLT_MODE_BIT}
+	return this, nil
+}
+
+// NewZRLTWithMode creates a new instance of ZRLT using the provided run
+// length encoding mode
+func NewZRLTWithMode(mode int) (*ZRLT, error) {
+	if mode != ZRLT_MODE_BIT && mode != ZRLT_MODE_BYTE {
+		return nil, errors.New("Invalid mode parameter")
+	}
+
+	this := &ZRLT{mode: mode}
 	return this, nil
 }
 
 // NewZRLTWithCtx creates a new instance of ZRLT using a
 // configuration map as parameter.
 func NewZRLTWithCtx(ctx *map[string]interface{}) (*ZRLT, error) {
-	this := &ZRLT{}
+	mode := ZRLT_MODE_BIT
+
+	if _, containsKey := (*ctx)["zrlt"]; containsKey {
+		mode = (*ctx)["zrlt"].(int)
+	}
+
+	this, err := NewZRLTWithMode(mode)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if val, containsKey := (*ctx)["reference"]; containsKey {
+		this.reference = val.(bool)
+	}
+
 	return this, nil
 }
 
@@ -52,12 +102,16 @@ func (this *ZRLT) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	if n := this.MaxEncodedLen(len(src)); len(dst) < n {
-		return 0, 0, fmt.Errorf("Output buffer is too small - size: %d, required %d", len(dst), n)
+		return 0, 0, kanzi.NewOutputTooSmallError(fmt.Sprintf("Output buffer is too small - size: %d, required %d", len(dst), n))
+	}
+
+	if this.mode == ZRLT_MODE_BYTE {
+		return this.forwardBytes(src, dst)
 	}
 
 	srcEnd, dstEnd := uint(len(src)), uint(len(dst))
@@ -117,12 +171,90 @@ func (this *ZRLT) Forward(src, dst []byte) (uint, uint, error) {
 	}
 
 	if srcIdx != srcEnd || runLength != 0 {
-		err = errors.New("Output buffer is too small")
+		err = kanzi.NewOutputTooSmallError("Output buffer is too small")
 	}
 
 	return srcIdx, dstIdx, err
 }
 
+func (this *ZRLT) forwardBytes(src, dst []byte) (uint, uint, error) {
+	srcEnd, dstEnd := len(src), len(dst)
+
+	if dstEnd < 2 {
+		return 0, 0, kanzi.NewOutputTooSmallError("Output buffer is too small")
+	}
+
+	dst[0] = 0xFF
+	dst[1] = _ZRLT_BYTE_MARKER
+	srcIdx, dstIdx := 0, 2
+
+	for srcIdx < srcEnd && dstIdx < dstEnd {
+		val := src[srcIdx]
+
+		if val == 0 {
+			runLength := 1
+
+			for srcIdx+runLength < srcEnd && src[srcIdx+runLength] == 0 {
+				runLength++
+			}
+
+			if runLength == 1 {
+				dst[dstIdx] = 0
+				srcIdx++
+				dstIdx++
+				continue
+			}
+
+			// Escape + varint(runLength-2)
+			length := runLength - 2
+			n := 2
+
+			for l := length >> 7; l > 0; l >>= 7 {
+				n++
+			}
+
+			if dstIdx+n > dstEnd {
+				break
+			}
+
+			dst[dstIdx] = _ZRLT_BYTE_RUN
+			dstIdx++
+
+			for length >= 0x80 {
+				dst[dstIdx] = byte(0x80 | (length & 0x7F))
+				dstIdx++
+				length >>= 7
+			}
+
+			dst[dstIdx] = byte(length)
+			dstIdx++
+			srcIdx += runLength
+			continue
+		}
+
+		if val >= 0xFE {
+			if dstIdx+2 > dstEnd {
+				break
+			}
+
+			dst[dstIdx] = 0xFF
+			dstIdx++
+			dst[dstIdx] = val - 0xFE
+		} else {
+			dst[dstIdx] = val + 1
+		}
+
+		srcIdx++
+		dstIdx++
+	}
+
+	if srcIdx != srcEnd {
+		return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Output buffer is too small")
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
 // Inverse applies the reverse function to the src and writes the result
 // to the destination. Returns number of bytes read, number of bytes
 // written and possibly an error.
@@ -131,8 +263,17 @@ func (this *ZRLT) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
+	}
+
+	if len(src) >= 2 && src[0] == 0xFF && src[1] == _ZRLT_BYTE_MARKER {
+		srcIdx, dstIdx, err := this.inverseBytes(src[2:], dst)
+		return srcIdx + 2, dstIdx, err
+	}
+
+	if this.reference == true {
+		return this.inverseReference(src, dst)
 	}
 
 	srcEnd, dstEnd := len(src), len(dst)
@@ -192,7 +333,7 @@ End:
 	end := dstIdx + runLength - 1
 
 	if end > dstEnd {
-		err = errors.New("Output buffer is too small")
+		err = kanzi.NewOutputTooSmallError("Output buffer is too small")
 	} else {
 		for dstIdx < end {
 			dst[dstIdx] = 0
@@ -200,14 +341,137 @@ End:
 		}
 
 		if srcIdx < srcEnd {
-			err = errors.New("Output buffer is too small")
+			err = kanzi.NewOutputTooSmallError("Output buffer is too small")
 		}
 	}
 
 	return uint(srcIdx), uint(dstIdx), err
 }
 
+// Reference implementation of the bit mode used to validate the inverse:
+// one symbol at a time, each run length is rebuilt before the zeros are
+// emitted.
+func (this *ZRLT) inverseReference(src, dst []byte) (uint, uint, error) {
+	srcIdx, dstIdx := 0, 0
+
+	for srcIdx < len(src) {
+		if src[srcIdx] <= 1 {
+			runLength := 1
+
+			for srcIdx < len(src) && src[srcIdx] <= 1 {
+				runLength = 2*runLength + int(src[srcIdx])
+				srcIdx++
+			}
+
+			if runLength-1 > len(dst)-dstIdx {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Output buffer is too small")
+			}
+
+			for n := runLength - 1; n > 0; n-- {
+				dst[dstIdx] = 0
+				dstIdx++
+			}
+
+			continue
+		}
+
+		if dstIdx >= len(dst) {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Output buffer is too small")
+		}
+
+		val := src[srcIdx]
+		srcIdx++
+
+		if val == 0xFF {
+			if srcIdx >= len(src) {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid escaped value: missing data")
+			}
+
+			dst[dstIdx] = 0xFE + src[srcIdx]
+			srcIdx++
+		} else {
+			dst[dstIdx] = val - 1
+		}
+
+		dstIdx++
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
+func (this *ZRLT) inverseBytes(src, dst []byte) (uint, uint, error) {
+	srcEnd, dstEnd := len(src), len(dst)
+	srcIdx, dstIdx := 0, 0
+
+	for srcIdx < srcEnd {
+		cur := src[srcIdx]
+		srcIdx++
+
+		if cur == _ZRLT_BYTE_RUN {
+			// Decode varint(runLength-2)
+			length := 0
+			shift := uint(0)
+
+			for {
+				if srcIdx >= srcEnd || shift > 28 {
+					return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid run length")
+				}
+
+				b := src[srcIdx]
+				srcIdx++
+				length |= int(b&0x7F) << shift
+				shift += 7
+
+				if b < 0x80 {
+					break
+				}
+			}
+
+			runLength := length + 2
+
+			if runLength > dstEnd-dstIdx {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Output buffer is too small")
+			}
+
+			clear(dst[dstIdx : dstIdx+runLength])
+			dstIdx += runLength
+			continue
+		}
+
+		if dstIdx >= dstEnd {
+			return uint(srcIdx), uint(dstIdx), kanzi.NewOutputTooSmallError("Output buffer is too small")
+		}
+
+		if cur == 0xFF {
+			if srcIdx >= srcEnd {
+				return uint(srcIdx), uint(dstIdx), kanzi.NewCorruptStreamError("Invalid escaped value: missing data")
+			}
+
+			dst[dstIdx] = 0xFE + src[srcIdx]
+			srcIdx++
+		} else if cur == 0 {
+			dst[dstIdx] = 0
+		} else {
+			dst[dstIdx] = cur - 1
+		}
+
+		dstIdx++
+	}
+
+	return uint(srcIdx), uint(dstIdx), nil
+}
+
 // MaxEncodedLen returns the max size required for the encoding output buffer
 func (this ZRLT) MaxEncodedLen(srcLen int) int {
 	return srcLen
 }
+
+// IsReusable returns true
+func (this *ZRLT) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the mode is set at creation)
+func (this *ZRLT) IsConcurrentSafe() bool {
+	return true
+}
@@ -1 +1,3 @@
 module github.com/flanglet/kanzi-go
+
+go 1.21
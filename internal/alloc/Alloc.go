@@ -0,0 +1,224 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package alloc provides the temporary slices used by the transforms and
+// entropy codecs. The slices are pooled by size class (powers of 2) so that
+// the buffers of a block can be reused by the next blocks instead of being
+// reallocated (and collected) for each block.
+//
+// A slice obtained with one of the getters is zeroed (like with make) and
+// may be returned to the pool with the matching Put function once it is no
+// longer referenced. Returning a slice is optional.
+package alloc
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const _MAX_CLASSES = 48
+
+// Config the configuration of the allocator
+type Config struct {
+	Enabled        bool  // if false, the slices are allocated with make and never pooled
+	MinSize        int   // slices smaller than this size (in bytes) are not pooled
+	MaxSize        int   // slices bigger than this size (in bytes) are not pooled
+	MaxPooledBytes int64 // maximum number of bytes retained by the pools
+}
+
+// Stats the statistics of the allocator
+type Stats struct {
+	Hits        int64 // requests served from a pool
+	Misses      int64 // requests served by a new allocation
+	Drops       int64 // slices not retained because of MaxPooledBytes
+	PooledBytes int64 // bytes currently retained by the pools
+}
+
+// DefaultConfig the configuration of the allocator at startup
+var DefaultConfig = Config{
+	Enabled:        true,
+	MinSize:        4096,
+	MaxSize:        1 << 30,
+	MaxPooledBytes: 512 << 20,
+}
+
+var (
+	config      atomic.Pointer[Config]
+	hits        atomic.Int64
+	misses      atomic.Int64
+	drops       atomic.Int64
+	pooledBytes atomic.Int64
+
+	bytePool   = &slicePool[byte]{elemSize: 1}
+	intPool    = &slicePool[int]{elemSize: bits.UintSize / 8}
+	int32Pool  = &slicePool[int32]{elemSize: 4}
+	uint16Pool = &slicePool[uint16]{elemSize: 2}
+	uint32Pool = &slicePool[uint32]{elemSize: 4}
+)
+
+func init() {
+	cfg := DefaultConfig
+	config.Store(&cfg)
+}
+
+// SetConfig updates the configuration of the allocator. The slices already
+// pooled are kept (the garbage collector eventually releases them).
+func SetConfig(cfg Config) {
+	config.Store(&cfg)
+}
+
+// GetConfig returns the current configuration of the allocator
+func GetConfig() Config {
+	return *config.Load()
+}
+
+// GetStats returns the current statistics of the allocator
+func GetStats() Stats {
+	return Stats{
+		Hits:        hits.Load(),
+		Misses:      misses.Load(),
+		Drops:       drops.Load(),
+		PooledBytes: pooledBytes.Load(),
+	}
+}
+
+// Slice retained by a pool. The finalizer accounts for the slices released
+// by the garbage collector (sync.Pool drops its content at each GC cycle).
+type pooledSlice[T any] struct {
+	buf  []T
+	size int64
+}
+
+func releasePooledSlice[T any](p *pooledSlice[T]) {
+	pooledBytes.Add(-p.size)
+}
+
+type slicePool[T any] struct {
+	classes  [_MAX_CLASSES]sync.Pool
+	elemSize int
+}
+
+func (this *slicePool[T]) get(n int) []T {
+	cfg := config.Load()
+
+	if n <= 0 || cfg.Enabled == false || n*this.elemSize < cfg.MinSize {
+		return make([]T, n)
+	}
+
+	// Smallest class with capacity >= n
+	c := bits.Len(uint(n - 1))
+
+	if c >= _MAX_CLASSES || (1<<uint(c))*this.elemSize > cfg.MaxSize {
+		return make([]T, n)
+	}
+
+	if v := this.classes[c].Get(); v != nil {
+		p := v.(*pooledSlice[T])
+		runtime.SetFinalizer(p, nil)
+		pooledBytes.Add(-p.size)
+		hits.Add(1)
+		buf := p.buf[0:n]
+		clear(buf)
+		return buf
+	}
+
+	misses.Add(1)
+	return make([]T, n, 1<<uint(c))
+}
+
+func (this *slicePool[T]) put(buf []T) {
+	n := cap(buf)
+	cfg := config.Load()
+
+	if n == 0 || cfg.Enabled == false {
+		return
+	}
+
+	size := int64(n) * int64(this.elemSize)
+
+	if size < int64(cfg.MinSize) || size > int64(cfg.MaxSize) {
+		return
+	}
+
+	if pooledBytes.Add(size) > cfg.MaxPooledBytes {
+		pooledBytes.Add(-size)
+		drops.Add(1)
+		return
+	}
+
+	// Largest class with capacity <= n
+	c := bits.Len(uint(n)) - 1
+
+	if c >= _MAX_CLASSES {
+		pooledBytes.Add(-size)
+		return
+	}
+
+	p := &pooledSlice[T]{buf: buf[0:0:n], size: size}
+	runtime.SetFinalizer(p, releasePooledSlice[T])
+	this.classes[c].Put(p)
+}
+
+// Bytes returns a zeroed slice of n bytes
+func Bytes(n int) []byte {
+	return bytePool.get(n)
+}
+
+// PutBytes returns a slice obtained with Bytes to the pool
+func PutBytes(buf []byte) {
+	bytePool.put(buf)
+}
+
+// Ints returns a zeroed slice of n ints
+func Ints(n int) []int {
+	return intPool.get(n)
+}
+
+// PutInts returns a slice obtained with Ints to the pool
+func PutInts(buf []int) {
+	intPool.put(buf)
+}
+
+// Int32s returns a zeroed slice of n int32s
+func Int32s(n int) []int32 {
+	return int32Pool.get(n)
+}
+
+// PutInt32s returns a slice obtained with Int32s to the pool
+func PutInt32s(buf []int32) {
+	int32Pool.put(buf)
+}
+
+// Uint16s returns a zeroed slice of n uint16s
+func Uint16s(n int) []uint16 {
+	return uint16Pool.get(n)
+}
+
+// PutUint16s returns a slice obtained with Uint16s to the pool
+func PutUint16s(buf []uint16) {
+	uint16Pool.put(buf)
+}
+
+// Uint32s returns a zeroed slice of n uint32s
+func Uint32s(n int) []uint32 {
+	return uint32Pool.get(n)
+}
+
+// PutUint32s returns a slice obtained with Uint32s to the pool
+func PutUint32s(buf []uint32) {
+	uint32Pool.put(buf)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cpuinfo detects the features of the host CPU at run time so that
+// the fastest implementation of a kernel can be selected without build tags.
+// The packages providing several kernels register a selector called with
+// the detected features (see Register).
+package cpuinfo
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Features the set of CPU features relevant to the codecs
+type Features struct {
+	Arch           string
+	SSE2           bool
+	SSE41          bool
+	SSE42          bool
+	POPCNT         bool
+	AVX            bool
+	AVX2           bool
+	BMI2           bool
+	UnalignedLoads bool // fast unaligned 64 bit loads
+}
+
+// CPU contains the features of the host CPU (detected once at startup)
+var CPU Features
+
+var (
+	selected  Features
+	selectors []func(Features)
+	lock      sync.Mutex
+)
+
+func init() {
+	CPU.Arch = runtime.GOARCH
+	detect(&CPU)
+	selected = CPU
+}
+
+// Register adds a kernel selector and calls it with the features in use
+// (the detected features unless overridden). Called from the init function
+// of the packages providing several kernels.
+func Register(selector func(Features)) {
+	lock.Lock()
+	defer lock.Unlock()
+	selectors = append(selectors, selector)
+	selector(selected)
+}
+
+// Override calls all the kernel selectors with the provided features and
+// returns the features previously in use. An empty Features value selects
+// the portable kernels. Not safe while kernels are running: meant for tests
+// and benchmarks comparing the implementations.
+func Override(f Features) Features {
+	lock.Lock()
+	defer lock.Unlock()
+	prev := selected
+	selected = f
+
+	for _, selector := range selectors {
+		selector(f)
+	}
+
+	return prev
+}
+
+// String returns a comma separated list of the detected features
+func (this Features) String() string {
+	res := make([]string, 0, 8)
+	flags := []struct {
+		name string
+		set  bool
+	}{
+		{"sse2", this.SSE2},
+		{"sse4.1", this.SSE41},
+		{"sse4.2", this.SSE42},
+		{"popcnt", this.POPCNT},
+		{"avx", this.AVX},
+		{"avx2", this.AVX2},
+		{"bmi2", this.BMI2},
+		{"unaligned", this.UnalignedLoads},
+	}
+
+	for _, f := range flags {
+		if f.set == true {
+			res = append(res, f.name)
+		}
+	}
+
+	return this.Arch + ": " + strings.Join(res, ",")
+}
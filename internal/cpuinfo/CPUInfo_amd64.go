@@ -0,0 +1,56 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cpuinfo
+
+// Implemented in CPUInfo_amd64.s
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+// Implemented in CPUInfo_amd64.s
+func xgetbv() (eax, edx uint32)
+
+func detect(f *Features) {
+	f.UnalignedLoads = true
+	maxID, _, _, _ := cpuid(0, 0)
+
+	if maxID < 1 {
+		return
+	}
+
+	_, _, ecx1, edx1 := cpuid(1, 0)
+	f.SSE2 = edx1&(1<<26) != 0
+	f.SSE41 = ecx1&(1<<19) != 0
+	f.SSE42 = ecx1&(1<<20) != 0
+	f.POPCNT = ecx1&(1<<23) != 0
+
+	// AVX requires OS support for saving the YMM registers
+	osxsave := ecx1&(1<<27) != 0
+	osAVX := false
+
+	if osxsave == true {
+		eax, _ := xgetbv()
+		osAVX = eax&0x6 == 0x6
+	}
+
+	f.AVX = ecx1&(1<<28) != 0 && osAVX
+
+	if maxID < 7 {
+		return
+	}
+
+	_, ebx7, _, _ := cpuid(7, 0)
+	f.AVX2 = ebx7&(1<<5) != 0 && osAVX
+	f.BMI2 = ebx7&(1<<8) != 0
+}
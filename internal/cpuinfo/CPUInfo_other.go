@@ -0,0 +1,26 @@
+//go:build !amd64
+
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cpuinfo
+
+func detect(f *Features) {
+	// No feature detection: only report what the architecture guarantees
+	switch f.Arch {
+	case "arm64", "ppc64le", "s390x":
+		f.UnalignedLoads = true
+	}
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/bits"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// AppendFile the storage of a compressed stream opened for appending
+// (EG. an *os.File opened for reading and writing)
+type AppendFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// The writer of an appended stream (the file is not closed by the stream)
+type appendWriter struct {
+	io.Writer
+}
+
+func (this appendWriter) Close() error {
+	return nil
+}
+
+// NewAppendingOutputStream opens the compressed stream stored in f for
+// appending data. The parameters of the stream (codec, transform, block
+// size, checksum, digest, parity, dictionaries, sync points, entropy options
+// and lanes) are read from the stream header
+// and override the ones of the map ("jobs" is required, the other entries
+// apply to the new blocks, EG. the number of entropy lanes).
+// If the stream has a block index, the new blocks are added to the stream:
+// the end block and the index are removed and written again by Close (with
+// the entries of the new blocks) and the number of blocks in the header is
+// reset to 'unknown'. The stream is invalid until Close returns.
+// Otherwise, the new blocks are written to a new stream with the same
+// parameters after the existing data (see the concatenated streams of
+// CompressedInputStream). An indexed stream must be the only stream in f
+// and must not have a digest of the original data.
+func NewAppendingOutputStream(f AppendFile, ctx map[string]interface{}) (*CompressedOutputStream, error) {
+	if f == nil {
+		return nil, NewIOError("Invalid null file parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if ctx == nil {
+		return nil, NewIOError("Invalid null context parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	size, err := f.Seek(0, io.SeekEnd)
+
+	if err != nil {
+		return nil, NewIOError("Cannot read stream: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	// A small stream may be shorter than a stream header
+	if size < STREAM_HEADER_SIZE && (size < SMALL_HEADER_MAGIC_BITS/8 || isSmallStream(f) == false) {
+		return nil, NewIOError("Invalid stream: missing stream header", kanzi.ERR_INVALID_FILE)
+	}
+
+	// Header and extended header (if any)
+	header := make([]byte, STREAM_HEADER_SIZE+STREAM_HEADER_EXT_SIZE)
+
+	if size < int64(len(header)) {
+		header = header[0:size]
+	}
+
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return nil, NewIOError("Cannot read stream header: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	// The dictionaries (if any) follow the extended header
+	var src io.Reader = bytes.NewReader(header)
+
+	if hdr, err := ParseStreamHeader(header); err == nil && hdr.Dictionaries == true {
+		src = io.NewSectionReader(f, 0, size)
+	}
+
+	is, err := newCompressedInputStream(ioutil.NopCloser(src), map[string]interface{}{"jobs": uint(1)}, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = readRepairHeader(is); err != nil {
+		return nil, err
+	}
+
+	index, err := openIndex(f, size)
+	var entries []IndexEntry
+
+	if err == nil {
+		entries, err = index.all()
+	}
+
+	indexed := is.headers.compact == false && err == nil
+	params := make(map[string]interface{}, len(ctx)+8)
+
+	for k, v := range ctx {
+		params[k] = v
+	}
+
+	params["codec"] = entropy.GetName(is.entropyType)
+	params["transform"] = function.GetName(is.transformType)
+	params["blockSize"] = is.blockSize
+	params["checksum"] = is.hasher != nil
+	params["streamDigest"] = is.dataDigest != nil
+	params["index"] = indexed
+	params["packedIndex"] = indexed == true && index.pages != nil
+	params["syncPoints"] = is.syncPoints
+	params["partialBlocks"] = is.partialBlocks
+	params["headerSections"] = is.sections
+	delete(params, "checksumType")
+	delete(params, "parityShards")
+	delete(params, "dictionaryMode")
+
+	if is.parity != nil {
+		params["parityShards"] = uint(is.parity.parityShards)
+	}
+
+	if is.dictionaries != nil {
+		is.dictionaries.setParams(params)
+	}
+
+	if is.hasher != nil {
+		params["checksumType"] = is.hasher.name()
+	}
+
+	if indexed == true && is.dataDigest != nil {
+		// The end block cannot be located before the digest
+		return nil, NewIOError("Cannot append blocks to an indexed stream with a digest of the original data", kanzi.ERR_INVALID_FILE)
+	}
+
+	// The flags of the header must match the new blocks
+	if entropy.HasEntropyOptions(is.ctx, is.entropyType) == false {
+		for _, key := range [...]string{"tpaqModels", "tpaq:extra", "tpaq:mix2", "tpaq:warm", "cm:order2"} {
+			delete(params, key)
+		}
+	} else if entropy.HasEntropyOptions(params, is.entropyType) == false {
+		for _, key := range [...]string{"tpaqModels", "cm:order2"} {
+			if val, containsKey := is.ctx[key]; containsKey == true {
+				params[key] = val
+			}
+		}
+	}
+
+	if indexed == true {
+		delete(params, "tpaq:warm")
+	}
+
+	if entropy.HasEntropyLanes(is.ctx, is.entropyType) == false {
+		delete(params, "entropy:lanes")
+	} else if _, containsKey := params["entropy:lanes"]; containsKey == false {
+		params["entropy:lanes"] = uint(1)
+	}
+
+	p, err := parseOutputParams(params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if indexed == false {
+		// New stream after the existing data (the file is positioned at the end)
+		return newCompressedOutputStream(appendWriter{f}, params, p)
+	}
+
+	// The end block header (mode 0x80 then length 0) is followed by padding
+	// bits (0) up to the index: its first bit is the last bit set
+	indexPos := index.start
+	tail := make([]byte, 4)
+
+	if _, err = f.ReadAt(tail[1:], indexPos-3); err != nil {
+		return nil, NewIOError("Cannot read end of stream: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	zeros := bits.TrailingZeros32(binary.BigEndian.Uint32(tail))
+
+	if zeros < 15 || zeros > 22 {
+		return nil, NewIOError("Invalid stream: cannot locate the end of stream block", kanzi.ERR_INVALID_FILE)
+	}
+
+	endPos := uint64(indexPos<<3) - uint64(zeros+1)
+
+	if len(entries) > 0 && endPos <= entries[len(entries)-1].BitOffset {
+		return nil, NewIOError("Invalid stream: cannot locate the end of stream block", kanzi.ERR_INVALID_FILE)
+	}
+
+	// Number of blocks (header bits 119 to 124) now unknown
+	header[14] &= 0xFE
+	header[15] &= 0x07
+
+	if _, err = f.WriteAt(header[14:16], 14); err != nil {
+		return nil, NewIOError("Cannot write stream header: "+err.Error(), kanzi.ERR_WRITE_FILE)
+	}
+
+	// Keep the bits of the last block in the byte of the end block
+	start := int64(endPos >> 3)
+	last := tail[start-indexPos+4]
+
+	if err = f.Truncate(start); err != nil {
+		return nil, NewIOError("Cannot truncate stream: "+err.Error(), kanzi.ERR_WRITE_FILE)
+	}
+
+	if _, err = f.Seek(start, io.SeekStart); err != nil {
+		return nil, NewIOError("Cannot truncate stream: "+err.Error(), kanzi.ERR_WRITE_FILE)
+	}
+
+	this, err := newCompressedOutputStream(appendWriter{f}, params, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this.initialized = 1
+	this.index.entries = entries
+	this.index.size = index.dataSize
+	this.index.base = uint64(start) << 3
+
+	if n := uint(endPos & 7); n > 0 {
+		this.obs.WriteBits(uint64(last>>(8-n)), n)
+	}
+
+	return this, nil
+}
@@ -0,0 +1,589 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// ArchiveEntry the header of a file (or directory) stored in an archive
+type ArchiveEntry struct {
+	Name    string      // path relative to the root of the archive, '/' separators
+	Size    int64       // size of the data of the file (0 for a directory)
+	Mode    os.FileMode // permissions and type (os.ModeDir for a directory)
+	ModTime time.Time   // modification time
+}
+
+// IsDir returns true if the entry is a directory
+func (this *ArchiveEntry) IsDir() bool {
+	return this.Mode.IsDir()
+}
+
+// CheckArchiveName returns an error if the name cannot be stored in an
+// archive: empty, too long, not UTF-8, absolute or escaping the root of the
+// archive (with '..' elements).
+func CheckArchiveName(name string) error {
+	if len(name) == 0 {
+		return NewIOError("Invalid archive entry name: empty name", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if len(name) > ARCHIVE_MAX_NAME_LENGTH {
+		errMsg := fmt.Sprintf("Invalid archive entry name '%v...': name longer than %v bytes", name[0:32], ARCHIVE_MAX_NAME_LENGTH)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	if utf8.ValidString(name) == false || strings.ContainsAny(name, "\x00\\") {
+		errMsg := fmt.Sprintf("Invalid archive entry name %q: invalid character", name)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	if path.IsAbs(name) == true || filepath.IsAbs(name) == true || filepath.VolumeName(name) != "" {
+		errMsg := fmt.Sprintf("Invalid archive entry name '%v': absolute path", name)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	for _, elt := range strings.Split(name, "/") {
+		if elt == ".." {
+			errMsg := fmt.Sprintf("Invalid archive entry name '%v': path outside of the archive", name)
+			return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+		}
+	}
+
+	return nil
+}
+
+// ArchiveWriter writes a sequence of files and directories (each one with
+// a header: name, size, mode and modification time) to a compressed stream.
+// See Format.go for the layout of the archive. Usage: call WriteHeader for
+// each entry then Write the data of the entry (exactly Size bytes).
+type ArchiveWriter struct {
+	cos       *CompressedOutputStream
+	remaining int64 // bytes of the current entry not written yet
+	buf       []byte
+	closed    bool
+}
+
+// NewArchiveWriter creates a new instance of ArchiveWriter compressing the
+// archive to os with the parameters of the configuration (frozen if needed).
+// The output writer is not closed.
+func NewArchiveWriter(os io.WriteCloser, cfg *Config) (*ArchiveWriter, error) {
+	if cfg == nil {
+		return nil, NewIOError("Invalid null configuration parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if cfg.Frozen() == false {
+		cfg = cfg.Clone()
+
+		if err := cfg.Freeze(); err != nil {
+			return nil, err
+		}
+	}
+
+	cos, err := NewCompressedOutputStreamWithConfig(os, cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &ArchiveWriter{cos: cos, buf: make([]byte, ARCHIVE_HEADER_SIZE+ARCHIVE_MAX_NAME_LENGTH)}
+	binary.BigEndian.PutUint32(this.buf, ARCHIVE_MAGIC)
+
+	if _, err = this.cos.Write(this.buf[0:4]); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// WriteHeader starts a new entry. The data of the previous entry must be
+// complete.
+func (this *ArchiveWriter) WriteHeader(entry *ArchiveEntry) error {
+	if this.closed == true {
+		return NewIOError("Archive closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	if entry == nil {
+		return NewIOError("Invalid null archive entry parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if this.remaining != 0 {
+		errMsg := fmt.Sprintf("Cannot write archive entry '%v': %v bytes missing in the previous entry", entry.Name, this.remaining)
+		return NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	name := strings.TrimSuffix(entry.Name, "/")
+
+	if err := CheckArchiveName(name); err != nil {
+		return err
+	}
+
+	if entry.Size < 0 || (entry.IsDir() == true && entry.Size != 0) {
+		errMsg := fmt.Sprintf("Invalid size for archive entry '%v': %v", entry.Name, entry.Size)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	buf := this.buf
+	buf[0] = ARCHIVE_ENTRY_FILE
+
+	if entry.IsDir() == true {
+		buf[0] = ARCHIVE_ENTRY_DIR
+	}
+
+	binary.BigEndian.PutUint16(buf[1:], uint16(len(name)))
+	n := 3 + copy(buf[3:], name)
+	binary.BigEndian.PutUint32(buf[n:], uint32(entry.Mode))
+	var mtime int64
+
+	if entry.ModTime.IsZero() == false {
+		mtime = entry.ModTime.UnixNano()
+	}
+
+	binary.BigEndian.PutUint64(buf[n+4:], uint64(mtime))
+	binary.BigEndian.PutUint64(buf[n+12:], uint64(entry.Size))
+
+	if _, err := this.cos.Write(buf[0 : n+20]); err != nil {
+		return err
+	}
+
+	this.remaining = entry.Size
+	return nil
+}
+
+// Write writes data of the current entry. Fails if the data exceeds the
+// size provided in the header of the entry.
+func (this *ArchiveWriter) Write(b []byte) (int, error) {
+	if this.closed == true {
+		return 0, NewIOError("Archive closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	if int64(len(b)) > this.remaining {
+		errMsg := fmt.Sprintf("Cannot write %v bytes: only %v bytes left in the archive entry", len(b), this.remaining)
+		return 0, NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	n, err := this.cos.Write(b)
+	this.remaining -= int64(n)
+	return n, err
+}
+
+// AddFile writes the file or directory (not its content) inputName as an
+// entry named name (the base name of the input if empty)
+func (this *ArchiveWriter) AddFile(inputName, name string) error {
+	fi, err := os.Stat(inputName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot access input file '%v': %v", inputName, err)
+		return NewIOError(errMsg, kanzi.ERR_OPEN_FILE)
+	}
+
+	if len(name) == 0 {
+		name = filepath.Base(inputName)
+	}
+
+	entry := &ArchiveEntry{Name: name, Mode: fi.Mode(), ModTime: fi.ModTime()}
+
+	if fi.IsDir() == true {
+		return this.WriteHeader(entry)
+	}
+
+	if fi.Mode().IsRegular() == false {
+		errMsg := fmt.Sprintf("Cannot archive '%v': not a regular file", inputName)
+		return NewIOError(errMsg, kanzi.ERR_OPEN_FILE)
+	}
+
+	input, err := os.Open(inputName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot open input file '%v': %v", inputName, err)
+		return NewIOError(errMsg, kanzi.ERR_OPEN_FILE)
+	}
+
+	defer input.Close()
+	entry.Size = fi.Size()
+
+	if err = this.WriteHeader(entry); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(this, io.LimitReader(input, entry.Size))
+
+	if err != nil {
+		return err
+	}
+
+	if n != entry.Size {
+		// The file was truncated since the call to Stat
+		errMsg := fmt.Sprintf("Cannot archive '%v': read %v bytes, expected %v", inputName, n, entry.Size)
+		return NewIOError(errMsg, kanzi.ERR_READ_FILE)
+	}
+
+	return nil
+}
+
+// AddDirectory writes the directory dir and all the files and directories
+// under it (the names start with the base name of dir). Other kinds of files
+// (symbolic links, devices, ...) are skipped. Returns the number of entries
+// written.
+func (this *ArchiveWriter) AddDirectory(dir string) (int, error) {
+	root := filepath.Dir(filepath.Clean(dir))
+	count := 0
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			errMsg := fmt.Sprintf("Cannot access input file '%v': %v", p, err)
+			return NewIOError(errMsg, kanzi.ERR_OPEN_FILE)
+		}
+
+		if fi.IsDir() == false && fi.Mode().IsRegular() == false {
+			return nil
+		}
+
+		name, err := filepath.Rel(root, p)
+
+		if err != nil {
+			return NewIOError(err.Error(), kanzi.ERR_OPEN_FILE)
+		}
+
+		if err = this.AddFile(p, filepath.ToSlash(name)); err != nil {
+			return err
+		}
+
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// Close writes the end of the archive and closes the compressed stream
+// (the output writer is not closed). Idempotent.
+func (this *ArchiveWriter) Close() error {
+	if this.closed == true {
+		return nil
+	}
+
+	this.closed = true
+
+	if this.remaining != 0 {
+		this.cos.Close()
+		errMsg := fmt.Sprintf("Cannot close archive: %v bytes missing in the last entry", this.remaining)
+		return NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	this.buf[0] = ARCHIVE_ENTRY_END
+
+	if _, err := this.cos.Write(this.buf[0:1]); err != nil {
+		this.cos.Close()
+		return err
+	}
+
+	return this.cos.Close()
+}
+
+// GetWritten returns the number of bytes written so far to the output
+func (this *ArchiveWriter) GetWritten() uint64 {
+	return this.cos.GetWritten()
+}
+
+// ArchiveReader reads the entries of an archive written by ArchiveWriter.
+// Usage: call Next to move to the next entry then Read the data of the entry.
+// The entries of concatenated archives (EG. an archive extended by appending
+// another archive to the file) are read in sequence.
+type ArchiveReader struct {
+	cis       *CompressedInputStream
+	remaining int64 // bytes of the current entry not read yet
+	buf       []byte
+	done      bool
+}
+
+// NewArchiveReader creates a new instance of ArchiveReader decompressing
+// the archive from is with 'jobs' concurrent tasks. The input reader is not
+// closed.
+func NewArchiveReader(is io.ReadCloser, jobs uint) (*ArchiveReader, error) {
+	cis, err := NewCompressedInputStream(is, jobs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &ArchiveReader{cis: cis, buf: make([]byte, ARCHIVE_HEADER_SIZE+ARCHIVE_MAX_NAME_LENGTH)}
+
+	if err = this.readFull(this.buf[0:4]); err != nil {
+		return nil, err
+	}
+
+	if binary.BigEndian.Uint32(this.buf) != ARCHIVE_MAGIC {
+		return nil, NewIOError("Invalid archive: missing archive magic", kanzi.ERR_INVALID_FILE)
+	}
+
+	return this, nil
+}
+
+// Next skips the rest of the current entry and returns the header of the
+// next entry. Returns io.EOF at the end of the archive.
+func (this *ArchiveReader) Next() (*ArchiveEntry, error) {
+	if this.done == true {
+		return nil, io.EOF
+	}
+
+	for this.remaining > 0 {
+		n := int64(len(this.buf))
+
+		if n > this.remaining {
+			n = this.remaining
+		}
+
+		if err := this.readFull(this.buf[0:n]); err != nil {
+			return nil, err
+		}
+
+		this.remaining -= n
+	}
+
+	buf := this.buf
+
+	if err := this.readFull(buf[0:1]); err != nil {
+		return nil, err
+	}
+
+	for buf[0] == ARCHIVE_ENTRY_END {
+		// Another archive may follow (concatenated streams)
+		n, err := this.cis.Read(buf[0:4])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if n == 0 {
+			this.done = true
+			return nil, io.EOF
+		}
+
+		if err = this.readFull(buf[n:4]); err != nil {
+			return nil, err
+		}
+
+		if binary.BigEndian.Uint32(buf) != ARCHIVE_MAGIC {
+			return nil, NewIOError("Invalid archive: missing archive magic", kanzi.ERR_INVALID_FILE)
+		}
+
+		if err = this.readFull(buf[0:1]); err != nil {
+			return nil, err
+		}
+	}
+
+	if buf[0] != ARCHIVE_ENTRY_FILE && buf[0] != ARCHIVE_ENTRY_DIR {
+		errMsg := fmt.Sprintf("Invalid archive: unknown entry type %v", buf[0])
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	isDir := buf[0] == ARCHIVE_ENTRY_DIR
+
+	if err := this.readFull(buf[1:3]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint16(buf[1:]))
+
+	if n > ARCHIVE_MAX_NAME_LENGTH {
+		errMsg := fmt.Sprintf("Invalid archive: entry name of %v bytes", n)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	if err := this.readFull(buf[3 : n+23]); err != nil {
+		return nil, err
+	}
+
+	entry := &ArchiveEntry{Name: string(buf[3 : n+3])}
+	entry.Mode = os.FileMode(binary.BigEndian.Uint32(buf[n+3:]))
+
+	if mtime := int64(binary.BigEndian.Uint64(buf[n+7:])); mtime != 0 {
+		entry.ModTime = time.Unix(0, mtime)
+	}
+
+	entry.Size = int64(binary.BigEndian.Uint64(buf[n+15:]))
+
+	if err := CheckArchiveName(entry.Name); err != nil {
+		return nil, NewIOError("Invalid archive: "+err.(*IOError).Message(), kanzi.ERR_INVALID_FILE)
+	}
+
+	if entry.Size < 0 || isDir != entry.IsDir() || (isDir == true && entry.Size != 0) {
+		errMsg := fmt.Sprintf("Invalid archive: invalid header for entry '%v'", entry.Name)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	this.remaining = entry.Size
+	return entry, nil
+}
+
+// Read reads data of the current entry. Returns io.EOF at the end of the
+// entry.
+func (this *ArchiveReader) Read(b []byte) (int, error) {
+	if this.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > this.remaining {
+		b = b[0:this.remaining]
+	}
+
+	if err := this.readFull(b); err != nil {
+		return 0, err
+	}
+
+	this.remaining -= int64(len(b))
+	return len(b), nil
+}
+
+// Extract writes all the remaining entries of the archive under the
+// directory dir (created if needed) and applies the modes and modification
+// times. Fails if a file exists. Returns the number of entries extracted.
+func (this *ArchiveReader) Extract(dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		errMsg := fmt.Sprintf("Cannot create output directory '%v': %v", dir, err)
+		return 0, NewIOError(errMsg, kanzi.ERR_CREATE_FILE)
+	}
+
+	// Times of the directories applied at the end (creating files in a
+	// directory changes its modification time)
+	dirs := make([]*ArchiveEntry, 0)
+	count := 0
+
+	for {
+		entry, err := this.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return count, err
+		}
+
+		outputName := filepath.Join(dir, filepath.FromSlash(entry.Name))
+
+		if entry.IsDir() == true {
+			if err = os.MkdirAll(outputName, entry.Mode.Perm()|0700); err != nil {
+				errMsg := fmt.Sprintf("Cannot create output directory '%v': %v", outputName, err)
+				return count, NewIOError(errMsg, kanzi.ERR_CREATE_FILE)
+			}
+
+			dirs = append(dirs, entry)
+			count++
+			continue
+		}
+
+		if err = os.MkdirAll(filepath.Dir(outputName), 0777); err != nil {
+			errMsg := fmt.Sprintf("Cannot create output directory '%v': %v", filepath.Dir(outputName), err)
+			return count, NewIOError(errMsg, kanzi.ERR_CREATE_FILE)
+		}
+
+		if err = this.extractFile(entry, outputName); err != nil {
+			return count, err
+		}
+
+		count++
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		outputName := filepath.Join(dir, filepath.FromSlash(dirs[i].Name))
+
+		if err := setArchiveAttributes(outputName, dirs[i]); err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+func (this *ArchiveReader) extractFile(entry *ArchiveEntry, outputName string) error {
+	output, err := os.OpenFile(outputName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot create output file '%v': %v", outputName, err)
+		return NewIOError(errMsg, kanzi.ERR_CREATE_FILE)
+	}
+
+	_, err = io.Copy(output, this)
+
+	if err2 := output.Close(); err == nil && err2 != nil {
+		errMsg := fmt.Sprintf("Cannot close output file '%v': %v", outputName, err2)
+		err = NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	if err != nil {
+		os.Remove(outputName)
+		return err
+	}
+
+	return setArchiveAttributes(outputName, entry)
+}
+
+func setArchiveAttributes(name string, entry *ArchiveEntry) error {
+	if err := os.Chmod(name, entry.Mode.Perm()); err != nil {
+		errMsg := fmt.Sprintf("Cannot set the mode of '%v': %v", name, err)
+		return NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	if entry.ModTime.IsZero() == false {
+		if err := os.Chtimes(name, entry.ModTime, entry.ModTime); err != nil {
+			errMsg := fmt.Sprintf("Cannot set the modification time of '%v': %v", name, err)
+			return NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the compressed stream (the input reader is not closed)
+func (this *ArchiveReader) Close() error {
+	return this.cis.Close()
+}
+
+// GetRead returns the number of bytes read so far from the input
+func (this *ArchiveReader) GetRead() uint64 {
+	return this.cis.GetRead()
+}
+
+// Read exactly len(buf) bytes (CompressedInputStream.Read returns 0 bytes
+// and no error at the end of the stream)
+func (this *ArchiveReader) readFull(buf []byte) error {
+	for len(buf) > 0 {
+		n, err := this.cis.Read(buf)
+
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return NewIOError("Invalid archive: unexpected end of stream", kanzi.ERR_INVALID_FILE)
+		}
+
+		buf = buf[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// BlockInfo contains the metadata of the block passed to a BlockHook
+type BlockInfo struct {
+	ID        int    // block id (starting at 1)
+	Stage     int    // one of the kanzi.EVT_XXX_TRANSFORM or kanzi.EVT_XXX_ENTROPY values
+	Decoding  bool   // true when invoked by a CompressedInputStream
+	Transform string // name of the transform chain of the stream
+	Entropy   string // name of the entropy codec of the stream
+}
+
+// BlockHook is a caller-provided function invoked inline on the content of
+// a block at a given stage of the pipeline (EG. redaction, sampling, tagging).
+// The hook may modify the content of the block in place but not its size.
+// Blocks are processed concurrently: a hook must be safe for concurrent use.
+// Returning an error stops the stream processing.
+type BlockHook func(info BlockInfo, block []byte) error
+
+// SetHook registers a hook for one stage of the output stream (nil removes
+// the hook). Supported stages:
+// kanzi.EVT_BEFORE_TRANSFORM: original data (before the block checksum is computed)
+// kanzi.EVT_BEFORE_ENTROPY: transformed data
+// Must not be called concurrently with Write.
+func (this *CompressedOutputStream) SetHook(stage int, hook BlockHook) error {
+	if stage != kanzi.EVT_BEFORE_TRANSFORM && stage != kanzi.EVT_BEFORE_ENTROPY {
+		errMsg := fmt.Sprintf("Unsupported hook stage for output stream: %d", stage)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	this.hooks = setHook(this.hooks, stage, hook)
+	return nil
+}
+
+// SetHook registers a hook for one stage of the input stream (nil removes
+// the hook). Supported stages:
+// kanzi.EVT_AFTER_ENTROPY: transformed data
+// kanzi.EVT_AFTER_TRANSFORM: decoded data (after verification of the block checksum)
+// Must not be called concurrently with Read.
+func (this *CompressedInputStream) SetHook(stage int, hook BlockHook) error {
+	if stage != kanzi.EVT_AFTER_ENTROPY && stage != kanzi.EVT_AFTER_TRANSFORM {
+		errMsg := fmt.Sprintf("Unsupported hook stage for input stream: %d", stage)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	this.hooks = setHook(this.hooks, stage, hook)
+	return nil
+}
+
+// Copy on write so that running tasks keep a consistent view of the hooks
+func setHook(hooks map[int]BlockHook, stage int, hook BlockHook) map[int]BlockHook {
+	res := make(map[int]BlockHook, len(hooks)+1)
+
+	for k, v := range hooks {
+		res[k] = v
+	}
+
+	if hook == nil {
+		delete(res, stage)
+	} else {
+		res[stage] = hook
+	}
+
+	return res
+}
+
+// Run the hook registered for the stage (if any)
+func runHook(hooks map[int]BlockHook, info BlockInfo, block []byte) (err error) {
+	hook := hooks[info.Stage]
+
+	if hook == nil {
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Block hook failed: %v", r)
+		}
+	}()
+
+	return hook(info, block)
+}
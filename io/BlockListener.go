@@ -0,0 +1,169 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"strings"
+	"time"
+
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// BlockStartEvent is passed to BlockListener.BlockStart
+type BlockStartEvent struct {
+	ID       int   // block id (starting at 1)
+	Decoding bool  // true when sent by a CompressedInputStream
+	Size     int64 // size of the original block (-1 if unknown, when decoding)
+	Time     time.Time
+}
+
+// BlockEndEvent is passed to BlockListener.BlockEnd
+type BlockEndEvent struct {
+	ID          int           // block id (starting at 1)
+	Decoding    bool          // true when sent by a CompressedInputStream
+	Size        int64         // size of the original block
+	Compressed  int64         // size of the block in the compressed stream (block header included)
+	Transform   string        // transforms applied to the block (skipped transforms excluded)
+	Entropy     string        // entropy codec of the block
+	Stored      bool          // true if the block is stored raw (copy block)
+	Checksum    uint32        // checksum of the original block (first 32 bits)
+	HasChecksum bool          // false if the stream has no block checksum
+	Duration    time.Duration // processing time of the block (waits included)
+}
+
+// Ratio returns the compression ratio of the block (compressed size over
+// original size)
+func (this BlockEndEvent) Ratio() float64 {
+	if this.Size == 0 {
+		return 0
+	}
+
+	return float64(this.Compressed) / float64(this.Size)
+}
+
+// BlockListener receives the events of the blocks of a stream with typed
+// metadata (EG. to log the compression ratio of each block). When encoding,
+// BlockEnd is called once the block is written, in block order. When
+// decoding, BlockEnd is called once the block is decoded and checked.
+// Blocks are processed concurrently: a listener must be safe for concurrent
+// use. The panics of a listener are ignored.
+type BlockListener interface {
+	BlockStart(evt BlockStartEvent)
+	BlockEnd(evt BlockEndEvent)
+}
+
+// AddBlockListener adds a block listener to the output stream. Must not be
+// called concurrently with Write.
+func (this *CompressedOutputStream) AddBlockListener(bl BlockListener) bool {
+	if bl == nil {
+		return false
+	}
+
+	this.blkListeners = addBlockListener(this.blkListeners, bl)
+	return true
+}
+
+// RemoveBlockListener removes a block listener from the output stream.
+// Returns true if the listener has been removed. Must not be called
+// concurrently with Write.
+func (this *CompressedOutputStream) RemoveBlockListener(bl BlockListener) bool {
+	var removed bool
+	this.blkListeners, removed = removeBlockListener(this.blkListeners, bl)
+	return removed
+}
+
+// AddBlockListener adds a block listener to the input stream. Must not be
+// called concurrently with Read.
+func (this *CompressedInputStream) AddBlockListener(bl BlockListener) bool {
+	if bl == nil {
+		return false
+	}
+
+	this.blkListeners = addBlockListener(this.blkListeners, bl)
+	return true
+}
+
+// RemoveBlockListener removes a block listener from the input stream.
+// Returns true if the listener has been removed. Must not be called
+// concurrently with Read.
+func (this *CompressedInputStream) RemoveBlockListener(bl BlockListener) bool {
+	var removed bool
+	this.blkListeners, removed = removeBlockListener(this.blkListeners, bl)
+	return removed
+}
+
+// Copy on write so that running tasks keep a consistent view of the listeners
+func addBlockListener(listeners []BlockListener, bl BlockListener) []BlockListener {
+	res := make([]BlockListener, len(listeners), len(listeners)+1)
+	copy(res, listeners)
+	return append(res, bl)
+}
+
+func removeBlockListener(listeners []BlockListener, bl BlockListener) ([]BlockListener, bool) {
+	for i, e := range listeners {
+		if e == bl {
+			res := make([]BlockListener, 0, len(listeners)-1)
+			res = append(res, listeners[:i]...)
+			return append(res, listeners[i+1:]...), true
+		}
+	}
+
+	return listeners, false
+}
+
+func notifyBlockStart(listeners []BlockListener, evt BlockStartEvent) {
+	defer func() {
+		//lint:ignore SA9003 ignore panics in listeners
+		if r := recover(); r != nil {
+			// Ignore panics in block listeners
+		}
+	}()
+
+	for _, bl := range listeners {
+		bl.BlockStart(evt)
+	}
+}
+
+func notifyBlockEnd(listeners []BlockListener, evt BlockEndEvent) {
+	defer func() {
+		//lint:ignore SA9003 ignore panics in listeners
+		if r := recover(); r != nil {
+			// Ignore panics in block listeners
+		}
+	}()
+
+	for _, bl := range listeners {
+		bl.BlockEnd(evt)
+	}
+}
+
+// Return the names of the transforms applied to a block (the skip flags
+// select the transforms of the chain)
+func appliedTransforms(transformType uint64, skipFlags byte) string {
+	names := make([]string, 0, 8)
+
+	for i, t := range function.GetTypes(transformType) {
+		if t != function.NONE_TYPE && skipFlags&(1<<(7-uint(i))) == 0 {
+			names = append(names, function.GetTypeName(t))
+		}
+	}
+
+	if len(names) == 0 {
+		return function.GetTypeName(function.NONE_TYPE)
+	}
+
+	return strings.Join(names, "+")
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/util/hash"
+)
+
+// Names of the block checksum algorithms (context key 'checksumType')
+const (
+	CHECKSUM_XXHASH32 = "XXHASH32"
+	CHECKSUM_XXHASH64 = "XXHASH64"
+	CHECKSUM_SHA256   = "SHA256"
+)
+
+// Indexed by the checksum type stored in the extended stream header
+var _CHECKSUM_NAMES = [...]string{CHECKSUM_XXHASH32, CHECKSUM_XXHASH64, CHECKSUM_SHA256}
+
+// Size in bits of the checksum of a block, indexed by checksum type
+var _CHECKSUM_BITS = [...]uint{32, 64, 256}
+
+// Return the checksum type stored in the stream header for the algorithm
+// name (case insensitive)
+func getChecksumType(name string) (uint8, error) {
+	for i, n := range _CHECKSUM_NAMES {
+		if strings.EqualFold(n, name) == true {
+			return uint8(i), nil
+		}
+	}
+
+	errMsg := fmt.Sprintf("Unknown block checksum: '%s'", name)
+	return 0, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+}
+
+// blockHasher computes the checksums of the blocks. The checksum is stored
+// big endian: the first 32 bits are the value reported to the listeners and
+// stored in the block index (the XXHash32 of the block for streams of
+// version 8). Stateless, shared by the tasks.
+type blockHasher struct {
+	kind uint8
+	xx32 *hash.XXHash32
+	xx64 *hash.XXHash64
+}
+
+func newBlockHasher(kind uint8) (*blockHasher, error) {
+	if int(kind) >= len(_CHECKSUM_NAMES) {
+		errMsg := fmt.Sprintf("Invalid bitstream, unknown block checksum type: %d", kind)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	this := &blockHasher{kind: kind}
+	var err error
+
+	switch kind {
+	case CHECKSUM_TYPE_XXHASH32:
+		this.xx32, err = hash.NewXXHash32(_BITSTREAM_TYPE)
+
+	case CHECKSUM_TYPE_XXHASH64:
+		this.xx64, err = hash.NewXXHash64(_BITSTREAM_TYPE)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Name of the checksum algorithm
+func (this *blockHasher) name() string {
+	return _CHECKSUM_NAMES[this.kind]
+}
+
+// Size of the checksum in bits
+func (this *blockHasher) bits() uint {
+	return _CHECKSUM_BITS[this.kind]
+}
+
+// Write the checksum of data to dst (at least 32 bytes) and return its first
+// 32 bits
+func (this *blockHasher) sum(data, dst []byte) uint32 {
+	switch this.kind {
+	case CHECKSUM_TYPE_XXHASH32:
+		binary.BigEndian.PutUint32(dst, this.xx32.Hash(data))
+
+	case CHECKSUM_TYPE_XXHASH64:
+		binary.BigEndian.PutUint64(dst, this.xx64.Hash(data))
+
+	default:
+		h := sha256.Sum256(data)
+		copy(dst, h[:])
+	}
+
+	return binary.BigEndian.Uint32(dst)
+}
+
+// VerifyReport the result of VerifyStream
+type VerifyReport struct {
+	Streams  int    // number of (concatenated) streams
+	Blocks   int    // number of blocks
+	Bytes    int64  // size of the original data
+	Checksum string // block checksum of the last stream (empty if none)
+	Digest   bool   // the digest of the original data of the last stream has been verified
+}
+
+// VerifyStream decodes the compressed stream and checks the integrity of the
+// data (block checksums and digest of the original data, if present in the
+// stream) without writing the original data. Returns an error if the stream
+// is invalid or corrupted. The reader is not closed.
+func VerifyStream(is io.ReadCloser, jobs uint) (*VerifyReport, error) {
+	cis, err := NewCompressedInputStream(is, jobs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &VerifyReport{}
+
+	for {
+		blk, err := cis.NextBlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if blk == nil {
+			break
+		}
+
+		res.Blocks++
+		res.Bytes += int64(len(blk.Data))
+	}
+
+	res.Streams = cis.streams
+
+	res.Digest = cis.dataDigest != nil
+
+	if cis.hasher != nil {
+		res.Checksum = cis.hasher.name()
+	}
+
+	cis.Close()
+	return res, nil
+}
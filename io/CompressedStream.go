@@ -16,8 +16,13 @@ limitations under the License.
 package io
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -25,7 +30,6 @@ import (
 	"github.com/flanglet/kanzi-go/bitstream"
 	"github.com/flanglet/kanzi-go/entropy"
 	"github.com/flanglet/kanzi-go/function"
-	"github.com/flanglet/kanzi-go/util/hash"
 )
 
 // Write to/read from stream using a 2 step process:
@@ -35,12 +39,13 @@ import (
 // Decoding is the exact reverse process.
 
 const (
-	_BITSTREAM_TYPE             = 0x4B414E5A // "KANZ"
-	_BITSTREAM_FORMAT_VERSION   = 8
+	_BITSTREAM_TYPE             = STREAM_MAGIC
+	_BITSTREAM_FORMAT_VERSION   = STREAM_FORMAT_VERSION
 	_STREAM_DEFAULT_BUFFER_SIZE = 256 * 1024
 	_EXTRA_BUFFER_SIZE          = 256
-	_COPY_BLOCK_MASK            = 0x80
-	_TRANSFORMS_MASK            = 0x10
+	_COPY_BLOCK_MASK            = BLOCK_MODE_COPY
+	_TRANSFORM_SKIP_MASK        = 0xFF
+	_TRANSFORMS_MASK            = BLOCK_MODE_TRANSFORMS
 	_MIN_BITSTREAM_BLOCK_SIZE   = 1024
 	_MAX_BITSTREAM_BLOCK_SIZE   = 1024 * 1024 * 1024
 	_SMALL_BLOCK_SIZE           = 15
@@ -49,12 +54,16 @@ const (
 
 var (
 	_EMPTY_BYTE_SLICE = make([]byte, 0)
+
+	// Block buffers recycled by the output streams (the tasks may grow them)
+	_BLOCK_BUFFERS = sync.Pool{New: func() interface{} { return &blockBuffer{Buf: _EMPTY_BYTE_SLICE} }}
 )
 
 // IOError an extended error containing a message and a code value
 type IOError struct {
 	msg  string
 	code int
+	err  error // underlying error (nil if none)
 }
 
 // NewIOError creates a new instance of IOError
@@ -77,6 +86,19 @@ func (this IOError) ErrorCode() int {
 	return this.code
 }
 
+// Unwrap returns the underlying error (nil if none). The failures to decode
+// a block unwrap to a *kanzi.ErrCorruptStream locating the block.
+func (this IOError) Unwrap() error {
+	return this.err
+}
+
+// Create an IOError for a block that cannot be decoded. The position of the
+// block in the input bitstream is provided in bits.
+func newCorruptBlockError(msg string, code int, blockID int, pos uint64, cause error) *IOError {
+	corrupt := &kanzi.ErrCorruptStream{Block: blockID, Offset: int64(pos >> 3), Msg: msg, Err: cause}
+	return &IOError{msg: msg, code: code, err: corrupt}
+}
+
 type blockBuffer struct {
 	// Enclose a buffer in a struct to share it between stream and tasks
 	// and reduce memory allocation.
@@ -84,39 +106,173 @@ type blockBuffer struct {
 	Buf []byte
 }
 
+// Block headers are written (read) sequentially by the tasks, in block order.
+// In compact mode, the mode (with skip flags) and the block length identical
+// to those of the previous block are encoded as a single bit.
+type blockHeaderCodec struct {
+	compact   bool
+	valid     bool // previous header available
+	mode      byte
+	skipFlags byte
+	length    uint
+}
+
+func (this *blockHeaderCodec) write(obs kanzi.OutputBitStream, mode, skipFlags byte, length uint) {
+	dataSize := 1 + uint((mode>>5)&0x03)
+	sameMode := this.valid && mode == this.mode && skipFlags == this.skipFlags
+	sameLength := this.valid && length == this.length
+
+	if this.compact == true && sameMode == true {
+		obs.WriteBit(1)
+	} else {
+		if this.compact == true {
+			obs.WriteBit(0)
+		}
+
+		obs.WriteBits(uint64(mode), 8)
+
+		if mode&_TRANSFORMS_MASK != 0 {
+			obs.WriteBits(uint64(skipFlags), 8)
+		}
+	}
+
+	if this.compact == true && sameLength == true {
+		obs.WriteBit(1)
+	} else {
+		if this.compact == true {
+			obs.WriteBit(0)
+		}
+
+		obs.WriteBits(uint64(length), 8*dataSize)
+	}
+
+	this.valid = true
+	this.mode = mode
+	this.skipFlags = skipFlags
+	this.length = length
+}
+
+// Return mode, skip flags byte (0 if absent) and block length
+func (this *blockHeaderCodec) read(ibs kanzi.InputBitStream) (byte, byte, uint, *IOError) {
+	var mode, skipFlags byte
+
+	if this.compact == true && ibs.ReadBit() == 1 {
+		if this.valid == false {
+			return 0, 0, 0, NewIOError("Invalid block header: no previous block mode", kanzi.ERR_READ_FILE)
+		}
+
+		mode = this.mode
+		skipFlags = this.skipFlags
+	} else {
+		mode = byte(ibs.ReadBits(8))
+
+		if mode&_TRANSFORMS_MASK != 0 {
+			skipFlags = byte(ibs.ReadBits(8))
+		}
+	}
+
+	var length uint
+
+	if this.compact == true && ibs.ReadBit() == 1 {
+		if this.valid == false {
+			return 0, 0, 0, NewIOError("Invalid block header: no previous block length", kanzi.ERR_READ_FILE)
+		}
+
+		length = this.length
+	} else {
+		dataSize := 1 + uint((mode>>5)&0x03)
+		length = uint(ibs.ReadBits(8 * dataSize))
+	}
+
+	this.valid = true
+	this.mode = mode
+	this.skipFlags = skipFlags
+	this.length = length
+	return mode, skipFlags, length, nil
+}
+
+// A memory buffer receiving the entropy coded block before it is copied to
+// the bitstream
+type entropyBuffer struct {
+	bytes.Buffer
+}
+
+func (this *entropyBuffer) Close() error {
+	return nil
+}
+
 // CompressedOutputStream a Writer that writes compressed data
 // to an OutputBitStream.
 type CompressedOutputStream struct {
 	blockSize     uint
 	nbInputBlocks uint8
-	hasher        *hash.XXHash32
+	hasher        *blockHasher
+	dataDigest    hash.Hash    // SHA-256 of the original data (nil if none)
+	parity        *parityCodec // nil if the blocks have no parity shards
+	dictionaries  *streamDictionaries
+	syncPoints    bool
+	partialBlocks bool // Flush writes the buffered data as a partial block
+	sections      bool
+	small         bool   // single block stream with a small header
+	smallSize     uint   // largest data written as a small stream
+	synced        uint64 // bits written at the last sync marker
+	flusher       interface{ Flush() error }
 	data          []byte
-	buffers       []blockBuffer
+	coders        []*entropy.EncoderCache // entropy encoders reused by each task
+	scratch       []entropyBuffer         // entropy coded blocks of each task
 	entropyType   uint32
 	transformType uint64
 	obs           kanzi.OutputBitStream
+	headers       *blockHeaderCodec
+	monitor       *RatioMonitor
+	race          *transformRace
+	digest        *digestWriter
+	encryption    *encryptWriter
+	index         *blockIndex
+	hooks         map[int]BlockHook
+	blkListeners  []BlockListener
+	metrics       metricsReporter
 	initialized   int32
 	closed        int32
 	blockID       int
 	curIdx        int
+	frameStart    int // start of the data buffered since the last partial block
 	jobs          int
-	channels      []chan error
+	tasks         int        // blocks encoded concurrently
+	slots         chan int   // free task slots (coders and scratch buffers)
+	last          chan error // completion of the last block in flight (nil if none)
 	listeners     []kanzi.Listener
+	tpaqModel     *entropy.TPAQSharedModel
+	textCodec     *function.TextCodec // text codec shared by the blocks (nil if none)
 	ctx           map[string]interface{}
 }
 
 type encodingTask struct {
 	iBuffer            *blockBuffer
 	oBuffer            *blockBuffer
-	hasher             *hash.XXHash32
+	hasher             *blockHasher
+	parity             *parityCodec
 	blockLength        uint
 	blockTransformType uint64
 	blockEntropyType   uint32
+	coders             *entropy.EncoderCache
+	scratch            *entropyBuffer
 	currentBlockID     int
+	partial            bool // partial block (continued by the next block)
 	input              chan error
 	output             chan error
 	listeners          []kanzi.Listener
 	obs                kanzi.OutputBitStream
+	headers            *blockHeaderCodec
+	monitor            *RatioMonitor
+	policy             int // ratio policy applied to this block
+	race               *transformRace
+	index              *blockIndex
+	hooks              map[int]BlockHook
+	blkListeners       []BlockListener
+	metrics            metricsReporter
+	tpaqModel          *entropy.TPAQSharedModel
+	textCodec          *function.TextCodec
 	ctx                map[string]interface{}
 }
 
@@ -132,7 +288,42 @@ func NewCompressedOutputStream(os io.WriteCloser, codec, transform string, block
 }
 
 // NewCompressedOutputStreamWithCtx creates a new instance of CompressedOutputStream using a
-// map of parameters
+// map of parameters. If "passphrase" (string) or "encryptionKey" ([]byte of
+// ENCRYPTION_KEY_SIZE bytes) is set, the compressed stream is encrypted and
+// authenticated (AES-256-GCM). If "syncPoints" is set to true, Flush can be
+// called to write the buffered data with a sync marker. If "partialBlocks"
+// is also set to true, Flush writes the data of an incomplete block as a
+// partial block continued by the next block (not compatible with "index",
+// see BLOCK_MODE_PARTIAL). If "maxMemory"
+// (uint64, in bytes) is set, fewer blocks are encoded concurrently for the
+// estimated memory of the blocks (see DescribePipeline) to fit in it. The
+// block buffers are recycled across the streams. If "headerSections" is set
+// to true, the header describes the transform chain and the entropy codec in
+// extensible sections (stream version 10, see SECTION_TRANSFORMS). If
+// "compactHeaders" is set to true, the headers of the blocks with the same
+// mode and length as the previous block take one bit (stream version 9 at
+// least, not compatible with "index"). If "textEscapeRuns" is set to true,
+// the text codec groups the escaped bytes. If "textMarkup" is set to true,
+// the text codec tokenizes the markup of XML/HTML text. If "textRetain" is
+// set to true, the dynamic dictionary of the text codec carries over from one
+// block to the next: the blocks are encoded one at a time (not compatible
+// with "index", "syncPoints" and "raceTransform") and the decoder requires
+// "textRetain" too. If "textChunkSize" is set, the text codec splits the
+// blocks bigger than the chunk size in chunks (all four: stream version 9 at
+// least, see function.HasTextExtensions). If "lzCoders" is set, the ROLZ
+// codec selects the entropy coder of each stream. If "rolzLogPosChecks" is
+// set, the ROLZ codecs check 2^n positions per context (both: stream version
+// 9 at least if not the default, see function.HasROLZExtensions). If
+// "rltWidth" is set (EG. function.RLT_WIDTH_AUTO), the RLT processes runs of
+// wide symbols (stream version 9 at least if not function.RLT_WIDTH_BYTE, see
+// function.HasRLTExtensions). If "packedIndex" is set to true (with
+// "index"), the block index is written in pages of entropy coded entries
+// that a CompressedReader loads on demand (see INDEX_PACKED_MAGIC). The data
+// written before Close is written as a small stream (single block, header of
+// a few bytes, see SMALL_STREAM_MAGIC) if it is at most
+// "smallStreamThreshold" bytes (uint, EG. SMALL_STREAM_THRESHOLD, 0 by
+// default: disabled) and if the stream uses no feature of the extended
+// header. The decoders of version 8 cannot read the small streams.
 func NewCompressedOutputStreamWithCtx(os io.WriteCloser, ctx map[string]interface{}) (*CompressedOutputStream, error) {
 	if os == nil {
 		return nil, NewIOError("Invalid null writer parameter", kanzi.ERR_CREATE_STREAM)
@@ -142,49 +333,118 @@ func NewCompressedOutputStreamWithCtx(os io.WriteCloser, ctx map[string]interfac
 		return nil, NewIOError("Invalid null context parameter", kanzi.ERR_CREATE_STREAM)
 	}
 
+	params, err := parseOutputParams(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newCompressedOutputStream(os, ctx, params)
+}
+
+// The validated parameters of an output stream
+type outputParams struct {
+	entropyType   uint32
+	transformType uint64
+	blockSize     uint
+	jobs          uint
+	tasks         uint // blocks encoded concurrently (bounded by 'maxMemory')
+	nbInputBlocks uint8
+	checksum      bool
+	checksumType  uint8               // see CHECKSUM_TYPE_XXHASH32
+	streamDigest  bool                // digest of the original data written after the end block
+	parityShards  uint                // parity shards of each block (0 if none)
+	dictionaries  *streamDictionaries // preset dictionaries in the header (nil if none)
+	syncPoints    bool                // sync markers written by Flush
+	partialBlocks bool                // Flush writes partial blocks (requires syncPoints)
+	sections      bool                // self-describing header (version 10)
+	compact       bool                // compact block headers (version 9)
+	smallSize     uint                // largest data written as a small stream (0 if disabled)
+	textRetain    bool                // text dictionary retained across blocks (one block at a time)
+	index         bool                // block index written at the end of the stream
+	packedIndex   bool                // pages of entropy coded index entries
+	race          *raceParams         // nil if there is no race of transform chains
+	digest        string              // digest of the compressed output (empty if none)
+	encryption    *encryptionParams   // nil if the stream is not encrypted
+}
+
+// Validate the parameters of an output stream in the context map.
+// Panics if a parameter is missing or if a codec or transform name is unknown.
+func parseOutputParams(ctx map[string]interface{}) (outputParams, error) {
+	var res outputParams
 	entropyCodec := ctx["codec"].(string)
 	transform := ctx["transform"].(string)
 	tasks := ctx["jobs"].(uint)
 
 	if tasks == 0 || tasks > _MAX_CONCURRENCY {
 		errMsg := fmt.Sprintf("The number of jobs must be in [1..%v]", _MAX_CONCURRENCY)
-		return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+		return res, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
 	}
 
 	bSize := ctx["blockSize"].(uint)
 
 	if bSize > _MAX_BITSTREAM_BLOCK_SIZE {
 		errMsg := fmt.Sprintf("The block size must be at most %d MB", _MAX_BITSTREAM_BLOCK_SIZE>>20)
-		return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+		return res, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
 	}
 
 	if bSize < _MIN_BITSTREAM_BLOCK_SIZE {
 		errMsg := fmt.Sprintf("The block size must be at least %d", _MIN_BITSTREAM_BLOCK_SIZE)
-		return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+		return res, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
 	}
 
 	if int(bSize)&-16 != int(bSize) {
-		return nil, NewIOError("The block size must be a multiple of 16", kanzi.ERR_CREATE_STREAM)
+		return res, NewIOError("The block size must be a multiple of 16", kanzi.ERR_CREATE_STREAM)
 	}
 
 	if uint64(bSize)*uint64(tasks) >= uint64(1<<31) {
 		tasks = (1 << 31) / bSize
 	}
 
-	this := new(CompressedOutputStream)
-	var err error
+	// Check entropy type validity (panic on error)
+	res.entropyType = entropy.GetType(entropyCodec)
 
-	if this.obs, err = bitstream.NewDefaultOutputBitStream(os, _STREAM_DEFAULT_BUFFER_SIZE); err != nil {
-		return nil, err
+	if val, containsKey := ctx["tpaqModels"]; containsKey {
+		if models, ok := val.(int); ok == false || models < 0 || models > entropy.TPAQ_MODEL_ALL {
+			errMsg := fmt.Sprintf("The TPAQ models must be a bit mask in [0..%d]", entropy.TPAQ_MODEL_ALL)
+			return res, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+		}
 	}
 
-	// Check entropy type validity (panic on error)
-	this.entropyType = entropy.GetType(entropyCodec)
+	for _, key := range [...]string{"tpaq:extra", "tpaq:mix2", "tpaq:warm", "cm:order2"} {
+		if val, containsKey := ctx[key]; containsKey {
+			if _, ok := val.(bool); ok == false {
+				errMsg := fmt.Sprintf("The entropy option '%s' must be a boolean", key)
+				return res, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+			}
+		}
+	}
+
+	if val, containsKey := ctx["entropy:lanes"]; containsKey {
+		if lanes, ok := val.(uint); ok == false || lanes < 1 || lanes > entropy.LANES_MAX {
+			errMsg := fmt.Sprintf("The number of entropy lanes must be in [1..%d]", entropy.LANES_MAX)
+			return res, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+		}
+
+		if warm, _ := ctx["tpaq:warm"].(bool); warm == true && entropy.HasEntropyLanes(ctx, res.entropyType) == true {
+			return res, NewIOError("The entropy lanes and the TPAQ warm model are mutually exclusive", kanzi.ERR_CREATE_STREAM)
+		}
+	}
 
 	// Check transform type validity (panic on error)
-	this.transformType = function.GetType(transform)
+	res.transformType = function.GetType(transform)
+	var err error
+
+	if res.race, err = parseRaceParams(ctx, res.transformType); err != nil {
+		return res, err
+	}
 
-	this.blockSize = bSize
+	if res.race != nil {
+		res.transformType = res.race.transformType()
+	}
+
+	res.blockSize = bSize
+	res.jobs = tasks
 	nbBlocks := uint8(0)
 
 	// If input size has been provided, calculate the number of blocks
@@ -198,34 +458,229 @@ func NewCompressedOutputStreamWithCtx(os io.WriteCloser, ctx map[string]interfac
 	}
 
 	if nbBlocks > 63 {
-		this.nbInputBlocks = 63
+		res.nbInputBlocks = 63
 	} else {
-		this.nbInputBlocks = nbBlocks
+		res.nbInputBlocks = nbBlocks
 	}
 
-	checksum := ctx["checksum"].(bool)
+	res.checksum = ctx["checksum"].(bool)
 
-	if checksum == true {
-		this.hasher, err = hash.NewXXHash32(_BITSTREAM_TYPE)
+	if val, containsKey := ctx["checksumType"]; containsKey {
+		if res.checksumType, err = getChecksumType(val.(string)); err != nil {
+			return res, err
+		}
 
-		if err != nil {
+		if res.checksum == false && res.checksumType != CHECKSUM_TYPE_XXHASH32 {
+			return res, NewIOError("The block checksum type requires the checksum option", kanzi.ERR_CREATE_STREAM)
+		}
+	}
+
+	if val, containsKey := ctx["streamDigest"]; containsKey {
+		res.streamDigest = val.(bool)
+	}
+
+	if val, containsKey := ctx["parityShards"]; containsKey {
+		res.parityShards = val.(uint)
+
+		if _, err := getParityLevel(res.parityShards); err != nil {
+			return res, err
+		}
+	}
+
+	if res.dictionaries, err = parseStreamDictionaries(ctx); err != nil {
+		return res, err
+	}
+
+	res.tasks = res.jobs
+
+	if val, containsKey := ctx["maxMemory"]; containsKey {
+		if res.tasks, err = getMaxTasks(ctx, val.(uint64), res.jobs); err != nil {
+			return res, err
+		}
+	}
+
+	if val, containsKey := ctx["index"]; containsKey {
+		if res.index, _ = val.(bool); res.index == true {
+			if warm, _ := ctx["tpaq:warm"].(bool); warm == true {
+				return res, NewIOError("The block index and the TPAQ warm model are mutually exclusive", kanzi.ERR_CREATE_STREAM)
+			}
+		}
+	}
+
+	if val, containsKey := ctx["packedIndex"]; containsKey {
+		if res.packedIndex, _ = val.(bool); res.packedIndex == true && res.index == false {
+			return res, NewIOError("The packed index requires the block index", kanzi.ERR_CREATE_STREAM)
+		}
+	}
+
+	if val, containsKey := ctx["compactHeaders"]; containsKey {
+		if res.compact, _ = val.(bool); res.compact == true && res.index == true {
+			return res, NewIOError("The block index and the compact block headers are mutually exclusive", kanzi.ERR_CREATE_STREAM)
+		}
+	}
+
+	if val, containsKey := ctx["syncPoints"]; containsKey {
+		if res.syncPoints, _ = val.(bool); res.syncPoints == true {
+			// The blocks following a sync marker must be decodable
+			if warm, _ := ctx["tpaq:warm"].(bool); warm == true {
+				return res, NewIOError("The sync points and the TPAQ warm model are mutually exclusive", kanzi.ERR_CREATE_STREAM)
+			}
+		}
+	}
+
+	if val, containsKey := ctx["partialBlocks"]; containsKey {
+		if res.partialBlocks, _ = val.(bool); res.partialBlocks == true {
+			if res.syncPoints == false {
+				return res, NewIOError("The partial blocks require the sync points", kanzi.ERR_CREATE_STREAM)
+			}
+
+			// A partial block cannot be decoded without the previous one
+			if res.index == true {
+				return res, NewIOError("The block index and the partial blocks are mutually exclusive", kanzi.ERR_CREATE_STREAM)
+			}
+		}
+	}
+
+	if val, containsKey := ctx["textRetain"]; containsKey {
+		if res.textRetain, _ = val.(bool); res.textRetain == true {
+			// Each block needs the dictionary of the previous block
+			if res.index == true || res.syncPoints == true || res.race != nil {
+				return res, NewIOError("The retained text dictionary is not compatible with the block index, the sync points and the race of transforms", kanzi.ERR_CREATE_STREAM)
+			}
+
+			res.textRetain = hasTextStage(res.transformType)
+
+			if res.textRetain == true {
+				// The blocks are transformed in block order
+				res.tasks = 1
+			}
+		}
+	}
+
+	if val, containsKey := ctx["headerSections"]; containsKey {
+		res.sections, _ = val.(bool)
+	}
+
+	if val, containsKey := ctx["smallStreamThreshold"]; containsKey {
+		if res.smallSize, _ = val.(uint); res.smallSize > SMALL_STREAM_BLOCK_SIZE {
+			errMsg := fmt.Sprintf("The small stream threshold must be at most %d bytes", SMALL_STREAM_BLOCK_SIZE)
+			return res, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+		}
+	}
+
+	if val, containsKey := ctx["outputDigest"]; containsKey {
+		res.digest = val.(string)
+
+		if _, err := newDigestHash(res.digest); err != nil {
+			return res, err
+		}
+	}
+
+	if res.encryption, err = parseEncryptionParams(ctx); err != nil {
+		return res, err
+	}
+
+	if res.encryption != nil && res.index == true {
+		// The offsets of the blocks are not available in the encrypted stream
+		return res, NewIOError("The block index and the encryption are mutually exclusive", kanzi.ERR_CREATE_STREAM)
+	}
+
+	return res, nil
+}
+
+func newCompressedOutputStream(os io.WriteCloser, ctx map[string]interface{}, params outputParams) (*CompressedOutputStream, error) {
+	this := new(CompressedOutputStream)
+	var err error
+
+	// Flush also flushes the underlying writer (EG. bufio.Writer)
+	this.flusher, _ = os.(interface{ Flush() error })
+
+	if len(params.digest) != 0 {
+		if this.digest, err = newDigestWriter(os, params.digest); err != nil {
 			return nil, err
 		}
+
+		os = this.digest
 	}
 
-	this.jobs = int(tasks)
+	// The digest of the output covers the encrypted stream
+	if params.encryption != nil {
+		if this.encryption, err = newEncryptWriter(os, params.encryption); err != nil {
+			return nil, err
+		}
+
+		os = this.encryption
+	}
+
+	if this.obs, err = bitstream.NewDefaultOutputBitStream(os, _STREAM_DEFAULT_BUFFER_SIZE); err != nil {
+		return nil, err
+	}
+
+	this.entropyType = params.entropyType
+	this.transformType = params.transformType
+	this.blockSize = params.blockSize
+	this.nbInputBlocks = params.nbInputBlocks
+
+	if params.race != nil {
+		this.race = newTransformRace(*params.race)
+	}
+
+	if params.checksum == true {
+		if this.hasher, err = newBlockHasher(params.checksumType); err != nil {
+			return nil, err
+		}
+	}
+
+	if params.streamDigest == true {
+		this.dataDigest = sha256.New()
+	}
+
+	if params.parityShards != 0 {
+		this.parity = newParityCodec(int(params.parityShards))
+	}
+
+	this.dictionaries = params.dictionaries
+	this.syncPoints = params.syncPoints
+	this.partialBlocks = params.partialBlocks
+	this.sections = params.sections
+	this.smallSize = params.smallSize
+
+	this.jobs = int(params.jobs)
+	this.tasks = int(params.tasks)
 	this.data = make([]byte, 0)
-	this.buffers = make([]blockBuffer, 2*this.jobs)
+	this.coders = make([]*entropy.EncoderCache, this.tasks)
 
-	for i := range this.buffers {
-		this.buffers[i] = blockBuffer{Buf: _EMPTY_BYTE_SLICE}
+	for i := range this.coders {
+		this.coders[i] = entropy.NewEncoderCache()
+	}
+
+	this.scratch = make([]entropyBuffer, this.tasks)
+
+	// The TPAQ model is kept warm across blocks (entropy coding is sequential)
+	if warm, _ := ctx["tpaq:warm"].(bool); warm == true {
+		if this.entropyType == entropy.TPAQ_TYPE || this.entropyType == entropy.TPAQX_TYPE {
+			this.tpaqModel = entropy.NewTPAQSharedModel()
+		}
+	}
+
+	// The text dictionary is retained across blocks (one task)
+	if params.textRetain == true {
+		if this.textCodec, err = function.NewStreamTextCodec(ctx); err != nil {
+			return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_STREAM)
+		}
 	}
 
 	this.blockID = 0
-	this.channels = make([]chan error, this.jobs+1)
+	this.slots = make(chan int, this.tasks)
 
-	for i := range this.channels {
-		this.channels[i] = make(chan error)
+	for i := 0; i < this.tasks; i++ {
+		this.slots <- i
+	}
+
+	this.headers = &blockHeaderCodec{compact: params.compact}
+
+	if params.index == true {
+		this.index = &blockIndex{packed: params.packedIndex}
 	}
 
 	this.listeners = make([]kanzi.Listener, 0)
@@ -261,51 +716,172 @@ func (this *CompressedOutputStream) RemoveListener(bl kanzi.Listener) bool {
 	return false
 }
 
+// SetRatioMonitor sets the monitor of the compression ratio (nil to remove).
+// The policy of a triggered monitor applies from the next group of blocks
+// processed concurrently. Must not be called concurrently with Write.
+func (this *CompressedOutputStream) SetRatioMonitor(monitor *RatioMonitor) {
+	this.monitor = monitor
+}
+
 func (this *CompressedOutputStream) writeHeader() *IOError {
+	if this.small == true {
+		return this.writeSmallHeader()
+	}
+
 	cksum := 0
 
 	if this.hasher != nil {
 		cksum = 1
 	}
 
-	if this.obs.WriteBits(_BITSTREAM_TYPE, 32) != 32 {
+	if this.obs.WriteBits(_BITSTREAM_TYPE, HEADER_MAGIC_BITS) != HEADER_MAGIC_BITS {
 		return NewIOError("Cannot write bitstream type to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	if this.obs.WriteBits(_BITSTREAM_FORMAT_VERSION, 5) != 5 {
+	// The oldest version with the features of the stream is written. The
+	// decoders of version 8 reject the streams of a later version: the flags
+	// reserved in version 8 (compact block headers, entropy options, entropy
+	// lanes) must be 0 in version 8. The blocks coded with the extensions of
+	// the transforms (EG. text codec extensions, ROLZ coders) cannot be
+	// decoded by the decoders of version 8 either.
+	version := uint64(STREAM_MIN_VERSION)
+	transformExtensions := function.HasExtensions(this.ctx, this.transformType)
+	compact := 0
+	entropyOptions := 0
+	entropyLanes := 0
+	checksumType := uint64(CHECKSUM_TYPE_XXHASH32)
+	digest := 0
+	dictionaries := 0
+	syncPoints := 0
+	partialBlocks := 0
+	parityLevel := uint8(0)
+
+	if this.hasher != nil {
+		checksumType = uint64(this.hasher.kind)
+	}
+
+	if this.dataDigest != nil {
+		digest = 1
+	}
+
+	if this.parity != nil {
+		parityLevel, _ = getParityLevel(uint(this.parity.parityShards))
+	}
+
+	if this.dictionaries != nil {
+		dictionaries = 1
+	}
+
+	if this.syncPoints == true {
+		syncPoints = 1
+	}
+
+	if this.partialBlocks == true {
+		partialBlocks = 1
+	}
+
+	if this.headers.compact == true {
+		compact = 1
+	}
+
+	if entropy.HasEntropyOptions(this.ctx, this.entropyType) == true {
+		entropyOptions = 1
+	}
+
+	if entropy.HasEntropyLanes(this.ctx, this.entropyType) == true {
+		entropyLanes = 1
+	}
+
+	if this.sections == true {
+		version = STREAM_SECTIONS_VERSION
+	} else if checksumType != CHECKSUM_TYPE_XXHASH32 || digest != 0 || parityLevel != 0 || dictionaries != 0 || syncPoints != 0 || partialBlocks != 0 || compact != 0 || entropyOptions != 0 || entropyLanes != 0 || transformExtensions == true {
+		version = STREAM_EXT_VERSION
+	}
+
+	if this.obs.WriteBits(version, HEADER_VERSION_BITS) != HEADER_VERSION_BITS {
 		return NewIOError("Cannot write bitstream version to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	if this.obs.WriteBits(uint64(cksum), 1) != 1 {
+	if this.obs.WriteBits(uint64(cksum), HEADER_CHECKSUM_BITS) != HEADER_CHECKSUM_BITS {
 		return NewIOError("Cannot write checksum to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	if this.obs.WriteBits(uint64(this.entropyType), 5) != 5 {
+	if this.obs.WriteBits(uint64(this.entropyType), HEADER_ENTROPY_BITS) != HEADER_ENTROPY_BITS {
 		return NewIOError("Cannot write entropy type to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	if this.obs.WriteBits(uint64(this.transformType), 48) != 48 {
+	if this.obs.WriteBits(uint64(this.transformType), HEADER_TRANSFORM_BITS) != HEADER_TRANSFORM_BITS {
 		return NewIOError("Cannot write transform types to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	if this.obs.WriteBits(uint64(this.blockSize>>4), 28) != 28 {
+	if this.obs.WriteBits(uint64(this.blockSize>>4), HEADER_BLOCK_SIZE_BITS) != HEADER_BLOCK_SIZE_BITS {
 		return NewIOError("Cannot write block size to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	if this.obs.WriteBits(uint64(this.nbInputBlocks), 6) != 6 {
+	if this.obs.WriteBits(uint64(this.nbInputBlocks), HEADER_NB_BLOCKS_BITS) != HEADER_NB_BLOCKS_BITS {
 		return NewIOError("Cannot write number of blocks to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	if this.obs.WriteBits(0, 3) != 3 {
-		return NewIOError("Cannot write reserved bits to header", kanzi.ERR_WRITE_FILE)
+	if this.obs.WriteBits(uint64(compact), HEADER_COMPACT_BITS) != HEADER_COMPACT_BITS {
+		return NewIOError("Cannot write block header mode to header", kanzi.ERR_WRITE_FILE)
 	}
 
-	return nil
+	if this.obs.WriteBits(uint64(entropyOptions), HEADER_ENTROPY_OPTIONS_BITS) != HEADER_ENTROPY_OPTIONS_BITS {
+		return NewIOError("Cannot write entropy options flag to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.obs.WriteBits(uint64(entropyLanes), HEADER_ENTROPY_LANES_BITS) != HEADER_ENTROPY_LANES_BITS {
+		return NewIOError("Cannot write entropy lanes flag to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if version == STREAM_MIN_VERSION {
+		return nil
+	}
+
+	if this.obs.WriteBits(checksumType, HEADER_CHECKSUM_TYPE_BITS) != HEADER_CHECKSUM_TYPE_BITS {
+		return NewIOError("Cannot write checksum type to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.obs.WriteBits(uint64(digest), HEADER_DIGEST_BITS) != HEADER_DIGEST_BITS {
+		return NewIOError("Cannot write digest flag to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.obs.WriteBits(uint64(parityLevel), HEADER_PARITY_BITS) != HEADER_PARITY_BITS {
+		return NewIOError("Cannot write parity level to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.obs.WriteBits(uint64(dictionaries), HEADER_DICTIONARIES_BITS) != HEADER_DICTIONARIES_BITS {
+		return NewIOError("Cannot write dictionaries flag to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.obs.WriteBits(uint64(syncPoints), HEADER_SYNC_BITS) != HEADER_SYNC_BITS {
+		return NewIOError("Cannot write sync points flag to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.obs.WriteBits(uint64(partialBlocks), HEADER_PARTIAL_BITS) != HEADER_PARTIAL_BITS {
+		return NewIOError("Cannot write partial blocks flag to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.dictionaries != nil {
+		if err := this.dictionaries.write(this.obs); err != nil {
+			return err
+		}
+	}
+
+	if version < STREAM_SECTIONS_VERSION {
+		return nil
+	}
+
+	features := entropyFeatures(entropyOptions == 1, entropyLanes == 1)
+	sections := newHeaderSections(this.transformType, this.entropyType, features, this.dictionaries)
+	return writeHeaderSections(this.obs, sections)
 }
 
 // Write writes len(block) bytes from block to the underlying data stream.
 // It returns the number of bytes written from block (0 <= n <= len(block)) and
-// any error encountered that caused the write to stop early.
+// any error encountered that caused the write to stop early. The blocks are
+// encoded concurrently and written in order: the error of a block may be
+// returned by a later call to Write, Flush or Close.
 func (this *CompressedOutputStream) Write(block []byte) (int, error) {
 	if atomic.LoadInt32(&this.closed) == 1 {
 		return 0, NewIOError("Stream closed", kanzi.ERR_WRITE_FILE)
@@ -345,6 +921,76 @@ func (this *CompressedOutputStream) Write(block []byte) (int, error) {
 	return len(block) - remaining, nil
 }
 
+// Flush compresses the buffered data (possibly a block shorter than the block
+// size), writes a sync marker then writes the pending bytes to the underlying
+// writer (and calls its Flush method, if any). The data written before Flush
+// can be decoded without the data written after it: network protocols can
+// bound the latency of the compressed stream. Each call ends the current
+// block: frequent calls decrease the compression ratio. With the partial
+// blocks (context key 'partialBlocks'), the incomplete block is written as
+// a partial block instead: the next block continues the same logical block
+// and its LZ matches can reference the data of the partial blocks.
+// Requires the sync points (context key 'syncPoints'). The encrypted streams
+// are written to the underlying writer by segments.
+func (this *CompressedOutputStream) Flush() error {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return NewIOError("Stream closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.syncPoints == false {
+		return NewIOError("Flush requires the sync points (context key 'syncPoints')", kanzi.ERR_WRITE_FILE)
+	}
+
+	if this.partialBlocks == true {
+		if err := this.encodeFrames(true); err != nil {
+			return err
+		}
+	} else if this.curIdx > 0 {
+		if err := this.processBlock(true); err != nil {
+			return err
+		}
+
+		this.curIdx = 0
+	}
+
+	if err := this.drain(); err != nil {
+		return err
+	}
+
+	if atomic.SwapInt32(&this.initialized, 1) == 0 {
+		if err := this.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	// No sync marker if no block was written since the previous one
+	if this.obs.Written() != this.synced {
+		this.headers.write(this.obs, BLOCK_MODE_SYNC, 0, 0)
+
+		if pad := this.obs.Written() & 7; pad != 0 {
+			this.obs.WriteBits(0, uint(8-pad))
+		}
+
+		this.obs.WriteBits(SYNC_MAGIC, 32)
+
+		// The decoding can resume at the next block header
+		this.headers.valid = false
+		this.synced = this.obs.Written()
+	}
+
+	if f, ok := this.obs.(interface{ Flush() error }); ok == true {
+		if err := f.Flush(); err != nil {
+			return NewIOError(err.Error(), kanzi.ERR_WRITE_FILE)
+		}
+	}
+
+	if this.flusher != nil {
+		return this.flusher.Flush()
+	}
+
+	return nil
+}
+
 // Close writes the buffered data to the output stream then writes
 // a final empty block and releases resources.
 // Close makes the bitstream unavailable for further writes. Idempotent.
@@ -353,6 +999,12 @@ func (this *CompressedOutputStream) Close() error {
 		return nil
 	}
 
+	// Nothing written yet: the data may fit in a small stream
+	if atomic.LoadInt32(&this.initialized) == 0 && this.smallEligible() == true {
+		this.small = true
+		this.headers.compact = false
+	}
+
 	if this.curIdx > 0 {
 		if err := this.processBlock(true); err != nil {
 			return err
@@ -361,23 +1013,62 @@ func (this *CompressedOutputStream) Close() error {
 		this.curIdx = 0
 	}
 
-	// Write end block of size 0
-	this.obs.WriteBits(_COPY_BLOCK_MASK, 8)
-	this.obs.WriteBits(0, 8)
+	if err := this.drain(); err != nil {
+		return err
+	}
+
+	// An empty indexed stream still has a header (read by CompressedReader),
+	// so does an empty stream with a digest
+	if (this.index != nil || this.dataDigest != nil) && atomic.SwapInt32(&this.initialized, 1) == 0 {
+		if err := this.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	// Write end block of size 0 (a small stream has a single block)
+	if this.small == false {
+		this.headers.write(this.obs, _COPY_BLOCK_MASK, 0, 0)
+	}
+
+	if this.dataDigest != nil {
+		// Digest of the original data at the next byte boundary
+		if pad := this.obs.Written() & 7; pad != 0 {
+			this.obs.WriteBits(0, uint(8-pad))
+		}
+
+		this.obs.WriteArray(this.dataDigest.Sum(nil), STREAM_DIGEST_BITS)
+	}
+
+	if this.index != nil {
+		if err := this.index.write(this.obs); err != nil {
+			return err
+		}
+	}
 
 	if _, err := this.obs.Close(); err != nil {
 		return err
 	}
 
+	if this.encryption != nil {
+		// Last segment (authenticates the end of the stream)
+		if err := this.encryption.finish(); err != nil {
+			return err
+		}
+	}
+
 	// Release resources
 	this.data = _EMPTY_BYTE_SLICE
 
-	for i := range this.buffers {
-		this.buffers[i] = blockBuffer{Buf: _EMPTY_BYTE_SLICE}
+	for _, c := range this.coders {
+		c.Clear()
+	}
+
+	for i := range this.scratch {
+		this.scratch[i] = entropyBuffer{}
 	}
 
-	for _, c := range this.channels {
-		close(c)
+	if this.tpaqModel != nil {
+		this.tpaqModel.Release()
 	}
 
 	return nil
@@ -385,10 +1076,10 @@ func (this *CompressedOutputStream) Close() error {
 
 func (this *CompressedOutputStream) processBlock(force bool) error {
 	if force == false {
-		bufSize := this.jobs * int(this.blockSize)
+		bufSize := this.tasks * int(this.blockSize)
 
 		if this.nbInputBlocks > 0 {
-			if int(this.nbInputBlocks) < this.jobs {
+			if int(this.nbInputBlocks) < this.tasks {
 				bufSize = int(this.nbInputBlocks) * int(this.blockSize)
 			}
 		}
@@ -405,78 +1096,269 @@ func (this *CompressedOutputStream) processBlock(force bool) error {
 		return nil
 	}
 
+	if err := this.encodeFrames(false); err != nil {
+		return err
+	}
+
+	this.curIdx = 0
+	this.frameStart = 0
+	return nil
+}
+
+// The part of a logical block written by a block
+type blockFrame struct {
+	prefix  []byte // data of the logical block in the previous blocks
+	partial bool   // the next block continues the logical block
+}
+
+// Return the preset LZ dictionary of a block continuing a partial block: the
+// end of the data of the logical block in the previous blocks (nil if it is
+// too short)
+func continuationDictionary(prefix []byte) *function.LZDictionary {
+	if len(prefix) < function.LZ_MIN_DICT_SIZE {
+		return nil
+	}
+
+	if len(prefix) > function.LZ_MAX_DICT_SIZE {
+		prefix = prefix[len(prefix)-function.LZ_MAX_DICT_SIZE:]
+	}
+
+	dict, _ := function.NewLZDictionary(prefix)
+	return dict
+}
+
+// Encode the data buffered since the last partial block (the whole buffer
+// without partial blocks). The first block continues the logical block of
+// the last partial block, if any. If 'partial' is true, the last block is
+// written as a partial block if it is shorter than the block size.
+func (this *CompressedOutputStream) encodeFrames(partial bool) error {
+	blockSize := int(this.blockSize)
+	start, end := this.frameStart, this.curIdx
+
+	for start < end {
+		var frame *blockFrame
+		blockStart := start - start%blockSize
+		stop := end
+
+		if start > blockStart {
+			// End of the logical block of the last partial block
+			if stop > blockStart+blockSize {
+				stop = blockStart + blockSize
+			}
+
+			frame = &blockFrame{prefix: this.data[blockStart:start]}
+		} else if partial == true && end%blockSize != 0 {
+			// Whole blocks first, then the partial block
+			if stop = end - end%blockSize; stop == start {
+				stop = end
+				frame = &blockFrame{}
+			}
+		}
+
+		if frame != nil {
+			frame.partial = partial == true && stop == end && stop%blockSize != 0
+		}
+
+		if err := this.encodeBlocks(this.data[start:stop], false, frame); err != nil {
+			return err
+		}
+
+		start = stop
+	}
+
+	this.frameStart = end
+	return nil
+}
+
+// Encode the blocks of 'src' (no more than one block per task). The blocks
+// of a mapped file are transformed in place (see MappedFile), the other
+// blocks are copied to block buffers first. If 'frame' is not nil, 'src' is
+// a single block: part of a logical block (see blockFrame).
+func (this *CompressedOutputStream) encodeBlocks(src []byte, mapped bool, frame *blockFrame) error {
 	if atomic.SwapInt32(&this.initialized, 1) == 0 {
 		if err := this.writeHeader(); err != nil {
 			return err
 		}
 	}
 
+	// The data is hashed in stream order (the blocks are encoded concurrently)
+	if this.dataDigest != nil {
+		this.dataDigest.Write(src)
+	}
+
 	offset := uint(0)
+	policy := RATIO_POLICY_NONE
+
+	if this.monitor != nil && this.monitor.Triggered() == true {
+		policy = this.monitor.Policy()
+
+		if policy == RATIO_POLICY_ABORT {
+			errMsg := fmt.Sprintf("Compression ratio over threshold (%.3f), aborting", this.monitor.Percentile())
+			return NewIOError(errMsg, kanzi.ERR_PROCESS_BLOCK)
+		}
+	}
 
 	// Protect against future concurrent modification of the list of block listeners
 	listeners := make([]kanzi.Listener, len(this.listeners))
 	copy(listeners, this.listeners)
-	nbJobs := 0
+
+	// Share the jobs between the tasks (EG. to build the suffix array of a
+	// big block concurrently when there are fewer blocks than jobs)
+	nbTasks := (uint(len(src)) + this.blockSize - 1) / this.blockSize
+
+	if nbTasks > uint(this.tasks) {
+		nbTasks = uint(this.tasks)
+	}
+
+	jobsPerTask := kanzi.ComputeJobsPerTask(make([]uint, nbTasks), uint(this.jobs), nbTasks)
 
 	// Invoke as many go routines as required
-	for jobID := 0; jobID < this.jobs; jobID++ {
-		if this.curIdx == 0 {
+	for jobID := 0; jobID < this.tasks; jobID++ {
+		if offset == uint(len(src)) {
 			break
 		}
 
-		nbJobs = jobID + 1
-		sz := uint(this.curIdx)
+		sz := uint(len(src)) - offset
 
 		if sz >= this.blockSize {
 			sz = this.blockSize
 		}
 
-		if len(this.buffers[2*jobID].Buf) < int(sz) {
-			this.buffers[2*jobID].Buf = make([]byte, sz)
-		}
+		// Wait for a task slot: no more than this.tasks blocks in flight
+		start := time.Now()
+		slot := <-this.slots
+		this.metrics.since(METRIC_WAIT_SECONDS, start)
+
+		var iBuffer *blockBuffer
+		oBuffer := _BLOCK_BUFFERS.Get().(*blockBuffer)
+
+		if mapped == true {
+			// No copy: the capacity of the block ends with the block
+			iBuffer = &blockBuffer{Buf: src[offset : offset+sz : offset+sz]}
+		} else {
+			iBuffer = _BLOCK_BUFFERS.Get().(*blockBuffer)
+
+			if len(iBuffer.Buf) < int(sz) {
+				iBuffer.Buf = make([]byte, sz)
+			}
 
-		copy(this.buffers[2*jobID].Buf, this.data[offset:offset+sz])
+			copy(iBuffer.Buf, src[offset:offset+sz])
+		}
 		copyCtx := make(map[string]interface{})
 
 		for k, v := range this.ctx {
 			copyCtx[k] = v
 		}
 
-		task := encodingTask{
-			iBuffer:            &this.buffers[2*jobID],
-			oBuffer:            &this.buffers[2*jobID+1],
+		copyCtx["jobs"] = jobsPerTask[jobID]
+
+		if this.small == true {
+			// The block size is not in the small stream header
+			copyCtx["blockSize"] = uint(SMALL_STREAM_BLOCK_SIZE)
+		}
+
+		if this.dictionaries != nil {
+			this.dictionaries.setCtx(copyCtx)
+		}
+
+		if frame != nil {
+			if dict := continuationDictionary(frame.prefix); dict != nil {
+				copyCtx["lzDictionary"] = dict
+			}
+		}
+
+		if this.textCodec != nil {
+			copyCtx["textShared"] = this.textCodec
+		}
+
+		input := this.last
+
+		if input == nil {
+			// Allow start of entropy coding for the first block in flight
+			input = make(chan error, 1)
+			input <- error(nil)
+		}
+
+		this.last = make(chan error, 1)
+
+		task := &encodingTask{
+			iBuffer:            iBuffer,
+			oBuffer:            oBuffer,
 			hasher:             this.hasher,
+			parity:             this.parity,
 			blockLength:        sz,
 			blockTransformType: this.transformType,
 			blockEntropyType:   this.entropyType,
+			coders:             this.coders[slot],
+			tpaqModel:          this.tpaqModel,
+			textCodec:          this.textCodec,
+			scratch:            &this.scratch[slot],
 			currentBlockID:     this.blockID + jobID + 1,
-			input:              this.channels[jobID],
-			output:             this.channels[jobID+1],
+			partial:            frame != nil && frame.partial,
+			input:              input,
+			output:             this.last,
 			obs:                this.obs,
+			headers:            this.headers,
+			monitor:            this.monitor,
+			policy:             policy,
+			race:               this.race,
+			index:              this.index,
+			hooks:              this.hooks,
+			blkListeners:       this.blkListeners,
+			metrics:            this.metrics,
 			listeners:          listeners,
 			ctx:                copyCtx}
 
 		// Invoke the tasks concurrently
-		// Tasks are chained through channels. Upon completion of transform
-		// (concurrently) the tasks wait for a signal to start entropy encoding
-		go task.encode()
+		// Tasks are chained through channels. The blocks are transformed and
+		// entropy coded in any order but written in block order: each task
+		// waits for the previous block to be written. The task slot and the
+		// block buffers are recycled once the block is written.
+		go func() {
+			task.encode()
+
+			if mapped == false {
+				_BLOCK_BUFFERS.Put(task.iBuffer)
+			}
+
+			_BLOCK_BUFFERS.Put(task.oBuffer)
+			this.slots <- slot
+		}()
 
+		this.metrics.set(METRIC_QUEUE_DEPTH, float64(this.tasks-len(this.slots)))
 		offset += sz
-		this.curIdx -= int(sz)
 	}
 
-	// Allow start of entropy coding for first block
-	this.channels[0] <- error(nil)
+	this.blockID += this.tasks
 
-	// Wait for completion of last task
-	err := <-this.channels[nbJobs]
+	// Report the error of a block written meanwhile (the blocks in flight
+	// are waited for by Flush and Close)
+	select {
+	case err := <-this.last:
+		this.last = nil
+		this.metrics.set(METRIC_QUEUE_DEPTH, 0)
+		return err
+	default:
+		return nil
+	}
+}
 
-	this.blockID += this.jobs
+// Wait for the blocks in flight to be written to the bitstream
+func (this *CompressedOutputStream) drain() error {
+	if this.last == nil {
+		return nil
+	}
+
+	err := <-this.last
+	this.last = nil
+	this.metrics.set(METRIC_QUEUE_DEPTH, 0)
 	return err
 }
 
-// GetWritten returns the number of bytes written so far
+// GetWritten returns the number of bytes written so far (once the blocks
+// in flight are written)
 func (this *CompressedOutputStream) GetWritten() uint64 {
+	this.drain()
 	return (this.obs.Written() + 7) >> 3
 }
 
@@ -495,10 +1377,24 @@ func (this *encodingTask) encode() {
 	mode := byte(0)
 	var postTransformLength uint
 	checksum := uint32(0)
+	blockStart := time.Now()
+
+	if len(this.blkListeners) > 0 {
+		notifyBlockStart(this.blkListeners, BlockStartEvent{ID: this.currentBlockID,
+			Size: int64(this.blockLength), Time: blockStart})
+	}
+
+	if err := runHook(this.hooks, this.blockInfo(kanzi.EVT_BEFORE_TRANSFORM), data[0:this.blockLength]); err != nil {
+		<-this.input
+		this.output <- NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+		return
+	}
 
 	// Compute block checksum
+	var sum [32]byte
+
 	if this.hasher != nil {
-		checksum = this.hasher.Hash(data[0:this.blockLength])
+		checksum = this.hasher.sum(data[0:this.blockLength], sum[:])
 	}
 
 	if len(this.listeners) > 0 {
@@ -520,21 +1416,25 @@ func (this *encodingTask) encode() {
 		}
 	}()
 
-	if this.blockLength <= _SMALL_BLOCK_SIZE {
-		if this.blockLength == 0 {
+	if this.blockLength <= _SMALL_BLOCK_SIZE || this.policy == RATIO_POLICY_STORE {
+		if this.blockLength == 0 || this.policy == RATIO_POLICY_STORE {
 			this.blockTransformType = function.NONE_TYPE
 			this.blockEntropyType = entropy.NONE_TYPE
 			mode |= byte(_COPY_BLOCK_MASK)
 		}
 	} else {
+		if this.policy == RATIO_POLICY_SKIP_TRANSFORMS {
+			this.blockTransformType = function.NONE_TYPE
+		}
 
 		if skip, prst := this.ctx["skipBlocks"]; prst == true {
 			if skip.(bool) == true {
-				histo := [256]int{}
-				entropy1024 := entropy.ComputeFirstOrderEntropy1024(data[0:this.blockLength], histo[:])
-				//this.ctx["histo0"] = histo
+				// The magic number of a compressed format only lowers the
+				// threshold of the block it starts
+				format := entropy.DetectCompressedFormat(data[0:this.blockLength])
+				sampleSize := entropy.PrecheckSampleSize(int(this.blockLength))
 
-				if entropy1024 >= entropy.INCOMPRESSIBLE_THRESHOLD {
+				if entropy.IsIncompressible(data[0:this.blockLength], sampleSize, format) == true {
 					this.blockTransformType = function.NONE_TYPE
 					this.blockEntropyType = entropy.NONE_TYPE
 					mode |= _COPY_BLOCK_MASK
@@ -543,6 +1443,7 @@ func (this *encodingTask) encode() {
 		}
 	}
 
+	start := time.Now()
 	this.ctx["size"] = this.blockLength
 	t, err := function.NewByteFunction(&this.ctx, this.blockTransformType)
 
@@ -552,15 +1453,34 @@ func (this *encodingTask) encode() {
 		return
 	}
 
-	requiredSize := t.MaxEncodedLen(int(this.blockLength))
+	var tSkipFlags byte
 
-	if len(buffer) < requiredSize {
-		buffer = make([]byte, requiredSize)
-		this.oBuffer.Buf = buffer
+	if this.race != nil && this.blockTransformType != function.NONE_TYPE {
+		// Select the transform chain of the block (race or last winner)
+		postTransformLength, tSkipFlags, err = this.race.run(data[0:this.blockLength], this.oBuffer,
+			this.ctx, this.blockEntropyType, this.metrics)
+
+		if err != nil {
+			<-this.input
+			this.output <- NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+			return
+		}
+
+		buffer = this.oBuffer.Buf
+	} else {
+		requiredSize := t.MaxEncodedLen(int(this.blockLength))
+
+		if len(buffer) < requiredSize {
+			buffer = make([]byte, requiredSize)
+			this.oBuffer.Buf = buffer
+		}
+
+		// Forward transform (ignore error, encode skipFlags)
+		_, postTransformLength, _ = t.Forward(data[0:this.blockLength], buffer)
+		tSkipFlags = t.SkipFlags()
 	}
 
-	// Forward transform (ignore error, encode skipFlags)
-	_, postTransformLength, _ = t.Forward(data[0:this.blockLength], buffer)
+	this.metrics.since(METRIC_TRANSFORM_SECONDS, start)
 	this.ctx["size"] = postTransformLength
 	dataSize := uint(0)
 
@@ -576,7 +1496,6 @@ func (this *encodingTask) encode() {
 
 	// Record size of 'block size' - 1 in bytes
 	mode |= byte((dataSize & 0x03) << 5)
-	dataSize++
 
 	if len(this.listeners) > 0 {
 		// Notify after transform
@@ -585,34 +1504,117 @@ func (this *encodingTask) encode() {
 		notifyListeners(this.listeners, evt)
 	}
 
-	// Wait for the concurrent task processing the previous block to complete
-	// entropy encoding. Entropy encoding must happen sequentially (and
-	// in the correct block order) in the bitstream.
+	if err := runHook(this.hooks, this.blockInfo(kanzi.EVT_BEFORE_ENTROPY), buffer[0:postTransformLength]); err != nil {
+		<-this.input
+		this.output <- NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+		return
+	}
+
+	// The block is entropy coded to memory first: it is stored raw (copy
+	// block) instead if the transforms or the entropy coder expanded it.
+	// The blocks are entropy coded out of order, except with the TPAQ codecs
+	// (entropy coded in block order): the predictors use hundreds of MB and
+	// the blocks may share the model.
+	var encoded []byte
+	encodedBits := uint64(0)
+	expanded := postTransformLength > this.blockLength
+	inOrder := this.blockEntropyType == entropy.TPAQ_TYPE || this.blockEntropyType == entropy.TPAQX_TYPE
+	start = time.Now()
+
+	if mode&_COPY_BLOCK_MASK == 0 && inOrder == false && this.blockEntropyType != entropy.NONE_TYPE {
+		// The entropy coder may make up for a transform header
+		encoded, encodedBits, err = this.encodeToMemory(buffer[0:postTransformLength])
+		expanded = err != nil || (encodedBits+7)>>3 > uint64(this.blockLength)
+	}
+
+	entropyDuration := time.Since(start)
+
+	// Wait for the concurrent task processing the previous block to write
+	// it. The blocks must be written sequentially (and in the correct block
+	// order) in the bitstream.
+	start = time.Now()
 	err2 := <-this.input
 	inputReceived = true
+	this.metrics.since(METRIC_WAIT_SECONDS, start)
 
 	if err2 != nil {
 		this.output <- err2
 		return
 	}
 
+	if this.tpaqModel != nil {
+		// Only the entropy coding (in block order) uses the shared model
+		this.ctx["tpaqShared"] = this.tpaqModel
+	}
+
 	// Write block 'header' (mode + compressed length)
 	written := this.obs.Written()
+	start = time.Now().Add(-entropyDuration)
+
+	if mode&_COPY_BLOCK_MASK == 0 {
+		if this.tpaqModel != nil {
+			// The shared model learns the block: it must be entropy coded
+			// unless the transforms expanded it
+			if expanded == false && this.blockEntropyType != entropy.NONE_TYPE {
+				if encoded, encodedBits, err = this.encodeToMemory(buffer[0:postTransformLength]); err != nil {
+					this.output <- NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+					return
+				}
+			}
+		} else if inOrder == true {
+			// The entropy coder may make up for a transform header
+			encoded, encodedBits, err = this.encodeToMemory(buffer[0:postTransformLength])
+			expanded = err != nil || (encodedBits+7)>>3 > uint64(this.blockLength)
+		}
+
+		if expanded == true {
+			encoded = nil
+			postTransformLength = this.blockLength
+			buffer = data
+			tSkipFlags = _TRANSFORM_SKIP_MASK
+			this.blockEntropyType = entropy.NONE_TYPE
+			mode = _COPY_BLOCK_MASK
+
+			for i := uint64(0xFF); i < uint64(postTransformLength); i <<= 8 {
+				mode += 1 << 5
+			}
+
+			this.metrics.add(METRIC_STORED_BLOCKS, 1)
+		}
+	}
+
+	if mode&_COPY_BLOCK_MASK != 0 && this.textCodec != nil {
+		// The decoder does not see the dictionary learned from a stored block
+		this.textCodec.ResetDictionary()
+	}
+
+	skipFlags := byte(0)
+
+	// Transforms replaced by NONE: all stream transforms must be skipped
+	if this.policy == RATIO_POLICY_SKIP_TRANSFORMS && (mode&_COPY_BLOCK_MASK) == 0 {
+		tSkipFlags = _TRANSFORM_SKIP_MASK
+	}
 
 	if ((mode & _COPY_BLOCK_MASK) != 0) || (t.Len() <= 4) {
-		mode |= byte(t.SkipFlags() >> 4)
-		this.obs.WriteBits(uint64(mode), 8)
+		mode |= byte(tSkipFlags >> 4)
 	} else {
 		mode |= _TRANSFORMS_MASK
-		this.obs.WriteBits(uint64(mode), 8)
-		this.obs.WriteBits(uint64(t.SkipFlags()), 8)
+		skipFlags = tSkipFlags
+	}
+
+	if this.partial == true {
+		this.headers.write(this.obs, BLOCK_MODE_PARTIAL, 0, 0)
 	}
 
-	this.obs.WriteBits(uint64(postTransformLength), 8*dataSize)
+	this.headers.write(this.obs, mode, skipFlags, postTransformLength)
+
+	if this.index != nil {
+		this.index.add(written, this.blockLength, checksum)
+	}
 
 	// Write checksum
 	if this.hasher != nil {
-		this.obs.WriteBits(uint64(checksum), 32)
+		this.obs.WriteArray(sum[:], this.hasher.bits())
 	}
 
 	if len(this.listeners) > 0 {
@@ -622,25 +1624,46 @@ func (this *encodingTask) encode() {
 		notifyListeners(this.listeners, evt)
 	}
 
-	// Each block is encoded separately
-	// Rebuild the entropy encoder to reset block statistics
-	ee, err := entropy.NewEntropyEncoder(this.obs, this.ctx, this.blockEntropyType)
+	if this.parity != nil {
+		if encoded == nil {
+			// Raw data (copy block or no entropy coding)
+			encoded = buffer[0:postTransformLength]
+			encodedBits = 8 * uint64(postTransformLength)
+		}
+
+		this.writeParity(encoded, encodedBits)
+	} else if encoded != nil {
+		this.obs.WriteArray(encoded, uint(encodedBits))
+	} else {
+		// Each block is encoded separately
+		// Reset (or rebuild) the entropy encoder to reset block statistics
+		ee, err := this.coders.Get(this.obs, this.ctx, this.blockEntropyType)
 
-	if err != nil {
-		this.output <- NewIOError(err.Error(), kanzi.ERR_CREATE_CODEC)
-		return
-	}
+		if err != nil {
+			this.output <- NewIOError(err.Error(), kanzi.ERR_CREATE_CODEC)
+			return
+		}
 
-	// Entropy encode block
-	_, err = ee.Write(buffer[0:postTransformLength])
+		// Entropy encode block
+		_, err = ee.Write(buffer[0:postTransformLength])
 
-	if err != nil {
-		this.output <- NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
-		return
+		if err != nil {
+			this.output <- NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+			return
+		}
+
+		// Dispose before displaying statistics. Dispose may write to the bitstream
+		ee.Dispose()
 	}
 
-	// Dispose before displaying statistics. Dispose may write to the bitstream
-	ee.Dispose()
+	this.metrics.since(METRIC_ENTROPY_SECONDS, start)
+	this.metrics.add(METRIC_BLOCKS, 1)
+	this.metrics.add(METRIC_BYTES_IN, int64(this.blockLength))
+	this.metrics.add(METRIC_BYTES_OUT, int64(this.obs.Written()-written)/8)
+
+	if this.monitor != nil {
+		this.monitor.Update(int64(this.blockLength), int64(this.obs.Written()-written)/8)
+	}
 
 	if len(this.listeners) > 0 {
 		// Notify after entropy
@@ -649,10 +1672,88 @@ func (this *encodingTask) encode() {
 		notifyListeners(this.listeners, evt)
 	}
 
+	if len(this.blkListeners) > 0 {
+		notifyBlockEnd(this.blkListeners, BlockEndEvent{ID: this.currentBlockID,
+			Size:        int64(this.blockLength),
+			Compressed:  int64(this.obs.Written()-written) / 8,
+			Transform:   appliedTransforms(this.blockTransformType, tSkipFlags),
+			Entropy:     entropy.GetName(this.blockEntropyType),
+			Stored:      mode&_COPY_BLOCK_MASK != 0,
+			Checksum:    checksum,
+			HasChecksum: this.hasher != nil,
+			Duration:    time.Since(blockStart)})
+	}
+
 	// Notify of completion of the task
 	this.output <- error(nil)
 }
 
+// Write the entropy coded block followed by the CRC32 of its shards and the
+// parity shards
+func (this *encodingTask) writeParity(encoded []byte, bits uint64) {
+	encoded = encoded[0 : (bits+7)>>3]
+
+	if bits&7 != 0 {
+		// The padding bits are read as zeros
+		encoded[len(encoded)-1] &= byte(0xFF << (8 - bits&7))
+	}
+
+	crcs, parity := this.parity.encode(encoded)
+	this.obs.WriteBits(bits, PARITY_LENGTH_BITS)
+	this.obs.WriteArray(encoded, uint(bits))
+
+	for _, crc := range crcs {
+		this.obs.WriteBits(uint64(crc), PARITY_CRC_BITS)
+	}
+
+	this.obs.WriteArray(parity, uint(8*len(parity)))
+}
+
+// Entropy code the block to the scratch buffer of the job. Returns the
+// encoded bits (the last byte is padded) and the number of bits.
+func (this *encodingTask) encodeToMemory(block []byte) (encoded []byte, bits uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	this.scratch.Reset()
+	obs, err := bitstream.NewDefaultOutputBitStream(this.scratch, 65536)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ee, err := this.coders.Get(obs, this.ctx, this.blockEntropyType)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if _, err = ee.Write(block); err != nil {
+		return nil, 0, err
+	}
+
+	ee.Dispose()
+
+	// Close pads the last byte and adjusts the count of written bits
+	bits = obs.Written()
+
+	if _, err = obs.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	return this.scratch.Bytes(), bits, nil
+}
+
+func (this *encodingTask) blockInfo(stage int) BlockInfo {
+	transform, _ := this.ctx["transform"].(string)
+	codec, _ := this.ctx["codec"].(string)
+	return BlockInfo{ID: this.currentBlockID, Stage: stage, Decoding: false,
+		Transform: transform, Entropy: codec}
+}
+
 func notifyListeners(listeners []kanzi.Listener, evt *kanzi.Event) {
 	defer func() {
 		//lint:ignore SA9003 ignore panics in listeners
@@ -672,22 +1773,62 @@ type message struct {
 	decoded        int
 	blockID        int
 	checksum       uint32
+	sync           bool // sync marker instead of a block
+	partial        bool // partial block (continued by the next block)
 	completionTime time.Time
 }
 
+// Return the number of blocks encoded concurrently for the estimated memory
+// of a block (see DescribePipeline) to fit in maxMemory bytes. The other
+// jobs process the blocks concurrently (EG. the suffix array of the BWT).
+func getMaxTasks(ctx map[string]interface{}, maxMemory uint64, jobs uint) (uint, error) {
+	info, err := DescribePipeline(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if maxMemory < info.BlockMemory {
+		errMsg := fmt.Sprintf("The maximum memory (%d bytes) is smaller than the estimated memory of a block (%d bytes)",
+			maxMemory, info.BlockMemory)
+		return 0, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+	}
+
+	if tasks := maxMemory / info.BlockMemory; tasks < uint64(jobs) {
+		return uint(tasks), nil
+	}
+
+	return jobs, nil
+}
+
 type semaphore chan bool
 
 // CompressedInputStream a Reader that reads compressed data
-// from an InputBitStream.
+// from an InputBitStream. Concatenated streams (EG. 'cat a.knz b.knz') are
+// decoded as one stream, like gzip members.
 type CompressedInputStream struct {
 	blockSize     uint
 	nbInputBlocks uint8
-	hasher        *hash.XXHash32
+	hasher        *blockHasher
+	dataDigest    hash.Hash    // SHA-256 of the decoded data (nil if not in the stream)
+	parity        *parityCodec // nil if the blocks have no parity shards
+	dictionaries  *streamDictionaries
+	syncPoints    bool
+	partialBlocks bool
+	prefix        []byte // end of the logical block of the last partial block (nil if none)
+	sections      bool   // header sections read (version 10)
+	small         bool   // single block stream with a small header
+	synced        bool   // the last group of blocks ended at a sync marker
 	data          []byte
 	buffers       []blockBuffer
+	coders        []*entropy.DecoderCache // entropy decoders reused by each job
 	entropyType   uint32
 	transformType uint64
 	ibs           kanzi.InputBitStream
+	headers       *blockHeaderCodec
+	hooks         map[int]BlockHook
+	blkListeners  []BlockListener
+	metrics       metricsReporter
 	initialized   int32
 	closed        int32
 	blockID       int
@@ -697,22 +1838,36 @@ type CompressedInputStream struct {
 	resChan       chan message
 	listeners     []kanzi.Listener
 	readLastBlock bool
+	streamBlocks  int       // blocks decoded in the current stream (concatenated streams)
+	streams       int       // number of stream headers read
+	pending       []message // decoded blocks not yet returned by NextBlock
+	tpaqModel     *entropy.TPAQSharedModel
+	textCodec     *function.TextCodec // text codec shared by the blocks (nil if none)
 	ctx           map[string]interface{}
 }
 
 type decodingTask struct {
 	iBuffer            *blockBuffer
 	oBuffer            *blockBuffer
-	hasher             *hash.XXHash32
+	hasher             *blockHasher
+	parity             *parityCodec
+	syncPoints         bool
+	partialBlocks      bool
 	blockLength        uint
 	blockTransformType uint64
 	blockEntropyType   uint32
+	coders             *entropy.DecoderCache
 	currentBlockID     int
 	input              chan bool
 	output             chan bool
 	result             chan message
 	listeners          []kanzi.Listener
 	ibs                kanzi.InputBitStream
+	headers            *blockHeaderCodec
+	hooks              map[int]BlockHook
+	blkListeners       []BlockListener
+	metrics            metricsReporter
+	tpaqModel          *entropy.TPAQSharedModel
 	ctx                map[string]interface{}
 }
 
@@ -724,7 +1879,20 @@ func NewCompressedInputStream(is io.ReadCloser, jobs uint) (*CompressedInputStre
 }
 
 // NewCompressedInputStreamWithCtx creates a new instance of CompressedInputStream
-// using a map of parameters
+// using a map of parameters. If "verify" is set to true, each block is also
+// decoded with the portable reference implementation of the transforms and
+// the results are compared (slower, used to validate the stream portability).
+// Only the BWT, BWTS, AUTOBWT, LZ, RLT, ZRLT (bit mode), MTFT and RANK
+// transforms have a reference implementation and are cross-checked: the
+// other stages of the chain are decoded twice with the same code (this does
+// not validate them). The streams without any of these transforms are
+// rejected in this mode.
+// An encrypted stream requires the "passphrase" (string) or "encryptionKey"
+// ([]byte) used to create it. If "resync" is set to true and the stream has
+// sync points, the decoding resumes after the sync marker following a
+// damaged block (the data in between is lost) instead of failing. The streams
+// written with "textRetain" set to true require "textRetain" (the blocks are
+// decoded one at a time).
 func NewCompressedInputStreamWithCtx(is io.ReadCloser, ctx map[string]interface{}) (*CompressedInputStream, error) {
 	if is == nil {
 		return nil, NewIOError("Invalid null reader parameter", kanzi.ERR_CREATE_STREAM)
@@ -741,8 +1909,11 @@ func NewCompressedInputStreamWithCtx(is io.ReadCloser, ctx map[string]interface{
 		return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
 	}
 
-	this := new(CompressedInputStream)
+	return newCompressedInputStream(is, ctx, tasks)
+}
 
+func newCompressedInputStream(is io.ReadCloser, ctx map[string]interface{}, tasks uint) (*CompressedInputStream, error) {
+	this := new(CompressedInputStream)
 	this.jobs = int(tasks)
 	this.blockID = 0
 	this.data = _EMPTY_BYTE_SLICE
@@ -752,14 +1923,29 @@ func NewCompressedInputStreamWithCtx(is io.ReadCloser, ctx map[string]interface{
 		this.buffers[i] = blockBuffer{Buf: _EMPTY_BYTE_SLICE}
 	}
 
+	this.coders = make([]*entropy.DecoderCache, this.jobs)
+
+	for i := range this.coders {
+		this.coders[i] = entropy.NewDecoderCache()
+	}
+
 	this.resChan = make(chan message)
-	var err error
+	enc, err := parseEncryptionParams(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if enc != nil {
+		is = &decryptReader{is: is, params: enc}
+	}
 
 	if this.ibs, err = bitstream.NewDefaultInputBitStream(is, _STREAM_DEFAULT_BUFFER_SIZE); err != nil {
 		errMsg := fmt.Sprintf("Cannot create input bit stream: %v", err)
 		return nil, NewIOError(errMsg, kanzi.ERR_CREATE_BITSTREAM)
 	}
 
+	this.headers = &blockHeaderCodec{}
 	this.listeners = make([]kanzi.Listener, 0)
 	this.ctx = ctx
 	this.blockSize = 0
@@ -796,50 +1982,80 @@ func (this *CompressedInputStream) RemoveListener(bl kanzi.Listener) bool {
 	return false
 }
 
-func (this *CompressedInputStream) readHeader() error {
+func (this *CompressedInputStream) readHeader() (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			panic(NewIOError("Cannot read bitstream header: "+r.(error).Error(), kanzi.ERR_READ_FILE))
+			cause := r.(error)
+			err = &IOError{msg: "Cannot read bitstream header: " + cause.Error(), code: kanzi.ERR_READ_FILE, err: cause}
 		}
 	}()
 
 	// Read stream type
-	fileType := this.ibs.ReadBits(32)
-
-	// Sanity check
-	if fileType != _BITSTREAM_TYPE {
+	fileType := readStreamMagic(this.ibs)
+
+	if fileType == SMALL_STREAM_MAGIC {
+		err = this.readSmallHeaderFields()
+	} else if fileType == _BITSTREAM_TYPE {
+		err = this.readHeaderFields()
+	} else if fileType == ENCRYPTION_MAGIC {
+		return NewIOError("Encrypted stream: a passphrase or an encryption key is required", kanzi.ERR_INVALID_PARAM)
+	} else {
+		// Sanity check
 		return NewIOError("Invalid stream type", kanzi.ERR_INVALID_FILE)
 	}
 
-	version := this.ibs.ReadBits(5)
+	if err != nil {
+		return err
+	}
+
+	// The text dictionary of the blocks of a stream (concatenated streams:
+	// the first block of the next stream starts with a fresh dictionary)
+	this.textCodec = nil
 
-	// Sanity check
-	if version != _BITSTREAM_FORMAT_VERSION {
-		errMsg := fmt.Sprintf("Invalid bitstream, cannot read this version of the stream: %d", version)
-		return NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+	if retain, _ := this.ctx["textRetain"].(bool); retain == true && hasTextStage(this.transformType) == true {
+		if this.textCodec, err = function.NewStreamTextCodec(this.ctx); err != nil {
+			return NewIOError(err.Error(), kanzi.ERR_CREATE_CODEC)
+		}
 	}
 
-	// Read block checksum
-	if this.ibs.ReadBit() == 1 {
-		var err error
-		this.hasher, err = hash.NewXXHash32(_BITSTREAM_TYPE)
+	return nil
+}
 
-		if err != nil {
-			return err
+// Return true if the transform chain has a TEXT stage
+func hasTextStage(transformType uint64) bool {
+	for _, t := range function.GetTypes(transformType) {
+		if t == function.DICT_TYPE {
+			return true
 		}
 	}
 
+	return false
+}
+
+// Read the fields of the stream header after the magic
+func (this *CompressedInputStream) readHeaderFields() error {
+	version := this.ibs.ReadBits(HEADER_VERSION_BITS)
+
+	// Sanity check
+	if version < STREAM_MIN_VERSION || version > _BITSTREAM_FORMAT_VERSION {
+		errMsg := fmt.Sprintf("Invalid bitstream, cannot read this version of the stream: %d", version)
+		return NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+	}
+
+	// Read block checksum flag (the type is in the extended header)
+	cksum := this.ibs.ReadBit()
+
 	// Read entropy codec
-	this.entropyType = uint32(this.ibs.ReadBits(5))
+	this.entropyType = uint32(this.ibs.ReadBits(HEADER_ENTROPY_BITS))
 	this.ctx["codec"] = entropy.GetName(this.entropyType)
 	this.ctx["extra"] = this.entropyType == entropy.TPAQX_TYPE
 
 	// Read transforms: 8*6 bits
-	this.transformType = this.ibs.ReadBits(48)
+	this.transformType = this.ibs.ReadBits(HEADER_TRANSFORM_BITS)
 	this.ctx["transform"] = function.GetName(this.transformType)
 
 	// Read block size
-	this.blockSize = uint(this.ibs.ReadBits(28)) << 4
+	this.blockSize = uint(this.ibs.ReadBits(HEADER_BLOCK_SIZE_BITS)) << 4
 	this.ctx["blockSize"] = this.blockSize
 
 	if this.blockSize < _MIN_BITSTREAM_BLOCK_SIZE || this.blockSize > _MAX_BITSTREAM_BLOCK_SIZE {
@@ -852,14 +2068,154 @@ func (this *CompressedInputStream) readHeader() error {
 	}
 
 	// Read number of blocks in input. 0 means 'unknown' and 63 means 63 or more.
-	this.nbInputBlocks = uint8(this.ibs.ReadBits(6))
+	this.nbInputBlocks = uint8(this.ibs.ReadBits(HEADER_NB_BLOCKS_BITS))
+
+	// Read block header mode (reserved in version 8)
+	this.headers.compact = this.ibs.ReadBit() == 1
+
+	if this.headers.compact == true && version == STREAM_MIN_VERSION {
+		return NewIOError("Invalid bitstream, compact block headers in a version 8 stream", kanzi.ERR_INVALID_FILE)
+	}
+
+	// Read entropy options flag (the options are stored in each block)
+	delete(this.ctx, "tpaq:extra")
+	delete(this.ctx, "tpaq:mix2")
+	delete(this.ctx, "tpaq:warm")
+	delete(this.ctx, "tpaqModels")
+	delete(this.ctx, "cm:order2")
+
+	if this.tpaqModel != nil {
+		// Previous stream (concatenated streams)
+		this.tpaqModel.Release()
+		this.tpaqModel = nil
+	}
+
+	entropyOptions := this.ibs.ReadBit() == 1
+
+	if entropyOptions == true && version == STREAM_MIN_VERSION {
+		return NewIOError("Invalid bitstream, entropy options in a version 8 stream", kanzi.ERR_INVALID_FILE)
+	}
+
+	if entropyOptions == true {
+		if this.entropyType == entropy.TPAQ_TYPE || this.entropyType == entropy.TPAQX_TYPE {
+			this.ctx["tpaqModels"] = entropy.TPAQ_MODEL_ALL
+
+			// For the blocks coded with the model of the previous blocks
+			this.tpaqModel = entropy.NewTPAQSharedModel()
+		} else if this.entropyType == entropy.CM_TYPE {
+			this.ctx["cm:order2"] = false
+		}
+	}
+
+	// Read entropy lanes flag (the number of lanes is stored in each block)
+	delete(this.ctx, "entropy:lanes")
+
+	entropyLanes := this.ibs.ReadBits(HEADER_ENTROPY_LANES_BITS) == 1
+
+	if entropyLanes == true && version == STREAM_MIN_VERSION {
+		return NewIOError("Invalid bitstream, entropy lanes in a version 8 stream", kanzi.ERR_INVALID_FILE)
+	}
+
+	if entropyLanes == true {
+		this.ctx["entropy:lanes"] = uint(0)
+	}
+
+	checksumType := uint8(CHECKSUM_TYPE_XXHASH32)
+	this.dataDigest = nil
+	this.parity = nil
+	this.dictionaries = nil
+	this.syncPoints = false
+	this.partialBlocks = false
+	this.prefix = nil
+	this.sections = false
+	this.small = false
+
+	if version > STREAM_MIN_VERSION {
+		// Read extended header
+		checksumType = uint8(this.ibs.ReadBits(HEADER_CHECKSUM_TYPE_BITS))
+
+		if this.ibs.ReadBits(HEADER_DIGEST_BITS) == 1 {
+			this.dataDigest = sha256.New()
+		}
+
+		if n := parityShardsOf(uint8(this.ibs.ReadBits(HEADER_PARITY_BITS))); n != 0 {
+			this.parity = newParityCodec(int(n))
+		}
 
-	// Read reserved bits
-	this.ibs.ReadBits(3)
+		dictionaries := this.ibs.ReadBits(HEADER_DICTIONARIES_BITS)
+		this.syncPoints = this.ibs.ReadBits(HEADER_SYNC_BITS) == 1
+		this.partialBlocks = this.ibs.ReadBits(HEADER_PARTIAL_BITS) == 1
+
+		if this.partialBlocks == true && this.syncPoints == false {
+			return NewIOError("Invalid bitstream, partial blocks without sync points", kanzi.ERR_INVALID_FILE)
+		}
+
+		if dictionaries == 1 {
+			var ioErr *IOError
+
+			if this.dictionaries, ioErr = readStreamDictionaries(this.ibs, this.ctx); ioErr != nil {
+				return ioErr
+			}
+
+			this.dictionaries.setCtx(this.ctx)
+		}
+	}
+
+	if version >= STREAM_SECTIONS_VERSION {
+		sections, ioErr := readHeaderSections(this.ibs)
+
+		if ioErr != nil {
+			return ioErr
+		}
+
+		features := entropyFeatures(entropyOptions, entropyLanes)
+
+		if ioErr = checkHeaderSections(sections, this.transformType, this.entropyType, features, this.dictionaries); ioErr != nil {
+			return ioErr
+		}
+
+		this.sections = true
+	}
+
+	this.hasher = nil
+
+	if cksum == 1 {
+		var err error
+
+		if this.hasher, err = newBlockHasher(checksumType); err != nil {
+			return err
+		}
+	}
+
+	this.streams++
 
 	if len(this.listeners) > 0 {
 		msg := ""
 		msg += fmt.Sprintf("Checksum set to %v\n", this.hasher != nil)
+
+		if this.hasher != nil {
+			msg += fmt.Sprintf("Using %v block checksum\n", this.hasher.name())
+		}
+
+		if this.dataDigest != nil {
+			msg += "Digest of the original data set to true\n"
+		}
+
+		if this.parity != nil {
+			msg += fmt.Sprintf("Using %d parity shards per block\n", this.parity.parityShards)
+		}
+
+		if this.dictionaries != nil {
+			msg += "Using the preset dictionaries of the stream\n"
+		}
+
+		if this.syncPoints == true {
+			msg += "Sync points set to true\n"
+		}
+
+		if this.partialBlocks == true {
+			msg += "Partial blocks set to true\n"
+		}
 		msg += fmt.Sprintf("Block size set to %d bytes\n", this.blockSize)
 		w1 := entropy.GetName(this.entropyType)
 
@@ -901,6 +2257,14 @@ func (this *CompressedInputStream) Close() error {
 		this.buffers[i] = blockBuffer{Buf: _EMPTY_BYTE_SLICE}
 	}
 
+	for _, c := range this.coders {
+		c.Clear()
+	}
+
+	if this.tpaqModel != nil {
+		this.tpaqModel.Release()
+	}
+
 	close(this.resChan)
 	return nil
 }
@@ -912,6 +2276,10 @@ func (this *CompressedInputStream) Read(block []byte) (int, error) {
 		return 0, NewIOError("Stream closed", kanzi.ERR_READ_FILE)
 	}
 
+	if len(this.pending) > 0 {
+		return 0, NewIOError("Cannot mix Read and NextBlock calls", kanzi.ERR_READ_FILE)
+	}
+
 	startChunk := 0
 	remaining := len(block)
 
@@ -935,38 +2303,151 @@ func (this *CompressedInputStream) Read(block []byte) (int, error) {
 			}
 		}
 
-		// Buffer empty, time to decode
-		if this.curIdx >= this.maxIdx {
-			var err error
+		// Buffer empty, time to decode
+		if this.curIdx >= this.maxIdx {
+			// Return the data preceding a sync marker without waiting for
+			// the next blocks
+			if this.synced == true && remaining < len(block) {
+				break
+			}
+
+			var err error
+
+			if this.maxIdx, err = this.processBlock(); err != nil {
+				return len(block) - remaining, err
+			}
+
+			if this.maxIdx == 0 {
+				// Reached end of stream
+				if len(block) == remaining {
+					// EOF and we did not read any bytes in this call
+					return 0, nil
+				}
+
+				break
+			}
+		}
+	}
+
+	return len(block) - remaining, nil
+}
+
+func (this *CompressedInputStream) processBlock() (int, error) {
+	for {
+		this.synced = false
+		results, decoded, err := this.decodeBlocks()
+
+		if err != nil || results == nil {
+			return decoded, err
+		}
+
+		if len(this.data) < decoded {
+			this.data = make([]byte, decoded)
+		}
+
+		offset := 0
+
+		for _, res := range results {
+			copy(this.data[offset:], res.data[0:res.decoded])
+			offset += res.decoded
+
+			if more, err := this.notifyBlock(res); more == false {
+				if err != nil {
+					return 0, err
+				}
+
+				break
+			}
+		}
+
+		if decoded > 0 {
+			this.curIdx = 0
+			return decoded, nil
+		}
+
+		// Only the end block or a sync marker: continue with the next stream
+		// (if any) or the next blocks
+	}
+}
+
+// Notify the listeners that a block has been decoded (in block order).
+// Returns false if the block is the end of stream block (and an error if the
+// digest of the original data does not match) or a sync marker.
+func (this *CompressedInputStream) notifyBlock(res message) (bool, error) {
+	if res.sync == true {
+		this.synced = true
+		return false, nil
+	}
+
+	if len(this.listeners) > 0 {
+		evt := kanzi.NewEvent(kanzi.EVT_AFTER_TRANSFORM, res.blockID,
+			int64(res.decoded), res.checksum, this.hasher != nil, res.completionTime)
+		notifyListeners(this.listeners, evt)
+	}
+
+	if res.decoded == 0 {
+		this.readLastBlock = true
+		return false, this.checkDigest()
+	}
+
+	if this.dataDigest != nil {
+		this.dataDigest.Write(res.data[0:res.decoded])
+	}
+
+	this.streamBlocks++
 
-			if this.maxIdx, err = this.processBlock(); err != nil {
-				return len(block) - remaining, err
-			}
+	// A small stream has a single block and no end block
+	if this.small == true {
+		this.readLastBlock = true
+	}
 
-			if this.maxIdx == 0 {
-				// Reached end of stream
-				if len(block) == remaining {
-					// EOF and we did not read any bytes in this call
-					return 0, nil
-				}
+	return true, nil
+}
 
-				break
-			}
+// Read the digest of the original data after the end block (if any) and
+// compare it to the digest of the decoded data
+func (this *CompressedInputStream) checkDigest() (err error) {
+	if this.dataDigest == nil {
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewIOError("Cannot read the digest of the original data: "+r.(error).Error(), kanzi.ERR_READ_FILE)
 		}
+	}()
+
+	if r := this.ibs.Read() & 7; r != 0 {
+		this.ibs.ReadBits(uint(8 - r))
 	}
 
-	return len(block) - remaining, nil
+	var expected [STREAM_DIGEST_BITS / 8]byte
+	this.ibs.ReadArray(expected[:], STREAM_DIGEST_BITS)
+
+	if found := this.dataDigest.Sum(nil); bytes.Equal(found, expected[:]) == false {
+		errMsg := fmt.Sprintf("Corrupted bitstream: expected digest %x, found %x", expected, found)
+		return NewIOError(errMsg, kanzi.ERR_CRC_CHECK)
+	}
+
+	return nil
 }
 
-func (this *CompressedInputStream) processBlock() (int, error) {
+// Decode the next group of blocks concurrently. Returns the results in block
+// order (nil at the end of stream) and the total number of decoded bytes.
+func (this *CompressedInputStream) decodeBlocks() ([]message, int, error) {
 	if atomic.SwapInt32(&this.initialized, 1) == 0 {
 		if err := this.readHeader(); err != nil {
-			return 0, err
+			return nil, 0, err
 		}
 	}
 
-	if this.readLastBlock == true {
-		return 0, nil
+	if this.readLastBlock == true && this.nextStream() == false {
+		return nil, 0, nil
+	}
+
+	if verify, _ := this.ctx["verify"].(bool); verify == true && hasReferenceInverse(this.transformType) == false {
+		errMsg := fmt.Sprintf("Cannot verify the stream: no reference decoder for the transforms %v", function.GetName(this.transformType))
+		return nil, 0, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
 	}
 
 	blkSize := int(this.blockSize)
@@ -985,6 +2466,11 @@ func (this *CompressedInputStream) processBlock() (int, error) {
 	nbJobs := uint(this.jobs)
 	var jobsPerTask []uint
 
+	if this.textCodec != nil {
+		// Each block needs the text dictionary of the previous block
+		nbJobs = 1
+	}
+
 	// Assign optimal number of tasks and jobs per task
 	if nbJobs > 1 {
 		// If the number of input blocks is available, use it to optimize
@@ -1003,6 +2489,13 @@ func (this *CompressedInputStream) processBlock() (int, error) {
 		jobsPerTask[0] = uint(this.jobs)
 	}
 
+	// The first block may continue the logical block of a partial block
+	var prefixDict *function.LZDictionary
+
+	if this.prefix != nil {
+		prefixDict = continuationDictionary(this.prefix)
+	}
+
 	// Channel of semaphores
 	syncChan := make([]semaphore, nbJobs)
 
@@ -1038,19 +2531,36 @@ func (this *CompressedInputStream) processBlock() (int, error) {
 
 		copyCtx["jobs"] = jobsPerTask[jobID]
 
+		if jobID == 0 && prefixDict != nil {
+			copyCtx["lzDictionary"] = prefixDict
+		}
+
+		if this.textCodec != nil {
+			copyCtx["textShared"] = this.textCodec
+		}
+
 		task := decodingTask{
 			iBuffer:            &this.buffers[2*jobID],
 			oBuffer:            &this.buffers[2*jobID+1],
 			hasher:             this.hasher,
+			parity:             this.parity,
+			syncPoints:         this.syncPoints,
+			partialBlocks:      this.partialBlocks,
 			blockLength:        uint(blkSize),
 			blockTransformType: this.transformType,
 			blockEntropyType:   this.entropyType,
+			coders:             this.coders[jobID],
+			tpaqModel:          this.tpaqModel,
 			currentBlockID:     this.blockID + jobID + 1,
 			input:              syncChan[jobID],
 			output:             syncChan[(jobID+1)%int(nbJobs)],
 			result:             this.resChan,
 			listeners:          listeners,
 			ibs:                this.ibs,
+			headers:            this.headers,
+			hooks:              this.hooks,
+			blkListeners:       this.blkListeners,
+			metrics:            this.metrics,
 			ctx:                copyCtx}
 
 		// Invoke the tasks concurrently
@@ -1063,10 +2573,13 @@ func (this *CompressedInputStream) processBlock() (int, error) {
 		go task.decode()
 	}
 
-	var err error
+	this.metrics.set(METRIC_QUEUE_DEPTH, float64(nbJobs))
+	defer this.metrics.set(METRIC_QUEUE_DEPTH, 0)
 	decoded := 0
-	offset := 0
 	results := make([]message, nbJobs)
+	resync, _ := this.ctx["resync"].(bool)
+	resync = resync && this.syncPoints
+	var failed error
 
 	// Wait for completion of all concurrent tasks
 	for range results {
@@ -1078,39 +2591,242 @@ func (this *CompressedInputStream) processBlock() (int, error) {
 		decoded += res.decoded
 
 		if res.err != nil {
-			return decoded, res.err
+			if resync == false {
+				return nil, decoded, res.err
+			}
+
+			if failed == nil {
+				failed = res.err
+			}
+		}
+	}
+
+	if failed != nil {
+		// Keep the blocks preceding the damaged block and resume decoding
+		// after the next sync marker
+		if err := this.skipToSyncMarker(); err != nil {
+			return nil, decoded, failed
 		}
+
+		n := 0
+		decoded = 0
+
+		for results[n].err == nil && results[n].sync == false {
+			decoded += results[n].decoded
+			n++
+		}
+
+		results[n] = message{blockID: this.blockID + n + 1, sync: true}
+		results = results[0 : n+1]
+		this.metrics.add(METRIC_RESYNCS, 1)
+
+		// The next block cannot continue a damaged partial block
+		this.prefix = nil
+
+		// The digest of the original data cannot match
+		this.dataDigest = nil
 	}
 
 	if decoded > int(nbJobs)*int(this.blockSize) {
-		return decoded, NewIOError("Invalid data", kanzi.ERR_PROCESS_BLOCK)
+		return nil, decoded, NewIOError("Invalid data", kanzi.ERR_PROCESS_BLOCK)
+	}
+
+	if this.partialBlocks == true && failed == nil {
+		this.updatePrefix(results)
 	}
 
-	if len(this.data) < decoded {
-		this.data = make([]byte, decoded)
+	// The block IDs are contiguous after a sync marker
+	for i := range results {
+		if results[i].sync == true {
+			this.blockID += i
+			return results, decoded, nil
+		}
 	}
 
-	// Process results
-	for _, res := range results {
-		copy(this.data[offset:], res.data[0:res.decoded])
-		offset += res.decoded
+	this.blockID += this.jobs
+	return results, decoded, nil
+}
+
+// Keep the end of the logical block of the last partial block (the LZ
+// dictionary of the block continuing it, see continuationDictionary)
+func (this *CompressedInputStream) updatePrefix(results []message) {
+	for i := range results {
+		if results[i].sync == true || results[i].err != nil {
+			return
+		}
 
-		if len(listeners) > 0 {
-			// Notify after transform ... in block order !
-			evt := kanzi.NewEvent(kanzi.EVT_AFTER_TRANSFORM, res.blockID,
-				int64(res.decoded), res.checksum, this.hasher != nil, res.completionTime)
-			notifyListeners(listeners, evt)
+		if results[i].partial == false || results[i].decoded == 0 {
+			this.prefix = nil
+			continue
 		}
 
-		if res.decoded == 0 {
-			this.readLastBlock = true
-			break
+		this.prefix = append(this.prefix, results[i].data[0:results[i].decoded]...)
+
+		if n := len(this.prefix); n > function.LZ_MAX_DICT_SIZE {
+			this.prefix = append([]byte(nil), this.prefix[n-function.LZ_MAX_DICT_SIZE:]...)
 		}
 	}
+}
 
-	this.blockID += this.jobs
-	this.curIdx = 0
-	return decoded, err
+// Skip the data up to the end of the next sync marker (after a damaged
+// block)
+func (this *CompressedInputStream) skipToSyncMarker() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewIOError("No sync marker after the damaged block", kanzi.ERR_READ_FILE)
+		}
+	}()
+
+	if r := this.ibs.Read() & 7; r != 0 {
+		this.ibs.ReadBits(uint(8 - r))
+	}
+
+	// The sync magic is byte aligned
+	window := uint64(this.ibs.ReadBits(24))
+
+	for window != SYNC_MAGIC {
+		window = (window<<8 | this.ibs.ReadBits(8)) & 0xFFFFFFFF
+	}
+
+	this.headers.valid = false
+	return nil
+}
+
+// Read the end of a sync marker (after the empty block)
+func readSyncMarker(ibs kanzi.InputBitStream) *IOError {
+	if r := ibs.Read() & 7; r != 0 {
+		ibs.ReadBits(uint(8 - r))
+	}
+
+	if ibs.ReadBits(32) != SYNC_MAGIC {
+		return NewIOError("Invalid bitstream: incorrect sync marker", kanzi.ERR_INVALID_FILE)
+	}
+
+	return nil
+}
+
+// Move to the stream following the end block, if any (concatenated streams,
+// EG. 'cat a.knz b.knz'). Skips the padding of the last byte and the block
+// index of the stream (if any). Returns false if there is no other stream:
+// the data after the end of the stream is ignored if it does not start with
+// a stream header.
+func (this *CompressedInputStream) nextStream() (found bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Truncated data after the end of the stream
+			found = false
+		}
+	}()
+
+	if r := this.ibs.Read() & 7; r != 0 {
+		this.ibs.ReadBits(uint(8 - r))
+	}
+
+	if more, _ := this.ibs.HasMoreToRead(); more == false {
+		return false
+	}
+
+	magic := readStreamMagic(this.ibs)
+
+	if magic != _BITSTREAM_TYPE && magic != SMALL_STREAM_MAGIC && this.headers.compact == false && this.small == false {
+		// Skip the block index: one entry per block then the trailer, or
+		// the size of a packed index after its magic
+		skip := this.streamBlocks*INDEX_ENTRY_SIZE + INDEX_TRAILER_SIZE - 8
+		indexMagic := uint64(INDEX_MAGIC)
+
+		if magic == INDEX_PACKED_MAGIC {
+			skip = int(this.ibs.ReadBits(32)) - INDEX_PACKED_HEADER_SIZE - 4
+			indexMagic = INDEX_PACKED_MAGIC
+		}
+
+		for ; skip > 0; skip-- {
+			this.ibs.ReadBits(8)
+		}
+
+		if this.ibs.ReadBits(32) != indexMagic {
+			return false
+		}
+
+		if more, _ := this.ibs.HasMoreToRead(); more == false {
+			return false
+		}
+
+		magic = readStreamMagic(this.ibs)
+	}
+
+	if magic != _BITSTREAM_TYPE && magic != SMALL_STREAM_MAGIC {
+		return false
+	}
+
+	this.headers = &blockHeaderCodec{}
+
+	if magic == SMALL_STREAM_MAGIC {
+		if err := this.readSmallHeaderFields(); err != nil {
+			return false
+		}
+	} else if err := this.readHeaderFields(); err != nil {
+		return false
+	}
+
+	this.streamBlocks = 0
+	this.readLastBlock = false
+	return true
+}
+
+// DecodedBlock a block of decompressed data returned by NextBlock
+type DecodedBlock struct {
+	ID   int    // index of the block in the stream (starting at 1)
+	Data []byte // decompressed data (owned by the stream)
+}
+
+// NextBlock returns the next block of decompressed data or nil at the end of
+// the stream. It is an alternative to Read for consumers processing the data
+// block by block: the data is not copied into an intermediate buffer and not
+// re-chunked. The blocks are decoded concurrently by groups of 'jobs' blocks,
+// so at most 'jobs' blocks are decoded ahead of the consumer. The data of the
+// block is valid until the next call to NextBlock or Close. NextBlock cannot
+// be mixed with Read on the same stream.
+func (this *CompressedInputStream) NextBlock() (*DecodedBlock, error) {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return nil, NewIOError("Stream closed", kanzi.ERR_READ_FILE)
+	}
+
+	if this.curIdx < this.maxIdx {
+		return nil, NewIOError("Cannot mix Read and NextBlock calls", kanzi.ERR_READ_FILE)
+	}
+
+	for {
+		if len(this.pending) == 0 {
+			results, _, err := this.decodeBlocks()
+
+			if err != nil {
+				return nil, err
+			}
+
+			this.pending = results
+		}
+
+		if len(this.pending) == 0 {
+			// End of stream
+			return nil, nil
+		}
+
+		res := this.pending[0]
+		this.pending = this.pending[1:]
+
+		more, err := this.notifyBlock(res)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if more == true {
+			return &DecodedBlock{ID: res.blockID, Data: res.data[0:res.decoded]}, nil
+		}
+
+		// End block: continue with the next stream (if any)
+		this.pending = nil
+	}
 }
 
 // GetRead returns the number of bytes read so far
@@ -1146,7 +2862,9 @@ func (this *decodingTask) decode() {
 
 	// Wait for task processing the previous block to complete
 	if this.input != nil {
+		start := time.Now()
 		run := <-this.input
+		this.metrics.since(METRIC_WAIT_SECONDS, start)
 
 		// If one of the previous tasks failed, skip
 		if run == false {
@@ -1158,32 +2876,56 @@ func (this *decodingTask) decode() {
 	defer func() {
 		if r := recover(); r != nil {
 			// Error => cancel concurrent decoding tasks
-			res.err = NewIOError(r.(error).Error(), kanzi.ERR_READ_FILE)
+			res.err = &IOError{msg: r.(error).Error(), code: kanzi.ERR_READ_FILE, err: r.(error)}
 			notify(this.output, this.result, false, res)
 		}
 	}()
 
 	// Extract block header directly from bitstream
 	read := this.ibs.Read()
-	mode := byte(this.ibs.ReadBits(8))
-	skipFlags := byte(0)
+	mode, skipFlags, preTransformLength, ioErr := this.headers.read(this.ibs)
+
+	if ioErr != nil {
+		// Error => cancel concurrent decoding tasks
+		res.err = ioErr
+		notify(this.output, this.result, false, res)
+		return
+	}
+
+	if preTransformLength == 0 && mode == BLOCK_MODE_PARTIAL && this.partialBlocks == true {
+		// The block ends before its logical block (continued by the next block)
+		res.partial = true
+		read = this.ibs.Read()
+
+		if mode, skipFlags, preTransformLength, ioErr = this.headers.read(this.ibs); ioErr == nil && preTransformLength == 0 {
+			ioErr = NewIOError("Invalid bitstream: empty partial block", kanzi.ERR_INVALID_FILE)
+		}
+
+		if ioErr != nil {
+			res.err = ioErr
+			notify(this.output, this.result, false, res)
+			return
+		}
+	}
+
+	if preTransformLength == 0 && mode == BLOCK_MODE_SYNC && this.syncPoints == true {
+		// Sync marker: return the previous blocks and cancel pending tasks.
+		// The next block header does not refer to the previous one.
+		res.err = readSyncMarker(this.ibs)
+		res.sync = true
+		this.headers.valid = false
+		notify(this.output, this.result, false, res)
+		return
+	}
 
 	if mode&_COPY_BLOCK_MASK != 0 {
 		this.blockTransformType = function.NONE_TYPE
 		this.blockEntropyType = entropy.NONE_TYPE
-	} else {
-		if mode&_TRANSFORMS_MASK != 0 {
-			skipFlags = byte(this.ibs.ReadBits(8))
-		} else {
-			skipFlags = (mode << 4) | 0x0F
-		}
+		skipFlags = 0
+	} else if mode&_TRANSFORMS_MASK == 0 {
+		skipFlags = (mode << 4) | 0x0F
 	}
 
-	dataSize := 1 + uint((mode>>5)&0x03)
-	length := dataSize << 3
-	mask := uint64(1<<length) - 1
-	preTransformLength := uint(this.ibs.ReadBits(length) & mask)
-
 	if preTransformLength == 0 {
 		// Last block is empty, return success and cancel pending tasks
 		res.decoded = 0
@@ -1191,19 +2933,28 @@ func (this *decodingTask) decode() {
 		return
 	}
 
+	blockStart := time.Now()
+
+	if len(this.blkListeners) > 0 {
+		notifyBlockStart(this.blkListeners, BlockStartEvent{ID: this.currentBlockID,
+			Decoding: true, Size: -1, Time: blockStart})
+	}
+
 	if preTransformLength > _MAX_BITSTREAM_BLOCK_SIZE {
 		// Error => cancel concurrent decoding tasks
 		errMsg := fmt.Sprintf("Invalid compressed block length: %d", preTransformLength)
-		res.err = NewIOError(errMsg, kanzi.ERR_BLOCK_SIZE)
+		res.err = newCorruptBlockError(errMsg, kanzi.ERR_BLOCK_SIZE, this.currentBlockID, read, nil)
 		notify(this.output, this.result, false, res)
 		return
 	}
 
 	checksum1 := uint32(0)
+	var sum1 [32]byte
 
 	// Extract checksum from bit stream (if any)
 	if this.hasher != nil {
-		checksum1 = uint32(this.ibs.ReadBits(32))
+		this.ibs.ReadArray(sum1[:], this.hasher.bits())
+		checksum1 = binary.BigEndian.Uint32(sum1[:])
 	}
 
 	if len(this.listeners) > 0 {
@@ -1227,9 +2978,26 @@ func (this *decodingTask) decode() {
 
 	this.ctx["size"] = preTransformLength
 
+	if this.tpaqModel != nil {
+		this.ctx["tpaqShared"] = this.tpaqModel
+	}
+
 	// Each block is decoded separately
-	// Rebuild the entropy decoder to reset block statistics
-	ed, err := entropy.NewEntropyDecoder(this.ibs, this.ctx, this.blockEntropyType)
+	// Reset (or rebuild) the entropy decoder to reset block statistics
+	start := time.Now()
+	ibs := this.ibs
+
+	if this.parity != nil {
+		// The entropy coded data is decoded from memory once checked
+		if ibs, ioErr = this.readParity(preTransformLength); ioErr != nil {
+			// Error => cancel concurrent decoding tasks
+			res.err = ioErr
+			notify(this.output, this.result, false, res)
+			return
+		}
+	}
+
+	ed, err := this.coders.Get(ibs, this.ctx, this.blockEntropyType)
 
 	if err != nil {
 		// Error => cancel concurrent decoding tasks
@@ -1238,20 +3006,33 @@ func (this *decodingTask) decode() {
 		return
 	}
 
-	defer ed.Dispose()
-
 	// Block entropy decode
-	if _, err = ed.Read(buffer[0:preTransformLength]); err != nil {
+	// Dispose now: the decoder may be reused by the next block of this job
+	decoded, err := ed.Read(buffer[0:preTransformLength])
+	ed.Dispose()
+
+	if err != nil {
 		// Error => cancel concurrent decoding tasks
-		res.err = NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+		res.err = newCorruptBlockError(err.Error(), kanzi.ERR_PROCESS_BLOCK, this.currentBlockID, read, err)
+		notify(this.output, this.result, false, res)
+		return
+	}
+
+	// Cross check the number of decoded symbols with the block header
+	if decoded != int(preTransformLength) {
+		errMsg := fmt.Sprintf("Invalid bitstream: decoded %d symbols, expected %d", decoded, preTransformLength)
+		res.err = newCorruptBlockError(errMsg, kanzi.ERR_PROCESS_BLOCK, this.currentBlockID, read, nil)
 		notify(this.output, this.result, false, res)
 		return
 	}
 
+	this.metrics.since(METRIC_ENTROPY_SECONDS, start)
+	compressed := int64(this.ibs.Read()-read) / 8
+
 	if len(this.listeners) > 0 {
 		// Notify after entropy
 		evt := kanzi.NewEvent(kanzi.EVT_AFTER_ENTROPY, this.currentBlockID,
-			int64(this.ibs.Read()-read)/8, checksum1, this.hasher != nil, time.Now())
+			compressed, checksum1, this.hasher != nil, time.Now())
 		notifyListeners(this.listeners, evt)
 	}
 
@@ -1259,6 +3040,12 @@ func (this *decodingTask) decode() {
 	// the next block (if any)
 	notify(this.output, nil, true, res)
 
+	if err = runHook(this.hooks, this.blockInfo(kanzi.EVT_AFTER_ENTROPY), buffer[0:preTransformLength]); err != nil {
+		res.err = NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+		notify(nil, this.result, false, res)
+		return
+	}
+
 	if len(this.listeners) > 0 {
 		// Notify before transform
 		evt := kanzi.NewEvent(kanzi.EVT_BEFORE_TRANSFORM, this.currentBlockID,
@@ -1266,6 +3053,7 @@ func (this *decodingTask) decode() {
 		notifyListeners(this.listeners, evt)
 	}
 
+	start = time.Now()
 	this.ctx["size"] = preTransformLength
 	transform, err := function.NewByteFunction(&this.ctx, this.blockTransformType)
 
@@ -1278,28 +3066,173 @@ func (this *decodingTask) decode() {
 
 	transform.SetSkipFlags(skipFlags)
 	var oIdx uint
+	var saved []byte
+
+	// The inverse transform uses the input buffer as scratch space: keep a
+	// copy for the reference decoder
+	if verify, _ := this.ctx["verify"].(bool); verify == true {
+		saved = make([]byte, len(buffer))
+		copy(saved, buffer[0:preTransformLength])
+	}
 
 	// Inverse transform
 	if _, oIdx, err = transform.Inverse(buffer[0:preTransformLength], data); err != nil {
 		// Error => return
-		res.err = NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+		res.err = newCorruptBlockError(err.Error(), kanzi.ERR_PROCESS_BLOCK, this.currentBlockID, read, err)
 		notify(nil, this.result, false, res)
 		return
 	}
 
 	res.decoded = int(oIdx)
+	this.metrics.since(METRIC_TRANSFORM_SECONDS, start)
+
+	if saved != nil {
+		if err = this.verifyInverse(saved[0:preTransformLength], data[0:res.decoded], skipFlags); err != nil {
+			res.err = NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+			notify(nil, this.result, false, res)
+			return
+		}
+	}
 
 	// Verify checksum
 	if this.hasher != nil {
-		checksum2 := this.hasher.Hash(data[0:res.decoded])
+		var sum2 [32]byte
+		this.hasher.sum(data[0:res.decoded], sum2[:])
 
-		if checksum2 != checksum1 {
-			errMsg := fmt.Sprintf("Corrupted bitstream: expected checksum %x, found %x", checksum1, checksum2)
-			res.err = NewIOError(errMsg, kanzi.ERR_CRC_CHECK)
+		if n := this.hasher.bits() >> 3; bytes.Equal(sum1[0:n], sum2[0:n]) == false {
+			errMsg := fmt.Sprintf("Corrupted bitstream: expected checksum %x, found %x", sum1[0:n], sum2[0:n])
+			res.err = newCorruptBlockError(errMsg, kanzi.ERR_CRC_CHECK, this.currentBlockID, read, nil)
 			notify(nil, this.result, false, res)
 			return
 		}
 	}
 
+	if err = runHook(this.hooks, this.blockInfo(kanzi.EVT_AFTER_TRANSFORM), data[0:res.decoded]); err != nil {
+		res.err = NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+		notify(nil, this.result, false, res)
+		return
+	}
+
+	this.metrics.add(METRIC_BLOCKS, 1)
+	this.metrics.add(METRIC_BYTES_IN, compressed)
+	this.metrics.add(METRIC_BYTES_OUT, int64(res.decoded))
+
+	if len(this.blkListeners) > 0 {
+		notifyBlockEnd(this.blkListeners, BlockEndEvent{ID: this.currentBlockID,
+			Decoding:    true,
+			Size:        int64(res.decoded),
+			Compressed:  compressed,
+			Transform:   appliedTransforms(this.blockTransformType, skipFlags),
+			Entropy:     entropy.GetName(this.blockEntropyType),
+			Stored:      mode&_COPY_BLOCK_MASK != 0,
+			Checksum:    checksum1,
+			HasChecksum: this.hasher != nil,
+			Duration:    time.Since(blockStart)})
+	}
+
 	notify(nil, this.result, false, res)
 }
+
+// Read the entropy coded block, the CRC32 of its shards and the parity
+// shards. Restore the damaged shards and return a bitstream reading the
+// entropy coded block.
+func (this *decodingTask) readParity(length uint) (kanzi.InputBitStream, *IOError) {
+	bits := this.ibs.ReadBits(PARITY_LENGTH_BITS)
+
+	// The entropy coders do not expand the data that much
+	if bits > 8*uint64(2*length+_EXTRA_BUFFER_SIZE) {
+		errMsg := fmt.Sprintf("Invalid entropy coded block length: %d bits", bits)
+		return nil, NewIOError(errMsg, kanzi.ERR_BLOCK_SIZE)
+	}
+
+	payload := make([]byte, (bits+7)>>3)
+	this.ibs.ReadArray(payload, uint(bits))
+	crcs := make([]uint32, this.parity.shards())
+
+	for i := range crcs {
+		crcs[i] = uint32(this.ibs.ReadBits(PARITY_CRC_BITS))
+	}
+
+	parity := make([]byte, this.parity.parityShards*this.parity.shardSize(len(payload)))
+	this.ibs.ReadArray(parity, uint(8*len(parity)))
+	repaired, ioErr := this.parity.repair(payload, crcs, parity)
+
+	if ioErr != nil {
+		return nil, ioErr
+	}
+
+	if repaired > 0 {
+		this.metrics.add(METRIC_REPAIRED_BLOCKS, 1)
+	}
+
+	bufferSize := (len(payload) + 7) &^ 7
+
+	if bufferSize < 1024 {
+		bufferSize = 1024
+	} else if bufferSize > 65536 {
+		bufferSize = 65536
+	}
+
+	ibs, err := bitstream.NewDefaultInputBitStream(io.NopCloser(bytes.NewReader(payload)), uint(bufferSize))
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_BITSTREAM)
+	}
+
+	return ibs, nil
+}
+
+// Return true if the transform chain has a stage with a portable reference
+// inverse (see "reference" in the context of the transforms)
+func hasReferenceInverse(transformType uint64) bool {
+	for _, t := range function.GetTypes(transformType) {
+		switch t {
+		case function.BWT_TYPE, function.BWTS_TYPE, function.AUTOBWT_TYPE, function.LZ_TYPE,
+			function.RLT_TYPE, function.ZRLT_TYPE, function.MTFT_TYPE, function.RANK_TYPE:
+			return true
+		}
+	}
+
+	return false
+}
+
+// Decode the block again with the portable reference implementation of the
+// transforms (single job, no word level or CPU specific fast path) and
+// compare with the result of the fast decoder. The stages without a
+// reference implementation (see hasReferenceInverse) run the same code.
+func (this *decodingTask) verifyInverse(src, decoded []byte, skipFlags byte) error {
+	ctx := make(map[string]interface{}, len(this.ctx)+2)
+
+	for k, v := range this.ctx {
+		ctx[k] = v
+	}
+
+	ctx["reference"] = true
+	ctx["jobs"] = uint(1)
+	transform, err := function.NewByteFunction(&ctx, this.blockTransformType)
+
+	if err != nil {
+		return err
+	}
+
+	transform.SetSkipFlags(skipFlags)
+	dst := make([]byte, len(this.oBuffer.Buf))
+	_, oIdx, err := transform.Inverse(src, dst)
+
+	if err != nil {
+		return fmt.Errorf("Verification of block %d failed: reference decoder error: %v", this.currentBlockID, err)
+	}
+
+	if bytes.Equal(dst[0:oIdx], decoded) == false {
+		return fmt.Errorf("Verification of block %d failed: output differs from the reference decoder", this.currentBlockID)
+	}
+
+	return nil
+}
+
+func (this *decodingTask) blockInfo(stage int) BlockInfo {
+	transform, _ := this.ctx["transform"].(string)
+	codec, _ := this.ctx["codec"].(string)
+	return BlockInfo{ID: this.currentBlockID, Stage: stage, Decoding: true,
+		Transform: transform, Entropy: codec}
+}
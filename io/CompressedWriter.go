@@ -0,0 +1,235 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// A range of data written out of order
+type pendingRange struct {
+	offset int64
+	data   []byte
+}
+
+// CompressedWriter compresses data written at arbitrary offsets (for layers
+// expecting random access, such as archive or file system layers).
+// CompressedWriter implements io.Writer, io.WriterAt, io.Seeker and
+// io.Closer. WriteAt can be called concurrently. The compressed stream is
+// sequential: the ranges written ahead of the compressed data are buffered
+// (up to a limit) until the gap before them is filled. The data cannot be
+// written twice.
+type CompressedWriter struct {
+	os         *CompressedOutputStream
+	written    int64 // size of the data sent to the compressed stream
+	pos        int64
+	pending    []pendingRange // sorted by offset, not overlapping
+	pendingLen int64
+	maxPending int64
+	mutex      sync.Mutex
+	closed     bool
+}
+
+// NewCompressedWriter creates a new instance of CompressedWriter writing to
+// the compressed stream 'os'. No more than 'maxPending' bytes can be written
+// ahead of the compressed data.
+func NewCompressedWriter(os *CompressedOutputStream, maxPending int64) (*CompressedWriter, error) {
+	if os == nil {
+		return nil, NewIOError("Invalid null output stream parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if maxPending < 0 {
+		return nil, NewIOError("Invalid negative buffer size parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	return &CompressedWriter{os: os, maxPending: maxPending}, nil
+}
+
+// Size returns the size of the data compressed so far (the ranges buffered
+// ahead of it excluded)
+func (this *CompressedWriter) Size() int64 {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.written
+}
+
+// Write writes len(p) bytes at the current position and advances it
+func (this *CompressedWriter) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	n, err := this.writeAt(p, this.pos)
+	this.pos += int64(n)
+	return n, err
+}
+
+// Seek sets the position of the next Write (see io.Seeker). io.SeekEnd is
+// relative to the end of the data written so far (buffered ranges included).
+func (this *CompressedWriter) Seek(offset int64, whence int) (int64, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += this.pos
+	case io.SeekEnd:
+		end := this.written
+
+		if len(this.pending) > 0 {
+			last := this.pending[len(this.pending)-1]
+			end = last.offset + int64(len(last.data))
+		}
+
+		offset += end
+	default:
+		return this.pos, NewIOError("Invalid seek whence parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if offset < 0 {
+		return this.pos, NewIOError("Invalid negative seek position", kanzi.ERR_INVALID_PARAM)
+	}
+
+	this.pos = offset
+	return offset, nil
+}
+
+// WriteAt writes len(p) bytes of original data at offset 'off' (see
+// io.WriterAt). Returns an error if the range overlaps data already written
+// or if too much data is buffered.
+func (this *CompressedWriter) WriteAt(p []byte, off int64) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.writeAt(p, off)
+}
+
+func (this *CompressedWriter) writeAt(p []byte, off int64) (int, error) {
+	if this.closed == true {
+		return 0, NewIOError("Stream closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	if off < 0 {
+		return 0, NewIOError("Invalid negative offset", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	end := off + int64(len(p))
+
+	if off < this.written {
+		errMsg := fmt.Sprintf("Cannot write at offset %d: the data up to offset %d is already compressed", off, this.written)
+		return 0, NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	// First pending range ending after 'off'
+	idx := sort.Search(len(this.pending), func(i int) bool {
+		return this.pending[i].offset+int64(len(this.pending[i].data)) > off
+	})
+
+	if idx < len(this.pending) && this.pending[idx].offset < end {
+		errMsg := fmt.Sprintf("Cannot write at offset %d: the range overlaps data already written", off)
+		return 0, NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	if off == this.written {
+		if _, err := this.os.Write(p); err != nil {
+			return 0, err
+		}
+
+		this.written = end
+		return len(p), this.drain()
+	}
+
+	if this.pendingLen+int64(len(p)) > this.maxPending {
+		errMsg := fmt.Sprintf("Cannot write at offset %d: more than %d bytes written ahead of offset %d",
+			off, this.maxPending, this.written)
+		return 0, NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	// The caller may reuse p
+	data := make([]byte, len(p))
+	copy(data, p)
+	this.pending = append(this.pending, pendingRange{})
+	copy(this.pending[idx+1:], this.pending[idx:])
+	this.pending[idx] = pendingRange{offset: off, data: data}
+	this.pendingLen += int64(len(data))
+	return len(p), nil
+}
+
+// Compress the pending ranges following the compressed data
+func (this *CompressedWriter) drain() error {
+	n := 0
+
+	for n < len(this.pending) && this.pending[n].offset == this.written {
+		data := this.pending[n].data
+
+		if _, err := this.os.Write(data); err != nil {
+			return err
+		}
+
+		this.written += int64(len(data))
+		this.pendingLen -= int64(len(data))
+		n++
+	}
+
+	if n > 0 {
+		this.pending = append(this.pending[:0], this.pending[n:]...)
+	}
+
+	return nil
+}
+
+// Flush compresses the data buffered by the compressed stream and writes it
+// with a sync marker (see CompressedOutputStream.Flush). The ranges written
+// ahead of the compressed data remain buffered.
+func (this *CompressedWriter) Flush() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed == true {
+		return NewIOError("Stream closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	return this.os.Flush()
+}
+
+// Close closes the compressed stream. Returns an error if some data is
+// missing before the ranges written ahead of it.
+func (this *CompressedWriter) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.closed == true {
+		return nil
+	}
+
+	this.closed = true
+
+	if len(this.pending) > 0 {
+		errMsg := fmt.Sprintf("Missing data at offset %d (%d bytes written after it)", this.written, this.pendingLen)
+		this.pending = nil
+		this.os.Close()
+		return NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	return this.os.Close()
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+var (
+	_CONFIGS       = make(map[string]*Config)
+	_CONFIGS_MUTEX sync.RWMutex
+
+	// Number of jobs (always required) then the output stream parameters
+	_CONFIG_CHECKS = []configCheck{
+		{"jobs", true, "uint", func(v interface{}) bool { _, ok := v.(uint); return ok }},
+		{"codec", true, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"transform", true, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"blockSize", true, "uint", func(v interface{}) bool { _, ok := v.(uint); return ok }},
+		{"checksum", true, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"checksumType", false, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"streamDigest", false, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"parityShards", false, "uint", func(v interface{}) bool { _, ok := v.(uint); return ok }},
+		{"dictionaryMode", false, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"lzDictionary", false, "*function.LZDictionary", func(v interface{}) bool { _, ok := v.(*function.LZDictionary); return ok }},
+		{"textDictionary", false, "*function.TextDictionary", func(v interface{}) bool { _, ok := v.(*function.TextDictionary); return ok }},
+		{"syncPoints", false, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"partialBlocks", false, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"headerSections", false, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"compactHeaders", false, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"fileSize", false, "int64", func(v interface{}) bool { _, ok := v.(int64); return ok }},
+		{"level", false, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"maxMemory", false, "uint64", func(v interface{}) bool { _, ok := v.(uint64); return ok }},
+		{"raceTransform", false, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"raceBudget", false, "float64", func(v interface{}) bool { _, ok := v.(float64); return ok }},
+		{"outputDigest", false, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"index", false, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"packedIndex", false, "bool", func(v interface{}) bool { _, ok := v.(bool); return ok }},
+		{"passphrase", false, "string", func(v interface{}) bool { _, ok := v.(string); return ok }},
+		{"encryptionKey", false, "[]byte", func(v interface{}) bool { _, ok := v.([]byte); return ok }},
+	}
+)
+
+type configCheck struct {
+	key      string
+	required bool
+	typeName string
+	isValid  func(interface{}) bool
+}
+
+// Config a set of stream parameters (the content of the map provided to
+// NewCompressedOutputStreamWithCtx or NewCompressedInputStreamWithCtx).
+// A Config can be modified until Freeze is called. Freeze validates the
+// parameters and normalizes the codec and transform names once. A frozen
+// Config is immutable: it can be shared by goroutines and used to create
+// any number of streams without validating the parameters again.
+// Clone returns a modifiable copy.
+type Config struct {
+	params map[string]interface{}
+	frozen bool
+	output *outputParams // validated output stream parameters (nil if absent)
+}
+
+// NewConfig creates a new modifiable configuration with the parameters of
+// an output stream
+func NewConfig(codec, transform string, blockSize, jobs uint, checksum bool) *Config {
+	return &Config{params: map[string]interface{}{
+		"codec":     codec,
+		"transform": transform,
+		"blockSize": blockSize,
+		"jobs":      jobs,
+		"checksum":  checksum,
+	}}
+}
+
+// NewConfigWithCtx creates a new modifiable configuration with a copy of the
+// provided map of parameters
+func NewConfigWithCtx(ctx map[string]interface{}) *Config {
+	this := &Config{params: make(map[string]interface{}, len(ctx))}
+
+	for k, v := range ctx {
+		this.params[k] = v
+	}
+
+	return this
+}
+
+// Set sets the value of a parameter. Fails if the configuration is frozen.
+func (this *Config) Set(key string, value interface{}) error {
+	if this.frozen == true {
+		errMsg := fmt.Sprintf("Cannot set parameter '%s': the configuration is frozen", key)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	this.params[key] = value
+	return nil
+}
+
+// Get returns the value of a parameter and true if present
+func (this *Config) Get(key string) (interface{}, bool) {
+	val, exists := this.params[key]
+	return val, exists
+}
+
+// Frozen returns true if the configuration has been validated and can no
+// longer be modified
+func (this *Config) Frozen() bool {
+	return this.frozen
+}
+
+// Freeze validates the parameters and makes the configuration immutable.
+// The number of jobs is required. If any of the output stream parameters
+// (codec, transform, block size, checksum) is present, all of them are
+// required and validated (the codec and transform names are normalized).
+// Freezing a frozen configuration does nothing.
+func (this *Config) Freeze() (err error) {
+	if this.frozen == true {
+		return nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewIOError(fmt.Sprintf("Invalid configuration: %v", r), kanzi.ERR_INVALID_PARAM)
+		}
+	}()
+
+	if err := this.checkType(_CONFIG_CHECKS[0]); err != nil {
+		return err
+	}
+
+	if jobs := this.params["jobs"].(uint); jobs == 0 || jobs > _MAX_CONCURRENCY {
+		errMsg := fmt.Sprintf("Invalid configuration: the number of jobs must be in [1..%v]", _MAX_CONCURRENCY)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	output := false
+
+	for _, c := range _CONFIG_CHECKS[1:] {
+		if _, exists := this.params[c.key]; exists == true && c.required == true {
+			output = true
+		}
+	}
+
+	if output == true {
+		for _, c := range _CONFIG_CHECKS[1:] {
+			if err := this.checkType(c); err != nil {
+				return err
+			}
+		}
+
+		params, err := parseOutputParams(this.params)
+
+		if err != nil {
+			if ioErr, isIOErr := err.(*IOError); isIOErr == true {
+				return NewIOError("Invalid configuration: "+ioErr.Message(), kanzi.ERR_INVALID_PARAM)
+			}
+
+			return err
+		}
+
+		this.params["codec"] = entropy.GetName(params.entropyType)
+		this.params["transform"] = function.GetName(params.transformType)
+
+		// The stream chain of a race includes the alternate chain
+		if params.race != nil {
+			this.params["transform"] = function.GetName(params.race.types[_RACE_PRIMARY])
+			this.params["raceTransform"] = function.GetName(params.race.types[_RACE_ALTERNATE])
+		}
+		this.output = &params
+	}
+
+	this.frozen = true
+	return nil
+}
+
+// Check that the parameter (if present or required) has the expected type
+func (this *Config) checkType(c configCheck) error {
+	key := c.key
+	val, exists := this.params[key]
+
+	if exists == false {
+		if c.required == false {
+			return nil
+		}
+
+		errMsg := fmt.Sprintf("Invalid configuration: missing parameter '%s'", key)
+		return NewIOError(errMsg, kanzi.ERR_MISSING_PARAM)
+	}
+
+	if c.isValid(val) == false {
+		errMsg := fmt.Sprintf("Invalid configuration: parameter '%s' must be a %s, got %T", key, c.typeName, val)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	return nil
+}
+
+// Clone returns a modifiable copy of the configuration
+func (this *Config) Clone() *Config {
+	return NewConfigWithCtx(this.params)
+}
+
+// Ctx returns a copy of the parameters (EG. for the constructors of the
+// transforms and entropy codecs)
+func (this *Config) Ctx() map[string]interface{} {
+	res := make(map[string]interface{}, len(this.params)+4)
+
+	for k, v := range this.params {
+		res[k] = v
+	}
+
+	return res
+}
+
+// String returns the parameters sorted by name (EG. "blockSize=1048576 checksum=false ...").
+// The key material of encrypted streams is masked.
+func (this *Config) String() string {
+	keys := make([]string, 0, len(this.params))
+
+	for k := range this.params {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	tokens := make([]string, len(keys))
+
+	for i, k := range keys {
+		if k == "passphrase" || k == "encryptionKey" {
+			tokens[i] = k + "=***"
+			continue
+		}
+
+		tokens[i] = fmt.Sprintf("%s=%v", k, this.params[k])
+	}
+
+	return strings.Join(tokens, " ")
+}
+
+// RegisterConfig makes a frozen configuration available by name. Registering
+// a configuration with the same name as a previous one replaces it.
+func RegisterConfig(name string, cfg *Config) error {
+	name = strings.TrimSpace(name)
+
+	if len(name) == 0 {
+		return NewIOError("Invalid empty configuration name", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if cfg == nil {
+		return NewIOError("Invalid null configuration parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if cfg.frozen == false {
+		errMsg := fmt.Sprintf("Cannot register configuration '%s': the configuration must be frozen", name)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	_CONFIGS_MUTEX.Lock()
+	defer _CONFIGS_MUTEX.Unlock()
+	_CONFIGS[name] = cfg
+	return nil
+}
+
+// GetConfig returns the configuration registered with the provided name
+func GetConfig(name string) (*Config, bool) {
+	_CONFIGS_MUTEX.RLock()
+	defer _CONFIGS_MUTEX.RUnlock()
+	cfg, exists := _CONFIGS[strings.TrimSpace(name)]
+	return cfg, exists
+}
+
+// NewCompressedOutputStreamWithConfig creates a new instance of
+// CompressedOutputStream using a frozen configuration (the parameters are
+// not validated again)
+func NewCompressedOutputStreamWithConfig(os io.WriteCloser, cfg *Config) (*CompressedOutputStream, error) {
+	if os == nil {
+		return nil, NewIOError("Invalid null writer parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if cfg == nil || cfg.frozen == false {
+		return nil, NewIOError("Invalid configuration parameter: the configuration must be frozen", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if cfg.output == nil {
+		return nil, NewIOError("Invalid configuration parameter: missing output stream parameters", kanzi.ERR_CREATE_STREAM)
+	}
+
+	return newCompressedOutputStream(os, cfg.Ctx(), *cfg.output)
+}
+
+// NewCompressedInputStreamWithConfig creates a new instance of
+// CompressedInputStream using a frozen configuration (the parameters are
+// not validated again)
+func NewCompressedInputStreamWithConfig(is io.ReadCloser, cfg *Config) (*CompressedInputStream, error) {
+	if is == nil {
+		return nil, NewIOError("Invalid null reader parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if cfg == nil || cfg.frozen == false {
+		return nil, NewIOError("Invalid configuration parameter: the configuration must be frozen", kanzi.ERR_CREATE_STREAM)
+	}
+
+	return newCompressedInputStream(is, cfg.Ctx(), cfg.params["jobs"].(uint))
+}
@@ -0,0 +1,271 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"strings"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// Preset dictionaries shared at the stream level (context key
+// 'dictionaryMode'). The LZ dictionary (context key 'lzDictionary') and the
+// text dictionary (context key 'textDictionary') are stored once in the
+// stream header, either embedded (the decoder needs nothing else) or
+// referenced by id (the decoder must be provided the dictionaries or they
+// must be registered, see function.RegisterLZDictionary). The decoder loads
+// them in its context: the blocks only reference them.
+const (
+	DICTIONARY_MODE_EMBED     = "embed"
+	DICTIONARY_MODE_REFERENCE = "reference"
+)
+
+// The preset dictionaries of a stream
+type streamDictionaries struct {
+	embed bool
+	lz    *function.LZDictionary
+	text  *function.TextDictionary // blocks reference it by id
+}
+
+// Return the dictionaries to store in the stream header (nil if none)
+func parseStreamDictionaries(ctx map[string]interface{}) (*streamDictionaries, error) {
+	val, containsKey := ctx["dictionaryMode"]
+
+	if containsKey == false {
+		return nil, nil
+	}
+
+	res := &streamDictionaries{}
+	mode, _ := val.(string)
+
+	if strings.EqualFold(mode, DICTIONARY_MODE_EMBED) == true {
+		res.embed = true
+	} else if strings.EqualFold(mode, DICTIONARY_MODE_REFERENCE) == false {
+		errMsg := fmt.Sprintf("Invalid dictionary mode: '%v' (must be '%s' or '%s')", val,
+			DICTIONARY_MODE_EMBED, DICTIONARY_MODE_REFERENCE)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	if dict, containsKey := ctx["lzDictionary"]; containsKey == true && dict != nil {
+		var ok bool
+
+		if res.lz, ok = dict.(*function.LZDictionary); ok == false {
+			errMsg := fmt.Sprintf("Invalid LZ dictionary: expected *LZDictionary, got %T", dict)
+			return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+		}
+	}
+
+	if dict, containsKey := ctx["textDictionary"]; containsKey == true && dict != nil {
+		text, ok := dict.(*function.TextDictionary)
+
+		if ok == false {
+			errMsg := fmt.Sprintf("Invalid text dictionary: expected *TextDictionary, got %T", dict)
+			return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+		}
+
+		if len(text.Bytes()) > DICTIONARY_MAX_SIZE {
+			return nil, NewIOError("The text dictionary is too big", kanzi.ERR_INVALID_PARAM)
+		}
+
+		// The blocks must not embed the dictionary again
+		var err error
+
+		if res.text, err = function.LoadTextDictionary(text.Bytes(), false); err != nil {
+			return nil, NewIOError(err.Error(), kanzi.ERR_INVALID_PARAM)
+		}
+	}
+
+	if res.lz == nil && res.text == nil {
+		return nil, NewIOError("The dictionary mode requires a LZ or a text dictionary", kanzi.ERR_MISSING_PARAM)
+	}
+
+	return res, nil
+}
+
+// Set the dictionaries in the context of a task
+func (this *streamDictionaries) setCtx(ctx map[string]interface{}) {
+	if this.lz != nil {
+		ctx["lzDictionary"] = this.lz
+	}
+
+	if this.text != nil {
+		ctx["textDictionary"] = this.text
+	}
+}
+
+// Set the dictionaries and the dictionary mode in the parameters of a new
+// stream
+func (this *streamDictionaries) setParams(ctx map[string]interface{}) {
+	this.setCtx(ctx)
+	ctx["dictionaryMode"] = DICTIONARY_MODE_REFERENCE
+
+	if this.embed == true {
+		ctx["dictionaryMode"] = DICTIONARY_MODE_EMBED
+	}
+}
+
+// Return the mode of a dictionary in the header
+func (this *streamDictionaries) mode(present bool) uint64 {
+	if present == false {
+		return DICTIONARY_NONE
+	}
+
+	if this.embed == true {
+		return DICTIONARY_EMBEDDED
+	}
+
+	return DICTIONARY_REFERENCED
+}
+
+// Size in bits of the dictionaries in the stream header
+func (this *streamDictionaries) headerBits() uint {
+	res := uint(2*DICTIONARY_MODE_BITS + DICTIONARY_RESERVED_BITS)
+
+	for _, data := range this.contents() {
+		if this.embed == true {
+			res += DICTIONARY_SIZE_BITS + 8*uint(len(data))
+		} else {
+			res += DICTIONARY_ID_BITS
+		}
+	}
+
+	return res
+}
+
+// Return the content of the dictionaries (LZ first)
+func (this *streamDictionaries) contents() [][]byte {
+	res := make([][]byte, 0, 2)
+
+	if this.lz != nil {
+		res = append(res, this.lz.Bytes())
+	}
+
+	if this.text != nil {
+		res = append(res, this.text.Bytes())
+	}
+
+	return res
+}
+
+func (this *streamDictionaries) write(obs kanzi.OutputBitStream) *IOError {
+	obs.WriteBits(this.mode(this.lz != nil), DICTIONARY_MODE_BITS)
+	obs.WriteBits(this.mode(this.text != nil), DICTIONARY_MODE_BITS)
+
+	if obs.WriteBits(0, DICTIONARY_RESERVED_BITS) != DICTIONARY_RESERVED_BITS {
+		return NewIOError("Cannot write dictionaries to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	ids := make([]uint32, 0, 2)
+
+	if this.lz != nil {
+		ids = append(ids, this.lz.ID())
+	}
+
+	if this.text != nil {
+		ids = append(ids, this.text.ID())
+	}
+
+	for i, data := range this.contents() {
+		if this.embed == false {
+			obs.WriteBits(uint64(ids[i]), DICTIONARY_ID_BITS)
+			continue
+		}
+
+		obs.WriteBits(uint64(len(data)), DICTIONARY_SIZE_BITS)
+
+		if obs.WriteArray(data, 8*uint(len(data))) != 8*uint(len(data)) {
+			return NewIOError("Cannot write dictionaries to header", kanzi.ERR_WRITE_FILE)
+		}
+	}
+
+	return nil
+}
+
+// Read the dictionaries in the stream header. The referenced dictionaries
+// are looked up in the context then in the registered dictionaries.
+func readStreamDictionaries(ibs kanzi.InputBitStream, ctx map[string]interface{}) (*streamDictionaries, *IOError) {
+	lzMode := ibs.ReadBits(DICTIONARY_MODE_BITS)
+	textMode := ibs.ReadBits(DICTIONARY_MODE_BITS)
+
+	if ibs.ReadBits(DICTIONARY_RESERVED_BITS) != 0 || lzMode > DICTIONARY_EMBEDDED || textMode > DICTIONARY_EMBEDDED {
+		return nil, NewIOError("Invalid bitstream, unknown dictionary fields", kanzi.ERR_INVALID_FILE)
+	}
+
+	res := &streamDictionaries{embed: lzMode == DICTIONARY_EMBEDDED || textMode == DICTIONARY_EMBEDDED}
+
+	if lzMode == DICTIONARY_REFERENCED {
+		id := uint32(ibs.ReadBits(DICTIONARY_ID_BITS))
+
+		if dict, _ := ctx["lzDictionary"].(*function.LZDictionary); dict != nil && dict.ID() == id {
+			res.lz = dict
+		} else if res.lz = function.GetLZDictionary(id); res.lz == nil {
+			errMsg := fmt.Sprintf("Missing LZ dictionary %x: it must be provided or registered", id)
+			return nil, NewIOError(errMsg, kanzi.ERR_MISSING_PARAM)
+		}
+	} else if lzMode == DICTIONARY_EMBEDDED {
+		data, ioErr := readDictionaryContent(ibs)
+
+		if ioErr != nil {
+			return nil, ioErr
+		}
+
+		var err error
+
+		if res.lz, err = function.NewLZDictionary(data); err != nil {
+			return nil, NewIOError("Invalid bitstream: "+err.Error(), kanzi.ERR_INVALID_FILE)
+		}
+	}
+
+	if textMode == DICTIONARY_REFERENCED {
+		id := uint32(ibs.ReadBits(DICTIONARY_ID_BITS))
+
+		if dict, _ := ctx["textDictionary"].(*function.TextDictionary); dict != nil && dict.ID() == id {
+			res.text = dict
+		} else if res.text = function.GetTextDictionary(id); res.text == nil {
+			errMsg := fmt.Sprintf("Missing text dictionary %x: it must be provided or registered", id)
+			return nil, NewIOError(errMsg, kanzi.ERR_MISSING_PARAM)
+		}
+	} else if textMode == DICTIONARY_EMBEDDED {
+		data, ioErr := readDictionaryContent(ibs)
+
+		if ioErr != nil {
+			return nil, ioErr
+		}
+
+		var err error
+
+		if res.text, err = function.LoadTextDictionary(data, false); err != nil {
+			return nil, NewIOError("Invalid bitstream: "+err.Error(), kanzi.ERR_INVALID_FILE)
+		}
+	}
+
+	return res, nil
+}
+
+func readDictionaryContent(ibs kanzi.InputBitStream) ([]byte, *IOError) {
+	size := ibs.ReadBits(DICTIONARY_SIZE_BITS)
+
+	if size == 0 || size > DICTIONARY_MAX_SIZE {
+		errMsg := fmt.Sprintf("Invalid bitstream, incorrect dictionary size: %d", size)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	data := make([]byte, size)
+	ibs.ReadArray(data, 8*uint(size))
+	return data, nil
+}
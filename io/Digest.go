@@ -0,0 +1,122 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Names of the digests of the compressed output (context key 'outputDigest')
+const (
+	DIGEST_CRC32  = "CRC32"
+	DIGEST_MD5    = "MD5"
+	DIGEST_SHA1   = "SHA1"
+	DIGEST_SHA256 = "SHA256"
+	DIGEST_SHA512 = "SHA512"
+)
+
+// Return a new hash for the digest name (case insensitive)
+func newDigestHash(name string) (hash.Hash, error) {
+	switch strings.ToUpper(name) {
+	case DIGEST_CRC32:
+		return crc32.NewIEEE(), nil
+
+	case DIGEST_MD5:
+		return md5.New(), nil
+
+	case DIGEST_SHA1:
+		return sha1.New(), nil
+
+	case DIGEST_SHA256:
+		return sha256.New(), nil
+
+	case DIGEST_SHA512:
+		return sha512.New(), nil
+
+	default:
+		errMsg := fmt.Sprintf("Unknown output digest: '%s'", name)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+}
+
+// digestWriter updates a digest with the bytes written to the underlying
+// writer, so the digest of a compressed stream is available without reading
+// the compressed data back.
+type digestWriter struct {
+	os     io.WriteCloser
+	name   string
+	hasher hash.Hash
+	mutex  sync.Mutex
+}
+
+func newDigestWriter(os io.WriteCloser, name string) (*digestWriter, error) {
+	hasher, err := newDigestHash(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &digestWriter{os: os, name: strings.ToUpper(name), hasher: hasher}, nil
+}
+
+// Write writes to the underlying writer and adds the bytes actually written
+// to the digest.
+func (this *digestWriter) Write(b []byte) (int, error) {
+	n, err := this.os.Write(b)
+
+	if n > 0 {
+		this.mutex.Lock()
+		this.hasher.Write(b[0:n])
+		this.mutex.Unlock()
+	}
+
+	return n, err
+}
+
+// Close closes the underlying writer
+func (this *digestWriter) Close() error {
+	return this.os.Close()
+}
+
+// Sum returns the digest of the bytes written so far
+func (this *digestWriter) Sum() []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.hasher.Sum(nil)
+}
+
+// Digest returns the name of the digest algorithm and the digest of the
+// bytes written to the underlying writer so far. After Close, the digest
+// covers the whole compressed stream. Returns an error if the stream was
+// created without 'outputDigest'.
+func (this *CompressedOutputStream) Digest() (string, []byte, error) {
+	if this.digest == nil {
+		return "", nil, NewIOError("No output digest for this stream", kanzi.ERR_INVALID_PARAM)
+	}
+
+	return this.digest.name, this.digest.Sum(), nil
+}
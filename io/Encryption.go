@@ -0,0 +1,342 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/util/hash"
+)
+
+// Authenticated encryption of the compressed stream (AES-256-GCM).
+// The key is derived from a passphrase (context key 'passphrase', scrypt)
+// or from a 256 bit key (context key 'encryptionKey', HKDF-SHA256) and a
+// random salt: each stream is encrypted with a different key.
+// The compressed stream is split into segments encrypted and authenticated
+// independently (see ENCRYPTION_MAGIC for the layout). The compressed data
+// (headers included) cannot be read or modified without the key, and
+// truncated, reordered or modified segments are detected.
+
+const (
+	_SCRYPT_LOG_COST    = 15 // 32 MB
+	_SCRYPT_BLOCK_SIZE  = 8
+	_SCRYPT_PARALLELISM = 1
+	_ENCRYPTION_INFO    = "kanzi stream encryption"
+	_NONCE_SIZE         = 12
+)
+
+// The key material of an encrypted stream
+type encryptionParams struct {
+	passphrase string
+	key        []byte
+}
+
+// Return the key material in the context map (nil if the stream is not
+// encrypted)
+func parseEncryptionParams(ctx map[string]interface{}) (*encryptionParams, error) {
+	passphrase, hasPassphrase := ctx["passphrase"]
+	key, hasKey := ctx["encryptionKey"]
+
+	if hasPassphrase == false && hasKey == false {
+		return nil, nil
+	}
+
+	if hasPassphrase == true && hasKey == true {
+		return nil, NewIOError("The passphrase and the encryption key are mutually exclusive", kanzi.ERR_INVALID_PARAM)
+	}
+
+	res := &encryptionParams{}
+
+	if hasPassphrase == true {
+		if res.passphrase, _ = passphrase.(string); len(res.passphrase) == 0 {
+			return nil, NewIOError("The passphrase must be a non empty string", kanzi.ERR_INVALID_PARAM)
+		}
+	} else if res.key, _ = key.([]byte); len(res.key) != ENCRYPTION_KEY_SIZE {
+		errMsg := fmt.Sprintf("The encryption key must be %d bytes long", ENCRYPTION_KEY_SIZE)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	return res, nil
+}
+
+// Validate the envelope header of an encrypted stream
+func checkEncryptionHeader(header []byte) error {
+	if binary.BigEndian.Uint32(header) != ENCRYPTION_MAGIC {
+		return NewIOError("Invalid stream: not an encrypted stream", kanzi.ERR_INVALID_FILE)
+	}
+
+	if header[4] != ENCRYPTION_VERSION {
+		errMsg := fmt.Sprintf("Unsupported version of the encrypted stream: %d", header[4])
+		return NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+	}
+
+	if header[5] != ENCRYPTION_AES256_GCM {
+		errMsg := fmt.Sprintf("Unsupported cipher of the encrypted stream: %d", header[5])
+		return NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	if header[6] != ENCRYPTION_KDF_HKDF && header[6] != ENCRYPTION_KDF_SCRYPT {
+		errMsg := fmt.Sprintf("Unsupported key derivation of the encrypted stream: %d", header[6])
+		return NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	return nil
+}
+
+// Derive the key of the stream and return the cipher
+func newEncryptionCipher(header []byte, params *encryptionParams) (cipher.AEAD, error) {
+	var key []byte
+	var err error
+	salt := header[ENCRYPTION_HEADER_SIZE-ENCRYPTION_SALT_SIZE : ENCRYPTION_HEADER_SIZE]
+
+	if header[6] == ENCRYPTION_KDF_SCRYPT {
+		if len(params.passphrase) == 0 {
+			return nil, NewIOError("The stream is encrypted with a passphrase", kanzi.ERR_INVALID_PARAM)
+		}
+
+		// The parameters are not authenticated yet: bound the memory and
+		// the time of the key derivation
+		if header[7] == 0 || header[7] > ENCRYPTION_SCRYPT_MAX_LOG_COST ||
+			header[8] == 0 || header[8] > ENCRYPTION_SCRYPT_MAX_BLOCK_SIZE ||
+			header[9] == 0 || header[9] > ENCRYPTION_SCRYPT_MAX_PARALLELISM {
+			errMsg := fmt.Sprintf("Invalid key derivation parameters: cost 2^%d, block size %d, parallelization %d",
+				header[7], header[8], header[9])
+			return nil, &IOError{msg: errMsg, code: kanzi.ERR_INVALID_FILE, err: kanzi.NewCorruptStreamError(errMsg)}
+		}
+
+		key, err = hash.Scrypt([]byte(params.passphrase), salt, 1<<header[7], int(header[8]),
+			int(header[9]), ENCRYPTION_KEY_SIZE)
+	} else {
+		if len(params.key) == 0 {
+			return nil, NewIOError("The stream is encrypted with a key", kanzi.ERR_INVALID_PARAM)
+		}
+
+		key, err = hash.HKDF(params.key, salt, []byte(_ENCRYPTION_INFO), ENCRYPTION_KEY_SIZE)
+	}
+
+	if err != nil {
+		return nil, NewIOError("Cannot derive the encryption key: "+err.Error(), kanzi.ERR_INVALID_FILE)
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Nonce of a segment: index of the segment then the 'last segment' flag
+func segmentNonce(nonce []byte, counter uint64, last bool) {
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	nonce[11] = 0
+
+	if last == true {
+		nonce[11] = 1
+	}
+}
+
+// encryptWriter encrypts the compressed stream written to the underlying
+// writer. The last segment is written by finish.
+type encryptWriter struct {
+	os      io.WriteCloser
+	aead    cipher.AEAD
+	header  []byte // envelope header, authenticated with each segment
+	buf     []byte // data of the current segment
+	sealed  []byte // current encrypted segment
+	nonce   [_NONCE_SIZE]byte
+	counter uint64
+	started bool
+}
+
+func newEncryptWriter(os io.WriteCloser, params *encryptionParams) (*encryptWriter, error) {
+	header := make([]byte, ENCRYPTION_HEADER_SIZE)
+	binary.BigEndian.PutUint32(header, ENCRYPTION_MAGIC)
+	header[4] = ENCRYPTION_VERSION
+	header[5] = ENCRYPTION_AES256_GCM
+	header[6] = ENCRYPTION_KDF_HKDF
+
+	if len(params.passphrase) != 0 {
+		header[6] = ENCRYPTION_KDF_SCRYPT
+		header[7] = _SCRYPT_LOG_COST
+		header[8] = _SCRYPT_BLOCK_SIZE
+		header[9] = _SCRYPT_PARALLELISM
+	}
+
+	if _, err := rand.Read(header[ENCRYPTION_HEADER_SIZE-ENCRYPTION_SALT_SIZE:]); err != nil {
+		return nil, NewIOError("Cannot generate the encryption salt: "+err.Error(), kanzi.ERR_CREATE_STREAM)
+	}
+
+	aead, err := newEncryptionCipher(header, params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	this := &encryptWriter{os: os, aead: aead, header: header}
+	this.buf = make([]byte, 0, ENCRYPTION_SEGMENT_SIZE)
+	return this, nil
+}
+
+// Write buffers the data and encrypts the full segments
+func (this *encryptWriter) Write(b []byte) (int, error) {
+	n := 0
+
+	for len(b) > 0 {
+		if len(this.buf) == cap(this.buf) {
+			// More data follows: not the last segment
+			if err := this.seal(false); err != nil {
+				return n, err
+			}
+		}
+
+		k := copy(this.buf[len(this.buf):cap(this.buf)], b)
+		this.buf = this.buf[0 : len(this.buf)+k]
+		b = b[k:]
+		n += k
+	}
+
+	return n, nil
+}
+
+func (this *encryptWriter) seal(last bool) error {
+	if this.started == false {
+		if _, err := this.os.Write(this.header); err != nil {
+			return err
+		}
+
+		this.started = true
+	}
+
+	segmentNonce(this.nonce[:], this.counter, last)
+	this.sealed = this.aead.Seal(this.sealed[:0], this.nonce[:], this.buf, this.header)
+	this.counter++
+	this.buf = this.buf[:0]
+	_, err := this.os.Write(this.sealed)
+	return err
+}
+
+// Encrypt and write the last segment (possibly empty)
+func (this *encryptWriter) finish() error {
+	return this.seal(true)
+}
+
+// Close closes the underlying writer
+func (this *encryptWriter) Close() error {
+	return this.os.Close()
+}
+
+// decryptReader decrypts and authenticates the segments read from the
+// underlying reader. The data after the last segment is not read.
+type decryptReader struct {
+	is      io.ReadCloser
+	params  *encryptionParams
+	aead    cipher.AEAD
+	header  []byte
+	segment []byte // current encrypted segment
+	plain   []byte // decrypted data of the current segment
+	offset  int    // read offset in plain
+	nonce   [_NONCE_SIZE]byte
+	counter uint64
+	last    bool // the last segment has been decrypted
+	err     error
+}
+
+// Read returns the decrypted data of the stream
+func (this *decryptReader) Read(b []byte) (int, error) {
+	for this.offset == len(this.plain) {
+		if this.err != nil {
+			return 0, this.err
+		}
+
+		if this.last == true {
+			return 0, io.EOF
+		}
+
+		this.err = this.open()
+	}
+
+	n := copy(b, this.plain[this.offset:])
+	this.offset += n
+	return n, nil
+}
+
+// Read and decrypt the next segment
+func (this *decryptReader) open() error {
+	if this.aead == nil {
+		this.header = make([]byte, ENCRYPTION_HEADER_SIZE)
+
+		if _, err := io.ReadFull(this.is, this.header); err != nil {
+			return NewIOError("Cannot read the encryption header: "+err.Error(), kanzi.ERR_READ_FILE)
+		}
+
+		if err := checkEncryptionHeader(this.header); err != nil {
+			return err
+		}
+
+		aead, err := newEncryptionCipher(this.header, this.params)
+
+		if err != nil {
+			return err
+		}
+
+		this.aead = aead
+		this.segment = make([]byte, ENCRYPTION_SEGMENT_SIZE+ENCRYPTION_TAG_SIZE)
+	}
+
+	n, err := io.ReadFull(this.is, this.segment)
+
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return NewIOError("Truncated encrypted stream", kanzi.ERR_READ_FILE)
+		}
+
+		return NewIOError("Cannot read encrypted stream: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	// A short segment is the last one, a full one may also be the last one
+	this.last = n < len(this.segment)
+	segmentNonce(this.nonce[:], this.counter, this.last)
+	plain, err := this.aead.Open(this.plain[:0], this.nonce[:], this.segment[0:n], this.header)
+
+	if err != nil && this.last == false {
+		this.last = true
+		segmentNonce(this.nonce[:], this.counter, this.last)
+		plain, err = this.aead.Open(this.plain[:0], this.nonce[:], this.segment[0:n], this.header)
+	}
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot decrypt segment %d: invalid key or corrupted data", this.counter)
+		return NewIOError(errMsg, kanzi.ERR_CRC_CHECK)
+	}
+
+	this.plain = plain
+	this.offset = 0
+	this.counter++
+	return nil
+}
+
+// Close closes the underlying reader
+func (this *decryptReader) Close() error {
+	return this.is.Close()
+}
@@ -0,0 +1,563 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// Wire format of a compressed stream. The values below are part of the
+// bitstream format: they only change with STREAM_FORMAT_VERSION.
+//
+// Stream header (bits, most significant bit first):
+// magic (32) | version (5) | checksum flag (1) | entropy id (5) |
+// transform ids (8*6) | block size/16 (28) | number of blocks (6) |
+// compact block headers flag (1) | entropy options flag (1) |
+// entropy lanes flag (1)
+// The 3 flags are reserved (0) in version 8: the streams that set one of
+// them are written with version 9 at least so that the decoders of version 8
+// reject them.
+// Streams of version 9 have an extended header (one more byte):
+// checksum type (2, see CHECKSUM_TYPE_XXHASH32) | digest flag (1) |
+// parity level (2, see PARITY_DATA_SHARDS) | dictionaries flag (1) |
+// sync points flag (1) | partial blocks flag (1). Streams of version 8 use
+// XXHash32 block checksums and have no digest, no parity, no dictionaries, no
+// sync points and no partial blocks. The version 8 header is written if these
+// fields and the reserved flags are 0 and if the extensions of the transforms
+// are not used (EG. context keys 'textEscapeRuns', 'textMarkup', 'textRetain',
+// 'textChunkSize', 'lzCoders', 'rolzLogPosChecks' and 'rltWidth', see
+// function.HasExtensions): the blocks are self-describing but the decoders
+// of version 8 cannot decode them.
+// If the dictionaries flag is set, the preset dictionaries of the transforms
+// follow (context key 'dictionaryMode', see CompressedOutputStream):
+// LZ dictionary mode (2) | text dictionary mode (2) | reserved (4, 0), then
+// for each dictionary (LZ first): id (32, DICTIONARY_REFERENCED) or
+// size in bytes (32) and content (DICTIONARY_EMBEDDED, see
+// function.LZDictionary.Bytes and function.TextDictionary.Bytes).
+// Streams of version 10 (context key 'headerSections') are self-describing:
+// sections follow the extended header (and the dictionaries), each one as
+// id (8) | flags (8: SECTION_CRITICAL, other bits 0) | length in bytes (24) |
+// data, then a section id SECTION_END (8). A decoder skips the sections it
+// does not know, unless they are critical. The sections start at a byte
+// boundary. SECTION_TRANSFORMS (transform chain in order of application) and
+// SECTION_ENTROPY (entropy codec) describe the stages of the blocks:
+// number of stages (8) then, for each stage, id (16) | number of parameters
+// (8) then, for each parameter, id (8, STAGE_PARAM_CRITICAL set if the
+// decoder must know it) | length in bytes (8) | value. Parameters:
+// STAGE_PARAM_DICTIONARY: id (32) of the preset dictionary of the stage in
+// the header (LZ and TEXT). STAGE_PARAM_FEATURES: block features of the
+// entropy codec (8 bits: 1 means entropy options, 2 means entropy lanes).
+// The stages and parameters must match the fixed header fields: the stage
+// ids are not limited to the 6 bit transform ids and 5 bit entropy ids of the
+// fixed header, which leaves room for new codecs.
+//
+// Block header:
+// mode (8) | skip flags (8, if mode&BLOCK_MODE_TRANSFORMS) | length (8*n)
+// with n = 1 + (mode&BLOCK_MODE_SIZE_MASK)>>BLOCK_MODE_SIZE_SHIFT.
+// With compact block headers, the mode (and skip flags) and the length are
+// each preceded by one bit: 1 means 'same as previous block' (field omitted).
+// A checksum follows if the checksum flag is set (32 bits for XXHash32,
+// 64 bits for XXHash64, 256 bits for SHA-256, big endian).
+// If the parity level is set (2^level parity shards), the entropy coded data
+// follows as: length in bits (40) | data | CRC32 of each data then parity
+// shard (32 each) | parity shards. The data (last byte padded with zeros) is
+// split into PARITY_DATA_SHARDS shards of ceil(bytes/PARITY_DATA_SHARDS)
+// bytes (padded with zeros). Parity shard i is the sum of the data shards j
+// multiplied by 1/((PARITY_DATA_SHARDS+i) xor j) in GF(256) (polynomial
+// PARITY_GF_POLYNOMIAL).
+// If the entropy options flag is set, each entropy coded block starts with
+// the options of the entropy codec:
+// - TPAQ and TPAQX: the mask of the models (8 bits, see entropy.TPAQ_MODEL_ALL)
+// and the option flags (8 bits: 1 means extra models, 2 means 2 mixing
+// layers, 4 means coded with the model of the previous blocks).
+// - CM: the option flags (8 bits: 1 means order 2 context).
+// If the entropy lanes flag is set, the blocks of the binary entropy codecs
+// (FPAQ, CM, CMX, TPAQ, TPAQX) are split into lanes decoded concurrently
+// (see entropy.BinaryLanesEncoder).
+// If the sync points flag is set, sync markers may follow any block (see
+// CompressedOutputStream.Flush): an empty block of mode BLOCK_MODE_SYNC,
+// padded to a byte boundary, then SYNC_MAGIC (32). The block header
+// following a sync marker does not refer to the previous block header: the
+// decoding can resume after any sync marker.
+// If the partial blocks flag is set (the sync points flag is set too), an
+// empty block of mode BLOCK_MODE_PARTIAL may precede a block: this block
+// ends before its logical block and the next block continues it (see
+// CompressedOutputStream.Flush). When the data of the logical block preceding
+// a continuation block is at least function.LZ_MIN_DICT_SIZE bytes long, its
+// last function.LZ_MAX_DICT_SIZE bytes are the preset LZ dictionary of the
+// continuation block (instead of the dictionary of the stream, if any).
+// Any other block of length 0 marks the end of the stream. If the digest
+// flag is set, the SHA-256 of the original data (256 bits) follows, at the
+// first byte boundary after the end block.
+//
+// Block index (optional, see CompressedReader), after the end block (and
+// the digest) and padded to a byte boundary:
+// one entry per block: bit offset of the block header in the stream (64) |
+// offset of the block in the original data (64) | checksum (32, 0 if none)
+// then the trailer: number of entries (32) | size of the original data (64) |
+// XXHash32 of the entries and of the two previous fields (32) | magic (32).
+// Packed index (context key 'packedIndex'): magic (32, INDEX_PACKED_MAGIC) |
+// size of the index (32, bytes, from the magic to the trailer included),
+// then the pages of INDEX_PAGE_ENTRIES entries (the last one may be shorter)
+// and the page directory: one entry per page: bit offset of the first block
+// (64) | offset of the first block in the original data (64) | size of the
+// page (32, bytes) | XXHash32 of the page (32). The trailer has the same
+// fields as above (with the hash of the directory instead of the entries)
+// and ends with INDEX_PACKED_MAGIC. A page is the size of the deltas and
+// checksums (varint) followed by the Huffman coded deltas and checksums: for
+// each entry but the first, the deltas of the bit offset and of the offset
+// of the data with the previous entry (unsigned varints, see
+// binary.PutUvarint), then the checksum (32) of each entry. A reader only
+// loads the directory, then the pages of the blocks accessed.
+// The block headers of an indexed stream are not compact: each block can be
+// decoded without the previous ones. The blocks appended to an indexed
+// stream (see NewAppendingOutputStream) replace the end block and the index.
+//
+// Small stream (data of at most 'smallStreamThreshold' bytes, see
+// NewCompressedOutputStreamWithCtx): magic (16, SMALL_STREAM_MAGIC) |
+// checksum flag (1, XXHash32) | entropy id (5) | number of transforms (4) |
+// transform ids (6 each, in order of application), then a single block with
+// a block header that is not compact. The block is decoded with a block size
+// of SMALL_STREAM_BLOCK_SIZE and without entropy options or lanes. There is
+// no end block. The small streams are opt-in: the decoders of version 8
+// reject them (invalid stream magic).
+//
+// One-shot block (see Compress), not a stream: magic (16, ONESHOT_MAGIC) |
+// checksum flag (1, XXHash32) | entropy id (5) | number of transforms (4) |
+// transform ids (6 each, in order of application) | skip flags (8) | size of
+// the data | size of the transformed data | checksum of the data (32, if any),
+// then the entropy coded transformed data. Each size is written as the
+// number of bytes minus 1 (2) followed by the bytes. The data is stored
+// (no transform, entropy id NONE) if the coded data is larger. The block is
+// padded with zeros so that none of the sizes exceeds ONESHOT_MAX_RATIO
+// times the size of the block (the decoders reject such blocks).
+//
+// Streams can be concatenated: the header of the next stream starts at the
+// first byte boundary after the end block (or after the digest or the index,
+// or after the block of a small stream).
+//
+// Encrypted stream (context key 'passphrase' or 'encryptionKey', see
+// CompressedOutputStream): an envelope header followed by the stream split
+// into segments of ENCRYPTION_SEGMENT_SIZE bytes (the last one may be shorter
+// or empty), each one encrypted with AES-256-GCM and followed by its tag
+// (ENCRYPTION_TAG_SIZE bytes). Envelope header:
+// magic (32) | version (8) | cipher (8) | key derivation (8) |
+// scrypt log2 of cost (8) | scrypt block size (8) | scrypt parallelization (8) |
+// salt (128). The scrypt parameters are at least 1 and at most
+// ENCRYPTION_SCRYPT_MAX_LOG_COST, ENCRYPTION_SCRYPT_MAX_BLOCK_SIZE and
+// ENCRYPTION_SCRYPT_MAX_PARALLELISM (the decoders reject larger values: the
+// header is only authenticated after the key derivation). The nonce of a segment is its index (88 bits) followed by a
+// flag byte (1 for the last segment). The envelope header is authenticated
+// with each segment.
+//
+// Archive (see ArchiveWriter): the original data of the stream is the
+// magic (32) followed by the entries, each one with a header:
+// type (8) | length of the name (16) | name (UTF-8, '/' separators) |
+// mode (32, os.FileMode) | modification time (64, unix nanoseconds) |
+// size (64), followed by the data of the file (size bytes, 0 for a
+// directory). An entry of type ARCHIVE_ENTRY_END (header reduced to the type
+// byte) ends the archive. All the fields are big endian.
+const (
+	STREAM_MAGIC            = 0x4B414E5A // "KANZ"
+	STREAM_FORMAT_VERSION   = 10
+	STREAM_MIN_VERSION      = 8  // oldest version decoded (no extended header)
+	STREAM_EXT_VERSION      = 9  // first version with the extended header
+	STREAM_SECTIONS_VERSION = 10 // first version with the header sections
+	STREAM_HEADER_SIZE      = 16 // bytes, without the extended header
+	STREAM_HEADER_EXT_SIZE  = 1  // bytes (version 9)
+
+	HEADER_MAGIC_BITS           = 32
+	HEADER_VERSION_BITS         = 5
+	HEADER_CHECKSUM_BITS        = 1
+	HEADER_ENTROPY_BITS         = 5
+	HEADER_TRANSFORM_BITS       = 48 // 8 transform ids of 6 bits
+	HEADER_BLOCK_SIZE_BITS      = 28 // block size >> 4
+	HEADER_NB_BLOCKS_BITS       = 6  // 0 means unknown, 63 means 63 or more
+	HEADER_COMPACT_BITS         = 1
+	HEADER_ENTROPY_OPTIONS_BITS = 1
+	HEADER_ENTROPY_LANES_BITS   = 1
+	HEADER_CHECKSUM_TYPE_BITS   = 2
+	HEADER_DIGEST_BITS          = 1
+	HEADER_PARITY_BITS          = 2
+	HEADER_DICTIONARIES_BITS    = 1
+	HEADER_SYNC_BITS            = 1
+	HEADER_PARTIAL_BITS         = 1
+
+	CHECKSUM_TYPE_XXHASH32 = 0
+	CHECKSUM_TYPE_XXHASH64 = 1
+	CHECKSUM_TYPE_SHA256   = 2
+	STREAM_DIGEST_BITS     = 256 // SHA-256 of the original data
+
+	PARITY_DATA_SHARDS   = 16
+	PARITY_LENGTH_BITS   = 40
+	PARITY_CRC_BITS      = 32
+	PARITY_GF_POLYNOMIAL = 0x11D
+
+	DICTIONARY_NONE          = 0
+	DICTIONARY_REFERENCED    = 1 // id of a dictionary provided to the decoder (or registered)
+	DICTIONARY_EMBEDDED      = 2 // content of the dictionary in the header
+	DICTIONARY_MODE_BITS     = 2
+	DICTIONARY_RESERVED_BITS = 4
+	DICTIONARY_ID_BITS       = 32
+	DICTIONARY_SIZE_BITS     = 32
+	DICTIONARY_MAX_SIZE      = 1 << 24 // bytes
+
+	SECTION_END            = 0
+	SECTION_TRANSFORMS     = 1
+	SECTION_ENTROPY        = 2
+	SECTION_ID_BITS        = 8
+	SECTION_FLAGS_BITS     = 8
+	SECTION_LENGTH_BITS    = 24   // bytes
+	SECTION_CRITICAL       = 0x80 // flag: the decoder must know the section
+	SECTION_MAX_COUNT      = 255
+	STAGE_ID_BITS          = 16
+	STAGE_PARAM_DICTIONARY = 1
+	STAGE_PARAM_FEATURES   = 2
+	STAGE_PARAM_CRITICAL   = 0x80 // bit of the parameter id
+
+	BLOCK_MODE_COPY       = 0x80 // block stored without transform and entropy coding
+	BLOCK_MODE_SIZE_MASK  = 0x60 // number of bytes of the length field minus 1
+	BLOCK_MODE_SIZE_SHIFT = 5
+	BLOCK_MODE_TRANSFORMS = 0x10 // skip flags stored in the next byte (more than 4 transforms)
+	BLOCK_MODE_SKIP_MASK  = 0x0F // skip flags of the first 4 transforms (1 means skip)
+	BLOCK_MODE_SYNC       = 0x81 // empty block followed by a sync marker
+	BLOCK_MODE_PARTIAL    = 0x82 // empty block preceding a partial block (continued by the next block)
+	BLOCK_CHECKSUM_BITS   = 32   // XXHash32
+
+	SYNC_MAGIC = 0x4B53594E // "KSYN"
+
+	SMALL_STREAM_MAGIC           = 0x4B73 // "Ks"
+	SMALL_STREAM_BLOCK_SIZE      = 65536  // bytes, largest small stream
+	SMALL_STREAM_THRESHOLD       = 1024   // bytes, suggested 'smallStreamThreshold' (disabled by default)
+	SMALL_HEADER_MAGIC_BITS      = 16
+	SMALL_HEADER_TRANSFORMS_BITS = 4
+
+	ONESHOT_MAGIC       = 0x4B6F  // "Ko"
+	ONESHOT_SIZE_BITS   = 2       // number of bytes of a size minus 1
+	ONESHOT_MAX_SIZE    = 1 << 30 // bytes, largest data of a one-shot block
+	ONESHOT_HEADER_SIZE = 17      // bytes, largest header of stored data (see CompressBound)
+	ONESHOT_MAX_RATIO   = 1024    // largest ratio of the sizes of the data to the size of the block
+
+	INDEX_MAGIC              = 0x4B494458 // "KIDX"
+	INDEX_ENTRY_SIZE         = 20         // bytes
+	INDEX_TRAILER_SIZE       = 20         // bytes
+	INDEX_PACKED_MAGIC       = 0x4B49445A // "KIDZ"
+	INDEX_PACKED_HEADER_SIZE = 8          // bytes
+	INDEX_PAGE_ENTRIES       = 4096       // entries of a page of a packed index
+	INDEX_PAGE_SIZE          = 24         // bytes, entry of the page directory
+
+	ARCHIVE_MAGIC           = 0x4B415243 // "KARC"
+	ARCHIVE_ENTRY_END       = 0
+	ARCHIVE_ENTRY_FILE      = 1
+	ARCHIVE_ENTRY_DIR       = 2
+	ARCHIVE_HEADER_SIZE     = 23   // bytes, without the name
+	ARCHIVE_MAX_NAME_LENGTH = 4096 // bytes
+
+	ENCRYPTION_MAGIC        = 0x4B454E43 // "KENC"
+	ENCRYPTION_VERSION      = 1
+	ENCRYPTION_AES256_GCM   = 1
+	ENCRYPTION_KDF_HKDF     = 0  // 256 bit key, HKDF-SHA256 with the salt
+	ENCRYPTION_KDF_SCRYPT   = 1  // passphrase
+	ENCRYPTION_HEADER_SIZE  = 26 // bytes
+	ENCRYPTION_SALT_SIZE    = 16 // bytes
+	ENCRYPTION_KEY_SIZE     = 32 // bytes
+	ENCRYPTION_SEGMENT_SIZE = 64 * 1024
+	ENCRYPTION_TAG_SIZE     = 16 // bytes
+
+	ENCRYPTION_SCRYPT_MAX_LOG_COST    = 20 // largest scrypt log2 of cost decoded
+	ENCRYPTION_SCRYPT_MAX_BLOCK_SIZE  = 8  // largest scrypt block size decoded (1 GB with the max cost)
+	ENCRYPTION_SCRYPT_MAX_PARALLELISM = 4  // largest scrypt parallelization decoded
+
+	TRANSFORM_ID_BITS = 6
+	MAX_TRANSFORMS    = 8
+)
+
+// EntropyID the identifier of an entropy codec in the stream header
+type EntropyID uint8
+
+// TransformID the identifier of a transform in the stream header
+type TransformID uint8
+
+// Entropy codec identifiers
+const (
+	ENTROPY_NONE     = EntropyID(entropy.NONE_TYPE)
+	ENTROPY_HUFFMAN  = EntropyID(entropy.HUFFMAN_TYPE)
+	ENTROPY_FPAQ     = EntropyID(entropy.FPAQ_TYPE)
+	ENTROPY_RANGE    = EntropyID(entropy.RANGE_TYPE)
+	ENTROPY_ANS0     = EntropyID(entropy.ANS0_TYPE)
+	ENTROPY_CM       = EntropyID(entropy.CM_TYPE)
+	ENTROPY_TPAQ     = EntropyID(entropy.TPAQ_TYPE)
+	ENTROPY_ANS1     = EntropyID(entropy.ANS1_TYPE)
+	ENTROPY_TPAQX    = EntropyID(entropy.TPAQX_TYPE)
+	ENTROPY_CMX      = EntropyID(entropy.CMX_TYPE)
+	ENTROPY_RANS0    = EntropyID(entropy.RANS0_TYPE)
+	ENTROPY_RANS1    = EntropyID(entropy.RANS1_TYPE)
+	ENTROPY_AHUFFMAN = EntropyID(entropy.AHUFFMAN_TYPE)
+	ENTROPY_RLE      = EntropyID(entropy.RLE_TYPE)
+	ENTROPY_AUTO     = EntropyID(entropy.AUTO_TYPE)
+)
+
+// Transform identifiers
+const (
+	TRANSFORM_NONE    = TransformID(function.NONE_TYPE)
+	TRANSFORM_BWT     = TransformID(function.BWT_TYPE)
+	TRANSFORM_BWTS    = TransformID(function.BWTS_TYPE)
+	TRANSFORM_LZ      = TransformID(function.LZ_TYPE)
+	TRANSFORM_RLT     = TransformID(function.RLT_TYPE)
+	TRANSFORM_ZRLT    = TransformID(function.ZRLT_TYPE)
+	TRANSFORM_MTFT    = TransformID(function.MTFT_TYPE)
+	TRANSFORM_RANK    = TransformID(function.RANK_TYPE)
+	TRANSFORM_X86     = TransformID(function.X86_TYPE)
+	TRANSFORM_TEXT    = TransformID(function.DICT_TYPE)
+	TRANSFORM_ROLZ    = TransformID(function.ROLZ_TYPE)
+	TRANSFORM_ROLZX   = TransformID(function.ROLZX_TYPE)
+	TRANSFORM_SRT     = TransformID(function.SRT_TYPE)
+	TRANSFORM_AUTOBWT = TransformID(function.AUTOBWT_TYPE)
+	TRANSFORM_PATH    = TransformID(function.PATH_TYPE)
+	TRANSFORM_EXE     = TransformID(function.EXE_TYPE)
+	TRANSFORM_FP      = TransformID(function.FP_TYPE)
+	TRANSFORM_LOG     = TransformID(function.LOG_TYPE)
+	TRANSFORM_SOA     = TransformID(function.SOA_TYPE)
+	TRANSFORM_UTF16   = TransformID(function.UTF16_TYPE)
+	TRANSFORM_B64     = TransformID(function.B64_TYPE)
+	TRANSFORM_STRUCT  = TransformID(function.STRUCT_TYPE)
+	TRANSFORM_IMG     = TransformID(function.IMG_TYPE)
+	TRANSFORM_COLOR   = TransformID(function.COLOR_TYPE)
+	TRANSFORM_META    = TransformID(function.META_TYPE)
+	TRANSFORM_PLANE   = TransformID(function.PLANE_TYPE)
+)
+
+var _ENTROPY_IDS = []EntropyID{
+	ENTROPY_NONE, ENTROPY_HUFFMAN, ENTROPY_FPAQ, ENTROPY_RANGE, ENTROPY_ANS0,
+	ENTROPY_CM, ENTROPY_TPAQ, ENTROPY_ANS1, ENTROPY_TPAQX, ENTROPY_CMX,
+	ENTROPY_RANS0, ENTROPY_RANS1, ENTROPY_AHUFFMAN, ENTROPY_RLE, ENTROPY_AUTO,
+}
+
+var _TRANSFORM_IDS = []TransformID{
+	TRANSFORM_NONE, TRANSFORM_BWT, TRANSFORM_BWTS, TRANSFORM_LZ, TRANSFORM_RLT,
+	TRANSFORM_ZRLT, TRANSFORM_MTFT, TRANSFORM_RANK, TRANSFORM_X86, TRANSFORM_TEXT,
+	TRANSFORM_ROLZ, TRANSFORM_ROLZX, TRANSFORM_SRT, TRANSFORM_AUTOBWT, TRANSFORM_PATH,
+	TRANSFORM_EXE, TRANSFORM_FP, TRANSFORM_LOG, TRANSFORM_SOA, TRANSFORM_UTF16,
+	TRANSFORM_B64, TRANSFORM_STRUCT, TRANSFORM_IMG, TRANSFORM_COLOR,
+	TRANSFORM_META, TRANSFORM_PLANE,
+}
+
+// EntropyIDs returns the identifiers of all the supported entropy codecs
+func EntropyIDs() []EntropyID {
+	res := make([]EntropyID, len(_ENTROPY_IDS))
+	copy(res, _ENTROPY_IDS)
+	return res
+}
+
+// TransformIDs returns the identifiers of all the supported transforms
+func TransformIDs() []TransformID {
+	res := make([]TransformID, len(_TRANSFORM_IDS))
+	copy(res, _TRANSFORM_IDS)
+	return res
+}
+
+// IsValid returns true if the identifier is a supported entropy codec
+func (this EntropyID) IsValid() bool {
+	for _, id := range _ENTROPY_IDS {
+		if id == this {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the name of the entropy codec (EG. "HUFFMAN")
+func (this EntropyID) String() string {
+	if this.IsValid() == false {
+		return fmt.Sprintf("EntropyID(%d)", uint8(this))
+	}
+
+	return entropy.GetName(uint32(this))
+}
+
+// IsValid returns true if the identifier is a supported transform
+func (this TransformID) IsValid() bool {
+	for _, id := range _TRANSFORM_IDS {
+		if id == this {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the name of the transform (EG. "BWT")
+func (this TransformID) String() string {
+	if this.IsValid() == false {
+		return fmt.Sprintf("TransformID(%d)", uint8(this))
+	}
+
+	return function.GetTypeName(uint64(this))
+}
+
+// LookupEntropyID returns the identifier of the entropy codec with the
+// provided name (case insensitive) and false if the name is unknown
+func LookupEntropyID(name string) (EntropyID, bool) {
+	for _, id := range _ENTROPY_IDS {
+		if strings.EqualFold(id.String(), name) == true {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+// LookupTransformID returns the identifier of the transform with the
+// provided name (case insensitive) and false if the name is unknown
+func LookupTransformID(name string) (TransformID, bool) {
+	for _, id := range _TRANSFORM_IDS {
+		if strings.EqualFold(id.String(), name) == true {
+			return id, true
+		}
+	}
+
+	return 0, false
+}
+
+// SplitTransformField returns the transform identifiers stored in the 48 bit
+// transform field of the stream header in order of application (null
+// transforms excluded)
+func SplitTransformField(field uint64) []TransformID {
+	res := make([]TransformID, 0, MAX_TRANSFORMS)
+
+	for i := MAX_TRANSFORMS - 1; i >= 0; i-- {
+		id := TransformID((field >> uint(TRANSFORM_ID_BITS*i)) & (1<<TRANSFORM_ID_BITS - 1))
+
+		if id != TRANSFORM_NONE {
+			res = append(res, id)
+		}
+	}
+
+	return res
+}
+
+// StreamHeader the decoded fields of a stream header
+type StreamHeader struct {
+	Magic          uint32
+	Version        uint8
+	Checksum       bool
+	Entropy        EntropyID
+	Transforms     []TransformID // in order of application
+	BlockSize      uint
+	NbBlocks       uint8 // 0 means unknown, 63 means 63 or more
+	CompactHeaders bool
+	EntropyOptions bool  // entropy codec options stored before each block
+	EntropyLanes   bool  // blocks of the binary entropy codecs coded as lanes
+	ChecksumType   uint8 // see CHECKSUM_TYPE_XXHASH32 (extended header)
+	Digest         bool  // digest of the original data after the end block (extended header)
+	ParityShards   uint8 // parity shards of each block, 0 if none (extended header)
+	Dictionaries   bool  // preset dictionaries after the extended header
+	SyncPoints     bool  // sync markers between the blocks (extended header)
+	PartialBlocks  bool  // blocks continued by the next block (extended header)
+	Sections       bool  // header sections after the dictionaries (version 10, see ParseHeaderSections)
+	Small          bool  // small stream: single block, no end block (see SMALL_STREAM_MAGIC)
+}
+
+// ParseStreamHeader decodes the first STREAM_HEADER_SIZE bytes of a
+// compressed stream (and the extended header of a version 9 or 10 stream, in
+// the next STREAM_HEADER_EXT_SIZE bytes) or the header of a small stream
+// (Magic is then SMALL_STREAM_MAGIC). The header fields are returned even if
+// the magic number, version or identifiers are invalid (along with an error).
+func ParseStreamHeader(buf []byte) (*StreamHeader, error) {
+	if len(buf) >= SMALL_HEADER_MAGIC_BITS/8 && binary.BigEndian.Uint16(buf) == SMALL_STREAM_MAGIC {
+		return parseSmallStreamHeader(buf)
+	}
+
+	if len(buf) < STREAM_HEADER_SIZE {
+		errMsg := fmt.Sprintf("Stream header too small: %d bytes, expected %d", len(buf), STREAM_HEADER_SIZE)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	hi := binary.BigEndian.Uint64(buf[0:8])
+	lo := binary.BigEndian.Uint64(buf[8:16])
+	res := &StreamHeader{}
+	res.Magic = uint32(hi >> 32)
+	res.Version = uint8(hi>>27) & 0x1F
+	res.Checksum = (hi>>26)&1 == 1
+	res.Entropy = EntropyID(hi>>21) & 0x1F
+	res.Transforms = SplitTransformField(((hi & 0x1FFFFF) << 27) | (lo >> 37))
+	res.BlockSize = uint((lo>>9)&0x0FFFFFFF) << 4
+	res.NbBlocks = uint8(lo>>3) & 0x3F
+	res.CompactHeaders = (lo>>2)&1 == 1
+	res.EntropyOptions = (lo>>1)&1 == 1
+	res.EntropyLanes = lo&1 == 1
+
+	if res.Magic != STREAM_MAGIC {
+		return res, NewIOError("Invalid stream type", kanzi.ERR_INVALID_FILE)
+	}
+
+	if res.Version < STREAM_MIN_VERSION || res.Version > STREAM_FORMAT_VERSION {
+		errMsg := fmt.Sprintf("Unsupported version of the stream: %d", res.Version)
+		return res, NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+	}
+
+	if res.Version == STREAM_MIN_VERSION && (res.CompactHeaders == true || res.EntropyOptions == true || res.EntropyLanes == true) {
+		return res, NewIOError("Invalid stream header: reserved flag set in a version 8 stream", kanzi.ERR_INVALID_FILE)
+	}
+
+	if res.Version > STREAM_MIN_VERSION {
+		if len(buf) < STREAM_HEADER_SIZE+STREAM_HEADER_EXT_SIZE {
+			errMsg := fmt.Sprintf("Stream header too small: %d bytes, expected %d", len(buf),
+				STREAM_HEADER_SIZE+STREAM_HEADER_EXT_SIZE)
+			return res, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		ext := buf[STREAM_HEADER_SIZE]
+		res.ChecksumType = ext >> 6
+		res.Digest = (ext>>5)&1 == 1
+		res.ParityShards = uint8(parityShardsOf((ext >> 3) & 3))
+		res.Dictionaries = (ext>>2)&1 == 1
+		res.SyncPoints = (ext>>1)&1 == 1
+		res.PartialBlocks = ext&1 == 1
+		res.Sections = res.Version >= STREAM_SECTIONS_VERSION
+
+		if int(res.ChecksumType) >= len(_CHECKSUM_NAMES) || (res.PartialBlocks == true && res.SyncPoints == false) {
+			errMsg := fmt.Sprintf("Invalid extended stream header: %#x", ext)
+			return res, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+	}
+
+	return res, res.checkIDs()
+}
+
+// Check the identifiers of the entropy codec and of the transforms
+func (this *StreamHeader) checkIDs() error {
+	if this.Entropy.IsValid() == false {
+		errMsg := fmt.Sprintf("Invalid entropy codec id: %d", this.Entropy)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_CODEC)
+	}
+
+	for _, t := range this.Transforms {
+		if t.IsValid() == false {
+			errMsg := fmt.Sprintf("Invalid transform id: %d", t)
+			return NewIOError(errMsg, kanzi.ERR_INVALID_CODEC)
+		}
+	}
+
+	return nil
+}
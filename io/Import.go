@@ -0,0 +1,277 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Formats of the compressed files that can be imported
+const (
+	IMPORT_GZIP  = "GZIP"
+	IMPORT_BZIP2 = "BZIP2"
+	IMPORT_XZ    = "XZ"
+)
+
+var (
+	_IMPORT_GZIP_MAGIC  = []byte{0x1F, 0x8B}
+	_IMPORT_BZIP2_MAGIC = []byte("BZh")
+	_IMPORT_XZ_MAGIC    = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+
+	// File extensions removed from the input name to build the output name
+	_IMPORT_EXTENSIONS = map[string]string{
+		".gz":   "",
+		".tgz":  ".tar",
+		".bz2":  "",
+		".tbz2": ".tar",
+		".tbz":  ".tar",
+		".xz":   "",
+		".txz":  ".tar",
+	}
+)
+
+// ImportInfo the result of the import of a compressed file
+type ImportInfo struct {
+	Format  string    // format of the imported file (EG. GZIP)
+	Name    string    // original file name (from the gzip header, may be empty)
+	ModTime time.Time // original modification time (zero if unknown)
+	Read    uint64    // number of decompressed bytes
+	Written uint64    // number of bytes of the kanzi stream
+}
+
+// ImportReader decompresses a gzip or bzip2 stream with the standard
+// library. The format is detected with the magic number of the stream.
+// Concatenated gzip members are decompressed as one stream (like gunzip).
+// The xz format is detected but cannot be decompressed (there is no xz
+// decoder in the standard library).
+type ImportReader struct {
+	r       io.Reader
+	format  string
+	name    string
+	modTime time.Time
+}
+
+// NewImportReader creates a new instance of ImportReader. Returns an error
+// if the format of the stream is not supported.
+func NewImportReader(is io.Reader) (*ImportReader, error) {
+	if is == nil {
+		return nil, NewIOError("Invalid null reader parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	br := bufio.NewReader(is)
+	magic, _ := br.Peek(len(_IMPORT_XZ_MAGIC))
+	this := &ImportReader{}
+
+	if bytes.HasPrefix(magic, _IMPORT_GZIP_MAGIC) {
+		zr, err := gzip.NewReader(br)
+
+		if err != nil {
+			errMsg := fmt.Sprintf("Invalid gzip stream: %v", err)
+			return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		this.r = zr
+		this.format = IMPORT_GZIP
+		this.name = zr.Name
+		this.modTime = zr.ModTime
+	} else if bytes.HasPrefix(magic, _IMPORT_BZIP2_MAGIC) {
+		this.r = bzip2.NewReader(br)
+		this.format = IMPORT_BZIP2
+	} else if bytes.HasPrefix(magic, _IMPORT_XZ_MAGIC) {
+		return nil, NewIOError("Cannot import xz stream: no xz decoder available", kanzi.ERR_INVALID_CODEC)
+	} else {
+		return nil, NewIOError("Cannot import stream: unknown compression format", kanzi.ERR_INVALID_FILE)
+	}
+
+	return this, nil
+}
+
+// Read reads decompressed bytes
+func (this *ImportReader) Read(b []byte) (int, error) {
+	n, err := this.r.Read(b)
+
+	if err == io.EOF && n > 0 {
+		// Report EOF on the next call (no data and EOF)
+		return n, nil
+	}
+
+	if err != nil && err != io.EOF {
+		errMsg := fmt.Sprintf("Failed to decompress %s stream: %v", strings.ToLower(this.format), err)
+		return n, NewIOError(errMsg, kanzi.ERR_READ_FILE)
+	}
+
+	return n, err
+}
+
+// Format returns the format of the imported stream
+func (this *ImportReader) Format() string {
+	return this.format
+}
+
+// Name returns the original file name stored in the stream (gzip only,
+// empty if absent)
+func (this *ImportReader) Name() string {
+	return this.name
+}
+
+// ModTime returns the original modification time stored in the stream
+// (gzip only, zero if absent)
+func (this *ImportReader) ModTime() time.Time {
+	return this.modTime
+}
+
+// ImportOutputName returns the name of the kanzi file for an imported file:
+// the original name stored in the stream (if any, in the folder of the input
+// file) or the input name without the compression extension, plus '.knz'.
+func ImportOutputName(inputName string, ir *ImportReader) string {
+	if ir != nil && len(ir.Name()) != 0 {
+		// Never trust a path stored in the stream
+		return filepath.Join(filepath.Dir(inputName), filepath.Base(ir.Name())) + ".knz"
+	}
+
+	ext := filepath.Ext(inputName)
+
+	if repl, exists := _IMPORT_EXTENSIONS[strings.ToLower(ext)]; exists == true {
+		return inputName[0:len(inputName)-len(ext)] + repl + ".knz"
+	}
+
+	return inputName + ".knz"
+}
+
+// Import decompresses a gzip or bzip2 stream and compresses the data to os
+// with the parameters of the configuration (frozen if needed). The output
+// writer is not closed.
+func Import(os io.WriteCloser, is io.Reader, cfg *Config) (ImportInfo, error) {
+	ir, err := NewImportReader(is)
+
+	if err != nil {
+		return ImportInfo{}, err
+	}
+
+	return importStream(os, ir, cfg)
+}
+
+func importStream(os io.WriteCloser, ir *ImportReader, cfg *Config) (ImportInfo, error) {
+	info := ImportInfo{Format: ir.Format(), Name: ir.Name(), ModTime: ir.ModTime()}
+
+	if cfg == nil {
+		return info, NewIOError("Invalid null configuration parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if cfg.Frozen() == false {
+		cfg = cfg.Clone()
+
+		if err := cfg.Freeze(); err != nil {
+			return info, err
+		}
+	}
+
+	cos, err := NewCompressedOutputStreamWithConfig(os, cfg)
+
+	if err != nil {
+		return info, err
+	}
+
+	n, err := io.Copy(cos, ir)
+	info.Read = uint64(n)
+
+	if err != nil {
+		cos.Close()
+		return info, err
+	}
+
+	if err = cos.Close(); err != nil {
+		return info, err
+	}
+
+	info.Written = cos.GetWritten()
+	return info, nil
+}
+
+// ImportFile imports the compressed file inputName into the kanzi file
+// outputName (see ImportOutputName if empty). The bitstream has no metadata
+// fields: the original modification time (from the gzip header or else from
+// the input file) is applied to the output file and the original name is
+// used to name the output file. Fails if the output file exists.
+func ImportFile(inputName, outputName string, cfg *Config) (ImportInfo, error) {
+	input, err := os.Open(inputName)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot open input file '%v': %v", inputName, err)
+		return ImportInfo{}, NewIOError(errMsg, kanzi.ERR_OPEN_FILE)
+	}
+
+	defer input.Close()
+	fi, err := input.Stat()
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot access input file '%v': %v", inputName, err)
+		return ImportInfo{}, NewIOError(errMsg, kanzi.ERR_OPEN_FILE)
+	}
+
+	ir, err := NewImportReader(input)
+
+	if err != nil {
+		return ImportInfo{}, err
+	}
+
+	if len(outputName) == 0 {
+		outputName = ImportOutputName(inputName, ir)
+	}
+
+	output, err := os.OpenFile(outputName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot create output file '%v': %v", outputName, err)
+		return ImportInfo{}, NewIOError(errMsg, kanzi.ERR_CREATE_FILE)
+	}
+
+	info, err := importStream(output, ir, cfg)
+
+	if err2 := output.Close(); err == nil && err2 != nil {
+		errMsg := fmt.Sprintf("Cannot close output file '%v': %v", outputName, err2)
+		err = NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	if err != nil {
+		os.Remove(outputName)
+		return info, err
+	}
+
+	modTime := info.ModTime
+
+	if modTime.IsZero() == true {
+		modTime = fi.ModTime()
+	}
+
+	if err = os.Chtimes(outputName, modTime, modTime); err != nil {
+		errMsg := fmt.Sprintf("Cannot set the modification time of '%v': %v", outputName, err)
+		return info, NewIOError(errMsg, kanzi.ERR_WRITE_FILE)
+	}
+
+	return info, nil
+}
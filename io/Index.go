@@ -0,0 +1,1061 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/bitstream"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/util/hash"
+)
+
+// Number of decoded pages of a packed index kept by a CompressedReader
+const _INDEX_PAGE_CACHE = 16
+
+// IndexEntry an entry of the block index of a compressed stream
+type IndexEntry struct {
+	BitOffset uint64 // offset of the block header in the compressed stream (in bits)
+	Offset    int64  // offset of the block in the original data
+	Length    int    // size of the block in the original data
+	Checksum  uint32 // checksum of the block (0 if the stream has no checksum)
+}
+
+// The index of the blocks written by a CompressedOutputStream (context key
+// 'index'). The entries are added during entropy coding, in block order.
+type blockIndex struct {
+	entries []IndexEntry
+	size    int64
+	base    uint64 // bit offset of the output bitstream (appended stream)
+	packed  bool   // pages of entropy coded entries (context key 'packedIndex')
+}
+
+func (this *blockIndex) add(bitOffset uint64, length uint, checksum uint32) {
+	this.entries = append(this.entries, IndexEntry{BitOffset: this.base + bitOffset,
+		Offset: this.size, Length: int(length), Checksum: checksum})
+	this.size += int64(length)
+}
+
+// Serialize the entries and the trailer (see Format.go)
+func (this *blockIndex) bytes() []byte {
+	buf := make([]byte, len(this.entries)*INDEX_ENTRY_SIZE+INDEX_TRAILER_SIZE)
+	idx := 0
+
+	for _, e := range this.entries {
+		binary.BigEndian.PutUint64(buf[idx:], e.BitOffset)
+		binary.BigEndian.PutUint64(buf[idx+8:], uint64(e.Offset))
+		binary.BigEndian.PutUint32(buf[idx+16:], e.Checksum)
+		idx += INDEX_ENTRY_SIZE
+	}
+
+	binary.BigEndian.PutUint32(buf[idx:], uint32(len(this.entries)))
+	binary.BigEndian.PutUint64(buf[idx+4:], uint64(this.size))
+	hasher, _ := hash.NewXXHash32(INDEX_MAGIC)
+	binary.BigEndian.PutUint32(buf[idx+12:], hasher.Hash(buf[0:idx+12]))
+	binary.BigEndian.PutUint32(buf[idx+16:], INDEX_MAGIC)
+	return buf
+}
+
+// Serialize the pages, the page directory and the trailer of a packed index
+// (see Format.go)
+func (this *blockIndex) packedBytes() ([]byte, error) {
+	nbPages := (len(this.entries) + INDEX_PAGE_ENTRIES - 1) / INDEX_PAGE_ENTRIES
+	buf := make([]byte, INDEX_PACKED_HEADER_SIZE, 4096)
+	dir := make([]byte, nbPages*INDEX_PAGE_SIZE+INDEX_TRAILER_SIZE)
+	binary.BigEndian.PutUint32(buf, INDEX_PACKED_MAGIC)
+
+	for p := 0; p < nbPages; p++ {
+		end := (p + 1) * INDEX_PAGE_ENTRIES
+
+		if end > len(this.entries) {
+			end = len(this.entries)
+		}
+
+		entries := this.entries[p*INDEX_PAGE_ENTRIES : end]
+		page, err := packIndexPage(entries)
+
+		if err != nil {
+			return nil, err
+		}
+
+		d := dir[p*INDEX_PAGE_SIZE:]
+		binary.BigEndian.PutUint64(d, entries[0].BitOffset)
+		binary.BigEndian.PutUint64(d[8:], uint64(entries[0].Offset))
+		binary.BigEndian.PutUint32(d[16:], uint32(len(page)))
+		hasher, _ := hash.NewXXHash32(INDEX_PACKED_MAGIC)
+		binary.BigEndian.PutUint32(d[20:], hasher.Hash(page))
+		buf = append(buf, page...)
+	}
+
+	idx := nbPages * INDEX_PAGE_SIZE
+	binary.BigEndian.PutUint32(dir[idx:], uint32(len(this.entries)))
+	binary.BigEndian.PutUint64(dir[idx+4:], uint64(this.size))
+	hasher, _ := hash.NewXXHash32(INDEX_PACKED_MAGIC)
+	binary.BigEndian.PutUint32(dir[idx+12:], hasher.Hash(dir[0:idx+12]))
+	binary.BigEndian.PutUint32(dir[idx+16:], INDEX_PACKED_MAGIC)
+	buf = append(buf, dir...)
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(buf)))
+	return buf, nil
+}
+
+// Encode the entries of a page: the deltas of the offsets (varints) then the
+// checksums, Huffman coded after the size of the deltas and checksums
+func packIndexPage(entries []IndexEntry) ([]byte, error) {
+	raw := make([]byte, 0, len(entries)*(2*binary.MaxVarintLen64+4))
+
+	for i := 1; i < len(entries); i++ {
+		raw = appendUvarint(raw, entries[i].BitOffset-entries[i-1].BitOffset)
+		raw = appendUvarint(raw, uint64(entries[i].Offset-entries[i-1].Offset))
+	}
+
+	for _, e := range entries {
+		raw = append(raw, byte(e.Checksum>>24), byte(e.Checksum>>16), byte(e.Checksum>>8), byte(e.Checksum))
+	}
+
+	w := &sliceWriter{}
+	obs, err := bitstream.NewDefaultOutputBitStream(w, 65536)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_BITSTREAM)
+	}
+
+	entropy.WriteVarInt(obs, uint32(len(raw)))
+	ee, err := entropy.NewHuffmanEncoder(obs)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_CODEC)
+	}
+
+	if _, err = ee.Write(raw); err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+	}
+
+	ee.Dispose()
+
+	if _, err = obs.Close(); err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_WRITE_FILE)
+	}
+
+	return w.buf, nil
+}
+
+func appendUvarint(buf []byte, val uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], val)
+	return append(buf, tmp[0:n]...)
+}
+
+// Write the index after the end block, at the next byte boundary
+func (this *blockIndex) write(obs kanzi.OutputBitStream) error {
+	if pad := obs.Written() & 7; pad != 0 {
+		obs.WriteBits(0, uint(8-pad))
+	}
+
+	if this.packed == false {
+		buf := this.bytes()
+		obs.WriteArray(buf, uint(8*len(buf)))
+		return nil
+	}
+
+	buf, err := this.packedBytes()
+
+	if err != nil {
+		return err
+	}
+
+	obs.WriteArray(buf, uint(8*len(buf)))
+	return nil
+}
+
+// ReadIndex reads the block index at the end of a compressed stream of
+// 'size' bytes. Returns the entries (in block order) and the size of the
+// original data. Returns an error if the stream has no (valid) index. All
+// the pages of a packed index are read.
+func ReadIndex(src io.ReaderAt, size int64) ([]IndexEntry, int64, error) {
+	index, err := openIndex(src, size)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries, err := index.all()
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return entries, index.dataSize, nil
+}
+
+// The block index of a stream read by a CompressedReader. Only the page
+// directory of a packed index is read when the index is opened: a page is
+// read and decoded when one of its entries is accessed.
+type streamIndex struct {
+	src      io.ReaderAt
+	start    int64        // position of the index in the stream
+	count    int          // number of entries of a packed index
+	dataSize int64        // size of the original data
+	entries  []IndexEntry // entries of a flat index (nil if packed)
+	pages    []indexPage  // page directory of a packed index (nil if flat)
+	mutex    sync.Mutex
+	cache    map[int][]IndexEntry // decoded pages of a packed index
+}
+
+// An entry of the page directory of a packed index
+type indexPage struct {
+	bitOffset uint64 // bit offset of the first block of the page
+	offset    int64  // offset of the first block of the page in the original data
+	pos       int64  // position of the page in the compressed stream
+	size      int    // size of the page (in bytes)
+	checksum  uint32 // XXHash32 of the page
+}
+
+// Read the trailer of the block index at the end of a compressed stream of
+// 'size' bytes, then the entries of a flat index or the page directory of a
+// packed index
+func openIndex(src io.ReaderAt, size int64) (*streamIndex, error) {
+	if size < STREAM_HEADER_SIZE+INDEX_TRAILER_SIZE {
+		return nil, NewIOError("Invalid stream: no block index", kanzi.ERR_INVALID_FILE)
+	}
+
+	trailer := make([]byte, INDEX_TRAILER_SIZE)
+
+	if _, err := src.ReadAt(trailer, size-INDEX_TRAILER_SIZE); err != nil {
+		return nil, NewIOError("Cannot read block index: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	count := int64(binary.BigEndian.Uint32(trailer))
+	dataSize := int64(binary.BigEndian.Uint64(trailer[4:]))
+
+	switch binary.BigEndian.Uint32(trailer[16:]) {
+	case INDEX_MAGIC:
+		return openFlatIndex(src, size, count, dataSize)
+
+	case INDEX_PACKED_MAGIC:
+		return openPackedIndex(src, size, count, dataSize)
+
+	default:
+		return nil, NewIOError("Invalid stream: no block index", kanzi.ERR_INVALID_FILE)
+	}
+}
+
+func openFlatIndex(src io.ReaderAt, size, count, dataSize int64) (*streamIndex, error) {
+	start := size - INDEX_TRAILER_SIZE - count*INDEX_ENTRY_SIZE
+
+	if start < STREAM_HEADER_SIZE || dataSize < 0 {
+		return nil, NewIOError("Invalid block index: incorrect number of entries", kanzi.ERR_INVALID_FILE)
+	}
+
+	buf := make([]byte, size-start)
+
+	if _, err := src.ReadAt(buf, start); err != nil {
+		return nil, NewIOError("Cannot read block index: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	hashed := len(buf) - INDEX_TRAILER_SIZE + 12
+	hasher, _ := hash.NewXXHash32(INDEX_MAGIC)
+
+	if hasher.Hash(buf[0:hashed]) != binary.BigEndian.Uint32(buf[hashed:]) {
+		return nil, NewIOError("Corrupted block index: invalid checksum", kanzi.ERR_CRC_CHECK)
+	}
+
+	entries := make([]IndexEntry, count)
+
+	for i := range entries {
+		e := buf[i*INDEX_ENTRY_SIZE:]
+		entries[i].BitOffset = binary.BigEndian.Uint64(e)
+		entries[i].Offset = int64(binary.BigEndian.Uint64(e[8:]))
+		entries[i].Checksum = binary.BigEndian.Uint32(e[16:])
+	}
+
+	if err := setIndexLengths(entries, 0, dataSize, uint64(start)<<3); err != nil {
+		return nil, err
+	}
+
+	return &streamIndex{src: src, start: start, dataSize: dataSize, entries: entries}, nil
+}
+
+func openPackedIndex(src io.ReaderAt, size, count, dataSize int64) (*streamIndex, error) {
+	nbPages := (count + INDEX_PAGE_ENTRIES - 1) / INDEX_PAGE_ENTRIES
+	dirPos := size - INDEX_TRAILER_SIZE - nbPages*INDEX_PAGE_SIZE
+
+	if dirPos < STREAM_HEADER_SIZE+INDEX_PACKED_HEADER_SIZE || dataSize < 0 {
+		return nil, NewIOError("Invalid block index: incorrect number of entries", kanzi.ERR_INVALID_FILE)
+	}
+
+	buf := make([]byte, size-dirPos)
+
+	if _, err := src.ReadAt(buf, dirPos); err != nil {
+		return nil, NewIOError("Cannot read block index: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	hashed := len(buf) - INDEX_TRAILER_SIZE + 12
+	hasher, _ := hash.NewXXHash32(INDEX_PACKED_MAGIC)
+
+	if hasher.Hash(buf[0:hashed]) != binary.BigEndian.Uint32(buf[hashed:]) {
+		return nil, NewIOError("Corrupted block index: invalid checksum", kanzi.ERR_CRC_CHECK)
+	}
+
+	// The pages precede the directory, in order
+	pages := make([]indexPage, nbPages)
+	pos := dirPos
+
+	for p := len(pages) - 1; p >= 0; p-- {
+		d := buf[p*INDEX_PAGE_SIZE:]
+		pages[p].bitOffset = binary.BigEndian.Uint64(d)
+		pages[p].offset = int64(binary.BigEndian.Uint64(d[8:]))
+		pages[p].size = int(binary.BigEndian.Uint32(d[16:]))
+		pages[p].checksum = binary.BigEndian.Uint32(d[20:])
+		pos -= int64(pages[p].size)
+		pages[p].pos = pos
+	}
+
+	start := pos - INDEX_PACKED_HEADER_SIZE
+	header := make([]byte, INDEX_PACKED_HEADER_SIZE)
+
+	if start < STREAM_HEADER_SIZE {
+		return nil, NewIOError("Invalid block index: incorrect size of the pages", kanzi.ERR_INVALID_FILE)
+	}
+
+	if _, err := src.ReadAt(header, start); err != nil {
+		return nil, NewIOError("Cannot read block index: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	if binary.BigEndian.Uint32(header) != INDEX_PACKED_MAGIC || int64(binary.BigEndian.Uint32(header[4:])) != size-start {
+		return nil, NewIOError("Invalid block index: incorrect size of the pages", kanzi.ERR_INVALID_FILE)
+	}
+
+	for p := range pages {
+		end := dataSize
+		bitEnd := uint64(start) << 3
+
+		if p+1 < len(pages) {
+			end = pages[p+1].offset
+			bitEnd = pages[p+1].bitOffset
+		}
+
+		if pages[p].offset < 0 || pages[p].offset >= end || pages[p].bitOffset < STREAM_HEADER_SIZE<<3 ||
+			pages[p].bitOffset >= bitEnd {
+			errMsg := fmt.Sprintf("Invalid block index: incorrect page %d", p)
+			return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+	}
+
+	return &streamIndex{src: src, start: start, count: int(count), dataSize: dataSize, pages: pages,
+		cache: make(map[int][]IndexEntry)}, nil
+}
+
+// Check the offsets of the entries (the first one is entry 'first' of the
+// index) and compute the block lengths. The offset of the data and the bit
+// offset following the last entry are 'end' and 'bitEnd'.
+func setIndexLengths(entries []IndexEntry, first int, end int64, bitEnd uint64) error {
+	for i := range entries {
+		blkEnd := end
+		blkBitEnd := bitEnd
+
+		if i+1 < len(entries) {
+			blkEnd = entries[i+1].Offset
+			blkBitEnd = entries[i+1].BitOffset
+		}
+
+		if entries[i].Offset < 0 || entries[i].Offset >= blkEnd || entries[i].BitOffset < STREAM_HEADER_SIZE<<3 ||
+			entries[i].BitOffset >= blkBitEnd || blkEnd-entries[i].Offset > _MAX_BITSTREAM_BLOCK_SIZE {
+			errMsg := fmt.Sprintf("Invalid block index: incorrect entry %d", first+i)
+			return NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		entries[i].Length = int(blkEnd - entries[i].Offset)
+	}
+
+	return nil
+}
+
+// Return the number of entries
+func (this *streamIndex) len() int {
+	if this.pages == nil {
+		return len(this.entries)
+	}
+
+	return this.count
+}
+
+// Return entry 'blk'
+func (this *streamIndex) entry(blk int) (IndexEntry, error) {
+	if this.pages == nil {
+		return this.entries[blk], nil
+	}
+
+	page, err := this.page(blk / INDEX_PAGE_ENTRIES)
+
+	if err != nil {
+		return IndexEntry{}, err
+	}
+
+	return page[blk%INDEX_PAGE_ENTRIES], nil
+}
+
+// Return the first block containing offset 'off' of the original data (the
+// number of entries if there is none)
+func (this *streamIndex) find(off int64) (int, error) {
+	if this.pages == nil {
+		return sort.Search(len(this.entries), func(i int) bool {
+			return this.entries[i].Offset+int64(this.entries[i].Length) > off
+		}), nil
+	}
+
+	p := sort.Search(len(this.pages), func(i int) bool { return this.pages[i].offset > off }) - 1
+
+	if p < 0 {
+		p = 0
+	}
+
+	page, err := this.page(p)
+
+	if err != nil {
+		return 0, err
+	}
+
+	blk := sort.Search(len(page), func(i int) bool {
+		return page[i].Offset+int64(page[i].Length) > off
+	})
+
+	return p*INDEX_PAGE_ENTRIES + blk, nil
+}
+
+// Return all the entries (the pages of a packed index are read, not cached)
+func (this *streamIndex) all() ([]IndexEntry, error) {
+	if this.pages == nil {
+		return this.entries, nil
+	}
+
+	entries := make([]IndexEntry, 0, this.count)
+
+	for p := range this.pages {
+		page, err := this.readPage(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, page...)
+	}
+
+	return entries, nil
+}
+
+// Return the entries of page 'p' of a packed index. The pages read last are
+// cached.
+func (this *streamIndex) page(p int) ([]IndexEntry, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if page, ok := this.cache[p]; ok == true {
+		return page, nil
+	}
+
+	page, err := this.readPage(p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(this.cache) >= _INDEX_PAGE_CACHE {
+		for k := range this.cache {
+			delete(this.cache, k)
+			break
+		}
+	}
+
+	this.cache[p] = page
+	return page, nil
+}
+
+// Read and decode page 'p' of a packed index
+func (this *streamIndex) readPage(p int) (entries []IndexEntry, err error) {
+	pg := this.pages[p]
+	buf := make([]byte, pg.size)
+
+	if _, err = this.src.ReadAt(buf, pg.pos); err != nil {
+		return nil, NewIOError("Cannot read block index: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	hasher, _ := hash.NewXXHash32(INDEX_PACKED_MAGIC)
+
+	if hasher.Hash(buf) != pg.checksum {
+		errMsg := fmt.Sprintf("Corrupted block index: invalid checksum of page %d", p)
+		return nil, NewIOError(errMsg, kanzi.ERR_CRC_CHECK)
+	}
+
+	first := p * INDEX_PAGE_ENTRIES
+	n := this.count - first
+
+	if n > INDEX_PAGE_ENTRIES {
+		n = INDEX_PAGE_ENTRIES
+	}
+
+	errMsg := fmt.Sprintf("Invalid block index: incorrect page %d", p)
+
+	defer func() {
+		if r := recover(); r != nil {
+			// Truncated page
+			entries = nil
+			err = NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+	}()
+
+	ibs, err := bitstream.NewDefaultInputBitStream(ioutil.NopCloser(bytes.NewReader(buf)), _STREAM_DEFAULT_BUFFER_SIZE)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_BITSTREAM)
+	}
+
+	// Deltas of the offsets (varints) then checksums
+	rawSize := int(entropy.ReadVarInt(ibs))
+
+	if rawSize < 4*n || rawSize > n*(2*binary.MaxVarintLen64+4) {
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	ed, err := entropy.NewHuffmanDecoder(ibs)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_INVALID_CODEC)
+	}
+
+	raw := make([]byte, rawSize)
+	_, err = ed.Read(raw)
+	ed.Dispose()
+
+	if err != nil {
+		return nil, NewIOError(errMsg+": "+err.Error(), kanzi.ERR_INVALID_FILE)
+	}
+
+	entries = make([]IndexEntry, n)
+	entries[0].BitOffset = pg.bitOffset
+	entries[0].Offset = pg.offset
+	idx := 0
+
+	for i := 1; i < n; i++ {
+		bitDelta, k1 := binary.Uvarint(raw[idx:])
+
+		if k1 <= 0 {
+			return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		delta, k2 := binary.Uvarint(raw[idx+k1:])
+
+		if k2 <= 0 {
+			return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		entries[i].BitOffset = entries[i-1].BitOffset + bitDelta
+		entries[i].Offset = entries[i-1].Offset + int64(delta)
+		idx += k1 + k2
+	}
+
+	if rawSize-idx != 4*n {
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	for i := range entries {
+		entries[i].Checksum = binary.BigEndian.Uint32(raw[idx+4*i:])
+	}
+
+	end := this.dataSize
+	bitEnd := uint64(this.start) << 3
+
+	if p+1 < len(this.pages) {
+		end = this.pages[p+1].offset
+		bitEnd = this.pages[p+1].bitOffset
+	}
+
+	if err = setIndexLengths(entries, first, end, bitEnd); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// CompressedReader provides random access to the data of a compressed stream
+// with a block index (written by a CompressedOutputStream created with
+// ctx["index"] = true). Only the blocks overlapping the requested range are
+// read and decompressed. CompressedReader implements io.Reader, io.Seeker,
+// io.ReaderAt and io.Closer. ReadAt can be called concurrently.
+// The blocks following the last block read (up to the lookahead) are decoded
+// concurrently: sequential reads use several cores.
+// See CompressedWriter to write the data at arbitrary offsets.
+// Only the last stream of concatenated streams is indexed: use a
+// CompressedInputStream to decode all of them.
+// In salvage mode, the damaged blocks are skipped (see Lost).
+type CompressedReader struct {
+	src       io.ReaderAt
+	size      int64 // size of the compressed stream
+	dataSize  int64 // size of the original data
+	index     *streamIndex
+	header    *CompressedInputStream
+	pos       int64
+	mutex     sync.Mutex
+	blocks    map[int]*readerBlock // blocks decoded or being decoded (nil once closed)
+	lookahead int
+	slots     chan int      // free decoding slots (coders and buffers)
+	buffers   []blockBuffer // buffer of each slot
+	pending   sync.WaitGroup
+	lost      []LostRange  // salvage mode
+	damaged   map[int]bool // blocks of the index read as zeros (salvage mode)
+	closed    int32
+}
+
+// A block decoded (or being decoded) by a CompressedReader
+type readerBlock struct {
+	done chan bool // closed once the block is decoded
+	data []byte
+	err  error
+}
+
+// NewCompressedReader creates a new instance of CompressedReader reading
+// the compressed stream of 'size' bytes from 'src'. The dictionaries
+// referenced by the stream header (if any) must be registered.
+func NewCompressedReader(src io.ReaderAt, size int64) (*CompressedReader, error) {
+	return NewCompressedReaderWithCtx(src, size, map[string]interface{}{"jobs": uint(1)})
+}
+
+// NewCompressedReaderWithCtx creates a new instance of CompressedReader using
+// a map of parameters: "jobs" (uint) is the number of blocks decoded
+// concurrently and "lookahead" (uint, optional, "jobs"-1 by default) the
+// number of blocks decoded ahead of the last block read. The referenced
+// dictionaries (if any) must be provided or registered. If "salvage" is set
+// to true, the stream is decoded once when the reader is created to find the
+// damaged blocks: the damaged blocks of the index read as zeros and, if the
+// index itself is damaged or missing (EG. truncated stream), the blocks are
+// found by decoding the stream, resuming after the sync marker following a
+// damaged block (if the stream has sync points). See Lost.
+func NewCompressedReaderWithCtx(src io.ReaderAt, size int64, ctx map[string]interface{}) (*CompressedReader, error) {
+	if src == nil {
+		return nil, NewIOError("Invalid null reader parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if ctx == nil {
+		return nil, NewIOError("Invalid null context parameter", kanzi.ERR_CREATE_STREAM)
+	}
+
+	jobs, _ := ctx["jobs"].(uint)
+
+	if jobs == 0 || jobs > _MAX_CONCURRENCY {
+		errMsg := fmt.Sprintf("The number of jobs must be in [1..%v]", _MAX_CONCURRENCY)
+		return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+	}
+
+	lookahead := jobs - 1
+
+	if val, containsKey := ctx["lookahead"]; containsKey {
+		lookahead, _ = val.(uint)
+
+		if lookahead > _MAX_CONCURRENCY {
+			errMsg := fmt.Sprintf("The lookahead must be in [0..%v]", _MAX_CONCURRENCY)
+			return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+		}
+	}
+
+	salvage, _ := ctx["salvage"].(bool)
+	index, err := openIndex(src, size)
+
+	if err == nil && salvage == true && index.pages != nil {
+		// The damaged blocks are found with all the entries in memory
+		if index.entries, err = index.all(); err == nil {
+			index.pages = nil
+		}
+	}
+
+	if err != nil && salvage == false {
+		return nil, err
+	}
+
+	// Without index, the blocks following the header are decoded to be found
+	indexed := err == nil
+	var header io.Reader = io.NewSectionReader(src, 0, size)
+
+	if indexed == true {
+		// The index follows the header: the extended header (if any) and the
+		// dictionaries (if any) precede the first block
+		buf := make([]byte, STREAM_HEADER_SIZE+STREAM_HEADER_EXT_SIZE)
+
+		if index.len() > 0 {
+			first, err := index.entry(0)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if first.BitOffset>>3 >= uint64(len(buf)) {
+				buf = make([]byte, first.BitOffset>>3+1)
+			}
+		}
+
+		if _, err = src.ReadAt(buf, 0); err != nil {
+			return nil, NewIOError("Cannot read stream header: "+err.Error(), kanzi.ERR_READ_FILE)
+		}
+
+		header = bytes.NewReader(buf)
+	}
+
+	// Each block is decoded by a single job
+	isCtx := make(map[string]interface{}, len(ctx))
+
+	for k, v := range ctx {
+		isCtx[k] = v
+	}
+
+	isCtx["jobs"] = uint(1)
+	is, err := newCompressedInputStream(ioutil.NopCloser(header), isCtx, jobs)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = readRepairHeader(is); err != nil {
+		return nil, err
+	}
+
+	if is.headers.compact == true || is.partialBlocks == true {
+		return nil, NewIOError("Invalid stream: the blocks cannot be decoded independently", kanzi.ERR_INVALID_FILE)
+	}
+
+	this := &CompressedReader{src: src, size: size, index: index, header: is}
+	this.blocks = make(map[int]*readerBlock)
+	this.lookahead = int(lookahead)
+	this.buffers = make([]blockBuffer, jobs)
+	this.slots = make(chan int, jobs)
+
+	for i := 0; i < int(jobs); i++ {
+		this.slots <- i
+	}
+
+	if indexed == false {
+		this.index = &streamIndex{src: src, start: size}
+
+		if err = this.rebuildIndex(); err != nil {
+			return nil, err
+		}
+	} else if salvage == true {
+		this.checkBlocks()
+	}
+
+	this.dataSize = this.index.dataSize
+
+	return this, nil
+}
+
+// Index returns the entries of the block index (in block order). The slice
+// must not be modified. All the pages of a packed index are read (nil if a
+// page is invalid).
+func (this *CompressedReader) Index() []IndexEntry {
+	entries, _ := this.index.all()
+	return entries
+}
+
+// Size returns the size of the original data
+func (this *CompressedReader) Size() int64 {
+	return this.dataSize
+}
+
+// Read reads up to len(p) bytes at the current position and advances it
+func (this *CompressedReader) Read(p []byte) (int, error) {
+	this.mutex.Lock()
+	pos := this.pos
+	this.mutex.Unlock()
+	n, err := this.ReadAt(p, pos)
+
+	this.mutex.Lock()
+	this.pos = pos + int64(n)
+	this.mutex.Unlock()
+
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Seek sets the position of the next Read (see io.Seeker)
+func (this *CompressedReader) Seek(offset int64, whence int) (int64, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += this.pos
+	case io.SeekEnd:
+		offset += this.dataSize
+	default:
+		return this.pos, NewIOError("Invalid seek whence parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if offset < 0 {
+		return this.pos, NewIOError("Invalid negative seek position", kanzi.ERR_INVALID_PARAM)
+	}
+
+	this.pos = offset
+	return offset, nil
+}
+
+// ReadAt reads len(p) bytes of original data starting at offset 'off'
+// (see io.ReaderAt). Only the blocks overlapping the range (and the blocks
+// of the lookahead) are decoded.
+func (this *CompressedReader) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return 0, NewIOError("Stream closed", kanzi.ERR_READ_FILE)
+	}
+
+	if off < 0 {
+		return 0, NewIOError("Invalid negative offset", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if off >= this.dataSize {
+		return 0, io.EOF
+	}
+
+	// First block containing 'off'
+	blk, err := this.index.find(off)
+
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for n < len(p) && blk < this.index.len() {
+		e, err := this.index.entry(blk)
+
+		if err != nil {
+			return n, err
+		}
+
+		data, err := this.block(blk)
+
+		if err != nil {
+			return n, err
+		}
+
+		n += copy(p[n:], data[off+int64(n)-e.Offset:])
+		blk++
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Return the decoded data of block 'blk'. The blocks of the lookahead are
+// decoded concurrently. The blocks outside of the lookahead are evicted.
+func (this *CompressedReader) block(blk int) ([]byte, error) {
+	this.mutex.Lock()
+	b := this.schedule(blk)
+
+	for i := blk + 1; i <= blk+this.lookahead && i < this.index.len(); i++ {
+		this.schedule(i)
+	}
+
+	for i := range this.blocks {
+		if i < blk || i > blk+this.lookahead {
+			delete(this.blocks, i)
+		}
+	}
+
+	this.mutex.Unlock()
+	<-b.done
+
+	if b.err != nil {
+		// Not cached: the block may be read again
+		this.mutex.Lock()
+
+		if this.blocks != nil && this.blocks[blk] == b {
+			delete(this.blocks, blk)
+		}
+
+		this.mutex.Unlock()
+	}
+
+	return b.data, b.err
+}
+
+// Start decoding block 'blk' (unless it is decoded or being decoded).
+// Requires the mutex.
+func (this *CompressedReader) schedule(blk int) *readerBlock {
+	if b, ok := this.blocks[blk]; ok == true {
+		return b
+	}
+
+	b := &readerBlock{done: make(chan bool)}
+
+	if this.blocks == nil {
+		b.err = NewIOError("Stream closed", kanzi.ERR_READ_FILE)
+		close(b.done)
+		return b
+	}
+
+	this.blocks[blk] = b
+	this.start(blk, b)
+	return b
+}
+
+// Decode block 'blk' into 'b' in the background. The damaged blocks read as
+// zeros. Requires the mutex.
+func (this *CompressedReader) start(blk int, b *readerBlock) {
+	// The index of a reader in salvage mode is in memory
+	if this.damaged[blk] == true {
+		b.data = make([]byte, this.index.entries[blk].Length)
+		close(b.done)
+		return
+	}
+
+	this.pending.Add(1)
+
+	go func() {
+		defer this.pending.Done()
+		b.data, b.err = this.readBlock(blk)
+		close(b.done)
+	}()
+}
+
+// Read and decode block 'blk'
+func (this *CompressedReader) readBlock(blk int) ([]byte, error) {
+	// Wait for a decoding slot: no more than 'jobs' blocks in memory
+	slot := <-this.slots
+	defer func() { this.slots <- slot }()
+
+	e, err := this.index.entry(blk)
+
+	if err != nil {
+		return nil, err
+	}
+
+	start, end, err := this.blockExtent(blk)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, end-start)
+
+	if _, err := this.src.ReadAt(buf, start); err != nil && err != io.EOF {
+		return nil, NewIOError("Cannot read block: "+err.Error(), kanzi.ERR_READ_FILE)
+	}
+
+	ibs, err := bitstream.NewDefaultInputBitStream(ioutil.NopCloser(bytes.NewReader(buf)), _STREAM_DEFAULT_BUFFER_SIZE)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_BITSTREAM)
+	}
+
+	if shift := uint(e.BitOffset & 7); shift != 0 {
+		ibs.ReadBits(shift)
+	}
+
+	res, err := this.decodeBlock(ibs, blk, slot)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if res.decoded != e.Length {
+		errMsg := fmt.Sprintf("Invalid block %d: decoded %d bytes, expected %d", blk+1, res.decoded, e.Length)
+		return nil, NewIOError(errMsg, kanzi.ERR_PROCESS_BLOCK)
+	}
+
+	if this.header.hasher != nil && res.checksum != e.Checksum {
+		errMsg := fmt.Sprintf("Invalid block %d: checksum differs from the index", blk+1)
+		return nil, NewIOError(errMsg, kanzi.ERR_CRC_CHECK)
+	}
+
+	return res.data[0:res.decoded], nil
+}
+
+// Decode one block with the parameters of the stream header
+func (this *CompressedReader) decodeBlock(ibs kanzi.InputBitStream, blk int, slot int) (message, error) {
+	is := this.header
+	blkSize := int(is.blockSize)
+
+	// Add a padding area to manage any block with header or temporarily expanded
+	if _EXTRA_BUFFER_SIZE >= (blkSize >> 4) {
+		blkSize += _EXTRA_BUFFER_SIZE
+	} else {
+		blkSize += (blkSize >> 4)
+	}
+
+	if len(this.buffers[slot].Buf) < blkSize {
+		this.buffers[slot].Buf = make([]byte, blkSize)
+	}
+
+	ctx := make(map[string]interface{}, len(is.ctx))
+
+	for k, v := range is.ctx {
+		ctx[k] = v
+	}
+
+	result := make(chan message, 2)
+	task := decodingTask{
+		iBuffer:            &blockBuffer{Buf: make([]byte, blkSize)}, // decoded data, cached
+		oBuffer:            &this.buffers[slot],
+		hasher:             is.hasher,
+		parity:             is.parity,
+		syncPoints:         is.syncPoints,
+		blockLength:        uint(blkSize),
+		blockTransformType: is.transformType,
+		blockEntropyType:   is.entropyType,
+		coders:             is.coders[slot],
+		tpaqModel:          is.tpaqModel,
+		currentBlockID:     blk + 1,
+		result:             result,
+		listeners:          is.listeners,
+		ibs:                ibs,
+		headers:            &blockHeaderCodec{},
+		ctx:                ctx}
+
+	task.decode()
+	res := <-result
+
+	if res.err != nil {
+		return res, res.err
+	}
+
+	return res, nil
+}
+
+// Close releases the resources. The underlying io.ReaderAt is not closed.
+func (this *CompressedReader) Close() error {
+	if atomic.SwapInt32(&this.closed, 1) == 1 {
+		return nil
+	}
+
+	// Wait for the blocks being decoded
+	this.mutex.Lock()
+	this.blocks = nil
+	this.mutex.Unlock()
+	this.pending.Wait()
+	this.buffers = nil
+	return this.header.Close()
+}
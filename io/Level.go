@@ -0,0 +1,288 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+const (
+	MEMORY_CLASS_LOW    = 0 // at most 64 MB per job
+	MEMORY_CLASS_MEDIUM = 1 // at most 512 MB per job
+	MEMORY_CLASS_HIGH   = 2 // no limit
+
+	_DEFAULT_LEVEL_BLOCK_SIZE = 1024 * 1024
+)
+
+var (
+	_MEMORY_CLASS_LIMITS = [...]uint64{64 << 20, 512 << 20, 1 << 63}
+	_LEVELS              = make(map[string]*Level)
+	_LEVELS_MUTEX        sync.RWMutex
+)
+
+// Level a named compression configuration: transform chain, entropy codec,
+// block size (0 means 'use default'), memory class and optional alternate
+// transform chain raced against the transform chain for each block.
+type Level struct {
+	name        string
+	transform   string
+	race        string
+	codec       string
+	blockSize   uint
+	memoryClass int
+	builtIn     bool
+}
+
+// Name returns the name of the level
+func (this *Level) Name() string {
+	return this.name
+}
+
+// Transform returns the transform chain of the level (EG. "TEXT+BWT+RANK+ZRLT")
+func (this *Level) Transform() string {
+	return this.transform
+}
+
+// Race returns the alternate transform chain of the level or an empty string
+// if the blocks are not raced
+func (this *Level) Race() string {
+	return this.race
+}
+
+// Codec returns the entropy codec of the level
+func (this *Level) Codec() string {
+	return this.codec
+}
+
+// BlockSize returns the block size of the level or 0 if not specified
+func (this *Level) BlockSize() uint {
+	return this.blockSize
+}
+
+// MemoryClass returns the memory class of the level
+func (this *Level) MemoryClass() int {
+	return this.memoryClass
+}
+
+// BuiltIn returns true for the predefined levels
+func (this *Level) BuiltIn() bool {
+	return this.builtIn
+}
+
+// String returns a short description of the level (EG. "4=TEXT+BWT+RANK+ZRLT&ANS0")
+func (this *Level) String() string {
+	return this.name + "=" + this.transform + "&" + this.codec
+}
+
+// LevelBuilder builds custom compression levels
+type LevelBuilder struct {
+	level Level
+}
+
+// NewLevelBuilder creates a new instance of LevelBuilder for a level with the
+// provided name. The defaults are: no transform, no entropy codec, default
+// block size and low memory class.
+func NewLevelBuilder(name string) *LevelBuilder {
+	this := &LevelBuilder{}
+	this.level.name = strings.TrimSpace(name)
+	this.level.transform = "NONE"
+	this.level.codec = "NONE"
+	this.level.memoryClass = MEMORY_CLASS_LOW
+	return this
+}
+
+// Transform sets the transform chain (EG. "BWT+RANK+ZRLT")
+func (this *LevelBuilder) Transform(transform string) *LevelBuilder {
+	this.level.transform = transform
+	return this
+}
+
+// Race sets the alternate transform chain raced against the transform chain
+// for each block (EG. "ROLZX"). An empty string disables the race.
+func (this *LevelBuilder) Race(transform string) *LevelBuilder {
+	this.level.race = transform
+	return this
+}
+
+// Entropy sets the entropy codec (EG. "ANS0")
+func (this *LevelBuilder) Entropy(codec string) *LevelBuilder {
+	this.level.codec = codec
+	return this
+}
+
+// BlockSize sets the block size (0 means 'use default')
+func (this *LevelBuilder) BlockSize(blockSize uint) *LevelBuilder {
+	this.level.blockSize = blockSize
+	return this
+}
+
+// MemoryClass sets the maximum memory class allowed for the level
+func (this *LevelBuilder) MemoryClass(memoryClass int) *LevelBuilder {
+	this.level.memoryClass = memoryClass
+	return this
+}
+
+// Build validates the configuration and returns the level.
+// The transform and codec names are normalized.
+func (this *LevelBuilder) Build() (level *Level, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			level = nil
+			err = NewIOError(fmt.Sprintf("Invalid level '%s': %v", this.level.name, r), kanzi.ERR_INVALID_PARAM)
+		}
+	}()
+
+	res := this.level
+
+	if len(res.name) == 0 || strings.ContainsAny(res.name, " &=+") {
+		return nil, NewIOError(fmt.Sprintf("Invalid level name: '%s'", res.name), kanzi.ERR_INVALID_PARAM)
+	}
+
+	if res.memoryClass < MEMORY_CLASS_LOW || res.memoryClass > MEMORY_CLASS_HIGH {
+		errMsg := fmt.Sprintf("Invalid level '%s': unknown memory class %d", res.name, res.memoryClass)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	// Curate names (panic on error)
+	res.transform = function.GetName(function.GetType(res.transform))
+	res.codec = entropy.GetName(entropy.GetType(res.codec))
+	bsz := res.blockSize
+
+	if bsz == 0 {
+		bsz = _DEFAULT_LEVEL_BLOCK_SIZE
+	} else if int(bsz)&-16 != int(bsz) {
+		errMsg := fmt.Sprintf("Invalid level '%s': the block size must be a multiple of 16", res.name)
+		return nil, NewIOError(errMsg, kanzi.ERR_BLOCK_SIZE)
+	}
+
+	ctx := map[string]interface{}{"codec": res.codec, "transform": res.transform,
+		"blockSize": bsz, "jobs": uint(1), "checksum": false}
+
+	if len(res.race) != 0 {
+		res.race = function.GetName(function.GetType(res.race))
+		ctx["raceTransform"] = res.race
+
+		if _, err := parseRaceParams(ctx, function.GetType(res.transform)); err != nil {
+			return nil, err
+		}
+	}
+
+	info, err := DescribePipeline(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.BlockMemory > _MEMORY_CLASS_LIMITS[res.memoryClass] {
+		errMsg := fmt.Sprintf("Invalid level '%s': estimated memory (%d MB) exceeds memory class %d",
+			res.name, info.BlockMemory>>20, res.memoryClass)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	return &res, nil
+}
+
+func init() {
+	builtIns := []string{
+		"NONE&NONE",
+		"TEXT+LZ&HUFFMAN",
+		"TEXT+ROLZ&NONE",
+		"TEXT+ROLZX&NONE",
+		"TEXT+BWT+RANK+ZRLT&ANS0",
+		"TEXT+BWT+SRT+ZRLT&FPAQ",
+		"BWT&CM",
+		"X86+RLT+TEXT&TPAQ",
+		"X86+RLT+TEXT&TPAQX",
+	}
+
+	for i, s := range builtIns {
+		tokens := strings.Split(s, "&")
+		l, err := NewLevelBuilder(strconv.Itoa(i)).Transform(tokens[0]).Entropy(tokens[1]).
+			MemoryClass(MEMORY_CLASS_HIGH).Build()
+
+		if err != nil {
+			panic(err)
+		}
+
+		l.builtIn = true
+		_LEVELS[l.name] = l
+	}
+}
+
+// RegisterLevel makes a level available by name (EG. to the command line).
+// Built-in levels cannot be replaced. Registering a custom level with the
+// same name as a previous one replaces it.
+func RegisterLevel(level *Level) error {
+	if level == nil {
+		return NewIOError("Invalid null level parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	_LEVELS_MUTEX.Lock()
+	defer _LEVELS_MUTEX.Unlock()
+
+	if l, exists := _LEVELS[level.name]; exists && l.builtIn == true {
+		errMsg := fmt.Sprintf("Cannot replace built-in level '%s'", level.name)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	_LEVELS[level.name] = level
+	return nil
+}
+
+// GetLevel returns the level registered with the provided name
+func GetLevel(name string) (*Level, bool) {
+	_LEVELS_MUTEX.RLock()
+	defer _LEVELS_MUTEX.RUnlock()
+	l, exists := _LEVELS[strings.TrimSpace(name)]
+	return l, exists
+}
+
+// GetLevels returns all registered levels: built-in levels first (in
+// increasing order) then custom levels sorted by name.
+func GetLevels() []*Level {
+	_LEVELS_MUTEX.RLock()
+	res := make([]*Level, 0, len(_LEVELS))
+
+	for _, l := range _LEVELS {
+		res = append(res, l)
+	}
+
+	_LEVELS_MUTEX.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].builtIn != res[j].builtIn {
+			return res[i].builtIn
+		}
+
+		if res[i].builtIn == true {
+			a, _ := strconv.Atoi(res[i].name)
+			b, _ := strconv.Atoi(res[j].name)
+			return a < b
+		}
+
+		return res[i].name < res[j].name
+	})
+
+	return res
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// MappedFile a file mapped in memory (see MMAP_SUPPORTED). The mapping is
+// private: the pages written to are copied, the file is never modified.
+// The file must not be truncated while mapped (the access to the missing
+// pages would crash the process).
+type MappedFile struct {
+	name string
+	data []byte
+}
+
+// OpenMappedFile maps the regular file 'name' in memory. Returns an error
+// if the platform does not support memory mapped files: the caller is
+// expected to read the file instead.
+func OpenMappedFile(name string) (*MappedFile, error) {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_OPEN_FILE)
+	}
+
+	// The mapping remains valid once the file is closed
+	defer f.Close()
+	fi, err := f.Stat()
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_OPEN_FILE)
+	}
+
+	if fi.Mode().IsRegular() == false {
+		return nil, NewIOError(fmt.Sprintf("Cannot map '%v': not a regular file", name), kanzi.ERR_OPEN_FILE)
+	}
+
+	size := fi.Size()
+
+	if int64(int(size)) != size {
+		return nil, NewIOError(fmt.Sprintf("Cannot map '%v': file too large (%d bytes)", name, size), kanzi.ERR_OPEN_FILE)
+	}
+
+	// Empty mappings are not allowed
+	if size == 0 {
+		return &MappedFile{name: name}, nil
+	}
+
+	data, err := mapFile(f, int(size))
+
+	if err != nil {
+		return nil, NewIOError(fmt.Sprintf("Cannot map '%v': %v", name, err), kanzi.ERR_OPEN_FILE)
+	}
+
+	return &MappedFile{name: name, data: data}, nil
+}
+
+// Name returns the name of the mapped file
+func (this *MappedFile) Name() string {
+	return this.name
+}
+
+// Bytes returns the content of the file (nil once the file is closed). The
+// slice must not be used after Close.
+func (this *MappedFile) Bytes() []byte {
+	return this.data
+}
+
+// Size returns the size of the mapped file
+func (this *MappedFile) Size() int64 {
+	return int64(len(this.data))
+}
+
+// Close unmaps the file. Idempotent.
+func (this *MappedFile) Close() error {
+	if this.data == nil {
+		return nil
+	}
+
+	data := this.data
+	this.data = nil
+
+	if err := unmapFile(data); err != nil {
+		return NewIOError(fmt.Sprintf("Cannot unmap '%v': %v", this.name, err), kanzi.ERR_READ_FILE)
+	}
+
+	return nil
+}
+
+// WriteMapped compresses the content of a mapped file. The blocks are sliced
+// from the mapping instead of being copied to the buffer of the stream: it
+// saves a copy per block and the memory of the buffer (several blocks with
+// concurrent jobs) with huge files. The transforms may write to the private
+// pages of the mapping. The data completing the blocks buffered by previous
+// writes and the end of the file shorter than a block are buffered as with
+// Write: the blocks are the same. The blocks sliced from the mapping are
+// written to the bitstream when WriteMapped returns: the file can be closed
+// before the stream.
+func (this *CompressedOutputStream) WriteMapped(mf *MappedFile) (int, error) {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return 0, NewIOError("Stream closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	data := mf.Bytes()
+	blockSize := int(this.blockSize)
+	n := 0
+
+	if this.curIdx > 0 {
+		// Complete the last buffered block
+		n = (blockSize - this.curIdx%blockSize) % blockSize
+
+		if n >= len(data) {
+			return this.Write(data)
+		}
+
+		if _, err := this.Write(data[0:n]); err != nil {
+			return 0, err
+		}
+
+		if err := this.processBlock(true); err != nil {
+			return n, err
+		}
+	}
+
+	for len(data)-n >= blockSize {
+		// Up to one block per task
+		sz := (len(data) - n) / blockSize
+
+		if sz > this.tasks {
+			sz = this.tasks
+		}
+
+		sz *= blockSize
+
+		if err := this.encodeBlocks(data[n:n+sz], true, nil); err != nil {
+			return n, err
+		}
+
+		n += sz
+	}
+
+	// No block of the mapping in flight once WriteMapped returns
+	if err := this.drain(); err != nil {
+		return n, err
+	}
+
+	m, err := this.Write(data[n:])
+	return n + m, err
+}
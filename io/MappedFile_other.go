@@ -0,0 +1,35 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+// MMAP_SUPPORTED true if the files can be mapped in memory (see OpenMappedFile)
+const MMAP_SUPPORTED = false
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory mapped files not supported on " + runtime.GOOS)
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
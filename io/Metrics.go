@@ -0,0 +1,262 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Names of the metrics reported by the compressed streams. The names are
+// prefixed with METRIC_ENCODER_PREFIX or METRIC_DECODER_PREFIX and follow
+// the Prometheus naming conventions (durations in seconds).
+const (
+	METRIC_ENCODER_PREFIX = "kanzi_encoder_"
+	METRIC_DECODER_PREFIX = "kanzi_decoder_"
+
+	METRIC_BLOCKS            = "blocks_total"          // counter: blocks processed
+	METRIC_BYTES_IN          = "bytes_in_total"        // counter: bytes read by the stage 1 (encoder) or 2 (decoder)
+	METRIC_BYTES_OUT         = "bytes_out_total"       // counter: bytes produced
+	METRIC_TRANSFORM_SECONDS = "transform_seconds"     // histogram: duration of the transform stage
+	METRIC_ENTROPY_SECONDS   = "entropy_seconds"       // histogram: duration of the entropy stage
+	METRIC_WAIT_SECONDS      = "wait_seconds"          // histogram: wait for the previous block (sequential bitstream access)
+	METRIC_QUEUE_DEPTH       = "queue_depth"           // gauge: blocks being processed concurrently
+	METRIC_STORED_BLOCKS     = "stored_blocks_total"   // counter: blocks stored raw because the transforms or the entropy coder expanded them
+	METRIC_REPAIRED_BLOCKS   = "repaired_blocks_total" // counter: damaged blocks restored from the parity shards
+	METRIC_RESYNCS           = "resyncs_total"         // counter: damaged blocks skipped up to the next sync marker
+
+	METRIC_RACE_BLOCKS         = "race_blocks_total"         // counter: blocks transformed by both raced chains
+	METRIC_RACE_ALTERNATE_WINS = "race_alternate_wins_total" // counter: raced blocks won by the alternate chain
+)
+
+// MetricsSink receives the metrics reported by the compressed streams.
+// Implementations must be safe for concurrent use (blocks are processed
+// concurrently) and should not block.
+type MetricsSink interface {
+	// Add increments a counter
+	Add(name string, delta int64)
+
+	// Set updates the value of a gauge
+	Set(name string, value float64)
+
+	// Observe records a sample in a histogram
+	Observe(name string, value float64)
+}
+
+// Report metrics for one stream direction (nil sink allowed)
+type metricsReporter struct {
+	sink   MetricsSink
+	prefix string
+}
+
+func (this metricsReporter) add(name string, delta int64) {
+	if this.sink != nil {
+		this.sink.Add(this.prefix+name, delta)
+	}
+}
+
+func (this metricsReporter) set(name string, value float64) {
+	if this.sink != nil {
+		this.sink.Set(this.prefix+name, value)
+	}
+}
+
+func (this metricsReporter) since(name string, start time.Time) {
+	if this.sink != nil {
+		this.sink.Observe(this.prefix+name, time.Since(start).Seconds())
+	}
+}
+
+// SetMetrics registers a sink for the metrics of the output stream (nil
+// removes it). Must not be called concurrently with Write.
+func (this *CompressedOutputStream) SetMetrics(sink MetricsSink) {
+	this.metrics = metricsReporter{sink: sink, prefix: METRIC_ENCODER_PREFIX}
+}
+
+// SetMetrics registers a sink for the metrics of the input stream (nil
+// removes it). Must not be called concurrently with Read.
+func (this *CompressedInputStream) SetMetrics(sink MetricsSink) {
+	this.metrics = metricsReporter{sink: sink, prefix: METRIC_DECODER_PREFIX}
+}
+
+// Upper bounds (in seconds) of the buckets of the duration histograms
+var _DURATION_BUCKETS = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005,
+	0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram a cumulative histogram (Prometheus style) that can be
+// published with expvar
+type Histogram struct {
+	bounds []float64
+	counts []int64 // one extra bucket for +Inf
+	sum    float64
+	total  int64
+	lock   sync.Mutex
+}
+
+// NewHistogram creates a new instance of Histogram given the (increasing)
+// upper bounds of the buckets
+func NewHistogram(bounds []float64) (*Histogram, error) {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, NewIOError("Histogram bounds must be increasing", kanzi.ERR_INVALID_PARAM)
+		}
+	}
+
+	this := &Histogram{}
+	this.bounds = make([]float64, len(bounds))
+	copy(this.bounds, bounds)
+	this.counts = make([]int64, len(bounds)+1)
+	return this, nil
+}
+
+// Observe records a sample
+func (this *Histogram) Observe(value float64) {
+	i := 0
+
+	for i < len(this.bounds) && value > this.bounds[i] {
+		i++
+	}
+
+	this.lock.Lock()
+	this.counts[i]++
+	this.sum += value
+	this.total++
+	this.lock.Unlock()
+}
+
+// Count returns the number of samples recorded
+func (this *Histogram) Count() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.total
+}
+
+// Sum returns the sum of the samples recorded
+func (this *Histogram) Sum() float64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.sum
+}
+
+// String returns a JSON representation of the histogram with cumulative
+// bucket counts (implements expvar.Var)
+func (this *Histogram) String() string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	var sb strings.Builder
+	sb.WriteString(`{"count": ` + strconv.FormatInt(this.total, 10))
+	sb.WriteString(`, "sum": ` + strconv.FormatFloat(this.sum, 'g', -1, 64))
+	sb.WriteString(`, "buckets": {`)
+	cumul := int64(0)
+
+	for i := range this.counts {
+		cumul += this.counts[i]
+		bound := "+Inf"
+
+		if i < len(this.bounds) {
+			bound = strconv.FormatFloat(this.bounds[i], 'g', -1, 64)
+		}
+
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+
+		sb.WriteString(`"` + bound + `": ` + strconv.FormatInt(cumul, 10))
+	}
+
+	sb.WriteString("}}")
+	return sb.String()
+}
+
+// ExpvarMetrics a MetricsSink publishing the metrics with the expvar package
+// (counters as expvar.Int, gauges as expvar.Float, histograms as Histogram)
+type ExpvarMetrics struct {
+	vars *expvar.Map
+	lock sync.Mutex
+}
+
+// NewExpvarMetrics creates a new instance of ExpvarMetrics publishing the
+// metrics in an expvar map with the provided name
+func NewExpvarMetrics(name string) (*ExpvarMetrics, error) {
+	if expvar.Get(name) != nil {
+		errMsg := fmt.Sprintf("An expvar variable named '%s' is already published", name)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	this := &ExpvarMetrics{}
+	this.vars = expvar.NewMap(name)
+	return this, nil
+}
+
+// Get returns the variable with the provided name (or nil)
+func (this *ExpvarMetrics) Get(name string) expvar.Var {
+	return this.vars.Get(name)
+}
+
+// Return the existing variable or create it (atomically)
+func (this *ExpvarMetrics) getOrCreate(name string, create func() expvar.Var) expvar.Var {
+	if v := this.vars.Get(name); v != nil {
+		return v
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	v := this.vars.Get(name)
+
+	if v == nil {
+		v = create()
+		this.vars.Set(name, v)
+	}
+
+	return v
+}
+
+// Add increments a counter
+func (this *ExpvarMetrics) Add(name string, delta int64) {
+	v := this.getOrCreate(name, func() expvar.Var { return new(expvar.Int) })
+
+	if c, ok := v.(*expvar.Int); ok == true {
+		c.Add(delta)
+	}
+}
+
+// Set updates the value of a gauge
+func (this *ExpvarMetrics) Set(name string, value float64) {
+	v := this.getOrCreate(name, func() expvar.Var { return new(expvar.Float) })
+
+	if g, ok := v.(*expvar.Float); ok == true {
+		g.Set(value)
+	}
+}
+
+// Observe records a sample in a histogram (duration buckets)
+func (this *ExpvarMetrics) Observe(name string, value float64) {
+	v := this.getOrCreate(name, func() expvar.Var {
+		h, _ := NewHistogram(_DURATION_BUCKETS)
+		return h
+	})
+
+	if h, ok := v.(*Histogram); ok == true && math.IsNaN(value) == false {
+		h.Observe(value)
+	}
+}
@@ -0,0 +1,448 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/bitstream"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// One-shot blocks (see ONESHOT_MAGIC): the whole data is transformed and
+// entropy coded in memory by the calling goroutine, without stream header,
+// block headers or end block. For the values of databases and the messages
+// of RPC systems, where the data is at hand and the stream plumbing is an
+// overhead. The helpers live in this package because the codecs import the
+// kanzi package: kanzi.Compress and kanzi.Decompress call them once this
+// package is imported.
+
+func init() {
+	kanzi.RegisterOneShot(Compress, Decompress)
+}
+
+// Writes the bitstream to a slice (the destination of Compress)
+type sliceWriter struct {
+	buf []byte
+}
+
+func (this *sliceWriter) Write(p []byte) (int, error) {
+	this.buf = append(this.buf, p...)
+	return len(p), nil
+}
+
+func (this *sliceWriter) Close() error {
+	return nil
+}
+
+// The header fields of a one-shot block
+type oneShotHeader struct {
+	entropyType   uint32
+	transformType uint64
+	skipFlags     byte
+	size          uint // size of the data
+	coded         uint // size of the transformed data
+	checksum      bool
+	sum           uint32
+}
+
+// CompressBound returns the largest size of the one-shot block of 'n' bytes
+// of data (see Compress)
+func CompressBound(n int) int {
+	return n + ONESHOT_HEADER_SIZE
+}
+
+// Compress compresses 'src' to a one-shot block (see ONESHOT_MAGIC) written
+// to 'dst' (if large enough, see CompressBound, else to a new slice) and
+// returns the block. The data is transformed and entropy coded directly from
+// 'src' (not modified). The context map is optional: "codec" (ANS0 by
+// default), "transform" (BWT+RANK+ZRLT by default), "checksum" (bool) and
+// "jobs" (uint, 1 by default). The entropy options and lanes of the streams
+// are not supported.
+func Compress(dst, src []byte, ctx map[string]interface{}) (res []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = nil
+			err = NewIOError(fmt.Sprintf("Cannot compress: %v", r), kanzi.ERR_PROCESS_BLOCK)
+		}
+	}()
+
+	if len(src) > ONESHOT_MAX_SIZE {
+		errMsg := fmt.Sprintf("The data must be at most %d MB", ONESHOT_MAX_SIZE>>20)
+		return nil, NewIOError(errMsg, kanzi.ERR_BLOCK_SIZE)
+	}
+
+	params := map[string]interface{}{"codec": "ANS0", "transform": "BWT+RANK+ZRLT", "jobs": uint(1)}
+
+	for k, v := range ctx {
+		params[k] = v
+	}
+
+	hdr, err := parseOneShotParams(params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hdr.size = uint(len(src))
+	params["blockSize"] = hdr.size
+	params["size"] = hdr.size
+	params["extra"] = hdr.entropyType == entropy.TPAQX_TYPE
+
+	if hdr.checksum == true {
+		var sum [4]byte
+		hasher, _ := newBlockHasher(CHECKSUM_TYPE_XXHASH32)
+		hasher.sum(src, sum[:])
+		hdr.sum = binary.BigEndian.Uint32(sum[:])
+	}
+
+	data := src
+	hdr.skipFlags = 0xFF
+
+	if hdr.transformType != function.NONE_TYPE && len(src) > _SMALL_BLOCK_SIZE {
+		t, err := function.NewByteFunction(&params, hdr.transformType)
+
+		if err != nil {
+			return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_CODEC)
+		}
+
+		input := src
+		buffer := make([]byte, t.MaxEncodedLen(len(src)))
+
+		// The transforms of a sequence write to the input of the first one
+		// if it is large enough to hold the largest output
+		if len(function.GetTypes(hdr.transformType)) > 1 && len(buffer) <= len(src) {
+			input = make([]byte, len(src))
+			copy(input, src)
+		}
+
+		// Forward transform (ignore error, encode skipFlags)
+		_, length, _ := t.Forward(input, buffer)
+		hdr.skipFlags = t.SkipFlags()
+
+		if hdr.skipFlags != 0xFF {
+			data = buffer[0:length]
+		}
+	}
+
+	if hdr.skipFlags == 0xFF {
+		hdr.transformType = function.NONE_TYPE
+	}
+
+	hdr.coded = uint(len(data))
+	params["size"] = hdr.coded
+
+	if res, err = writeOneShotBlock(dst[:0], data, hdr, params); err != nil {
+		return nil, err
+	}
+
+	// Store the data if it does not compress
+	if stored := CompressBound(len(src)); len(res) > stored || (len(res) == stored && hdr.entropyType != entropy.NONE_TYPE) {
+		hdr.entropyType = entropy.NONE_TYPE
+		hdr.transformType = function.NONE_TYPE
+		hdr.skipFlags = 0xFF
+		hdr.coded = hdr.size
+		return writeOneShotBlock(res[:0], src, hdr, params)
+	}
+
+	largest := int(hdr.size)
+
+	if largest < int(hdr.coded) {
+		largest = int(hdr.coded)
+	}
+
+	// The decoders reject the blocks expanding more than ONESHOT_MAX_RATIO
+	// times: pad the block with zeros (ignored)
+	if minLen := (largest + ONESHOT_MAX_RATIO - 1) / ONESHOT_MAX_RATIO; len(res) < minLen {
+		res = append(res, make([]byte, minLen-len(res))...)
+	}
+
+	return res, nil
+}
+
+// Validate the parameters of Compress. Panics if a codec or transform name
+// is unknown.
+func parseOneShotParams(params map[string]interface{}) (*oneShotHeader, error) {
+	codec, ok1 := params["codec"].(string)
+	transform, ok2 := params["transform"].(string)
+
+	if ok1 == false || ok2 == false {
+		return nil, NewIOError("The codec and the transform must be strings", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if jobs, ok := params["jobs"].(uint); ok == false || jobs == 0 || jobs > _MAX_CONCURRENCY {
+		errMsg := fmt.Sprintf("The number of jobs must be in [1..%v]", _MAX_CONCURRENCY)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	hdr := &oneShotHeader{entropyType: entropy.GetType(codec), transformType: function.GetType(transform)}
+
+	if val, prst := params["checksum"]; prst == true {
+		if hdr.checksum, ok1 = val.(bool); ok1 == false {
+			return nil, NewIOError("The checksum parameter must be a boolean", kanzi.ERR_INVALID_PARAM)
+		}
+	}
+
+	if entropy.HasEntropyOptions(params, hdr.entropyType) == true || entropy.HasEntropyLanes(params, hdr.entropyType) == true {
+		return nil, NewIOError("The entropy options and lanes are not supported by one-shot blocks", kanzi.ERR_INVALID_PARAM)
+	}
+
+	return hdr, nil
+}
+
+// Write the header of the block and the entropy coded data to 'dst'
+func writeOneShotBlock(dst, data []byte, hdr *oneShotHeader, params map[string]interface{}) ([]byte, error) {
+	w := &sliceWriter{buf: dst}
+	obs, err := bitstream.NewDefaultOutputBitStream(w, oneShotBufferSize(len(data)))
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_BITSTREAM)
+	}
+
+	cksum := uint64(0)
+
+	if hdr.checksum == true {
+		cksum = 1
+	}
+
+	transforms := SplitTransformField(hdr.transformType)
+	obs.WriteBits(ONESHOT_MAGIC, SMALL_HEADER_MAGIC_BITS)
+	obs.WriteBits(cksum, HEADER_CHECKSUM_BITS)
+	obs.WriteBits(uint64(hdr.entropyType), HEADER_ENTROPY_BITS)
+	obs.WriteBits(uint64(len(transforms)), SMALL_HEADER_TRANSFORMS_BITS)
+
+	for _, t := range transforms {
+		obs.WriteBits(uint64(t), TRANSFORM_ID_BITS)
+	}
+
+	obs.WriteBits(uint64(hdr.skipFlags), 8)
+	writeOneShotSize(obs, hdr.size)
+	writeOneShotSize(obs, hdr.coded)
+
+	if hdr.checksum == true {
+		obs.WriteBits(uint64(hdr.sum), BLOCK_CHECKSUM_BITS)
+	}
+
+	ee, err := entropy.NewEntropyEncoder(obs, params, hdr.entropyType)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_CODEC)
+	}
+
+	if _, err = ee.Write(data); err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+	}
+
+	ee.Dispose()
+
+	if _, err = obs.Close(); err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_WRITE_FILE)
+	}
+
+	return w.buf, nil
+}
+
+func writeOneShotSize(obs kanzi.OutputBitStream, size uint) {
+	n := uint(1)
+
+	for size>>(8*n) != 0 {
+		n++
+	}
+
+	obs.WriteBits(uint64(n-1), ONESHOT_SIZE_BITS)
+	obs.WriteBits(uint64(size), 8*n)
+}
+
+func readOneShotSize(ibs kanzi.InputBitStream) uint {
+	n := uint(ibs.ReadBits(ONESHOT_SIZE_BITS)) + 1
+	return uint(ibs.ReadBits(8 * n))
+}
+
+// Size of the buffer of the bitstreams of a one-shot block
+func oneShotBufferSize(n int) uint {
+	n = (n + 7) &^ 7
+
+	if n < 1024 {
+		return 1024
+	}
+
+	if n > 65536 {
+		return 65536
+	}
+
+	return uint(n)
+}
+
+// Decompress decodes the one-shot block 'src' (see Compress) to 'dst' (if
+// its capacity is at least the size of the data, else to a new slice) and
+// returns the data. The last inverse transform writes to 'dst' directly if
+// it has room for the intermediate outputs of the transforms (else the data
+// is copied to 'dst' from a scratch buffer). The sizes in the header are bounded by the size of the block (see
+// ONESHOT_MAX_RATIO) before any allocation.
+func Decompress(dst, src []byte) (res []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res = nil
+			err = NewIOError(fmt.Sprintf("Invalid one-shot block: %v", r), kanzi.ERR_INVALID_FILE)
+		}
+	}()
+
+	if len(src) < SMALL_HEADER_MAGIC_BITS/8 || binary.BigEndian.Uint16(src) != ONESHOT_MAGIC {
+		return nil, NewIOError("Invalid one-shot block: missing magic", kanzi.ERR_INVALID_FILE)
+	}
+
+	ibs, err := bitstream.NewDefaultInputBitStream(io.NopCloser(bytes.NewReader(src)), oneShotBufferSize(len(src)))
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_BITSTREAM)
+	}
+
+	defer ibs.Close()
+	ibs.ReadBits(SMALL_HEADER_MAGIC_BITS)
+	hdr := &oneShotHeader{checksum: ibs.ReadBit() == 1}
+	hdr.entropyType = uint32(ibs.ReadBits(HEADER_ENTROPY_BITS))
+	nbTransforms := int(ibs.ReadBits(SMALL_HEADER_TRANSFORMS_BITS))
+
+	if nbTransforms > MAX_TRANSFORMS {
+		errMsg := fmt.Sprintf("Invalid one-shot block, incorrect number of transforms: %d", nbTransforms)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	for i := 0; i < nbTransforms; i++ {
+		t := ibs.ReadBits(TRANSFORM_ID_BITS)
+		hdr.transformType |= t << uint(TRANSFORM_ID_BITS*(MAX_TRANSFORMS-1-i))
+	}
+
+	hdr.skipFlags = byte(ibs.ReadBits(8))
+	hdr.size = readOneShotSize(ibs)
+	hdr.coded = readOneShotSize(ibs)
+
+	// The sizes are not trusted: neither the entropy decoder nor the inverse
+	// transforms expand the block more than ONESHOT_MAX_RATIO times
+	maxSize := uint64(len(src)) * ONESHOT_MAX_RATIO
+
+	if hdr.size > ONESHOT_MAX_SIZE || hdr.coded > ONESHOT_MAX_SIZE+_EXTRA_BUFFER_SIZE ||
+		uint64(hdr.size) > maxSize || uint64(hdr.coded) > maxSize {
+		errMsg := fmt.Sprintf("Invalid one-shot block sizes: %d, %d", hdr.size, hdr.coded)
+		return nil, NewIOError(errMsg, kanzi.ERR_BLOCK_SIZE)
+	}
+
+	stored := hdr.transformType == function.NONE_TYPE || hdr.skipFlags == 0xFF
+
+	if stored == true && hdr.coded != hdr.size {
+		errMsg := fmt.Sprintf("Invalid one-shot block sizes: %d, %d", hdr.size, hdr.coded)
+		return nil, NewIOError(errMsg, kanzi.ERR_BLOCK_SIZE)
+	}
+
+	if hdr.checksum == true {
+		hdr.sum = uint32(ibs.ReadBits(BLOCK_CHECKSUM_BITS))
+	}
+
+	// Names of the header ids (panic if unknown)
+	params := map[string]interface{}{"codec": entropy.GetName(hdr.entropyType),
+		"transform": function.GetName(hdr.transformType), "jobs": uint(1),
+		"blockSize": hdr.size, "size": hdr.coded, "extra": hdr.entropyType == entropy.TPAQX_TYPE}
+
+	if uint(cap(dst)) < hdr.size {
+		dst = make([]byte, hdr.size)
+	}
+
+	dst = dst[0:hdr.size]
+	buffer := dst
+	bufSize := int(hdr.size)
+
+	if bufSize < int(hdr.coded) {
+		bufSize = int(hdr.coded)
+	}
+
+	// The intermediate outputs of the inverse transforms may be larger than
+	// the data (slack)
+	bufSize += _EXTRA_BUFFER_SIZE
+
+	if stored == false {
+		buffer = make([]byte, bufSize)
+	}
+
+	ed, err := entropy.NewEntropyDecoder(ibs, params, hdr.entropyType)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_INVALID_CODEC)
+	}
+
+	decoded, err := ed.Read(buffer[0:hdr.coded])
+	ed.Dispose()
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+	}
+
+	if decoded != int(hdr.coded) {
+		errMsg := fmt.Sprintf("Invalid one-shot block: decoded %d symbols, expected %d", decoded, hdr.coded)
+		return nil, NewIOError(errMsg, kanzi.ERR_PROCESS_BLOCK)
+	}
+
+	size := hdr.coded
+
+	if stored == false {
+		params["size"] = hdr.coded
+		t, err := function.NewByteFunction(&params, hdr.transformType)
+
+		if err != nil {
+			return nil, NewIOError(err.Error(), kanzi.ERR_INVALID_CODEC)
+		}
+
+		t.SetSkipFlags(hdr.skipFlags)
+		output := dst[0:cap(dst)]
+
+		// Keep the slack in a scratch buffer if 'dst' is too small for it
+		if len(output) < bufSize {
+			output = make([]byte, bufSize)
+		}
+
+		if _, size, err = t.Inverse(buffer[0:hdr.coded], output); err != nil {
+			return nil, NewIOError(err.Error(), kanzi.ERR_PROCESS_BLOCK)
+		}
+
+		if size == hdr.size && size > 0 && &output[0] != &dst[0] {
+			copy(dst, output[0:size])
+		}
+	}
+
+	if size != hdr.size {
+		errMsg := fmt.Sprintf("Invalid one-shot block: decoded %d bytes, expected %d", size, hdr.size)
+		return nil, NewIOError(errMsg, kanzi.ERR_PROCESS_BLOCK)
+	}
+
+	res = dst[0:size]
+
+	if hdr.checksum == true {
+		var sum [4]byte
+		hasher, _ := newBlockHasher(CHECKSUM_TYPE_XXHASH32)
+		hasher.sum(res, sum[:])
+
+		if checksum := binary.BigEndian.Uint32(sum[:]); checksum != hdr.sum {
+			errMsg := fmt.Sprintf("Corrupted one-shot block: expected checksum %x, found %x", hdr.sum, checksum)
+			return nil, NewIOError(errMsg, kanzi.ERR_CRC_CHECK)
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"hash/crc32"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Reed-Solomon erasure code protecting the entropy coded data of the blocks
+// (context key 'parityShards'). The data is split into PARITY_DATA_SHARDS
+// shards and the parity shards are computed with a Cauchy matrix over
+// GF(256): any PARITY_DATA_SHARDS intact shards restore the data. The CRC32
+// of each shard locates the damaged shards (erasures). The block headers are
+// not protected.
+
+var (
+	_GF_EXP [512]byte
+	_GF_LOG [256]byte
+)
+
+func init() {
+	x := 1
+
+	for i := 0; i < 255; i++ {
+		_GF_EXP[i] = byte(x)
+		_GF_LOG[x] = byte(i)
+		x <<= 1
+
+		if x&0x100 != 0 {
+			x ^= PARITY_GF_POLYNOMIAL
+		}
+	}
+
+	for i := 255; i < len(_GF_EXP); i++ {
+		_GF_EXP[i] = _GF_EXP[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return _GF_EXP[int(_GF_LOG[a])+int(_GF_LOG[b])]
+}
+
+// a must not be 0
+func gfInv(a byte) byte {
+	return _GF_EXP[255-int(_GF_LOG[a])]
+}
+
+// dst += c * src
+func gfMulAdd(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+
+	var table [256]byte
+
+	for i := 1; i < 256; i++ {
+		table[i] = gfMul(c, byte(i))
+	}
+
+	for i := range dst {
+		dst[i] ^= table[src[i]]
+	}
+}
+
+// Invert the square matrix m (modified). Returns false if m is singular.
+func gfInvert(m [][]byte) ([][]byte, bool) {
+	n := len(m)
+	inv := make([][]byte, n)
+
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+
+		for pivot < n && m[pivot][col] == 0 {
+			pivot++
+		}
+
+		if pivot == n {
+			return nil, false
+		}
+
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		if c := gfInv(m[col][col]); c != 1 {
+			for j := 0; j < n; j++ {
+				m[col][j] = gfMul(m[col][j], c)
+				inv[col][j] = gfMul(inv[col][j], c)
+			}
+		}
+
+		for row := 0; row < n; row++ {
+			if c := m[row][col]; row != col && c != 0 {
+				gfMulAdd(c, m[col], m[row])
+				gfMulAdd(c, inv[col], inv[row])
+			}
+		}
+	}
+
+	return inv, true
+}
+
+// parityCodec computes and checks the parity shards of a block. Stateless,
+// shared by the tasks.
+type parityCodec struct {
+	parityShards int
+	matrix       [][]byte // identity rows (data shards) then Cauchy rows (parity shards)
+}
+
+func newParityCodec(parityShards int) *parityCodec {
+	this := &parityCodec{parityShards: parityShards}
+	this.matrix = make([][]byte, PARITY_DATA_SHARDS+parityShards)
+
+	for i := range this.matrix {
+		row := make([]byte, PARITY_DATA_SHARDS)
+
+		if i < PARITY_DATA_SHARDS {
+			row[i] = 1
+		} else {
+			// 1/(x_i + y_j) with x_i = i and y_j = j (distinct)
+			for j := range row {
+				row[j] = gfInv(byte(i) ^ byte(j))
+			}
+		}
+
+		this.matrix[i] = row
+	}
+
+	return this
+}
+
+// Return the parity level stored in the stream header
+func getParityLevel(parityShards uint) (uint8, error) {
+	for level := uint8(0); level < 1<<HEADER_PARITY_BITS; level++ {
+		if parityShardsOf(level) == parityShards {
+			return level, nil
+		}
+	}
+
+	errMsg := fmt.Sprintf("The number of parity shards must be 0, 2, 4 or 8 (for %d data shards)", PARITY_DATA_SHARDS)
+	return 0, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+}
+
+// Return the number of parity shards for the parity level of the header
+func parityShardsOf(level uint8) uint {
+	if level == 0 {
+		return 0
+	}
+
+	return 1 << level
+}
+
+// Size in bytes of each shard for n bytes of data
+func (this *parityCodec) shardSize(n int) int {
+	if n == 0 {
+		return 1
+	}
+
+	return (n + PARITY_DATA_SHARDS - 1) / PARITY_DATA_SHARDS
+}
+
+// Number of shards (data and parity)
+func (this *parityCodec) shards() int {
+	return PARITY_DATA_SHARDS + this.parityShards
+}
+
+// Copy the data shard (padded with zeros) to shard
+func (this *parityCodec) dataShard(data []byte, idx int, shard []byte) {
+	start := idx * len(shard)
+
+	if start > len(data) {
+		start = len(data)
+	}
+
+	n := copy(shard, data[start:])
+
+	for i := n; i < len(shard); i++ {
+		shard[i] = 0
+	}
+}
+
+// Return the CRC32 of the shards and the parity shards of data
+func (this *parityCodec) encode(data []byte) ([]uint32, []byte) {
+	size := this.shardSize(len(data))
+	parity := make([]byte, this.parityShards*size)
+	crcs := make([]uint32, this.shards())
+	shard := make([]byte, size)
+
+	for j := 0; j < PARITY_DATA_SHARDS; j++ {
+		this.dataShard(data, j, shard)
+		crcs[j] = crc32.ChecksumIEEE(shard)
+
+		for i := 0; i < this.parityShards; i++ {
+			gfMulAdd(this.matrix[PARITY_DATA_SHARDS+i][j], shard, parity[i*size:(i+1)*size])
+		}
+	}
+
+	for i := 0; i < this.parityShards; i++ {
+		crcs[PARITY_DATA_SHARDS+i] = crc32.ChecksumIEEE(parity[i*size : (i+1)*size])
+	}
+
+	return crcs, parity
+}
+
+// Check the shards of data with their CRC32 and restore the damaged data
+// shards from the intact shards. Returns the number of restored shards or an
+// error if too many shards are damaged.
+func (this *parityCodec) repair(data []byte, crcs []uint32, parity []byte) (int, *IOError) {
+	size := this.shardSize(len(data))
+	shards := make([][]byte, this.shards())
+	valid := make([]int, 0, PARITY_DATA_SHARDS)
+	damaged := make([]int, 0)
+
+	for i := range shards {
+		if i < PARITY_DATA_SHARDS {
+			shards[i] = make([]byte, size)
+			this.dataShard(data, i, shards[i])
+		} else {
+			shards[i] = parity[(i-PARITY_DATA_SHARDS)*size : (i-PARITY_DATA_SHARDS+1)*size]
+		}
+
+		if crc32.ChecksumIEEE(shards[i]) != crcs[i] {
+			if i < PARITY_DATA_SHARDS {
+				damaged = append(damaged, i)
+			}
+		} else if len(valid) < PARITY_DATA_SHARDS {
+			valid = append(valid, i)
+		}
+	}
+
+	if len(damaged) == 0 {
+		return 0, nil
+	}
+
+	if len(valid) < PARITY_DATA_SHARDS {
+		errMsg := fmt.Sprintf("Corrupted bitstream: %d damaged shards, cannot repair the block", this.shards()-len(valid))
+		return 0, NewIOError(errMsg, kanzi.ERR_CRC_CHECK)
+	}
+
+	// The valid shards are the product of their rows of the matrix by the
+	// data shards: invert these rows
+	m := make([][]byte, PARITY_DATA_SHARDS)
+
+	for k, row := range valid {
+		m[k] = append([]byte(nil), this.matrix[row]...)
+	}
+
+	inv, ok := gfInvert(m)
+
+	if ok == false {
+		return 0, NewIOError("Corrupted bitstream: cannot repair the block", kanzi.ERR_CRC_CHECK)
+	}
+
+	shard := make([]byte, size)
+
+	for _, j := range damaged {
+		for i := range shard {
+			shard[i] = 0
+		}
+
+		for k, row := range valid {
+			gfMulAdd(inv[j][k], shards[row], shard)
+		}
+
+		if start := j * size; start < len(data) {
+			copy(data[start:], shard)
+		}
+	}
+
+	return len(damaged), nil
+}
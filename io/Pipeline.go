@@ -0,0 +1,395 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// StageInfo describes one stage of the compression pipeline
+type StageInfo struct {
+	Kind   string `json:"kind"` // "transform" or "entropy"
+	Name   string `json:"name"`
+	Type   uint64 `json:"type"`
+	Memory uint64 `json:"memory"` // estimated memory per block in bytes
+}
+
+// HeaderField describes one field of the bitstream header
+type HeaderField struct {
+	Name  string `json:"name"`
+	Bits  uint   `json:"bits"`
+	Value uint64 `json:"value"`
+}
+
+// PipelineInfo describes what a configuration actually does: the stages
+// applied to each block, the memory usage and the layout of the header.
+type PipelineInfo struct {
+	Version     uint          `json:"version"`
+	BlockSize   uint          `json:"blockSize"`
+	Jobs        uint          `json:"jobs"`
+	Checksum    bool          `json:"checksum"`
+	Stages      []StageInfo   `json:"stages"`
+	Header      []HeaderField `json:"header"`
+	HeaderBits  uint          `json:"headerBits"`
+	BlockMemory uint64        `json:"blockMemory"` // estimated memory per block in bytes
+	TotalMemory uint64        `json:"totalMemory"` // estimated memory for all jobs in bytes
+}
+
+// DescribePipeline builds a PipelineInfo from a map of parameters using the
+// same keys as NewCompressedOutputStreamWithCtx ('codec', 'transform',
+// 'blockSize', 'jobs', 'checksum', 'checksumType', 'streamDigest',
+// 'parityShards', 'dictionaryMode', 'lzDictionary', 'textDictionary',
+// 'syncPoints', 'partialBlocks', 'headerSections', 'compactHeaders',
+// 'textEscapeRuns', 'textMarkup', 'textRetain', 'textChunkSize', 'lzCoders',
+// 'rolzLogPosChecks', 'rltWidth').
+// Returns an error if the configuration is invalid.
+func DescribePipeline(ctx map[string]interface{}) (info *PipelineInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			info = nil
+			err = NewIOError(fmt.Sprintf("Invalid configuration: %v", r), kanzi.ERR_INVALID_PARAM)
+		}
+	}()
+
+	if ctx == nil {
+		return nil, NewIOError("Invalid null context parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	codec, _ := ctx["codec"].(string)
+	transform, _ := ctx["transform"].(string)
+	blockSize, _ := ctx["blockSize"].(uint)
+	jobs, _ := ctx["jobs"].(uint)
+	checksum, _ := ctx["checksum"].(bool)
+	checksumName, _ := ctx["checksumType"].(string)
+	streamDigest, _ := ctx["streamDigest"].(bool)
+	parityShards, _ := ctx["parityShards"].(uint)
+	syncPoints, _ := ctx["syncPoints"].(bool)
+	partialBlocks, _ := ctx["partialBlocks"].(bool)
+	sections, _ := ctx["headerSections"].(bool)
+	compact, _ := ctx["compactHeaders"].(bool)
+	checksumType := uint8(CHECKSUM_TYPE_XXHASH32)
+	parityLevel, err := getParityLevel(parityShards)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dictionaries, err := parseStreamDictionaries(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(checksumName) != 0 {
+		if checksumType, err = getChecksumType(checksumName); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(codec) == 0 {
+		codec = "NONE"
+	}
+
+	if len(transform) == 0 {
+		transform = "NONE"
+	}
+
+	if jobs == 0 {
+		jobs = 1
+	}
+
+	if blockSize < _MIN_BITSTREAM_BLOCK_SIZE || blockSize > _MAX_BITSTREAM_BLOCK_SIZE {
+		errMsg := fmt.Sprintf("Invalid block size: %d (must be in [%d..%d])", blockSize,
+			_MIN_BITSTREAM_BLOCK_SIZE, _MAX_BITSTREAM_BLOCK_SIZE)
+		return nil, NewIOError(errMsg, kanzi.ERR_BLOCK_SIZE)
+	}
+
+	// Raced chains: the stream chain contains both chains
+	race, _ := ctx["raceTransform"].(string)
+
+	if len(race) != 0 {
+		transform += "+" + race
+	}
+
+	entropyType := entropy.GetType(codec)
+	transformType := function.GetType(transform)
+	version := uint(STREAM_MIN_VERSION)
+	hasOptions := entropy.HasEntropyOptions(ctx, entropyType)
+	hasLanes := entropy.HasEntropyLanes(ctx, entropyType)
+	transformExtensions := function.HasExtensions(ctx, transformType)
+
+	if sections == true {
+		version = STREAM_SECTIONS_VERSION
+	} else if checksumType != CHECKSUM_TYPE_XXHASH32 || streamDigest == true || parityLevel != 0 || dictionaries != nil || syncPoints == true || partialBlocks == true || compact == true || hasOptions == true || hasLanes == true || transformExtensions == true {
+		version = STREAM_EXT_VERSION
+	}
+
+	info = &PipelineInfo{Version: version, BlockSize: blockSize,
+		Jobs: jobs, Checksum: checksum}
+
+	// Input and output block buffers
+	info.BlockMemory = 2 * uint64(blockSize)
+
+	for _, t := range function.GetTypes(transformType) {
+		stage := StageInfo{Kind: "transform", Name: function.GetTypeName(t), Type: t,
+			Memory: estimateTransformMemory(t, blockSize)}
+		info.Stages = append(info.Stages, stage)
+		info.BlockMemory += stage.Memory
+	}
+
+	stage := StageInfo{Kind: "entropy", Name: entropy.GetName(entropyType), Type: uint64(entropyType),
+		Memory: estimateEntropyMemory(entropyType, blockSize)}
+
+	// One predictor per lane (and the coded lanes)
+	if lanes, _ := ctx["entropy:lanes"].(uint); lanes > 1 && entropy.HasEntropyLanes(ctx, entropyType) == true {
+		stage.Memory = stage.Memory*uint64(lanes) + uint64(blockSize)
+	}
+	info.Stages = append(info.Stages, stage)
+	info.BlockMemory += stage.Memory
+
+	// Both chains run concurrently (extra output buffer and entropy codec)
+	if len(race) != 0 {
+		info.BlockMemory += uint64(blockSize) + stage.Memory
+	}
+
+	info.TotalMemory = info.BlockMemory * uint64(jobs)
+	entropyOptions := uint64(0)
+
+	if hasOptions == true {
+		entropyOptions = 1
+	}
+
+	entropyLanes := uint64(0)
+
+	if hasLanes == true {
+		entropyLanes = 1
+	}
+
+	cksum := uint64(0)
+
+	if checksum == true {
+		cksum = 1
+	}
+
+	compactFlag := uint64(0)
+
+	if compact == true {
+		compactFlag = 1
+	}
+
+	// Mirror CompressedOutputStream.writeHeader()
+	info.Header = []HeaderField{
+		{Name: "type", Bits: 32, Value: _BITSTREAM_TYPE},
+		{Name: "version", Bits: 5, Value: uint64(version)},
+		{Name: "checksum", Bits: 1, Value: cksum},
+		{Name: "entropy", Bits: 5, Value: uint64(entropyType)},
+		{Name: "transforms", Bits: 48, Value: transformType},
+		{Name: "blockSize", Bits: 28, Value: uint64(blockSize >> 4)},
+		{Name: "blocks", Bits: 6, Value: 0},
+		{Name: "compactHeaders", Bits: 1, Value: compactFlag},
+		{Name: "entropyOptions", Bits: 1, Value: entropyOptions},
+		{Name: "entropyLanes", Bits: 1, Value: entropyLanes},
+	}
+
+	if version > STREAM_MIN_VERSION {
+		digest := uint64(0)
+		dictFlag := uint64(0)
+		syncFlag := uint64(0)
+		partialFlag := uint64(0)
+
+		if streamDigest == true {
+			digest = 1
+		}
+
+		if dictionaries != nil {
+			dictFlag = 1
+		}
+
+		if syncPoints == true {
+			syncFlag = 1
+		}
+
+		if partialBlocks == true {
+			partialFlag = 1
+		}
+
+		info.Header = append(info.Header,
+			HeaderField{Name: "checksumType", Bits: 2, Value: uint64(checksumType)},
+			HeaderField{Name: "digest", Bits: 1, Value: digest},
+			HeaderField{Name: "parity", Bits: 2, Value: uint64(parityLevel)},
+			HeaderField{Name: "dictionaries", Bits: 1, Value: dictFlag},
+			HeaderField{Name: "syncPoints", Bits: 1, Value: syncFlag},
+			HeaderField{Name: "partialBlocks", Bits: 1, Value: partialFlag})
+
+		if dictionaries != nil {
+			// Variable size: the value is the number of dictionaries
+			info.Header = append(info.Header, HeaderField{Name: "dictionaryData",
+				Bits: dictionaries.headerBits(), Value: uint64(len(dictionaries.contents()))})
+		}
+
+		if sections == true {
+			// Variable size: the value is the number of sections
+			features := entropyFeatures(entropyOptions == 1, entropyLanes == 1)
+			s := newHeaderSections(transformType, entropyType, features, dictionaries)
+			info.Header = append(info.Header, HeaderField{Name: "sections",
+				Bits: headerSectionsBits(s), Value: uint64(len(s))})
+		}
+	}
+
+	for _, f := range info.Header {
+		info.HeaderBits += f.Bits
+	}
+
+	return info, nil
+}
+
+// Pipeline returns a description of the pipeline configured for this stream
+func (this *CompressedOutputStream) Pipeline() (*PipelineInfo, error) {
+	return DescribePipeline(this.ctx)
+}
+
+// JSON returns the JSON representation of the pipeline
+func (this *PipelineInfo) JSON() (string, error) {
+	buf, err := json.MarshalIndent(this, "", "  ")
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// String returns a one line summary of the pipeline
+func (this *PipelineInfo) String() string {
+	names := make([]string, len(this.Stages))
+
+	for i, s := range this.Stages {
+		names[i] = s.Name
+	}
+
+	return fmt.Sprintf("%s (block size %d, %d job(s), ~%d MB)", strings.Join(names, " => "),
+		this.BlockSize, this.Jobs, (this.TotalMemory+(1<<20)-1)>>20)
+}
+
+// Rough estimates based on the allocations performed by each transform
+func estimateTransformMemory(transformType uint64, blockSize uint) uint64 {
+	bsz := uint64(blockSize)
+
+	switch transformType {
+	case function.BWT_TYPE:
+		return 4*bsz + 65536*8 + (1<<17)*2
+
+	case function.BWTS_TYPE, function.AUTOBWT_TYPE:
+		return 8 * bsz
+
+	case function.LZ_TYPE:
+		return 4 << 18
+
+	case function.ROLZ_TYPE, function.ROLZX_TYPE:
+		return 4*(1<<16) + 4*(1<<21) + 2*bsz
+
+	case function.DICT_TYPE:
+		return 16*(1<<18) + 32*(1<<16)
+
+	case function.PATH_TYPE:
+		return 16*(1<<18) + 32*(1<<16) + 4*bsz
+
+	case function.UTF16_TYPE:
+		return 16*(1<<18) + 32*(1<<16) + 3*bsz
+
+	case function.META_TYPE:
+		// Text codecs of the TEXT and UTF16 chains and chain buffers
+		return 2*(16*(1<<18)+32*(1<<16)) + 6*bsz
+
+	case function.B64_TYPE:
+		return 4 * bsz
+
+	case function.STRUCT_TYPE:
+		return 2 * bsz
+
+	case function.PLANE_TYPE:
+		return bsz
+
+	case function.SRT_TYPE, function.RANK_TYPE, function.MTFT_TYPE:
+		return 4 * 256 * 3
+
+	default:
+		return 0
+	}
+}
+
+// Rough estimates based on the allocations performed by each entropy codec
+func estimateEntropyMemory(entropyType uint32, blockSize uint) uint64 {
+	switch entropyType {
+	case entropy.TPAQ_TYPE, entropy.TPAQX_TYPE:
+		extra := uint(0)
+
+		if entropyType == entropy.TPAQX_TYPE {
+			extra = 1
+		}
+
+		states := uint64(1 << 26)
+
+		if blockSize >= 64*1024*1024 {
+			states = 1 << 29
+		} else if blockSize >= 16*1024*1024 {
+			states = 1 << 28
+		} else if blockSize >= 1024*1024 {
+			states = 1 << 27
+		}
+
+		return (states << extra) + (1 << 16) + (1 << 24) + (4*16*1024*1024)<<(2*extra) + 64*1024*1024
+
+	case entropy.CM_TYPE:
+		return 256 * 256 * 4 * 2
+
+	case entropy.CMX_TYPE:
+		return ((1<<21)+(1<<22)+65536+256)*2 + 65536*33*2
+
+	case entropy.ANS1_TYPE, entropy.RANS1_TYPE:
+		return 256*256*8*3 + 256*(1<<12)
+
+	case entropy.ANS0_TYPE, entropy.RANS0_TYPE, entropy.RANGE_TYPE, entropy.HUFFMAN_TYPE:
+		return 256*8*3 + (1 << 16)
+
+	case entropy.AHUFFMAN_TYPE:
+		return 256*8*5 + (1 << 13)
+
+	case entropy.RLE_TYPE:
+		return 256 * 8
+
+	case entropy.AUTO_TYPE:
+		// One codec at a time (trial encodings included)
+		res := uint64(0)
+
+		for _, t := range entropy.AutoCandidates() {
+			if m := estimateEntropyMemory(t, blockSize); m > res {
+				res = m
+			}
+		}
+
+		return res
+
+	default:
+		return 0
+	}
+}
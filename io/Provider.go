@@ -0,0 +1,660 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// Source a random access data source (local file, memory, HTTP server,
+// object store, ...). ReadAt follows the io.ReaderAt contract and may be
+// called concurrently.
+type Source interface {
+	io.ReaderAt
+
+	// Size returns the size of the data in bytes
+	Size() (int64, error)
+
+	// Close releases the resources of the source
+	Close() error
+}
+
+// Sink a destination receiving the data in numbered parts (EG. a multipart
+// upload to an object store). WritePart may be called concurrently and the
+// parts may arrive in any order. A failed WritePart may be called again
+// with the same part (retry).
+type Sink interface {
+	// WritePart writes the part (numbered from 1) located at the provided
+	// offset of the output
+	WritePart(part int, offset int64, data []byte) error
+
+	// Complete is called once all the parts have been written
+	Complete(parts int) error
+
+	// Abort is called instead of Complete if a part could not be written
+	Abort() error
+}
+
+// SourceProvider opens a source from a location (EG. "s3://bucket/key")
+type SourceProvider func(location string) (Source, error)
+
+// SinkProvider creates a sink for a location
+type SinkProvider func(location string) (Sink, error)
+
+// RetryPolicy the number of attempts of a failed operation on a source or
+// sink and the delay between attempts (doubled after each attempt up to
+// MaxDelay)
+type RetryPolicy struct {
+	Attempts int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy 3 attempts, waiting 100 ms then 200 ms
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Delay: 100 * time.Millisecond, MaxDelay: 2 * time.Second}
+
+var (
+	_SOURCE_PROVIDERS = map[string]SourceProvider{
+		"file":  func(location string) (Source, error) { return NewFileSource(location) },
+		"http":  func(location string) (Source, error) { return NewHTTPSource(location, nil) },
+		"https": func(location string) (Source, error) { return NewHTTPSource(location, nil) },
+	}
+
+	_SINK_PROVIDERS = map[string]SinkProvider{
+		"file": func(location string) (Sink, error) { return NewFileSink(location) },
+	}
+
+	_PROVIDERS_MUTEX sync.RWMutex
+)
+
+// Run the operation until it succeeds, returns io.EOF or the attempts are
+// exhausted
+func (this RetryPolicy) run(op func() error) error {
+	delay := this.Delay
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		if err = op(); err == nil || err == io.EOF || attempt >= this.Attempts {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+
+		if this.MaxDelay > 0 && delay > this.MaxDelay {
+			delay = this.MaxDelay
+		}
+	}
+}
+
+// RegisterSourceProvider makes a source provider available for the
+// locations with the provided scheme (EG. "s3"). Replaces the previous
+// provider of the scheme if any.
+func RegisterSourceProvider(scheme string, provider SourceProvider) error {
+	scheme = strings.ToLower(strings.TrimSpace(scheme))
+
+	if len(scheme) == 0 || provider == nil {
+		return NewIOError("Invalid source provider parameters", kanzi.ERR_INVALID_PARAM)
+	}
+
+	_PROVIDERS_MUTEX.Lock()
+	defer _PROVIDERS_MUTEX.Unlock()
+	_SOURCE_PROVIDERS[scheme] = provider
+	return nil
+}
+
+// RegisterSinkProvider makes a sink provider available for the locations
+// with the provided scheme (EG. "s3"). Replaces the previous provider of
+// the scheme if any.
+func RegisterSinkProvider(scheme string, provider SinkProvider) error {
+	scheme = strings.ToLower(strings.TrimSpace(scheme))
+
+	if len(scheme) == 0 || provider == nil {
+		return NewIOError("Invalid sink provider parameters", kanzi.ERR_INVALID_PARAM)
+	}
+
+	_PROVIDERS_MUTEX.Lock()
+	defer _PROVIDERS_MUTEX.Unlock()
+	_SINK_PROVIDERS[scheme] = provider
+	return nil
+}
+
+// Return the scheme of the location ("file" if none)
+func locationScheme(location string) string {
+	if idx := strings.Index(location, "://"); idx > 0 {
+		return strings.ToLower(location[0:idx])
+	}
+
+	return "file"
+}
+
+// OpenSource opens a source using the provider registered for the scheme
+// of the location. Locations without scheme are local files.
+func OpenSource(location string) (Source, error) {
+	scheme := locationScheme(location)
+	_PROVIDERS_MUTEX.RLock()
+	provider, exists := _SOURCE_PROVIDERS[scheme]
+	_PROVIDERS_MUTEX.RUnlock()
+
+	if exists == false {
+		return nil, NewIOError(fmt.Sprintf("No source provider for scheme '%s'", scheme), kanzi.ERR_OPEN_FILE)
+	}
+
+	if scheme == "file" {
+		location = strings.TrimPrefix(location, "file://")
+	}
+
+	return provider(location)
+}
+
+// CreateSink creates a sink using the provider registered for the scheme
+// of the location. Locations without scheme are local files.
+func CreateSink(location string) (Sink, error) {
+	scheme := locationScheme(location)
+	_PROVIDERS_MUTEX.RLock()
+	provider, exists := _SINK_PROVIDERS[scheme]
+	_PROVIDERS_MUTEX.RUnlock()
+
+	if exists == false {
+		return nil, NewIOError(fmt.Sprintf("No sink provider for scheme '%s'", scheme), kanzi.ERR_CREATE_FILE)
+	}
+
+	if scheme == "file" {
+		location = strings.TrimPrefix(location, "file://")
+	}
+
+	return provider(location)
+}
+
+// FileSource a source reading a local file
+type FileSource struct {
+	file *os.File
+}
+
+// NewFileSource creates a new instance of FileSource
+func NewFileSource(path string) (*FileSource, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_OPEN_FILE)
+	}
+
+	return &FileSource{file: f}, nil
+}
+
+// ReadAt reads len(p) bytes at offset off of the file
+func (this *FileSource) ReadAt(p []byte, off int64) (int, error) {
+	return this.file.ReadAt(p, off)
+}
+
+// Size returns the size of the file
+func (this *FileSource) Size() (int64, error) {
+	fi, err := this.file.Stat()
+
+	if err != nil {
+		return 0, err
+	}
+
+	return fi.Size(), nil
+}
+
+// Close closes the file
+func (this *FileSource) Close() error {
+	return this.file.Close()
+}
+
+// MemorySource a source reading a byte slice
+type MemorySource struct {
+	buf []byte
+}
+
+// NewMemorySource creates a new instance of MemorySource (the slice is not
+// copied)
+func NewMemorySource(buf []byte) *MemorySource {
+	return &MemorySource{buf: buf}
+}
+
+// ReadAt reads len(p) bytes at offset off of the slice
+func (this *MemorySource) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Invalid negative offset")
+	}
+
+	if off >= int64(len(this.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, this.buf[off:])
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Size returns the size of the slice
+func (this *MemorySource) Size() (int64, error) {
+	return int64(len(this.buf)), nil
+}
+
+// Close does nothing
+func (this *MemorySource) Close() error {
+	return nil
+}
+
+// HTTPSource a source reading a resource of a HTTP server with range
+// requests (the server must support 'Range' headers)
+type HTTPSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSource creates a new instance of HTTPSource. If the client is nil,
+// http.DefaultClient is used.
+func NewHTTPSource(url string, client *http.Client) (*HTTPSource, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &HTTPSource{url: url, client: client}, nil
+}
+
+// ReadAt reads len(p) bytes at offset off of the resource (one range request)
+func (this *HTTPSource) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, this.url, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := this.client.Do(req)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Expected answer
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+
+	default:
+		return 0, fmt.Errorf("Range request on %s failed: %s", this.url, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, p)
+
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// Size returns the size of the resource (HEAD request)
+func (this *HTTPSource) Size() (int64, error) {
+	resp, err := this.client.Head(this.url)
+
+	if err != nil {
+		return 0, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD request on %s failed: %s", this.url, resp.Status)
+	}
+
+	return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+}
+
+// Close does nothing
+func (this *HTTPSource) Close() error {
+	return nil
+}
+
+// FileSink a sink writing the parts to a local file (at their offset)
+type FileSink struct {
+	file *os.File
+}
+
+// NewFileSink creates a new instance of FileSink (the file is truncated)
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.Create(path)
+
+	if err != nil {
+		return nil, NewIOError(err.Error(), kanzi.ERR_CREATE_FILE)
+	}
+
+	return &FileSink{file: f}, nil
+}
+
+// WritePart writes the part at its offset of the file
+func (this *FileSink) WritePart(part int, offset int64, data []byte) error {
+	_, err := this.file.WriteAt(data, offset)
+	return err
+}
+
+// Complete closes the file
+func (this *FileSink) Complete(parts int) error {
+	return this.file.Close()
+}
+
+// Abort closes and removes the file
+func (this *FileSink) Abort() error {
+	this.file.Close()
+	return os.Remove(this.file.Name())
+}
+
+// MemorySink a sink collecting the parts in memory
+type MemorySink struct {
+	parts    map[int][]byte
+	mutex    sync.Mutex
+	data     []byte
+	complete bool
+}
+
+// NewMemorySink creates a new instance of MemorySink
+func NewMemorySink() *MemorySink {
+	return &MemorySink{parts: make(map[int][]byte)}
+}
+
+// WritePart stores a copy of the part
+func (this *MemorySink) WritePart(part int, offset int64, data []byte) error {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.parts[part] = buf
+	return nil
+}
+
+// Complete assembles the parts
+func (this *MemorySink) Complete(parts int) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if len(this.parts) != parts {
+		return fmt.Errorf("Missing parts: expected %d, got %d", parts, len(this.parts))
+	}
+
+	ids := make([]int, 0, len(this.parts))
+
+	for id := range this.parts {
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+	this.data = this.data[:0]
+
+	for _, id := range ids {
+		this.data = append(this.data, this.parts[id]...)
+	}
+
+	this.parts = make(map[int][]byte)
+	this.complete = true
+	return nil
+}
+
+// Abort drops the parts
+func (this *MemorySink) Abort() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.parts = make(map[int][]byte)
+	return nil
+}
+
+// Bytes returns the data once Complete has been called (nil before)
+func (this *MemorySink) Bytes() []byte {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.complete == false {
+		return nil
+	}
+
+	return this.data
+}
+
+// SourceReader an io.ReadCloser reading a source sequentially with ranged
+// reads of a fixed size (EG. to provide the input of a
+// CompressedInputStream). Failed reads are retried.
+type SourceReader struct {
+	source Source
+	retry  RetryPolicy
+	buffer []byte
+	start  int   // start of the unread data in the buffer
+	end    int   // end of the data in the buffer
+	offset int64 // offset of the next ranged read
+	eof    bool
+}
+
+// NewSourceReader creates a new instance of SourceReader reading chunks of
+// 'chunkSize' bytes
+func NewSourceReader(source Source, chunkSize int, retry RetryPolicy) (*SourceReader, error) {
+	if source == nil {
+		return nil, NewIOError("Invalid null source parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if chunkSize <= 0 {
+		return nil, NewIOError("Invalid chunk size parameter: must be positive", kanzi.ERR_INVALID_PARAM)
+	}
+
+	return &SourceReader{source: source, retry: retry, buffer: make([]byte, chunkSize)}, nil
+}
+
+// Read reads up to len(p) bytes from the source
+func (this *SourceReader) Read(p []byte) (int, error) {
+	if this.start == this.end {
+		if this.eof == true {
+			return 0, io.EOF
+		}
+
+		var n int
+
+		err := this.retry.run(func() error {
+			var err error
+			n, err = this.source.ReadAt(this.buffer, this.offset)
+			return err
+		})
+
+		if err == io.EOF {
+			this.eof = true
+		} else if err != nil {
+			return 0, NewIOError(err.Error(), kanzi.ERR_READ_FILE)
+		}
+
+		this.start, this.end = 0, n
+		this.offset += int64(n)
+
+		if n == 0 {
+			return 0, io.EOF
+		}
+	}
+
+	n := copy(p, this.buffer[this.start:this.end])
+	this.start += n
+	return n, nil
+}
+
+// Close closes the source
+func (this *SourceReader) Close() error {
+	return this.source.Close()
+}
+
+// SinkWriter an io.WriteCloser splitting the data in parts of a fixed size
+// written concurrently to a sink (EG. to receive the output of a
+// CompressedOutputStream). Failed parts are retried. If a part cannot be
+// written, the sink is aborted and the next calls return the error.
+type SinkWriter struct {
+	sink     Sink
+	retry    RetryPolicy
+	partSize int
+	buffer   []byte
+	parts    int
+	offset   int64
+	slots    chan bool // limits the number of concurrent uploads
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+	err      error
+	closed   bool
+}
+
+// NewSinkWriter creates a new instance of SinkWriter with parts of
+// 'partSize' bytes and at most 'concurrency' parts written at a time
+func NewSinkWriter(sink Sink, partSize, concurrency int, retry RetryPolicy) (*SinkWriter, error) {
+	if sink == nil {
+		return nil, NewIOError("Invalid null sink parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if partSize <= 0 {
+		return nil, NewIOError("Invalid part size parameter: must be positive", kanzi.ERR_INVALID_PARAM)
+	}
+
+	if concurrency <= 0 {
+		return nil, NewIOError("Invalid concurrency parameter: must be positive", kanzi.ERR_INVALID_PARAM)
+	}
+
+	this := &SinkWriter{sink: sink, retry: retry, partSize: partSize}
+	this.buffer = make([]byte, 0, partSize)
+	this.slots = make(chan bool, concurrency)
+	return this, nil
+}
+
+func (this *SinkWriter) getError() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.err
+}
+
+// Write buffers the data and starts the upload of each full part
+func (this *SinkWriter) Write(p []byte) (int, error) {
+	if this.closed == true {
+		return 0, NewIOError("Stream closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	if err := this.getError(); err != nil {
+		return 0, err
+	}
+
+	written := 0
+
+	for len(p) > 0 {
+		n := this.partSize - len(this.buffer)
+
+		if n > len(p) {
+			n = len(p)
+		}
+
+		this.buffer = append(this.buffer, p[0:n]...)
+		p = p[n:]
+		written += n
+
+		if len(this.buffer) == this.partSize {
+			this.flushPart()
+		}
+	}
+
+	return written, nil
+}
+
+// Start the upload of the buffered part
+func (this *SinkWriter) flushPart() {
+	this.parts++
+	part, offset, data := this.parts, this.offset, this.buffer
+	this.offset += int64(len(data))
+	this.buffer = make([]byte, 0, this.partSize)
+	this.slots <- true
+	this.wg.Add(1)
+
+	go func() {
+		defer func() {
+			<-this.slots
+			this.wg.Done()
+		}()
+
+		err := this.retry.run(func() error {
+			return this.sink.WritePart(part, offset, data)
+		})
+
+		if err != nil {
+			this.mutex.Lock()
+
+			if this.err == nil {
+				this.err = NewIOError(fmt.Sprintf("Cannot write part %d: %v", part, err), kanzi.ERR_WRITE_FILE)
+			}
+
+			this.mutex.Unlock()
+		}
+	}()
+}
+
+// Close writes the last part, waits for all the parts and completes the
+// sink (or aborts it if a part could not be written)
+func (this *SinkWriter) Close() error {
+	if this.closed == true {
+		return nil
+	}
+
+	this.closed = true
+
+	if len(this.buffer) > 0 || this.parts == 0 {
+		this.flushPart()
+	}
+
+	this.wg.Wait()
+
+	if err := this.getError(); err != nil {
+		this.sink.Abort()
+		return err
+	}
+
+	err := this.retry.run(func() error {
+		return this.sink.Complete(this.parts)
+	})
+
+	if err != nil {
+		return NewIOError(err.Error(), kanzi.ERR_WRITE_FILE)
+	}
+
+	return nil
+}
+
+// Written returns the number of bytes written so far
+func (this *SinkWriter) Written() int64 {
+	return this.offset + int64(len(this.buffer))
+}
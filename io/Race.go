@@ -0,0 +1,319 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/bitstream"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+const (
+	RACE_DEFAULT_BUDGET = 1.0 // the losing chains may use as much CPU as the winning ones
+
+	_RACE_PRIMARY   = 0
+	_RACE_ALTERNATE = 1
+)
+
+// RaceStats the statistics of the race between the transform chains of an
+// output stream
+type RaceStats struct {
+	Blocks        int64 // blocks encoded with both chains
+	PrimaryWins   int64 // raced blocks won by the primary chain
+	AlternateWins int64 // raced blocks won by the alternate chain
+	Unraced       int64 // blocks encoded with the last winner only (CPU budget exhausted)
+}
+
+// The parameters of a race between two transform chains
+type raceParams struct {
+	types  [2]uint64 // primary and alternate chains
+	split  uint      // number of transforms of the primary chain
+	budget float64   // max ratio of CPU time spent on the losing chains
+}
+
+// Parse the alternate chain and the CPU budget of a race (if any) in the
+// context map. Returns nil if there is no race.
+func parseRaceParams(ctx map[string]interface{}, primary uint64) (*raceParams, error) {
+	val, containsKey := ctx["raceTransform"]
+
+	if containsKey == false {
+		return nil, nil
+	}
+
+	res := &raceParams{budget: RACE_DEFAULT_BUDGET}
+	res.types[_RACE_PRIMARY] = primary
+	res.types[_RACE_ALTERNATE] = function.GetType(val.(string))
+	primaryTypes := function.GetTypes(primary)
+	alternateTypes := function.GetTypes(res.types[_RACE_ALTERNATE])
+
+	if primaryTypes[0] == function.NONE_TYPE || alternateTypes[0] == function.NONE_TYPE {
+		return nil, NewIOError("The raced transform chains must not be empty", kanzi.ERR_CREATE_STREAM)
+	}
+
+	if len(primaryTypes)+len(alternateTypes) > 8 {
+		errMsg := fmt.Sprintf("The raced transform chains must have at most 8 transforms in total, got %d",
+			len(primaryTypes)+len(alternateTypes))
+		return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+	}
+
+	if val, containsKey := ctx["raceBudget"]; containsKey {
+		res.budget = val.(float64)
+
+		if res.budget < 0 {
+			errMsg := fmt.Sprintf("The race budget must be positive, got %v", res.budget)
+			return nil, NewIOError(errMsg, kanzi.ERR_CREATE_STREAM)
+		}
+	}
+
+	res.split = uint(len(primaryTypes))
+	return res, nil
+}
+
+// Return the transform chain of the stream: the primary chain followed by
+// the alternate chain
+func (this *raceParams) transformType() uint64 {
+	return function.GetType(function.GetName(this.types[_RACE_PRIMARY]) + "+" +
+		function.GetName(this.types[_RACE_ALTERNATE]))
+}
+
+// transformRace runs the transform chains of a race for the blocks of an
+// output stream. The transform chain of the stream is the concatenation of
+// both chains: each block is transformed by one chain, the transforms of the
+// other chain are marked as skipped in the block header (so the decoder is
+// not aware of the race). Both chains are applied to a block (concurrently)
+// and the transformed block with the smallest entropy coded size wins, as
+// long as the CPU time spent on the losing chains stays below the budget
+// (ratio of the CPU time spent on the winning chains). Otherwise, the block
+// is transformed by the last winner only.
+type transformRace struct {
+	params    raceParams
+	mutex     sync.Mutex
+	baseTime  time.Duration // spent on the chains selected for the blocks
+	extraTime time.Duration // spent on the losing chains
+	last      int           // last winner
+	stats     RaceStats
+}
+
+type raceCandidate struct {
+	buffer    []byte
+	length    uint // size of the transformed block
+	skipFlags byte // skip flags of the stream transform chain
+	size      uint64
+	elapsed   time.Duration
+	err       error
+}
+
+// A writer discarding the entropy coded data (only the size matters)
+type discardWriter struct {
+}
+
+func (this discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (this discardWriter) Close() error {
+	return nil
+}
+
+func newTransformRace(params raceParams) *transformRace {
+	return &transformRace{params: params}
+}
+
+// Stats returns a snapshot of the statistics of the race
+func (this *transformRace) Stats() RaceStats {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.stats
+}
+
+// Return true if the budget allows a race for the next block and the chain
+// to apply otherwise
+func (this *transformRace) schedule() (bool, int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if float64(this.extraTime) <= this.params.budget*float64(this.baseTime) || this.stats.Blocks == 0 {
+		return true, this.last
+	}
+
+	this.stats.Unraced++
+	return false, this.last
+}
+
+// Return the skip flags of the stream transform chain given the skip flags
+// of the transform chain of the candidate
+func (this *transformRace) skipFlags(candidate int, flags byte) byte {
+	if candidate == _RACE_PRIMARY {
+		// The transforms of the alternate chain are already skipped
+		return flags
+	}
+
+	return byte(0xFF<<(8-this.params.split)) | (flags >> this.params.split)
+}
+
+// Apply the transform chain of the candidate to the block. If size is true,
+// the transformed block is also entropy coded to measure its size.
+func (this *transformRace) transform(candidate int, block, buffer []byte, ctx map[string]interface{},
+	entropyType uint32, size bool) (res raceCandidate) {
+	start := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			res.err = fmt.Errorf("%v", r)
+		}
+
+		res.elapsed = time.Since(start)
+	}()
+
+	ctx["size"] = uint(len(block))
+	t, err := function.NewByteFunction(&ctx, this.params.types[candidate])
+
+	if err != nil {
+		res.err = err
+		return
+	}
+
+	if requiredSize := t.MaxEncodedLen(len(block)); len(buffer) < requiredSize {
+		buffer = make([]byte, requiredSize)
+	}
+
+	// Ignore error, encode skip flags
+	_, res.length, _ = t.Forward(block, buffer)
+	res.buffer = buffer
+	res.skipFlags = this.skipFlags(candidate, t.SkipFlags())
+
+	if size == false {
+		return
+	}
+
+	obs, err := bitstream.NewDefaultOutputBitStream(discardWriter{}, 65536)
+
+	if err != nil {
+		res.err = err
+		return
+	}
+
+	ctx["size"] = res.length
+	ee, err := entropy.NewEntropyEncoder(obs, ctx, entropyType)
+
+	if err != nil {
+		res.err = err
+		return
+	}
+
+	if _, err = ee.Write(buffer[0:res.length]); err != nil {
+		res.err = err
+		return
+	}
+
+	ee.Dispose()
+	res.size = obs.Written()
+	return
+}
+
+// Transform the block with the winning chain (or the last winner if there is
+// no race for this block) into the output buffer. Returns the size of the
+// transformed block and the skip flags of the stream transform chain.
+func (this *transformRace) run(block []byte, output *blockBuffer, ctx map[string]interface{},
+	entropyType uint32, metrics metricsReporter) (uint, byte, error) {
+	race, candidate := this.schedule()
+
+	if race == false {
+		res := this.transform(candidate, block, output.Buf, copyCtx(ctx), entropyType, false)
+
+		if res.err != nil {
+			return 0, 0, res.err
+		}
+
+		output.Buf = res.buffer
+		this.mutex.Lock()
+		this.baseTime += res.elapsed
+		this.mutex.Unlock()
+		return res.length, res.skipFlags, nil
+	}
+
+	var results [2]raceCandidate
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	// Each chain gets its own copy of the context and its own buffer
+	go func() {
+		results[_RACE_ALTERNATE] = this.transform(_RACE_ALTERNATE, block, nil, copyCtx(ctx), entropyType, true)
+		wg.Done()
+	}()
+
+	results[_RACE_PRIMARY] = this.transform(_RACE_PRIMARY, block, output.Buf, copyCtx(ctx), entropyType, true)
+	wg.Wait()
+
+	for i := range results {
+		if results[i].err != nil {
+			return 0, 0, results[i].err
+		}
+	}
+
+	winner := _RACE_PRIMARY
+
+	if results[_RACE_ALTERNATE].size < results[_RACE_PRIMARY].size {
+		winner = _RACE_ALTERNATE
+	}
+
+	this.mutex.Lock()
+	this.baseTime += results[winner].elapsed
+	this.extraTime += results[1-winner].elapsed
+	this.last = winner
+	this.stats.Blocks++
+
+	if winner == _RACE_PRIMARY {
+		this.stats.PrimaryWins++
+	} else {
+		this.stats.AlternateWins++
+	}
+
+	this.mutex.Unlock()
+	metrics.add(METRIC_RACE_BLOCKS, 1)
+
+	if winner == _RACE_ALTERNATE {
+		metrics.add(METRIC_RACE_ALTERNATE_WINS, 1)
+	}
+
+	output.Buf = results[winner].buffer
+	return results[winner].length, results[winner].skipFlags, nil
+}
+
+func copyCtx(ctx map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(ctx))
+
+	for k, v := range ctx {
+		res[k] = v
+	}
+
+	return res
+}
+
+// RaceStats returns the statistics of the race between the transform chains
+// (all zeros if the stream has no 'raceTransform')
+func (this *CompressedOutputStream) RaceStats() RaceStats {
+	if this.race == nil {
+		return RaceStats{}
+	}
+
+	return this.race.Stats()
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+const (
+	RATIO_POLICY_NONE            = 0 // monitor only
+	RATIO_POLICY_SKIP_TRANSFORMS = 1 // faster: skip all transforms, keep entropy coding
+	RATIO_POLICY_STORE           = 2 // copy blocks without compression
+	RATIO_POLICY_ABORT           = 3 // fail the stream with an error
+)
+
+// RatioMonitor tracks the compression ratio (compressed size / original size)
+// of the last blocks written to a CompressedOutputStream and triggers a
+// policy when the selected percentile of the ratios exceeds the threshold.
+// A low percentile (EG. 10) triggers only when nearly all recent blocks
+// compress poorly. Once triggered, the policy applies to all the following
+// blocks of the stream.
+type RatioMonitor struct {
+	threshold  float64
+	percentile int
+	window     int
+	policy     int
+	ratios     []float64
+	index      int
+	blocks     int
+	triggered  bool
+	lock       sync.Mutex
+}
+
+// NewRatioMonitor creates a new instance of RatioMonitor.
+// threshold is a ratio in ]0..1], percentile in [0..100] and window is the
+// number of most recent blocks considered (the policy cannot be triggered
+// before 'window' blocks have been written).
+func NewRatioMonitor(threshold float64, percentile, window, policy int) (*RatioMonitor, error) {
+	if threshold <= 0 || threshold > 1 {
+		errMsg := fmt.Sprintf("Invalid ratio threshold: %v (must be in ]0..1])", threshold)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	if percentile < 0 || percentile > 100 {
+		errMsg := fmt.Sprintf("Invalid percentile: %d (must be in [0..100])", percentile)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	if window < 1 || window > 1024 {
+		errMsg := fmt.Sprintf("Invalid window: %d (must be in [1..1024])", window)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	if policy < RATIO_POLICY_NONE || policy > RATIO_POLICY_ABORT {
+		errMsg := fmt.Sprintf("Invalid ratio policy: %d", policy)
+		return nil, NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	this := &RatioMonitor{}
+	this.threshold = threshold
+	this.percentile = percentile
+	this.window = window
+	this.policy = policy
+	this.ratios = make([]float64, window)
+	return this, nil
+}
+
+// Update records the sizes of a block before and after compression.
+// Returns true if the policy has been triggered (by this or a previous block).
+func (this *RatioMonitor) Update(inSize, outSize int64) bool {
+	if inSize <= 0 {
+		return this.Triggered()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.ratios[this.index] = float64(outSize) / float64(inSize)
+	this.index = (this.index + 1) % this.window
+	this.blocks++
+
+	if this.triggered == false && this.blocks >= this.window {
+		this.triggered = this.computePercentile() > this.threshold
+	}
+
+	return this.triggered
+}
+
+func (this *RatioMonitor) computePercentile() float64 {
+	n := this.blocks
+
+	if n > this.window {
+		n = this.window
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	sorted := make([]float64, n)
+	copy(sorted, this.ratios[0:n])
+	sort.Float64s(sorted)
+	return sorted[this.percentile*(n-1)/100]
+}
+
+// Percentile returns the current value of the monitored percentile of the
+// ratios of the last blocks (0 if no block has been written yet)
+func (this *RatioMonitor) Percentile() float64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.computePercentile()
+}
+
+// Triggered returns true if the ratio went over the threshold
+func (this *RatioMonitor) Triggered() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.triggered
+}
+
+// Policy returns the policy applied once the monitor has been triggered
+func (this *RatioMonitor) Policy() int {
+	return this.policy
+}
+
+// Blocks returns the number of blocks recorded so far
+func (this *RatioMonitor) Blocks() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.blocks
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// ByteRange a range of the original data of a CompressedReader
+type ByteRange struct {
+	Offset int64 // offset of the range in the original data
+	Length int64 // size of the range
+}
+
+// ReadPlan the blocks to decode to serve a set of ranges of the original
+// data (see CompressedReader.Plan)
+type ReadPlan struct {
+	Ranges []ByteRange // requested ranges, in the order of the request
+	Blocks []int       // blocks overlapping the ranges, each block once, in stream order
+	Size   int64       // size of the compressed blocks to read (in bytes)
+}
+
+// Plan returns the minimal set of blocks to decode to serve the ranges of
+// the original data (in any order, possibly overlapping). The blocks are
+// sorted in stream order: the compressed data is read sequentially. Only the
+// pages of a packed index covering the ranges are read.
+func (this *CompressedReader) Plan(ranges []ByteRange) (*ReadPlan, error) {
+	if atomic.LoadInt32(&this.closed) == 1 {
+		return nil, NewIOError("Stream closed", kanzi.ERR_READ_FILE)
+	}
+
+	plan := &ReadPlan{Ranges: ranges, Blocks: make([]int, 0)}
+	blocks := make(map[int]bool)
+
+	for i, r := range ranges {
+		if err := this.checkRange(i, r); err != nil {
+			return nil, err
+		}
+
+		if r.Length == 0 {
+			continue
+		}
+
+		blk, err := this.index.find(r.Offset)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for ; blk < this.index.len(); blk++ {
+			e, err := this.index.entry(blk)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if e.Offset >= r.Offset+r.Length {
+				break
+			}
+
+			if blocks[blk] == false {
+				blocks[blk] = true
+				plan.Blocks = append(plan.Blocks, blk)
+			}
+		}
+	}
+
+	sort.Ints(plan.Blocks)
+
+	for _, blk := range plan.Blocks {
+		start, end, err := this.blockExtent(blk)
+
+		if err != nil {
+			return nil, err
+		}
+
+		plan.Size += end - start
+	}
+
+	return plan, nil
+}
+
+// Check that range 'i' is in the original data
+func (this *CompressedReader) checkRange(i int, r ByteRange) error {
+	if r.Offset < 0 || r.Length < 0 || r.Offset+r.Length > this.dataSize {
+		errMsg := fmt.Sprintf("Invalid range %d: [%d, %d[ (size of the data: %d)", i, r.Offset, r.Offset+r.Length, this.dataSize)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+	}
+
+	return nil
+}
+
+// Return the offsets of the first byte of block 'blk' and of the byte
+// following it in the compressed stream
+func (this *CompressedReader) blockExtent(blk int) (int64, int64, error) {
+	e, err := this.index.entry(blk)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end := this.index.start
+
+	if blk+1 < this.index.len() {
+		next, err := this.index.entry(blk + 1)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if pos := int64(next.BitOffset+7) >> 3; pos < end {
+			end = pos
+		}
+	}
+
+	return int64(e.BitOffset >> 3), end, nil
+}
+
+// ReadRanges decodes the blocks of the plan and calls 'fn' with the data of
+// the ranges, in order of offset (in the order of the request for the ranges
+// starting at the same offset). 'fn' is called with the index of the range
+// in plan.Ranges and a part of its data, once per block of the range, in
+// order: the data of a range is not buffered. The slice is only valid
+// during the call. The blocks are decoded concurrently in stream order
+// ('jobs' plus 'lookahead' blocks ahead of the block being delivered) and
+// released once the ranges overlapping them are delivered. Stops at the
+// first error (returned), EG. a damaged block or an error returned by 'fn'.
+func (this *CompressedReader) ReadRanges(plan *ReadPlan, fn func(rng int, data []byte) error) error {
+	if plan == nil || fn == nil {
+		return NewIOError("Invalid null plan or function parameter", kanzi.ERR_INVALID_PARAM)
+	}
+
+	order := make([]int, 0, len(plan.Ranges))
+
+	for i, r := range plan.Ranges {
+		if err := this.checkRange(i, r); err != nil {
+			return err
+		}
+
+		if r.Length > 0 {
+			order = append(order, i)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return plan.Ranges[order[i]].Offset < plan.Ranges[order[j]].Offset
+	})
+
+	window := len(this.buffers) + this.lookahead
+	decoding := make(map[int]*readerBlock, window)
+	next := 0 // next block of the plan to decode
+
+	defer func() {
+		// Wait for the blocks being decoded (the slots are shared)
+		for _, b := range decoding {
+			<-b.done
+		}
+	}()
+
+	for k, rng := range order {
+		r := plan.Ranges[rng]
+		blk, err := this.index.find(r.Offset)
+
+		if err != nil {
+			return err
+		}
+
+		for pos := r.Offset; pos < r.Offset+r.Length; blk++ {
+			idx := sort.SearchInts(plan.Blocks, blk)
+
+			if idx == len(plan.Blocks) || plan.Blocks[idx] != blk {
+				errMsg := fmt.Sprintf("Invalid plan: block %d of range %d is missing", blk, rng)
+				return NewIOError(errMsg, kanzi.ERR_INVALID_PARAM)
+			}
+
+			// Decode the blocks of the window in stream order
+			for ; next < len(plan.Blocks) && next <= idx+window; next++ {
+				if err = this.decodeAsync(decoding, plan.Blocks[next]); err != nil {
+					return err
+				}
+			}
+
+			if err = this.decodeAsync(decoding, blk); err != nil {
+				return err
+			}
+
+			e, err := this.index.entry(blk)
+
+			if err != nil {
+				return err
+			}
+
+			b := decoding[blk]
+			<-b.done
+
+			if b.err != nil {
+				return b.err
+			}
+
+			end := e.Offset + int64(e.Length)
+
+			if end > r.Offset+r.Length {
+				end = r.Offset + r.Length
+			}
+
+			if err = fn(rng, b.data[pos-e.Offset:end-e.Offset]); err != nil {
+				return err
+			}
+
+			pos = end
+		}
+
+		// The following ranges start at or after the next range
+		if k+1 < len(order) {
+			start := plan.Ranges[order[k+1]].Offset
+
+			for i, b := range decoding {
+				e, err := this.index.entry(i)
+
+				if err != nil {
+					return err
+				}
+
+				if e.Offset+int64(e.Length) <= start {
+					<-b.done
+					delete(decoding, i)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Start decoding block 'blk' of a plan (unless it is in 'decoding'). The
+// block is shared with the reader if it is decoded or being decoded, not
+// cached otherwise.
+func (this *CompressedReader) decodeAsync(decoding map[int]*readerBlock, blk int) error {
+	if _, ok := decoding[blk]; ok == true {
+		return nil
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.blocks == nil {
+		return NewIOError("Stream closed", kanzi.ERR_READ_FILE)
+	}
+
+	if b, ok := this.blocks[blk]; ok == true {
+		decoding[blk] = b
+		return nil
+	}
+
+	b := &readerBlock{done: make(chan bool)}
+	this.start(blk, b)
+	decoding[blk] = b
+	return nil
+}
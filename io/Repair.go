@@ -0,0 +1,172 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// RepairReport the result of the repair of a compressed stream
+type RepairReport struct {
+	Blocks       int    // number of intact blocks copied to the repaired stream
+	Bytes        int64  // number of decompressed bytes in the repaired stream
+	Verified     bool   // true if the blocks were verified with their checksum
+	Damaged      bool   // true if a damaged block was found
+	DamagedBlock int    // id of the first damaged block (0 if none)
+	Reason       string // error found in the first damaged block
+}
+
+// String returns a human readable report
+func (this RepairReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Intact blocks: %d (%d bytes)\n", this.Blocks, this.Bytes)
+	fmt.Fprintf(&sb, "Blocks verified with checksums: %v\n", this.Verified)
+
+	if this.Damaged == false {
+		sb.WriteString("No damage found\n")
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "First damaged block: %d (%s)\n", this.DamagedBlock, this.Reason)
+	sb.WriteString("The damaged block and the following blocks were dropped\n")
+	return sb.String()
+}
+
+// Repair copies the intact blocks of a damaged compressed stream to a new
+// valid compressed stream (same entropy codec, transforms, block size and
+// checksum option as the original). The blocks are decoded in order and
+// verified with their checksum (if present) until the first damaged block.
+// The damaged blocks with parity shards are repaired if possible. The
+// bitstream has no block index: the block boundaries after a damaged block
+// cannot be found and the tail of the stream is lost.
+// Returns an error (and no report) if the header of the stream is invalid.
+func Repair(archive io.ReadCloser, output io.WriteCloser) (report *RepairReport, err error) {
+	is, err := NewCompressedInputStream(archive, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &RepairReport{}
+
+	// Blocks are decoded sequentially with 1 job: count the verified blocks
+	is.SetHook(kanzi.EVT_AFTER_TRANSFORM, func(info BlockInfo, block []byte) error {
+		res.Blocks = info.ID
+		res.Bytes += int64(len(block))
+		return nil
+	})
+
+	if err = readRepairHeader(is); err != nil {
+		return nil, err
+	}
+
+	res.Verified = is.hasher != nil
+	ctx := map[string]interface{}{
+		"codec":     entropy.GetName(is.entropyType),
+		"transform": function.GetName(is.transformType),
+		"blockSize": is.blockSize,
+		"jobs":      uint(1),
+		"checksum":  is.hasher != nil,
+	}
+
+	// The digest covers the repaired data
+	if is.hasher != nil {
+		ctx["checksumType"] = is.hasher.name()
+	}
+
+	if is.dataDigest != nil {
+		ctx["streamDigest"] = true
+	}
+
+	if is.parity != nil {
+		ctx["parityShards"] = uint(is.parity.parityShards)
+	}
+
+	if is.dictionaries != nil {
+		is.dictionaries.setParams(ctx)
+	}
+
+	os, err := NewCompressedOutputStreamWithCtx(output, ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, is.blockSize)
+
+	for {
+		n, rerr := readRepairBlock(is, buf)
+
+		if n > 0 {
+			if _, err = os.Write(buf[0:n]); err != nil {
+				return nil, err
+			}
+		}
+
+		if rerr != nil {
+			res.Damaged = true
+			res.DamagedBlock = res.Blocks + 1
+			res.Reason = rerr.Error()
+			break
+		}
+
+		if n == 0 {
+			break
+		}
+	}
+
+	if res.Damaged == false {
+		// The end of the stream must also be readable
+		is.Close()
+	}
+
+	if err = os.Close(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Read the header of the stream (which panics on a bitstream read error)
+func readRepairHeader(is *CompressedInputStream) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewIOError(fmt.Sprintf("%v", r), kanzi.ERR_READ_FILE)
+		}
+	}()
+
+	atomic.StoreInt32(&is.initialized, 1)
+	return is.readHeader()
+}
+
+// Read decoded data, the damaged blocks may panic
+func readRepairBlock(is *CompressedInputStream, buf []byte) (n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			n = 0
+			err = NewIOError(fmt.Sprintf("%v", r), kanzi.ERR_PROCESS_BLOCK)
+		}
+	}()
+
+	return is.Read(buf)
+}
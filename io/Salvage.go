@@ -0,0 +1,168 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/bitstream"
+)
+
+// LostRange a range of a damaged stream that a CompressedReader in salvage
+// mode (context key 'salvage') could not decode
+type LostRange struct {
+	Start  int64 // offset of the damaged data in the compressed stream
+	End    int64 // offset of the next decodable data in the compressed stream (or size of the stream)
+	Offset int64 // offset of the missing data in the data of the reader
+	Length int64 // size of the missing data, -1 if unknown (damaged or missing index)
+}
+
+// Lost returns the ranges of the stream that could not be decoded (in stream
+// order, empty if the stream is intact or if the reader is not in salvage
+// mode). With a valid block index, the damaged blocks read as zeros: the
+// offsets of the data are preserved. Without index, the data of the reader
+// is made of the intact blocks: the missing data is dropped at Offset.
+func (this *CompressedReader) Lost() []LostRange {
+	return this.lost
+}
+
+// Add a lost range, merged with the previous one if contiguous
+func (this *CompressedReader) addLost(r LostRange) {
+	if n := len(this.lost); n > 0 {
+		last := &this.lost[n-1]
+
+		if last.End == r.Start && (last.Length < 0) == (r.Length < 0) &&
+			(r.Length < 0 || last.Offset+last.Length == r.Offset) {
+			last.End = r.End
+
+			if r.Length >= 0 {
+				last.Length += r.Length
+			}
+
+			return
+		}
+	}
+
+	this.lost = append(this.lost, r)
+}
+
+// Decode each block of the index once. The damaged blocks read as zeros.
+func (this *CompressedReader) checkBlocks() {
+	for blk, e := range this.index.entries {
+		if _, err := this.block(blk); err == nil {
+			continue
+		}
+
+		end := this.index.start
+
+		if blk+1 < len(this.index.entries) {
+			end = int64(this.index.entries[blk+1].BitOffset >> 3)
+		}
+
+		this.mutex.Lock()
+
+		if this.damaged == nil {
+			this.damaged = make(map[int]bool)
+		}
+
+		this.damaged[blk] = true
+		this.mutex.Unlock()
+		this.addLost(LostRange{Start: int64(e.BitOffset >> 3), End: end, Offset: e.Offset, Length: int64(e.Length)})
+	}
+}
+
+// Find the blocks of a stream without (valid) index by decoding the blocks
+// following the header. The decoding resumes after the sync marker following
+// a damaged block (if the stream has sync points). The end of the stream is
+// lost otherwise.
+func (this *CompressedReader) rebuildIndex() error {
+	ibs := this.header.ibs
+	base := int64(0) // offset of ibs in the stream
+	offset := int64(0)
+
+	for {
+		pos := base<<3 + int64(ibs.Read())
+		res, err := this.decodeBlock(ibs, len(this.index.entries), 0)
+
+		if err == nil {
+			if res.sync == true {
+				continue
+			}
+
+			// End block
+			if res.decoded == 0 {
+				break
+			}
+
+			this.index.entries = append(this.index.entries, IndexEntry{BitOffset: uint64(pos), Offset: offset,
+				Length: res.decoded, Checksum: res.checksum})
+			offset += int64(res.decoded)
+			continue
+		}
+
+		start := pos >> 3
+		end := this.size
+
+		if this.header.syncPoints == true {
+			end = this.findSyncMarker(start + 1)
+		}
+
+		this.addLost(LostRange{Start: start, End: end, Offset: offset, Length: -1})
+
+		if end >= this.size {
+			break
+		}
+
+		base = end
+		sr := io.NewSectionReader(this.src, end, this.size-end)
+
+		if ibs, err = bitstream.NewDefaultInputBitStream(ioutil.NopCloser(sr), _STREAM_DEFAULT_BUFFER_SIZE); err != nil {
+			return NewIOError(err.Error(), kanzi.ERR_CREATE_BITSTREAM)
+		}
+	}
+
+	this.index.dataSize = offset
+	return nil
+}
+
+// Return the offset following the first sync magic at or after 'from' (the
+// size of the stream if there is none)
+func (this *CompressedReader) findSyncMarker(from int64) int64 {
+	var magic [4]byte
+	binary.BigEndian.PutUint32(magic[:], SYNC_MAGIC)
+	buf := make([]byte, 64*1024)
+
+	for from+int64(len(magic)) <= this.size {
+		n, err := this.src.ReadAt(buf, from)
+
+		if idx := bytes.Index(buf[0:n], magic[:]); idx >= 0 {
+			return from + int64(idx+len(magic))
+		}
+
+		if err != nil || n < len(magic) {
+			break
+		}
+
+		// The magic may straddle two reads
+		from += int64(n - len(magic) + 1)
+	}
+
+	return this.size
+}
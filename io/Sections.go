@@ -0,0 +1,408 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// Self-describing stream header (context key 'headerSections', see
+// SECTION_TRANSFORMS for the layout). The transform chain and the entropy
+// codec are described by sections made of stages with extensible ids and
+// parameters. A decoder skips the optional sections it does not know and
+// rejects the critical ones.
+
+// HeaderSection a section of the stream header (version 10)
+type HeaderSection struct {
+	ID       uint8
+	Critical bool // the decoder must know the section to decode the stream
+	Data     []byte
+}
+
+// HeaderStage a stage of the blocks (transform or entropy codec) described
+// by a section
+type HeaderStage struct {
+	ID     uint16 // TransformID or EntropyID
+	Params []StageParam
+}
+
+// StageParam a parameter of a stage
+type StageParam struct {
+	ID       uint8 // see STAGE_PARAM_DICTIONARY
+	Critical bool  // the decoder must know the parameter to decode the stream
+	Value    []byte
+}
+
+// Return the sections describing the stages of the blocks
+func newHeaderSections(transformType uint64, entropyType uint32, features uint8,
+	dictionaries *streamDictionaries) []HeaderSection {
+	stages := make([]HeaderStage, 0, MAX_TRANSFORMS)
+
+	for _, t := range SplitTransformField(transformType) {
+		stage := HeaderStage{ID: uint16(t)}
+
+		if id, ok := dictionaries.stageDictionary(uint64(t)); ok == true {
+			value := make([]byte, 4)
+			binary.BigEndian.PutUint32(value, id)
+			stage.Params = append(stage.Params, StageParam{ID: STAGE_PARAM_DICTIONARY, Critical: true, Value: value})
+		}
+
+		stages = append(stages, stage)
+	}
+
+	codec := HeaderStage{ID: uint16(entropyType)}
+
+	if features != 0 {
+		codec.Params = append(codec.Params, StageParam{ID: STAGE_PARAM_FEATURES, Critical: true, Value: []byte{features}})
+	}
+
+	return []HeaderSection{
+		{ID: SECTION_TRANSFORMS, Critical: true, Data: encodeHeaderStages(stages)},
+		{ID: SECTION_ENTROPY, Critical: true, Data: encodeHeaderStages([]HeaderStage{codec})},
+	}
+}
+
+// Return the id of the preset dictionary used by a transform (false if none)
+func (this *streamDictionaries) stageDictionary(transformType uint64) (uint32, bool) {
+	if this == nil {
+		return 0, false
+	}
+
+	if transformType == function.LZ_TYPE && this.lz != nil {
+		return this.lz.ID(), true
+	}
+
+	if transformType == function.DICT_TYPE && this.text != nil {
+		return this.text.ID(), true
+	}
+
+	return 0, false
+}
+
+// Block features of the entropy codec in a stage parameter
+func entropyFeatures(entropyOptions, entropyLanes bool) uint8 {
+	res := uint8(0)
+
+	if entropyOptions == true {
+		res |= 1
+	}
+
+	if entropyLanes == true {
+		res |= 2
+	}
+
+	return res
+}
+
+func encodeHeaderStages(stages []HeaderStage) []byte {
+	res := []byte{byte(len(stages))}
+
+	for _, stage := range stages {
+		res = append(res, byte(stage.ID>>8), byte(stage.ID), byte(len(stage.Params)))
+
+		for _, p := range stage.Params {
+			id := p.ID
+
+			if p.Critical == true {
+				id |= STAGE_PARAM_CRITICAL
+			}
+
+			res = append(res, id, byte(len(p.Value)))
+			res = append(res, p.Value...)
+		}
+	}
+
+	return res
+}
+
+// ParseHeaderStages decodes the stages of a SECTION_TRANSFORMS or
+// SECTION_ENTROPY section
+func ParseHeaderStages(data []byte) ([]HeaderStage, error) {
+	res, err := parseHeaderStages(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+func parseHeaderStages(data []byte) ([]HeaderStage, *IOError) {
+	truncated := NewIOError("Invalid bitstream, truncated header stages", kanzi.ERR_INVALID_FILE)
+
+	if len(data) == 0 {
+		return nil, truncated
+	}
+
+	res := make([]HeaderStage, int(data[0]))
+	data = data[1:]
+
+	for i := range res {
+		if len(data) < 3 {
+			return nil, truncated
+		}
+
+		res[i].ID = binary.BigEndian.Uint16(data)
+		res[i].Params = make([]StageParam, int(data[2]))
+		data = data[3:]
+
+		for j := range res[i].Params {
+			if len(data) < 2 || len(data) < 2+int(data[1]) {
+				return nil, truncated
+			}
+
+			p := &res[i].Params[j]
+			p.ID = data[0] &^ STAGE_PARAM_CRITICAL
+			p.Critical = data[0]&STAGE_PARAM_CRITICAL != 0
+			p.Value = data[2 : 2+int(data[1])]
+			data = data[2+int(data[1]):]
+		}
+	}
+
+	if len(data) != 0 {
+		return nil, NewIOError("Invalid bitstream, unexpected data after the header stages", kanzi.ERR_INVALID_FILE)
+	}
+
+	return res, nil
+}
+
+// Size in bits of the sections in the stream header (end marker included)
+func headerSectionsBits(sections []HeaderSection) uint {
+	res := uint(SECTION_ID_BITS)
+
+	for _, s := range sections {
+		res += SECTION_ID_BITS + SECTION_FLAGS_BITS + SECTION_LENGTH_BITS + 8*uint(len(s.Data))
+	}
+
+	return res
+}
+
+func writeHeaderSections(obs kanzi.OutputBitStream, sections []HeaderSection) *IOError {
+	for _, s := range sections {
+		flags := uint64(0)
+
+		if s.Critical == true {
+			flags = SECTION_CRITICAL
+		}
+
+		obs.WriteBits(uint64(s.ID), SECTION_ID_BITS)
+		obs.WriteBits(flags, SECTION_FLAGS_BITS)
+
+		if obs.WriteBits(uint64(len(s.Data)), SECTION_LENGTH_BITS) != SECTION_LENGTH_BITS {
+			return NewIOError("Cannot write sections to header", kanzi.ERR_WRITE_FILE)
+		}
+
+		if obs.WriteArray(s.Data, 8*uint(len(s.Data))) != 8*uint(len(s.Data)) {
+			return NewIOError("Cannot write sections to header", kanzi.ERR_WRITE_FILE)
+		}
+	}
+
+	if obs.WriteBits(SECTION_END, SECTION_ID_BITS) != SECTION_ID_BITS {
+		return NewIOError("Cannot write sections to header", kanzi.ERR_WRITE_FILE)
+	}
+
+	return nil
+}
+
+// Read the sections of the stream header (end marker included)
+func readHeaderSections(ibs kanzi.InputBitStream) ([]HeaderSection, *IOError) {
+	res := make([]HeaderSection, 0, 2)
+
+	for {
+		id := uint8(ibs.ReadBits(SECTION_ID_BITS))
+
+		if id == SECTION_END {
+			return res, nil
+		}
+
+		if len(res) == SECTION_MAX_COUNT {
+			return nil, NewIOError("Invalid bitstream, too many header sections", kanzi.ERR_INVALID_FILE)
+		}
+
+		flags := ibs.ReadBits(SECTION_FLAGS_BITS)
+
+		if flags&^SECTION_CRITICAL != 0 {
+			errMsg := fmt.Sprintf("Invalid bitstream, unknown flags of header section %d: %#x", id, flags)
+			return nil, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		data := make([]byte, ibs.ReadBits(SECTION_LENGTH_BITS))
+		ibs.ReadArray(data, 8*uint(len(data)))
+		res = append(res, HeaderSection{ID: id, Critical: flags == SECTION_CRITICAL, Data: data})
+	}
+}
+
+// ParseHeaderSections decodes the sections of a version 10 stream header
+// starting at buf[0] (after the extended header and the dictionaries).
+// Returns the sections and the number of bytes read (end marker included).
+func ParseHeaderSections(buf []byte) ([]HeaderSection, int, error) {
+	res := make([]HeaderSection, 0, 2)
+	n := 0
+
+	for {
+		if n >= len(buf) {
+			return nil, n, NewIOError("Invalid bitstream, truncated header sections", kanzi.ERR_INVALID_FILE)
+		}
+
+		id := buf[n]
+		n++
+
+		if id == SECTION_END {
+			return res, n, nil
+		}
+
+		if len(res) == SECTION_MAX_COUNT {
+			return nil, n, NewIOError("Invalid bitstream, too many header sections", kanzi.ERR_INVALID_FILE)
+		}
+
+		if n+4 > len(buf) {
+			return nil, n, NewIOError("Invalid bitstream, truncated header sections", kanzi.ERR_INVALID_FILE)
+		}
+
+		flags := buf[n]
+		length := int(binary.BigEndian.Uint32(buf[n:n+4]) & 0xFFFFFF)
+		n += 4
+
+		if flags&^SECTION_CRITICAL != 0 {
+			errMsg := fmt.Sprintf("Invalid bitstream, unknown flags of header section %d: %#x", id, flags)
+			return nil, n, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		if n+length > len(buf) {
+			return nil, n, NewIOError("Invalid bitstream, truncated header sections", kanzi.ERR_INVALID_FILE)
+		}
+
+		res = append(res, HeaderSection{ID: id, Critical: flags == SECTION_CRITICAL, Data: buf[n : n+length]})
+		n += length
+	}
+}
+
+// Check the sections read in the stream header against the fixed fields.
+// The unknown optional sections and parameters are skipped.
+func checkHeaderSections(sections []HeaderSection, transformType uint64, entropyType uint32, features uint8,
+	dictionaries *streamDictionaries) *IOError {
+	seen := make(map[uint8]bool, len(sections))
+
+	for _, s := range sections {
+		if seen[s.ID] == true {
+			errMsg := fmt.Sprintf("Invalid bitstream, duplicate header section %d", s.ID)
+			return NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+		}
+
+		seen[s.ID] = true
+
+		switch s.ID {
+		case SECTION_TRANSFORMS:
+			stages, err := parseHeaderStages(s.Data)
+
+			if err != nil {
+				return err
+			}
+
+			transforms := SplitTransformField(transformType)
+
+			if len(stages) > MAX_TRANSFORMS {
+				return NewIOError("Invalid bitstream, too many transforms in the header section", kanzi.ERR_INVALID_FILE)
+			}
+
+			for i, stage := range stages {
+				id := TransformID(stage.ID)
+
+				if stage.ID >= 1<<TRANSFORM_ID_BITS || id.IsValid() == false {
+					errMsg := fmt.Sprintf("Unsupported transform in the stream header: %d (a newer decoder is required)", stage.ID)
+					return NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+				}
+
+				if i >= len(transforms) || transforms[i] != id {
+					return NewIOError("Invalid bitstream, the transform section does not match the header", kanzi.ERR_INVALID_FILE)
+				}
+
+				expected := make(map[uint8][]byte, 1)
+
+				if dictID, ok := dictionaries.stageDictionary(uint64(id)); ok == true {
+					expected[STAGE_PARAM_DICTIONARY] = make([]byte, 4)
+					binary.BigEndian.PutUint32(expected[STAGE_PARAM_DICTIONARY], dictID)
+				}
+
+				if err := checkStageParams(id.String(), stage.Params, expected); err != nil {
+					return err
+				}
+			}
+
+			if len(stages) != len(transforms) {
+				return NewIOError("Invalid bitstream, the transform section does not match the header", kanzi.ERR_INVALID_FILE)
+			}
+
+		case SECTION_ENTROPY:
+			stages, err := parseHeaderStages(s.Data)
+
+			if err != nil {
+				return err
+			}
+
+			if len(stages) != 1 {
+				return NewIOError("Invalid bitstream, the entropy section must have one stage", kanzi.ERR_INVALID_FILE)
+			}
+
+			id := EntropyID(stages[0].ID)
+
+			if stages[0].ID >= 1<<HEADER_ENTROPY_BITS || id.IsValid() == false {
+				errMsg := fmt.Sprintf("Unsupported entropy codec in the stream header: %d (a newer decoder is required)", stages[0].ID)
+				return NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+			}
+
+			if uint32(id) != entropyType {
+				return NewIOError("Invalid bitstream, the entropy section does not match the header", kanzi.ERR_INVALID_FILE)
+			}
+
+			expected := map[uint8][]byte{STAGE_PARAM_FEATURES: []byte{features}}
+
+			if err := checkStageParams(id.String(), stages[0].Params, expected); err != nil {
+				return err
+			}
+
+		default:
+			if s.Critical == true {
+				errMsg := fmt.Sprintf("Unsupported header section: %d (a newer decoder is required)", s.ID)
+				return NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Check the parameters of a stage against the expected values (by id)
+func checkStageParams(name string, params []StageParam, expected map[uint8][]byte) *IOError {
+	for _, p := range params {
+		if value, ok := expected[p.ID]; ok == true {
+			if bytes.Equal(value, p.Value) == false {
+				errMsg := fmt.Sprintf("Invalid bitstream, parameter %d of stage %s does not match the header", p.ID, name)
+				return NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+			}
+		} else if p.Critical == true {
+			errMsg := fmt.Sprintf("Unsupported parameter %d of stage %s (a newer decoder is required)", p.ID, name)
+			return NewIOError(errMsg, kanzi.ERR_STREAM_VERSION)
+		}
+	}
+
+	return nil
+}
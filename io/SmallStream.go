@@ -0,0 +1,194 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// Small streams (see SMALL_STREAM_MAGIC): the data written at once before
+// Close, if small enough, is written as a single block after a header of a
+// few bytes, without end block. The header of a regular stream (and its end
+// block) would dominate the size of a short message.
+
+// Return true if the buffered data can be written as a small stream: the
+// features stored in the header of a regular stream are not supported.
+func (this *CompressedOutputStream) smallEligible() bool {
+	if this.curIdx == 0 || uint(this.curIdx) > this.smallSize || uint(this.curIdx) > this.blockSize {
+		return false
+	}
+
+	if this.hasher != nil && this.hasher.kind != CHECKSUM_TYPE_XXHASH32 {
+		return false
+	}
+
+	if this.dataDigest != nil || this.parity != nil || this.dictionaries != nil || this.syncPoints == true ||
+		this.sections == true || this.index != nil || this.race != nil || this.tpaqModel != nil {
+		return false
+	}
+
+	return entropy.HasEntropyOptions(this.ctx, this.entropyType) == false &&
+		entropy.HasEntropyLanes(this.ctx, this.entropyType) == false
+}
+
+func (this *CompressedOutputStream) writeSmallHeader() *IOError {
+	cksum := uint64(0)
+
+	if this.hasher != nil {
+		cksum = 1
+	}
+
+	transforms := SplitTransformField(this.transformType)
+	this.obs.WriteBits(SMALL_STREAM_MAGIC, SMALL_HEADER_MAGIC_BITS)
+	this.obs.WriteBits(cksum, HEADER_CHECKSUM_BITS)
+	this.obs.WriteBits(uint64(this.entropyType), HEADER_ENTROPY_BITS)
+
+	if this.obs.WriteBits(uint64(len(transforms)), SMALL_HEADER_TRANSFORMS_BITS) != SMALL_HEADER_TRANSFORMS_BITS {
+		return NewIOError("Cannot write small stream header", kanzi.ERR_WRITE_FILE)
+	}
+
+	for _, t := range transforms {
+		if this.obs.WriteBits(uint64(t), TRANSFORM_ID_BITS) != TRANSFORM_ID_BITS {
+			return NewIOError("Cannot write small stream header", kanzi.ERR_WRITE_FILE)
+		}
+	}
+
+	return nil
+}
+
+// Read the first bits of a stream header: the magic of a small stream
+// (16 bits) or of a regular stream (32 bits)
+func readStreamMagic(ibs kanzi.InputBitStream) uint64 {
+	magic := ibs.ReadBits(SMALL_HEADER_MAGIC_BITS)
+
+	if magic == SMALL_STREAM_MAGIC {
+		return magic
+	}
+
+	return magic<<(HEADER_MAGIC_BITS-SMALL_HEADER_MAGIC_BITS) | ibs.ReadBits(HEADER_MAGIC_BITS-SMALL_HEADER_MAGIC_BITS)
+}
+
+// Read the fields of a small stream header after the magic
+func (this *CompressedInputStream) readSmallHeaderFields() error {
+	cksum := this.ibs.ReadBit()
+	this.entropyType = uint32(this.ibs.ReadBits(HEADER_ENTROPY_BITS))
+	this.ctx["codec"] = entropy.GetName(this.entropyType)
+	this.ctx["extra"] = this.entropyType == entropy.TPAQX_TYPE
+	nbTransforms := int(this.ibs.ReadBits(SMALL_HEADER_TRANSFORMS_BITS))
+
+	if nbTransforms > MAX_TRANSFORMS {
+		errMsg := fmt.Sprintf("Invalid bitstream, incorrect number of transforms: %d", nbTransforms)
+		return NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	this.transformType = 0
+
+	for i := 0; i < nbTransforms; i++ {
+		t := this.ibs.ReadBits(TRANSFORM_ID_BITS)
+		this.transformType |= t << uint(TRANSFORM_ID_BITS*(MAX_TRANSFORMS-1-i))
+	}
+
+	this.ctx["transform"] = function.GetName(this.transformType)
+	this.blockSize = SMALL_STREAM_BLOCK_SIZE
+	this.ctx["blockSize"] = this.blockSize
+	this.nbInputBlocks = 1
+	this.headers.compact = false
+
+	// No entropy options, lanes or features of the extended header
+	delete(this.ctx, "tpaq:extra")
+	delete(this.ctx, "tpaq:mix2")
+	delete(this.ctx, "tpaq:warm")
+	delete(this.ctx, "tpaqModels")
+	delete(this.ctx, "cm:order2")
+	delete(this.ctx, "entropy:lanes")
+
+	if this.tpaqModel != nil {
+		// Previous stream (concatenated streams)
+		this.tpaqModel.Release()
+		this.tpaqModel = nil
+	}
+
+	this.dataDigest = nil
+	this.parity = nil
+	this.dictionaries = nil
+	this.syncPoints = false
+	this.sections = false
+	this.small = true
+	this.hasher = nil
+
+	if cksum == 1 {
+		this.hasher, _ = newBlockHasher(CHECKSUM_TYPE_XXHASH32)
+	}
+
+	this.streams++
+
+	if len(this.listeners) > 0 {
+		msg := "Small stream (single block)\n"
+		msg += fmt.Sprintf("Checksum set to %v\n", this.hasher != nil)
+		msg += fmt.Sprintf("Using %v entropy codec (stage 1)\n", entropy.GetName(this.entropyType))
+		msg += fmt.Sprintf("Using %v transform (stage 2)\n", function.GetName(this.transformType))
+		evt := kanzi.NewEventFromString(kanzi.EVT_AFTER_HEADER_DECODING, 0, msg, time.Now())
+		notifyListeners(this.listeners, evt)
+	}
+
+	return nil
+}
+
+// Decode the header of a small stream (see ParseStreamHeader)
+func parseSmallStreamHeader(buf []byte) (*StreamHeader, error) {
+	var fields [8]byte
+	copy(fields[:], buf[SMALL_HEADER_MAGIC_BITS/8:])
+	v := binary.BigEndian.Uint64(fields[:])
+	res := &StreamHeader{Magic: SMALL_STREAM_MAGIC, Small: true, BlockSize: SMALL_STREAM_BLOCK_SIZE, NbBlocks: 1}
+	res.Checksum = v>>63 == 1
+	res.Entropy = EntropyID(v>>58) & 0x1F
+	nbTransforms := int(v>>54) & 0x0F
+	res.Transforms = make([]TransformID, 0, MAX_TRANSFORMS)
+
+	if nbTransforms > MAX_TRANSFORMS {
+		errMsg := fmt.Sprintf("Invalid small stream header, incorrect number of transforms: %d", nbTransforms)
+		return res, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	if bits := SMALL_HEADER_MAGIC_BITS + 10 + TRANSFORM_ID_BITS*nbTransforms; 8*len(buf) < bits {
+		errMsg := fmt.Sprintf("Small stream header too small: %d bytes, expected %d", len(buf), (bits+7)/8)
+		return res, NewIOError(errMsg, kanzi.ERR_INVALID_FILE)
+	}
+
+	for i := 0; i < nbTransforms; i++ {
+		res.Transforms = append(res.Transforms, TransformID(v>>uint(48-TRANSFORM_ID_BITS*i))&0x3F)
+	}
+
+	return res, res.checkIDs()
+}
+
+// Return true if the stream starts with the magic of a small stream
+func isSmallStream(src io.ReaderAt) bool {
+	var magic [SMALL_HEADER_MAGIC_BITS / 8]byte
+
+	if _, err := src.ReadAt(magic[:], 0); err != nil {
+		return false
+	}
+
+	return binary.BigEndian.Uint16(magic[:]) == SMALL_STREAM_MAGIC
+}
@@ -0,0 +1,434 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"fmt"
+
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+	"github.com/flanglet/kanzi-go/transform"
+)
+
+const (
+	DIAGNOSTIC_WARNING = 0 // the parameters work but are likely not the intended ones
+	DIAGNOSTIC_ERROR   = 1 // the stream cannot be created or the blocks cannot be processed
+)
+
+// Diagnostic an issue found in a configuration by Config.Validate
+type Diagnostic struct {
+	Severity  int    // DIAGNOSTIC_WARNING or DIAGNOSTIC_ERROR
+	Parameter string // name of the parameter at fault
+	Message   string // description of the issue
+	Fix       string // suggested fix (may be empty)
+}
+
+// String returns the diagnostic in one line (EG. "error: blockSize: ... (fix)")
+func (this Diagnostic) String() string {
+	severity := "warning"
+
+	if this.Severity == DIAGNOSTIC_ERROR {
+		severity = "error"
+	}
+
+	res := fmt.Sprintf("%s: %s: %s", severity, this.Parameter, this.Message)
+
+	if len(this.Fix) != 0 {
+		res += " (" + this.Fix + ")"
+	}
+
+	return res
+}
+
+// HasErrors returns true if one of the diagnostics is an error
+func HasErrors(diagnostics []Diagnostic) bool {
+	for _, d := range diagnostics {
+		if d.Severity == DIAGNOSTIC_ERROR {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks the parameters of the configuration without creating a
+// stream (dry run) and returns the issues found, each with a suggested fix.
+// Unlike Freeze, Validate does not stop at the first issue and also checks
+// the consistency of the parameters: block size vs transform limits, memory
+// usage vs number of jobs ('maxMemory', optional, in bytes), codec and
+// transform vs compression level ('level', optional), block size and jobs
+// vs input size ('fileSize', optional) and the transform specific
+// parameters (EG. 'textChunkSize'), which otherwise fail when the first
+// block is processed. Returns an empty slice if no issue is found.
+func (this *Config) Validate() []Diagnostic {
+	v := &configValidator{params: this.params, res: make([]Diagnostic, 0)}
+	v.validate()
+	return v.res
+}
+
+type configValidator struct {
+	params map[string]interface{}
+	res    []Diagnostic
+}
+
+func (this *configValidator) error(param, fix, format string, args ...interface{}) {
+	this.res = append(this.res, Diagnostic{Severity: DIAGNOSTIC_ERROR, Parameter: param,
+		Message: fmt.Sprintf(format, args...), Fix: fix})
+}
+
+func (this *configValidator) warning(param, fix, format string, args ...interface{}) {
+	this.res = append(this.res, Diagnostic{Severity: DIAGNOSTIC_WARNING, Parameter: param,
+		Message: fmt.Sprintf(format, args...), Fix: fix})
+}
+
+func (this *configValidator) validate() {
+	output := false
+
+	for _, c := range _CONFIG_CHECKS[1:] {
+		if _, exists := this.params[c.key]; exists == true && c.required == true {
+			output = true
+		}
+	}
+
+	// Types first: the other checks need valid values
+	for i, c := range _CONFIG_CHECKS {
+		if i > 0 && output == false {
+			break
+		}
+
+		val, exists := this.params[c.key]
+
+		if exists == false {
+			if c.required == true {
+				this.error(c.key, fmt.Sprintf("set '%s' to a %s value", c.key, c.typeName),
+					"missing parameter")
+			}
+		} else if c.isValid(val) == false {
+			this.error(c.key, fmt.Sprintf("use a %s value", c.typeName),
+				"must be a %s, got %T", c.typeName, val)
+		}
+	}
+
+	if HasErrors(this.res) == true {
+		return
+	}
+
+	jobs := this.params["jobs"].(uint)
+
+	if jobs == 0 || jobs > _MAX_CONCURRENCY {
+		this.error("jobs", fmt.Sprintf("use a number of jobs in [1..%d]", _MAX_CONCURRENCY),
+			"invalid number of jobs: %d", jobs)
+		jobs = 1
+	}
+
+	if output == false {
+		return
+	}
+
+	codec := this.params["codec"].(string)
+	entropyType, codecErr := getEntropyType(codec)
+
+	if codecErr != nil {
+		this.error("codec", "use one of NONE, HUFFMAN, AHUFFMAN, ANS0, ANS1, RANS0, RANS1, RANGE, FPAQ, CM, CMX, TPAQ, TPAQX, RLE or AUTO",
+			"%v", codecErr)
+	}
+
+	chain := this.params["transform"].(string)
+	transformType, transformErr := getTransformType(chain)
+
+	if transformErr != nil {
+		this.error("transform", "use transforms separated by '+' (EG. BWT+RANK+ZRLT)",
+			"%v", transformErr)
+	}
+
+	blockSize := this.params["blockSize"].(uint)
+	blockSizeValid := false
+
+	if blockSize < _MIN_BITSTREAM_BLOCK_SIZE {
+		this.error("blockSize", fmt.Sprintf("use a block size of at least %d", _MIN_BITSTREAM_BLOCK_SIZE),
+			"block size too small: %d", blockSize)
+	} else if blockSize > _MAX_BITSTREAM_BLOCK_SIZE {
+		this.error("blockSize", fmt.Sprintf("use a block size of at most %d MB", _MAX_BITSTREAM_BLOCK_SIZE>>20),
+			"block size too big: %d", blockSize)
+	} else if blockSize&15 != 0 {
+		this.error("blockSize", fmt.Sprintf("use %d", (blockSize+15)&^15),
+			"the block size must be a multiple of 16, got %d", blockSize)
+	} else {
+		blockSizeValid = true
+	}
+
+	if uint64(blockSize)*uint64(jobs) >= uint64(1<<31) && blockSizeValid == true {
+		maxJobs := (1 << 31) / blockSize
+		this.warning("jobs", fmt.Sprintf("use at most %d jobs or a smaller block size", maxJobs),
+			"the total size of the blocks exceeds 2 GB: the number of jobs is reduced to %d", maxJobs)
+		jobs = maxJobs
+	}
+
+	if transformErr == nil {
+		this.validateTransforms(transformType, blockSize, blockSizeValid)
+	}
+
+	if codecErr == nil && transformErr == nil {
+		this.validateCodec(entropyType, transformType)
+	}
+
+	if codecErr != nil || transformErr != nil || blockSizeValid == false {
+		return
+	}
+
+	ctx := make(map[string]interface{}, len(this.params))
+
+	for k, v := range this.params {
+		ctx[k] = v
+	}
+
+	ctx["jobs"] = jobs
+	info, err := DescribePipeline(ctx)
+
+	if err != nil {
+		this.error("transform", "", "%v", err)
+		return
+	}
+
+	this.validateMemory(info)
+	this.validateLevel(info, entropyType, transformType, blockSize)
+	this.validateInputSize(blockSize, jobs)
+}
+
+func (this *configValidator) validateTransforms(transformType uint64, blockSize uint, blockSizeValid bool) {
+	types := function.GetTypes(transformType)
+
+	if blockSizeValid == true {
+		for _, t := range types {
+			if maxSize := maxTransformBlockSize(t); blockSize > maxSize {
+				this.error("blockSize", fmt.Sprintf("use a block size of at most %d", maxSize),
+					"the %s transform supports blocks of at most %d bytes, got %d",
+					function.GetTypeName(t), maxSize, blockSize)
+			}
+		}
+	}
+
+	// Dry run: create the transforms with the parameters (the transform
+	// specific parameters are only checked by the constructors)
+	ctx := make(map[string]interface{}, len(this.params))
+
+	for k, v := range this.params {
+		ctx[k] = v
+	}
+
+	if err := newByteFunction(ctx, transformType); err != nil {
+		this.error("transform", "fix the transform specific parameters", "%v", err)
+	}
+
+	for _, t := range types {
+		if t != function.DICT_TYPE {
+			continue
+		}
+
+		if val, exists := this.params["textChunkSize"]; exists == true {
+			chunkSize := -1
+
+			switch v := val.(type) {
+			case int:
+				chunkSize = v
+			case uint:
+				chunkSize = int(v)
+			}
+
+			if chunkSize >= int(blockSize) {
+				this.warning("textChunkSize", "remove 'textChunkSize' or use a value smaller than the block size",
+					"the text chunk size (%d) is not smaller than the block size: the blocks are never split",
+					chunkSize)
+			}
+		}
+	}
+}
+
+func (this *configValidator) validateCodec(entropyType uint32, transformType uint64) {
+	types := function.GetTypes(transformType)
+	last := types[len(types)-1]
+
+	if (last == function.ROLZ_TYPE || last == function.ROLZX_TYPE) && entropyType != entropy.NONE_TYPE {
+		this.warning("codec", "use the NONE codec",
+			"the %s transform already entropy codes its output: the %s codec adds little compression",
+			function.GetTypeName(last), entropy.GetName(entropyType))
+	}
+}
+
+func (this *configValidator) validateMemory(info *PipelineInfo) {
+	val, exists := this.params["maxMemory"]
+
+	if exists == false {
+		return
+	}
+
+	maxMemory := val.(uint64)
+
+	if info.TotalMemory <= maxMemory {
+		return
+	}
+
+	if maxJobs := maxMemory / info.BlockMemory; maxJobs > 0 {
+		this.error("jobs", fmt.Sprintf("use at most %d jobs", maxJobs),
+			"the estimated memory (%s for %d jobs) exceeds the maximum (%s)",
+			memoryString(info.TotalMemory), info.Jobs, memoryString(maxMemory))
+		return
+	}
+
+	this.error("blockSize", "use a smaller block size or a lighter transform and codec",
+		"the estimated memory of one job (%s) exceeds the maximum (%s)",
+		memoryString(info.BlockMemory), memoryString(maxMemory))
+}
+
+func (this *configValidator) validateLevel(info *PipelineInfo, entropyType uint32, transformType uint64, blockSize uint) {
+	val, exists := this.params["level"]
+
+	if exists == false {
+		return
+	}
+
+	name := val.(string)
+	level, exists := GetLevel(name)
+
+	if exists == false {
+		this.error("level", "use a level in [0..8] or register the level first", "unknown level '%s'", name)
+		return
+	}
+
+	if codec := entropy.GetName(entropyType); codec != level.Codec() {
+		this.warning("codec", fmt.Sprintf("set 'codec' to %s or remove 'level'", level.Codec()),
+			"level %s uses the %s codec, got %s", level.Name(), level.Codec(), codec)
+	}
+
+	if chain := function.GetName(transformType); chain != level.Transform() {
+		this.warning("transform", fmt.Sprintf("set 'transform' to %s or remove 'level'", level.Transform()),
+			"level %s uses the %s transform, got %s", level.Name(), level.Transform(), chain)
+	}
+
+	if level.BlockSize() != 0 && level.BlockSize() != blockSize {
+		this.warning("blockSize", fmt.Sprintf("use %d", level.BlockSize()),
+			"level %s uses a block size of %d, got %d", level.Name(), level.BlockSize(), blockSize)
+	}
+
+	if limit := _MEMORY_CLASS_LIMITS[level.MemoryClass()]; info.BlockMemory > limit {
+		this.error("blockSize", "use a smaller block size",
+			"the estimated memory of one job (%s) exceeds the memory class of level %s (%s)",
+			memoryString(info.BlockMemory), level.Name(), memoryString(limit))
+	}
+}
+
+func (this *configValidator) validateInputSize(blockSize, jobs uint) {
+	val, exists := this.params["fileSize"]
+
+	if exists == false {
+		return
+	}
+
+	fileSize := val.(int64)
+
+	if fileSize <= 0 {
+		return
+	}
+
+	if fileSize < int64(blockSize) {
+		suggested := uint(fileSize+15) &^ 15
+
+		if suggested < _MIN_BITSTREAM_BLOCK_SIZE {
+			suggested = _MIN_BITSTREAM_BLOCK_SIZE
+		}
+
+		if suggested < blockSize {
+			this.warning("blockSize", fmt.Sprintf("use a block size of %d to save memory", suggested),
+				"the block size is larger than the input (%d bytes)", fileSize)
+		}
+	}
+
+	if blocks := (fileSize + int64(blockSize) - 1) / int64(blockSize); blocks < int64(jobs) {
+		this.warning("jobs", fmt.Sprintf("use %d job(s) or a smaller block size", blocks),
+			"only %d block(s) to process with %d jobs", blocks, jobs)
+	}
+}
+
+func memoryString(size uint64) string {
+	if size < 1<<20 {
+		return fmt.Sprintf("%d KB", (size+1023)>>10)
+	}
+
+	return fmt.Sprintf("%d MB", (size+(1<<20)-1)>>20)
+}
+
+// Return the maximum block size supported by the transform
+func maxTransformBlockSize(transformType uint64) uint {
+	res := uint(_MAX_BITSTREAM_BLOCK_SIZE)
+	limits := make([]int, 0, 2)
+
+	switch transformType {
+	case function.BWT_TYPE:
+		limits = append(limits, transform.MaxBWTBlockSize())
+
+	case function.BWTS_TYPE:
+		limits = append(limits, transform.MaxBWTSBlockSize())
+
+	case function.AUTOBWT_TYPE:
+		limits = append(limits, transform.MaxBWTBlockSize(), transform.MaxBWTSBlockSize())
+
+	case function.DICT_TYPE:
+		limits = append(limits, function.MaxTextBlockSize())
+
+	case function.ROLZ_TYPE, function.ROLZX_TYPE:
+		limits = append(limits, function.MaxROLZBlockSize())
+	}
+
+	for _, l := range limits {
+		if uint(l) < res {
+			res = uint(l)
+		}
+	}
+
+	return res
+}
+
+// The factories panic on unknown names
+func getEntropyType(name string) (res uint32, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return entropy.GetType(name), nil
+}
+
+func getTransformType(name string) (res uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	return function.GetType(name), nil
+}
+
+func newByteFunction(ctx map[string]interface{}, transformType uint64) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	_, err = function.NewByteFunction(&ctx, transformType)
+	return err
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package io
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	kanzi "github.com/flanglet/kanzi-go"
+)
+
+// WriterAtOutputStream an io.WriteCloser that writes to an io.WriterAt
+// starting at a given offset. It lets a CompressedOutputStream emit its
+// blocks directly into a caller owned destination (file region, database
+// page, ...) without intermediate buffering. The offset of each write is
+// computed from the start offset and the bytes reserved by the previous
+// writes, so that concurrent writers get disjoint ranges of the destination.
+type WriterAtOutputStream struct {
+	writer io.WriterAt
+	start  int64
+	offset int64 // next offset to reserve
+	limit  int64
+	closed bool
+	lock   sync.Mutex
+}
+
+// NewWriterAtOutputStream creates a new instance of WriterAtOutputStream.
+// Data is written at offset 'start' and onwards. If 'limit' is positive,
+// no more than 'limit' bytes can be written.
+func NewWriterAtOutputStream(w io.WriterAt, start, limit int64) (*WriterAtOutputStream, error) {
+	if w == nil {
+		return nil, errors.New("Invalid null writer parameter")
+	}
+
+	if start < 0 {
+		return nil, errors.New("Invalid negative offset parameter")
+	}
+
+	this := new(WriterAtOutputStream)
+	this.writer = w
+	this.start = start
+	this.offset = start
+	this.limit = limit
+	return this, nil
+}
+
+// reserve computes the offset of a write of 'count' bytes and reserves the
+// range. Returns the offset and the number of bytes that fit.
+func (this *WriterAtOutputStream) reserve(count int) (int64, int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed == true {
+		return 0, 0, NewIOError("Stream closed", kanzi.ERR_WRITE_FILE)
+	}
+
+	off := this.offset
+
+	if this.limit > 0 && off-this.start+int64(count) > this.limit {
+		count = int(this.limit - (off - this.start))
+	}
+
+	this.offset += int64(count)
+	return off, count, nil
+}
+
+// Write writes len(b) bytes at the offset computed for this write. Returns
+// an error if the stream is closed, if the limit has been reached or if the
+// underlying io.WriterAt fails.
+func (this *WriterAtOutputStream) Write(b []byte) (int, error) {
+	off, count, err := this.reserve(len(b))
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := this.writer.WriteAt(b[0:count], off)
+
+	if err != nil {
+		return n, err
+	}
+
+	if count < len(b) {
+		return n, NewIOError("Not enough room in destination", kanzi.ERR_WRITE_FILE)
+	}
+
+	return n, nil
+}
+
+// Written returns the number of bytes reserved by the writes so far
+func (this *WriterAtOutputStream) Written() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.offset - this.start
+}
+
+// Offset returns the offset of the next byte to write in the destination
+func (this *WriterAtOutputStream) Offset() int64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.offset
+}
+
+// Close makes the stream unavailable for further writes. The underlying
+// io.WriterAt is not closed.
+func (this *WriterAtOutputStream) Close() error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.closed = true
+	return nil
+}
+
+// ByteSliceWriterAt an io.WriterAt backed by a caller provided byte slice
+// (EG. a memory mapped region). The slice is never re-allocated.
+type ByteSliceWriterAt struct {
+	buf []byte
+}
+
+// NewByteSliceWriterAt creates a new instance of ByteSliceWriterAt
+func NewByteSliceWriterAt(buf []byte) (*ByteSliceWriterAt, error) {
+	if buf == nil {
+		return nil, errors.New("Invalid null buffer parameter")
+	}
+
+	return &ByteSliceWriterAt{buf: buf}, nil
+}
+
+// WriteAt copies b into the slice at offset off. Returns an error if the
+// data does not fit.
+func (this *ByteSliceWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(this.buf)) {
+		return 0, errors.New("Invalid offset parameter")
+	}
+
+	n := copy(this.buf[off:], b)
+
+	if n < len(b) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+// NewByteSliceOutputStream creates an output stream that writes into the
+// provided slice, starting at index 0. The size of the slice is the limit.
+func NewByteSliceOutputStream(buf []byte) (*WriterAtOutputStream, error) {
+	w, err := NewByteSliceWriterAt(buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewWriterAtOutputStream(w, 0, int64(len(buf)))
+}
@@ -16,6 +16,8 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
@@ -27,13 +29,23 @@ import (
 
 func TestBWT(b *testing.T) {
 	if err := testCorrectnessBWT(false); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
 	}
 }
 
 func TestBWTS(b *testing.T) {
 	if err := testCorrectnessBWT(true); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+}
+
+func TestBWTJobs(b *testing.T) {
+	if err := testBWTJobs(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testBWTInverseJobs(); err != nil {
+		b.Error(err)
 	}
 }
 
@@ -157,3 +169,110 @@ func testCorrectnessBWT(isBWT bool) error {
 
 	return error(nil)
 }
+
+// The suffix array built with several jobs must be the same as with 1 job
+func testBWTJobs() error {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	size := 1 << 20
+	inputs := make([][]byte, 4)
+
+	for i := range inputs {
+		inputs[i] = make([]byte, size)
+	}
+
+	for i := 0; i < size; i++ {
+		inputs[0][i] = byte(rnd.Intn(256))    // random
+		inputs[1][i] = byte(65 + rnd.Intn(4)) // small alphabet
+		inputs[2][i] = byte(i % 7)            // periodic
+		inputs[3][i] = "banana "[rnd.Intn(7)] // text like
+	}
+
+	sa1 := make([]int32, size)
+	sa2 := make([]int32, size)
+
+	for i, input := range inputs {
+		ds1, _ := transform.NewDivSufSort()
+		ds1.ComputeSuffixArray(input, sa1)
+
+		for _, jobs := range []uint{2, 4, 7} {
+			ds2, _ := transform.NewDivSufSortWithJobs(jobs)
+			ds2.ComputeSuffixArray(input, sa2)
+
+			for j := range sa1 {
+				if sa1[j] != sa2[j] {
+					return fmt.Errorf("Input %d, %d jobs: different suffix arrays at index %d", i, jobs, j)
+				}
+			}
+		}
+
+		ctx := map[string]interface{}{"jobs": uint(4)}
+		bwt, _ := transform.NewBWTWithCtx(&ctx)
+		output := make([]byte, size)
+		reverse := make([]byte, size)
+
+		if _, _, err := bwt.Forward(input, output); err != nil {
+			return err
+		}
+
+		if _, _, err := bwt.Inverse(output, reverse); err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, reverse) == false {
+			return fmt.Errorf("Input %d: BWT with 4 jobs, input and inverse are different", i)
+		}
+
+		fmt.Printf("Input %d: identical suffix arrays with 1, 2, 4 and 7 jobs\n", i)
+	}
+
+	if _, err := transform.NewDivSufSortWithJobs(0); err == nil {
+		return errors.New("Expected an error for 0 jobs")
+	}
+
+	return nil
+}
+
+// Blocks of 4MB and more are split into chunks (one primary index per chunk
+// in the block header) reconstructed concurrently by the inverse BWT
+func testBWTInverseJobs() error {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	input := make([]byte, 9*1024*1024)
+
+	for i := range input {
+		input[i] = "banana "[rnd.Intn(7)]
+	}
+
+	chunks := transform.GetBWTChunks(len(input))
+
+	if chunks < 2 {
+		return fmt.Errorf("Expected several BWT chunks for a block of %d bytes, got %d", len(input), chunks)
+	}
+
+	bwt, _ := transform.NewBWT()
+	output := make([]byte, len(input))
+
+	if _, _, err := bwt.Forward(input, output); err != nil {
+		return err
+	}
+
+	for _, jobs := range []uint{1, 2, 3, 8} {
+		ctx := map[string]interface{}{"jobs": jobs}
+		ibwt, _ := transform.NewBWTWithCtx(&ctx)
+		reverse := make([]byte, len(input))
+
+		for n := 0; n < chunks; n++ {
+			ibwt.SetPrimaryIndex(n, bwt.PrimaryIndex(n))
+		}
+
+		if _, _, err := ibwt.Inverse(output, reverse); err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, reverse) == false {
+			return fmt.Errorf("Inverse BWT with %d jobs: input and inverse are different", jobs)
+		}
+	}
+
+	fmt.Printf("Inverse BWT of %d chunks identical with 1, 2, 3 and 8 jobs\n", chunks)
+	return nil
+}
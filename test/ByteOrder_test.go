@@ -0,0 +1,514 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/function"
+	kio "github.com/flanglet/kanzi-go/io"
+)
+
+// The compressed format must not depend on the byte order of the host:
+// all multi byte accesses go through encoding/binary with an explicit order.
+func TestByteOrderAudit(b *testing.T) {
+	if err := testByteOrderAudit(".."); err != nil {
+		b.Error(err)
+	}
+}
+
+func testByteOrderAudit(root string) error {
+	issues := make([]string, 0)
+	fset := token.NewFileSet()
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() == true {
+			if strings.HasPrefix(info.Name(), ".") == true && path != root {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if strings.HasSuffix(path, ".go") == false || strings.HasSuffix(path, "_test.go") == true {
+			return nil
+		}
+
+		f, err := parser.ParseFile(fset, path, nil, 0)
+
+		if err != nil {
+			return err
+		}
+
+		for _, imp := range f.Imports {
+			if name, _ := strconv.Unquote(imp.Path.Value); name == "unsafe" {
+				issues = append(issues, fmt.Sprintf("%v: import of package unsafe", fset.Position(imp.Pos())))
+			}
+		}
+
+		ast.Inspect(f, func(n ast.Node) bool {
+			sel, ok := n.(*ast.SelectorExpr)
+
+			if ok == false {
+				return true
+			}
+
+			if pkg, ok := sel.X.(*ast.Ident); ok == true && pkg.Name == "binary" && sel.Sel.Name == "NativeEndian" {
+				issues = append(issues, fmt.Sprintf("%v: host byte order (binary.NativeEndian)", fset.Position(sel.Pos())))
+			}
+
+			return true
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("Byte order audit failed:\n%v", strings.Join(issues, "\n"))
+	}
+
+	return nil
+}
+
+// The source audit cannot see a host dependent computation (EG. a hash or a
+// model indexed with bytes read in host order). The compressed streams of a
+// deterministic input are compared with digests of reference streams: any
+// host (little or big endian, 32 or 64 bits) must produce the same bytes.
+func TestByteOrderVectors(b *testing.T) {
+	if err := testByteOrderVectors(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Deterministic input (text, runs, floats and noise) that does not depend on
+// math/rand
+func byteOrderInput() []byte {
+	words := []string{"alpha ", "beta ", "gamma\n", "<delta>", "/usr/lib/", "0x1234 ", "\xe9t\xe9 "}
+	buf := make([]byte, 0, 256*1024+64)
+	seed := uint32(0x12345678)
+
+	for len(buf) < 256*1024 {
+		seed = seed*1664525 + 1013904223
+
+		switch seed >> 29 {
+		case 0, 1, 2, 3:
+			buf = append(buf, words[(seed>>8)%uint32(len(words))]...)
+
+		case 4:
+			buf = append(buf, bytes.Repeat([]byte{byte(seed >> 8)}, int(seed>>16)&63)...)
+
+		case 5, 6:
+			for i := uint32(0); i < 8; i++ {
+				buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(seed>>20)*0.25+float32(i)))
+			}
+
+		default:
+			for i := 0; i < 16; i++ {
+				seed = seed*1664525 + 1013904223
+				buf = append(buf, byte(seed>>24))
+			}
+		}
+	}
+
+	return buf[0 : 256*1024]
+}
+
+func testByteOrderVectors() error {
+	input := byteOrderInput()
+
+	// Digests (SHA-256) of the reference streams
+	vectors := []struct {
+		transform string
+		codec     string
+		digest    string
+	}{
+		{"BWT+RANK+ZRLT", "ANS0", "ed354e67c83cd30739f9821ba080d8f5377f26ec2638aab5cd790057fb3ecc04"},
+		{"BWTS+MTFT+RLT", "RANGE", "d85cab23e8121e378a60d636a3d8289076f13a01b709bc0213ed06680da99bf8"},
+		{"LZ", "HUFFMAN", "86d28300904757006b7c7e87f7797849f8a3922f564462c008a6477fe203b947"},
+		{"TEXT+ROLZ", "NONE", "9eff8206dc4a311eb915208a9c1b5b75e1cdc2ac2ea0b5cd50eec081476475a5"},
+		{"ROLZX", "NONE", "cef5d365cf76664d6e493bd3c9bdb8ed982707e16de2c71b3a129230a066b717"},
+		{"TEXT+BWT+SRT+ZRLT", "FPAQ", "85011ac21e25e21d8526d630d7f9a860844d7b2559d0726b8ead1f80ecc3a0cc"},
+		{"FP+X86", "CM", "2ff35a61b2b16ee7c6936ccc1e492a6b3919bcc384d0edf74244d94f17bf7dce"},
+		{"NONE", "TPAQ", "877e6311695993e1416ebbd827fa96aa3665e73c9155a5410c1cfcf341ba8516"},
+	}
+
+	for _, v := range vectors {
+		params := map[string]interface{}{"transform": v.transform, "codec": v.codec,
+			"blockSize": uint(128 * 1024), "jobs": uint(1)}
+		output, err := compressStream(input, params)
+
+		if err != nil {
+			return fmt.Errorf("%v&%v: %v", v.transform, v.codec, err)
+		}
+
+		digest := sha256.Sum256(output)
+
+		if res := hex.EncodeToString(digest[:]); res != v.digest {
+			return fmt.Errorf("%v&%v: the stream differs from the reference stream (digest %v, expected %v)",
+				v.transform, v.codec, res, v.digest)
+		}
+
+		decoded, err := decompressStream(output, map[string]interface{}{"jobs": uint(1)})
+
+		if err != nil {
+			return fmt.Errorf("%v&%v: %v", v.transform, v.codec, err)
+		}
+
+		if bytes.Equal(input, decoded) == false {
+			return fmt.Errorf("%v&%v: decompressed data differs from input", v.transform, v.codec)
+		}
+	}
+
+	return nil
+}
+
+func TestReferenceInverse(b *testing.T) {
+	if err := testReferenceInverse(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The reference inverse of each transform must produce the same output as
+// the fast inverse
+func testReferenceInverse() error {
+	sparse := make([]byte, 64*1024)
+
+	for i := range sparse {
+		if rand.Intn(4) == 0 {
+			sparse[i] = byte(rand.Intn(256))
+		}
+	}
+
+	noise := make([]byte, 64*1024)
+	rand.Read(noise)
+	inputs := [][]byte{byteOrderInput()[0 : 64*1024], sparse, noise, []byte{0xFF, 0xFE, 0, 0, 0, 1, 0xFF}}
+	transforms := []string{"BWT", "BWTS", "AUTOBWT", "LZ", "RLT", "ZRLT", "MTFT", "RANK"}
+
+	for _, name := range transforms {
+		for n, input := range inputs {
+			ctx := map[string]interface{}{"blockSize": uint(len(input))}
+			f, err := function.NewByteFunction(&ctx, function.GetType(name))
+
+			if err != nil {
+				return err
+			}
+
+			encoded := make([]byte, 2*len(input)+1024)
+			_, dstIdx, err := f.Forward(input, encoded)
+
+			if err != nil {
+				// Not applicable to this input
+				continue
+			}
+
+			encoded = encoded[0:dstIdx]
+			skipFlags := f.SkipFlags()
+			outputs := make([][]byte, 2)
+
+			for i, reference := range []bool{false, true} {
+				ctx := map[string]interface{}{"blockSize": uint(len(input)), "reference": reference}
+
+				if f, err = function.NewByteFunction(&ctx, function.GetType(name)); err != nil {
+					return err
+				}
+
+				f.SetSkipFlags(skipFlags)
+				src := make([]byte, len(encoded))
+				copy(src, encoded)
+				outputs[i] = make([]byte, len(input)+1024)
+				_, dstIdx, err := f.Inverse(src, outputs[i])
+
+				if err != nil {
+					return fmt.Errorf("%v (input %d, reference=%v): %v", name, n, reference, err)
+				}
+
+				outputs[i] = outputs[i][0:dstIdx]
+			}
+
+			if bytes.Equal(outputs[0], input) == false {
+				return fmt.Errorf("%v (input %d): decompressed data differs from input", name, n)
+			}
+
+			if bytes.Equal(outputs[1], input) == false {
+				return fmt.Errorf("%v (input %d): the reference inverse differs from the inverse", name, n)
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestVerifyDecode(b *testing.T) {
+	if err := testVerifyDecode(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Decode streams produced with every transform in verification mode (each
+// block is cross-checked with the portable reference decoder). Only the
+// streams with a transform that has a reference inverse can be verified.
+func testVerifyDecode() error {
+	words := []string{"alpha ", "beta ", "gamma\n", "delta ", "/usr/lib/", "0x1234 ", "\xe9t\xe9 "}
+	var text bytes.Buffer
+
+	for text.Len() < 6*1024*1024 {
+		text.WriteString(words[rand.Intn(len(words))])
+	}
+
+	transforms := []string{"BWT", "BWTS", "AUTOBWT", "LZ", "ROLZ", "ROLZX", "RLT", "ZRLT",
+		"MTFT", "RANK", "SRT", "TEXT", "X86", "BWT+RANK+ZRLT", "TEXT+LZ"}
+	verified := map[string]bool{"BWT": true, "BWTS": true, "AUTOBWT": true, "LZ": true, "RLT": true,
+		"ZRLT": true, "MTFT": true, "RANK": true, "BWT+RANK+ZRLT": true, "TEXT+LZ": true}
+
+	for _, t := range transforms {
+		input := text.Bytes()[0 : 256*1024]
+		blockSize := uint(64 * 1024)
+
+		// Exercise the multi chunk inverse of the BWT (blocks of 4 MB or more)
+		if t == "BWT" {
+			input = text.Bytes()
+			blockSize = uint(len(input)+15) &^ 15
+		}
+
+		var buf bytes.Buffer
+		cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", t, blockSize, 4, true)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = cos.Write(input); err != nil {
+			return err
+		}
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		ctx := map[string]interface{}{"jobs": uint(4), "verify": true}
+		cis, err := kio.NewCompressedInputStreamWithCtx(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output, err := readAll(cis)
+
+		if verified[t] == false {
+			if ioErr, ok := err.(*kio.IOError); ok == false || ioErr.ErrorCode() != kanzi.ERR_INVALID_PARAM {
+				return fmt.Errorf("%v: expected an error without reference decoder, got: %v", t, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t, err)
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("%v: decompressed data differs from input", t)
+		}
+	}
+
+	return nil
+}
+
+func TestBaselineFormat(b *testing.T) {
+	if err := testBaselineFormat(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Deterministic XML/HTML input (markup, attributes and entities) that does
+// not depend on math/rand
+func markupInput() []byte {
+	words := strings.Fields("alpha beta gamma delta epsilon zeta eta theta iota kappa lambda")
+	var buf bytes.Buffer
+	seed := uint32(0x2521)
+	next := func(n int) int {
+		seed = seed*1664525 + 1013904223
+		return int((seed >> 16) % uint32(n))
+	}
+
+	buf.WriteString("<?xml version=\"1.0\"?>\n<!DOCTYPE html>\n<html><body title='a > b'>\n")
+
+	for buf.Len() < 200*1024 {
+		w1 := words[next(len(words))] + " and the " + words[next(len(words))]
+		w2 := "some " + words[next(len(words))] + " text with " + words[next(len(words))]
+		fmt.Fprintf(&buf, "<div class=\"item\" id=\"i%d\"><p>%s &amp; %s<br>", next(1000), w1, w2)
+		fmt.Fprintf(&buf, "<span title='a/b'>%s &lt;%d&gt;</span><img src=\"x.png\"/></p>", w2, next(100))
+		fmt.Fprintf(&buf, "<ul><li>%s</li><li>&quot;%s&quot;</li></ul></div>\n", w1, w2)
+	}
+
+	buf.WriteString("</body></html>\n")
+	return buf.Bytes()
+}
+
+// The extensions of the text transform that older decoders cannot read must
+// be requested explicitly. By default, the stream of an XML input is a
+// version 8 stream identical to the stream produced by the baseline format
+// (digest of the reference stream), so it can be decoded by older decoders.
+func testBaselineFormat() error {
+	input := markupInput()
+	params := map[string]interface{}{"transform": "TEXT", "blockSize": uint(128 * 1024), "jobs": uint(1)}
+	output, err := compressStream(input, params)
+
+	if err != nil {
+		return err
+	}
+
+	hdr, err := kio.ParseStreamHeader(output)
+
+	if err != nil {
+		return err
+	}
+
+	if hdr.Version != kio.STREAM_MIN_VERSION {
+		return fmt.Errorf("Baseline format: got stream version %d, expected %d", hdr.Version, kio.STREAM_MIN_VERSION)
+	}
+
+	digest := sha256.Sum256(output)
+	expected := "8138f145b15bafd756c43ffc5b5937a5ad3a476708fcde7d9216165198c9f9de"
+
+	if res := hex.EncodeToString(digest[:]); res != expected {
+		return fmt.Errorf("Baseline format: the stream differs from the reference stream (digest %v, expected %v)",
+			res, expected)
+	}
+
+	// With the markup pass, the stream must be a version 9 stream
+	params["textMarkup"] = true
+	markup, err := compressStream(input, params)
+
+	if err != nil {
+		return err
+	}
+
+	if hdr, err = kio.ParseStreamHeader(markup); err != nil {
+		return err
+	}
+
+	if hdr.Version != kio.STREAM_EXT_VERSION {
+		return fmt.Errorf("Baseline format: got stream version %d with the markup pass, expected %d",
+			hdr.Version, kio.STREAM_EXT_VERSION)
+	}
+
+	if len(markup) >= len(output) {
+		return fmt.Errorf("Baseline format: no gain from the markup pass (%d => %d bytes)", len(output), len(markup))
+	}
+
+	for _, stream := range [][]byte{output, markup} {
+		decoded, err := decompressStream(stream, map[string]interface{}{"jobs": uint(1)})
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, decoded) == false {
+			return fmt.Errorf("Baseline format: decompressed data differs from input")
+		}
+	}
+
+	return nil
+}
+
+func TestExtensionVersions(b *testing.T) {
+	if err := testExtensionVersions(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The options of the transforms that change the format of the blocks must
+// be written with stream version 9: the decoders of version 8 reject the
+// stream instead of misreading the blocks.
+func testExtensionVersions() error {
+	input := byteOrderInput()[0 : 64*1024]
+
+	for _, t := range []struct {
+		transform string
+		option    string
+		value     interface{}
+	}{
+		{"ROLZ", "lzCoders", "ANS1,HUFFMAN,ANS0"},
+		{"TEXT", "textChunkSize", uint(16 * 1024)},
+		{"ROLZ", "rolzLogPosChecks", uint(6)},
+		{"ROLZX", "rolzLogPosChecks", 3},
+		{"RLT", "rltWidth", 2},
+	} {
+		for _, set := range []bool{false, true} {
+			params := map[string]interface{}{"transform": t.transform, "jobs": uint(1)}
+			version := uint8(kio.STREAM_MIN_VERSION)
+
+			if set == true {
+				params[t.option] = t.value
+				version = kio.STREAM_EXT_VERSION
+			}
+
+			output, err := compressStream(input, params)
+
+			if err != nil {
+				return fmt.Errorf("%v (%v): %v", t.transform, t.option, err)
+			}
+
+			hdr, err := kio.ParseStreamHeader(output)
+
+			if err != nil {
+				return err
+			}
+
+			if hdr.Version != version {
+				return fmt.Errorf("%v (%v set: %v): got stream version %d, expected %d",
+					t.transform, t.option, set, hdr.Version, version)
+			}
+
+			decoded, err := decompressStream(output, map[string]interface{}{"jobs": uint(1)})
+
+			if err != nil {
+				return fmt.Errorf("%v (%v): %v", t.transform, t.option, err)
+			}
+
+			if bytes.Equal(input, decoded) == false {
+				return fmt.Errorf("%v (%v): decompressed data differs from input", t.transform, t.option)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,5413 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/bitstream"
+	"github.com/flanglet/kanzi-go/entropy"
+	"github.com/flanglet/kanzi-go/function"
+	"github.com/flanglet/kanzi-go/internal/cpuinfo"
+	kio "github.com/flanglet/kanzi-go/io"
+	"github.com/flanglet/kanzi-go/util/hash"
+)
+
+func TestWriterAtOutputStream(b *testing.T) {
+	if err := testWriterAtOutputStream(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testWriterAtOutputStream() error {
+	input := make([]byte, 100000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>10)+1))
+	}
+
+	region := make([]byte, 2*len(input))
+	ws, err := kio.NewByteSliceOutputStream(region)
+
+	if err != nil {
+		return err
+	}
+
+	cos, err := kio.NewCompressedOutputStream(ws, "HUFFMAN", "LZ", 16384, 2, true)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	compressed := region[0:ws.Written()]
+	fmt.Printf("Compressed %d => %d bytes into memory region\n", len(input), len(compressed))
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(compressed)), 2)
+
+	if err != nil {
+		return err
+	}
+
+	output, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(input, output) == false {
+		return fmt.Errorf("Decompressed data differs from input")
+	}
+
+	// Destination too small
+	ws, _ = kio.NewByteSliceOutputStream(make([]byte, 100))
+	cos, _ = kio.NewCompressedOutputStream(ws, "NONE", "NONE", 16384, 1, false)
+	cos.Write(input)
+
+	if err = cos.Close(); err == nil {
+		return fmt.Errorf("Expected an error when the destination is too small")
+	}
+
+	// Errors of the destination on the truncated path
+	ws, _ = kio.NewWriterAtOutputStream(failingWriterAt{}, 0, 10)
+
+	if _, err = ws.Write(make([]byte, 20)); err != errWriterAt {
+		return fmt.Errorf("Expected the error of the destination, got %v", err)
+	}
+
+	// Concurrent writes land at disjoint computed offsets
+	region = make([]byte, 64*1024)
+	ws, _ = kio.NewByteSliceOutputStream(region)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+
+		go func(val byte) {
+			defer wg.Done()
+			ws.Write(bytes.Repeat([]byte{val}, 1024))
+		}(byte(i + 1))
+	}
+
+	wg.Wait()
+	seen := make(map[byte]bool)
+
+	for i := 0; i < len(region); i += 1024 {
+		if bytes.Count(region[i:i+1024], region[i:i+1]) != 1024 || seen[region[i]] == true {
+			return fmt.Errorf("Overlapping concurrent writes at offset %d", i)
+		}
+
+		seen[region[i]] = true
+	}
+
+	return nil
+}
+
+var errWriterAt = errors.New("write failed")
+
+// failingWriterAt an io.WriterAt that always fails
+type failingWriterAt struct{}
+
+func (failingWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	return 0, errWriterAt
+}
+
+// streamParams returns the parameters of the streams of the tests: HUFFMAN,
+// no transform, blocks of 64 KB, 2 jobs and block checksums, replaced by the
+// entries of 'params'
+func streamParams(params map[string]interface{}) map[string]interface{} {
+	ctx := map[string]interface{}{"codec": "HUFFMAN", "transform": "NONE", "blockSize": uint(64 * 1024),
+		"jobs": uint(2), "checksum": true}
+
+	for k, v := range params {
+		ctx[k] = v
+	}
+
+	return ctx
+}
+
+// compressStream compresses 'input' to a stream (see streamParams)
+func compressStream(input []byte, params map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, streamParams(params))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return nil, err
+	}
+
+	if err = cos.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompressStream decompresses a stream with 2 jobs and the parameters of
+// 'params' (EG. the key of an encrypted stream)
+func decompressStream(output []byte, params map[string]interface{}) ([]byte, error) {
+	ctx := map[string]interface{}{"jobs": uint(2)}
+
+	for k, v := range params {
+		ctx[k] = v
+	}
+
+	cis, err := kio.NewCompressedInputStreamWithCtx(ioutil.NopCloser(bytes.NewReader(output)), ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return readAll(cis)
+}
+
+// readAll reads until the compressed stream returns 0 bytes (end of stream)
+func readAll(cis *kio.CompressedInputStream) ([]byte, error) {
+	res := make([]byte, 0)
+	buf := make([]byte, 65536)
+
+	for {
+		n, err := cis.Read(buf)
+
+		if err != nil {
+			return res, err
+		}
+
+		if n == 0 {
+			return res, nil
+		}
+
+		res = append(res, buf[0:n]...)
+	}
+}
+
+func TestCorruptedStream(b *testing.T) {
+	if err := testCorruptedStream(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testCorruptedStream() error {
+	// Fixed seed: the decoding time of a corrupted stream depends on the
+	// corrupted bytes
+	rnd := rand.New(rand.NewSource(2488))
+	input := make([]byte, 32768)
+	rounds := 10
+
+	if testing.Short() == true {
+		rounds = 3
+	}
+
+	for i := range input {
+		input[i] = byte(65 + rnd.Intn(8))
+	}
+
+	for _, codec := range []string{"HUFFMAN", "AHUFFMAN", "ANS0", "ANS1", "RANS0", "RANS1", "RANGE", "FPAQ", "CM", "CMX", "RLE", "AUTO"} {
+		var buf bytes.Buffer
+		cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, codec, "NONE", 16384, 1, false)
+
+		if err != nil {
+			return err
+		}
+
+		cos.Write(input)
+		cos.Close()
+		compressed := buf.Bytes()
+
+		for n := 0; n < rounds; n++ {
+			corrupted := make([]byte, len(compressed))
+			copy(corrupted, compressed)
+
+			// Do not touch the stream header
+			for k := 0; k < 4; k++ {
+				corrupted[16+rnd.Intn(len(corrupted)-16)] ^= byte(1 + rnd.Intn(255))
+			}
+
+			cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(corrupted)), 1)
+
+			if err != nil {
+				return err
+			}
+
+			// Must not panic or loop forever. Errors are expected.
+			readAll(cis)
+		}
+
+		fmt.Printf("Corrupted %v streams decoded without panic\n", codec)
+	}
+
+	return nil
+}
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (this *nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestCustomLevel(b *testing.T) {
+	if err := testCustomLevel(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testCustomLevel() error {
+	l, err := kio.NewLevelBuilder("fastbwt").Transform("bwt+rank+zrlt").Entropy("ans0").
+		BlockSize(4 * 1024 * 1024).Build()
+
+	if err != nil {
+		return err
+	}
+
+	if l.Transform() != "BWT+RANK+ZRLT" || l.Codec() != "ANS0" {
+		return fmt.Errorf("Unexpected level configuration: %v", l)
+	}
+
+	if err = kio.RegisterLevel(l); err != nil {
+		return err
+	}
+
+	if res, exists := kio.GetLevel("fastbwt"); exists == false || res != l {
+		return fmt.Errorf("Registered level not found")
+	}
+
+	levels := kio.GetLevels()
+
+	if levels[0].Name() != "0" || levels[len(levels)-1].Name() != "fastbwt" {
+		return fmt.Errorf("Unexpected level order")
+	}
+
+	// Built-in levels cannot be replaced
+	l, _ = kio.NewLevelBuilder("4").Build()
+
+	if err = kio.RegisterLevel(l); err == nil {
+		return fmt.Errorf("Expected an error when replacing a built-in level")
+	}
+
+	// Invalid configurations
+	if _, err = kio.NewLevelBuilder("bad").Transform("FOO").Build(); err == nil {
+		return fmt.Errorf("Expected an error for an unknown transform")
+	}
+
+	if _, err = kio.NewLevelBuilder("bad").BlockSize(1000).Build(); err == nil {
+		return fmt.Errorf("Expected an error for an invalid block size")
+	}
+
+	if _, err = kio.NewLevelBuilder("big").Transform("BWT").BlockSize(1024 * 1024 * 1024).Build(); err == nil {
+		return fmt.Errorf("Expected an error when exceeding the memory class")
+	}
+
+	l, err = kio.NewLevelBuilder("race").Transform("BWT+RANK+ZRLT").Race("rolzx").Entropy("ANS0").
+		MemoryClass(kio.MEMORY_CLASS_HIGH).Build()
+
+	if err != nil {
+		return err
+	}
+
+	if l.Race() != "ROLZX" {
+		return fmt.Errorf("Unexpected race transform: %s", l.Race())
+	}
+
+	if _, err = kio.NewLevelBuilder("bad").Transform("BWT").Race("NONE").Build(); err == nil {
+		return fmt.Errorf("Expected an error for an empty race transform")
+	}
+
+	return nil
+}
+
+func TestCompactBlockHeaders(b *testing.T) {
+	if err := testCompactBlockHeaders(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testCompactBlockHeaders() error {
+	input := make([]byte, 100*1024)
+
+	for i := range input {
+		input[i] = byte(rand.Intn(256))
+	}
+
+	ctx := map[string]interface{}{"codec": "NONE", "transform": "NONE", "blockSize": uint(1024),
+		"jobs": uint(4), "checksum": false, "compactHeaders": true}
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+	if err != nil {
+		return err
+	}
+
+	cos.Write(input)
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	// 17 bytes of stream header, 2 bits per block header (identical blocks)
+	// and up to 8 bytes of padding
+	if overhead := buf.Len() - len(input); overhead > 17+100/4+8 {
+		return fmt.Errorf("Unexpected framing overhead: %d bytes for 100 blocks", overhead)
+	}
+
+	// The flag is reserved in version 8: the decoders of version 8 must
+	// reject the stream
+	hdr, err := kio.ParseStreamHeader(buf.Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	if hdr.CompactHeaders == false || hdr.Version < kio.STREAM_EXT_VERSION {
+		return fmt.Errorf("Invalid stream header: %+v", *hdr)
+	}
+
+	ctx["index"] = true
+
+	if _, err = kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&bytes.Buffer{}}, ctx); err == nil {
+		return fmt.Errorf("Expected an error for compact block headers in an indexed stream")
+	}
+
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 4)
+
+	if err != nil {
+		return err
+	}
+
+	output, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(input, output) == false {
+		return fmt.Errorf("Decompressed data differs from input")
+	}
+
+	return nil
+}
+
+func TestRatioMonitor(b *testing.T) {
+	if err := testRatioMonitor(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testRatioMonitor() error {
+	input := make([]byte, 64*16384)
+
+	for i := range input {
+		input[i] = byte(rand.Intn(256))
+	}
+
+	for _, policy := range []int{kio.RATIO_POLICY_SKIP_TRANSFORMS, kio.RATIO_POLICY_STORE, kio.RATIO_POLICY_ABORT} {
+		monitor, err := kio.NewRatioMonitor(0.9, 25, 4, policy)
+
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "BWT+RANK+ZRLT+LZ+RLT", 16384, 2, true)
+
+		if err != nil {
+			return err
+		}
+
+		cos.SetRatioMonitor(monitor)
+		_, err = cos.Write(input)
+
+		if err == nil {
+			err = cos.Close()
+		}
+
+		if policy == kio.RATIO_POLICY_ABORT {
+			if err == nil {
+				return fmt.Errorf("Expected an error with the abort policy")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if monitor.Triggered() == false {
+			return fmt.Errorf("Monitor not triggered, ratio percentile: %v", monitor.Percentile())
+		}
+
+		cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 2)
+
+		if err != nil {
+			return err
+		}
+
+		output, err := readAll(cis)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("Decompressed data differs from input (policy %d)", policy)
+		}
+	}
+
+	return nil
+}
+
+func TestBlockHooks(b *testing.T) {
+	if err := testBlockHooks(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testBlockHooks() error {
+	secret := []byte("password")
+	redacted := []byte("********")
+	// 32-byte lines: no secret straddles two blocks
+	input := bytes.Repeat([]byte("user=admin password=letmein1234\n"), 4096)
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "TEXT+LZ", 16384, 2, true)
+
+	if err != nil {
+		return err
+	}
+
+	if err = cos.SetHook(kanzi.EVT_AFTER_TRANSFORM, nil); err == nil {
+		return fmt.Errorf("Expected an error for an unsupported hook stage")
+	}
+
+	redact := func(info kio.BlockInfo, block []byte) error {
+		for {
+			idx := bytes.Index(block, secret)
+
+			if idx < 0 {
+				return nil
+			}
+
+			copy(block[idx:], redacted)
+		}
+	}
+
+	var encoded int32
+
+	if err = cos.SetHook(kanzi.EVT_BEFORE_TRANSFORM, redact); err != nil {
+		return err
+	}
+
+	if err = cos.SetHook(kanzi.EVT_BEFORE_ENTROPY, func(info kio.BlockInfo, block []byte) error {
+		atomic.AddInt32(&encoded, 1)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 2)
+
+	if err != nil {
+		return err
+	}
+
+	var decoded int32
+
+	if err = cis.SetHook(kanzi.EVT_AFTER_TRANSFORM, func(info kio.BlockInfo, block []byte) error {
+		if info.Decoding == false || info.Stage != kanzi.EVT_AFTER_TRANSFORM {
+			return fmt.Errorf("Invalid block info: %+v", info)
+		}
+
+		atomic.AddInt32(&decoded, 1)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	output, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	nbBlocks := int32((len(input) + 16383) / 16384)
+
+	if encoded != nbBlocks || decoded != nbBlocks {
+		return fmt.Errorf("Unexpected number of hook calls: %d/%d, expected %d", encoded, decoded, nbBlocks)
+	}
+
+	if bytes.Contains(output, secret) == true || len(output) != len(input) {
+		return fmt.Errorf("Decompressed data not redacted")
+	}
+
+	// A failing hook stops the stream
+	cis, err = kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 2)
+
+	if err != nil {
+		return err
+	}
+
+	cis.SetHook(kanzi.EVT_AFTER_ENTROPY, func(info kio.BlockInfo, block []byte) error {
+		return fmt.Errorf("rejected block %d", info.ID)
+	})
+
+	if _, err = readAll(cis); err == nil {
+		return fmt.Errorf("Expected an error from the hook")
+	}
+
+	return nil
+}
+
+func TestStreamHeader(b *testing.T) {
+	if err := testStreamHeader(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testStreamHeader() error {
+	for _, id := range kio.EntropyIDs() {
+		if res, found := kio.LookupEntropyID(strings.ToLower(id.String())); found == false || res != id {
+			return fmt.Errorf("Lookup of entropy codec %v failed", id)
+		}
+	}
+
+	for _, id := range kio.TransformIDs() {
+		if res, found := kio.LookupTransformID(id.String()); found == false || res != id {
+			return fmt.Errorf("Lookup of transform %v failed", id)
+		}
+	}
+
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "ANS0", "TEXT+BWT+RANK+ZRLT", 65536, 1, true)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = cos.Write(bytes.Repeat([]byte("header "), 1000)); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	hdr, err := kio.ParseStreamHeader(buf.Bytes())
+
+	if err != nil {
+		return err
+	}
+
+	expected := []kio.TransformID{kio.TRANSFORM_TEXT, kio.TRANSFORM_BWT, kio.TRANSFORM_RANK, kio.TRANSFORM_ZRLT}
+
+	if hdr.Magic != kio.STREAM_MAGIC || hdr.Version != kio.STREAM_MIN_VERSION ||
+		hdr.Checksum == false || hdr.Entropy != kio.ENTROPY_ANS0 ||
+		fmt.Sprint(hdr.Transforms) != fmt.Sprint(expected) || hdr.BlockSize != 65536 ||
+		hdr.CompactHeaders == true || hdr.EntropyOptions == true {
+		return fmt.Errorf("Invalid stream header: %+v", *hdr)
+	}
+
+	// Compact block headers, entropy options and entropy lanes flags
+	// (reserved in version 8)
+	for _, flag := range []byte{0x04, 0x02, 0x01} {
+		header := append([]byte{}, buf.Bytes()[0:kio.STREAM_HEADER_SIZE]...)
+		header[kio.STREAM_HEADER_SIZE-1] |= flag
+
+		if _, err = kio.ParseStreamHeader(header); err == nil {
+			return fmt.Errorf("Expected an error for a reserved flag set in a version 8 stream header")
+		}
+	}
+
+	if _, err = kio.ParseStreamHeader([]byte("not a kanzi stream")); err == nil {
+		return fmt.Errorf("Expected an error for an invalid stream header")
+	}
+
+	return nil
+}
+
+func TestMetrics(b *testing.T) {
+	if err := testMetrics(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testMetrics() error {
+	metrics, err := kio.NewExpvarMetrics("kanzi_test_metrics")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = kio.NewExpvarMetrics("kanzi_test_metrics"); err == nil {
+		return fmt.Errorf("Expected an error for a duplicate expvar name")
+	}
+
+	input := bytes.Repeat([]byte("metrics sink test "), 4000)
+	nbBlocks := int64((len(input) + 16383) / 16384)
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "BWT+RANK+ZRLT", 16384, 2, false)
+
+	if err != nil {
+		return err
+	}
+
+	cos.SetMetrics(metrics)
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 2)
+
+	if err != nil {
+		return err
+	}
+
+	cis.SetMetrics(metrics)
+
+	if _, err = readAll(cis); err != nil {
+		return err
+	}
+
+	counters := map[string]int64{
+		kio.METRIC_ENCODER_PREFIX + kio.METRIC_BLOCKS:    nbBlocks,
+		kio.METRIC_ENCODER_PREFIX + kio.METRIC_BYTES_IN:  int64(len(input)),
+		kio.METRIC_DECODER_PREFIX + kio.METRIC_BLOCKS:    nbBlocks,
+		kio.METRIC_DECODER_PREFIX + kio.METRIC_BYTES_OUT: int64(len(input)),
+	}
+
+	for name, expected := range counters {
+		v, ok := metrics.Get(name).(*expvar.Int)
+
+		if ok == false || v.Value() != expected {
+			return fmt.Errorf("Invalid value for counter %v: %v, expected %v", name, metrics.Get(name), expected)
+		}
+	}
+
+	for _, name := range []string{kio.METRIC_ENCODER_PREFIX + kio.METRIC_ENTROPY_SECONDS,
+		kio.METRIC_DECODER_PREFIX + kio.METRIC_TRANSFORM_SECONDS} {
+		h, ok := metrics.Get(name).(*kio.Histogram)
+
+		if ok == false || h.Count() != nbBlocks {
+			return fmt.Errorf("Invalid histogram %v: %v", name, metrics.Get(name))
+		}
+	}
+
+	if bytes.Contains([]byte(expvar.Get("kanzi_test_metrics").String()), []byte(`"+Inf": `)) == false {
+		return fmt.Errorf("Invalid expvar output")
+	}
+
+	return nil
+}
+
+func TestConfig(b *testing.T) {
+	if err := testConfig(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testConfig() error {
+	cfg := kio.NewConfig("ans0", "bwt+rank+zrlt", 16384, 2, true)
+
+	if err := cfg.Set("fileSize", int64(100000)); err != nil {
+		return err
+	}
+
+	if err := cfg.Freeze(); err != nil {
+		return err
+	}
+
+	if t, _ := cfg.Get("transform"); t != "BWT+RANK+ZRLT" {
+		return fmt.Errorf("Transform name not normalized: %v", t)
+	}
+
+	if err := cfg.Set("checksum", false); err == nil {
+		return fmt.Errorf("Expected an error when modifying a frozen configuration")
+	}
+
+	if err := kio.RegisterConfig("fast", cfg); err != nil {
+		return err
+	}
+
+	shared, exists := kio.GetConfig("fast")
+
+	if exists == false || shared != cfg {
+		return fmt.Errorf("Registered configuration not found")
+	}
+
+	if err := kio.RegisterConfig("tmp", kio.NewConfig("ANS0", "NONE", 16384, 1, false)); err == nil {
+		return fmt.Errorf("Expected an error when registering a configuration that is not frozen")
+	}
+
+	// The frozen configuration is shared by concurrent streams
+	inputCfg := kio.NewConfigWithCtx(map[string]interface{}{"jobs": uint(2)})
+
+	if err := inputCfg.Freeze(); err != nil {
+		return err
+	}
+
+	errs := make(chan error, 8)
+
+	for i := 0; i < cap(errs); i++ {
+		go func(seed int64) {
+			rnd := rand.New(rand.NewSource(seed))
+			input := make([]byte, 100000)
+
+			for i := range input {
+				input[i] = byte(65 + rnd.Intn(4*(i>>10)+1))
+			}
+
+			var buf bytes.Buffer
+			cos, err := kio.NewCompressedOutputStreamWithConfig(&nopWriteCloser{&buf}, shared)
+
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			cos.Write(input)
+
+			if err = cos.Close(); err != nil {
+				errs <- err
+				return
+			}
+
+			cis, err := kio.NewCompressedInputStreamWithConfig(ioutil.NopCloser(&buf), inputCfg)
+
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			output, err := readAll(cis)
+
+			if err == nil && bytes.Equal(input, output) == false {
+				err = fmt.Errorf("Decompressed data differs from input")
+			}
+
+			errs <- err
+		}(int64(i))
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	// A clone can be modified
+	clone := shared.Clone()
+
+	if clone.Frozen() == true || clone.Set("blockSize", uint(65536)) != nil || clone.Freeze() != nil {
+		return fmt.Errorf("Cannot modify and freeze a clone")
+	}
+
+	if bs, _ := shared.Get("blockSize"); bs != uint(16384) {
+		return fmt.Errorf("Modifying a clone changed the original configuration")
+	}
+
+	// Invalid configurations
+	invalid := []map[string]interface{}{
+		{"codec": "ANS0", "transform": "NONE", "blockSize": uint(16384), "checksum": false},
+		{"jobs": uint(0)},
+		{"jobs": 2},
+		{"jobs": uint(1), "codec": "ANS0"},
+		{"jobs": uint(1), "codec": "ZIP", "transform": "NONE", "blockSize": uint(16384), "checksum": false},
+		{"jobs": uint(1), "codec": "ANS0", "transform": "FOO", "blockSize": uint(16384), "checksum": false},
+		{"jobs": uint(1), "codec": "ANS0", "transform": "NONE", "blockSize": uint(1000), "checksum": false},
+		{"jobs": uint(1), "codec": "ANS0", "transform": "NONE", "blockSize": 16384, "checksum": false},
+	}
+
+	for _, ctx := range invalid {
+		err := kio.NewConfigWithCtx(ctx).Freeze()
+
+		if err == nil {
+			return fmt.Errorf("Expected an error for configuration %v", ctx)
+		}
+
+		fmt.Printf("Invalid configuration %v: %v\n", ctx, err)
+	}
+
+	if _, err := kio.NewCompressedOutputStreamWithConfig(&nopWriteCloser{&bytes.Buffer{}}, inputCfg); err == nil {
+		return fmt.Errorf("Expected an error for an output stream without output parameters")
+	}
+
+	return nil
+}
+
+func TestRepair(b *testing.T) {
+	if err := testRepair(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testRepair() error {
+	input := make([]byte, 5*16384)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(8))
+	}
+
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "NONE", 16384, 1, true)
+
+	if err != nil {
+		return err
+	}
+
+	cos.Write(input)
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	compressed := buf.Bytes()
+
+	// Intact stream: all the blocks are kept
+	var repaired bytes.Buffer
+	report, err := kio.Repair(ioutil.NopCloser(bytes.NewReader(compressed)), &nopWriteCloser{&repaired})
+
+	if err != nil {
+		return err
+	}
+
+	if report.Damaged == true || report.Blocks != 5 || report.Bytes != int64(len(input)) || report.Verified == false {
+		return fmt.Errorf("Unexpected report for an intact stream: %+v", *report)
+	}
+
+	// Damage the 4th block (the blocks have similar compressed sizes)
+	corrupted := make([]byte, len(compressed))
+	copy(corrupted, compressed)
+	offset := len(corrupted) * 7 / 10
+
+	for k := 0; k < 16; k++ {
+		corrupted[offset+k] ^= 0x55
+	}
+
+	repaired.Reset()
+	report, err = kio.Repair(ioutil.NopCloser(bytes.NewReader(corrupted)), &nopWriteCloser{&repaired})
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(report)
+
+	if report.Damaged == false || report.Blocks == 0 || report.Blocks >= 5 || report.DamagedBlock != report.Blocks+1 {
+		return fmt.Errorf("Unexpected report for a damaged stream: %+v", *report)
+	}
+
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(repaired.Bytes())), 1)
+
+	if err != nil {
+		return err
+	}
+
+	output, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	if int64(len(output)) != report.Bytes || bytes.Equal(output, input[0:len(output)]) == false {
+		return fmt.Errorf("The repaired stream does not contain the intact blocks")
+	}
+
+	// Invalid stream header
+	if _, err = kio.Repair(ioutil.NopCloser(bytes.NewReader(corrupted[2:])), &nopWriteCloser{&repaired}); err == nil {
+		return fmt.Errorf("Expected an error for an invalid stream header")
+	}
+
+	return nil
+}
+
+func TestConfigValidate(b *testing.T) {
+	if err := testConfigValidate(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testConfigValidate() error {
+	type validateCase struct {
+		params    map[string]interface{} // on top of a valid configuration
+		severity  int                    // -1 if no diagnostic expected
+		parameter string
+		fix       string // expected in the suggested fix
+	}
+
+	cases := []validateCase{
+		{map[string]interface{}{}, -1, "", ""},
+		{map[string]interface{}{"jobs": 4}, kio.DIAGNOSTIC_ERROR, "jobs", "uint"},
+		{map[string]interface{}{"jobs": uint(100)}, kio.DIAGNOSTIC_ERROR, "jobs", "[1..64]"},
+		{map[string]interface{}{"blockSize": uint(1000)}, kio.DIAGNOSTIC_ERROR, "blockSize", "1024"},
+		{map[string]interface{}{"blockSize": uint(16385)}, kio.DIAGNOSTIC_ERROR, "blockSize", "16400"},
+		{map[string]interface{}{"codec": "FOO"}, kio.DIAGNOSTIC_ERROR, "codec", "HUFFMAN"},
+		{map[string]interface{}{"transform": "BWT+FOO"}, kio.DIAGNOSTIC_ERROR, "transform", "BWT+RANK+ZRLT"},
+		{map[string]interface{}{"transform": "TEXT", "textChunkSize": 10}, kio.DIAGNOSTIC_ERROR, "transform", "parameters"},
+		{map[string]interface{}{"transform": "TEXT", "textChunkSize": 1 << 20}, kio.DIAGNOSTIC_WARNING, "textChunkSize", "smaller"},
+		{map[string]interface{}{"transform": "ROLZ"}, kio.DIAGNOSTIC_WARNING, "codec", "NONE"},
+		{map[string]interface{}{"maxMemory": uint64(3 << 20)}, kio.DIAGNOSTIC_ERROR, "jobs", "at most 2 jobs"},
+		{map[string]interface{}{"maxMemory": uint64(1 << 10)}, kio.DIAGNOSTIC_ERROR, "blockSize", "smaller"},
+		{map[string]interface{}{"level": "4", "transform": "TEXT+BWT+RANK+ZRLT"}, kio.DIAGNOSTIC_WARNING, "codec", "ANS0"},
+		{map[string]interface{}{"level": "foo"}, kio.DIAGNOSTIC_ERROR, "level", "register"},
+		{map[string]interface{}{"fileSize": int64(100000)}, kio.DIAGNOSTIC_WARNING, "jobs", "use 2 job(s)"},
+		{map[string]interface{}{"fileSize": int64(100)}, kio.DIAGNOSTIC_WARNING, "blockSize", "1024"},
+	}
+
+	for i, c := range cases {
+		cfg := kio.NewConfig("HUFFMAN", "BWT", 65536, 4, true)
+
+		for k, v := range c.params {
+			cfg.Set(k, v)
+		}
+
+		diagnostics := cfg.Validate()
+
+		if c.severity < 0 {
+			if len(diagnostics) != 0 {
+				return fmt.Errorf("Case %d: unexpected diagnostics: %v", i, diagnostics)
+			}
+
+			continue
+		}
+
+		found := false
+
+		for _, d := range diagnostics {
+			if d.Severity == c.severity && d.Parameter == c.parameter && strings.Contains(d.Fix, c.fix) {
+				found = true
+			}
+		}
+
+		if found == false {
+			return fmt.Errorf("Case %d: expected a diagnostic for '%s' with fix '%s', got %v", i, c.parameter, c.fix, diagnostics)
+		}
+
+		if kio.HasErrors(diagnostics) != (c.severity == kio.DIAGNOSTIC_ERROR) {
+			return fmt.Errorf("Case %d: unexpected severity in %v", i, diagnostics)
+		}
+
+		fmt.Printf("%v\n", diagnostics[0])
+	}
+
+	return nil
+}
+
+func TestProviders(b *testing.T) {
+	if err := testProviders(); err != nil {
+		b.Error(err)
+	}
+}
+
+// A sink failing the first attempt of each part
+type flakySink struct {
+	*kio.MemorySink
+	failed sync.Map
+}
+
+func (this *flakySink) WritePart(part int, offset int64, data []byte) error {
+	if _, seen := this.failed.LoadOrStore(part, true); seen == false {
+		return fmt.Errorf("Transient failure of part %d", part)
+	}
+
+	return this.MemorySink.WritePart(part, offset, data)
+}
+
+func testProviders() error {
+	input := make([]byte, 300000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(1+i/50000)))
+	}
+
+	retry := kio.RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+
+	// Compress to a sink with parts uploaded concurrently and retried
+	sink := &flakySink{MemorySink: kio.NewMemorySink()}
+	sw, err := kio.NewSinkWriter(sink, 4096, 4, retry)
+
+	if err != nil {
+		return err
+	}
+
+	cos, err := kio.NewCompressedOutputStream(sw, "HUFFMAN", "LZ", 65536, 2, true)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	// The stream does not close the underlying writer
+	if err = sw.Close(); err != nil {
+		return err
+	}
+
+	compressed := sink.Bytes()
+
+	if int64(len(compressed)) != sw.Written() {
+		return fmt.Errorf("Sink size mismatch: got %d, expected %d", len(compressed), sw.Written())
+	}
+
+	// Decompress from a HTTP server with ranged reads
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data.knz", time.Time{}, bytes.NewReader(compressed))
+	}))
+
+	defer server.Close()
+	src, err := kio.OpenSource(server.URL + "/data.knz")
+
+	if err != nil {
+		return err
+	}
+
+	if size, err := src.Size(); err != nil || size != int64(len(compressed)) {
+		return fmt.Errorf("Invalid HTTP source size: %d (%v)", size, err)
+	}
+
+	sr, err := kio.NewSourceReader(src, 1000, retry)
+
+	if err != nil {
+		return err
+	}
+
+	cis, err := kio.NewCompressedInputStream(sr, 2)
+
+	if err != nil {
+		return err
+	}
+
+	output, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(input, output) == false {
+		return fmt.Errorf("Data read from the HTTP source differs from the input")
+	}
+
+	// Local file round trip (default provider)
+	dir, err := ioutil.TempDir("", "kanzi")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "data.knz")
+	fsink, err := kio.CreateSink(name)
+
+	if err != nil {
+		return err
+	}
+
+	if sw, err = kio.NewSinkWriter(fsink, 10000, 3, kio.DefaultRetryPolicy); err != nil {
+		return err
+	}
+
+	if _, err = sw.Write(compressed); err != nil {
+		return err
+	}
+
+	if err = sw.Close(); err != nil {
+		return err
+	}
+
+	if src, err = kio.OpenSource("file://" + name); err != nil {
+		return err
+	}
+
+	if sr, err = kio.NewSourceReader(src, 777, kio.DefaultRetryPolicy); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(sr)
+	sr.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(data, compressed) == false {
+		return fmt.Errorf("Data read from the file source differs from the data written")
+	}
+
+	if _, err = kio.OpenSource("s3://bucket/key"); err == nil {
+		return fmt.Errorf("Expected an error for a scheme without provider")
+	}
+
+	return nil
+}
+
+func TestTPAQPool(b *testing.T) {
+	if err := testTPAQPool(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testTPAQPool() error {
+	input := make([]byte, 4*64*1024)
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon ", "zeta ", "eta ", "theta "}
+
+	for i := 0; i < len(input); {
+		i += copy(input[i:], words[rand.Intn(len(words))])
+	}
+
+	// Reference: predictors allocated for each block
+	limit := entropy.SetTPAQPoolLimit(0)
+	defer entropy.SetTPAQPoolLimit(limit)
+	defer entropy.PurgeTPAQPool()
+	params := map[string]interface{}{"codec": "TPAQ", "jobs": uint(1), "checksum": false}
+	ref, err := compressStream(input, params)
+
+	if err != nil {
+		return err
+	}
+
+	// The recycled predictors must behave like new ones
+	entropy.SetTPAQPoolLimit(int64(1) << 30)
+	stats := entropy.GetTPAQPoolStats()
+
+	for i := 0; i < 2; i++ {
+		output, err := compressStream(input, params)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(ref, output) == false {
+			return fmt.Errorf("Compressed data differs with recycled predictors (pass %d)", i)
+		}
+
+		cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(output)), 1)
+
+		if err != nil {
+			return err
+		}
+
+		res, err := readAll(cis)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, res) == false {
+			return fmt.Errorf("Decompressed data differs from input (pass %d)", i)
+		}
+	}
+
+	if hits := entropy.GetTPAQPoolStats().Hits - stats.Hits; hits == 0 {
+		return fmt.Errorf("No predictor recycled")
+	}
+
+	return nil
+}
+
+func TestTPAQModels(b *testing.T) {
+	if err := testTPAQModels(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testTPAQModels() error {
+	input := make([]byte, 2*64*1024)
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon ", "zeta ", "eta ", "theta "}
+
+	for i := 0; i < len(input); {
+		i += copy(input[i:], words[rand.Intn(len(words))])
+	}
+
+	all := entropy.TPAQ_MODEL_ALL
+	small := entropy.TPAQ_MODEL_ORDER1 | entropy.TPAQ_MODEL_ORDER2
+	noMatch := entropy.TPAQ_MODEL_ALL &^ entropy.TPAQ_MODEL_MATCH
+	sizes := make(map[int]int)
+
+	for _, codec := range []string{"TPAQ", "TPAQX"} {
+		for _, models := range []int{all, small, noMatch, 0} {
+			var buf bytes.Buffer
+			ctx := map[string]interface{}{
+				"codec":      codec,
+				"transform":  "NONE",
+				"blockSize":  uint(64 * 1024),
+				"jobs":       uint(1),
+				"checksum":   true,
+				"tpaqModels": models,
+			}
+
+			cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+			if err != nil {
+				return err
+			}
+
+			if _, err = cos.Write(input); err != nil {
+				return err
+			}
+
+			if err = cos.Close(); err != nil {
+				return err
+			}
+
+			if codec == "TPAQ" {
+				sizes[models] = buf.Len()
+			}
+
+			if hdr, err := kio.ParseStreamHeader(buf.Bytes()); err != nil || hdr.EntropyOptions == false {
+				return fmt.Errorf("%s: TPAQ options flag not set in the stream header", codec)
+			} else if hdr.Version < kio.STREAM_EXT_VERSION {
+				// The flag is reserved in version 8
+				return fmt.Errorf("%s: unexpected stream version with the options flag: %d", codec, hdr.Version)
+			}
+
+			cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 1)
+
+			if err != nil {
+				return err
+			}
+
+			res, err := readAll(cis)
+
+			if err != nil {
+				return err
+			}
+
+			if bytes.Equal(input, res) == false {
+				return fmt.Errorf("%s: decompressed data differs from input (models %#x)", codec, models)
+			}
+		}
+	}
+
+	// Fewer models compress worse
+	if sizes[small] <= sizes[all] || sizes[0] <= sizes[small] {
+		return fmt.Errorf("Unexpected compressed sizes: %v", sizes)
+	}
+
+	// Invalid mask
+	ctx := map[string]interface{}{
+		"codec":      "TPAQ",
+		"transform":  "NONE",
+		"blockSize":  uint(64 * 1024),
+		"jobs":       uint(1),
+		"checksum":   false,
+		"tpaqModels": 256,
+	}
+
+	if _, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&bytes.Buffer{}}, ctx); err == nil {
+		return fmt.Errorf("Invalid TPAQ models not rejected")
+	}
+
+	return nil
+}
+
+func TestTPAQExtraModels(b *testing.T) {
+	if err := testTPAQExtraModels(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testTPAQExtraModels() error {
+	// Text where each word depends on the previous word
+	words := []string{"The", "quick", "brown", "fox", "jumps", "over", "the", "lazy", "dog", "while",
+		"a", "small", "cat", "sleeps", "under", "old", "wooden", "table", "in", "kitchen"}
+	var buf bytes.Buffer
+	prev := 0
+
+	for buf.Len() < 2*64*1024 {
+		next := (prev*7 + rand.Intn(3)) % len(words)
+		buf.WriteString(words[next])
+
+		if rand.Intn(12) == 0 {
+			buf.WriteString(".\n")
+		} else {
+			buf.WriteByte(' ')
+		}
+
+		prev = next
+	}
+
+	input := buf.Bytes()
+
+	for _, codec := range []string{"TPAQ", "TPAQX"} {
+		var sizes [2]int
+
+		for i, extra := range []bool{false, true} {
+			var err error
+
+			if sizes[i], err = roundTripTPAQ(input, codec, "tpaq:extra", extra); err != nil {
+				return err
+			}
+		}
+
+		if sizes[1] >= sizes[0] {
+			return fmt.Errorf("%s: no gain from the extra models: %d bytes vs %d bytes", codec, sizes[1], sizes[0])
+		}
+	}
+
+	return nil
+}
+
+// Compress and decompress the input with a TPAQ option, return the size
+// of the compressed data
+func roundTripTPAQ(input []byte, codec, option string, value bool) (int, error) {
+	output, err := compressStream(input, map[string]interface{}{"codec": codec, option: value})
+
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := decompressStream(output, nil)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if bytes.Equal(input, res) == false {
+		return 0, fmt.Errorf("%s: decompressed data differs from input (%s: %v)", codec, option, value)
+	}
+
+	return len(output), nil
+}
+
+func TestTPAQMix2(b *testing.T) {
+	if err := testTPAQMix2(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testTPAQMix2() error {
+	// Blocks mixing text and binary records
+	words := []string{"record ", "value ", "index ", "offset ", "length ", "name\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 2*64*1024 {
+		if rand.Intn(2) == 0 {
+			for i := 0; i < 32; i++ {
+				buf.WriteString(words[rand.Intn(len(words))])
+			}
+		} else {
+			for i := 0; i < 32; i++ {
+				n := buf.Len()
+				buf.Write([]byte{byte(n >> 8), byte(n), 0, byte(rand.Intn(4)), 0x7F, 0xFF, byte(i), 0})
+			}
+		}
+	}
+
+	input := buf.Bytes()
+
+	for _, codec := range []string{"TPAQ", "TPAQX"} {
+		var sizes [2]int
+
+		for i, mix2 := range []bool{false, true} {
+			var err error
+
+			if sizes[i], err = roundTripTPAQ(input, codec, "tpaq:mix2", mix2); err != nil {
+				return err
+			}
+		}
+
+		if sizes[1] >= sizes[0] {
+			return fmt.Errorf("%s: no gain from 2 mixing layers: %d bytes vs %d bytes", codec, sizes[1], sizes[0])
+		}
+	}
+
+	return nil
+}
+
+func TestTPAQWarm(b *testing.T) {
+	if err := testTPAQWarm(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testTPAQWarm() error {
+	// Many small blocks of similar text and a random block
+	words := []string{"archive ", "member ", "file ", "header ", "size ", "date ", "owner ", "mode\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 256*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+
+		if buf.Len() >= 128*1024 && buf.Len() < 128*1024+8 {
+			for i := 0; i < 4096; i++ {
+				buf.WriteByte(byte(rand.Intn(256)))
+			}
+		}
+	}
+
+	input := buf.Bytes()
+
+	for _, codec := range []string{"TPAQ", "TPAQX"} {
+		var sizes [2]int
+
+		for i, warm := range []bool{false, true} {
+			var out bytes.Buffer
+			ctx := map[string]interface{}{
+				"codec":     codec,
+				"transform": "LZ",
+				"blockSize": uint(4096),
+				"jobs":      uint(4),
+				"checksum":  true,
+				"tpaq:warm": warm,
+			}
+
+			cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&out}, ctx)
+
+			if err != nil {
+				return err
+			}
+
+			if _, err = cos.Write(input); err != nil {
+				return err
+			}
+
+			if err = cos.Close(); err != nil {
+				return err
+			}
+
+			sizes[i] = out.Len()
+
+			for _, jobs := range []uint{1, 3} {
+				cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(out.Bytes())), jobs)
+
+				if err != nil {
+					return err
+				}
+
+				res, err := readAll(cis)
+
+				if err != nil {
+					return err
+				}
+
+				cis.Close()
+
+				if bytes.Equal(input, res) == false {
+					return fmt.Errorf("%s: decompressed data differs from input (warm model: %v, jobs: %d)", codec, warm, jobs)
+				}
+			}
+		}
+
+		// The model learnt from the previous blocks helps a lot
+		if sizes[1] >= sizes[0]*9/10 {
+			return fmt.Errorf("%s: not enough gain from the warm model: %d bytes vs %d bytes", codec, sizes[1], sizes[0])
+		}
+	}
+
+	return nil
+}
+
+func TestTextRetainStream(b *testing.T) {
+	if err := testTextRetainStream(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testTextRetainStream() error {
+	// Many small blocks of similar text and a random block (stored)
+	words := []string{"Scheduling ", "container ", "kubernetes ", "allocation ", "persistent ",
+		"volume ", "controller ", "endpoint ", "Reconciling ", "replication ", "threshold.\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 256*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+
+		if buf.Len() >= 128*1024 && buf.Len() < 128*1024+12 {
+			for i := 0; i < 8192; i++ {
+				buf.WriteByte(byte(rand.Intn(256)))
+			}
+		}
+	}
+
+	input := buf.Bytes()
+
+	for _, t := range []struct {
+		transform string
+		codec     string
+	}{
+		{"TEXT", "HUFFMAN"},
+		{"TEXT+LZ", "ANS0"},
+		{"TEXT", "FPAQ"},
+	} {
+		var sizes [2]int
+
+		for i, retain := range []bool{false, true} {
+			params := map[string]interface{}{"transform": t.transform, "codec": t.codec,
+				"blockSize": uint(4096), "jobs": uint(4), "textRetain": retain}
+			output, err := compressStream(input, params)
+
+			if err != nil {
+				return err
+			}
+
+			sizes[i] = len(output)
+			hdr, err := kio.ParseStreamHeader(output)
+
+			if err != nil {
+				return err
+			}
+
+			// The decoders of version 8 cannot decode the retained dictionaries
+			if version := map[bool]uint8{false: kio.STREAM_MIN_VERSION, true: kio.STREAM_EXT_VERSION}[retain]; hdr.Version != version {
+				return fmt.Errorf("%s&%s: got stream version %d, expected %d", t.transform, t.codec, hdr.Version, version)
+			}
+
+			for _, jobs := range []uint{1, 3} {
+				res, err := decompressStream(output, map[string]interface{}{"jobs": jobs, "textRetain": true})
+
+				if err != nil {
+					return fmt.Errorf("%s&%s: %v", t.transform, t.codec, err)
+				}
+
+				if bytes.Equal(input, res) == false {
+					return fmt.Errorf("%s&%s: decompressed data differs from input (retain: %v, jobs: %d)",
+						t.transform, t.codec, retain, jobs)
+				}
+			}
+
+			// The blocks that continue the dictionary of the previous block
+			// require the retain mode
+			if _, err = decompressStream(output, map[string]interface{}{"jobs": uint(1)}); retain == true && err == nil {
+				return fmt.Errorf("%s&%s: expected an error when decoding without the retain mode", t.transform, t.codec)
+			}
+		}
+
+		fmt.Printf("%s&%s: %d bytes (%d bytes with retained text dictionary)\n", t.transform, t.codec, sizes[0], sizes[1])
+
+		if sizes[1] >= sizes[0] {
+			return fmt.Errorf("%s&%s: no gain from the retained dictionary: %d bytes vs %d bytes",
+				t.transform, t.codec, sizes[1], sizes[0])
+		}
+	}
+
+	// Each block depends on the previous block
+	for _, key := range []string{"index", "syncPoints"} {
+		params := map[string]interface{}{"transform": "TEXT", "textRetain": true, key: true}
+
+		if _, err := compressStream(input, params); err == nil {
+			return fmt.Errorf("Expected an error with the retained text dictionary and '%s'", key)
+		}
+	}
+
+	return nil
+}
+
+func TestTransformRace(b *testing.T) {
+	if err := testTransformRace(); err != nil {
+		b.Error(err)
+	}
+}
+
+func compressRace(input []byte, transform, race string, budget float64) ([]byte, kio.RaceStats, error) {
+	var buf bytes.Buffer
+	ctx := map[string]interface{}{
+		"codec":     "ANS0",
+		"transform": transform,
+		"blockSize": uint(64 * 1024),
+		"jobs":      uint(2),
+		"checksum":  true,
+	}
+
+	if len(race) != 0 {
+		ctx["raceTransform"] = race
+		ctx["raceBudget"] = budget
+	}
+
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+	if err != nil {
+		return nil, kio.RaceStats{}, err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return nil, kio.RaceStats{}, err
+	}
+
+	if err = cos.Close(); err != nil {
+		return nil, kio.RaceStats{}, err
+	}
+
+	return buf.Bytes(), cos.RaceStats(), nil
+}
+
+func testTransformRace() error {
+	// Alternate text blocks and blocks of skewed random bytes (the BWT chain
+	// wins on text and loses the order 0 statistics on random bytes)
+	input := make([]byte, 8*64*1024)
+	words := []string{"alpha ", "beta ", "gamma ", "delta ", "epsilon ", "zeta ", "eta ", "theta "}
+
+	for i := 0; i < len(input); {
+		if (i>>16)&1 == 0 {
+			i += copy(input[i:], words[rand.Intn(len(words))])
+			continue
+		}
+
+		input[i] = byte(rand.Intn(256) & rand.Intn(256) & rand.Intn(256))
+		i++
+	}
+
+	primary, _, err := compressRace(input, "BWT+RANK+ZRLT", "", 0)
+
+	if err != nil {
+		return err
+	}
+
+	alternate, _, err := compressRace(input, "RLT", "", 0)
+
+	if err != nil {
+		return err
+	}
+
+	output, stats, err := compressRace(input, "BWT+RANK+ZRLT", "RLT", 100)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Primary: %d, alternate: %d, race: %d, stats: %+v\n", len(primary), len(alternate), len(output), stats)
+
+	if stats.Blocks != 8 || stats.PrimaryWins == 0 || stats.AlternateWins == 0 {
+		return fmt.Errorf("Unexpected race statistics: %+v", stats)
+	}
+
+	if len(output) >= len(primary) || len(output) >= len(alternate) {
+		return fmt.Errorf("The race output (%d) should be smaller than the output of each chain (%d, %d)",
+			len(output), len(primary), len(alternate))
+	}
+
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(output)), 2)
+
+	if err != nil {
+		return err
+	}
+
+	decoded, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(input, decoded) == false {
+		return fmt.Errorf("Decompressed data differs from input")
+	}
+
+	// No CPU budget: only the first block is raced
+	if _, stats, err = compressRace(input, "BWT+RANK+ZRLT", "RLT", 0); err != nil {
+		return err
+	}
+
+	if stats.Unraced == 0 || stats.Blocks+stats.Unraced != 8 {
+		return fmt.Errorf("Unexpected race statistics without budget: %+v", stats)
+	}
+
+	// Invalid races
+	for _, race := range []string{"NONE", "RLT+ZRLT+RLT+ZRLT+RLT"} {
+		if _, _, err = compressRace(input, "BWT+RANK+ZRLT+RLT", race, 1); err == nil {
+			return fmt.Errorf("Expected an error for race transform %s", race)
+		}
+	}
+
+	return nil
+}
+
+func TestOutputDigest(b *testing.T) {
+	if err := testOutputDigest(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testOutputDigest() error {
+	input := make([]byte, 300000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>12)+1))
+	}
+
+	for _, name := range []string{"sha256", "MD5"} {
+		var buf bytes.Buffer
+		ctx := map[string]interface{}{"codec": "HUFFMAN", "transform": "LZ", "blockSize": uint(64 * 1024),
+			"jobs": uint(4), "checksum": false, "outputDigest": name}
+		cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = cos.Write(input); err != nil {
+			return err
+		}
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		algo, digest, err := cos.Digest()
+
+		if err != nil {
+			return err
+		}
+
+		var expected []byte
+
+		if algo == kio.DIGEST_SHA256 {
+			sum := sha256.Sum256(buf.Bytes())
+			expected = sum[:]
+		} else {
+			sum := md5.Sum(buf.Bytes())
+			expected = sum[:]
+		}
+
+		if strings.EqualFold(algo, name) == false || bytes.Equal(digest, expected) == false {
+			return fmt.Errorf("Invalid %s digest of the compressed output: %x instead of %x", algo, digest, expected)
+		}
+	}
+
+	// No digest requested
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&bytes.Buffer{}}, "NONE", "NONE", 65536, 1, false)
+
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = cos.Digest(); err == nil {
+		return fmt.Errorf("Expected an error for a stream without digest")
+	}
+
+	cos.Close()
+	cfg := kio.NewConfigWithCtx(map[string]interface{}{"codec": "NONE", "transform": "NONE",
+		"blockSize": uint(65536), "jobs": uint(1), "checksum": false, "outputDigest": "FOO"})
+
+	if err = cfg.Freeze(); err == nil {
+		return fmt.Errorf("Expected an error for an unknown digest")
+	}
+
+	return nil
+}
+
+func TestNextBlock(b *testing.T) {
+	if err := testNextBlock(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testNextBlock() error {
+	input := make([]byte, 10*16384+1234)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>12)+1))
+	}
+
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "ANS0", "LZ", 16384, 4, true)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	for _, jobs := range []uint{1, 3} {
+		cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), jobs)
+
+		if err != nil {
+			return err
+		}
+
+		output := make([]byte, 0, len(input))
+		expectedID := 1
+
+		for {
+			blk, err := cis.NextBlock()
+
+			if err != nil {
+				return err
+			}
+
+			if blk == nil {
+				break
+			}
+
+			if blk.ID != expectedID || len(blk.Data) > 16384 {
+				return fmt.Errorf("Unexpected block %d (%d bytes), expected block %d", blk.ID, len(blk.Data), expectedID)
+			}
+
+			expectedID++
+			output = append(output, blk.Data...)
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("Decompressed blocks differ from input (jobs=%d)", jobs)
+		}
+
+		if blk, err := cis.NextBlock(); blk != nil || err != nil {
+			return fmt.Errorf("Expected the end of stream after the last block")
+		}
+
+		cis.Close()
+	}
+
+	// Read and NextBlock cannot be mixed
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 2)
+
+	if err != nil {
+		return err
+	}
+
+	defer cis.Close()
+
+	if _, err = cis.NextBlock(); err != nil {
+		return err
+	}
+
+	if _, err = cis.Read(make([]byte, 100)); err == nil {
+		return fmt.Errorf("Expected an error when calling Read after NextBlock")
+	}
+
+	return nil
+}
+
+func TestImport(b *testing.T) {
+	if err := testImport(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testImport() error {
+	dir, err := ioutil.TempDir("", "kanzi-import")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+	input := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 2000))
+	cfg := kio.NewConfig("ANS0", "TEXT+BWT", 65536, 2, true)
+
+	// Gzip file with two members, original name and modification time
+	modTime := time.Date(2015, 6, 7, 8, 9, 10, 0, time.UTC)
+	var gz bytes.Buffer
+
+	for i := 0; i < 2; i++ {
+		zw := gzip.NewWriter(&gz)
+		zw.Name = "fox.txt"
+		zw.ModTime = modTime
+		zw.Write(input[i*len(input)/2 : (i+1)*len(input)/2])
+		zw.Close()
+	}
+
+	gzName := filepath.Join(dir, "archive.gz")
+
+	if err = ioutil.WriteFile(gzName, gz.Bytes(), 0666); err != nil {
+		return err
+	}
+
+	info, err := kio.ImportFile(gzName, "", cfg)
+
+	if err != nil {
+		return err
+	}
+
+	knzName := filepath.Join(dir, "fox.txt.knz")
+
+	if info.Format != kio.IMPORT_GZIP || info.Name != "fox.txt" || info.Read != uint64(len(input)) {
+		return fmt.Errorf("Unexpected import info: %+v", info)
+	}
+
+	if err = checkImportedFile(knzName, input); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(knzName); err != nil || fi.ModTime().Equal(modTime) == false {
+		return fmt.Errorf("The modification time of the gzip file was not preserved")
+	}
+
+	if _, err = kio.ImportFile(gzName, "", cfg); err == nil {
+		return fmt.Errorf("Expected an error when the output file exists")
+	}
+
+	// Bzip2 stream (no metadata): the name and time come from the input file
+	bz := []byte{0x42, 0x5A, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0xB9, 0xD0, 0x73, 0x42,
+		0x00, 0x00, 0x06, 0x59, 0x80, 0x00, 0x10, 0x40, 0x00, 0x10, 0x00, 0x32, 0x2B, 0xDC, 0x10, 0x20,
+		0x00, 0x22, 0x23, 0xD4, 0x0F, 0x44, 0xC9, 0xEA, 0x14, 0xC0, 0x01, 0x34, 0xA6, 0xE6, 0x64, 0xBF,
+		0x29, 0x0B, 0xB9, 0x86, 0x22, 0x52, 0x00, 0xD4, 0x25, 0xF1, 0x77, 0x24, 0x53, 0x85, 0x09, 0x0B,
+		0x9D, 0x07, 0x34, 0x20}
+	bzName := filepath.Join(dir, "note.txt.bz2")
+	bzTime := time.Date(2012, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err = ioutil.WriteFile(bzName, bz, 0666); err != nil {
+		return err
+	}
+
+	if err = os.Chtimes(bzName, bzTime, bzTime); err != nil {
+		return err
+	}
+
+	if info, err = kio.ImportFile(bzName, "", cfg); err != nil {
+		return err
+	}
+
+	knzName = filepath.Join(dir, "note.txt.knz")
+
+	if info.Format != kio.IMPORT_BZIP2 || info.Name != "" {
+		return fmt.Errorf("Unexpected import info: %+v", info)
+	}
+
+	if err = checkImportedFile(knzName, []byte("kanzi imports bzip2 streams\n")); err != nil {
+		return err
+	}
+
+	if fi, err := os.Stat(knzName); err != nil || fi.ModTime().Equal(bzTime) == false {
+		return fmt.Errorf("The modification time of the bzip2 file was not preserved")
+	}
+
+	// Xz streams are detected but not supported, unknown formats are rejected
+	xz := []byte{0xFD, '7', 'z', 'X', 'Z', 0x00, 0x00, 0x04}
+
+	if _, err = kio.Import(&nopWriteCloser{&bytes.Buffer{}}, bytes.NewReader(xz), cfg); err == nil ||
+		strings.Contains(err.Error(), "xz") == false {
+		return fmt.Errorf("Expected an error for the xz stream, got %v", err)
+	}
+
+	if _, err = kio.Import(&nopWriteCloser{&bytes.Buffer{}}, bytes.NewReader(input), cfg); err == nil {
+		return fmt.Errorf("Expected an error for an uncompressed stream")
+	}
+
+	// Output names
+	if name := kio.ImportOutputName("a/b.tgz", nil); name != "a/b.tar.knz" {
+		return fmt.Errorf("Unexpected output name: %s", name)
+	}
+
+	if name := kio.ImportOutputName("a/b.dat", nil); name != "a/b.dat.knz" {
+		return fmt.Errorf("Unexpected output name: %s", name)
+	}
+
+	return nil
+}
+
+func checkImportedFile(name string, expected []byte) error {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return err
+	}
+
+	cis, err := kio.NewCompressedInputStream(f, 1)
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	defer cis.Close()
+	output, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(output, expected) == false {
+		return fmt.Errorf("The content of %s differs from the imported data", filepath.Base(name))
+	}
+
+	return nil
+}
+
+func TestStoredBlocks(b *testing.T) {
+	if err := testStoredBlocks(); err != nil {
+		b.Error(err)
+	}
+}
+
+// A metrics sink keeping the counters only
+type counterSink struct {
+	mutex    sync.Mutex
+	counters map[string]int64
+}
+
+func (this *counterSink) Add(name string, delta int64) {
+	this.mutex.Lock()
+	this.counters[name] += delta
+	this.mutex.Unlock()
+}
+
+func (this *counterSink) Set(name string, value float64) {
+}
+
+func (this *counterSink) Observe(name string, value float64) {
+}
+
+func testStoredBlocks() error {
+	// Random blocks interleaved with text blocks
+	const blockSize = 65536
+	rnd := rand.New(rand.NewSource(12345))
+	text := bytes.Repeat([]byte("Incompressible blocks are stored raw. "), blockSize/38+1)[0:blockSize]
+	input := make([]byte, 0, 6*blockSize)
+	nbRandom := 0
+
+	for i := 0; i < 6; i++ {
+		if i%3 == 2 {
+			input = append(input, text...)
+			continue
+		}
+
+		block := make([]byte, blockSize)
+		rnd.Read(block)
+		input = append(input, block...)
+		nbRandom++
+	}
+
+	configs := [][2]string{
+		{"ROLZX", "ANS1"},
+		{"ROLZX", "NONE"},
+		{"BWT+RANK+ZRLT", "ANS1"},
+		{"NONE", "ANS1"},
+		{"LZ", "HUFFMAN"},
+		{"TEXT+LZ", "FPAQ"},
+	}
+
+	for _, config := range configs {
+		var buf bytes.Buffer
+		sink := &counterSink{counters: make(map[string]int64)}
+		cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, config[1], config[0], blockSize, 2, true)
+
+		if err != nil {
+			return err
+		}
+
+		cos.SetMetrics(sink)
+
+		if _, err = cos.Write(input); err != nil {
+			return fmt.Errorf("%v/%v: %v", config[0], config[1], err)
+		}
+
+		if err = cos.Close(); err != nil {
+			return fmt.Errorf("%v/%v: %v", config[0], config[1], err)
+		}
+
+		// The random blocks cost their size plus a few bytes
+		if max := nbRandom*(blockSize+16) + 6*blockSize/10; buf.Len() > max {
+			return fmt.Errorf("%v/%v: output too big: %v bytes (max %v)", config[0], config[1], buf.Len(), max)
+		}
+
+		if stored := sink.counters[kio.METRIC_ENCODER_PREFIX+kio.METRIC_STORED_BLOCKS]; stored != int64(nbRandom) {
+			return fmt.Errorf("%v/%v: %v stored blocks, expected %v", config[0], config[1], stored, nbRandom)
+		}
+
+		cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 2)
+
+		if err != nil {
+			return err
+		}
+
+		output, err := readAll(cis)
+
+		if err != nil {
+			return fmt.Errorf("%v/%v: %v", config[0], config[1], err)
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("%v/%v: invalid round trip", config[0], config[1])
+		}
+	}
+
+	return nil
+}
+
+func TestCMOrder2(b *testing.T) {
+	if err := testCMOrder2(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testCMOrder2() error {
+	words := []string{"the ", "order ", "two ", "context ", "of ", "a ", "text ", "model\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 3*64*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+	}
+
+	input := buf.Bytes()
+	var sizes [2]int
+
+	for i, order2 := range []bool{false, true} {
+		var err error
+
+		if sizes[i], err = roundTripTPAQ(input, "CM", "cm:order2", order2); err != nil {
+			return err
+		}
+	}
+
+	if sizes[1] >= sizes[0]*9/10 {
+		return fmt.Errorf("CM: no gain from the order 2 context: %d bytes vs %d bytes", sizes[1], sizes[0])
+	}
+
+	ctx := map[string]interface{}{"codec": "CM", "transform": "NONE", "blockSize": uint(65536),
+		"jobs": uint(1), "checksum": false, "cm:order2": 1}
+
+	if _, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx); err == nil {
+		return fmt.Errorf("Expected an error for an invalid CM option")
+	}
+
+	return nil
+}
+
+func TestStreamEntropyLanes(b *testing.T) {
+	if err := testStreamEntropyLanes(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testStreamEntropyLanes() error {
+	words := []string{"lanes ", "of ", "a ", "block ", "decoded ", "concurrently\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 2*256*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+	}
+
+	input := buf.Bytes()
+
+	for _, codec := range []string{"CM", "TPAQ", "HUFFMAN"} {
+		var out bytes.Buffer
+		ctx := map[string]interface{}{"codec": codec, "transform": "NONE", "blockSize": uint(256 * 1024),
+			"jobs": uint(2), "checksum": true, "entropy:lanes": uint(4)}
+		cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&out}, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = cos.Write(input); err != nil {
+			return err
+		}
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		// Only the binary entropy codecs support lanes
+		hdr, err := kio.ParseStreamHeader(out.Bytes())
+
+		if err != nil || hdr.EntropyLanes != (codec != "HUFFMAN") {
+			return fmt.Errorf("%s: incorrect entropy lanes flag in the stream header", codec)
+		}
+
+		// The flag is reserved in version 8: the decoders of version 8 must
+		// reject the stream
+		if (hdr.EntropyLanes == true) != (hdr.Version >= kio.STREAM_EXT_VERSION) {
+			return fmt.Errorf("%s: unexpected stream version: %d", codec, hdr.Version)
+		}
+
+		if info, err := kio.DescribePipeline(ctx); err != nil || info.Version != uint(hdr.Version) {
+			return fmt.Errorf("%s: the pipeline description does not match the stream version", codec)
+		}
+
+		cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(out.Bytes())), 2)
+
+		if err != nil {
+			return err
+		}
+
+		res, err := readAll(cis)
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", codec, err)
+		}
+
+		if bytes.Equal(input, res) == false {
+			return fmt.Errorf("%s: decompressed data differs from input (entropy lanes)", codec)
+		}
+	}
+
+	invalid := []map[string]interface{}{
+		{"entropy:lanes": uint(0)},
+		{"entropy:lanes": uint(17)},
+		{"entropy:lanes": 4},
+		{"entropy:lanes": uint(4), "tpaq:warm": true},
+	}
+
+	for _, options := range invalid {
+		ctx := map[string]interface{}{"codec": "TPAQ", "transform": "NONE", "blockSize": uint(65536),
+			"jobs": uint(1), "checksum": false}
+
+		for k, v := range options {
+			ctx[k] = v
+		}
+
+		if _, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx); err == nil {
+			return fmt.Errorf("Expected an error for invalid entropy lanes options %v", options)
+		}
+	}
+
+	return nil
+}
+
+func TestStreamEntropyStats(b *testing.T) {
+	if err := testStreamEntropyStats(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The stats collector registers the blocks of all the tasks of a stream
+func testStreamEntropyStats() error {
+	words := []string{"stream ", "block ", "task ", "collector\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 4*65536 {
+		buf.WriteString(words[rand.Intn(len(words))])
+	}
+
+	input := buf.Bytes()[0 : 4*65536]
+	collector := entropy.NewStatsCollector()
+	var out bytes.Buffer
+	ctx := map[string]interface{}{"codec": "CM", "transform": "NONE", "blockSize": uint(65536),
+		"jobs": uint(4), "checksum": false, "entropyStats": collector, "modelSampling": uint(8)}
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&out}, ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	stats := collector.Stats()
+
+	if stats.Blocks != 4 || stats.Symbols != uint64(len(input)) || stats.Codecs["CM"] != 4 {
+		return fmt.Errorf("Unexpected stream statistics: %d blocks, %d symbols, codecs %v",
+			stats.Blocks, stats.Symbols, stats.Codecs)
+	}
+
+	if stats.ActualBits == 0 || stats.ActualBits > uint64(8*out.Len()) || stats.ModelBits != uint64(len(input)) {
+		return fmt.Errorf("Unexpected stream statistics: %d bits for %d bytes, %d model bits",
+			stats.ActualBits, out.Len(), stats.ModelBits)
+	}
+
+	return nil
+}
+
+func TestCompressedReader(b *testing.T) {
+	if err := testCompressedReader(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Random access to the blocks of an indexed stream
+func testCompressedReader() error {
+	input := make([]byte, 20*16384+777)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>13)+1))
+	}
+
+	for _, t := range []struct {
+		codec, transform string
+		jobs             uint
+		checksum         bool
+	}{
+		{"ANS0", "LZ", 4, true},
+		{"HUFFMAN", "BWT+MTFT+ZRLT", 1, false},
+		{"TPAQ", "NONE", 2, true},
+	} {
+		var buf bytes.Buffer
+		ctx := map[string]interface{}{"codec": t.codec, "transform": t.transform, "blockSize": uint(16384),
+			"jobs": t.jobs, "checksum": t.checksum, "index": true}
+		cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = cos.Write(input); err != nil {
+			return err
+		}
+
+		if err = cos.Close(); err != nil {
+			return fmt.Errorf("%v/%v: %v", t.codec, t.transform, err)
+		}
+
+		// The indexed stream can be decoded sequentially
+		cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 3)
+
+		if err != nil {
+			return err
+		}
+
+		output, err := readAll(cis)
+		cis.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("%v/%v: decompressed data differs from input", t.codec, t.transform)
+		}
+
+		cr, err := kio.NewCompressedReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+		if err != nil {
+			return fmt.Errorf("%v/%v: %v", t.codec, t.transform, err)
+		}
+
+		if cr.Size() != int64(len(input)) || len(cr.Index()) != 21 {
+			return fmt.Errorf("%v/%v: unexpected index: %d bytes, %d blocks", t.codec, t.transform, cr.Size(), len(cr.Index()))
+		}
+
+		for i := 0; i < 50; i++ {
+			off := rand.Intn(len(input))
+			p := make([]byte, rand.Intn(40000))
+			n, err := cr.ReadAt(p, int64(off))
+			expected := len(input) - off
+
+			if expected > len(p) {
+				expected = len(p)
+			}
+
+			if n != expected || (n < len(p) && err == nil) || (n == len(p) && err != nil) {
+				return fmt.Errorf("%v/%v: ReadAt(%d, %d): %d bytes read, error %v", t.codec, t.transform, len(p), off, n, err)
+			}
+
+			if bytes.Equal(p[0:n], input[off:off+n]) == false {
+				return fmt.Errorf("%v/%v: ReadAt(%d, %d): data differs from input", t.codec, t.transform, len(p), off)
+			}
+		}
+
+		if _, err = cr.Seek(-1000, os.SEEK_END); err != nil {
+			return err
+		}
+
+		output, err = ioutil.ReadAll(cr)
+
+		if err != nil || bytes.Equal(output, input[len(input)-1000:]) == false {
+			return fmt.Errorf("%v/%v: invalid data after Seek (%v)", t.codec, t.transform, err)
+		}
+
+		cr.Close()
+	}
+
+	// A stream without index
+	var buf bytes.Buffer
+	cos, _ := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "LZ", 16384, 1, true)
+	cos.Write(input)
+	cos.Close()
+
+	if _, err := kio.NewCompressedReader(bytes.NewReader(buf.Bytes()), int64(buf.Len())); err == nil {
+		return fmt.Errorf("Expected an error for a stream without index")
+	}
+
+	// A corrupted index
+	buf.Reset()
+	ctx := map[string]interface{}{"codec": "HUFFMAN", "transform": "LZ", "blockSize": uint(16384),
+		"jobs": uint(1), "checksum": true, "index": true}
+	cos, _ = kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+	cos.Write(input)
+	cos.Close()
+	data := buf.Bytes()
+	data[len(data)-40] ^= 1
+
+	if _, err := kio.NewCompressedReader(bytes.NewReader(data), int64(len(data))); err == nil {
+		return fmt.Errorf("Expected an error for a corrupted index")
+	}
+
+	ctx["codec"] = "TPAQ"
+	ctx["tpaq:warm"] = true
+
+	if _, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx); err == nil {
+		return fmt.Errorf("Expected an error for an index with the TPAQ warm model")
+	}
+
+	return nil
+}
+
+func TestCompressedReaderPrefetch(b *testing.T) {
+	if err := testCompressedReaderPrefetch(); err != nil {
+		b.Error(err)
+	}
+}
+
+// A slow io.ReaderAt recording the maximum number of concurrent reads
+type slowReaderAt struct {
+	src     io.ReaderAt
+	current int32
+	max     int32
+}
+
+func (this *slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := atomic.AddInt32(&this.current, 1)
+	defer atomic.AddInt32(&this.current, -1)
+
+	for {
+		max := atomic.LoadInt32(&this.max)
+
+		if n <= max || atomic.CompareAndSwapInt32(&this.max, max, n) == true {
+			break
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	return this.src.ReadAt(p, off)
+}
+
+// Sequential reads decode the next blocks concurrently
+func testCompressedReaderPrefetch() error {
+	input := bytes.Repeat([]byte("The blocks of the lookahead are decoded concurrently. "), 12000)
+	var buf bytes.Buffer
+	ctx := map[string]interface{}{"codec": "ANS0", "transform": "BWT", "blockSize": uint(16384),
+		"jobs": uint(4), "checksum": true, "index": true}
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+	if err != nil {
+		return err
+	}
+
+	cos.Write(input)
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	for _, t := range []struct {
+		jobs, lookahead uint
+		concurrent      bool
+	}{
+		{1, 0, false},
+		{4, 8, true},
+		{4, 0, false},
+	} {
+		src := &slowReaderAt{src: bytes.NewReader(buf.Bytes())}
+		ctx := map[string]interface{}{"jobs": t.jobs, "lookahead": t.lookahead}
+		cr, err := kio.NewCompressedReaderWithCtx(src, int64(buf.Len()), ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output, err := ioutil.ReadAll(cr)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("jobs %d, lookahead %d: invalid data", t.jobs, t.lookahead)
+		}
+
+		// Concurrent random reads
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+
+			go func(seed int64) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(seed))
+				off := rnd.Intn(len(input) - 40000)
+				p := make([]byte, 40000)
+
+				if _, err := cr.ReadAt(p, int64(off)); err != nil || bytes.Equal(p, input[off:off+len(p)]) == false {
+					errs <- fmt.Errorf("jobs %d, lookahead %d: invalid data at offset %d (%v)", t.jobs, t.lookahead, off, err)
+				}
+			}(int64(i))
+		}
+
+		wg.Wait()
+		close(errs)
+
+		if err = <-errs; err != nil {
+			return err
+		}
+
+		if err = cr.Close(); err != nil {
+			return err
+		}
+
+		if _, err = cr.ReadAt(make([]byte, 10), 0); err == nil {
+			return fmt.Errorf("Expected an error after Close")
+		}
+
+		if t.concurrent == true && src.max < 2 {
+			return fmt.Errorf("jobs %d, lookahead %d: expected concurrent reads", t.jobs, t.lookahead)
+		}
+
+		if t.jobs == 1 && src.max > 1 {
+			return fmt.Errorf("jobs 1: %d concurrent reads", src.max)
+		}
+	}
+
+	ctx = map[string]interface{}{"jobs": uint(0)}
+
+	if _, err = kio.NewCompressedReaderWithCtx(bytes.NewReader(buf.Bytes()), int64(buf.Len()), ctx); err == nil {
+		return fmt.Errorf("Expected an error for 0 jobs")
+	}
+
+	return nil
+}
+
+func TestPackedIndex(b *testing.T) {
+	if err := testPackedIndex(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testPackedIndex() error {
+	// More than 2 pages of entries
+	nbBlocks := 2*kio.INDEX_PAGE_ENTRIES + 100
+	input := make([]byte, nbBlocks*1024-300)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(1+(i>>14)&7))
+	}
+
+	params := map[string]interface{}{"blockSize": uint(1024), "index": true}
+	flat, err := compressStream(input, params)
+
+	if err != nil {
+		return err
+	}
+
+	params["packedIndex"] = true
+	packed, err := compressStream(input, params)
+
+	if err != nil {
+		return err
+	}
+
+	// Same blocks, smaller index
+	if len(flat)-len(packed) < nbBlocks*kio.INDEX_ENTRY_SIZE/2 {
+		return fmt.Errorf("Packed index too large: %d bytes, flat index: %d bytes", len(packed), len(flat))
+	}
+
+	expected, _, err := kio.ReadIndex(bytes.NewReader(flat), int64(len(flat)))
+
+	if err != nil {
+		return err
+	}
+
+	entries, size, err := kio.ReadIndex(bytes.NewReader(packed), int64(len(packed)))
+
+	if err != nil {
+		return err
+	}
+
+	if size != int64(len(input)) || len(entries) != nbBlocks {
+		return fmt.Errorf("Invalid packed index: %d bytes, %d blocks", size, len(entries))
+	}
+
+	for i := range entries {
+		if entries[i] != expected[i] {
+			return fmt.Errorf("Invalid entry %d of the packed index: %+v, expected %+v", i, entries[i], expected[i])
+		}
+	}
+
+	// The packed index is skipped between concatenated streams
+	decoded, err := decompressStream(append(append([]byte{}, packed...), flat...), nil)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(decoded, append(append([]byte{}, input...), input...)) == false {
+		return fmt.Errorf("Invalid decoded data after a packed index")
+	}
+
+	// Damaged last page: the reader only loads the pages of the blocks read
+	damaged := append([]byte{}, packed...)
+	dirPos := len(damaged) - kio.INDEX_TRAILER_SIZE - 3*kio.INDEX_PAGE_SIZE
+	damaged[dirPos-10] ^= 0x01
+	cr, err := kio.NewCompressedReaderWithCtx(bytes.NewReader(damaged), int64(len(damaged)),
+		map[string]interface{}{"jobs": uint(4)})
+
+	if err != nil {
+		return err
+	}
+
+	defer cr.Close()
+
+	for i := 0; i < 100; i++ {
+		off := rand.Intn(2*kio.INDEX_PAGE_ENTRIES*1024 - 5000)
+		p := make([]byte, 1+rand.Intn(5000))
+
+		if n, err := cr.ReadAt(p, int64(off)); err != nil || bytes.Equal(p[0:n], input[off:off+n]) == false {
+			return fmt.Errorf("ReadAt(%d, %d): %d bytes read, error %v", len(p), off, n, err)
+		}
+	}
+
+	var ioErr *kio.IOError
+
+	if _, err = cr.ReadAt(make([]byte, 10), int64(len(input)-10)); errors.As(err, &ioErr) == false ||
+		ioErr.ErrorCode() != kanzi.ERR_CRC_CHECK {
+		return fmt.Errorf("Expected a checksum error in the last page, got %v", err)
+	}
+
+	if cr.Index() != nil {
+		return fmt.Errorf("Expected no index with a damaged page")
+	}
+
+	if _, _, err = kio.ReadIndex(bytes.NewReader(damaged), int64(len(damaged))); err == nil {
+		return fmt.Errorf("Expected an error for the damaged packed index")
+	}
+
+	// In salvage mode, the blocks are found by decoding the stream
+	salvaged, err := kio.NewCompressedReaderWithCtx(bytes.NewReader(damaged), int64(len(damaged)),
+		map[string]interface{}{"jobs": uint(2), "salvage": true})
+
+	if err != nil {
+		return err
+	}
+
+	defer salvaged.Close()
+	tail := make([]byte, 5000)
+
+	if _, err = salvaged.ReadAt(tail, int64(len(input)-len(tail))); err != nil || len(salvaged.Lost()) != 0 ||
+		bytes.Equal(tail, input[len(input)-len(tail):]) == false {
+		return fmt.Errorf("Invalid data in salvage mode: error %v, lost %v", err, salvaged.Lost())
+	}
+
+	// The packed index requires the block index
+	if _, err = compressStream(input, map[string]interface{}{"packedIndex": true}); err == nil {
+		return fmt.Errorf("Expected an error for a packed index without index")
+	}
+
+	return nil
+}
+
+func TestReadPlan(b *testing.T) {
+	if err := testReadPlan(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testReadPlan() error {
+	const blockSize = 4096
+	input := make([]byte, 64*blockSize-100)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(1+(i>>12)&15))
+	}
+
+	// Unordered and overlapping ranges, one of them empty
+	ranges := []kio.ByteRange{{Offset: 200000, Length: 30000}, {Offset: 10, Length: 100},
+		{Offset: 5000, Length: 0}, {Offset: 210000, Length: 100}, {Offset: 4000, Length: 9000},
+		{Offset: int64(len(input)) - 5000, Length: 5000}}
+
+	for _, packed := range []bool{false, true} {
+		output, err := compressStream(input, map[string]interface{}{"transform": "LZ", "blockSize": uint(blockSize),
+			"index": true, "packedIndex": packed})
+
+		if err != nil {
+			return err
+		}
+
+		cr, err := kio.NewCompressedReaderWithCtx(bytes.NewReader(output), int64(len(output)),
+			map[string]interface{}{"jobs": uint(3)})
+
+		if err != nil {
+			return err
+		}
+
+		defer cr.Close()
+		plan, err := cr.Plan(ranges)
+
+		if err != nil {
+			return err
+		}
+
+		// Blocks of the ranges, once each and in stream order
+		expected := make([]int, 0)
+
+		for blk := 0; blk*blockSize < len(input); blk++ {
+			for _, r := range ranges {
+				if r.Length > 0 && int64(blk*blockSize) < r.Offset+r.Length && int64((blk+1)*blockSize) > r.Offset {
+					expected = append(expected, blk)
+					break
+				}
+			}
+		}
+
+		if fmt.Sprint(plan.Blocks) != fmt.Sprint(expected) || plan.Size <= 0 || plan.Size >= int64(len(output)) {
+			return fmt.Errorf("Invalid plan (packed index: %v): blocks %v, expected %v, %d bytes", packed, plan.Blocks, expected, plan.Size)
+		}
+
+		decoded := make([][]byte, len(ranges))
+		last := int64(-1)
+
+		err = cr.ReadRanges(plan, func(rng int, data []byte) error {
+			// Delivered in order of offset
+			if ranges[rng].Offset < last {
+				return fmt.Errorf("Range %d delivered out of order", rng)
+			}
+
+			last = ranges[rng].Offset
+			decoded[rng] = append(decoded[rng], data...)
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for i, r := range ranges {
+			if bytes.Equal(decoded[i], input[r.Offset:r.Offset+r.Length]) == false {
+				return fmt.Errorf("Invalid data of range %d (packed index: %v)", i, packed)
+			}
+		}
+
+		// The error of the function stops the delivery
+		calls := 0
+		stop := errors.New("stop")
+
+		if err = cr.ReadRanges(plan, func(rng int, data []byte) error { calls++; return stop }); err != stop || calls != 1 {
+			return fmt.Errorf("Expected the error of the function after 1 call, got %v after %d calls", err, calls)
+		}
+
+		if _, err = cr.Plan([]kio.ByteRange{{Offset: int64(len(input)) - 10, Length: 11}}); err == nil {
+			return fmt.Errorf("Expected an error for a range after the end of the data")
+		}
+	}
+
+	return nil
+}
+
+func TestCompressedWriter(b *testing.T) {
+	if err := testCompressedWriter(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Data written out of order (concurrently) then read at random offsets
+func testCompressedWriter() error {
+	input := make([]byte, 64*1000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>12)+1))
+	}
+
+	var buf bytes.Buffer
+	ctx := map[string]interface{}{"codec": "ANS0", "transform": "LZ", "blockSize": uint(16384),
+		"jobs": uint(2), "checksum": true, "index": true}
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+	if err != nil {
+		return err
+	}
+
+	cw, err := kio.NewCompressedWriter(cos, int64(len(input)))
+
+	if err != nil {
+		return err
+	}
+
+	// 64 chunks written by 4 goroutines in random order
+	chunks := rand.Perm(64)
+	errs := make([]error, 4)
+	var wg sync.WaitGroup
+
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+
+		go func(g int) {
+			defer wg.Done()
+
+			for _, c := range chunks[g*16 : (g+1)*16] {
+				if _, err := cw.WriteAt(input[c*1000:(c+1)*1000], int64(c*1000)); err != nil {
+					errs[g] = err
+					return
+				}
+			}
+		}(g)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	if cw.Size() != int64(len(input)) {
+		return fmt.Errorf("Unexpected size of the compressed data: %d", cw.Size())
+	}
+
+	if err = cw.Close(); err != nil {
+		return err
+	}
+
+	cr, err := kio.NewCompressedReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+	if err != nil {
+		return err
+	}
+
+	defer cr.Close()
+	output, err := ioutil.ReadAll(cr)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(input, output) == false {
+		return fmt.Errorf("Decompressed data differs from input")
+	}
+
+	// Write and Seek
+	buf.Reset()
+	cos, _ = kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "NONE", 4096, 1, false)
+	cw, _ = kio.NewCompressedWriter(cos, 100)
+	cw.Seek(10, io.SeekStart)
+	cw.Write(input[10:20])
+
+	if pos, _ := cw.Seek(0, io.SeekEnd); pos != 20 {
+		return fmt.Errorf("Unexpected end position: %d", pos)
+	}
+
+	if _, err = cw.WriteAt(input[15:25], 15); err == nil {
+		return fmt.Errorf("Expected an error for overlapping ranges")
+	}
+
+	if _, err = cw.WriteAt(input[200:400], 200); err == nil {
+		return fmt.Errorf("Expected an error for too much data written ahead")
+	}
+
+	cw.Seek(0, io.SeekStart)
+	cw.Write(input[0:10])
+
+	if _, err = cw.WriteAt(input[5:8], 5); err == nil {
+		return fmt.Errorf("Expected an error for data already compressed")
+	}
+
+	cw.WriteAt(input[30:40], 30)
+
+	if err = cw.Close(); err == nil {
+		return fmt.Errorf("Expected an error for missing data")
+	}
+
+	return nil
+}
+
+func TestArchive(b *testing.T) {
+	if err := testArchive(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Archive of a directory tree (names, modes and modification times)
+func testArchive() error {
+	dir, err := ioutil.TempDir("", "kanzi-archive")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	files := map[string][]byte{
+		"a.txt":       []byte(strings.Repeat("archive entry ", 1000)),
+		"empty":       {},
+		"sub/b.bin":   make([]byte, 100000),
+		"sub/c/d.txt": []byte("d"),
+	}
+
+	for name, data := range files {
+		rand.Read(data)
+		p := filepath.Join(src, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0755)
+
+		if err = ioutil.WriteFile(p, data, 0640); err != nil {
+			return err
+		}
+	}
+
+	mtime := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime)
+	os.Chmod(filepath.Join(src, "sub", "c", "d.txt"), 0600)
+
+	var buf bytes.Buffer
+	cfg := kio.NewConfig("ANS0", "LZ", 65536, 2, true)
+	aw, err := kio.NewArchiveWriter(&nopWriteCloser{&buf}, cfg)
+
+	if err != nil {
+		return err
+	}
+
+	count, err := aw.AddDirectory(src)
+
+	if err != nil {
+		return err
+	}
+
+	// src, sub, sub/c and 4 files
+	if count != 7 {
+		return fmt.Errorf("Expected 7 entries, got %v", count)
+	}
+
+	if err = aw.WriteHeader(&kio.ArchiveEntry{Name: "../evil", Size: 1}); err == nil {
+		return fmt.Errorf("Expected an error for a name outside of the archive")
+	}
+
+	if err = aw.WriteHeader(&kio.ArchiveEntry{Name: "x", Size: 2}); err != nil {
+		return err
+	}
+
+	if _, err = aw.Write([]byte("xyz")); err == nil {
+		return fmt.Errorf("Expected an error for data exceeding the entry size")
+	}
+
+	if err = aw.Close(); err == nil {
+		return fmt.Errorf("Expected an error for an incomplete entry")
+	}
+
+	buf.Reset()
+	aw, _ = kio.NewArchiveWriter(&nopWriteCloser{&buf}, cfg)
+
+	if _, err = aw.AddDirectory(src); err != nil {
+		return err
+	}
+
+	if err = aw.Close(); err != nil {
+		return err
+	}
+
+	archive := buf.Bytes()
+
+	// Skip the data of all entries
+	ar, err := kio.NewArchiveReader(ioutil.NopCloser(bytes.NewReader(archive)), 2)
+
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0)
+
+	for {
+		entry, err := ar.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		names = append(names, entry.Name)
+	}
+
+	ar.Close()
+
+	if len(names) != 7 || names[0] != "src" {
+		return fmt.Errorf("Invalid entries: %v", names)
+	}
+
+	// Extract and compare
+	ar, _ = kio.NewArchiveReader(ioutil.NopCloser(bytes.NewReader(archive)), 1)
+	dst := filepath.Join(dir, "dst")
+
+	if count, err = ar.Extract(dst); err != nil {
+		return err
+	}
+
+	ar.Close()
+
+	if count != 7 {
+		return fmt.Errorf("Expected 7 extracted entries, got %v", count)
+	}
+
+	for name, data := range files {
+		p := filepath.Join(dst, "src", filepath.FromSlash(name))
+		output, err := ioutil.ReadFile(p)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(output, data) == false {
+			return fmt.Errorf("Invalid data for entry '%v'", name)
+		}
+	}
+
+	if fi, err := os.Stat(filepath.Join(dst, "src", "a.txt")); err != nil || fi.ModTime().Equal(mtime) == false {
+		return fmt.Errorf("Invalid modification time for entry 'a.txt' (%v)", err)
+	}
+
+	if fi, err := os.Stat(filepath.Join(dst, "src", "sub", "c", "d.txt")); err != nil || fi.Mode().Perm() != 0600 {
+		return fmt.Errorf("Invalid mode for entry 'd.txt' (%v)", err)
+	}
+
+	// Existing files are not overwritten
+	ar, _ = kio.NewArchiveReader(ioutil.NopCloser(bytes.NewReader(archive)), 1)
+
+	if _, err = ar.Extract(dst); err == nil {
+		return fmt.Errorf("Expected an error for an existing file")
+	}
+
+	ar.Close()
+
+	// Not an archive
+	buf.Reset()
+	cos, _ := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "NONE", 65536, 1, false)
+	cos.Write([]byte("not an archive"))
+	cos.Close()
+
+	if _, err = kio.NewArchiveReader(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 1); err == nil {
+		return fmt.Errorf("Expected an error for a stream without archive magic")
+	}
+
+	return nil
+}
+
+func TestConcatenatedStreams(b *testing.T) {
+	if err := testConcatenatedStreams(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Streams with different parameters decoded as one stream
+func testConcatenatedStreams() error {
+	var buf bytes.Buffer
+	var input []byte
+	ctxs := []map[string]interface{}{
+		{"codec": "HUFFMAN", "transform": "LZ", "blockSize": uint(16384), "checksum": true},
+		{"codec": "ANS0", "transform": "NONE", "blockSize": uint(65536), "checksum": false, "index": true},
+		{"codec": "TPAQ", "transform": "BWT", "blockSize": uint(32768), "checksum": true, "tpaq:warm": true},
+		{"codec": "NONE", "transform": "NONE", "blockSize": uint(1024), "checksum": false},
+		{"codec": "FPAQ", "transform": "RLT", "blockSize": uint(4096), "checksum": false, "index": true},
+	}
+
+	for i, ctx := range ctxs {
+		// The last stream is empty
+		data := make([]byte, (i&2)*10000+(i&1)*7777+(1-i/3)*555)
+
+		for j := range data {
+			data[j] = byte(65 + rand.Intn(4*(j>>12)+1))
+		}
+
+		ctx["jobs"] = uint(2)
+		cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		cos.Write(data)
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		input = append(input, data...)
+	}
+
+	compressed := buf.Bytes()
+
+	for _, jobs := range []uint{1, 3} {
+		// Trailing data that is not a stream is ignored
+		for _, trailer := range [][]byte{nil, []byte("trailing garbage")} {
+			data := append(append([]byte{}, compressed...), trailer...)
+			cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(data)), jobs)
+
+			if err != nil {
+				return err
+			}
+
+			output, err := readAll(cis)
+			cis.Close()
+
+			if err != nil {
+				return err
+			}
+
+			if bytes.Equal(output, input) == false {
+				return fmt.Errorf("Invalid output for concatenated streams (jobs=%v): %v bytes, expected %v",
+					jobs, len(output), len(input))
+			}
+		}
+
+		// Same with NextBlock
+		cis, _ := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(compressed)), jobs)
+		output := make([]byte, 0, len(input))
+
+		for {
+			blk, err := cis.NextBlock()
+
+			if err != nil {
+				return err
+			}
+
+			if blk == nil {
+				break
+			}
+
+			output = append(output, blk.Data...)
+		}
+
+		cis.Close()
+
+		if bytes.Equal(output, input) == false {
+			return fmt.Errorf("Invalid output for concatenated streams with NextBlock (jobs=%v)", jobs)
+		}
+	}
+
+	// Appended archives
+	buf.Reset()
+	cfg := kio.NewConfig("HUFFMAN", "NONE", 65536, 1, false)
+
+	for _, name := range []string{"a", "b"} {
+		aw, _ := kio.NewArchiveWriter(&nopWriteCloser{&buf}, cfg)
+		aw.WriteHeader(&kio.ArchiveEntry{Name: name, Size: 3, Mode: 0644})
+		aw.Write([]byte(name + name + name))
+
+		if err := aw.Close(); err != nil {
+			return err
+		}
+	}
+
+	ar, err := kio.NewArchiveReader(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 1)
+
+	if err != nil {
+		return err
+	}
+
+	defer ar.Close()
+	names := ""
+
+	for {
+		entry, err := ar.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		names += entry.Name
+	}
+
+	if names != "ab" {
+		return fmt.Errorf("Invalid entries for appended archives: '%v'", names)
+	}
+
+	return nil
+}
+
+func TestAppendingOutputStream(b *testing.T) {
+	if err := testAppendingOutputStream(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Append data to indexed and non indexed streams
+func testAppendingOutputStream() error {
+	dir, err := ioutil.TempDir("", "kanzi-append")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+
+	for _, ctx := range []map[string]interface{}{
+		{"codec": "ANS0", "transform": "LZ", "blockSize": uint(16384), "checksum": true, "index": true},
+		{"codec": "FPAQ", "transform": "RLT", "blockSize": uint(8192), "checksum": false, "index": true,
+			"entropy:lanes": uint(4)},
+		{"codec": "ANS1", "transform": "TEXT", "blockSize": uint(4096), "checksum": true, "index": true,
+			"packedIndex": true},
+		{"codec": "HUFFMAN", "transform": "BWT+MTFT+ZRLT", "blockSize": uint(16384), "checksum": true},
+	} {
+		name := filepath.Join(dir, ctx["codec"].(string)+".knz")
+		f, err := os.Create(name)
+
+		if err != nil {
+			return err
+		}
+
+		ctx["jobs"] = uint(2)
+		cos, err := kio.NewCompressedOutputStreamWithCtx(f, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		var input []byte
+
+		for i := 0; i < 4; i++ {
+			data := make([]byte, 10000+i*13333)
+
+			for j := range data {
+				data[j] = byte(65 + rand.Intn(4*(j>>11)+i+1))
+			}
+
+			if i > 0 {
+				// The codec of the map is ignored: the stream parameters apply
+				f, _ = os.OpenFile(name, os.O_RDWR, 0666)
+				cos, err = kio.NewAppendingOutputStream(f, map[string]interface{}{"jobs": uint(i), "codec": "TPAQ"})
+
+				if err != nil {
+					return err
+				}
+			}
+
+			cos.Write(data)
+
+			if err = cos.Close(); err != nil {
+				return err
+			}
+
+			f.Close()
+			input = append(input, data...)
+		}
+
+		compressed, _ := ioutil.ReadFile(name)
+		cis, _ := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(compressed)), 2)
+		output, err := readAll(cis)
+		cis.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(output, input) == false {
+			return fmt.Errorf("%v: invalid output after append: %v bytes, expected %v",
+				ctx["codec"], len(output), len(input))
+		}
+
+		if ctx["index"] == nil {
+			continue
+		}
+
+		// One stream: random access to all the blocks
+		cr, err := kio.NewCompressedReader(bytes.NewReader(compressed), int64(len(compressed)))
+
+		if err != nil {
+			return err
+		}
+
+		if cr.Size() != int64(len(input)) {
+			return fmt.Errorf("%v: invalid size after append: %v, expected %v", ctx["codec"], cr.Size(), len(input))
+		}
+
+		for i := 0; i < 20; i++ {
+			off := rand.Intn(len(input) - 1000)
+			buf := make([]byte, 1000)
+
+			if _, err = cr.ReadAt(buf, int64(off)); err != nil {
+				return err
+			}
+
+			if bytes.Equal(buf, input[off:off+1000]) == false {
+				return fmt.Errorf("%v: invalid data at offset %v after append", ctx["codec"], off)
+			}
+		}
+
+		cr.Close()
+	}
+
+	return nil
+}
+
+func TestBlockChecksums(b *testing.T) {
+	if err := testBlockChecksums(); err != nil {
+		b.Error(err)
+	}
+}
+
+func compressChecksums(input []byte, codec, transform, checksumType string, digest, index bool) ([]byte, error) {
+	params := map[string]interface{}{"codec": codec, "transform": transform, "jobs": uint(4),
+		"checksum": len(checksumType) != 0, "streamDigest": digest, "index": index}
+
+	if len(checksumType) != 0 {
+		params["checksumType"] = checksumType
+	}
+
+	return compressStream(input, params)
+}
+
+func testBlockChecksums() error {
+	input := make([]byte, 300000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>12)+1))
+	}
+
+	var all bytes.Buffer
+
+	for _, name := range []string{"", kio.CHECKSUM_XXHASH32, kio.CHECKSUM_XXHASH64, "sha256"} {
+		for _, digest := range []bool{false, true} {
+			fmt.Printf("Checksum %q, digest %v\n", name, digest)
+			output, err := compressChecksums(input, "ANS0", "LZ", name, digest, name == kio.CHECKSUM_XXHASH64)
+
+			if err != nil {
+				return err
+			}
+
+			all.Write(output)
+			hdr, err := kio.ParseStreamHeader(output)
+
+			if err != nil {
+				return err
+			}
+
+			version, checksumType := uint8(kio.STREAM_MIN_VERSION), uint8(kio.CHECKSUM_TYPE_XXHASH32)
+
+			if name == kio.CHECKSUM_XXHASH64 {
+				checksumType = kio.CHECKSUM_TYPE_XXHASH64
+			} else if name == "sha256" {
+				checksumType = kio.CHECKSUM_TYPE_SHA256
+			}
+
+			if checksumType != kio.CHECKSUM_TYPE_XXHASH32 || digest == true {
+				version = kio.STREAM_EXT_VERSION
+			}
+
+			if hdr.Version != version || hdr.ChecksumType != checksumType || hdr.Digest != digest {
+				return fmt.Errorf("Invalid stream header: %+v", *hdr)
+			}
+
+			cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(output)), 2)
+
+			if err != nil {
+				return err
+			}
+
+			decoded, err := readAll(cis)
+
+			if err != nil {
+				return err
+			}
+
+			if bytes.Equal(decoded, input) == false {
+				return fmt.Errorf("Invalid decoded data")
+			}
+
+			report, err := kio.VerifyStream(ioutil.NopCloser(bytes.NewReader(output)), 4)
+
+			if err != nil {
+				return err
+			}
+
+			if report.Streams != 1 || report.Blocks != 5 || report.Bytes != int64(len(input)) ||
+				report.Checksum != strings.ToUpper(name) || report.Digest != digest {
+				return fmt.Errorf("Invalid verify report: %+v", *report)
+			}
+
+			// Corrupted block (stored blocks: only detected by the checksum or the digest)
+			if output, err = compressChecksums(input, "NONE", "NONE", name, digest, false); err != nil {
+				return err
+			}
+
+			output[len(output)/2] ^= 0x10
+			_, err = kio.VerifyStream(ioutil.NopCloser(bytes.NewReader(output)), 4)
+
+			if len(name) == 0 && digest == false {
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if err == nil || (strings.Contains(err.Error(), "checksum") || strings.Contains(err.Error(), "digest")) == false {
+				return fmt.Errorf("Corrupted block not detected: %v", err)
+			}
+
+			fmt.Printf("Corrupted block: %v\n", err)
+			output[len(output)/2] ^= 0x10
+
+			if digest == false {
+				continue
+			}
+
+			// Corrupted digest (at the end of a stream without index)
+			output[len(output)-1] ^= 0x01
+			_, err = kio.VerifyStream(ioutil.NopCloser(bytes.NewReader(output)), 4)
+
+			if err == nil || strings.Contains(err.Error(), "digest") == false {
+				return fmt.Errorf("Corrupted digest not detected: %v", err)
+			}
+		}
+	}
+
+	// Concatenated streams (with digests and indexes)
+	report, err := kio.VerifyStream(ioutil.NopCloser(bytes.NewReader(all.Bytes())), 3)
+
+	if err != nil {
+		return err
+	}
+
+	if report.Streams != 8 || report.Blocks != 40 || report.Bytes != int64(8*len(input)) {
+		return fmt.Errorf("Invalid verify report: %+v", *report)
+	}
+
+	// Indexed stream with a digest
+	output, err := compressChecksums(input, "ANS0", "LZ", kio.CHECKSUM_SHA256, true, true)
+
+	if err != nil {
+		return err
+	}
+
+	cr, err := kio.NewCompressedReader(bytes.NewReader(output), int64(len(output)))
+
+	if err != nil {
+		return err
+	}
+
+	block := make([]byte, 1000)
+
+	if _, err = cr.ReadAt(block, 200000); err != nil {
+		return err
+	}
+
+	if bytes.Equal(block, input[200000:201000]) == false {
+		return fmt.Errorf("Invalid data read from indexed stream")
+	}
+
+	// A checksum type requires the checksum option
+	ctx := map[string]interface{}{"codec": "ANS0", "transform": "LZ", "blockSize": uint(64 * 1024),
+		"jobs": uint(1), "checksum": false, "checksumType": kio.CHECKSUM_SHA256}
+
+	if _, err = kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&bytes.Buffer{}}, ctx); err == nil {
+		return fmt.Errorf("Checksum type accepted without checksum")
+	}
+
+	ctx["checksum"] = true
+	info, err := kio.DescribePipeline(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if info.Version != kio.STREAM_EXT_VERSION || info.HeaderBits != 8*(kio.STREAM_HEADER_SIZE+kio.STREAM_HEADER_EXT_SIZE) {
+		return fmt.Errorf("Invalid pipeline header: version %d, %d bits", info.Version, info.HeaderBits)
+	}
+
+	return nil
+}
+
+func TestEncryption(b *testing.T) {
+	if err := testEncryption(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testEncryption() error {
+	// RFC 7914 test vectors
+	for _, v := range []struct {
+		password, salt string
+		n, r, p        int
+		expected       string
+	}{
+		{"", "", 16, 1, 1, "77d6576238657b203b19ca42c18a0497f16b4844e3074ae8dfdffa3fede21442" +
+			"fcd0069ded0948f8326a753a0fc81f17e8d3e0fb2e0d3628cf35e20c38d18906"},
+		{"password", "NaCl", 1024, 8, 16, "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b373162" +
+			"2eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640"},
+	} {
+		key, err := hash.Scrypt([]byte(v.password), []byte(v.salt), v.n, v.r, v.p, 64)
+
+		if err != nil {
+			return err
+		}
+
+		if fmt.Sprintf("%x", key) != v.expected {
+			return fmt.Errorf("Invalid scrypt key: %x", key)
+		}
+	}
+
+	// RFC 5869 test vectors (SHA-256)
+	ikm := bytes.Repeat([]byte{0x0b}, 22)
+
+	for _, v := range []struct {
+		salt, info, expected string
+	}{
+		{"000102030405060708090a0b0c", "f0f1f2f3f4f5f6f7f8f9", "3cb25f25faacd57a90434f64d0362f2a" +
+			"2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"},
+		{"", "", "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8"},
+	} {
+		salt, _ := hex.DecodeString(v.salt)
+		info, _ := hex.DecodeString(v.info)
+		key, err := hash.HKDF(ikm, salt, info, 42)
+
+		if err != nil {
+			return err
+		}
+
+		if fmt.Sprintf("%x", key) != v.expected {
+			return fmt.Errorf("Invalid HKDF key: %x", key)
+		}
+	}
+
+	input := make([]byte, 500000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>12)+1))
+	}
+
+	key := make([]byte, kio.ENCRYPTION_KEY_SIZE)
+	rand.Read(key)
+
+	for _, p := range []struct {
+		key   string
+		value interface{}
+	}{{"passphrase", "correct horse battery staple"}, {"encryptionKey", key}} {
+		fmt.Printf("Encryption with %s\n", p.key)
+		output, err := compressStream(input, map[string]interface{}{"transform": "LZ", "checksum": false, p.key: p.value})
+
+		if err != nil {
+			return err
+		}
+
+		if len(output) < 2*kio.ENCRYPTION_SEGMENT_SIZE || bytes.Contains(output, []byte("KANZ")) == true {
+			return fmt.Errorf("Invalid encrypted stream (%d bytes)", len(output))
+		}
+
+		decoded, err := decompressStream(output, map[string]interface{}{p.key: p.value})
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(decoded, input) == false {
+			return fmt.Errorf("Invalid decrypted data")
+		}
+
+		// A different salt for each stream
+		if output2, err := compressStream(input, map[string]interface{}{"transform": "LZ", "checksum": false, p.key: p.value}); err != nil || bytes.Equal(output, output2) == true {
+			return fmt.Errorf("Identical encrypted streams (%v)", err)
+		}
+
+		if _, err = decompressStream(output, nil); err == nil || strings.Contains(err.Error(), "Encrypted") == false {
+			return fmt.Errorf("Encrypted stream decoded without key: %v", err)
+		}
+
+		// Modified, truncated and extended streams
+		corrupted := append([]byte(nil), output...)
+		corrupted[kio.ENCRYPTION_SEGMENT_SIZE+100] ^= 1
+
+		for _, data := range [][]byte{corrupted, output[0 : 2*kio.ENCRYPTION_SEGMENT_SIZE], output[0 : len(output)-1]} {
+			if decoded, err = decompressStream(data, map[string]interface{}{p.key: p.value}); err == nil {
+				return fmt.Errorf("Corrupted encrypted stream not detected")
+			}
+
+			fmt.Printf("Corrupted stream: %v\n", err)
+		}
+	}
+
+	output, err := compressStream(input, map[string]interface{}{"transform": "LZ", "checksum": false, "passphrase": "secret"})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = decompressStream(output, map[string]interface{}{"passphrase": "Secret"}); err == nil {
+		return fmt.Errorf("Wrong passphrase not detected")
+	}
+
+	if _, err = decompressStream(output, map[string]interface{}{"encryptionKey": key}); err == nil {
+		return fmt.Errorf("Wrong key not detected")
+	}
+
+	// Unbounded key derivation parameters (cost, block size, parallelization)
+	for i, val := range []byte{kio.ENCRYPTION_SCRYPT_MAX_LOG_COST + 1, kio.ENCRYPTION_SCRYPT_MAX_BLOCK_SIZE + 1,
+		kio.ENCRYPTION_SCRYPT_MAX_PARALLELISM + 1} {
+		corrupted := append([]byte(nil), output...)
+		corrupted[7+i] = val
+
+		if _, err = decompressStream(corrupted, map[string]interface{}{"passphrase": "secret"}); errors.Is(err, &kanzi.ErrCorruptStream{}) == false {
+			return fmt.Errorf("Invalid key derivation parameters not detected: %v", err)
+		}
+
+		corrupted[7+i] = 0
+
+		if _, err = decompressStream(corrupted, map[string]interface{}{"passphrase": "secret"}); errors.Is(err, &kanzi.ErrCorruptStream{}) == false {
+			return fmt.Errorf("Invalid key derivation parameters not detected: %v", err)
+		}
+	}
+
+	if _, err = compressStream(input, map[string]interface{}{"transform": "LZ", "checksum": false, "encryptionKey": key[1:]}); err == nil {
+		return fmt.Errorf("Invalid key size not detected")
+	}
+
+	cfg := kio.NewConfig("HUFFMAN", "LZ", 65536, 1, false)
+	cfg.Set("passphrase", "secret")
+
+	if strings.Contains(cfg.String(), "secret") == true {
+		return fmt.Errorf("Passphrase visible in configuration: %s", cfg.String())
+	}
+
+	cfg.Set("index", true)
+
+	if err = cfg.Freeze(); err == nil {
+		return fmt.Errorf("Encryption accepted with a block index")
+	}
+
+	return nil
+}
+
+func TestParity(b *testing.T) {
+	if err := testParity(); err != nil {
+		b.Error(err)
+	}
+}
+
+func decompressParity(output []byte) ([]byte, *counterSink, error) {
+	sink := &counterSink{counters: make(map[string]int64)}
+	cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(bytes.NewReader(output)), 2)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cis.SetMetrics(sink)
+	decoded, err := readAll(cis)
+	return decoded, sink, err
+}
+
+func testParity() error {
+	input := make([]byte, 200000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>12)+1))
+	}
+
+	configs := [][2]string{
+		{"LZ", "ANS0"},
+		{"BWT+RANK+ZRLT", "HUFFMAN"},
+		{"TEXT+LZ", "FPAQ"},
+		{"NONE", "TPAQ"},
+		{"ROLZ", "NONE"},
+		{"RLT", "RANGE"},
+		{"NONE", "CM"},
+	}
+
+	for i, config := range configs {
+		parityShards := uint(2 << uint(i%3))
+		fmt.Printf("%v/%v with %v parity shards\n", config[0], config[1], parityShards)
+		output, err := compressStream(input, map[string]interface{}{"codec": config[1], "transform": config[0], "jobs": uint(4), "parityShards": parityShards})
+
+		if err != nil {
+			return err
+		}
+
+		hdr, err := kio.ParseStreamHeader(output)
+
+		if err != nil {
+			return err
+		}
+
+		if hdr.Version != kio.STREAM_EXT_VERSION || uint(hdr.ParityShards) != parityShards {
+			return fmt.Errorf("Invalid stream header: %+v", *hdr)
+		}
+
+		decoded, _, err := decompressParity(output)
+
+		if err != nil {
+			return fmt.Errorf("%v/%v: %v", config[0], config[1], err)
+		}
+
+		if bytes.Equal(decoded, input) == false {
+			return fmt.Errorf("%v/%v: invalid round trip", config[0], config[1])
+		}
+	}
+
+	// One block: the entropy coded data follows the headers and the checksum
+	input = input[0:60000]
+	reference, err := compressStream(input, map[string]interface{}{"codec": "ANS0", "transform": "LZ", "jobs": uint(4), "parityShards": uint(2)})
+
+	if err != nil {
+		return err
+	}
+
+	size := (len(reference) - 100) * 16 / 18
+	output := make([]byte, len(reference))
+
+	// Damaged shards (at most 2)
+	copy(output, reference)
+
+	for i := 30 + size/2; i < 30+size/2+size/40; i++ {
+		output[i] ^= 0x5A
+	}
+
+	decoded, sink, err := decompressParity(output)
+
+	if err != nil {
+		return fmt.Errorf("Damaged block not repaired: %v", err)
+	}
+
+	if bytes.Equal(decoded, input) == false {
+		return fmt.Errorf("Invalid repaired block")
+	}
+
+	if n := sink.counters[kio.METRIC_DECODER_PREFIX+kio.METRIC_REPAIRED_BLOCKS]; n != 1 {
+		return fmt.Errorf("%v repaired blocks, expected 1", n)
+	}
+
+	// Too many damaged shards
+	copy(output, reference)
+
+	for k := 1; k <= 3; k++ {
+		output[30+k*size/4] ^= 0x01
+	}
+
+	if _, _, err = decompressParity(output); err == nil || strings.Contains(err.Error(), "damaged shards") == false {
+		return fmt.Errorf("Damaged block not detected: %v", err)
+	}
+
+	fmt.Printf("Damaged block: %v\n", err)
+
+	// Invalid number of parity shards
+	if _, err = compressStream(input, map[string]interface{}{"codec": "ANS0", "transform": "LZ", "jobs": uint(4), "parityShards": uint(3)}); err == nil {
+		return fmt.Errorf("Invalid number of parity shards accepted")
+	}
+
+	return nil
+}
+
+func TestStreamDictionaries(b *testing.T) {
+	if err := testStreamDictionaries(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testStreamDictionaries() error {
+	// Small messages sharing most of their content
+	samples := make([][]byte, 300)
+
+	for i := range samples {
+		samples[i] = []byte(fmt.Sprintf(`{"id":%d,"user":"user%d","status":"active","created":"2017-%02d-%02dT10:00:00Z",`+
+			`"roles":["reader","writer"],"settings":{"theme":"dark","language":"en-US","notifications":true},"score":%d}`,
+			rand.Intn(100000), rand.Intn(1000), 1+rand.Intn(12), 1+rand.Intn(28), rand.Intn(1000)))
+	}
+
+	lzDict, err := function.TrainLZDictionary(samples[0:200], 2048)
+
+	if err != nil {
+		return err
+	}
+
+	// LZ dictionary: embedded or referenced
+	plain, embedded, referenced := 0, 0, 0
+
+	for _, msg := range samples[200:] {
+		output, err := compressStream(msg, map[string]interface{}{"transform": "LZ"})
+
+		if err != nil {
+			return err
+		}
+
+		plain += len(output)
+
+		for _, mode := range []string{kio.DICTIONARY_MODE_EMBED, kio.DICTIONARY_MODE_REFERENCE} {
+			params := map[string]interface{}{"transform": "LZ", "lzDictionary": lzDict, "dictionaryMode": mode}
+
+			if output, err = compressStream(msg, params); err != nil {
+				return err
+			}
+
+			if hdr, err := kio.ParseStreamHeader(output); err != nil || hdr.Dictionaries == false {
+				return fmt.Errorf("Invalid stream header: %v", err)
+			}
+
+			var decoded []byte
+
+			if mode == kio.DICTIONARY_MODE_EMBED {
+				// Nothing else needed to decode
+				embedded += len(output)
+				decoded, err = decompressStream(output, nil)
+			} else {
+				referenced += len(output)
+				decoded, err = decompressStream(output, map[string]interface{}{"lzDictionary": lzDict})
+			}
+
+			if err != nil {
+				return fmt.Errorf("Mode %v: %v", mode, err)
+			}
+
+			if bytes.Equal(decoded, msg) == false {
+				return fmt.Errorf("Mode %v: invalid round trip", mode)
+			}
+		}
+	}
+
+	fmt.Printf("LZ: %v bytes, embedded dictionary: %v bytes, referenced dictionary: %v bytes\n", plain, embedded, referenced)
+
+	if referenced >= plain*2/3 {
+		return fmt.Errorf("The dictionary does not improve compression: %v bytes (%v without)", referenced, plain)
+	}
+
+	// Missing then registered dictionary
+	other, err := function.NewLZDictionary(bytes.Repeat(samples[0], 3))
+
+	if err != nil {
+		return err
+	}
+
+	output, err := compressStream(samples[1], map[string]interface{}{"transform": "LZ",
+		"lzDictionary": other, "dictionaryMode": kio.DICTIONARY_MODE_REFERENCE})
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = decompressStream(output, map[string]interface{}{"lzDictionary": lzDict}); err == nil ||
+		strings.Contains(err.Error(), "Missing LZ dictionary") == false {
+		return fmt.Errorf("Missing dictionary not detected: %v", err)
+	}
+
+	function.RegisterLZDictionary(other)
+
+	if decoded, err := decompressStream(output, nil); err != nil || bytes.Equal(decoded, samples[1]) == false {
+		return fmt.Errorf("Registered dictionary: invalid round trip (%v)", err)
+	}
+
+	// Text dictionary embedded in the header once instead of in each block
+	words := [][]byte{[]byte("settings"), []byte("notifications"), []byte("language"), []byte("theme"),
+		[]byte("roles"), []byte("reader"), []byte("writer"), []byte("status"), []byte("active")}
+	textDict, err := function.NewTextDictionary(words, true, true)
+
+	if err != nil {
+		return err
+	}
+
+	var sb bytes.Buffer
+
+	for i := 0; i < 6000; i++ {
+		sb.Write(words[rand.Intn(len(words))])
+		sb.WriteString([]string{" ", " the ", ", ", ". The ", " and "}[rand.Intn(5)])
+	}
+
+	input := sb.Bytes()
+	perBlock, err := compressStream(input, map[string]interface{}{"transform": "TEXT", "blockSize": uint(4096),
+		"textDictionary": textDict})
+
+	if err != nil {
+		return err
+	}
+
+	params := map[string]interface{}{"transform": "TEXT+LZ", "blockSize": uint(4096), "textDictionary": textDict,
+		"lzDictionary": lzDict, "dictionaryMode": kio.DICTIONARY_MODE_EMBED}
+
+	if output, err = compressStream(input, params); err != nil {
+		return err
+	}
+
+	header, err := compressStream(input, map[string]interface{}{"transform": "TEXT", "blockSize": uint(4096),
+		"textDictionary": textDict, "dictionaryMode": kio.DICTIONARY_MODE_EMBED})
+
+	if err != nil {
+		return err
+	}
+
+	if len(header) >= len(perBlock) {
+		return fmt.Errorf("Dictionary embedded in each block: %v bytes, in the header: %v bytes", len(perBlock), len(header))
+	}
+
+	// Concatenated streams
+	all := append(append([]byte{}, output...), header...)
+	decoded, err := decompressStream(all, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(decoded, append(append([]byte{}, input...), input...)) == false {
+		return fmt.Errorf("Text dictionary: invalid round trip")
+	}
+
+	// Invalid parameters
+	if _, err = compressStream(input, map[string]interface{}{"transform": "LZ", "blockSize": uint(1024),
+		"dictionaryMode": "embed"}); err == nil {
+		return fmt.Errorf("Dictionary mode without dictionary accepted")
+	}
+
+	if _, err = compressStream(input, map[string]interface{}{"transform": "LZ", "blockSize": uint(1024),
+		"lzDictionary": lzDict, "dictionaryMode": "inline"}); err == nil {
+		return fmt.Errorf("Invalid dictionary mode accepted")
+	}
+
+	return nil
+}
+
+func TestSyncPoints(b *testing.T) {
+	if err := testSyncPoints(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Flushed data decoded before the next writes, then decoding resumed after a
+// damaged block
+func testSyncPoints() error {
+	chunks := make([][]byte, 10)
+
+	for i := range chunks {
+		chunks[i] = []byte(strings.Repeat(fmt.Sprintf("message %d, ", i), 200+i*50))
+	}
+
+	for _, t := range []struct {
+		codec, transform string
+		jobs             uint
+	}{
+		{"HUFFMAN", "LZ", 1},
+		{"ANS0", "BWT+MTFT+ZRLT", 4},
+		{"FPAQ", "TEXT+RLT", 2},
+		{"TPAQ", "NONE", 1},
+	} {
+		// Each chunk must be received before the next one is written
+		pr, pw := io.Pipe()
+		ctx := map[string]interface{}{"codec": t.codec, "transform": t.transform, "blockSize": uint(65536),
+			"jobs": t.jobs, "checksum": true, "syncPoints": true}
+		cos, err := kio.NewCompressedOutputStreamWithCtx(pw, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		ack := make(chan error)
+
+		go func() {
+			cis, _ := kio.NewCompressedInputStream(pr, t.jobs)
+			buf := make([]byte, 65536)
+
+			for _, chunk := range chunks {
+				received := make([]byte, 0, len(chunk))
+
+				for len(received) < len(chunk) {
+					n, err := cis.Read(buf[0 : len(chunk)-len(received)])
+
+					if err != nil || n == 0 {
+						ack <- fmt.Errorf("Cannot read the flushed data: %v", err)
+						return
+					}
+
+					received = append(received, buf[0:n]...)
+				}
+
+				if bytes.Equal(received, chunk) == false {
+					ack <- fmt.Errorf("The flushed data differs from input")
+					return
+				}
+
+				ack <- nil
+			}
+
+			output, err := readAll(cis)
+
+			if err == nil && len(output) != 0 {
+				err = fmt.Errorf("Unexpected data at the end of the stream")
+			}
+
+			ack <- err
+		}()
+
+		for _, chunk := range chunks {
+			cos.Write(chunk)
+
+			if err = cos.Flush(); err != nil {
+				return err
+			}
+
+			select {
+			case err = <-ack:
+			case <-time.After(30 * time.Second):
+				err = fmt.Errorf("The flushed data was not decoded")
+			}
+
+			if err != nil {
+				return fmt.Errorf("%v/%v: %v", t.codec, t.transform, err)
+			}
+		}
+
+		cos.Close()
+		pw.Close()
+
+		if err = <-ack; err != nil {
+			return fmt.Errorf("%v/%v: %v", t.codec, t.transform, err)
+		}
+	}
+
+	// A damaged block: the decoding resumes at the next sync marker
+	var buf bytes.Buffer
+	ctx := map[string]interface{}{"codec": "ANS0", "transform": "LZ", "blockSize": uint(65536),
+		"jobs": uint(2), "checksum": true, "syncPoints": true, "streamDigest": true}
+	cos, _ := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+	offsets := make([]int, len(chunks))
+
+	for i, chunk := range chunks {
+		offsets[i] = buf.Len()
+		cos.Write(chunk)
+		cos.Flush()
+	}
+
+	cos.Close()
+	data := buf.Bytes()
+	hdr, err := kio.ParseStreamHeader(data)
+
+	if err != nil || hdr.SyncPoints == false {
+		return fmt.Errorf("Expected sync points in the stream header (%v)", err)
+	}
+
+	data[(offsets[4]+offsets[5])/2] ^= 0x55
+
+	if _, err = readAll(newInputStream(data, map[string]interface{}{"jobs": uint(2)})); err == nil {
+		return fmt.Errorf("Expected an error for a damaged block")
+	}
+
+	sink := &counterSink{counters: map[string]int64{}}
+	cis := newInputStream(data, map[string]interface{}{"jobs": uint(2), "resync": true})
+	cis.SetMetrics(sink)
+	output, err := readAll(cis)
+
+	if err != nil {
+		return err
+	}
+
+	expected := make([]byte, 0)
+
+	for i, chunk := range chunks {
+		if i != 4 {
+			expected = append(expected, chunk...)
+		}
+	}
+
+	if bytes.Equal(output, expected) == false {
+		return fmt.Errorf("Unexpected data after resync: %d bytes, expected %d", len(output), len(expected))
+	}
+
+	if sink.counters[kio.METRIC_DECODER_PREFIX+kio.METRIC_RESYNCS] != 1 {
+		return fmt.Errorf("Unexpected number of resyncs: %v", sink.counters)
+	}
+
+	// Invalid parameters
+	cos, _ = kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "HUFFMAN", "NONE", 65536, 1, false)
+
+	if err = cos.Flush(); err == nil {
+		return fmt.Errorf("Expected an error for Flush without sync points")
+	}
+
+	ctx = map[string]interface{}{"codec": "TPAQ", "transform": "NONE", "blockSize": uint(65536),
+		"jobs": uint(1), "checksum": false, "syncPoints": true, "tpaq:warm": true}
+
+	if _, err = kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx); err == nil {
+		return fmt.Errorf("Expected an error for sync points with the TPAQ warm model")
+	}
+
+	return nil
+}
+
+func TestPartialBlocks(b *testing.T) {
+	if err := testPartialBlocks(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Write the chunks and flush after each of them
+func flushChunks(chunks [][]byte, params map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, streamParams(params))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chunk := range chunks {
+		if _, err = cos.Write(chunk); err != nil {
+			return nil, err
+		}
+
+		if err = cos.Flush(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = cos.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Flushed data decoded before the next writes, the logical blocks continued
+// after each flush (LZ dictionary of the partial blocks)
+func testPartialBlocks() error {
+	// Variants of the same text: each chunk repeats most of the previous ones
+	rnd := rand.New(rand.NewSource(2504))
+	base := make([]byte, 8000)
+
+	for i := range base {
+		base[i] = byte('a' + rnd.Intn(26))
+	}
+
+	chunks := make([][]byte, 40)
+	input := make([]byte, 0)
+
+	for i := range chunks {
+		size := 1000 + (i*1777)%7000
+
+		if i == 20 {
+			// Spans several blocks
+			size = 150000
+		}
+
+		chunks[i] = make([]byte, size)
+
+		for j := range chunks[i] {
+			chunks[i][j] = base[j%len(base)]
+		}
+
+		for j := 0; j < 20; j++ {
+			chunks[i][rnd.Intn(size)] = byte('A' + rnd.Intn(26))
+		}
+
+		input = append(input, chunks[i]...)
+	}
+
+	for _, t := range []struct {
+		codec, transform string
+		jobs             uint
+	}{
+		{"HUFFMAN", "LZ", 1},
+		{"ANS0", "RLT+LZ", 4},
+		{"ANS0", "BWT+MTFT+ZRLT", 4},
+		{"FPAQ", "TEXT+ROLZ", 2},
+	} {
+		// Each chunk must be received before the next one is written
+		pr, pw := io.Pipe()
+		ctx := map[string]interface{}{"codec": t.codec, "transform": t.transform, "blockSize": uint(65536),
+			"jobs": t.jobs, "checksum": true, "syncPoints": true, "partialBlocks": true}
+		cos, err := kio.NewCompressedOutputStreamWithCtx(pw, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		ack := make(chan error)
+
+		go func() {
+			cis, _ := kio.NewCompressedInputStream(pr, t.jobs)
+			buf := make([]byte, 65536)
+
+			for _, chunk := range chunks {
+				received := make([]byte, 0, len(chunk))
+
+				for len(received) < len(chunk) {
+					sz := len(chunk) - len(received)
+
+					if sz > len(buf) {
+						sz = len(buf)
+					}
+
+					n, err := cis.Read(buf[0:sz])
+
+					if err != nil || n == 0 {
+						ack <- fmt.Errorf("Cannot read the flushed data: %v", err)
+						return
+					}
+
+					received = append(received, buf[0:n]...)
+				}
+
+				if bytes.Equal(received, chunk) == false {
+					ack <- fmt.Errorf("The flushed data differs from input")
+					return
+				}
+
+				ack <- nil
+			}
+
+			output, err := readAll(cis)
+
+			if err == nil && len(output) != 0 {
+				err = fmt.Errorf("Unexpected data at the end of the stream")
+			}
+
+			ack <- err
+		}()
+
+		for _, chunk := range chunks {
+			cos.Write(chunk)
+
+			if err = cos.Flush(); err != nil {
+				return err
+			}
+
+			select {
+			case err = <-ack:
+			case <-time.After(30 * time.Second):
+				err = fmt.Errorf("The flushed data was not decoded")
+			}
+
+			if err != nil {
+				return fmt.Errorf("%v/%v: %v", t.codec, t.transform, err)
+			}
+		}
+
+		cos.Close()
+		pw.Close()
+
+		if err = <-ack; err != nil {
+			return fmt.Errorf("%v/%v: %v", t.codec, t.transform, err)
+		}
+
+		// Decoded with another number of jobs, then with writes split
+		// across the flushes
+		output, err := flushChunks(chunks, map[string]interface{}{"codec": t.codec, "transform": t.transform,
+			"jobs": t.jobs, "syncPoints": true, "partialBlocks": true})
+
+		if err != nil {
+			return err
+		}
+
+		for _, jobs := range []uint{1, 3} {
+			decoded, err := decompressStream(output, map[string]interface{}{"jobs": jobs})
+
+			if err != nil {
+				return fmt.Errorf("%v/%v: %v", t.codec, t.transform, err)
+			}
+
+			if bytes.Equal(decoded, input) == false {
+				return fmt.Errorf("%v/%v: invalid round trip with %d jobs", t.codec, t.transform, jobs)
+			}
+		}
+	}
+
+	// The blocks continued after a flush compress better than hard cuts
+	params := map[string]interface{}{"codec": "HUFFMAN", "transform": "LZ", "syncPoints": true}
+	cuts, err := flushChunks(chunks, params)
+
+	if err != nil {
+		return err
+	}
+
+	params["partialBlocks"] = true
+	output, err := flushChunks(chunks, params)
+
+	if err != nil {
+		return err
+	}
+
+	if len(output) >= len(cuts) {
+		return fmt.Errorf("Partial blocks: %d bytes, expected fewer than with hard cuts (%d bytes)", len(output), len(cuts))
+	}
+
+	hdr, err := kio.ParseStreamHeader(output)
+
+	if err != nil || hdr.PartialBlocks == false || hdr.Version != kio.STREAM_EXT_VERSION {
+		return fmt.Errorf("Expected partial blocks in a version %d stream header (%v)", kio.STREAM_EXT_VERSION, err)
+	}
+
+	// Compact block headers (the header of a partial block refers to the
+	// empty block before it)
+	compact, err := flushChunks(chunks, map[string]interface{}{"codec": "HUFFMAN", "transform": "LZ",
+		"syncPoints": true, "partialBlocks": true, "compactHeaders": true})
+
+	if err != nil {
+		return err
+	}
+
+	if decoded, err := decompressStream(compact, nil); err != nil || bytes.Equal(decoded, input) == false {
+		return fmt.Errorf("Partial blocks with compact headers: invalid round trip (%v)", err)
+	}
+
+	// Damaged partial block: the decoding resumes after the logical block
+	data := append([]byte{}, output...)
+	data[len(data)/2] ^= 0x55
+	cis := newInputStream(data, map[string]interface{}{"jobs": uint(2), "resync": true})
+
+	if decoded, err := readAll(cis); err != nil || len(decoded) >= len(input) {
+		return fmt.Errorf("Unexpected resync after a damaged partial block: %d bytes (%v)", len(decoded), err)
+	}
+
+	// Invalid parameters
+	if _, err = compressStream(input, map[string]interface{}{"partialBlocks": true}); err == nil {
+		return fmt.Errorf("Expected an error for partial blocks without sync points")
+	}
+
+	if _, err = compressStream(input, map[string]interface{}{"partialBlocks": true, "syncPoints": true,
+		"index": true}); err == nil {
+		return fmt.Errorf("Expected an error for partial blocks with a block index")
+	}
+
+	return nil
+}
+
+func newInputStream(data []byte, ctx map[string]interface{}) *kio.CompressedInputStream {
+	cis, _ := kio.NewCompressedInputStreamWithCtx(ioutil.NopCloser(bytes.NewReader(data)), ctx)
+	return cis
+}
+
+func TestMaxMemory(b *testing.T) {
+	if err := testMaxMemory(); err != nil {
+		b.Error(err)
+	}
+}
+
+// A metrics sink keeping the maximum of the gauges
+type gaugeSink struct {
+	counterSink
+	gauges map[string]float64
+}
+
+func (this *gaugeSink) Set(name string, value float64) {
+	this.mutex.Lock()
+
+	if value > this.gauges[name] {
+		this.gauges[name] = value
+	}
+
+	this.mutex.Unlock()
+}
+
+func testMaxMemory() error {
+	input := bytes.Repeat([]byte("The block buffers are recycled by the tasks. "), 40000)
+
+	for _, maxMemory := range []uint64{3 << 20, 1 << 30} {
+		var buf bytes.Buffer
+		ctx := map[string]interface{}{"codec": "HUFFMAN", "transform": "BWT", "blockSize": uint(65536),
+			"jobs": uint(8), "checksum": true, "maxMemory": maxMemory}
+		info, err := kio.DescribePipeline(ctx)
+
+		if err != nil {
+			return err
+		}
+
+		cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		sink := &gaugeSink{counterSink: counterSink{counters: map[string]int64{}}, gauges: map[string]float64{}}
+		cos.SetMetrics(sink)
+
+		// Several writes to reuse the block buffers
+		for i := 0; i < len(input); i += 300000 {
+			end := i + 300000
+
+			if end > len(input) {
+				end = len(input)
+			}
+
+			if _, err = cos.Write(input[i:end]); err != nil {
+				return err
+			}
+		}
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		tasks := maxMemory / info.BlockMemory
+
+		if tasks > 8 {
+			tasks = 8
+		}
+
+		depth := sink.gauges[kio.METRIC_ENCODER_PREFIX+kio.METRIC_QUEUE_DEPTH]
+
+		if depth == 0 || depth > float64(tasks) {
+			return fmt.Errorf("maxMemory %d: %v blocks encoded concurrently, expected at most %d", maxMemory, depth, tasks)
+		}
+
+		output, err := readAll(newInputStream(buf.Bytes(), map[string]interface{}{"jobs": uint(4)}))
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("maxMemory %d: invalid round trip", maxMemory)
+		}
+	}
+
+	// Not enough memory for one block
+	ctx := map[string]interface{}{"codec": "HUFFMAN", "transform": "BWT", "blockSize": uint(65536),
+		"jobs": uint(8), "checksum": false, "maxMemory": uint64(1 << 10)}
+
+	if _, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&bytes.Buffer{}}, ctx); err == nil {
+		return fmt.Errorf("Expected an error for a maximum memory smaller than a block")
+	}
+
+	return nil
+}
+
+func TestOutOfOrderBlocks(b *testing.T) {
+	if err := testOutOfOrderBlocks(); err != nil {
+		b.Error(err)
+	}
+}
+
+// A listener recording the IDs of the blocks written
+type writtenBlocks struct {
+	mutex sync.Mutex
+	ids   []int
+}
+
+func (this *writtenBlocks) ProcessEvent(evt *kanzi.Event) {
+	if evt.Type() == kanzi.EVT_AFTER_ENTROPY {
+		this.mutex.Lock()
+		this.ids = append(this.ids, evt.ID())
+		this.mutex.Unlock()
+	}
+}
+
+func testOutOfOrderBlocks() error {
+	const blockSize = 16384
+	input := bytes.Repeat([]byte("A slow block does not stall the next blocks. "), 16*blockSize/45)
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "ANS0", "LZ", blockSize, 2, true)
+
+	if err != nil {
+		return err
+	}
+
+	// Block 2 waits for block 3 to start: the task of block 1 is reused as
+	// soon as block 1 is written
+	started := make(chan bool)
+	var timeout int32
+
+	cos.SetHook(kanzi.EVT_BEFORE_TRANSFORM, func(info kio.BlockInfo, block []byte) error {
+		switch info.ID {
+		case 2:
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				atomic.StoreInt32(&timeout, 1)
+			}
+		case 3:
+			close(started)
+		}
+
+		return nil
+	})
+
+	listener := &writtenBlocks{}
+	cos.AddListener(listener)
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	if timeout != 0 {
+		return fmt.Errorf("Block 3 not started before the end of block 2")
+	}
+
+	for i, id := range listener.ids {
+		if id != i+1 {
+			return fmt.Errorf("Blocks written out of order: %v", listener.ids)
+		}
+	}
+
+	output, err := readAll(newInputStream(buf.Bytes(), map[string]interface{}{"jobs": uint(2)}))
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(input, output) == false {
+		return fmt.Errorf("Invalid round trip")
+	}
+
+	return nil
+}
+
+func TestBlockListener(b *testing.T) {
+	if err := testBlockListener(); err != nil {
+		b.Error(err)
+	}
+}
+
+// A block listener recording the events
+type blockRecorder struct {
+	mutex  sync.Mutex
+	starts map[int]kio.BlockStartEvent
+	ends   []kio.BlockEndEvent
+}
+
+func (this *blockRecorder) BlockStart(evt kio.BlockStartEvent) {
+	this.mutex.Lock()
+	this.starts[evt.ID] = evt
+	this.mutex.Unlock()
+}
+
+func (this *blockRecorder) BlockEnd(evt kio.BlockEndEvent) {
+	this.mutex.Lock()
+	this.ends = append(this.ends, evt)
+	this.mutex.Unlock()
+}
+
+func testBlockListener() error {
+	const blockSize = 32768
+	text := bytes.Repeat([]byte("Monitoring tools log the ratio of each block. "), 3*blockSize/46)
+	random := make([]byte, blockSize)
+	rand.New(rand.NewSource(1)).Read(random)
+	input := append(append(text[0:2*blockSize], random...), text[0:blockSize/2]...)
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "ANS0", "TEXT+LZ", blockSize, 4, true)
+
+	if err != nil {
+		return err
+	}
+
+	enc := &blockRecorder{starts: map[int]kio.BlockStartEvent{}}
+
+	if cos.AddBlockListener(nil) == true || cos.AddBlockListener(enc) == false {
+		return fmt.Errorf("Unexpected result of AddBlockListener")
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	cis := newInputStream(buf.Bytes(), map[string]interface{}{"jobs": uint(4)})
+	dec := &blockRecorder{starts: map[int]kio.BlockStartEvent{}}
+	cis.AddBlockListener(dec)
+
+	if _, err = readAll(cis); err != nil {
+		return err
+	}
+
+	if len(enc.ends) != 4 || len(dec.ends) != 4 || len(enc.starts) != 4 || len(dec.starts) != 4 {
+		return fmt.Errorf("Unexpected number of events: %d/%d, %d/%d", len(enc.starts), len(enc.ends),
+			len(dec.starts), len(dec.ends))
+	}
+
+	compressed := int64(0)
+
+	for i, e := range enc.ends {
+		// The blocks are written in order
+		if e.ID != i+1 || e.Decoding == true || enc.starts[e.ID].Size != e.Size {
+			return fmt.Errorf("Invalid encoding event: %+v", e)
+		}
+
+		if stored := i == 2; e.Stored != stored || (stored == true && (e.Transform != "NONE" || e.Entropy != "NONE")) {
+			return fmt.Errorf("Invalid encoding event of block %d: %+v", e.ID, e)
+		}
+
+		if e.Stored == false && (e.Entropy != "ANS0" || e.Ratio() >= 0.5) {
+			return fmt.Errorf("Invalid encoding event of block %d: %+v", e.ID, e)
+		}
+
+		compressed += e.Compressed
+	}
+
+	// Stream header and end block excluded
+	if compressed >= int64(buf.Len()) || compressed < int64(buf.Len())-32 {
+		return fmt.Errorf("Invalid compressed sizes: %d bytes, stream of %d bytes", compressed, buf.Len())
+	}
+
+	size := int64(0)
+
+	for _, d := range dec.ends {
+		e := enc.ends[d.ID-1]
+
+		if d.Decoding == false || dec.starts[d.ID].Size != -1 || d.Size != e.Size || d.Compressed != e.Compressed ||
+			d.Transform != e.Transform || d.Entropy != e.Entropy || d.Checksum != e.Checksum || d.HasChecksum == false {
+			return fmt.Errorf("Decoding event %+v differs from encoding event %+v", d, e)
+		}
+
+		size += d.Size
+	}
+
+	if size != int64(len(input)) {
+		return fmt.Errorf("Invalid decoded sizes: %d bytes, expected %d", size, len(input))
+	}
+
+	if cos.RemoveBlockListener(enc) == false || cos.RemoveBlockListener(enc) == true {
+		return fmt.Errorf("Unexpected result of RemoveBlockListener")
+	}
+
+	return nil
+}
+
+func TestHeaderSections(b *testing.T) {
+	if err := testHeaderSections(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testHeaderSections() error {
+	input := bytes.Repeat([]byte("The header describes the stages of the blocks. "), 2000)
+	ctx := map[string]interface{}{"codec": "ANS0", "transform": "TEXT+LZ", "blockSize": uint(32768),
+		"jobs": uint(2), "checksum": true, "headerSections": true}
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return err
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	output := buf.Bytes()
+	hdr, err := kio.ParseStreamHeader(output)
+
+	if err != nil {
+		return err
+	}
+
+	if hdr.Version != kio.STREAM_SECTIONS_VERSION || hdr.Sections == false {
+		return fmt.Errorf("Invalid stream header: %+v", *hdr)
+	}
+
+	start := kio.STREAM_HEADER_SIZE + kio.STREAM_HEADER_EXT_SIZE
+	sections, n, err := kio.ParseHeaderSections(output[start:])
+
+	if err != nil {
+		return err
+	}
+
+	if len(sections) != 2 || sections[0].ID != kio.SECTION_TRANSFORMS || sections[1].ID != kio.SECTION_ENTROPY {
+		return fmt.Errorf("Invalid header sections: %+v", sections)
+	}
+
+	transforms, err := kio.ParseHeaderStages(sections[0].Data)
+
+	if err != nil {
+		return err
+	}
+
+	if len(transforms) != 2 || transforms[0].ID != uint16(kio.TRANSFORM_TEXT) || transforms[1].ID != uint16(kio.TRANSFORM_LZ) {
+		return fmt.Errorf("Invalid transform stages: %+v", transforms)
+	}
+
+	codec, err := kio.ParseHeaderStages(sections[1].Data)
+
+	if err != nil {
+		return err
+	}
+
+	if len(codec) != 1 || codec[0].ID != uint16(kio.ENTROPY_ANS0) {
+		return fmt.Errorf("Invalid entropy stages: %+v", codec)
+	}
+
+	info, err := kio.DescribePipeline(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	if info.Version != kio.STREAM_SECTIONS_VERSION || info.HeaderBits != uint(8*(start+n)) {
+		return fmt.Errorf("Invalid pipeline header: version %d, %d bits", info.Version, info.HeaderBits)
+	}
+
+	decoded, err := decompressStream(output, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(decoded, input) == false {
+		return fmt.Errorf("Invalid decoded data")
+	}
+
+	// Insert a section before the end marker
+	insert := func(flags byte) []byte {
+		end := start + n - 1
+		res := append([]byte{}, output[0:end]...)
+		res = append(res, 200, flags, 0, 0, 3, 'n', 'e', 'w')
+		return append(res, output[end:]...)
+	}
+
+	// Unknown optional section: skipped
+	if decoded, err = decompressStream(insert(0), nil); err != nil {
+		return err
+	}
+
+	if bytes.Equal(decoded, input) == false {
+		return fmt.Errorf("Invalid decoded data with an unknown optional section")
+	}
+
+	// Unknown critical section or stage: newer decoder required
+	unknownStage := append([]byte{}, output...)
+	unknownStage[start+6] = 1 // first transform id: 256 + TEXT
+
+	for _, data := range [][]byte{insert(kio.SECTION_CRITICAL), unknownStage} {
+		_, err = decompressStream(data, nil)
+
+		if ioErr, ok := err.(*kio.IOError); ok == false || ioErr.ErrorCode() != kanzi.ERR_STREAM_VERSION {
+			return fmt.Errorf("Unexpected error with an unknown critical section or stage: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func TestCompressedReaderSalvage(b *testing.T) {
+	if err := testCompressedReaderSalvage(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testCompressedReaderSalvage() error {
+	const blockSize = 16384
+	input := make([]byte, 6*blockSize)
+
+	for i := range input {
+		input[i] = byte('a' + (i/7+i/blockSize)%23)
+	}
+
+	var buf bytes.Buffer
+	ctx := map[string]interface{}{"codec": "ANS0", "transform": "LZ", "blockSize": uint(blockSize),
+		"jobs": uint(2), "checksum": true, "index": true, "syncPoints": true}
+	cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&buf}, ctx)
+
+	if err != nil {
+		return err
+	}
+
+	// One sync marker after each block
+	for i := 0; i < len(input); i += blockSize {
+		if _, err = cos.Write(input[i : i+blockSize]); err != nil {
+			return err
+		}
+
+		if err = cos.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if err = cos.Close(); err != nil {
+		return err
+	}
+
+	entries, _, err := kio.ReadIndex(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+
+	if err != nil {
+		return err
+	}
+
+	if len(entries) != 6 {
+		return fmt.Errorf("Unexpected number of blocks: %d", len(entries))
+	}
+
+	start := func(blk int) int64 { return int64(entries[blk].BitOffset >> 3) }
+
+	// Damage the second block
+	damaged := append([]byte{}, buf.Bytes()...)
+	damaged[(start(1)+start(2))/2] ^= 0x5A
+	salvage := map[string]interface{}{"jobs": uint(2), "salvage": true}
+
+	// With the index: the damaged block reads as zeros
+	cr, err := kio.NewCompressedReaderWithCtx(bytes.NewReader(damaged), int64(len(damaged)), salvage)
+
+	if err != nil {
+		return err
+	}
+
+	lost := cr.Lost()
+	expected := kio.LostRange{Start: start(1), End: start(2), Offset: blockSize, Length: blockSize}
+
+	if len(lost) != 1 || lost[0] != expected {
+		return fmt.Errorf("Invalid lost ranges: %+v, expected %+v", lost, expected)
+	}
+
+	output, err := ioutil.ReadAll(cr)
+	cr.Close()
+
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, blockSize)
+
+	if bytes.Equal(output[0:blockSize], input[0:blockSize]) == false || bytes.Equal(output[blockSize:2*blockSize], zeros) == false ||
+		bytes.Equal(output[2*blockSize:], input[2*blockSize:]) == false {
+		return fmt.Errorf("Invalid salvaged data with the index")
+	}
+
+	if cr, err = kio.NewCompressedReader(bytes.NewReader(damaged), int64(len(damaged))); err != nil {
+		return err
+	}
+
+	if _, err = ioutil.ReadAll(cr); err == nil {
+		return fmt.Errorf("The damaged block was decoded without salvage mode")
+	}
+
+	// Truncated in the fifth block: no index, the intact blocks are found by
+	// decoding the stream
+	damaged = damaged[0 : start(4)+10]
+
+	if _, err = kio.NewCompressedReader(bytes.NewReader(damaged), int64(len(damaged))); err == nil {
+		return fmt.Errorf("Truncated stream opened without salvage mode")
+	}
+
+	if cr, err = kio.NewCompressedReaderWithCtx(bytes.NewReader(damaged), int64(len(damaged)), salvage); err != nil {
+		return err
+	}
+
+	defer cr.Close()
+	lost = cr.Lost()
+
+	if len(lost) != 2 || lost[0] != (kio.LostRange{Start: start(1), End: start(2), Offset: blockSize, Length: -1}) ||
+		lost[1] != (kio.LostRange{Start: start(4), End: int64(len(damaged)), Offset: 3 * blockSize, Length: -1}) {
+		return fmt.Errorf("Invalid lost ranges without index: %+v", lost)
+	}
+
+	if output, err = ioutil.ReadAll(cr); err != nil {
+		return err
+	}
+
+	if cr.Size() != 3*blockSize || bytes.Equal(output[0:blockSize], input[0:blockSize]) == false ||
+		bytes.Equal(output[blockSize:], input[2*blockSize:4*blockSize]) == false {
+		return fmt.Errorf("Invalid salvaged data without index: %d bytes", len(output))
+	}
+
+	return nil
+}
+
+func TestSmallStream(b *testing.T) {
+	if err := testSmallStream(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testSmallStream() error {
+	input := []byte("A short message, such as a log line or a RPC payload, is written as a small stream. " +
+		"The header of a small stream is a few bytes long and there is no end block.")
+	params := map[string]interface{}{"transform": "LZ", "blockSize": uint(1024 * 1024)}
+	threshold := map[string]interface{}{"transform": "LZ", "blockSize": uint(1024 * 1024),
+		"smallStreamThreshold": uint(kio.SMALL_STREAM_THRESHOLD)}
+	small, err := compressStream(input, threshold)
+
+	if err != nil {
+		return err
+	}
+
+	// The small streams are opt-in
+	regular, err := compressStream(input, params)
+
+	if err != nil {
+		return err
+	}
+
+	hdr, err := kio.ParseStreamHeader(small)
+
+	if err != nil {
+		return err
+	}
+
+	if hdr.Small == false || hdr.Checksum == false || hdr.BlockSize != kio.SMALL_STREAM_BLOCK_SIZE ||
+		len(hdr.Transforms) != 1 || hdr.Transforms[0] != kio.TRANSFORM_LZ || hdr.Entropy != kio.ENTROPY_HUFFMAN {
+		return fmt.Errorf("Invalid small stream header: %+v", *hdr)
+	}
+
+	if len(small)+8 > len(regular) {
+		return fmt.Errorf("Small stream too large: %d bytes, regular stream: %d bytes", len(small), len(regular))
+	}
+
+	if hdr, err = kio.ParseStreamHeader(regular); err != nil {
+		return err
+	}
+
+	// The default stream must be readable by a decoder of version 8: header
+	// of version 8 with the reserved flags (last 3 bits) set to 0
+	if hdr.Small == true || hdr.Magic != kio.STREAM_MAGIC || hdr.Version != kio.STREAM_MIN_VERSION ||
+		regular[kio.STREAM_HEADER_SIZE-1]&0x07 != 0 {
+		return fmt.Errorf("Unexpected stream header by default: %+v", *hdr)
+	}
+
+	// Concatenated small and regular streams
+	data := append(append(append([]byte{}, small...), regular...), small...)
+	decoded, err := decompressStream(data, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(decoded, bytes.Repeat(input, 3)) == false {
+		return fmt.Errorf("Invalid decoded data")
+	}
+
+	// Features stored in the header of a regular stream
+	for _, params := range []map[string]interface{}{{"streamDigest": true}, {"index": true}, {"headerSections": true}} {
+		for k, v := range threshold {
+			params[k] = v
+		}
+
+		output, err := compressStream(input, params)
+
+		if err != nil {
+			return err
+		}
+
+		if hdr, err = kio.ParseStreamHeader(output); err != nil {
+			return err
+		}
+
+		if hdr.Small == true {
+			return fmt.Errorf("Unexpected small stream with %v", params)
+		}
+
+		if decoded, err = decompressStream(output, nil); err != nil {
+			return err
+		}
+
+		if bytes.Equal(decoded, input) == false {
+			return fmt.Errorf("Invalid decoded data with %v", params)
+		}
+	}
+
+	// The threshold cannot exceed the block size of a small stream
+	if _, err = compressStream(input, map[string]interface{}{"transform": "LZ", "blockSize": uint(1024),
+		"smallStreamThreshold": uint(1 << 20)}); err == nil {
+		return fmt.Errorf("Invalid small stream threshold accepted")
+	}
+
+	return nil
+}
+
+func TestMappedFile(b *testing.T) {
+	if kio.MMAP_SUPPORTED == false {
+		b.Skip("Memory mapped files not supported")
+	}
+
+	if err := testMappedFile(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testMappedFile() error {
+	const blockSize = 16384
+	input := make([]byte, 7*blockSize+1000)
+
+	for i := range input {
+		input[i] = byte('a' + (i/5+i/3001)%19)
+	}
+
+	dir, err := ioutil.TempDir("", "kanzi")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "input.bin")
+
+	if err = ioutil.WriteFile(name, input, 0666); err != nil {
+		return err
+	}
+
+	mf, err := kio.OpenMappedFile(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer mf.Close()
+
+	if mf.Size() != int64(len(input)) || bytes.Equal(mf.Bytes(), input) == false {
+		return fmt.Errorf("Invalid mapped file: %d bytes", mf.Size())
+	}
+
+	// The transforms of the chain write to their input
+	ctx := map[string]interface{}{"codec": "ANS0", "transform": "TEXT+BWT+MTFT+ZRLT", "blockSize": uint(blockSize),
+		"jobs": uint(3), "checksum": true}
+
+	// Some data written before the mapped file (prefix) or not
+	for _, prefix := range []int{0, 100, blockSize} {
+		var expected, actual bytes.Buffer
+		cos, err := kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&expected}, ctx)
+
+		if err != nil {
+			return err
+		}
+
+		cos.Write(input[0:prefix])
+		cos.Write(input)
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		if cos, err = kio.NewCompressedOutputStreamWithCtx(&nopWriteCloser{&actual}, ctx); err != nil {
+			return err
+		}
+
+		cos.Write(input[0:prefix])
+		n, err := cos.WriteMapped(mf)
+
+		if err != nil {
+			return err
+		}
+
+		if n != len(input) {
+			return fmt.Errorf("Invalid number of bytes written: %d, expected %d", n, len(input))
+		}
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		// Same blocks as with Write
+		if bytes.Equal(actual.Bytes(), expected.Bytes()) == false {
+			return fmt.Errorf("Invalid compressed data with a prefix of %d bytes", prefix)
+		}
+	}
+
+	// The file is not modified
+	if data, err := ioutil.ReadFile(name); err != nil || bytes.Equal(data, input) == false {
+		return fmt.Errorf("Mapped file modified (%v)", err)
+	}
+
+	if err = mf.Close(); err != nil {
+		return err
+	}
+
+	if mf.Bytes() != nil || mf.Close() != nil {
+		return fmt.Errorf("Invalid closed mapped file")
+	}
+
+	if _, err = kio.OpenMappedFile(dir); err == nil {
+		return fmt.Errorf("Directory mapped")
+	}
+
+	return nil
+}
+
+func TestOneShot(b *testing.T) {
+	if err := testOneShot(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testOneShot() error {
+	text := bytes.Repeat([]byte("{\"id\": 1234, \"name\": \"one-shot\", \"values\": [1, 2, 3, 4]}\n"), 2000)
+	random := make([]byte, 50000)
+	rand.New(rand.NewSource(7)).Read(random)
+	configs := []map[string]interface{}{
+		nil,
+		{"codec": "HUFFMAN", "transform": "NONE"},
+		{"codec": "ANS0", "transform": "TEXT+BWT+MTFT+ZRLT", "checksum": true, "jobs": uint(2)},
+		{"codec": "TPAQX", "transform": "TEXT+LZ"},
+		{"codec": "CM", "transform": "RLT+ZRLT", "checksum": true},
+		{"codec": "NONE", "transform": "LZ"},
+	}
+
+	for _, ctx := range configs {
+		for _, size := range []int{0, 10, 300, len(text)} {
+			for _, input := range [][]byte{text[0:size], random[0 : size%len(random)]} {
+				saved := append([]byte{}, input...)
+				output, err := kio.Compress(nil, input, ctx)
+
+				if err != nil {
+					return fmt.Errorf("%v: %v", ctx, err)
+				}
+
+				if bytes.Equal(input, saved) == false {
+					return fmt.Errorf("%v: input modified", ctx)
+				}
+
+				if len(output) > kio.CompressBound(len(input)) {
+					return fmt.Errorf("%v: %d bytes compressed to %d bytes", ctx, len(input), len(output))
+				}
+
+				// The destination is reused if large enough
+				dst := make([]byte, len(input)+1024)
+				decoded, err := kio.Decompress(dst, output)
+
+				if err != nil {
+					return fmt.Errorf("%v: %v", ctx, err)
+				}
+
+				if bytes.Equal(decoded, input) == false {
+					return fmt.Errorf("%v: invalid decoded data (%d bytes)", ctx, len(input))
+				}
+
+				if len(decoded) > 0 && &decoded[0] != &dst[0] {
+					return fmt.Errorf("%v: destination not reused", ctx)
+				}
+
+				// Even if its size is the size of the data
+				dst = make([]byte, len(input))
+
+				if decoded, err = kio.Decompress(dst, output); err != nil || bytes.Equal(decoded, input) == false {
+					return fmt.Errorf("%v: invalid decoded data (%d bytes): %v", ctx, len(input), err)
+				}
+
+				if len(decoded) > 0 && &decoded[0] != &dst[0] {
+					return fmt.Errorf("%v: destination of the size of the data not reused", ctx)
+				}
+			}
+		}
+	}
+
+	// The sizes in the header are bounded by the size of the block: the
+	// blocks with a higher ratio are padded
+	zeros := make([]byte, 4*1024*1024)
+	output, err := kanzi.Compress(nil, zeros, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if len(output) < len(zeros)/kio.ONESHOT_MAX_RATIO {
+		return fmt.Errorf("One-shot block not padded: %d bytes", len(output))
+	}
+
+	if decoded, err := kanzi.Decompress(nil, output); err != nil || bytes.Equal(decoded, zeros) == false {
+		return fmt.Errorf("Invalid decoded data (padded block): %v", err)
+	}
+
+	if _, err = kio.Decompress(nil, output[0:len(output)/2]); err == nil {
+		return fmt.Errorf("Sizes of the data larger than allowed by the size of the block accepted")
+	}
+
+	// Without the package io, the helpers of the kanzi package are not registered
+	kanzi.RegisterOneShot(nil, nil)
+	_, err = kanzi.Compress(nil, zeros, nil)
+	_, err2 := kanzi.Decompress(nil, output)
+	kanzi.RegisterOneShot(kio.Compress, kio.Decompress)
+
+	if errors.Is(err, kanzi.ErrOneShotUnavailable) == false || errors.Is(err2, kanzi.ErrOneShotUnavailable) == false {
+		return fmt.Errorf("Unexpected errors without the package io: %v, %v", err, err2)
+	}
+
+	// No stream header and end block
+	msg := text[0:300]
+	output, err = kio.Compress(make([]byte, 0, 1024), msg, map[string]interface{}{"checksum": true})
+
+	if err != nil {
+		return err
+	}
+
+	stream, err := compressStream(msg, map[string]interface{}{"codec": "ANS0", "transform": "BWT+RANK+ZRLT",
+		"blockSize": uint(1024 * 1024)})
+
+	if err != nil {
+		return err
+	}
+
+	if len(output)+8 > len(stream) {
+		return fmt.Errorf("One-shot block too large: %d bytes, stream: %d bytes", len(output), len(stream))
+	}
+
+	damaged := append([]byte{}, output...)
+	damaged[len(damaged)/2] ^= 0x10
+
+	if _, err = kio.Decompress(nil, damaged); err == nil {
+		return fmt.Errorf("Damaged one-shot block decoded")
+	}
+
+	if _, err = kio.Decompress(nil, stream); err == nil {
+		return fmt.Errorf("Stream decoded as a one-shot block")
+	}
+
+	if _, err = kio.Compress(nil, msg, map[string]interface{}{"codec": "FOO"}); err == nil {
+		return fmt.Errorf("Unknown codec accepted")
+	}
+
+	return nil
+}
+
+func TestErrorTypes(b *testing.T) {
+	if err := testErrorTypes(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testErrorTypes() error {
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 2000)
+
+	// Transform skipped
+	x86, _ := function.NewX86Codec()
+
+	if _, _, err := x86.Forward(text, make([]byte, x86.MaxEncodedLen(len(text)))); errors.Is(err, kanzi.ErrNotApplicable) == false {
+		return fmt.Errorf("X86 codec: expected a 'not applicable' error, got %v", err)
+	}
+
+	// Output buffer too small
+	zrlt, _ := function.NewZRLT()
+
+	if _, _, err := zrlt.Forward(text, make([]byte, 16)); errors.Is(err, kanzi.ErrOutputTooSmall) == false {
+		return fmt.Errorf("ZRLT: expected an 'output too small' error, got %v", err)
+	}
+
+	if _, _, err := zrlt.Forward(text, make([]byte, 16)); errors.Is(err, kanzi.ErrNotApplicable) == true {
+		return fmt.Errorf("ZRLT: unexpected 'not applicable' error: %v", err)
+	}
+
+	// Damaged block: the error locates the block
+	blockSize := uint(16 * 1024)
+	output, err := compressStream(text, map[string]interface{}{"blockSize": blockSize})
+
+	if err != nil {
+		return err
+	}
+
+	output[len(output)*3/4] ^= 0x5A
+	_, err = decompressStream(output, nil)
+	var corrupt *kanzi.ErrCorruptStream
+
+	if errors.As(err, &corrupt) == false {
+		return fmt.Errorf("Expected a corrupt stream error, got %v", err)
+	}
+
+	if corrupt.Block < 1 || corrupt.Offset <= 0 || corrupt.Offset >= int64(len(output)) {
+		return fmt.Errorf("Invalid location of the damaged block: block %d at offset %d", corrupt.Block, corrupt.Offset)
+	}
+
+	if errors.Is(err, &kanzi.ErrCorruptStream{}) == false || errors.Is(err, kanzi.ErrNotApplicable) == true {
+		return fmt.Errorf("Unexpected error kind: %v", err)
+	}
+
+	if ioErr, ok := err.(*kio.IOError); ok == false || ioErr.ErrorCode() == 0 {
+		return fmt.Errorf("Expected an IOError, got %T", err)
+	}
+
+	return nil
+}
+
+func TestKernelDispatch(b *testing.T) {
+	if err := testKernelDispatch(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Every set of kernels selected by the CPU features must produce the same
+// hashes, histograms and compressed streams
+func testKernelDispatch() error {
+	input := make([]byte, 200003)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4*(i>>12)+1))
+	}
+
+	detected := cpuinfo.CPU
+	defer cpuinfo.Override(detected)
+	var ref []byte
+
+	for _, f := range []cpuinfo.Features{{}, {UnalignedLoads: true, AVX2: true}, detected} {
+		cpuinfo.Override(f)
+		var res bytes.Buffer
+		h32, _ := hash.NewXXHash32(0x12345678)
+		h64, _ := hash.NewXXHash64(0x12345678)
+
+		for _, n := range []int{0, 15, 16, 63, 64, 65, 1000, len(input)} {
+			fmt.Fprintf(&res, "%x %x ", h32.Hash(input[0:n]), h64.Hash(input[0:n]))
+		}
+
+		freqs := make([]int, 257)
+		kanzi.ComputeHistogram(input[1:], freqs, true, true)
+		fmt.Fprint(&res, freqs)
+
+		// Arrays written and read at a cursor that is not byte aligned
+		var buf bytes.Buffer
+		obs, _ := bitstream.NewDefaultOutputBitStream(&nopWriteCloser{&buf}, 16384)
+		obs.WriteBits(5, 3)
+		obs.WriteArray(input, uint(8*len(input)-5))
+		obs.Close()
+		res.Write(buf.Bytes())
+		ibs, _ := bitstream.NewDefaultInputBitStream(ioutil.NopCloser(bytes.NewReader(buf.Bytes())), 16384)
+		ibs.ReadBits(3)
+		array := make([]byte, len(input))
+		ibs.ReadArray(array, uint(8*len(input)-5))
+
+		if bytes.Equal(array[0:len(array)-1], input[0:len(input)-1]) == false {
+			return fmt.Errorf("%v: invalid array read from the bitstream", f)
+		}
+
+		output, err := compressStream(input, map[string]interface{}{"codec": "CMX", "transform": "LZ"})
+
+		if err != nil {
+			return err
+		}
+
+		res.Write(output)
+
+		if ref == nil {
+			ref = res.Bytes()
+		} else if bytes.Equal(ref, res.Bytes()) == false {
+			return fmt.Errorf("%v: the kernels produce different results", f)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/flanglet/kanzi-go/util/corpus"
+)
+
+func TestCorpus(b *testing.T) {
+	if err := testCorpus(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testCorpus() error {
+	const size = 200000
+
+	// The datasets must not change across versions (reproducible evaluations)
+	digests := map[string]string{
+		corpus.TEXT:   "73e2d5d5879df1ac",
+		corpus.LOGS:   "a000d3e4db0233d8",
+		corpus.EXE:    "45927594622cf2a3",
+		corpus.DNA:    "ea76c9129c5fc50b",
+		corpus.SPARSE: "2c01ea362b891fe8",
+	}
+
+	for _, kind := range corpus.Kinds() {
+		data1, err := corpus.Generate(kind, size, 12345)
+
+		if err != nil {
+			return err
+		}
+
+		data2, _ := corpus.Generate(kind, size, 12345)
+		data3, _ := corpus.Generate(kind, size, 54321)
+
+		if len(data1) != size || len(data3) != size {
+			return fmt.Errorf("%v: unexpected corpus size %v", kind, len(data1))
+		}
+
+		if bytes.Equal(data1, data2) == false {
+			return fmt.Errorf("%v: the corpus is not deterministic", kind)
+		}
+
+		if bytes.Equal(data1, data3) == true {
+			return fmt.Errorf("%v: the corpus does not depend on the seed", kind)
+		}
+
+		if digest := fmt.Sprintf("%x", sha256.Sum256(data1)); digest[0:16] != digests[kind] {
+			return fmt.Errorf("%v: the corpus has changed (sha256 %v)", kind, digest)
+		}
+
+		for _, n := range []int{0, 1, 100, 4097} {
+			if data, err := corpus.Generate(kind, n, 7); err != nil || len(data) != n {
+				return fmt.Errorf("%v: failed to generate %v bytes", kind, n)
+			}
+		}
+
+		// Representative data is compressible
+		csize, err := compressedSize(data1, "BWT+RANK+ZRLT", "ANS0")
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Corpus %-6s: %v bytes => BWT+RANK+ZRLT+ANS0: %v\n", kind, size, csize)
+
+		if csize*10 > size*8 {
+			return fmt.Errorf("%v: the corpus is not compressible enough: %v => %v", kind, size, csize)
+		}
+	}
+
+	if _, err := corpus.Generate("WAV", 100, 1); err == nil {
+		return errors.New("Expected an error for an unknown corpus kind")
+	}
+
+	return nil
+}
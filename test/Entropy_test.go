@@ -16,10 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,48 +33,116 @@ import (
 
 func TestHuffman(b *testing.T) {
 	if err := testEntropyCorrectness("HUFFMAN"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+}
+
+func TestAdaptiveHuffman(b *testing.T) {
+	if err := testEntropyCorrectness("AHUFFMAN"); err != nil {
+		b.Error(err)
 	}
 }
 
 func TestANS0(b *testing.T) {
 	if err := testEntropyCorrectness("ANS0"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
 	}
 }
 func TestANS1(b *testing.T) {
 	if err := testEntropyCorrectness("ANS1"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+}
+func TestRANS0(b *testing.T) {
+	if err := testEntropyCorrectness("RANS0"); err != nil {
+		b.Error(err)
+	}
+}
+func TestRANS1(b *testing.T) {
+	if err := testEntropyCorrectness("RANS1"); err != nil {
+		b.Error(err)
 	}
 }
 func TestRange(b *testing.T) {
 	if err := testEntropyCorrectness("RANGE"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
 	}
 }
 func TestFPAQ(b *testing.T) {
 	if err := testEntropyCorrectness("FPAQ"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
 	}
 }
 func TestCM(b *testing.T) {
 	if err := testEntropyCorrectness("CM"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+}
+func TestCMX(b *testing.T) {
+	if err := testEntropyCorrectness("CMX"); err != nil {
+		b.Error(err)
 	}
 }
 func TestTPAQ(b *testing.T) {
 	if err := testEntropyCorrectness("TPAQ"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+}
+func TestRLE(b *testing.T) {
+	if err := testEntropyCorrectness("RLE"); err != nil {
+		b.Error(err)
+	}
+}
+func TestAuto(b *testing.T) {
+	if err := testEntropyCorrectness("AUTO"); err != nil {
+		b.Error(err)
 	}
 }
+
 func TestExpGolomb(b *testing.T) {
 	if err := testEntropyCorrectness("EXPGOLOMB"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
 	}
 }
 func TestRiceGolomb(b *testing.T) {
 	if err := testEntropyCorrectness("RICEGOLOMB"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+}
+
+func TestAdaptiveExpGolomb(b *testing.T) {
+	if err := testEntropyCorrectness("AEXPGOLOMB"); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestAdaptiveRiceGolomb(b *testing.T) {
+	if err := testEntropyCorrectness("ARICEGOLOMB"); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestIncompressible(b *testing.T) {
+	if err := testIncompressible(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestEntropyEstimate(b *testing.T) {
+	if err := testEntropyEstimate(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestEntropyReset(b *testing.T) {
+	if err := testEntropyReset(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestModelSink(b *testing.T) {
+	if err := testModelSink(); err != nil {
+		b.Error(err)
 	}
 }
 
@@ -90,6 +160,10 @@ func getPredictor(name string) kanzi.Predictor {
 		res, _ := entropy.NewCMPredictor()
 		return res
 
+	case "CMX":
+		res, _ := entropy.NewCMXPredictor()
+		return res
+
 	default:
 		panic(fmt.Errorf("Unsupported type: '%s'", name))
 	}
@@ -109,10 +183,26 @@ func getEncoder(name string, obs kanzi.OutputBitStream) kanzi.EntropyEncoder {
 		res, _ := entropy.NewBinaryEntropyEncoder(obs, getPredictor(name))
 		return res
 
+	case "CMX":
+		res, _ := entropy.NewBinaryEntropyEncoder(obs, getPredictor(name))
+		return res
+
 	case "HUFFMAN":
 		res, _ := entropy.NewHuffmanEncoder(obs)
 		return res
 
+	case "AHUFFMAN":
+		res, _ := entropy.NewAdaptiveHuffmanEncoder(obs)
+		return res
+
+	case "RLE":
+		res, _ := entropy.NewRLEEncoder(obs)
+		return res
+
+	case "AUTO":
+		res, _ := entropy.NewAutoEncoder(obs, nil)
+		return res
+
 	case "ANS0":
 		res, _ := entropy.NewANSRangeEncoder(obs, 0)
 		return res
@@ -121,6 +211,14 @@ func getEncoder(name string, obs kanzi.OutputBitStream) kanzi.EntropyEncoder {
 		res, _ := entropy.NewANSRangeEncoder(obs, 1)
 		return res
 
+	case "RANS0":
+		res, _ := entropy.NewRANSEncoder(obs, 0)
+		return res
+
+	case "RANS1":
+		res, _ := entropy.NewRANSEncoder(obs, 1)
+		return res
+
 	case "RANGE":
 		res, _ := entropy.NewRangeEncoder(obs)
 		return res
@@ -133,6 +231,14 @@ func getEncoder(name string, obs kanzi.OutputBitStream) kanzi.EntropyEncoder {
 		res, _ := entropy.NewRiceGolombEncoder(obs, true, 4)
 		return res
 
+	case "AEXPGOLOMB":
+		res, _ := entropy.NewAdaptiveExpGolombEncoder(obs, true)
+		return res
+
+	case "ARICEGOLOMB":
+		res, _ := entropy.NewAdaptiveRiceGolombEncoder(obs, true)
+		return res
+
 	default:
 		panic(fmt.Errorf("No such entropy encoder: '%s'", name))
 	}
@@ -170,10 +276,32 @@ func getDecoder(name string, ibs kanzi.InputBitStream) kanzi.EntropyDecoder {
 		res, _ := entropy.NewBinaryEntropyDecoder(ibs, pred)
 		return res
 
+	case "CMX":
+		pred := getPredictor(name)
+
+		if pred == nil {
+			panic(fmt.Errorf("No such entropy decoder: '%s'", name))
+		}
+
+		res, _ := entropy.NewBinaryEntropyDecoder(ibs, pred)
+		return res
+
 	case "HUFFMAN":
 		res, _ := entropy.NewHuffmanDecoder(ibs)
 		return res
 
+	case "AHUFFMAN":
+		res, _ := entropy.NewAdaptiveHuffmanDecoder(ibs)
+		return res
+
+	case "RLE":
+		res, _ := entropy.NewRLEDecoder(ibs)
+		return res
+
+	case "AUTO":
+		res, _ := entropy.NewAutoDecoder(ibs, nil)
+		return res
+
 	case "ANS0":
 		res, _ := entropy.NewANSRangeDecoder(ibs, 0)
 		return res
@@ -182,6 +310,14 @@ func getDecoder(name string, ibs kanzi.InputBitStream) kanzi.EntropyDecoder {
 		res, _ := entropy.NewANSRangeDecoder(ibs, 1)
 		return res
 
+	case "RANS0":
+		res, _ := entropy.NewRANSDecoder(ibs, 0)
+		return res
+
+	case "RANS1":
+		res, _ := entropy.NewRANSDecoder(ibs, 1)
+		return res
+
 	case "RANGE":
 		res, _ := entropy.NewRangeDecoder(ibs)
 		return res
@@ -194,6 +330,14 @@ func getDecoder(name string, ibs kanzi.InputBitStream) kanzi.EntropyDecoder {
 		res, _ := entropy.NewRiceGolombDecoder(ibs, true, 4)
 		return res
 
+	case "AEXPGOLOMB":
+		res, _ := entropy.NewAdaptiveExpGolombDecoder(ibs, true)
+		return res
+
+	case "ARICEGOLOMB":
+		res, _ := entropy.NewAdaptiveRiceGolombDecoder(ibs, true)
+		return res
+
 	default:
 		panic(fmt.Errorf("No such entropy decoder: '%s'", name))
 	}
@@ -300,3 +444,1327 @@ func testEntropyCorrectness(name string) error {
 
 	return error(nil)
 }
+
+func testIncompressible() error {
+	random := make([]byte, 1<<20)
+	text := make([]byte, 1<<20)
+
+	for i := range random {
+		random[i] = byte(rand.Intn(256))
+		text[i] = byte(97 + rand.Intn(16))
+	}
+
+	sampleSize := entropy.PrecheckSampleSize(len(random))
+
+	if sampleSize != 64*1024 {
+		return fmt.Errorf("Unexpected sample size: %d", sampleSize)
+	}
+
+	if entropy.IsIncompressible(random, sampleSize, "") == false {
+		return errors.New("Random data should be incompressible")
+	}
+
+	if entropy.IsIncompressible(text, sampleSize, "") == true {
+		return errors.New("Low entropy data should be compressible")
+	}
+
+	jpeg := append([]byte{0xFF, 0xD8, 0xFF, 0xE0}, random[0:1000]...)
+
+	if format := entropy.DetectCompressedFormat(jpeg); format != "JPEG" {
+		return fmt.Errorf("Expected JPEG format, got '%s'", format)
+	}
+
+	if format := entropy.DetectCompressedFormat(text); format != "" {
+		return fmt.Errorf("Expected no format, got '%s'", format)
+	}
+
+	// Short magic numbers matched by chance
+	for _, prefix := range [][]byte{{0x60, 0xEA}, {0xFF, 0xFB}, {0xFF, 0xF1}, {0xFF, 0x0A}, {0x1F, 0x9D}, {0x1F, 0x8B}} {
+		block := append(append([]byte{}, prefix...), text[0:1000]...)
+
+		if format := entropy.DetectCompressedFormat(block); format != "" {
+			return fmt.Errorf("Expected no format for % X, got '%s'", prefix, format)
+		}
+	}
+
+	// MP3 frames: 128 kbps, 44.1 kHz, no padding => 417 bytes per frame
+	mp3 := append([]byte{}, random[0:1000]...)
+	copy(mp3, []byte{0xFF, 0xFB, 0x90, 0x00})
+	copy(mp3[417:], []byte{0xFF, 0xFB, 0x90, 0x00})
+
+	if format := entropy.DetectCompressedFormat(mp3); format != "MP3" {
+		return fmt.Errorf("Expected MP3 format, got '%s'", format)
+	}
+
+	// ADTS frames of 300 bytes
+	aac := append([]byte{}, random[0:1000]...)
+	copy(aac, []byte{0xFF, 0xF1, 0x50, 0x80, 0x25, 0x9F, 0xFC})
+	copy(aac[300:], []byte{0xFF, 0xF1})
+
+	if format := entropy.DetectCompressedFormat(aac); format != "AAC" {
+		return fmt.Errorf("Expected AAC format, got '%s'", format)
+	}
+
+	gz := append([]byte{0x1F, 0x8B, 0x08, 0x00, 0, 0, 0, 0, 0x00, 0x03}, random[0:1000]...)
+
+	if format := entropy.DetectCompressedFormat(gz); format != "GZIP" {
+		return fmt.Errorf("Expected GZIP format, got '%s'", format)
+	}
+
+	return nil
+}
+
+func testEntropyEstimate() error {
+	random := make([]byte, 1<<20)
+	rand.Read(random)
+
+	// Random chunk repeated: high order 0 and order 1 entropies but
+	// compressible
+	repeated := make([]byte, 0, 1<<16)
+
+	for len(repeated) < 1<<16 {
+		repeated = append(repeated, random[0:4096]...)
+	}
+
+	// Random walk: the previous byte predicts the next one
+	walk := make([]byte, 1<<16)
+
+	for i := 1; i < len(walk); i++ {
+		walk[i] = walk[i-1] + byte(rand.Intn(7)-3)
+	}
+
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 20))
+	tests := []struct {
+		name   string
+		block  []byte
+		random bool
+	}{
+		{"random", random, true},
+		{"small random", random[0:4096], true},
+		{"repeated", repeated, false},
+		{"walk", walk, false},
+		{"text", text, false},
+	}
+
+	for _, t := range tests {
+		stats := kanzi.EntropyEstimate(t.block)
+		fmt.Printf("%-12s %+v\n", t.name, stats)
+
+		if stats.IsIncompressible() != t.random {
+			return fmt.Errorf("%v: unexpected randomness %v", t.name, stats)
+		}
+
+		if stats.Order1 > stats.Order0 || stats.Randomness > stats.Order1 {
+			return fmt.Errorf("%v: inconsistent estimates %v", t.name, stats)
+		}
+	}
+
+	if stats := kanzi.EntropyEstimate(random); stats.Size != 64*1024 || stats.Distinct != 256 {
+		return fmt.Errorf("Unexpected sample of a big block: %v", stats)
+	}
+
+	if stats := kanzi.EntropyEstimate(walk); stats.Order1*2 > stats.Order0 {
+		return fmt.Errorf("The order 1 entropy should be much lower for a random walk: %v", stats)
+	}
+
+	if stats := kanzi.EntropyEstimate(repeated); stats.Order0 < 1000 || stats.MatchRatio < 900 {
+		return fmt.Errorf("Expected high order 0 entropy and matches for repeats: %v", stats)
+	}
+
+	if stats := kanzi.EntropyEstimate(nil); stats != (kanzi.EntropyStats{}) {
+		return fmt.Errorf("Expected empty statistics for an empty block: %v", stats)
+	}
+
+	return nil
+}
+
+// Encode several blocks with cached (reset) codecs and check that the output
+// matches the output of new codecs and that the blocks decode correctly
+func testEntropyReset() error {
+	names := []string{"HUFFMAN", "AHUFFMAN", "RLE", "ANS0", "ANS1", "RANS0", "RANS1", "RANGE", "FPAQ", "CM", "CMX", "TPAQ", "AUTO"}
+	blocks := make([][]byte, 4)
+
+	for i := range blocks {
+		blocks[i] = make([]byte, 4096<<uint(i&1))
+
+		for j := range blocks[i] {
+			blocks[i][j] = byte(32 + rand.Intn(16*(i+1)))
+		}
+	}
+
+	for _, name := range names {
+		entropyType := entropy.GetType(name)
+		var bs1, bs2 util.BufferStream
+		obs1, _ := bitstream.NewDefaultOutputBitStream(&bs1, 16384)
+		obs2, _ := bitstream.NewDefaultOutputBitStream(&bs2, 16384)
+		encoders := entropy.NewEncoderCache()
+		var previous kanzi.EntropyEncoder
+
+		for i, block := range blocks {
+			ctx := map[string]interface{}{"size": uint(len(block)), "blockSize": uint(len(block))}
+			ee1, err := encoders.Get(obs1, ctx, entropyType)
+
+			if err != nil {
+				return err
+			}
+
+			// The resettable encoders must be reused
+			if i > 0 && name != "TPAQ" && ee1 != previous {
+				return fmt.Errorf("%s: the encoder was not reused for block %d", name, i)
+			}
+
+			previous = ee1
+			ee2, _ := entropy.NewEntropyEncoder(obs2, ctx, entropyType)
+
+			if _, err := ee1.Write(block); err != nil {
+				return err
+			}
+
+			if _, err := ee2.Write(block); err != nil {
+				return err
+			}
+
+			ee1.Dispose()
+			ee2.Dispose()
+		}
+
+		obs1.Close()
+		obs2.Close()
+
+		out1 := make([]byte, bs1.Len())
+		out2 := make([]byte, bs2.Len())
+		bs1.Read(out1)
+		bs2.Read(out2)
+
+		if bytes.Equal(out1, out2) == false {
+			return fmt.Errorf("%s: different output with reset and new encoders", name)
+		}
+
+		bs1.SetOffset(0)
+
+		ibs, _ := bitstream.NewDefaultInputBitStream(&bs1, 16384)
+		decoders := entropy.NewDecoderCache()
+
+		for i, block := range blocks {
+			ctx := map[string]interface{}{"size": uint(len(block)), "blockSize": uint(len(block))}
+			ed, err := decoders.Get(ibs, ctx, entropyType)
+
+			if err != nil {
+				return err
+			}
+
+			decoded := make([]byte, len(block))
+
+			if _, err := ed.Read(decoded); err != nil {
+				return err
+			}
+
+			ed.Dispose()
+
+			if bytes.Equal(block, decoded) == false {
+				return fmt.Errorf("%s: block %d: input and inverse are different", name, i)
+			}
+		}
+
+		ibs.Close()
+		fmt.Printf("%s: reset codecs OK\n", name)
+	}
+
+	return nil
+}
+
+type modelSamples struct {
+	samples []entropy.ModelSample
+}
+
+func (this *modelSamples) Sample(sample *entropy.ModelSample) {
+	s := *sample
+	s.Inputs = append([]int32(nil), sample.Inputs...)
+	s.Weights = append([]int32(nil), sample.Weights...)
+	this.samples = append(this.samples, s)
+}
+
+// Instrumented predictors: the samples match the input and the output is
+// the same as without instrumentation
+func testModelSink() error {
+	words := []string{"model ", "sink ", "context ", "mixer ", "weight ", "probability\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 64*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+	}
+
+	input := buf.Bytes()
+
+	for _, name := range []string{"CM", "CMX", "TPAQ"} {
+		entropyType := entropy.GetType(name)
+		sink := &modelSamples{}
+		var outputs [2][]byte
+
+		for i := range outputs {
+			ctx := map[string]interface{}{"size": uint(len(input)), "blockSize": uint(len(input))}
+
+			if i == 1 {
+				ctx["modelSink"] = sink
+				ctx["modelSampling"] = uint(16)
+			}
+
+			var bs util.BufferStream
+			obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+			ee, err := entropy.NewEntropyEncoder(obs, ctx, entropyType)
+
+			if err != nil {
+				return err
+			}
+
+			if _, err = ee.Write(input); err != nil {
+				return err
+			}
+
+			ee.Dispose()
+			obs.Close()
+			outputs[i] = make([]byte, bs.Len())
+			bs.Read(outputs[i])
+		}
+
+		if bytes.Equal(outputs[0], outputs[1]) == false {
+			return fmt.Errorf("%s: the instrumented predictor changed the output", name)
+		}
+
+		if len(sink.samples) != (len(input)+15)/16 {
+			return fmt.Errorf("%s: expected %d samples, got %d", name, (len(input)+15)/16, len(sink.samples))
+		}
+
+		cost := 0.0
+		nbInputs := 3
+
+		if name == "TPAQ" {
+			nbInputs = 8
+		} else if name == "CMX" {
+			nbInputs = 4
+		}
+
+		for i, s := range sink.samples {
+			if s.Predictor != name || s.Position != int64(16*i) || s.Value != input[16*i] {
+				return fmt.Errorf("%s: invalid sample %d: %v %v %v", name, i, s.Predictor, s.Position, s.Value)
+			}
+
+			if len(s.Inputs) != nbInputs || len(s.Weights) != nbInputs {
+				return fmt.Errorf("%s: expected %d model inputs and weights, got %d and %d", name, nbInputs, len(s.Inputs), len(s.Weights))
+			}
+
+			cost += s.Cost
+		}
+
+		// The sampled bytes cost about as much as the average byte
+		avg := cost / float64(len(sink.samples))
+		ratio := 8 * float64(len(outputs[0])) / float64(len(input))
+
+		if avg < ratio/2 || avg > ratio*2 {
+			return fmt.Errorf("%s: unexpected cost per sampled byte: %.3f bits (%.3f bits per byte)", name, avg, ratio)
+		}
+
+		fmt.Printf("%s: %d samples, %.3f bits per sampled byte, %.3f bits per byte\n", name, len(sink.samples), avg, ratio)
+	}
+
+	ctx := map[string]interface{}{"modelSink": "sink"}
+	var bs util.BufferStream
+	obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+
+	if _, err := entropy.NewEntropyEncoder(obs, ctx, entropy.CM_TYPE); err == nil {
+		return errors.New("Expected an error for an invalid model sink")
+	}
+
+	return nil
+}
+
+func TestRANSInterleaving(b *testing.T) {
+	if err := testRANSInterleaving(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The interleaved codecs handle the blocks that do not split evenly in 4
+// streams (and several chunks per block) and compress about as well as the
+// ANS codecs
+func testRANSInterleaving() error {
+	for _, size := range []int{1, 2, 3, 5, 7, 1023, 70001} {
+		input := make([]byte, size)
+
+		for i := range input {
+			input[i] = byte(97 + rand.Intn(4) + rand.Intn(4)*(i&1))
+		}
+
+		for order := uint(0); order < 2; order++ {
+			var sizes [2]int
+
+			for i := range sizes {
+				var bs util.BufferStream
+				obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+				var ee kanzi.EntropyEncoder
+
+				if i == 0 {
+					ee, _ = entropy.NewANSRangeEncoder(obs, order, 16384)
+				} else {
+					ee, _ = entropy.NewRANSEncoder(obs, order, 16384)
+				}
+
+				if _, err := ee.Write(input); err != nil {
+					return err
+				}
+
+				ee.Dispose()
+				obs.Close()
+				sizes[i] = bs.Len()
+
+				if i == 0 {
+					continue
+				}
+
+				ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+				ed, _ := entropy.NewRANSDecoder(ibs, order, 16384)
+				output := make([]byte, size)
+
+				if _, err := ed.Read(output); err != nil {
+					return fmt.Errorf("Order %d, size %d: %v", order, size, err)
+				}
+
+				ed.Dispose()
+
+				if bytes.Equal(input, output) == false {
+					return fmt.Errorf("Order %d, size %d: the decoded data does not match the input", order, size)
+				}
+			}
+
+			// 12 extra bytes per chunk for the states
+			if sizes[1] > sizes[0]+(12+16)*(size/16384+1)+sizes[0]/100 {
+				return fmt.Errorf("Order %d, size %d: ANS: %d bytes, RANS: %d bytes", order, size, sizes[0], sizes[1])
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestAdaptiveHuffmanUpdates(b *testing.T) {
+	if err := testAdaptiveHuffmanUpdates(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The adaptive Huffman codec follows the changes of statistics within a
+// block, does not pay for code tables on small blocks and carries the codes
+// over from one call to the next
+func testAdaptiveHuffmanUpdates() error {
+	// 4 sections with different skewed alphabets
+	input := make([]byte, 200000)
+
+	for i := range input {
+		section := i / 50000
+		input[i] = byte(32*section + rand.Intn(4) + rand.Intn(4)*rand.Intn(4))
+	}
+
+	var huf util.BufferStream
+	obs, _ := bitstream.NewDefaultOutputBitStream(&huf, 16384)
+	ee := getEncoder("HUFFMAN", obs)
+	ee.Write(input)
+	ee.Dispose()
+	obs.Close()
+
+	for _, period := range []uint{256, 1024, 65536} {
+		var bs util.BufferStream
+		obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+		ee, err := entropy.NewAdaptiveHuffmanEncoder(obs, period)
+
+		if err != nil {
+			return err
+		}
+
+		// Several calls, some of them shorter than the fast decoding padding
+		for _, chunk := range [][]byte{input[0:10], input[10:100000], input[100000:100030], input[100030:]} {
+			if _, err = ee.Write(chunk); err != nil {
+				return err
+			}
+		}
+
+		ee.Dispose()
+		obs.Close()
+		size := bs.Len()
+
+		// Close to the static Huffman codec (which transmits the codes every 32 KB)
+		if period <= 1024 && size > huf.Len()*103/100 {
+			return fmt.Errorf("Period %d: %d bytes, %d bytes with the Huffman codec", period, size, huf.Len())
+		}
+
+		ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+		ed, _ := entropy.NewAdaptiveHuffmanDecoder(ibs, period)
+		output := make([]byte, len(input))
+
+		for _, chunk := range [][]byte{output[0:10], output[10:100000], output[100000:100030], output[100030:]} {
+			if _, err = ed.Read(chunk); err != nil {
+				return err
+			}
+		}
+
+		ed.Dispose()
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("Period %d: the decoded data does not match the input", period)
+		}
+
+		fmt.Printf("Adaptive Huffman (period %d): %d => %d bytes\n", period, len(input), size)
+	}
+
+	// Stream of small writes with a large alphabet: cheaper than the static
+	// Huffman codec (which transmits the code table for each write)
+	small := make([]byte, 64*1024)
+
+	for i := range small {
+		small[i] = byte(32 + rand.Intn(48) + rand.Intn(48))
+	}
+
+	var sizes [2]int
+
+	for i := range sizes {
+		var bs util.BufferStream
+		obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+		ee := getEncoder([]string{"HUFFMAN", "AHUFFMAN"}[i], obs)
+
+		for j := 0; j < len(small); j += 1024 {
+			ee.Write(small[j : j+1024])
+		}
+
+		ee.Dispose()
+		obs.Close()
+		sizes[i] = bs.Len()
+	}
+
+	if sizes[1] > sizes[0]*97/100 {
+		return fmt.Errorf("Small writes: Huffman: %d bytes, adaptive Huffman: %d bytes", sizes[0], sizes[1])
+	}
+
+	if _, err := entropy.NewAdaptiveHuffmanEncoder(nil); err == nil {
+		return errors.New("Expected an error for a null bitstream")
+	}
+
+	if _, err := entropy.NewAdaptiveHuffmanEncoder(obs, 1000); err == nil {
+		return errors.New("Expected an error for an update period that is not a power of 2")
+	}
+
+	return nil
+}
+
+func TestRLESkewed(b *testing.T) {
+	if err := testRLESkewed(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Near constant blocks: the run length codec costs much less than 1 bit per
+// symbol. Both literal modes (small and large differences with the most
+// probable symbol) round trip.
+func testRLESkewed() error {
+	for _, spread := range []int{4, 250} {
+		input := make([]byte, 100000)
+
+		for i := range input {
+			input[i] = 7
+
+			if rand.Intn(200) == 0 {
+				input[i] = byte(8 + rand.Intn(spread))
+			}
+		}
+
+		// Long run at the end of the block
+		for i := len(input) - 5000; i < len(input); i++ {
+			input[i] = 7
+		}
+
+		var sizes [2]int
+
+		for i, name := range []string{"HUFFMAN", "RLE"} {
+			var bs util.BufferStream
+			obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+			ee := getEncoder(name, obs)
+
+			if _, err := ee.Write(input); err != nil {
+				return err
+			}
+
+			ee.Dispose()
+			obs.Close()
+			sizes[i] = bs.Len()
+			ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+			ed := getDecoder(name, ibs)
+			output := make([]byte, len(input))
+
+			if _, err := ed.Read(output); err != nil {
+				return err
+			}
+
+			ed.Dispose()
+
+			if bytes.Equal(input, output) == false {
+				return fmt.Errorf("%s: the decoded data does not match the input", name)
+			}
+		}
+
+		if sizes[1]*4 > sizes[0] {
+			return fmt.Errorf("Spread %d: Huffman: %d bytes, RLE: %d bytes", spread, sizes[0], sizes[1])
+		}
+
+		fmt.Printf("Spread %d: Huffman: %d bytes, RLE: %d bytes\n", spread, sizes[0], sizes[1])
+	}
+
+	return nil
+}
+
+func TestSelectBest(b *testing.T) {
+	if err := testSelectBest(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The selected codec must be the one with the smallest output: the run
+// length codec for near constant data, no codec for random data and the
+// context model for text. The AUTO codec writes the selected type before
+// the block.
+func testSelectBest() error {
+	// Fixed seed: the sparse bytes of the constant block may favor FPAQ
+	rnd := rand.New(rand.NewSource(2543))
+	constant := make([]byte, 200000)
+
+	for i := range constant {
+		if rnd.Intn(500) == 0 {
+			constant[i] = byte(rnd.Intn(256))
+		}
+	}
+
+	random := make([]byte, 60000)
+	rnd.Read(random)
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 1400))
+
+	// Mostly text, so the order 1 and context model codecs shine
+	for i := 0; i < len(text); i += 97 {
+		text[i] = byte('a' + rnd.Intn(26))
+	}
+
+	tests := []struct {
+		name     string
+		block    []byte
+		expected []uint32
+	}{
+		{"constant", constant, []uint32{entropy.RLE_TYPE}},
+		{"random", random, []uint32{entropy.NONE_TYPE}},
+		{"text", text, []uint32{entropy.CM_TYPE, entropy.ANS1_TYPE}},
+	}
+
+	for _, t := range tests {
+		best, err := entropy.SelectBest(t.block, nil)
+
+		if err != nil {
+			return err
+		}
+
+		found := false
+
+		for _, e := range t.expected {
+			found = found || best == e
+		}
+
+		if found == false {
+			return fmt.Errorf("%s: unexpected entropy codec %s", t.name, entropy.GetName(best))
+		}
+
+		fmt.Printf("%s: %s\n", t.name, entropy.GetName(best))
+
+		// The selection is the smallest trial encoding among the candidates
+		// (the whole block is the sample of small blocks)
+		bestSize, _ := entropy.TrialEncode(t.block, best)
+
+		for _, c := range entropy.AutoCandidates() {
+			if size, _ := entropy.TrialEncode(t.block, c); size < bestSize && len(t.block) <= 64*1024 {
+				return fmt.Errorf("%s: %s is smaller than %s", t.name, entropy.GetName(c), entropy.GetName(best))
+			}
+		}
+
+		// AUTO block = selected type (8 bits) + block of the selected codec
+		var bs util.BufferStream
+		obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+		ee, _ := entropy.NewEntropyEncoder(obs, map[string]interface{}{}, entropy.AUTO_TYPE)
+
+		if _, err := ee.Write(t.block); err != nil {
+			return err
+		}
+
+		ee.Dispose()
+		obs.Close()
+
+		if bs.Len() > len(t.block)+16 {
+			return fmt.Errorf("%s: AUTO output too big: %d bytes for %d", t.name, bs.Len(), len(t.block))
+		}
+
+		ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+
+		if ibs.ReadBits(8) != uint64(best) {
+			return fmt.Errorf("%s: the AUTO codec did not write the selected type", t.name)
+		}
+	}
+
+	if _, err := entropy.SelectBest(text, []uint32{}); err == nil {
+		return errors.New("Expected an error for an empty list of candidates")
+	}
+
+	if _, err := entropy.SelectBest(text, []uint32{entropy.AUTO_TYPE}); err == nil {
+		return errors.New("Expected an error for the AUTO candidate")
+	}
+
+	// Corrupted selected type
+	var bs util.BufferStream
+	bs.Write([]byte{byte(entropy.TPAQ_TYPE), 0, 0, 0, 0, 0, 0, 0})
+	ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+	ed, _ := entropy.NewAutoDecoder(ibs, nil)
+
+	if _, err := ed.Read(make([]byte, 16)); err == nil {
+		return errors.New("Expected an error for an invalid entropy codec type in the AUTO block")
+	}
+
+	return nil
+}
+
+func TestAdaptiveProbMaps(b *testing.T) {
+	if err := testAdaptiveProbMaps(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The maps learn the actual probability of a context whatever the input
+// probability, and an APM stage on top of a predictor composes with the
+// binary entropy codec.
+func testAdaptiveProbMaps() error {
+	logistic, _ := entropy.NewLogisticAdaptiveProbMap(2, 6)
+	fastLogistic, _ := entropy.NewFastLogisticAdaptiveProbMap(2, 6)
+	linear, _ := entropy.NewLinearAdaptiveProbMap(2, 6)
+	fast, _ := entropy.NewFastAdaptiveProbMap(2, 6)
+	maps := []entropy.ProbMap{logistic, fastLogistic, linear, fast}
+	names := []string{"Logistic", "FastLogistic", "Linear", "Fast"}
+
+	for i, apm := range maps {
+		for round := 0; round < 2; round++ {
+			// Context 0: always 1, context 1: always 0 (input says 50%)
+			p0, p1, bit := 0, 0, 0
+
+			for n := 0; n < 2000; n++ {
+				p0 = apm.Get(bit, 2048, 0)
+				bit = 1
+				p1 = apm.Get(bit, 2048, 1)
+				bit = 0
+			}
+
+			if p0 < 3800 || p1 > 300 {
+				return fmt.Errorf("%s: unexpected probabilities %d and %d", names[i], p0, p1)
+			}
+
+			// The second round starts from scratch
+			apm.Reset()
+
+			if p := apm.Get(0, 2048, 0); p < 1900 || p > 2200 {
+				return fmt.Errorf("%s: unexpected probability %d after reset", names[i], p)
+			}
+		}
+	}
+
+	if _, err := entropy.NewLogisticAdaptiveProbMap(0, 7); err == nil {
+		return errors.New("Expected an error for an empty map")
+	}
+
+	if _, err := entropy.NewFastAdaptiveProbMap(256, 16); err == nil {
+		return errors.New("Expected an error for an invalid update rate")
+	}
+
+	if _, err := entropy.NewAPMPredictor(nil, 0); err == nil {
+		return errors.New("Expected an error for a null predictor")
+	}
+
+	// Order 1 data: the order 1 APM helps the order 0 predictor
+	input := make([]byte, 100000)
+
+	for i := 1; i < len(input); i++ {
+		input[i] = byte(int(input[i-1])*7 + 1 + rand.Intn(3))
+	}
+
+	var sizes [3]int
+
+	for order := 0; order < 3; order++ {
+		var bs util.BufferStream
+		obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+		fpaq, _ := entropy.NewFPAQPredictor()
+		var pred kanzi.Predictor = fpaq
+
+		if order > 0 {
+			pred, _ = entropy.NewAPMPredictor(fpaq, uint(order-1))
+		}
+
+		ee, _ := entropy.NewBinaryEntropyEncoder(obs, pred)
+
+		if _, err := ee.Write(input); err != nil {
+			return err
+		}
+
+		ee.Dispose()
+		obs.Close()
+		sizes[order] = bs.Len()
+
+		ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+		fpaq, _ = entropy.NewFPAQPredictor()
+		pred = fpaq
+
+		if order > 0 {
+			pred, _ = entropy.NewAPMPredictor(fpaq, uint(order-1))
+		}
+
+		ed, _ := entropy.NewBinaryEntropyDecoder(ibs, pred)
+		output := make([]byte, len(input))
+
+		if _, err := ed.Read(output); err != nil {
+			return err
+		}
+
+		ed.Dispose()
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("APM order %d: the decoded data does not match the input", order-1)
+		}
+	}
+
+	fmt.Printf("FPAQ: %d bytes, FPAQ+APM0: %d bytes, FPAQ+APM1: %d bytes\n", sizes[0], sizes[1], sizes[2])
+
+	if sizes[2] >= sizes[0]*3/4 {
+		return errors.New("Expected a better compression with an order 1 APM")
+	}
+
+	return nil
+}
+
+// Hide the byte level API of a predictor (bit by bit coding)
+type bitPredictor struct {
+	kanzi.Predictor
+}
+
+func TestBytePredictor(b *testing.T) {
+	if err := testBytePredictor(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The byte level API of the predictors must produce the same probabilities
+// as the bit level API (also when not called at a byte boundary) and the
+// same bitstream
+func testBytePredictor() error {
+	input := make([]byte, 50000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4+i&15))
+	}
+
+	newPredictors := map[string]func() kanzi.Predictor{
+		"FPAQ": func() kanzi.Predictor { p, _ := entropy.NewFPAQPredictor(); return p },
+		"CM":   func() kanzi.Predictor { p, _ := entropy.NewCMPredictor(); return p },
+		"CM+O2": func() kanzi.Predictor {
+			ctx := map[string]interface{}{"cm:order2": true}
+			p, _ := entropy.NewCMPredictorWithCtx(&ctx)
+			return p
+		},
+	}
+
+	for name, newPredictor := range newPredictors {
+		for _, offset := range []int{0, 3} {
+			bp, ok := newPredictor().(entropy.BytePredictor)
+
+			if ok == false {
+				return fmt.Errorf("%s: no byte level API", name)
+			}
+
+			p := newPredictor()
+
+			for i := 0; i < offset; i++ {
+				bp.Update(byte(i & 1))
+				p.Update(byte(i & 1))
+			}
+
+			for n, val := range input[0:5000] {
+				var probs [8]int
+				bp.PredictByte(val, &probs)
+
+				for i := range probs {
+					if probs[i] != p.Get() {
+						return fmt.Errorf("%s: different probabilities for bit %d of byte %d (offset %d)", name, i, n, offset)
+					}
+
+					p.Update((val >> uint(7-i)) & 1)
+				}
+			}
+		}
+
+		var outputs [2][]byte
+
+		for i := range outputs {
+			var bs util.BufferStream
+			obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+			pred := newPredictor()
+
+			if i == 1 {
+				pred = bitPredictor{pred}
+			}
+
+			ee, _ := entropy.NewBinaryEntropyEncoder(obs, pred)
+			ee.Write(input)
+			ee.Dispose()
+			obs.Close()
+			outputs[i] = make([]byte, bs.Len())
+			bs.Read(outputs[i])
+		}
+
+		if bytes.Equal(outputs[0], outputs[1]) == false {
+			return fmt.Errorf("%s: the byte and bit level APIs produce different bitstreams", name)
+		}
+
+		for i := range outputs {
+			var bs util.BufferStream
+			bs.Write(outputs[0])
+			ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+			pred := newPredictor()
+
+			if i == 1 {
+				pred = bitPredictor{pred}
+			}
+
+			ed, _ := entropy.NewBinaryEntropyDecoder(ibs, pred)
+			output := make([]byte, len(input))
+
+			if _, err := ed.Read(output); err != nil {
+				return err
+			}
+
+			ed.Dispose()
+
+			if bytes.Equal(input, output) == false {
+				return fmt.Errorf("%s: the decoded data does not match the input (byte level API: %v)", name, i == 0)
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestEntropyLanes(b *testing.T) {
+	if err := testEntropyLanes(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testEntropyLanes() error {
+	input := make([]byte, 300000)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(4+(i>>10)&15))
+	}
+
+	for _, name := range []string{"FPAQ", "CM", "CMX", "TPAQ"} {
+		// 4 lanes of 75000 bytes, a single lane for the small block
+		for _, block := range [][]byte{input, input[0:1000]} {
+			var bs util.BufferStream
+			obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+			ctx := map[string]interface{}{"entropy:lanes": uint(8), "size": uint(len(block)),
+				"blockSize": uint(len(block))}
+			ee, err := entropy.NewEntropyEncoder(obs, ctx, entropy.GetType(name))
+
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			if _, err = ee.Write(block); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			ee.Dispose()
+			obs.Close()
+			ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+			ctx["entropy:lanes"] = uint(0)
+			ed, err := entropy.NewEntropyDecoder(ibs, ctx, entropy.GetType(name))
+
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			output := make([]byte, len(block))
+
+			if _, err = ed.Read(output); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+
+			ed.Dispose()
+
+			if bytes.Equal(block, output) == false {
+				return fmt.Errorf("%s: invalid round trip with lanes (%d bytes)", name, len(block))
+			}
+		}
+	}
+
+	var bs util.BufferStream
+	obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+	newPredictor := func() (kanzi.Predictor, error) { return entropy.NewFPAQPredictor() }
+
+	for _, lanes := range []uint{0, entropy.LANES_MAX + 1} {
+		if _, err := entropy.NewBinaryLanesEncoder(obs, newPredictor, lanes); err == nil {
+			return fmt.Errorf("Expected an error for %d lanes", lanes)
+		}
+	}
+
+	// 16 lanes announced for a block too small to have more than one
+	obs.WriteBits(entropy.LANES_MAX-1, 4)
+	obs.WriteBits(0, 60)
+	obs.Close()
+	ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+	ed, _ := entropy.NewBinaryLanesDecoder(ibs, newPredictor)
+
+	if _, err := ed.Read(make([]byte, 100000)); err == nil {
+		return errors.New("Expected an error for an invalid number of lanes")
+	}
+
+	return nil
+}
+
+func TestHuffmanTables(b *testing.T) {
+	if err := testHuffmanTables(); err != nil {
+		b.Error(err)
+	}
+}
+
+// Code lengths limited to a max length, canonical codes and serialization of
+// the lengths; the Huffman codec with long codes and limited code lengths
+func testHuffmanTables() error {
+	// Fibonacci frequencies: the longest code is as long as possible
+	var freqs [256]int
+	f1, f2 := 1, 1
+
+	for i := 0; i < 30; i++ {
+		freqs[i] = f1
+		f1, f2 = f2, f1+f2
+	}
+
+	for _, maxLength := range []uint{8, 12, 15, entropy.HUF_MAX_CODE_LENGTH} {
+		var sizes [256]byte
+		var codes [256]uint
+		count, err := entropy.ComputeHuffmanCodeLengths(freqs[:], sizes[:], maxLength)
+
+		if err != nil {
+			return err
+		}
+
+		if count != 30 {
+			return fmt.Errorf("Max length %d: %d codes, expected 30", maxLength, count)
+		}
+
+		longest := byte(0)
+
+		for _, sz := range sizes {
+			if sz > longest {
+				longest = sz
+			}
+		}
+
+		if uint(longest) > maxLength {
+			return fmt.Errorf("Max length %d: the longest code has %d bits", maxLength, longest)
+		}
+
+		if _, err = entropy.GenerateHuffmanCodes(sizes[:], codes[:]); err != nil {
+			return err
+		}
+
+		// Prefix free codes
+		for i := 0; i < 30; i++ {
+			for j := 0; j < 30; j++ {
+				if i != j && sizes[i] <= sizes[j] && codes[j]>>(sizes[j]-sizes[i]) == codes[i] {
+					return fmt.Errorf("Max length %d: the code of %d is a prefix of the code of %d", maxLength, i, j)
+				}
+			}
+		}
+
+		var bs util.BufferStream
+		obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+
+		if _, err = entropy.WriteHuffmanLengths(obs, sizes[:]); err != nil {
+			return err
+		}
+
+		obs.Close()
+		ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+		var sizes2 [256]byte
+
+		if n, err := entropy.ReadHuffmanLengths(ibs, sizes2[:]); err != nil || n != count || sizes != sizes2 {
+			return fmt.Errorf("Max length %d: invalid round trip of the code lengths (%v)", maxLength, err)
+		}
+	}
+
+	var sizes [256]byte
+
+	if _, err := entropy.ComputeHuffmanCodeLengths(freqs[:], sizes[:], 7); err == nil {
+		return errors.New("Expected an error for a max code length of 7")
+	}
+
+	// Not a prefix code
+	sizes[0], sizes[1], sizes[2] = 1, 1, 1
+
+	if _, err := entropy.GenerateHuffmanCodes(sizes[:], make([]uint, 256)); err == nil {
+		return errors.New("Expected an error for invalid code lengths")
+	}
+
+	// Chunk with Fibonacci frequencies (codes longer than 16 bits)
+	input := make([]byte, 0, 32768)
+
+	for i := 0; i < 22; i++ {
+		input = append(input, bytes.Repeat([]byte{byte(i)}, freqs[i])...)
+	}
+
+	rand.Shuffle(len(input), func(i, j int) { input[i], input[j] = input[j], input[i] })
+
+	for _, maxLength := range []uint{8, 12, entropy.HUF_MAX_CODE_LENGTH} {
+		var bs util.BufferStream
+		obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+		ee, err := entropy.NewHuffmanEncoder(obs, 16384, maxLength)
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = ee.Write(input); err != nil {
+			return err
+		}
+
+		obs.Close()
+		ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+		ed, _ := entropy.NewHuffmanDecoder(ibs, 16384)
+		output := make([]byte, len(input))
+
+		if _, err = ed.Read(output); err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("Max length %d: invalid round trip", maxLength)
+		}
+	}
+
+	var bs util.BufferStream
+	obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+
+	if _, err := entropy.NewHuffmanEncoder(obs, 16384, 19); err == nil {
+		return errors.New("Expected an error for a max code length of 19")
+	}
+
+	return nil
+}
+
+func TestGolombParameters(b *testing.T) {
+	if err := testGolombParameters(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The adaptive Golomb codecs select a larger parameter for residuals of
+// larger magnitude and code them in fewer bits than the fixed parameter
+// codecs
+func testGolombParameters() error {
+	type codec struct {
+		name    string
+		encoder func(obs kanzi.OutputBitStream) kanzi.EntropyEncoder
+	}
+
+	codecs := []codec{
+		{"RICEGOLOMB", func(obs kanzi.OutputBitStream) kanzi.EntropyEncoder {
+			res, _ := entropy.NewRiceGolombEncoder(obs, true, 4)
+			return res
+		}},
+		{"ARICEGOLOMB", func(obs kanzi.OutputBitStream) kanzi.EntropyEncoder {
+			res, _ := entropy.NewAdaptiveRiceGolombEncoder(obs, true)
+			return res
+		}},
+		{"EXPGOLOMB", func(obs kanzi.OutputBitStream) kanzi.EntropyEncoder {
+			res, _ := entropy.NewExpGolombEncoder(obs, true)
+			return res
+		}},
+		{"AEXPGOLOMB", func(obs kanzi.OutputBitStream) kanzi.EntropyEncoder {
+			res, _ := entropy.NewAdaptiveExpGolombEncoder(obs, true)
+			return res
+		}},
+	}
+
+	prevRice, prevExpG := uint(0), uint(0)
+
+	for _, scale := range []float64{0.5, 4, 32} {
+		// Laplacian residuals
+		input := make([]byte, 20000)
+
+		for i := range input {
+			v := int(rand.ExpFloat64() * scale)
+
+			if v > 127 {
+				v = 127
+			}
+
+			if rand.Intn(2) == 0 {
+				v = -v
+			}
+
+			input[i] = byte(v)
+		}
+
+		rice := entropy.RiceGolombParameter(input, true)
+		expg := entropy.ExpGolombOrder(input, true)
+
+		if rice < prevRice || expg < prevExpG || (scale == 32 && (rice <= 1 || expg == 0)) {
+			return fmt.Errorf("Scale %v: unexpected parameters (Rice: %d, ExpGolomb: %d)", scale, rice, expg)
+		}
+
+		prevRice, prevExpG = rice, expg
+		var sizes [4]uint64
+
+		for i, c := range codecs {
+			var bs util.BufferStream
+			obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+			ee := c.encoder(obs)
+
+			if _, err := ee.Write(input); err != nil {
+				return err
+			}
+
+			obs.Close()
+			sizes[i] = obs.Written()
+			ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+			ed := getDecoder(c.name, ibs)
+			output := make([]byte, len(input))
+
+			if _, err := ed.Read(output); err != nil {
+				return fmt.Errorf("%s: %v", c.name, err)
+			}
+
+			if bytes.Equal(input, output) == false {
+				return fmt.Errorf("%s (scale %v): invalid round trip", c.name, scale)
+			}
+		}
+
+		// The parameter of the block costs a few bits (padded to a byte)
+		if sizes[1] > sizes[0]+8 || sizes[3] > sizes[2]+8 {
+			return fmt.Errorf("Scale %v: the adaptive codecs are worse than the fixed ones (%v)", scale, sizes)
+		}
+
+		fmt.Printf("Scale %v: Rice(4): %d bits, Rice(%d): %d bits, ExpGolomb: %d bits, ExpGolomb(%d): %d bits\n",
+			scale, sizes[0], rice, sizes[1], sizes[2], expg, sizes[3])
+	}
+
+	// Invalid parameter in the bitstream
+	var bs util.BufferStream
+	obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+	obs.WriteBits(15, 4)
+	obs.WriteBits(0, 60)
+	obs.Close()
+	ibs, _ := bitstream.NewDefaultInputBitStream(&bs, 16384)
+	ed, _ := entropy.NewAdaptiveExpGolombDecoder(ibs, true)
+
+	if _, err := ed.Read(make([]byte, 4)); err == nil {
+		return errors.New("Expected an error for an invalid ExpGolomb order")
+	}
+
+	return nil
+}
+
+func TestEntropyStats(b *testing.T) {
+	if err := testEntropyStats(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testEntropyStats() error {
+	words := []string{"entropy ", "stats ", "symbol ", "count ", "model ", "hit\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 32*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+	}
+
+	input := buf.Bytes()
+
+	for _, name := range []string{"HUFFMAN", "CM", "TPAQ", "AUTO"} {
+		collector := entropy.NewStatsCollector()
+		ctx := map[string]interface{}{"size": uint(len(input)), "blockSize": uint(len(input)),
+			"entropyStats": collector}
+		var bs util.BufferStream
+		obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+		ee, err := entropy.NewEntropyEncoder(obs, ctx, entropy.GetType(name))
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err = ee.Write(input[i*len(input)/2 : (i+1)*len(input)/2]); err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+		}
+
+		ee.Dispose()
+		written := obs.Written()
+		obs.Close()
+		stats := collector.Stats()
+		fmt.Printf("%s: %d bits (estimate %.0f), %.3f bits/symbol, hit rate %.3f, codecs %v\n",
+			name, stats.ActualBits, stats.EstimatedBits, stats.BitsPerSymbol(), stats.HitRate(), stats.Codecs)
+
+		if stats.Blocks != 2 || stats.Symbols != uint64(len(input)) || stats.Counts[' '] != uint64(bytes.Count(input, []byte{' '})) {
+			return fmt.Errorf("%s: invalid symbol statistics", name)
+		}
+
+		if stats.ActualBits != written {
+			return fmt.Errorf("%s: %d bits registered, %d bits written", name, stats.ActualBits, written)
+		}
+
+		if stats.EstimatedBits <= 0 || float64(stats.ActualBits) > 2*stats.EstimatedBits {
+			return fmt.Errorf("%s: inconsistent estimated bits: %v", name, stats.EstimatedBits)
+		}
+
+		// The instrumented models predict most bits correctly
+		if (name == "CM" || name == "TPAQ") && (stats.ModelBits != 8*uint64(len(input)) || stats.HitRate() < 0.8) {
+			return fmt.Errorf("%s: unexpected model statistics: %d bits, hit rate %v", name, stats.ModelBits, stats.HitRate())
+		}
+
+		total := uint64(0)
+
+		for codec, n := range stats.Codecs {
+			if codec == "AUTO" {
+				return fmt.Errorf("%s: the codec selected by AUTO was not registered", name)
+			}
+
+			total += n
+		}
+
+		if total != 2 || (name != "AUTO" && stats.Codecs[name] != 2) {
+			return fmt.Errorf("%s: unexpected codecs %v", name, stats.Codecs)
+		}
+
+		collector.Reset()
+
+		if stats = collector.Stats(); stats.Blocks != 0 || stats.ActualBits != 0 {
+			return fmt.Errorf("%s: the statistics were not reset", name)
+		}
+	}
+
+	var bs util.BufferStream
+	obs, _ := bitstream.NewDefaultOutputBitStream(&bs, 16384)
+	ctx := map[string]interface{}{"entropyStats": "stats"}
+
+	if _, err := entropy.NewEntropyEncoder(obs, ctx, entropy.HUFFMAN_TYPE); err == nil {
+		return errors.New("Expected an error for an invalid stats collector")
+	}
+
+	return nil
+}
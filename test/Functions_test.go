@@ -16,13 +16,26 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf16"
 
 	kanzi "github.com/flanglet/kanzi-go"
 	"github.com/flanglet/kanzi-go/function"
+	kio "github.com/flanglet/kanzi-go/io"
+	"github.com/flanglet/kanzi-go/util/corpus"
 )
 
 func getByteFunction(name string) (kanzi.ByteFunction, error) {
@@ -51,6 +64,58 @@ func getByteFunction(name string) (kanzi.ByteFunction, error) {
 		res, err := function.NewROLZCodecWithFlag(true)
 		return res, err
 
+	case "AUTOBWT":
+		res, err := function.NewAutoBWTCodec()
+		return res, err
+
+	case "PATH":
+		res, err := function.NewPathCodec()
+		return res, err
+
+	case "EXE":
+		res, err := function.NewExeCodec()
+		return res, err
+
+	case "FP":
+		res, err := function.NewFPCodec()
+		return res, err
+
+	case "LOG":
+		res, err := function.NewLogCodec()
+		return res, err
+
+	case "SOA":
+		res, err := function.NewSoACodec()
+		return res, err
+
+	case "UTF16":
+		res, err := function.NewUTF16Codec()
+		return res, err
+
+	case "STRUCT":
+		res, err := function.NewStructCodec()
+		return res, err
+
+	case "META":
+		res, err := function.NewMetaCodec()
+		return res, err
+
+	case "COLOR":
+		res, err := function.NewColorCodec()
+		return res, err
+
+	case "PLANE":
+		res, err := function.NewPlaneCodec()
+		return res, err
+
+	case "IMG":
+		res, err := function.NewImageCodec()
+		return res, err
+
+	case "B64":
+		res, err := function.NewBase64Codec()
+		return res, err
+
 	default:
 		panic(fmt.Errorf("No such byte function: '%s'", name))
 	}
@@ -58,37 +123,243 @@ func getByteFunction(name string) (kanzi.ByteFunction, error) {
 
 func TestLZ(b *testing.T) {
 	if err := testFunctionCorrectness("LZ"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+
+	if err := testLZModes(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testLZDictionary(); err != nil {
+		b.Error(err)
 	}
 }
 
 func TestROLZ(b *testing.T) {
 	if err := testFunctionCorrectness("ROLZ"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+
+	if err := testROLZCoders(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testROLZLogPosChecks(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testROLZSmallBlocks(); err != nil {
+		b.Error(err)
 	}
 }
 
 func TestZRLT(b *testing.T) {
 	if err := testFunctionCorrectness("ZRLT"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+
+	if err := testZRLTModes(); err != nil {
+		b.Error(err)
 	}
 }
 
 func TestRLT(b *testing.T) {
 	if err := testFunctionCorrectness("RLT"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+
+	if err := testRLTWidths(); err != nil {
+		b.Error(err)
 	}
 }
 
 func TestSRT(b *testing.T) {
 	if err := testFunctionCorrectness("SRT"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
+	}
+
+	if err := testSRTAfterBWT(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestAutoBWT(b *testing.T) {
+	if err := testFunctionCorrectness("AUTOBWT"); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestPath(b *testing.T) {
+	if err := testFunctionCorrectness("PATH"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testPathCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestExe(b *testing.T) {
+	if err := testFunctionCorrectness("EXE"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testExeCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestFP(b *testing.T) {
+	if err := testFunctionCorrectness("FP"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testFPCodec(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testFPCodecParams(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestLog(b *testing.T) {
+	if err := testFunctionCorrectness("LOG"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testLogCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestSoA(b *testing.T) {
+	if err := testFunctionCorrectness("SOA"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testSoACodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestUTF16(b *testing.T) {
+	if err := testFunctionCorrectness("UTF16"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testUTF16Codec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestB64(b *testing.T) {
+	if err := testFunctionCorrectness("B64"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testBase64Codec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestStruct(b *testing.T) {
+	if err := testFunctionCorrectness("STRUCT"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testStructCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestImage(b *testing.T) {
+	if err := testFunctionCorrectness("IMG"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testImageCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestColor(b *testing.T) {
+	if err := testFunctionCorrectness("COLOR"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testColorCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestMeta(b *testing.T) {
+	if err := testFunctionCorrectness("META"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testMetaCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestPlane(b *testing.T) {
+	if err := testFunctionCorrectness("PLANE"); err != nil {
+		b.Error(err)
+	}
+
+	if err := testPlaneCodec(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestSequenceHeader(b *testing.T) {
+	if err := testSequenceHeader(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestGuard(b *testing.T) {
+	if err := testGuard(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestStreamFunction(b *testing.T) {
+	if err := testStreamFunction(); err != nil {
+		b.Error(err)
+	}
+}
+
+func TestTextCodec(b *testing.T) {
+	if err := testTextCodec(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testTextDictionary(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testTextRetain(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testTextChunks(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testTextMarkup(); err != nil {
+		b.Error(err)
+	}
+
+	if err := testTextBaselineFormat(); err != nil {
+		b.Error(err)
 	}
 }
 
 // func TestROLZX(b *testing.T) {
 // 	if err := testFunctionCorrectness("ROLZX"); err != nil {
-// 		b.Errorf(err.Error())
+// 		b.Error(err)
 // 	}
 // }
 
@@ -278,3 +549,2773 @@ func testFunctionCorrectness(name string) error {
 
 	return error(nil)
 }
+
+func testPathCodec() error {
+	dirs := []string{"src", "test", "docs", "build/classes", "lib/native"}
+	words := []string{"Main", "Reader", "Writer", "Utils", "Config", "Parser", "Server", "Client"}
+	names := make([]string, 0)
+
+	for _, d := range dirs {
+		for i := 0; i < 200; i++ {
+			name := fmt.Sprintf("project/%s/module%d/%s%s.go", d, i%17, words[i%len(words)], words[(i/8)%len(words)])
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, trailingLF := range []bool{true, false} {
+		input := []byte(strings.Join(names, "\n"))
+
+		if trailingLF == true {
+			input = append(input, '\n')
+		}
+
+		f, _ := function.NewPathCodec()
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+		_, dstIdx, err := f.Forward(input, output)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Path codec: %d names, %d => %d bytes\n", len(names), len(input), dstIdx)
+		reverse := make([]byte, len(input))
+		f, _ = function.NewPathCodec()
+		_, n, err := f.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, reverse[0:n]) == false {
+			return fmt.Errorf("Path codec: decoded names differ from input")
+		}
+	}
+
+	return nil
+}
+
+func testTextCodec() error {
+	words := []string{"the", "compression", "of", "some", "text", "with", "a", "few", "naïve", "café",
+		"日本語", "für", "and", "data", "in", "many", "languages", "is", "common", "today"}
+	var buf bytes.Buffer
+
+	for i := 0; i < 20000; i++ {
+		buf.WriteString(words[rand.Intn(len(words))])
+		buf.WriteByte(' ')
+
+		if i%17 == 16 {
+			buf.WriteString(".\n")
+		}
+	}
+
+	input := buf.Bytes()
+
+	for _, tc := range []int{1, 2} {
+		ctx := map[string]interface{}{"blockSize": uint(len(input)), "textcodec": tc}
+		f, err := function.NewTextCodecWithCtx(&ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+		_, dstIdx, err := f.Forward(input, output)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Text codec %d: %d => %d bytes\n", tc, len(input), dstIdx)
+		f, _ = function.NewTextCodecWithCtx(&ctx)
+		reverse := make([]byte, len(input))
+		_, n, err := f.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, reverse[0:n]) == false {
+			return fmt.Errorf("Text codec %d: decoded data differs from input", tc)
+		}
+	}
+
+	return nil
+}
+
+// Text with a few runs of bytes with the high bit set, generated without
+// math/rand so that the output of the codecs is reproducible
+func baselineText() []byte {
+	words := []string{"the", "compression", "of", "naïve", "some", "text", "with", "a", "few", "data",
+		"and", "in", "many", "languages", "is", "common", "today", "für"}
+	res := make([]byte, 0, 200000)
+	seed := uint32(12345)
+
+	for len(res) < 150000 {
+		seed = seed*1103515245 + 12345
+		r := int(seed >> 16)
+
+		if r%200 == 0 {
+			for i := 0; i < 3+r%9; i++ {
+				res = append(res, byte(0x80|(r>>(i%8))))
+			}
+		} else {
+			res = append(res, words[r%len(words)]...)
+		}
+
+		res = append(res, " \n"[r%13/12])
+	}
+
+	return res
+}
+
+// The text codecs must produce the blocks of the stream format version 8
+// unless the extensions are enabled: the SHA-256 of the reference outputs
+// were computed with the version 8 codecs.
+func testTextBaselineFormat() error {
+	input := baselineText()
+	baseline := map[int]string{
+		1: "d9114a07987c7a67a3c58fe0920f76ce6a95a1e05daf965cdf28ace29c9bfd17",
+		2: "8e1a5a45e652439883b00a6fbf903b7c70d1c448b71fbd3540e9516671da22c0",
+	}
+
+	for _, tc := range []int{1, 2} {
+		for _, ext := range []bool{false, true} {
+			ctx := map[string]interface{}{"blockSize": uint(len(input)), "textcodec": tc, "textEscapeRuns": ext}
+			f, _ := function.NewTextCodecWithCtx(&ctx)
+			output := make([]byte, f.MaxEncodedLen(len(input)))
+			_, dstIdx, err := f.Forward(input, output)
+
+			if err != nil {
+				return err
+			}
+
+			// Only the second codec groups the escapes
+			if sum := fmt.Sprintf("%x", sha256.Sum256(output[0:dstIdx])); (sum == baseline[tc]) != (ext == false || tc == 1) {
+				return fmt.Errorf("Text codec %d (escape runs %v): unexpected format of the output", tc, ext)
+			}
+
+			// The decoder does not need the option
+			f, _ = function.NewTextCodecWithCtx(&map[string]interface{}{"blockSize": uint(len(input)), "textcodec": tc})
+			reverse := make([]byte, len(input))
+			_, n, err := f.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return err
+			}
+
+			if bytes.Equal(input, reverse[0:n]) == false {
+				return fmt.Errorf("Text codec %d (escape runs %v): decoded data differs from input", tc, ext)
+			}
+		}
+	}
+
+	// The streams using the extensions are rejected by the decoders of version 8
+	for _, ext := range []bool{false, true} {
+		output, err := compressStream(input, map[string]interface{}{"codec": "HUFFMAN", "transform": "TEXT", "textEscapeRuns": ext})
+
+		if err != nil {
+			return err
+		}
+
+		hdr, err := kio.ParseStreamHeader(output)
+
+		if err != nil {
+			return err
+		}
+
+		if (hdr.Version == kio.STREAM_MIN_VERSION) != (ext == false) {
+			return fmt.Errorf("Escape runs %v: invalid stream version %d", ext, hdr.Version)
+		}
+
+		decoded, err := decompressStream(output, nil)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, decoded) == false {
+			return fmt.Errorf("Escape runs %v: decompressed data differs from input", ext)
+		}
+	}
+
+	return nil
+}
+
+func testTextDictionary() error {
+	tokens := []string{"kubelet", "apiserver", "containerd", "namespace", "deployment",
+		"replicaset", "Reconciling", "podSandbox", "etcd", "timeout"}
+	var buf bytes.Buffer
+
+	for i := 0; i < 20000; i++ {
+		buf.WriteString(tokens[rand.Intn(len(tokens))])
+		buf.WriteString([]string{" ", " ", ": ", " = ", ".\n"}[rand.Intn(5)])
+	}
+
+	input := buf.Bytes()
+	words := make([][]byte, len(tokens))
+
+	for i := range tokens {
+		words[i] = []byte(tokens[i])
+	}
+
+	if _, err := function.NewTextDictionary([][]byte{[]byte("no-dash")}, false, false); err == nil {
+		return fmt.Errorf("Expected an error for an invalid dictionary word")
+	}
+
+	encode := func(ctx map[string]interface{}) ([]byte, error) {
+		ctx["blockSize"] = uint(len(input))
+		f, err := function.NewTextCodecWithCtx(&ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+		_, dstIdx, err := f.Forward(input, output)
+		return output[0:dstIdx], err
+	}
+
+	decode := func(ctx map[string]interface{}, encoded []byte) error {
+		ctx["blockSize"] = uint(len(input))
+		f, err := function.NewTextCodecWithCtx(&ctx)
+
+		if err != nil {
+			return err
+		}
+
+		reverse := make([]byte, len(input))
+		_, n, err := f.Inverse(encoded, reverse)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, reverse[0:n]) == false {
+			return fmt.Errorf("Text dictionary: decoded data differs from input")
+		}
+
+		return nil
+	}
+
+	for _, tc := range []int{1, 2} {
+		ref, err := encode(map[string]interface{}{"textcodec": tc})
+
+		if err != nil {
+			return err
+		}
+
+		for _, extend := range []bool{false, true} {
+			for _, embed := range []bool{false, true} {
+				dict, err := function.NewTextDictionary(words, extend, embed)
+
+				if err != nil {
+					return err
+				}
+
+				encoded, err := encode(map[string]interface{}{"textcodec": tc, "textDictionary": dict})
+
+				if err != nil {
+					return err
+				}
+
+				fmt.Printf("Text codec %d (extend=%v, embed=%v): %d => %d bytes (default dictionary: %d)\n",
+					tc, extend, embed, len(input), len(encoded), len(ref))
+
+				if len(encoded) >= len(ref) {
+					return fmt.Errorf("Text dictionary: no gain over the default dictionary")
+				}
+
+				// The decoder does not know the dictionary
+				registered := function.GetTextDictionary(dict.ID()) != nil
+				err = decode(map[string]interface{}{"textcodec": tc}, encoded)
+
+				if embed == false && registered == false {
+					if err == nil {
+						return fmt.Errorf("Text dictionary: expected an error for an unregistered dictionary")
+					}
+
+					function.RegisterTextDictionary(dict)
+					err = decode(map[string]interface{}{"textcodec": tc}, encoded)
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func testLZModes() error {
+	words := []string{"match ", "finder ", "hash ", "chain ", "lazy ", "greedy ", "parsing ", "literal\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 256*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+
+		if rand.Intn(8) == 0 {
+			buf.WriteByte(byte(rand.Intn(256)))
+		}
+	}
+
+	inputs := [][]byte{buf.Bytes(), make([]byte, 100000), make([]byte, 15)}
+	random := make([]byte, 70000)
+	rand.Read(random)
+	inputs = append(inputs, random)
+
+	for i, input := range inputs {
+		sizes := make([]uint, 0)
+
+		for _, mode := range []int{function.LZ_MODE_FAST, function.LZ_MODE_GREEDY, function.LZ_MODE_LAZY} {
+			ctx := map[string]interface{}{"lzMode": mode}
+			f, err := function.NewLZCodecWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			output := make([]byte, f.MaxEncodedLen(len(input)))
+			_, dstIdx, err := f.Forward(input, output)
+
+			if err != nil {
+				return fmt.Errorf("Input %v, mode %v: %v", i, mode, err)
+			}
+
+			// The decoder does not depend on the mode
+			g, _ := function.NewLZCodec()
+			reverse := make([]byte, len(input))
+			_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return fmt.Errorf("Input %v, mode %v: %v", i, mode, err)
+			}
+
+			if int(oIdx) != len(input) || bytes.Equal(input, reverse) == false {
+				return fmt.Errorf("Input %v, mode %v: decompressed data differs from input", i, mode)
+			}
+
+			sizes = append(sizes, dstIdx)
+		}
+
+		fmt.Printf("LZ input %v: %v bytes => fast: %v, greedy: %v, lazy: %v\n", i, len(input), sizes[0], sizes[1], sizes[2])
+
+		if i == 0 && (sizes[1] >= sizes[0] || sizes[2] > sizes[1]) {
+			return fmt.Errorf("Hash chains do not improve compression: %v", sizes)
+		}
+	}
+
+	ctx := map[string]interface{}{"lzMode": 5}
+
+	if _, err := function.NewLZCodecWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid LZ mode")
+	}
+
+	return nil
+}
+
+func testLZDictionary() error {
+	// Small messages sharing most of their content
+	statuses := []string{"active", "disabled", "pending"}
+	samples := make([][]byte, 600)
+
+	for i := range samples {
+		samples[i] = []byte(fmt.Sprintf(`{"id":%d,"user":"user%d","status":"%s","created":"2017-%02d-%02dT10:%02d:00Z",`+
+			`"roles":["reader","writer"],"settings":{"theme":"dark","language":"en-US","notifications":true},"score":%d}`,
+			rand.Intn(100000), rand.Intn(1000), statuses[rand.Intn(3)], 1+rand.Intn(12), 1+rand.Intn(28),
+			rand.Intn(60), rand.Intn(1000)))
+	}
+
+	dict, err := function.TrainLZDictionary(samples[0:500], 4096)
+
+	if err != nil {
+		return err
+	}
+
+	if len(dict.Bytes()) < function.LZ_MIN_DICT_SIZE || len(dict.Bytes()) > 4096 {
+		return fmt.Errorf("Invalid trained dictionary size: %v", len(dict.Bytes()))
+	}
+
+	for _, mode := range []int{function.LZ_MODE_FAST, function.LZ_MODE_GREEDY, function.LZ_MODE_LAZY} {
+		sizes := [2]int{}
+
+		for i, d := range []*function.LZDictionary{nil, dict} {
+			ctx := map[string]interface{}{"lzMode": mode, "lzDictionary": d}
+			f, err := function.NewLZCodecWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			for n, input := range samples[500:] {
+				output := make([]byte, f.MaxEncodedLen(len(input)))
+				_, dstIdx, err := f.Forward(input, output)
+
+				if err != nil {
+					return fmt.Errorf("Sample %v, mode %v: %v", n, mode, err)
+				}
+
+				reverse := make([]byte, len(input))
+				_, oIdx, err := f.Inverse(output[0:dstIdx], reverse)
+
+				if err != nil {
+					return fmt.Errorf("Sample %v, mode %v: %v", n, mode, err)
+				}
+
+				if int(oIdx) != len(input) || bytes.Equal(input, reverse) == false {
+					return fmt.Errorf("Sample %v, mode %v: decompressed data differs from input", n, mode)
+				}
+
+				sizes[i] += int(dstIdx)
+			}
+		}
+
+		fmt.Printf("LZ mode %v, 100 samples: %v bytes without dictionary, %v bytes with a dictionary of %v bytes\n",
+			mode, sizes[0], sizes[1], len(dict.Bytes()))
+
+		if sizes[1]*2 > sizes[0] {
+			return fmt.Errorf("The dictionary does not improve compression: %v", sizes)
+		}
+	}
+
+	// Decode with another dictionary: the dictionary of the block must be registered
+	other, _ := function.NewLZDictionary(bytes.Repeat([]byte("other dictionary "), 20))
+	ctx := map[string]interface{}{"lzDictionary": dict}
+	f, _ := function.NewLZCodecWithCtx(&ctx)
+	output := make([]byte, f.MaxEncodedLen(len(samples[0])))
+	_, dstIdx, _ := f.Forward(samples[0], output)
+	ctx = map[string]interface{}{"lzDictionary": other}
+	g, _ := function.NewLZCodecWithCtx(&ctx)
+	reverse := make([]byte, len(samples[0]))
+
+	if function.GetLZDictionary(dict.ID()) == nil {
+		if _, _, err := g.Inverse(output[0:dstIdx], reverse); err == nil {
+			return errors.New("Expected an error for an unregistered dictionary")
+		}
+
+		function.RegisterLZDictionary(dict)
+	}
+
+	if _, _, err := g.Inverse(output[0:dstIdx], reverse); err != nil {
+		return err
+	}
+
+	if bytes.Equal(samples[0], reverse) == false {
+		return errors.New("Decompressed data differs from input with a registered dictionary")
+	}
+
+	if _, err := function.NewLZDictionary(make([]byte, 10)); err == nil {
+		return errors.New("Expected an error for a dictionary too small")
+	}
+
+	if _, err := function.TrainLZDictionary(samples, 100); err == nil {
+		return errors.New("Expected an error for an invalid dictionary size")
+	}
+
+	ctx = map[string]interface{}{"lzDictionary": "dict"}
+
+	if _, err := function.NewLZCodecWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid dictionary parameter")
+	}
+
+	return nil
+}
+
+func testZRLTModes() error {
+	inputs := [][]byte{
+		{0},
+		{0, 0, 0, 0},
+		{0xFE, 0xFF, 0, 0xFF, 0, 0, 1, 0xFD},
+		make([]byte, 100000),
+	}
+
+	// Post MTF like data: many zero runs (some very long), small values
+	for _, maxRun := range []int{4, 64, 4096} {
+		block := make([]byte, 0, 65536)
+
+		for len(block) < 65536 {
+			block = append(block, make([]byte, rand.Intn(maxRun))...)
+			block = append(block, byte(1+rand.Intn(8)), byte(rand.Intn(256)))
+		}
+
+		inputs = append(inputs, block)
+	}
+
+	for i, input := range inputs {
+		sizes := [3]uint{}
+
+		for _, mode := range []int{function.ZRLT_MODE_BIT, function.ZRLT_MODE_BYTE} {
+			ctx := map[string]interface{}{"zrlt": mode}
+			f, err := function.NewZRLTWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			output := make([]byte, f.MaxEncodedLen(len(input)))
+			_, dstIdx, err := f.Forward(input, output)
+
+			if err != nil {
+				// Expansion (EG. isolated escaped values)
+				continue
+			}
+
+			if mode == function.ZRLT_MODE_BYTE && (output[0] != 0xFF || output[1] != 2) {
+				return fmt.Errorf("Input %v: missing byte mode marker", i)
+			}
+
+			sizes[mode] = dstIdx
+
+			// The decoder detects the mode
+			g, _ := function.NewZRLT()
+			reverse := make([]byte, len(input))
+			_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return fmt.Errorf("Input %v, mode %v: %v", i, mode, err)
+			}
+
+			if int(oIdx) != len(input) || bytes.Equal(input, reverse) == false {
+				return fmt.Errorf("Input %v, mode %v: decompressed data differs from input", i, mode)
+			}
+		}
+
+		fmt.Printf("ZRLT input %v: %v bytes => bit mode: %v, byte mode: %v\n", i, len(input), sizes[1], sizes[2])
+
+		// Long runs are shorter in byte mode
+		if i == len(inputs)-1 && sizes[2] >= sizes[1] {
+			return fmt.Errorf("Input %v: byte mode not better for long runs", i)
+		}
+	}
+
+	ctx := map[string]interface{}{"zrlt": 3}
+
+	if _, err := function.NewZRLTWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid ZRLT mode")
+	}
+
+	return nil
+}
+
+func testRLTWidths() error {
+	// 16 bit pattern runs (bitmap), 32 bit values in zero-initialized
+	// structures, byte runs
+	bitmap := make([]byte, 0, 65536)
+	records := make([]byte, 0, 65536)
+	zeros := make([]byte, 0, 65536)
+
+	// Blank area: without byte runs, the byte width would expand the bitmap
+	bitmap = append(bitmap, make([]byte, 512)...)
+
+	for len(bitmap) < 65536 {
+		pattern := []byte{byte(rand.Intn(256)), byte(rand.Intn(256))}
+		bitmap = append(bitmap, bytes.Repeat(pattern, 8+rand.Intn(64))...)
+	}
+
+	for len(records) < 65536 {
+		var rec [64]byte
+		binary.LittleEndian.PutUint32(rec[0:], uint32(len(records)))
+		binary.LittleEndian.PutUint32(rec[4:], 0xDEADBEEF)
+		copy(rec[32:], bytes.Repeat([]byte{0x3F, 0x80, 0, 0}, 6))
+		records = append(records, rec[:]...)
+	}
+
+	for len(zeros) < 65536 {
+		zeros = append(zeros, make([]byte, 4+rand.Intn(100))...)
+		zeros = append(zeros, byte(1+rand.Intn(255)))
+	}
+
+	inputs := []struct {
+		name  string
+		input []byte
+		best  int
+	}{
+		{"bitmap", bitmap, function.RLT_WIDTH_SHORT},
+		{"records", records, function.RLT_WIDTH_INT},
+		{"zeros", zeros, function.RLT_WIDTH_BYTE},
+	}
+
+	for _, t := range inputs {
+		sizes := [5]uint{}
+
+		for _, width := range []int{function.RLT_WIDTH_AUTO, function.RLT_WIDTH_BYTE,
+			function.RLT_WIDTH_SHORT, function.RLT_WIDTH_INT} {
+			ctx := map[string]interface{}{"rltWidth": width}
+			f, err := function.NewRLTWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			output := make([]byte, f.MaxEncodedLen(len(t.input)))
+			_, dstIdx, err := f.Forward(t.input, output)
+
+			if err != nil {
+				return fmt.Errorf("%v, width %v: %v", t.name, width, err)
+			}
+
+			if width > function.RLT_WIDTH_BYTE && (output[0] != output[1] || int(output[2]) != width) {
+				return fmt.Errorf("%v, width %v: missing width marker", t.name, width)
+			}
+
+			sizes[width] = dstIdx
+
+			// The decoder detects the width
+			g, _ := function.NewRLT()
+			reverse := make([]byte, len(t.input))
+			_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return fmt.Errorf("%v, width %v: %v", t.name, width, err)
+			}
+
+			if int(oIdx) != len(t.input) || bytes.Equal(t.input, reverse) == false {
+				return fmt.Errorf("%v, width %v: decompressed data differs from input", t.name, width)
+			}
+		}
+
+		fmt.Printf("RLT %v: %v bytes => auto: %v, 8 bits: %v, 16 bits: %v, 32 bits: %v\n",
+			t.name, len(t.input), sizes[0], sizes[1], sizes[2], sizes[4])
+
+		for _, width := range []int{function.RLT_WIDTH_BYTE, function.RLT_WIDTH_SHORT, function.RLT_WIDTH_INT} {
+			if width != t.best && sizes[width] <= sizes[t.best] {
+				return fmt.Errorf("%v: width %v not worse than width %v: %v", t.name, width, t.best, sizes)
+			}
+		}
+
+		if sizes[function.RLT_WIDTH_AUTO] != sizes[t.best] {
+			return fmt.Errorf("%v: width %v not selected: %v", t.name, t.best, sizes)
+		}
+	}
+
+	// Run at the start of a block
+	g, _ := function.NewRLT()
+
+	if _, _, err := g.Inverse([]byte{7, 7, 2, 7, 5}, make([]byte, 64)); err == nil {
+		return errors.New("Expected an error for a run of wide symbols at the start of the block")
+	}
+
+	ctx := map[string]interface{}{"rltWidth": 3}
+
+	if _, err := function.NewRLTWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid RLT symbol width")
+	}
+
+	return nil
+}
+
+// Big mixed block (CR+LF text, binary data, LF text) split in chunks
+func testTextChunks() error {
+	tokens := []string{"Scheduling", "container", "kubernetes", "allocation", "persistent",
+		"volume", "controller", "endpoint", "Reconciling", "replication", "threshold"}
+	var buf bytes.Buffer
+
+	for _, part := range []string{"\r\n", "binary", "\n"} {
+		start := buf.Len()
+
+		for buf.Len() < start+48*1024 {
+			if part == "binary" {
+				buf.WriteByte(byte(rand.Intn(256)))
+				continue
+			}
+
+			buf.WriteString(tokens[rand.Intn(len(tokens))])
+			buf.WriteString([]string{" ", " the ", " of ", " and ", ", ", "." + part}[rand.Intn(6)])
+		}
+	}
+
+	input := buf.Bytes()
+	sizes := make([]int, 0)
+
+	for _, chunkSize := range []int{0, 16 * 1024, 40 * 1024} {
+		for _, tc := range []int{1, 2} {
+			ctx := map[string]interface{}{"textcodec": tc}
+
+			if chunkSize > 0 {
+				ctx["textChunkSize"] = chunkSize
+			}
+
+			f, err := function.NewTextCodecWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			output := make([]byte, f.MaxEncodedLen(len(input)))
+			_, dstIdx, err := f.Forward(input, output)
+
+			if err != nil {
+				return fmt.Errorf("Chunk size %v, TC%v: %v", chunkSize, tc, err)
+			}
+
+			if chunked := output[0]&0x40 != 0; chunked != (chunkSize > 0) {
+				return fmt.Errorf("Chunk size %v, TC%v: unexpected chunked flag", chunkSize, tc)
+			}
+
+			fmt.Printf("Text chunks: chunk size %v, TC%v: %v => %v bytes\n", chunkSize, tc, len(input), dstIdx)
+			sizes = append(sizes, int(dstIdx))
+			f, _ = function.NewTextCodecWithCtx(&ctx)
+			reverse := make([]byte, len(input))
+			_, oIdx, err := f.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return fmt.Errorf("Chunk size %v, TC%v: %v", chunkSize, tc, err)
+			}
+
+			if int(oIdx) != len(input) || bytes.Equal(input, reverse) == false {
+				return fmt.Errorf("Chunk size %v, TC%v: decompressed data differs from input", chunkSize, tc)
+			}
+		}
+	}
+
+	// The CR+LF chunks and the binary chunks are no longer misclassified
+	if sizes[2] >= sizes[0] || sizes[3] >= sizes[1] {
+		return fmt.Errorf("Chunked blocks are not smaller: %v", sizes)
+	}
+
+	ctx := map[string]interface{}{"textChunkSize": 16}
+
+	if _, err := function.NewTextCodecWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid chunk size")
+	}
+
+	return nil
+}
+
+// Many small blocks: the dynamic dictionary of a block seeds the next block
+func testTextRetain() error {
+	tokens := []string{"Scheduling", "container", "kubernetes", "allocation", "persistent",
+		"volume", "controller", "endpoint", "Reconciling", "replication", "threshold"}
+	blocks := make([][]byte, 64)
+
+	for i := range blocks {
+		var buf bytes.Buffer
+
+		for buf.Len() < 1024 {
+			buf.WriteString(tokens[rand.Intn(len(tokens))])
+			buf.WriteString([]string{" ", " the ", " of ", " and ", ", ", ".\n"}[rand.Intn(6)])
+		}
+
+		blocks[i] = buf.Bytes()
+	}
+
+	for _, tc := range []int{1, 2} {
+		encode := func(retain bool) ([][]byte, int, error) {
+			ctx := map[string]interface{}{"blockSize": uint(1024), "textcodec": tc, "textRetain": retain}
+			f, err := function.NewTextCodecWithCtx(&ctx)
+
+			if err != nil {
+				return nil, 0, err
+			}
+
+			res := make([][]byte, len(blocks))
+			total := 0
+			output := make([]byte, 4096)
+
+			for i := range blocks {
+				// Escape: restart from a fresh dictionary in the middle
+				if i == len(blocks)/2 {
+					f.ResetDictionary()
+				}
+
+				_, dstIdx, err := f.Forward(blocks[i], output)
+
+				if err != nil {
+					return nil, 0, err
+				}
+
+				// Reuse the output buffer (the retained dictionary must not alias it)
+				res[i] = append([]byte(nil), output[0:dstIdx]...)
+				total += int(dstIdx)
+			}
+
+			return res, total, nil
+		}
+
+		_, plainSize, err := encode(false)
+
+		if err != nil {
+			return err
+		}
+
+		encoded, retainSize, err := encode(true)
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("TC%d: blocks encoded to %d bytes (%d bytes with retained dictionary)\n", tc, plainSize, retainSize)
+
+		if retainSize >= plainSize {
+			return fmt.Errorf("TC%d: no gain with retained dictionary (%d >= %d)", tc, retainSize, plainSize)
+		}
+
+		ctx := map[string]interface{}{"blockSize": uint(1024), "textcodec": tc, "textRetain": true}
+		f, err := function.NewTextCodecWithCtx(&ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output := make([]byte, 2048)
+
+		for i := range encoded {
+			_, dstIdx, err := f.Inverse(encoded[i], output)
+
+			if err != nil {
+				return fmt.Errorf("TC%d: block %d: %v", tc, i, err)
+			}
+
+			if bytes.Equal(output[0:dstIdx], blocks[i]) == false {
+				return fmt.Errorf("TC%d: block %d: decompressed data differs from input", tc, i)
+			}
+
+			// Scribble over the buffer shared with the next block
+			for j := range output {
+				output[j] = 0xAA
+			}
+		}
+
+		// A block that depends on the previous block cannot be decoded alone
+		ctx = map[string]interface{}{"blockSize": uint(1024), "textcodec": tc}
+		f, _ = function.NewTextCodecWithCtx(&ctx)
+
+		if _, _, err = f.Inverse(encoded[1], output); err == nil {
+			return fmt.Errorf("TC%d: expected an error when decoding a dependent block alone", tc)
+		}
+	}
+
+	return nil
+}
+
+// One entropy coder per ROLZ stream (literals, match lengths, match indexes)
+func testROLZCoders() error {
+	words := []string{"literal ", "length ", "offset ", "stream ", "0x2F ", "coder\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 256*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+		buf.WriteByte(byte(rand.Intn(256)))
+	}
+
+	input := buf.Bytes()
+
+	for _, coders := range []string{"", "ANS0,ANS0,ANS0", "ANS1,HUFFMAN,ANS0", "HUFFMAN,RANGE,NONE", "CM,FPAQ,HUFFMAN"} {
+		ctx := map[string]interface{}{"transform": "ROLZ"}
+
+		if coders != "" {
+			ctx["lzCoders"] = coders
+		}
+
+		f, err := function.NewROLZCodecWithCtx(&ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+		_, dstIdx, err := f.Forward(input, output)
+
+		if err != nil {
+			return fmt.Errorf("Coders '%v': %v", coders, err)
+		}
+
+		fmt.Printf("ROLZ coders '%v': %d => %d bytes\n", coders, len(input), dstIdx)
+
+		// The coders are read from the block header
+		ctx = map[string]interface{}{"transform": "ROLZ"}
+		f, _ = function.NewROLZCodecWithCtx(&ctx)
+		reverse := make([]byte, len(input))
+
+		if _, _, err = f.Inverse(output[0:dstIdx], reverse); err != nil {
+			return fmt.Errorf("Coders '%v': %v", coders, err)
+		}
+
+		if bytes.Equal(input, reverse) == false {
+			return fmt.Errorf("Coders '%v': decompressed data differs from input", coders)
+		}
+	}
+
+	for _, coders := range []string{"ANS0,ANS0", "ANS0,ZIP,ANS0"} {
+		ctx := map[string]interface{}{"transform": "ROLZ", "lzCoders": coders}
+
+		if _, err := function.NewROLZCodecWithCtx(&ctx); err == nil {
+			return fmt.Errorf("Expected an error for invalid coders '%v'", coders)
+		}
+	}
+
+	return nil
+}
+
+// Number of positions checked per context (recorded in the block if not the default)
+func testROLZLogPosChecks() error {
+	words := []string{"reduced ", "offset ", "context ", "position ", "table ", "match\n"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 256*1024 {
+		buf.WriteString(words[rand.Intn(len(words))])
+		buf.WriteByte(byte(rand.Intn(256)))
+	}
+
+	input := buf.Bytes()
+
+	for _, transform := range []string{"ROLZ", "ROLZX"} {
+		for _, logPosChecks := range []uint{2, 4, 5, 8} {
+			ctx := map[string]interface{}{"transform": transform, "rolzLogPosChecks": logPosChecks}
+			f, err := function.NewROLZCodecWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			output := make([]byte, f.MaxEncodedLen(len(input)))
+			_, dstIdx, err := f.Forward(input, output)
+
+			if err != nil {
+				return fmt.Errorf("%s, log positions %d: %v", transform, logPosChecks, err)
+			}
+
+			fmt.Printf("%s log positions %d: %d => %d bytes\n", transform, logPosChecks, len(input), dstIdx)
+
+			// The number of positions is read from the block header
+			ctx = map[string]interface{}{"transform": transform}
+			f, _ = function.NewROLZCodecWithCtx(&ctx)
+			reverse := make([]byte, len(input))
+
+			if _, _, err = f.Inverse(output[0:dstIdx], reverse); err != nil {
+				return fmt.Errorf("%s, log positions %d: %v", transform, logPosChecks, err)
+			}
+
+			if bytes.Equal(input, reverse) == false {
+				return fmt.Errorf("%s, log positions %d: decompressed data differs from input", transform, logPosChecks)
+			}
+		}
+
+		ctx := map[string]interface{}{"transform": transform, "rolzLogPosChecks": uint(9)}
+
+		if _, err := function.NewROLZCodecWithCtx(&ctx); err == nil {
+			return fmt.Errorf("%s: expected an error for invalid log positions 9", transform)
+		}
+	}
+
+	return nil
+}
+
+// The blocks of a few bytes are not transformed and the streams of a few
+// bytes round trip
+func testROLZSmallBlocks() error {
+	input := []byte("abcabcabcabcabcabc")
+
+	for _, transform := range []string{"ROLZ", "ROLZX"} {
+		for n := 1; n <= 8; n++ {
+			ctx := map[string]interface{}{"transform": transform}
+			f, err := function.NewROLZCodecWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			output := make([]byte, f.MaxEncodedLen(n))
+
+			if _, _, err = f.Forward(input[0:n], output); errors.Is(err, kanzi.ErrNotApplicable) == false {
+				return fmt.Errorf("%s, %d bytes: expected a not applicable error, got: %v", transform, n, err)
+			}
+
+			params := map[string]interface{}{"transform": transform}
+			compressed, err := compressStream(input[0:n], params)
+
+			if err != nil {
+				return fmt.Errorf("%s, %d bytes: %v", transform, n, err)
+			}
+
+			decoded, err := decompressStream(compressed, params)
+
+			if err != nil {
+				return fmt.Errorf("%s, %d bytes: %v", transform, n, err)
+			}
+
+			if bytes.Equal(input[0:n], decoded) == false {
+				return fmt.Errorf("%s, %d bytes: decompressed data differs from input", transform, n)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Generate ARM64 like code: 1 BL every 8 instructions, 1 RET every 64
+func generateARM64Code(size int) []byte {
+	code := make([]byte, size)
+
+	for i := 0; i+4 <= size; i += 4 {
+		var w uint32
+
+		switch {
+		case (i>>2)&63 == 63:
+			w = 0xD65F03C0
+		case (i>>2)&7 == 3:
+			w = 0x94000000 | uint32(rand.Intn(1<<12)-(i>>2))&0x03FFFFFF
+		default:
+			w = 0xA9000000 | uint32(rand.Intn(1<<24))
+		}
+
+		binary.LittleEndian.PutUint32(code[i:], w)
+	}
+
+	return code
+}
+
+// Generate x86 like code: random bytes with frequent CALL rel32
+func generateX86Code(size int) []byte {
+	code := make([]byte, size)
+
+	for i := 0; i < size; i++ {
+		code[i] = byte(0x40 + rand.Intn(64))
+	}
+
+	for i := 0; i+5 <= size; i += 16 + rand.Intn(16) {
+		code[i] = 0xE8
+		binary.LittleEndian.PutUint32(code[i+1:], uint32(rand.Intn(1<<16)-(1<<15)))
+	}
+
+	return code
+}
+
+func testExeCodec() error {
+	const size = 64 * 1024
+
+	elf := generateARM64Code(size)
+	copy(elf, "\x7FELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(elf[18:], 183) // EM_AARCH64
+
+	pe := generateX86Code(size)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3C:], 0x80)
+	copy(pe[0x80:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(pe[0x84:], 0x8664) // AMD64
+
+	tests := []struct {
+		name  string
+		input []byte
+		arch  byte
+	}{
+		{"ELF ARM64", elf, 2},
+		{"PE x86", pe, 1},
+		{"ARM64 (no header)", generateARM64Code(size), 2},
+		{"x86 (no header)", generateX86Code(size), 1},
+	}
+
+	for _, t := range tests {
+		f, _ := function.NewExeCodec()
+		output := make([]byte, f.MaxEncodedLen(len(t.input)))
+		srcIdx, dstIdx, err := f.Forward(t.input, output)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if srcIdx != uint(len(t.input)) {
+			return fmt.Errorf("%v: only %d bytes consumed", t.name, srcIdx)
+		}
+
+		if output[0] != t.arch {
+			return fmt.Errorf("%v: expected architecture %d, got %d", t.name, t.arch, output[0])
+		}
+
+		fmt.Printf("%v: architecture %d, %d => %d bytes\n", t.name, output[0], len(t.input), dstIdx)
+		f, _ = function.NewExeCodec()
+		reverse := make([]byte, len(t.input))
+
+		if _, _, err = f.Inverse(output[0:dstIdx], reverse); err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if bytes.Equal(t.input, reverse) == false {
+			return fmt.Errorf("%v: decompressed data differs from input", t.name)
+		}
+	}
+
+	// Not code or unsupported architecture: the transform must be skipped
+	rnd := make([]byte, size)
+	rand.Read(rnd)
+	riscv := generateARM64Code(size)
+	copy(riscv, "\x7FELF\x02\x01\x01")
+	binary.LittleEndian.PutUint16(riscv[18:], 243) // EM_RISCV
+
+	for _, input := range [][]byte{rnd, riscv} {
+		f, _ := function.NewExeCodec()
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+
+		if _, _, err := f.Forward(input, output); err == nil {
+			return errors.New("Expected an error for data that is not supported code")
+		}
+	}
+
+	return nil
+}
+
+// Return the size of the input compressed with the transform and codec
+func compressedSize(input []byte, transform, codec string) (int, error) {
+	var buf bytes.Buffer
+	cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, codec, transform, 1<<20, 1, false)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = cos.Write(input); err != nil {
+		return 0, err
+	}
+
+	if err = cos.Close(); err != nil {
+		return 0, err
+	}
+
+	return buf.Len(), nil
+}
+
+func testFPCodec() error {
+	const n = 32768
+	f64 := make([]byte, 8*n)
+	f32 := make([]byte, 4*n)
+	xyz := make([]byte, 12*n+3) // interleaved float32 coordinates + trailing bytes
+
+	for i := 0; i < n; i++ {
+		t := float64(i) * 0.001
+		binary.LittleEndian.PutUint64(f64[8*i:], math.Float64bits(1000*math.Sin(t)*math.Exp(-t/10)))
+		binary.LittleEndian.PutUint32(f32[4*i:], math.Float32bits(float32(20+5*math.Sin(t)+rand.Float64()*0.01)))
+		binary.LittleEndian.PutUint32(xyz[12*i:], math.Float32bits(float32(t)))
+		binary.LittleEndian.PutUint32(xyz[12*i+4:], math.Float32bits(float32(math.Sin(t))))
+		binary.LittleEndian.PutUint32(xyz[12*i+8:], math.Float32bits(float32(100*math.Cos(t))))
+	}
+
+	text := []byte(strings.Repeat("Floating point numbers are not text. ", 1000))
+	random := make([]byte, 65536)
+	rand.Read(random)
+
+	tests := []struct {
+		name  string
+		input []byte
+		valid bool
+	}{
+		{"float64", f64, true},
+		{"float32", f32, true},
+		{"float32 x, y, z", xyz, true},
+		{"text", text, false},
+		{"random", random, false},
+	}
+
+	for _, t := range tests {
+		f, _ := function.NewFPCodec()
+		output := make([]byte, f.MaxEncodedLen(len(t.input)))
+		_, dstIdx, err := f.Forward(t.input, output)
+
+		if t.valid == false {
+			if err == nil {
+				return fmt.Errorf("%v: expected the transform to be skipped", t.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		reverse := make([]byte, len(t.input))
+		g, _ := function.NewFPCodec()
+		_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if int(oIdx) != len(t.input) || bytes.Equal(t.input, reverse) == false {
+			return fmt.Errorf("%v: decompressed data differs from input", t.name)
+		}
+
+		if int(dstIdx) >= len(t.input) {
+			return fmt.Errorf("%v: the FP transform expands the data: %v bytes => %v bytes", t.name, len(t.input), dstIdx)
+		}
+
+		// Followed by another stage
+		for _, tf := range []string{"FP+LZ", "FP+RLT", "FP+BWT+MTFT+ZRLT"} {
+			output, err := compressStream(t.input, map[string]interface{}{"transform": tf, "codec": "ANS0"})
+
+			if err != nil {
+				return fmt.Errorf("%v, %v: %v", t.name, tf, err)
+			}
+
+			decoded, err := decompressStream(output, nil)
+
+			if err != nil {
+				return fmt.Errorf("%v, %v: %v", t.name, tf, err)
+			}
+
+			if bytes.Equal(decoded, t.input) == false {
+				return fmt.Errorf("%v, %v: decompressed data differs from input", t.name, tf)
+			}
+		}
+
+		sizes := [2]int{}
+
+		for i, tf := range []string{"NONE", "FP"} {
+			if sizes[i], err = compressedSize(t.input, tf, "ANS0"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("FP %v: %v bytes => ANS0: %v, FP+ANS0: %v\n", t.name, len(t.input), sizes[0], sizes[1])
+
+		if sizes[1]*5 > sizes[0]*4 {
+			return fmt.Errorf("%v: the FP transform does not improve compression: %v", t.name, sizes)
+		}
+	}
+
+	// Corrupted header
+	f, _ := function.NewFPCodec()
+	output := make([]byte, f.MaxEncodedLen(len(f32)))
+	_, dstIdx, _ := f.Forward(f32, output)
+	output[1] = 9
+
+	if _, _, err := f.Inverse(output[0:dstIdx], make([]byte, len(f32))); err == nil {
+		return errors.New("Expected an error for an invalid stride")
+	}
+
+	return nil
+}
+
+func testLogCodec() error {
+	// Tokens restored verbatim, including the forms that cannot be encoded
+	samples := []string{
+		"192.168.1.20", "10.0.0.1", "010.0.0.1", "256.1.1.1", "1.2.3.4.5",
+		"2001:db8:85a3::8a2e:370:7334", "2001:0db8:85a3:0000:0000:8a2e:0370:7334",
+		"2001:DB8:85A3::8A2E:370:7334", "fe80::1ff:fe23:4567:890a:", "::ffff:192.0.2.128",
+		"123e4567-e89b-12d3-a456-426614174000", "123E4567-E89B-12D3-A456-426614174000",
+		"123e4567-E89B-12d3-a456-426614174000", "d41d8cd98f00b204e9800998ecf8427e",
+		"DA39A3EE5E6B4B0D3255BFEF95601890AFD80709", "da39a3ee5e6b4b0d3255BFEF95601890afd80709",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855x", "deadbeef",
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&sb, "2017-03-%02d 12:%02d:%02d INFO request id=%08x-%04x-4%03x-a%03x-%012x from %d.%d.%d.%d ",
+			1+i%28, i%60, (7*i)%60, rand.Uint32(), rand.Intn(65536), rand.Intn(4096), rand.Intn(4096),
+			rand.Int63n(1<<48), 10+rand.Intn(3), rand.Intn(256), rand.Intn(256), 1+rand.Intn(254))
+		fmt.Fprintf(&sb, "user=%x sha1=%016x%016x%08x peer=2001:db8::%x:%x %s\n", rand.Intn(1000),
+			rand.Uint64(), rand.Uint64(), rand.Uint32(), 1+rand.Intn(65535), 1+rand.Intn(65535), samples[i%len(samples)])
+	}
+
+	input := []byte(sb.String())
+	f, _ := function.NewLogCodec()
+	output := make([]byte, f.MaxEncodedLen(len(input)))
+	_, dstIdx, err := f.Forward(input, output)
+
+	if err != nil {
+		return err
+	}
+
+	reverse := make([]byte, len(input))
+	g, _ := function.NewLogCodec()
+	_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+	if err != nil {
+		return err
+	}
+
+	if int(oIdx) != len(input) || bytes.Equal(input, reverse[0:oIdx]) == false {
+		return errors.New("Log codec: decompressed data differs from input")
+	}
+
+	fmt.Printf("LOG: %v bytes => %v bytes\n", len(input), dstIdx)
+	sizes := [2]int{}
+
+	for i, tf := range []string{"LZ", "LOG+LZ"} {
+		if sizes[i], err = compressedSize(input, tf, "HUFFMAN"); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("LZ+HUFFMAN: %v, LOG+LZ+HUFFMAN: %v\n", sizes[0], sizes[1])
+
+	if sizes[1]*5 > sizes[0]*4 {
+		return fmt.Errorf("The LOG transform does not improve compression: %v", sizes)
+	}
+
+	// No token: the transform is skipped
+	text := []byte(strings.Repeat("No address and no digest in this line. ", 100))
+
+	if _, _, err = f.Forward(text, make([]byte, f.MaxEncodedLen(len(text)))); err == nil {
+		return errors.New("Log codec: expected the transform to be skipped (no token)")
+	}
+
+	// Invalid token type
+	output[0], output[1], output[2] = 0, 0, 99
+
+	if _, _, err = g.Inverse(output[0:dstIdx], reverse); err == nil {
+		return errors.New("Log codec: expected an error for an invalid token type")
+	}
+
+	return nil
+}
+
+// SRT as the post BWT stage (instead of MTFT) on text
+func testSRTAfterBWT() error {
+	words := strings.Fields("the quick brown fox jumps over a lazy dog while seven wizards " +
+		"box and quiz the jolly sphinx of black quartz judging my vow")
+	var sb strings.Builder
+
+	for sb.Len() < 200000 {
+		sb.WriteString(words[rand.Intn(len(words))])
+
+		if rand.Intn(12) == 0 {
+			sb.WriteString(".\n")
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+
+	input := []byte(sb.String())
+
+	for _, tf := range []string{"BWT+MTFT+ZRLT", "BWT+SRT+ZRLT"} {
+		var buf bytes.Buffer
+		cos, err := kio.NewCompressedOutputStream(&nopWriteCloser{&buf}, "ANS0", tf, 1<<16, 2, true)
+
+		if err != nil {
+			return err
+		}
+
+		cos.Write(input)
+
+		if err = cos.Close(); err != nil {
+			return err
+		}
+
+		size := buf.Len()
+		cis, err := kio.NewCompressedInputStream(ioutil.NopCloser(&buf), 2)
+
+		if err != nil {
+			return err
+		}
+
+		output, err := readAll(cis)
+
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(input, output) == false {
+			return fmt.Errorf("%v: decompressed data differs from input", tf)
+		}
+
+		fmt.Printf("%v+ANS0: %v bytes => %v bytes\n", tf, len(input), size)
+	}
+
+	return nil
+}
+
+// Byte order and width: detection, context overrides and header
+func testFPCodecParams() error {
+	const n = 16384
+	be64 := make([]byte, 8*n+5)
+	be32 := make([]byte, 4*n)
+
+	for i := 0; i < n; i++ {
+		t := float64(i) * 0.01
+		binary.BigEndian.PutUint64(be64[8*i:], math.Float64bits(50*math.Cos(t)))
+		binary.BigEndian.PutUint32(be32[4*i:], math.Float32bits(float32(3*math.Sin(t))))
+	}
+
+	roundTrip := func(ctx map[string]interface{}, input []byte) ([]byte, error) {
+		f, err := function.NewFPCodecWithCtx(&ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+		_, dstIdx, err := f.Forward(input, output)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The decoder only uses the header
+		g, _ := function.NewFPCodec()
+		reverse := make([]byte, len(input))
+		_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if int(oIdx) != len(input) || bytes.Equal(input, reverse) == false {
+			return nil, errors.New("Decompressed data differs from input")
+		}
+
+		return output[0:dstIdx], nil
+	}
+
+	tests := []struct {
+		name   string
+		ctx    map[string]interface{}
+		input  []byte
+		header byte // expected type byte (0 => transform skipped)
+	}{
+		{"auto float64 BE", map[string]interface{}{}, be64, 0x82},
+		{"auto float32 BE", map[string]interface{}{}, be32, 0x81},
+		{"forced float32 BE", map[string]interface{}{"fpWidth": 4, "fpEndian": function.FP_ENDIAN_BIG}, be32, 0x81},
+		{"forced little endian", map[string]interface{}{"fpEndian": function.FP_ENDIAN_LITTLE}, be64, 0},
+		{"fully forced BE", map[string]interface{}{"fpWidth": 8, "fpEndian": function.FP_ENDIAN_BIG, "fpStride": 1}, be64, 0x82},
+		{"fully forced LE (no gain)", map[string]interface{}{"fpWidth": 8, "fpEndian": function.FP_ENDIAN_LITTLE, "fpStride": 1}, be64, 0},
+	}
+
+	for _, t := range tests {
+		output, err := roundTrip(t.ctx, t.input)
+
+		if t.header == 0 {
+			if err == nil {
+				return fmt.Errorf("%v: expected the transform to be skipped", t.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if output[0] != t.header {
+			return fmt.Errorf("%v: invalid header type byte: %x, expected %x", t.name, output[0], t.header)
+		}
+	}
+
+	// Same values in little endian order: same compression
+	le64 := make([]byte, len(be64))
+
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint64(le64[8*i:], binary.BigEndian.Uint64(be64[8*i:]))
+	}
+
+	sizes := [3]int{}
+	var err error
+
+	for i, in := range [][]byte{be64, be64, le64} {
+		tf := "FP"
+
+		if i == 0 {
+			tf = "NONE"
+		}
+
+		if sizes[i], err = compressedSize(in, tf, "ANS0"); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("FP float64: %v bytes => ANS0: %v, FP+ANS0: %v (BE), %v (LE)\n", len(be64), sizes[0], sizes[1], sizes[2])
+
+	if sizes[1] >= sizes[0] || sizes[1] > sizes[2]+sizes[2]/100 {
+		return fmt.Errorf("The FP transform does not handle big endian data: %v", sizes)
+	}
+
+	for _, ctx := range []map[string]interface{}{{"fpWidth": 2}, {"fpEndian": 3}, {"fpStride": 5}} {
+		if _, err := function.NewFPCodecWithCtx(&ctx); err == nil {
+			return fmt.Errorf("Expected an error for invalid parameters %v", ctx)
+		}
+	}
+
+	return nil
+}
+
+func testSoACodec() error {
+	// Table of 20 byte records: id, type, timestamp, value, flags
+	table := make([]byte, 0, 20*10000+7)
+
+	for i := 0; i < 10000; i++ {
+		var rec [20]byte
+		binary.LittleEndian.PutUint32(rec[0:], uint32(100000+i))
+		binary.LittleEndian.PutUint16(rec[4:], uint16(rand.Intn(5)))
+		binary.LittleEndian.PutUint64(rec[6:], uint64(1489000000000+int64(i)*250+rand.Int63n(50)))
+		binary.LittleEndian.PutUint32(rec[14:], math.Float32bits(float32(20+rand.Intn(100))/4))
+		rec[18] = byte(rand.Intn(2))
+		rec[19] = 'R'
+		table = append(table, rec[:]...)
+	}
+
+	table = append(table, "TRAILER"...) // incomplete last record
+
+	// RGB pixels (smooth gradients with noise)
+	const w, h = 256, 256
+	pixels := make([]byte, 3*w*h)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := 3 * (y*w + x)
+			pixels[p] = byte(x + rand.Intn(4))
+			pixels[p+1] = byte(y/2 + rand.Intn(4))
+			pixels[p+2] = byte(128 + rand.Intn(8))
+		}
+	}
+
+	tests := []struct {
+		name       string
+		input      []byte
+		recordSize int
+	}{
+		{"table", table, 20},
+		{"pixels", pixels, 3},
+	}
+
+	for _, t := range tests {
+		if size := function.DetectRecordSize(t.input); size != t.recordSize {
+			return fmt.Errorf("%v: detected record size %v, expected %v", t.name, size, t.recordSize)
+		}
+
+		// Detected and provided record size
+		for _, ctx := range []map[string]interface{}{{}, {"recordSize": t.recordSize}} {
+			f, err := function.NewSoACodecWithCtx(&ctx)
+
+			if err != nil {
+				return err
+			}
+
+			output := make([]byte, f.MaxEncodedLen(len(t.input)))
+			_, dstIdx, err := f.Forward(t.input, output)
+
+			if err != nil {
+				return fmt.Errorf("%v: %v", t.name, err)
+			}
+
+			g, _ := function.NewSoACodec()
+			reverse := make([]byte, len(t.input))
+			_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return fmt.Errorf("%v: %v", t.name, err)
+			}
+
+			if int(oIdx) != len(t.input) || bytes.Equal(t.input, reverse) == false {
+				return fmt.Errorf("%v: decompressed data differs from input", t.name)
+			}
+		}
+
+		sizes := [2]int{}
+		var err error
+
+		for i, tf := range []string{"LZ", "SOA+LZ"} {
+			if sizes[i], err = compressedSize(t.input, tf, "HUFFMAN"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("SOA %v: %v bytes => LZ+HUFFMAN: %v, SOA+LZ+HUFFMAN: %v\n", t.name, len(t.input), sizes[0], sizes[1])
+
+		if sizes[1]*5 > sizes[0]*4 {
+			return fmt.Errorf("%v: the SOA transform does not improve compression: %v", t.name, sizes)
+		}
+	}
+
+	// Text has no record structure
+	words := strings.Fields("records columns are not found in plain text made of words of various lengths")
+	var sb strings.Builder
+
+	for sb.Len() < 65536 {
+		sb.WriteString(words[rand.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+
+	if size := function.DetectRecordSize([]byte(sb.String())); size != 0 {
+		return fmt.Errorf("Unexpected record size detected in text: %v", size)
+	}
+
+	ctx := map[string]interface{}{"recordSize": 1}
+
+	if _, err := function.NewSoACodecWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid record size")
+	}
+
+	return nil
+}
+
+func testUTF16Codec() error {
+	words := strings.Fields("The quick brown fox jumps over the lazy dog. Le cœur a ses raisons " +
+		"que la raison ne connaît point. Prix: 20€ \U0001F600 Windows\r\nNotepad")
+	var sb strings.Builder
+
+	for sb.Len() < 100000 {
+		sb.WriteString(words[rand.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+
+	units := utf16.Encode([]rune("\uFEFF" + sb.String()))
+	units = append(units, 0xD800, 'x') // lone surrogate: restored as is
+	le := make([]byte, 2*len(units)+1)
+	be := make([]byte, 2*len(units))
+
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(le[2*i:], u)
+		binary.BigEndian.PutUint16(be[2*i:], u)
+	}
+
+	le[len(le)-1] = 0x42 // odd size
+
+	for _, t := range []struct {
+		name      string
+		input     []byte
+		bigEndian bool
+	}{{"UTF-16LE", le, false}, {"UTF-16BE", be, true}} {
+		if ok, bigEndian := function.DetectUTF16(t.input); ok == false || bigEndian != t.bigEndian {
+			return fmt.Errorf("%v: not detected (detected: %v, big endian: %v)", t.name, ok, bigEndian)
+		}
+
+		for _, codec := range []string{"ANS0", "CM"} {
+			ctx := map[string]interface{}{"codec": codec}
+			f, _ := function.NewUTF16CodecWithCtx(&ctx)
+			output := make([]byte, f.MaxEncodedLen(len(t.input)))
+			_, dstIdx, err := f.Forward(t.input, output)
+
+			if err != nil {
+				return fmt.Errorf("%v: %v", t.name, err)
+			}
+
+			g, _ := function.NewUTF16CodecWithCtx(&ctx)
+			reverse := make([]byte, len(t.input))
+			_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return fmt.Errorf("%v: %v", t.name, err)
+			}
+
+			if int(oIdx) != len(t.input) || bytes.Equal(t.input, reverse) == false {
+				return fmt.Errorf("%v: decompressed data differs from input", t.name)
+			}
+		}
+
+		sizes := [2]int{}
+		var err error
+
+		for i, tf := range []string{"TEXT+LZ", "UTF16+LZ"} {
+			if sizes[i], err = compressedSize(t.input, tf, "HUFFMAN"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("%v: %v bytes => TEXT+LZ+HUFFMAN: %v, UTF16+LZ+HUFFMAN: %v\n",
+			t.name, len(t.input), sizes[0], sizes[1])
+
+		if sizes[1]*5 > sizes[0]*4 {
+			return fmt.Errorf("%v: the UTF16 transform does not improve compression: %v", t.name, sizes)
+		}
+	}
+
+	// 8 bit text and 16 bit samples are not UTF-16 text
+	samples := make([]byte, 65536)
+
+	for i := 0; i < len(samples); i += 2 {
+		binary.LittleEndian.PutUint16(samples[i:], uint16(rand.Intn(64)))
+	}
+
+	for _, buf := range [][]byte{[]byte(sb.String()), samples} {
+		if ok, _ := function.DetectUTF16(buf); ok == true {
+			return errors.New("Unexpected UTF-16 detection")
+		}
+	}
+
+	return nil
+}
+
+// Split the text in lines of the provided length
+func splitLines(text string, lineLen int, eol string) string {
+	var sb strings.Builder
+
+	for len(text) > lineLen {
+		sb.WriteString(text[0:lineLen])
+		sb.WriteString(eol)
+		text = text[lineLen:]
+	}
+
+	sb.WriteString(text)
+	return sb.String()
+}
+
+func testBase64Codec() error {
+	words := strings.Fields("alpha beta gamma delta epsilon zeta eta theta iota kappa lambda mu")
+	var sb strings.Builder
+
+	// Compressible payloads (text documents, pixels, ...) in various encodings
+	payload := func(n int) []byte {
+		res := make([]byte, 0, n+8)
+
+		for len(res) < n {
+			res = append(res, words[rand.Intn(len(words))]...)
+			res = append(res, ' ')
+		}
+
+		return res[0:n]
+	}
+
+	for sb.Len() < 200000 {
+		sb.WriteString("{\"id\": 12, \"path\": \"/usr/local/lib/python3/site-packages/setuptools/command\", ")
+		sb.WriteString("\"data\": \"" + base64.StdEncoding.EncodeToString(payload(500+rand.Intn(100))) + "\", ")
+		sb.WriteString("\"token\": \"" + base64.RawURLEncoding.EncodeToString(payload(200+rand.Intn(3))) + "\", ")
+		sb.WriteString("\"digest\": \"" + hex.EncodeToString(payload(64)) + "\"}\n")
+		sb.WriteString("Content-Transfer-Encoding: base64\r\n\r\n")
+		sb.WriteString(splitLines(base64.StdEncoding.EncodeToString(payload(1000+rand.Intn(10))), 76, "\r\n") + "\r\n\r\n")
+		sb.WriteString(splitLines(strings.ToUpper(hex.EncodeToString(payload(300))), 64, "\n") + "\n")
+	}
+
+	input := []byte(sb.String())
+	f, _ := function.NewBase64Codec()
+	output := make([]byte, f.MaxEncodedLen(len(input)))
+	_, dstIdx, err := f.Forward(input, output)
+
+	if err != nil {
+		return err
+	}
+
+	g, _ := function.NewBase64Codec()
+	reverse := make([]byte, len(input))
+	_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+	if err != nil {
+		return err
+	}
+
+	if int(oIdx) != len(input) || bytes.Equal(input, reverse) == false {
+		return errors.New("Base64: decompressed data differs from input")
+	}
+
+	// The payloads are about 70% of the text
+	if int(dstIdx) > len(input)*3/4 {
+		return fmt.Errorf("Base64: payloads not decoded (%v => %v bytes)", len(input), dstIdx)
+	}
+
+	sizes := [2]int{}
+
+	for i, tf := range []string{"LZ", "B64+LZ"} {
+		if sizes[i], err = compressedSize(input, tf, "HUFFMAN"); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Base64: %v bytes => LZ+HUFFMAN: %v, B64+LZ+HUFFMAN: %v\n", len(input), sizes[0], sizes[1])
+
+	if sizes[1]*5 > sizes[0]*4 {
+		return fmt.Errorf("Base64: the B64 transform does not improve compression: %v", sizes)
+	}
+
+	// Text without encoded payloads (long paths and identifiers, numbers)
+	sb.Reset()
+
+	for sb.Len() < 10000 {
+		sb.WriteString("/usr/local/lib/python3/site-packages/setuptools/command/build_ext.py ")
+		sb.WriteString("AbstractSingletonProxyFactoryBeanDefinitionRegistryPostProcessorImplementation ")
+		sb.WriteString("3141592653589793238462643383279502884197169399375105820974944592307816406286\n")
+	}
+
+	text := []byte(sb.String())
+
+	if _, _, err = f.Forward(text, make([]byte, f.MaxEncodedLen(len(text)))); err == nil {
+		return errors.New("Base64: unexpected region in plain text")
+	}
+
+	return nil
+}
+
+func testStructCodec() error {
+	names := strings.Fields("alice bob carol dave erin frank grace heidi ivan judy")
+	cities := strings.Fields("Paris Berlin Madrid Rome Lisbon Vienna")
+	var sbJSON, sbCSV strings.Builder
+	sbJSON.WriteString("[\n")
+	sbCSV.WriteString("id,name,city,status,score\n")
+
+	for i := 0; sbJSON.Len() < 200000; i++ {
+		name := names[rand.Intn(len(names))]
+		city := cities[rand.Intn(len(cities))]
+		fmt.Fprintf(&sbJSON, "  {\n    \"id\": %d,\n    \"name\": \"%s\",\n    \"address\": {\n", i, name)
+		fmt.Fprintf(&sbJSON, "      \"city\": \"%s\",\n      \"zip\": \"%05d\"\n    },\n", city, rand.Intn(100000))
+		fmt.Fprintf(&sbJSON, "    \"tags\": [\"a\", \"b\"],\n    \"active\": %v\n  },\n", rand.Intn(2) == 0)
+		fmt.Fprintf(&sbCSV, "%d,%s,%s,%s,%d\n", i, name, city, []string{"active", "inactive"}[i/100%2], rand.Intn(100))
+	}
+
+	sbJSON.WriteString("  {}\n]\n")
+
+	for _, input := range [][]byte{[]byte(sbJSON.String()), []byte(sbCSV.String())} {
+		f, _ := function.NewStructCodec()
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+		_, dstIdx, err := f.Forward(input, output)
+
+		if err != nil {
+			return err
+		}
+
+		g, _ := function.NewStructCodec()
+		reverse := make([]byte, len(input))
+		_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return err
+		}
+
+		if int(oIdx) != len(input) || bytes.Equal(input, reverse) == false {
+			return errors.New("Struct: decompressed data differs from input")
+		}
+
+		sizes := [2]int{}
+
+		for i, tf := range []string{"TEXT+LZ", "STRUCT+TEXT+LZ"} {
+			if sizes[i], err = compressedSize(input, tf, "HUFFMAN"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("Struct: %v => %v bytes, TEXT+LZ+HUFFMAN: %v, STRUCT+TEXT+LZ+HUFFMAN: %v\n",
+			len(input), dstIdx, sizes[0], sizes[1])
+
+		if sizes[1] >= sizes[0] {
+			return fmt.Errorf("Struct: the STRUCT transform does not improve compression: %v", sizes)
+		}
+	}
+
+	// Neither JSON nor CSV
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100))
+	f, _ := function.NewStructCodec()
+
+	if _, _, err := f.Forward(text, make([]byte, f.MaxEncodedLen(len(text)))); err == nil {
+		return errors.New("Struct: unexpected structure in plain text")
+	}
+
+	return nil
+}
+
+func testTextMarkup() error {
+	words := strings.Fields("alpha beta gamma delta epsilon zeta eta theta iota kappa lambda")
+	var sb strings.Builder
+	sb.WriteString("<?xml version=\"1.0\"?>\n<!DOCTYPE html>\n<html><body title='a > b'>\n")
+
+	for sb.Len() < 300000 {
+		w1 := words[rand.Intn(len(words))] + " and the " + words[rand.Intn(len(words))]
+		w2 := "some " + words[rand.Intn(len(words))] + " text with " + words[rand.Intn(len(words))]
+		fmt.Fprintf(&sb, "<div class=\"item\" id=\"i%d\"><p>%s &amp; %s<br>", rand.Intn(1000), w1, w2)
+		fmt.Fprintf(&sb, "<span title='a/b'>%s &lt;%d&gt;</span><img src=\"x.png\"/></p>", w2, rand.Intn(100))
+		fmt.Fprintf(&sb, "<ul><li>%s</li><li>&quot;%s&quot;</li></ul></div>\n", w1, w2)
+	}
+
+	sb.WriteString("</body></html>\n")
+	xml := []byte(sb.String())
+
+	for _, chunkSize := range []int{0, 64 * 1024} {
+		for _, codec := range []int{1, 2} {
+			ctx := map[string]interface{}{"textcodec": codec, "textMarkup": true}
+
+			if chunkSize != 0 {
+				ctx["textChunkSize"] = chunkSize
+			}
+
+			f, _ := function.NewTextCodecWithCtx(&ctx)
+			output := make([]byte, f.MaxEncodedLen(len(xml)))
+			_, dstIdx, err := f.Forward(xml, output)
+
+			if err != nil {
+				return err
+			}
+
+			if chunkSize == 0 && output[0]&0x0C != 0x0C {
+				return fmt.Errorf("Text markup: markup pass not applied (mode %x)", output[0])
+			}
+
+			g, _ := function.NewTextCodecWithCtx(&ctx)
+			reverse := make([]byte, len(xml))
+			_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+			if err != nil {
+				return err
+			}
+
+			if int(oIdx) != len(xml) || bytes.Equal(xml, reverse) == false {
+				return fmt.Errorf("Text markup: decompressed data differs from input (codec %d, chunk size %d)", codec, chunkSize)
+			}
+
+			fmt.Printf("Text markup (codec %d, chunk size %d): %d => %d bytes\n", codec, chunkSize, len(xml), dstIdx)
+		}
+	}
+
+	// Plain text or markup pass not enabled: no markup pass
+	text := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 1000))
+	ctx := map[string]interface{}{"textMarkup": true}
+
+	for _, t := range []struct {
+		input []byte
+		ctx   map[string]interface{}
+	}{
+		{text, ctx},
+		{xml[0:60000], map[string]interface{}{}},
+	} {
+		f, _ := function.NewTextCodecWithCtx(&t.ctx)
+		output := make([]byte, f.MaxEncodedLen(len(t.input)))
+
+		if _, _, err := f.Forward(t.input, output); err != nil {
+			return err
+		}
+
+		if output[0]&0x0C == 0x0C {
+			return fmt.Errorf("Text markup: unexpected markup pass (context %v)", t.ctx)
+		}
+	}
+
+	if function.HasTextExtensions(ctx, function.DICT_TYPE) == false {
+		return errors.New("Text markup: the markup pass must require the stream version 9")
+	}
+
+	return nil
+}
+
+// Smooth image (gradients with noise) with the provided number of channels
+func makeTestImage(w, h, channels, stride int) []byte {
+	pixels := make([]byte, stride*h)
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := y*stride + x*channels
+			base := (x + y) / 3
+
+			for c := 0; c < channels; c++ {
+				pixels[p+c] = byte(base + 40*c + rand.Intn(6))
+			}
+		}
+	}
+
+	return pixels
+}
+
+func testImageCodec() error {
+	const w, h = 301, 200
+
+	// 24 bit BMP (rows padded to 4 bytes)
+	bmpStride := ((w*24 + 31) >> 5) << 2
+	bmp := make([]byte, 54)
+	bmp[0], bmp[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(bmp[2:], uint32(54+bmpStride*h))
+	binary.LittleEndian.PutUint32(bmp[10:], 54)
+	binary.LittleEndian.PutUint32(bmp[14:], 40)
+	binary.LittleEndian.PutUint32(bmp[18:], w)
+	binary.LittleEndian.PutUint32(bmp[22:], h)
+	binary.LittleEndian.PutUint16(bmp[26:], 1)
+	binary.LittleEndian.PutUint16(bmp[28:], 24)
+	bmp = append(bmp, makeTestImage(w, h, 3, bmpStride)...)
+
+	// PPM and PGM with a comment in the header and trailing bytes
+	ppm := append([]byte(fmt.Sprintf("P6\n# kanzi\n%d %d\n255\n", w, h)), makeTestImage(w, h, 3, 3*w)...)
+	ppm = append(ppm, "TRAILER"...)
+	pgm := append([]byte(fmt.Sprintf("P5 %d %d 255\n", w, h)), makeTestImage(w, h, 1, w)...)
+
+	// Raw RGBA pixels
+	raw := makeTestImage(w, h, 4, 4*w)
+
+	tests := []struct {
+		name  string
+		input []byte
+		ctx   map[string]interface{}
+	}{
+		{"BMP", bmp, map[string]interface{}{}},
+		{"PPM", ppm, map[string]interface{}{}},
+		{"PGM", pgm, map[string]interface{}{}},
+		{"RAW", raw, map[string]interface{}{"imageWidth": w, "imageChannels": 4}},
+	}
+
+	for _, t := range tests {
+		f, err := function.NewImageCodecWithCtx(&t.ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output := make([]byte, f.MaxEncodedLen(len(t.input)))
+		_, dstIdx, err := f.Forward(t.input, output)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		g, _ := function.NewImageCodec()
+		reverse := make([]byte, len(t.input))
+		_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if int(oIdx) != len(t.input) || bytes.Equal(t.input, reverse) == false {
+			return fmt.Errorf("%v: decompressed data differs from input", t.name)
+		}
+
+		if len(t.ctx) != 0 {
+			continue
+		}
+
+		sizes := [2]int{}
+
+		for i, tf := range []string{"SOA+LZ", "IMG+LZ"} {
+			if sizes[i], err = compressedSize(t.input, tf, "ANS0"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("IMG %v: %v bytes => SOA+LZ+ANS0: %v, IMG+LZ+ANS0: %v\n", t.name, len(t.input), sizes[0], sizes[1])
+
+		if sizes[1] >= sizes[0] {
+			return fmt.Errorf("%v: the IMG transform does not improve compression: %v", t.name, sizes)
+		}
+	}
+
+	// Blocks without image header are rejected
+	f, _ := function.NewImageCodec()
+	output := make([]byte, f.MaxEncodedLen(len(raw)))
+
+	if _, _, err := f.Forward(raw, output); err == nil {
+		return errors.New("Expected an error for a block without image header")
+	}
+
+	ctx := map[string]interface{}{"imageWidth": 4}
+
+	if _, err := function.NewImageCodecWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid image width")
+	}
+
+	return nil
+}
+
+func testPlaneCodec() error {
+	// 1 bit per pixel bitmap (64 bytes per row): random columns that change
+	// rarely from row to row (short horizontal runs, long vertical runs)
+	const rowSize = 64
+	bitmap := make([]byte, 512*rowSize)
+	rand.Read(bitmap[0:rowSize])
+
+	for i := rowSize; i < len(bitmap); i++ {
+		bitmap[i] = bitmap[i-rowSize]
+
+		if rand.Intn(1024) == 0 {
+			bitmap[i] ^= byte(1 << uint(rand.Intn(8)))
+		}
+	}
+
+	// Sparse index data: few small values in 32 bit little endian integers
+	indexes := make([]byte, 65536)
+
+	for i := 0; i < len(indexes); i += 4 {
+		if rand.Intn(32) == 0 {
+			binary.LittleEndian.PutUint32(indexes[i:], uint32(1+rand.Intn(255)))
+		}
+	}
+
+	random := make([]byte, 65536)
+	rand.Read(random)
+
+	tests := []struct {
+		name   string
+		input  []byte
+		stride int
+		valid  bool
+	}{
+		{"bitmap", bitmap, rowSize, true},
+		{"bitmap (auto)", bitmap, -1, true},
+		{"indexes", indexes, 0, true},
+		{"random", random, -1, false},
+	}
+
+	for _, t := range tests {
+		ctx := make(map[string]interface{})
+
+		if t.stride >= 0 {
+			ctx["planeStride"] = t.stride
+		}
+
+		f, err := function.NewPlaneCodecWithCtx(&ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output := make([]byte, f.MaxEncodedLen(len(t.input)))
+		_, dstIdx, err := f.Forward(t.input, output)
+
+		if t.valid == false {
+			if err == nil {
+				return fmt.Errorf("%v: expected the transform to be skipped", t.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		reverse := make([]byte, len(t.input))
+		g, _ := function.NewPlaneCodec()
+		_, oIdx, err := g.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if int(oIdx) != len(t.input) || bytes.Equal(t.input, reverse) == false {
+			return fmt.Errorf("%v: decompressed data differs from input", t.name)
+		}
+
+		fmt.Printf("PLANE %v: %v bytes => %v bytes\n", t.name, len(t.input), dstIdx)
+
+		if int(dstIdx)*4 > len(t.input) {
+			return fmt.Errorf("%v: the PLANE transform does not reduce the block enough: %v bytes", t.name, dstIdx)
+		}
+	}
+
+	sizes := [2]int{}
+	var err error
+
+	for i, tf := range []string{"RLT", "PLANE"} {
+		if sizes[i], err = compressedSize(bitmap, tf, "ANS0"); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("PLANE bitmap: %v bytes => RLT+ANS0: %v, PLANE+ANS0: %v\n", len(bitmap), sizes[0], sizes[1])
+
+	if sizes[1]*2 > sizes[0] {
+		return fmt.Errorf("The PLANE transform does not improve compression: %v", sizes)
+	}
+
+	// Truncated planes
+	f, _ := function.NewPlaneCodec()
+	output := make([]byte, f.MaxEncodedLen(len(indexes)))
+	_, dstIdx, _ := f.Forward(indexes, output)
+
+	if _, _, err := f.Inverse(output[0:dstIdx-1], make([]byte, len(indexes))); err == nil {
+		return errors.New("Expected an error for truncated planes")
+	}
+
+	ctx := map[string]interface{}{"planeStride": -2}
+
+	if _, err := function.NewPlaneCodecWithCtx(&ctx); err == nil {
+		return errors.New("Expected an error for an invalid plane stride")
+	}
+
+	return nil
+}
+
+func testColorCodec() error {
+	const w, h = 301, 200
+	rgb := makeTestImage(w, h, 3, 3*w)
+	rgba := makeTestImage(w, h, 4, 4*w)
+	padded := append(makeTestImage(w, h, 3, 3*w+5), "TRAILER"...)
+
+	// Gray pixels with a few random ones (the chroma values wrap around)
+	gray := make([]byte, 3*w*h)
+
+	for i := 0; i < len(gray); i += 3 {
+		if rand.Intn(10) == 0 {
+			gray[i], gray[i+1], gray[i+2] = byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))
+		} else {
+			gray[i] = byte(rand.Intn(256))
+			gray[i+1], gray[i+2] = gray[i], gray[i]
+		}
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		ctx   map[string]interface{}
+	}{
+		{"RGB", rgb, map[string]interface{}{}},
+		{"RGBA", rgba, map[string]interface{}{}},
+		{"RGB RCT", rgb, map[string]interface{}{"colorTransform": "RCT", "imageWidth": w}},
+		{"RGBA YCOCG", rgba, map[string]interface{}{"colorTransform": "ycocg", "imageWidth": w, "imageChannels": 4}},
+		{"Padded", padded, map[string]interface{}{"imageWidth": w, "imageStride": 3*w + 5}},
+		{"Gray RCT", gray, map[string]interface{}{"colorTransform": "RCT"}},
+		{"Gray YCOCG", gray, map[string]interface{}{"colorTransform": "YCOCG"}},
+	}
+
+	for _, t := range tests {
+		f, err := function.NewColorCodecWithCtx(&t.ctx)
+
+		if err != nil {
+			return err
+		}
+
+		output := make([]byte, f.MaxEncodedLen(len(t.input)))
+		reverse := make([]byte, len(t.input))
+		_, dstIdx, err := f.Forward(t.input, output)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		// The planes have the size of the pixels
+		if dstIdx <= uint(len(t.input)) || dstIdx > uint(len(t.input)+21) {
+			return fmt.Errorf("%v: unexpected output size: %v for %v bytes", t.name, dstIdx, len(t.input))
+		}
+
+		// The inverse does not need the context
+		g, _ := function.NewColorCodec()
+
+		if _, _, err = g.Inverse(output[0:dstIdx], reverse); err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if bytes.Equal(t.input, reverse) == false {
+			return fmt.Errorf("%v: different data after round trip", t.name)
+		}
+	}
+
+	// The planes are more compressible than the interleaved pixels
+	for _, input := range [][]byte{rgb, rgba} {
+		var sizes [2]int
+		var err error
+
+		for i, tf := range []string{"LZ", "COLOR+LZ"} {
+			if sizes[i], err = compressedSize(input, tf, "ANS0"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("COLOR %v bytes => LZ+ANS0: %v, COLOR+LZ+ANS0: %v\n", len(input), sizes[0], sizes[1])
+
+		if sizes[1] >= sizes[0] {
+			return fmt.Errorf("The COLOR transform does not improve compression: %v", sizes)
+		}
+	}
+
+	// Random bytes are rejected
+	noise := make([]byte, 30000)
+	rand.Read(noise)
+	f, _ := function.NewColorCodec()
+	output := make([]byte, f.MaxEncodedLen(len(noise)))
+
+	if _, _, err := f.Forward(noise, output); err == nil {
+		return errors.New("Expected an error for random bytes")
+	}
+
+	for _, ctx := range []map[string]interface{}{{"colorTransform": "YUV"}, {"imageStride": 1000},
+		{"imageWidth": 100, "imageChannels": 2}, {"imageWidth": 100, "imageStride": 200}} {
+		if _, err := function.NewColorCodecWithCtx(&ctx); err == nil {
+			return fmt.Errorf("Expected an error for the context %v", ctx)
+		}
+	}
+
+	return nil
+}
+
+func testMetaCodec() error {
+	const size = 200000
+	text := corpus.GenerateText(size, 1)
+	var json bytes.Buffer
+
+	for i := 0; json.Len() < size; i++ {
+		fmt.Fprintf(&json, "{\"id\": %d, \"name\": \"user%d\", \"active\": %v, \"score\": %d}\n", i, i%97, i%3 == 0, i*7%1000)
+	}
+
+	utf16Text := make([]byte, 0, 2*size)
+
+	for _, u := range utf16.Encode([]rune(string(text[0 : size/2]))) {
+		utf16Text = append(utf16Text, byte(u), byte(u>>8))
+	}
+
+	// 24 bit BMP
+	const w, h = 301, 200
+	stride := ((w*24 + 31) >> 5) << 2
+	bmp := make([]byte, 54)
+	bmp[0], bmp[1] = 'B', 'M'
+	binary.LittleEndian.PutUint32(bmp[10:], 54)
+	binary.LittleEndian.PutUint32(bmp[14:], 40)
+	binary.LittleEndian.PutUint32(bmp[18:], w)
+	binary.LittleEndian.PutUint32(bmp[22:], h)
+	binary.LittleEndian.PutUint16(bmp[26:], 1)
+	binary.LittleEndian.PutUint16(bmp[28:], 24)
+	bmp = append(bmp, makeTestImage(w, h, 3, stride)...)
+
+	// 16 bit stereo WAV
+	wav := make([]byte, 44+4*size/4)
+	copy(wav, "RIFF")
+	copy(wav[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(wav[16:], 16)
+	binary.LittleEndian.PutUint16(wav[20:], 1)
+	binary.LittleEndian.PutUint16(wav[22:], 2)
+	binary.LittleEndian.PutUint16(wav[32:], 4)
+	binary.LittleEndian.PutUint16(wav[34:], 16)
+	copy(wav[36:], "data")
+
+	for i := 44; i+4 <= len(wav); i += 4 {
+		t := float64(i) / 400
+		binary.LittleEndian.PutUint16(wav[i:], uint16(int16(8000*math.Sin(t))))
+		binary.LittleEndian.PutUint16(wav[i+2:], uint16(int16(6000*math.Sin(t*1.5))))
+	}
+
+	// Float64 array
+	fp := make([]byte, 8*(size/8))
+
+	for i := 0; i < len(fp); i += 8 {
+		binary.LittleEndian.PutUint64(fp[i:], math.Float64bits(100*math.Sin(float64(i)*0.0001)))
+	}
+
+	// Sparse 1 bit per pixel bitmap (rows of 64 bytes): fixed size records
+	// but no floating point values
+	sparse := make([]byte, size)
+	row := make([]byte, 64)
+
+	for i := range sparse {
+		if i%len(row) == 0 {
+			for j := range row {
+				if rand.Intn(20) == 0 {
+					row[j] = 0
+
+					if rand.Intn(8) == 0 {
+						row[j] = 1 << uint(rand.Intn(8))
+					}
+				}
+			}
+		}
+
+		sparse[i] = row[i%len(row)]
+	}
+
+	random := make([]byte, size)
+	rand.Read(random)
+
+	// The chains that keep the size of the block (EXE, IMG, SOA) do not shrink
+	// it: the block is rejected
+	tests := []struct {
+		name     string
+		input    []byte
+		detected []int // chains tried
+		chain    int   // 0 => rejected
+	}{
+		{"TEXT", text, []int{function.META_CHAIN_TEXT}, function.META_CHAIN_TEXT},
+		{"JSON", json.Bytes(), []int{function.META_CHAIN_STRUCT, function.META_CHAIN_TEXT}, function.META_CHAIN_STRUCT},
+		{"UTF16", utf16Text, []int{function.META_CHAIN_UTF16}, function.META_CHAIN_UTF16},
+		{"EXE", corpus.GenerateExe(size, 1), []int{function.META_CHAIN_EXE}, 0},
+		{"BMP", bmp, []int{function.META_CHAIN_IMAGE}, 0},
+		{"WAV", wav, []int{function.META_CHAIN_AUDIO}, 0},
+		{"FP", fp, []int{function.META_CHAIN_FP, function.META_CHAIN_RECORDS}, function.META_CHAIN_FP},
+		{"SPARSE", sparse, []int{function.META_CHAIN_RECORDS}, 0},
+		{"RANDOM", random, []int{}, 0},
+	}
+
+	for _, t := range tests {
+		if detected := function.DetectMetaChains(t.input); fmt.Sprint(detected) != fmt.Sprint(t.detected) {
+			return fmt.Errorf("%v: unexpected chains %v (expected %v)", t.name, detected, t.detected)
+		}
+
+		// Followed by other stages
+		for _, tf := range []string{"META+BWT+RANK+ZRLT", "META+LZ", "META+RLT", "META+ROLZ"} {
+			output, err := compressStream(t.input, map[string]interface{}{"transform": tf, "codec": "ANS0"})
+
+			if err != nil {
+				return fmt.Errorf("%v, %v: %v", t.name, tf, err)
+			}
+
+			decoded, err := decompressStream(output, nil)
+
+			if err != nil {
+				return fmt.Errorf("%v, %v: %v", t.name, tf, err)
+			}
+
+			if bytes.Equal(decoded, t.input) == false {
+				return fmt.Errorf("%v, %v: different data after round trip", t.name, tf)
+			}
+		}
+
+		f, err := function.NewMetaCodec()
+
+		if err != nil {
+			return err
+		}
+
+		input := make([]byte, len(t.input))
+		copy(input, t.input)
+		output := make([]byte, f.MaxEncodedLen(len(input)))
+		_, dstIdx, err := f.Forward(input, output)
+
+		if t.chain == 0 {
+			if err == nil {
+				return fmt.Errorf("%v: expected the block to be rejected", t.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if bytes.Equal(input, t.input) == false {
+			return fmt.Errorf("%v: the input was modified", t.name)
+		}
+
+		if chain := int(output[0] >> 2); chain != t.chain {
+			return fmt.Errorf("%v: unexpected chain %v (expected %v)", t.name, chain, t.chain)
+		}
+
+		if int(dstIdx) >= len(input) {
+			return fmt.Errorf("%v: the META transform expands the data: %v bytes => %v bytes", t.name, len(input), dstIdx)
+		}
+
+		reverse := make([]byte, len(input))
+		g, _ := function.NewMetaCodec()
+
+		if _, _, err = g.Inverse(output[0:dstIdx], reverse); err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if bytes.Equal(t.input, reverse) == false {
+			return fmt.Errorf("%v: different data after round trip", t.name)
+		}
+
+		// The selected chain helps the generic transforms
+		var sizes [2]int
+
+		for i, tf := range []string{"BWT+RANK+ZRLT", "META+BWT+RANK+ZRLT"} {
+			if sizes[i], err = compressedSize(t.input, tf, "ANS0"); err != nil {
+				return err
+			}
+		}
+
+		fmt.Printf("META %v: %v bytes => BWT+RANK+ZRLT: %v, META+BWT+RANK+ZRLT: %v\n", t.name, len(t.input), sizes[0], sizes[1])
+
+		if sizes[1] > sizes[0] {
+			return fmt.Errorf("%v: the META transform does not improve compression: %v", t.name, sizes)
+		}
+	}
+
+	return nil
+}
+
+// blockingTransform blocks in Forward until released and fails in Inverse
+type blockingTransform struct {
+	started    chan bool
+	release    chan bool
+	reusable   bool
+	concurrent bool
+}
+
+func (this *blockingTransform) Forward(src, dst []byte) (uint, uint, error) {
+	this.started <- true
+	<-this.release
+	return uint(copy(dst, src)), uint(len(src)), nil
+}
+
+func (this *blockingTransform) Inverse(src, dst []byte) (uint, uint, error) {
+	return 0, 0, errors.New("Invalid block")
+}
+
+func (this *blockingTransform) IsReusable() bool {
+	return this.reusable
+}
+
+func (this *blockingTransform) IsConcurrentSafe() bool {
+	return this.concurrent
+}
+
+func guardReason(err error) int {
+	if ge, isGuard := err.(*function.GuardError); isGuard == true {
+		return ge.Reason
+	}
+
+	return 0
+}
+
+func testGuard() error {
+	// All transforms declare their capabilities
+	for _, name := range []string{"LZ", "ZRLT", "RLT", "SRT", "ROLZ", "ROLZX", "AUTOBWT", "EXE", "PATH", "FP", "LOG",
+		"SOA", "UTF16", "B64", "STRUCT", "IMG", "COLOR", "META", "PLANE"} {
+		f, err := getByteFunction(name)
+
+		if err != nil {
+			return err
+		}
+
+		if _, ok := f.(kanzi.ThreadSafety); ok == false {
+			return fmt.Errorf("%v does not implement ThreadSafety", name)
+		}
+	}
+
+	lz, _ := function.NewLZCodec()
+	zrlt, _ := function.NewZRLT()
+
+	if lz.IsConcurrentSafe() == true || zrlt.IsConcurrentSafe() == false {
+		return errors.New("Unexpected concurrent capabilities for LZ/ZRLT")
+	}
+
+	ctx := map[string]interface{}{"textRetain": true}
+	tc, _ := function.NewTextCodecWithCtx(&ctx)
+
+	if tc.IsReusable() == true {
+		return errors.New("A text codec in retain mode should not be reusable")
+	}
+
+	src := []byte("0123456789abcdef")
+	dst := make([]byte, 64)
+
+	// Concurrent calls on an instance not safe for concurrent use
+	for _, concurrent := range []bool{false, true} {
+		bt := &blockingTransform{started: make(chan bool), release: make(chan bool), reusable: true, concurrent: concurrent}
+		gt, _ := function.NewGuardedTransform(bt)
+		done := make(chan error)
+
+		go func() {
+			_, _, err := gt.Forward(src, make([]byte, 64))
+			done <- err
+		}()
+
+		<-bt.started
+
+		if concurrent == false {
+			_, _, err := gt.Forward(src, dst)
+			bt.release <- true
+
+			if guardReason(err) != function.GUARD_CONCURRENT_CALL {
+				return fmt.Errorf("Expected a concurrent call error, got %v", err)
+			}
+		} else {
+			// Release both calls once the second one is running
+			go func() {
+				<-bt.started
+				bt.release <- true
+				bt.release <- true
+			}()
+
+			if _, _, err := gt.Forward(src, dst); err != nil {
+				<-done
+				return fmt.Errorf("Unexpected error for a concurrent safe transform: %v", err)
+			}
+		}
+
+		if err := <-done; err != nil {
+			return err
+		}
+	}
+
+	// Reuse after a failed Inverse
+	for _, reusable := range []bool{true, false} {
+		bt := &blockingTransform{reusable: reusable}
+		seq, _ := function.NewByteTransformSequence([]kanzi.ByteTransform{bt})
+		seq.SetSkipFlags(0)
+
+		if _, _, err := seq.Inverse(src, dst); err == nil || guardReason(err) != 0 {
+			return fmt.Errorf("Expected the error of the transform, got %v", err)
+		}
+
+		_, _, err := seq.Inverse(src, dst)
+
+		if reusable == true && guardReason(err) != 0 {
+			return fmt.Errorf("Unexpected guard error for a reusable transform: %v", err)
+		}
+
+		if reusable == false && guardReason(err) != function.GUARD_REUSE_AFTER_ERROR {
+			return fmt.Errorf("Expected a reuse after error, got %v", err)
+		}
+	}
+
+	return nil
+}
+
+func testSequenceHeader() error {
+	newSequence := func() (*function.ByteTransformSequence, error) {
+		tc, err := function.NewTextCodec()
+
+		if err != nil {
+			return nil, err
+		}
+
+		rlt, err := function.NewRLT()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return function.NewByteTransformSequenceWithHeader([]kanzi.ByteTransform{tc, rlt})
+	}
+
+	text := []byte(strings.Repeat("The skip flags of the sequence are in the block.\n"+strings.Repeat(" ", 24), 200))
+	random := make([]byte, 16384)
+	rand.Read(random)
+	binary := make([]byte, 0, 20000)
+
+	for len(binary) < 16384 {
+		binary = append(binary, random[0:1+rand.Intn(64)]...)
+		binary = append(binary, make([]byte, 16+rand.Intn(64))...)
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		flags byte
+	}{
+		{"text", text, 0x3F},     // both stages
+		{"binary", binary, 0xBF}, // RLT only
+		{"random", random, 0xFF}, // no stage (copy)
+	}
+
+	for _, t := range tests {
+		seq, err := newSequence()
+
+		if err != nil {
+			return err
+		}
+
+		// The sequence uses its input as a buffer
+		input := append([]byte(nil), t.input...)
+		output := make([]byte, seq.MaxEncodedLen(len(t.input)))
+		_, dstIdx, err := seq.Forward(input, output)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if output[0] != t.flags || output[0] != seq.SkipFlags() {
+			return fmt.Errorf("%v: invalid skip flags: %#x, expected %#x", t.name, output[0], t.flags)
+		}
+
+		if t.flags == 0xFF && int(dstIdx) != len(t.input)+1 {
+			return fmt.Errorf("%v: invalid size of the copied block: %v", t.name, dstIdx)
+		}
+
+		// A new sequence reads the skip flags from the block
+		seq, _ = newSequence()
+		reverse := make([]byte, len(t.input))
+		_, oIdx, err := seq.Inverse(output[0:dstIdx], reverse)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", t.name, err)
+		}
+
+		if int(oIdx) != len(t.input) || bytes.Equal(t.input, reverse) == false {
+			return fmt.Errorf("%v: decompressed data differs from input", t.name)
+		}
+	}
+
+	return nil
+}
+
+func testStreamFunction() error {
+	tokens := []string{"Scheduling", "container", "kubernetes", "allocation", "persistent",
+		"volume", "controller", "endpoint", "Reconciling", "replication", "threshold"}
+	var buf bytes.Buffer
+
+	for buf.Len() < 300*1024 {
+		buf.WriteString(tokens[rand.Intn(len(tokens))])
+		buf.WriteString([]string{" ", " the ", " of ", " and ", ", ", ".\n"}[rand.Intn(6)])
+
+		if rand.Intn(1024) == 0 {
+			// Runs across the chunk boundaries
+			buf.Write(bytes.Repeat([]byte{byte(rand.Intn(256))}, 100+rand.Intn(1000)))
+		}
+	}
+
+	newFunction := func(name string) (kanzi.ByteFunction, error) {
+		if name == "TEXT" {
+			return function.NewTextCodec()
+		}
+
+		return getByteFunction(name)
+	}
+
+	input := buf.Bytes()
+	random := make([]byte, 20000)
+	rand.Read(random)
+
+	for _, name := range []string{"TEXT", "RLT", "LZ", "ZRLT"} {
+		for _, data := range [][]byte{input, random, input[0:100]} {
+			var sizes [2]int64
+
+			for i, chunkSize := range []int{8192, 256 * 1024} {
+				f, err := newFunction(name)
+
+				if err != nil {
+					return err
+				}
+
+				sf, err := function.NewStreamFunction(f, chunkSize)
+
+				if err != nil {
+					return err
+				}
+
+				var encoded, decoded bytes.Buffer
+				read, written, err := sf.ForwardStream(bytes.NewReader(data), &encoded)
+
+				if err != nil {
+					return fmt.Errorf("%v, chunk size %v: %v", name, chunkSize, err)
+				}
+
+				if read != int64(len(data)) || written != int64(encoded.Len()) {
+					return fmt.Errorf("%v, chunk size %v: invalid sizes %v, %v", name, chunkSize, read, written)
+				}
+
+				sizes[i] = written
+				f, _ = newFunction(name)
+				sf, _ = function.NewStreamFunction(f, chunkSize)
+
+				// The chunks are decoded one at a time (the stream can be followed by
+				// other data)
+				encoded.WriteString("trailer")
+				read, _, err = sf.InverseStream(&encoded, &decoded)
+
+				if err != nil {
+					return fmt.Errorf("%v, chunk size %v: %v", name, chunkSize, err)
+				}
+
+				if read != written || encoded.String() != "trailer" {
+					return fmt.Errorf("%v, chunk size %v: the stream was not fully read", name, chunkSize)
+				}
+
+				if bytes.Equal(data, decoded.Bytes()) == false {
+					return fmt.Errorf("%v, chunk size %v: decompressed data differs from input", name, chunkSize)
+				}
+			}
+
+			if len(data) == len(input) {
+				fmt.Printf("Stream %v: %v => %v (8 KB chunks), %v (256 KB chunks)\n", name, len(data), sizes[0], sizes[1])
+			}
+
+			// A chunk that does not shrink is stored raw
+			if len(data) == len(random) && sizes[0] > int64(len(random)+(len(random)/8192+1)*8+4) {
+				return fmt.Errorf("%v: random data expanded to %v bytes", name, sizes[0])
+			}
+		}
+	}
+
+	// The carried over state improves the compression of small chunks
+	var independent int64
+
+	for start := 0; start < len(input); start += 8192 {
+		end := start + 8192
+
+		if end > len(input) {
+			end = len(input)
+		}
+
+		f, _ := function.NewLZCodec()
+		output := make([]byte, f.MaxEncodedLen(end-start))
+		_, dstIdx, _ := f.Forward(input[start:end], output)
+		independent += int64(dstIdx) + 8
+	}
+
+	f, _ := function.NewLZCodec()
+	sf, _ := function.NewStreamFunction(f, 8192)
+	_, written, _ := sf.ForwardStream(bytes.NewReader(input), ioutil.Discard)
+
+	if written >= independent {
+		return fmt.Errorf("The LZ window does not improve compression: %v >= %v", written, independent)
+	}
+
+	if _, err := function.NewStreamFunction(f, 100); err == nil {
+		return errors.New("Expected an error for an invalid chunk size")
+	}
+
+	return nil
+}
@@ -16,12 +16,15 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"testing"
 	"time"
+	"unsafe"
 
 	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/function"
 	"github.com/flanglet/kanzi-go/transform"
 )
 
@@ -46,13 +49,13 @@ func getByteTransform(name string) (kanzi.ByteTransform, error) {
 
 func TestRank(b *testing.T) {
 	if err := testTransformCorrectness("RANK"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
 	}
 }
 
 func TestMTFT(b *testing.T) {
 	if err := testTransformCorrectness("MTFT"); err != nil {
-		b.Errorf(err.Error())
+		b.Error(err)
 	}
 }
 
@@ -231,3 +234,215 @@ func testTransformCorrectness(name string) error {
 
 	return error(nil)
 }
+
+func TestDetectStride(b *testing.T) {
+	if err := testDetectStride(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testDetectStride() error {
+	// Slowly varying records of 'stride' bytes (EG. RGB pixels, 32 bit samples)
+	for _, stride := range []int{2, 3, 4, 8} {
+		block := make([]byte, 32768)
+		lanes := make([]int, stride)
+
+		for l := range lanes {
+			lanes[l] = rand.Intn(256)
+		}
+
+		for i := range block {
+			l := i % stride
+			lanes[l] += rand.Intn(5) - 2
+			block[i] = byte(lanes[l])
+		}
+
+		s, ok := kanzi.DetectStride(block)
+
+		if ok == false || s != stride {
+			return fmt.Errorf("Expected stride %d, got %d (detected=%v)", stride, s, ok)
+		}
+
+		stats := kanzi.ComputeStrideStats(block, []int{1, stride})
+
+		if stats[1].Autocorrelation <= stats[0].Autocorrelation || stats[1].Score() >= stats[0].Score() {
+			return fmt.Errorf("Stride %d: unexpected statistics %+v", stride, stats)
+		}
+	}
+
+	// Random data has no structure
+	block := make([]byte, 32768)
+	rand.Read(block)
+
+	if s, ok := kanzi.DetectStride(block); ok == true {
+		return fmt.Errorf("Unexpected stride %d detected in random data", s)
+	}
+
+	return nil
+}
+
+func TestAllocator(b *testing.T) {
+	if err := testAllocator(); err != nil {
+		b.Error(err)
+	}
+}
+
+// The temporary buffers of the transforms are reused across blocks
+func testAllocator() error {
+	saved := kanzi.GetAllocatorConfig()
+	defer kanzi.SetAllocatorConfig(saved)
+
+	if err := kanzi.SetAllocatorConfig(kanzi.AllocatorConfig{MinSize: 100, MaxSize: 10}); err == nil {
+		return fmt.Errorf("Invalid allocator configuration accepted")
+	}
+
+	input := make([]byte, 256*1024)
+
+	for i := range input {
+		input[i] = byte(65 + rand.Intn(1+(i>>12)%26))
+	}
+
+	roundTrip := func() error {
+		bwt, _ := transform.NewBWT()
+		output := make([]byte, len(input))
+		reverse := make([]byte, len(input))
+
+		if _, _, err := bwt.Forward(input, output); err != nil {
+			return err
+		}
+
+		bwt2, _ := transform.NewBWT()
+		bwt2.SetPrimaryIndex(0, bwt.PrimaryIndex(0))
+
+		if _, _, err := bwt2.Inverse(output, reverse); err != nil {
+			return err
+		}
+
+		if string(input) != string(reverse) {
+			return fmt.Errorf("Allocator: BWT round trip failed")
+		}
+
+		return nil
+	}
+
+	for _, enabled := range []bool{true, false} {
+		cfg := kanzi.GetAllocatorConfig()
+		cfg.Enabled = enabled
+		kanzi.SetAllocatorConfig(cfg)
+		before := kanzi.GetAllocatorStats()
+
+		for i := 0; i < 4; i++ {
+			if err := roundTrip(); err != nil {
+				return err
+			}
+		}
+
+		after := kanzi.GetAllocatorStats()
+
+		if enabled == true && after.Hits == before.Hits {
+			return fmt.Errorf("Allocator: no buffer reused (stats: %+v)", after)
+		}
+
+		if enabled == false && after.Hits+after.Misses != before.Hits+before.Misses {
+			return fmt.Errorf("Allocator: buffers pooled while disabled (stats: %+v)", after)
+		}
+	}
+
+	return nil
+}
+
+func TestOverlap(b *testing.T) {
+	if err := testOverlap(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testOverlap() error {
+	const size = 4096
+	buf := make([]byte, 4*size)
+
+	for i := range buf {
+		buf[i] = byte(rand.Intn(4))
+	}
+
+	transforms := make(map[string]kanzi.ByteTransform)
+
+	for _, name := range []string{"RANK", "MTFT", "BWTS"} {
+		transforms[name], _ = getByteTransform(name)
+	}
+
+	for _, name := range []string{"LZ", "ZRLT", "RLT", "SRT", "ROLZ", "AUTOBWT", "EXE", "FP", "LOG", "SOA", "UTF16", "B64", "STRUCT", "IMG", "COLOR", "META", "PLANE"} {
+		transforms[name], _ = getByteFunction(name)
+	}
+
+	transforms["BWT"], _ = transform.NewBWT()
+
+	for name, t := range transforms {
+		// Same start, output inside input, input inside output
+		cases := [][2][]byte{
+			{buf[0:size], buf[0 : 2*size]},
+			{buf[size : 2*size], buf[size+size/2 : 4*size]},
+			{buf[2*size : 3*size], buf[size : 4*size]},
+		}
+
+		for i, c := range cases {
+			_, _, err := t.Forward(c[0], c[1])
+			var ovErr *kanzi.OverlapError
+
+			if errors.As(err, &ovErr) == false {
+				return fmt.Errorf("%v forward, case %d: expected an overlap error, got: %v", name, i, err)
+			}
+
+			if errors.Is(err, kanzi.ErrBufferOverlap) == false || errors.Is(err, &kanzi.OverlapError{}) == false {
+				return fmt.Errorf("%v forward, case %d: the overlap error does not match its kind", name, i)
+			}
+
+			if _, _, err = t.Inverse(c[0], c[1]); errors.As(err, &ovErr) == false {
+				return fmt.Errorf("%v inverse, case %d: expected an overlap error, got: %v", name, i, err)
+			}
+		}
+	}
+
+	// Adjacent slices of the same array do not overlap
+	if kanzi.SlicesOverlap(buf[0:size], buf[size:2*size]) == true {
+		return errors.New("Adjacent slices reported as overlapping")
+	}
+
+	if kanzi.SlicesOverlap(buf[0:size], buf[size-1:2*size]) == false {
+		return errors.New("Overlapping slices not detected")
+	}
+
+	return nil
+}
+
+func TestBlockTooLarge(b *testing.T) {
+	if err := testBlockTooLarge(); err != nil {
+		b.Error(err)
+	}
+}
+
+func testBlockTooLarge() error {
+	// The size is checked first: the block is a fake slice over a small buffer
+	// (the memory after the buffer is never read). The destination precedes
+	// the block in the buffer so that they do not overlap.
+	buf := make([]byte, 2048)
+	dst := buf[0:1024]
+	src := unsafe.Slice(&buf[1024], transform.MaxBWTBlockSize()+1)
+	transforms := make(map[string]kanzi.ByteTransform)
+	transforms["BWT"], _ = transform.NewBWT()
+	transforms["BWTS"], _ = getByteTransform("BWTS")
+	transforms["TEXT"], _ = function.NewTextCodec()
+	transforms["ROLZ"], _ = getByteFunction("ROLZ")
+
+	for name, t := range transforms {
+		if _, _, err := t.Forward(src, dst); errors.Is(err, kanzi.ErrBlockTooLarge) == false {
+			return fmt.Errorf("%v forward: expected a block too large error, got: %v", name, err)
+		}
+
+		if _, _, err := t.Inverse(src, dst); errors.Is(err, kanzi.ErrBlockTooLarge) == false {
+			return fmt.Errorf("%v inverse: expected a block too large error, got: %v", name, err)
+		}
+	}
+
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"sync"
 
 	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
 )
 
 const (
@@ -73,6 +74,7 @@ type BWT struct {
 	primaryIndexes [8]uint
 	saAlgo         *DivSufSort
 	jobs           uint
+	reference      bool // use the portable reference inverse
 }
 
 // NewBWT creates a new BWT instance with 1 job
@@ -86,7 +88,8 @@ func NewBWT() (*BWT, error) {
 }
 
 // NewBWTWithCtx creates a new BWT instance. The number of jobs is extracted
-// from the provided map or arguments.
+// from the provided map or arguments. The jobs are used to build the suffix
+// array of big blocks (forward) and to invert the chunks (inverse).
 func NewBWTWithCtx(ctx *map[string]interface{}) (*BWT, error) {
 	this := new(BWT)
 	this.buffer1 = make([]uint32, 0)
@@ -99,6 +102,14 @@ func NewBWTWithCtx(ctx *map[string]interface{}) (*BWT, error) {
 		this.jobs = 1
 	}
 
+	if this.jobs == 0 {
+		return nil, errors.New("BWT: The number of jobs must be at least 1")
+	}
+
+	if val, containsKey := (*ctx)["reference"]; containsKey {
+		this.reference = val.(bool)
+	}
+
 	return this, nil
 }
 
@@ -125,22 +136,20 @@ func (this *BWT) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 
 	if count > MaxBWTBlockSize() {
-		// Not a recoverable error: instead of silently fail the transform,
-		// issue a fatal error.
 		errMsg := fmt.Sprintf("The max BWT block size is %v, got %v", MaxBWTBlockSize(), count)
-		panic(errors.New(errMsg))
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
 	}
 
 	if count > len(dst) {
 		errMsg := fmt.Sprintf("Block size is %v, output buffer length is %v", count, len(dst))
-		return 0, 0, errors.New(errMsg)
+		return 0, 0, kanzi.NewOutputTooSmallError(errMsg)
 	}
 
 	if count < 2 {
@@ -154,16 +163,19 @@ func (this *BWT) Forward(src, dst []byte) (uint, uint, error) {
 	if this.saAlgo == nil {
 		var err error
 
-		if this.saAlgo, err = NewDivSufSort(); err != nil {
+		if this.saAlgo, err = NewDivSufSortWithJobs(this.jobs); err != nil {
 			return 0, 0, err
 		}
 	}
 
-	// Lazy dynamic memory allocation
+	// Lazy dynamic memory allocation (returned to the pool on exit)
 	if len(this.buffer2) < count {
-		this.buffer2 = make([]int32, count)
+		alloc.PutInt32s(this.buffer2)
+		this.buffer2 = alloc.Int32s(count)
 	}
 
+	defer this.releaseBuffers()
+
 	sa := this.buffer2
 	this.saAlgo.ComputeSuffixArray(src[0:count], sa[0:count])
 	chunks := GetBWTChunks(count)
@@ -233,22 +245,20 @@ func (this *BWT) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 
 	if count > MaxBWTBlockSize() {
-		// Not a recoverable error: instead of silently fail the transform,
-		// issue a fatal error.
-		errMsg := fmt.Sprintf("The max BWT block size is %v, got %v", MaxBWTSBlockSize(), count)
-		panic(errors.New(errMsg))
+		errMsg := fmt.Sprintf("The max BWT block size is %v, got %v", MaxBWTBlockSize(), count)
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
 	}
 
 	if count > len(dst) {
 		errMsg := fmt.Sprintf("BWT inverse failed: output buffer size is %v, expected %v", count, len(dst))
-		return 0, 0, errors.New(errMsg)
+		return 0, 0, kanzi.NewOutputTooSmallError(errMsg)
 	}
 
 	if count < 2 {
@@ -259,6 +269,10 @@ func (this *BWT) Inverse(src, dst []byte) (uint, uint, error) {
 		return uint(count), uint(count), nil
 	}
 
+	if this.reference == true {
+		return this.inverseReference(src, dst, count)
+	}
+
 	// Find the fastest way to implement inverse based on block size
 	if count < 4*1024*1024 {
 		return this.inverseSmallBlock(src, dst, count)
@@ -267,13 +281,26 @@ func (this *BWT) Inverse(src, dst []byte) (uint, uint, error) {
 	return this.inverseBigBlock(src, dst, count)
 }
 
+// IsReusable returns true
+func (this *BWT) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns false (the suffix array buffers are shared by the calls)
+func (this *BWT) IsConcurrentSafe() bool {
+	return false
+}
+
 // When count < 4M, mergeTPSI algo. Always in one chunk
 func (this *BWT) inverseSmallBlock(src, dst []byte, count int) (uint, uint, error) {
-	// Lazy dynamic memory allocation
+	// Lazy dynamic memory allocation (returned to the pool on exit)
 	if len(this.buffer1) < count {
-		this.buffer1 = make([]uint32, count)
+		alloc.PutUint32s(this.buffer1)
+		this.buffer1 = alloc.Uint32s(count)
 	}
 
+	defer this.releaseBuffers()
+
 	// Aliasing
 	data := this.buffer1
 
@@ -281,7 +308,7 @@ func (this *BWT) inverseSmallBlock(src, dst []byte, count int) (uint, uint, erro
 	pIdx := int(this.PrimaryIndex(0))
 
 	if pIdx > len(src) {
-		return 0, 0, errors.New("Invalid input: corrupted BWT primary index")
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid input: corrupted BWT primary index")
 	}
 
 	buckets := [256]int{}
@@ -317,22 +344,81 @@ func (this *BWT) inverseSmallBlock(src, dst []byte, count int) (uint, uint, erro
 	return uint(count), uint(count), nil
 }
 
+// Reference implementation used to validate the fast paths: canonical LF
+// mapping in one chunk, plain histogram, no packing of indexes and values.
+func (this *BWT) inverseReference(src, dst []byte, count int) (uint, uint, error) {
+	pIdx := int(this.PrimaryIndex(0))
+
+	if pIdx < 1 || pIdx > count {
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid input: corrupted BWT primary index")
+	}
+
+	buckets := [256]int{}
+
+	for _, c := range src[0:count] {
+		buckets[c]++
+	}
+
+	sum := 0
+
+	for i := range buckets {
+		tmp := buckets[i]
+		buckets[i] = sum
+		sum += tmp
+	}
+
+	symbols := alloc.Bytes(count)
+	next := alloc.Ints(count)
+	defer alloc.PutBytes(symbols)
+	defer alloc.PutInts(next)
+
+	for i := 0; i < count; i++ {
+		c := src[i]
+		k := buckets[c]
+		buckets[c]++
+		symbols[k] = c
+		next[k] = i
+
+		// The primary index marks the position of the (virtual) end of block
+		if i < pIdx {
+			next[k] = i - 1
+		}
+	}
+
+	t := pIdx - 1
+
+	for i := 0; i < count; i++ {
+		if t < 0 {
+			return 0, 0, kanzi.NewCorruptStreamError("Invalid input: corrupted BWT primary index")
+		}
+
+		dst[i] = symbols[t]
+		t = next[t]
+	}
+
+	return uint(count), uint(count), nil
+}
+
 // When count >= 1<<24, biPSIv2 algo. Possibly multiple chunks
 func (this *BWT) inverseBigBlock(src, dst []byte, count int) (uint, uint, error) {
-	// Lazy dynamic memory allocations
+	// Lazy dynamic memory allocations (returned to the pool on exit)
 	if len(this.buffer1) < count+1 {
-		this.buffer1 = make([]uint32, count+1)
+		alloc.PutUint32s(this.buffer1)
+		this.buffer1 = alloc.Uint32s(count + 1)
 	}
 
+	defer this.releaseBuffers()
+
 	pIdx := int(this.PrimaryIndex(0))
 
 	if pIdx > len(src) {
-		return 0, 0, errors.New("Invalid input: corrupted BWT primary index")
+		return 0, 0, kanzi.NewCorruptStreamError("Invalid input: corrupted BWT primary index")
 	}
 
 	freqs := [256]int{}
 	kanzi.ComputeHistogram(src[0:count], freqs[:], true, false)
-	buckets := make([]int, 65536)
+	buckets := alloc.Ints(65536)
+	defer alloc.PutInts(buckets)
 
 	for c, sum := 0, 1; c < 256; c++ {
 		f := sum
@@ -366,7 +452,8 @@ func (this *BWT) inverseBigBlock(src, dst []byte, count int) (uint, uint, error)
 	}
 
 	lastc := int(src[0])
-	fastBits := make([]uint16, _BWT_MASK_FASTBITS+1)
+	fastBits := alloc.Uint16s(_BWT_MASK_FASTBITS + 1)
+	defer alloc.PutUint16s(fastBits)
 	shift := uint(0)
 
 	for (count >> shift) > _BWT_MASK_FASTBITS {
@@ -522,6 +609,14 @@ func (this *BWT) inverseChunkTask(dst []byte, buckets []int, fastBits []uint16,
 	}
 }
 
+// Return the temporary buffers to the pool
+func (this *BWT) releaseBuffers() {
+	alloc.PutUint32s(this.buffer1)
+	alloc.PutInt32s(this.buffer2)
+	this.buffer1 = this.buffer1[:0:0]
+	this.buffer2 = this.buffer2[:0:0]
+}
+
 // MaxBWTBlockSize returns the maximum size of a block to transform
 func MaxBWTBlockSize() int {
 	return _BWT_MAX_BLOCK_SIZE
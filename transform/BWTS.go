@@ -16,8 +16,10 @@ limitations under the License.
 package transform
 
 import (
-	"errors"
 	"fmt"
+
+	kanzi "github.com/flanglet/kanzi-go"
+	"github.com/flanglet/kanzi-go/internal/alloc"
 )
 
 const (
@@ -30,9 +32,10 @@ const (
 // Forward transform based on the code at https://code.google.com/p/mk-bwts/
 // by Neal Burns and DivSufSort (port of libDivSufSort by Yuta Mori)
 type BWTS struct {
-	buffer1 []int32
-	buffer2 []int32
-	saAlgo  *DivSufSort
+	buffer1   []int32
+	buffer2   []int32
+	saAlgo    *DivSufSort
+	reference bool // use the portable reference inverse
 }
 
 // NewBWTS creates a new instance of BWTS
@@ -49,6 +52,11 @@ func NewBWTSWithCtx(ctx *map[string]interface{}) (*BWTS, error) {
 	this := &BWTS{}
 	this.buffer1 = make([]int32, 0)
 	this.buffer2 = make([]int32, 0)
+
+	if val, containsKey := (*ctx)["reference"]; containsKey {
+		this.reference = val.(bool)
+	}
+
 	return this, nil
 }
 
@@ -60,23 +68,21 @@ func (this *BWTS) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 	count32 := int32(count)
 
 	if count > MaxBWTSBlockSize() {
-		// Not a recoverable error: instead of silently fail the transform,
-		// issue a fatal error.
 		errMsg := fmt.Sprintf("The max BWTS block size is %v, got %v", MaxBWTSBlockSize(), count)
-		panic(errors.New(errMsg))
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
 	}
 
 	if count > len(dst) {
 		errMsg := fmt.Sprintf("Block size is %v, output buffer length is %v", count, len(dst))
-		return 0, 0, errors.New(errMsg)
+		return 0, 0, kanzi.NewOutputTooSmallError(errMsg)
 	}
 
 	if count < 2 {
@@ -95,15 +101,19 @@ func (this *BWTS) Forward(src, dst []byte) (uint, uint, error) {
 		}
 	}
 
-	// Lazy dynamic memory allocations
+	// Lazy dynamic memory allocations (returned to the pool on exit)
 	if len(this.buffer1) < count {
-		this.buffer1 = make([]int32, count)
+		alloc.PutInt32s(this.buffer1)
+		this.buffer1 = alloc.Int32s(count)
 	}
 
 	if len(this.buffer2) < count {
-		this.buffer2 = make([]int32, count)
+		alloc.PutInt32s(this.buffer2)
+		this.buffer2 = alloc.Int32s(count)
 	}
 
+	defer this.releaseBuffers()
+
 	// Aliasing
 	sa := this.buffer1[0:count]
 	isa := this.buffer2[0:count]
@@ -217,22 +227,20 @@ func (this *BWTS) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 
 	if count > MaxBWTSBlockSize() {
-		// Not a recoverable error: instead of silently fail the transform,
-		// issue a fatal error.
 		errMsg := fmt.Sprintf("The max BWTS block size is %v, got %v", MaxBWTSBlockSize(), count)
-		panic(errors.New(errMsg))
+		return 0, 0, kanzi.NewBlockTooLargeError(errMsg)
 	}
 
 	if count > len(dst) {
 		errMsg := fmt.Sprintf("Block size is %v, output buffer length is %v", count, len(dst))
-		return 0, 0, errors.New(errMsg)
+		return 0, 0, kanzi.NewOutputTooSmallError(errMsg)
 	}
 
 	if count < 2 {
@@ -243,11 +251,18 @@ func (this *BWTS) Inverse(src, dst []byte) (uint, uint, error) {
 		return uint(count), uint(count), nil
 	}
 
-	// Lazy dynamic memory allocation
+	if this.reference == true {
+		return this.inverseReference(src, dst, count)
+	}
+
+	// Lazy dynamic memory allocation (returned to the pool on exit)
 	if len(this.buffer1) < count {
-		this.buffer1 = make([]int32, count)
+		alloc.PutInt32s(this.buffer1)
+		this.buffer1 = alloc.Int32s(count)
 	}
 
+	defer this.releaseBuffers()
+
 	// Aliasing
 	lf := this.buffer1
 
@@ -295,6 +310,87 @@ func (this *BWTS) Inverse(src, dst []byte) (uint, uint, error) {
 	return uint(count), uint(count), nil
 }
 
+// Reference implementation used to validate the inverse: each cycle of the
+// forward (psi) mapping is a Lyndon word, rebuilt front to back from the
+// sorted symbols. The words are found in increasing order and emitted in
+// non increasing order.
+func (this *BWTS) inverseReference(src, dst []byte, count int) (uint, uint, error) {
+	buckets := [256]int{}
+
+	for _, c := range src[0:count] {
+		buckets[c]++
+	}
+
+	sum := 0
+
+	for i := range buckets {
+		tmp := buckets[i]
+		buckets[i] = sum
+		sum += tmp
+	}
+
+	symbols := alloc.Bytes(count)
+	next := alloc.Ints(count)
+	words := alloc.Bytes(count)
+	defer alloc.PutBytes(symbols)
+	defer alloc.PutInts(next)
+	defer alloc.PutBytes(words)
+
+	for i := 0; i < count; i++ {
+		c := src[i]
+		k := buckets[c]
+		buckets[c]++
+		symbols[k] = c
+		next[k] = i
+	}
+
+	starts := make([]int, 0, 16)
+	n := 0
+
+	for i := 0; i < count; i++ {
+		if next[i] < 0 {
+			continue
+		}
+
+		starts = append(starts, n)
+
+		for p := i; next[p] >= 0; {
+			words[n] = symbols[p]
+			n++
+			t := next[p]
+			next[p] = -1
+			p = t
+		}
+	}
+
+	dstIdx, end := 0, n
+
+	for j := len(starts) - 1; j >= 0; j-- {
+		dstIdx += copy(dst[dstIdx:], words[starts[j]:end])
+		end = starts[j]
+	}
+
+	return uint(count), uint(count), nil
+}
+
+// IsReusable returns true
+func (this *BWTS) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns false (the buffers are shared by the calls)
+func (this *BWTS) IsConcurrentSafe() bool {
+	return false
+}
+
+// Return the temporary buffers to the pool
+func (this *BWTS) releaseBuffers() {
+	alloc.PutInt32s(this.buffer1)
+	alloc.PutInt32s(this.buffer2)
+	this.buffer1 = this.buffer1[:0:0]
+	this.buffer2 = this.buffer2[:0:0]
+}
+
 // MaxBWTSBlockSize returns the maximum size of a block to transform
 func MaxBWTSBlockSize() int {
 	return _BWTS_MAX_BLOCK_SIZE
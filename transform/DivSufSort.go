@@ -15,6 +15,11 @@ limitations under the License.
 
 package transform
 
+import (
+	"errors"
+	"sync"
+)
+
 const (
 	_SS_INSERTIONSORT_THRESHOLD = int32(8)
 	_SS_BLOCKSIZE               = int32(1024)
@@ -25,6 +30,9 @@ const (
 	_MASK_FFFF0000              = -65536    // make 32 bit systems happy
 	_MASK_FF000000              = -16777216 // make 32 bit systems happy
 	_MASK_0000FF00              = 65280     // make 32 bit systems happy
+
+	// Min number of type B* suffixes to sort them concurrently
+	_SS_MIN_PARALLEL_SIZE = int32(1 << 16)
 )
 
 var _SQQ_TABLE = []int32{
@@ -67,6 +75,7 @@ type DivSufSort struct {
 	ssStack    *stack
 	trStack    *stack
 	mergestack *stack
+	jobs       int
 }
 
 // NewDivSufSort creates a new instance of DivSufSort
@@ -75,6 +84,20 @@ func NewDivSufSort() (*DivSufSort, error) {
 	this.ssStack = newStack(_SS_MISORT_STACKSIZE)
 	this.trStack = newStack(_TR_STACKSIZE)
 	this.mergestack = newStack(_SS_SMERGE_STACKSIZE)
+	this.jobs = 1
+	return this, nil
+}
+
+// NewDivSufSortWithJobs creates a new instance of DivSufSort that sorts the
+// type B* substrings of big inputs with up to 'jobs' goroutines. The suffix
+// array is the same as with 1 job.
+func NewDivSufSortWithJobs(jobs uint) (*DivSufSort, error) {
+	if jobs == 0 {
+		return nil, errors.New("DivSufSort: The number of jobs must be at least 1")
+	}
+
+	this, _ := NewDivSufSort()
+	this.jobs = int(jobs)
 	return this, nil
 }
 
@@ -360,20 +383,24 @@ func (this *DivSufSort) sortTypeBstar(bucketA, bucketB []int32, n int32) int32 {
 		arr[bucketB[c3]] = m - 1
 
 		// Sort the type B* substrings using ssSort.
-		bufSize := n - m - m
-		x0 = 254
+		if this.jobs > 1 && m >= _SS_MIN_PARALLEL_SIZE {
+			this.ssSortBuckets(bucketB, pab, m, n)
+		} else {
+			bufSize := n - m - m
+			x0 = 254
 
-		for j := m; j > 0; x0-- {
-			idx := x0 << 8
+			for j := m; j > 0; x0-- {
+				idx := x0 << 8
 
-			for x1 := 255; x1 > x0; x1-- {
-				i := bucketB[idx+x1]
+				for x1 := 255; x1 > x0; x1-- {
+					i := bucketB[idx+x1]
 
-				if j-i > 1 {
-					this.ssSort(pab, i, j, m, bufSize, 2, n, arr[i] == m-1)
-				}
+					if j-i > 1 {
+						this.ssSort(pab, i, j, m, bufSize, 2, n, arr[i] == m-1)
+					}
 
-				j = i
+					j = i
+				}
 			}
 		}
 
@@ -491,6 +518,64 @@ func (this *DivSufSort) sortTypeBstar(bucketA, bucketB []int32, n int32) int32 {
 	return m
 }
 
+// Sort the type B* substrings of each bucket concurrently (as in the OpenMP
+// version of libdivsufsort). The buckets are handed out in the order of the
+// sequential sort. Each goroutine has its own stacks and its own part of the
+// work area between the sorted B* suffixes and their positions.
+func (this *DivSufSort) ssSortBuckets(bucketB []int32, pab, m, n int32) {
+	bufSize := (n - m - m) / int32(this.jobs)
+	x0, x1 := 254, 255
+	j := m
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	// Return the next range [first, last) of type B* substrings to sort or
+	// an empty range if there is none
+	next := func() (int32, int32) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		for j > 0 && x0 >= 0 {
+			last := j
+			j = bucketB[(x0<<8)+x1]
+
+			if x1--; x1 <= x0 {
+				x1 = 255
+				x0--
+			}
+
+			if last-j > 1 {
+				return j, last
+			}
+		}
+
+		return 0, 0
+	}
+
+	for t := 0; t < this.jobs; t++ {
+		wg.Add(1)
+
+		go func(buf int32) {
+			defer wg.Done()
+			worker := &DivSufSort{sa: this.sa, buffer: this.buffer, jobs: 1}
+			worker.ssStack = newStack(_SS_MISORT_STACKSIZE)
+			worker.mergestack = newStack(_SS_SMERGE_STACKSIZE)
+
+			for {
+				first, last := next()
+
+				if first == last {
+					return
+				}
+
+				worker.ssSort(pab, first, last, buf, bufSize, 2, n, this.sa[first] == m-1)
+			}
+		}(m + int32(t)*bufSize)
+	}
+
+	wg.Wait()
+}
+
 // Sub String Sort
 func (this *DivSufSort) ssSort(pa, first, last, buf, bufSize, depth, n int32, lastSuffix bool) {
 	if lastSuffix == true {
@@ -18,6 +18,9 @@ package transform
 import (
 	"errors"
 	"fmt"
+	"sort"
+
+	kanzi "github.com/flanglet/kanzi-go"
 )
 
 // Sort by Rank Transform is a family of transforms typically used after
@@ -41,10 +44,11 @@ const (
 
 // SBRT Sort By Rank Transform
 type SBRT struct {
-	mode  int
-	mask1 int
-	mask2 int
-	shift uint
+	mode      int
+	mask1     int
+	mask2     int
+	shift     uint
+	reference bool // use the portable reference inverse
 }
 
 // NewSBRT creates a new instance of SBRT
@@ -111,6 +115,10 @@ func NewSBRTWithCtx(ctx *map[string]interface{}) (*SBRT, error) {
 		this.shift = 0
 	}
 
+	if val, containsKey := (*ctx)["reference"]; containsKey {
+		this.reference = val.(bool)
+	}
+
 	return this, nil
 }
 
@@ -122,15 +130,15 @@ func (this *SBRT) Forward(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 
 	if count > len(dst) {
 		errMsg := fmt.Sprintf("Block size is %v, output buffer length is %v", count, len(dst))
-		return 0, 0, errors.New(errMsg)
+		return 0, 0, kanzi.NewOutputTooSmallError(errMsg)
 	}
 
 	m1 := this.mask1
@@ -176,15 +184,19 @@ func (this *SBRT) Inverse(src, dst []byte) (uint, uint, error) {
 		return 0, 0, nil
 	}
 
-	if &src[0] == &dst[0] {
-		return 0, 0, errors.New("Input and output buffers cannot be equal")
+	if err := kanzi.CheckOverlap(src, dst); err != nil {
+		return 0, 0, err
 	}
 
 	count := len(src)
 
 	if count > len(dst) {
 		errMsg := fmt.Sprintf("Block size is %v, output buffer length is %v", count, len(dst))
-		return 0, 0, errors.New(errMsg)
+		return 0, 0, kanzi.NewOutputTooSmallError(errMsg)
+	}
+
+	if this.reference == true {
+		return this.inverseReference(src, dst, count)
 	}
 
 	m1 := this.mask1
@@ -217,3 +229,41 @@ func (this *SBRT) Inverse(src, dst []byte) (uint, uint, error) {
 
 	return uint(count), uint(count), nil
 }
+
+// Reference implementation used to validate the inverse. The list of
+// symbols is sorted by decreasing rank value at all times: the new position
+// of a symbol is found by binary search (before the symbols with the same
+// rank value) and the list is shifted with a single copy.
+func (this *SBRT) inverseReference(src, dst []byte, count int) (uint, uint, error) {
+	last := [256]int{}
+	ranks := [256]int{}
+	list := [256]byte{}
+
+	for i := range list {
+		list[i] = byte(i)
+	}
+
+	for i := 0; i < count; i++ {
+		r := int(src[i])
+		c := list[r]
+		dst[i] = c
+		rank := ((i & this.mask1) + (last[c] & this.mask2)) >> this.shift
+		last[c] = i
+		ranks[c] = rank
+		n := sort.Search(r, func(k int) bool { return ranks[list[k]] <= rank })
+		copy(list[n+1:r+1], list[n:r])
+		list[n] = c
+	}
+
+	return uint(count), uint(count), nil
+}
+
+// IsReusable returns true
+func (this *SBRT) IsReusable() bool {
+	return true
+}
+
+// IsConcurrentSafe returns true (the mode is set at creation)
+func (this *SBRT) IsConcurrentSafe() bool {
+	return true
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package corpus generates representative datasets to evaluate compression
+// settings without shipping large files. The data is a deterministic function
+// of the kind, size and seed: the same parameters always produce the same
+// bytes.
+package corpus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/flanglet/kanzi-go/function"
+)
+
+// Kinds of datasets
+const (
+	TEXT   = "TEXT"   // English-like text (words of the static text dictionary)
+	LOGS   = "LOGS"   // structured log lines with Zipfian fields
+	EXE    = "EXE"    // x86-64 like machine code and tables
+	DNA    = "DNA"    // nucleotide sequences with repeats
+	SPARSE = "SPARSE" // binary records mostly made of zeros
+)
+
+var (
+	_CORPUS_KINDS = []string{TEXT, LOGS, EXE, DNA, SPARSE}
+
+	_CORPUS_LEVELS    = []string{"INFO", "DEBUG", "WARN", "ERROR", "TRACE", "FATAL"}
+	_CORPUS_METHODS   = []string{"GET", "POST", "PUT", "DELETE", "HEAD"}
+	_CORPUS_RESOURCES = []string{"users", "items", "orders", "sessions", "search", "images", "carts",
+		"payments", "reports", "health", "metrics", "auth", "config", "invoices", "stock", "reviews"}
+	_CORPUS_STATUS  = []int{200, 204, 304, 404, 201, 500, 302, 401, 403, 503}
+	_CORPUS_SERVICE = []string{"api", "worker", "scheduler", "gateway", "db-proxy", "cache"}
+)
+
+// Kinds returns the kinds of datasets that can be generated
+func Kinds() []string {
+	res := make([]string, len(_CORPUS_KINDS))
+	copy(res, _CORPUS_KINDS)
+	return res
+}
+
+// Generate returns size bytes of the dataset of the provided kind (case
+// insensitive) generated from the seed
+func Generate(kind string, size int, seed int64) ([]byte, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("Invalid corpus size: %d", size)
+	}
+
+	switch strings.ToUpper(kind) {
+	case TEXT:
+		return GenerateText(size, seed), nil
+
+	case LOGS:
+		return GenerateLogs(size, seed), nil
+
+	case EXE:
+		return GenerateExe(size, seed), nil
+
+	case DNA:
+		return GenerateDNA(size, seed), nil
+
+	case SPARSE:
+		return GenerateSparse(size, seed), nil
+
+	default:
+		return nil, fmt.Errorf("Unknown corpus kind: '%s'", kind)
+	}
+}
+
+// GenerateText returns English-like text: sentences of words of the static
+// text dictionary drawn with a Zipfian distribution (the dictionary is
+// sorted by frequency), with punctuation and paragraphs.
+func GenerateText(size int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	words := function.DefaultDictionaryWords()
+	zipf := rand.NewZipf(rnd, 1.1, 2, uint64(len(words)-1))
+	var buf bytes.Buffer
+	buf.Grow(size + 256)
+
+	for buf.Len() < size {
+		// One paragraph
+		sentences := 2 + rnd.Intn(6)
+
+		for s := 0; s < sentences; s++ {
+			n := 4 + rnd.Intn(14)
+
+			for i := 0; i < n; i++ {
+				w := words[zipf.Uint64()]
+
+				if i == 0 {
+					buf.WriteByte(w[0] - 0x20)
+					buf.Write(w[1:])
+				} else {
+					buf.WriteByte(' ')
+					buf.Write(w)
+				}
+
+				if i > 1 && i < n-2 && rnd.Intn(12) == 0 {
+					buf.WriteByte(',')
+				}
+			}
+
+			switch rnd.Intn(10) {
+			case 0:
+				buf.WriteString("? ")
+
+			case 1:
+				buf.WriteString("! ")
+
+			default:
+				buf.WriteString(". ")
+			}
+		}
+
+		buf.Truncate(buf.Len() - 1)
+		buf.WriteString("\n\n")
+	}
+
+	return buf.Bytes()[0:size]
+}
+
+// GenerateLogs returns log lines (timestamp, level, service, request,
+// status, latency, client address and request id) with Zipfian fields and
+// increasing timestamps
+func GenerateLogs(size int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	zipfRes := rand.NewZipf(rnd, 1.3, 1, uint64(len(_CORPUS_RESOURCES)-1))
+	zipfStatus := rand.NewZipf(rnd, 2, 1, uint64(len(_CORPUS_STATUS)-1))
+	zipfLevel := rand.NewZipf(rnd, 2, 1, uint64(len(_CORPUS_LEVELS)-1))
+	zipfUser := rand.NewZipf(rnd, 1.2, 1, 99999)
+	zipfClient := rand.NewZipf(rnd, 1.1, 1, 4095)
+	ts := int64(1489000000000) + rnd.Int63n(1000000)
+	var buf bytes.Buffer
+	buf.Grow(size + 256)
+
+	for buf.Len() < size {
+		ts += rnd.Int63n(250)
+		fmt.Fprintf(&buf, "%s %-5s [%s-%d] ", time.Unix(ts/1000, (ts%1000)*1000000).UTC().Format("2006-01-02 15:04:05.000"),
+			_CORPUS_LEVELS[zipfLevel.Uint64()], _CORPUS_SERVICE[rnd.Intn(len(_CORPUS_SERVICE))], rnd.Intn(8))
+		client := zipfClient.Uint64()
+		fmt.Fprintf(&buf, "%s /api/v1/%s/%d status=%d latency=%dms client=10.%d.%d.%d user=u%05d req=%016x\n",
+			_CORPUS_METHODS[rnd.Intn(len(_CORPUS_METHODS))], _CORPUS_RESOURCES[zipfRes.Uint64()],
+			rnd.Intn(5000), _CORPUS_STATUS[zipfStatus.Uint64()], 1+rnd.Intn(40)*rnd.Intn(12),
+			client>>8, client&0xFF, 1+rnd.Intn(4), zipfUser.Uint64(), rnd.Uint64())
+	}
+
+	return buf.Bytes()[0:size]
+}
+
+// GenerateExe returns x86-64 like machine code: functions made of
+// prologues, register moves, loads and stores with small displacements,
+// relative calls to other functions, epilogues and alignment padding,
+// followed by a read only data section (strings and address tables)
+func GenerateExe(size int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	res := make([]byte, 0, size+64)
+	codeSize := size * 3 / 4
+	functions := make([]int, 0, 256)
+	words := function.DefaultDictionaryWords()
+
+	for len(res) < codeSize {
+		functions = append(functions, len(res))
+
+		// Prologue: push rbp; mov rbp, rsp; sub rsp, imm8
+		res = append(res, 0x55, 0x48, 0x89, 0xE5, 0x48, 0x83, 0xEC, byte(8*(1+rnd.Intn(8))))
+		n := 4 + rnd.Intn(40)
+
+		for i := 0; i < n; i++ {
+			switch rnd.Intn(8) {
+			case 0, 1:
+				// mov reg, [rbp-disp8]
+				res = append(res, 0x48, 0x8B, byte(0x45+8*rnd.Intn(4)), byte(-8*(1+rnd.Intn(8))))
+
+			case 2:
+				// mov [rbp-disp8], reg
+				res = append(res, 0x48, 0x89, byte(0x45+8*rnd.Intn(4)), byte(-8*(1+rnd.Intn(8))))
+
+			case 3:
+				// call rel32 (to a previous function)
+				target := functions[rnd.Intn(len(functions))]
+				res = append(res, 0xE8, 0, 0, 0, 0)
+				binary.LittleEndian.PutUint32(res[len(res)-4:], uint32(int32(target-len(res))))
+
+			case 4:
+				// mov eax, imm32
+				res = append(res, 0xB8, 0, 0, 0, 0)
+				binary.LittleEndian.PutUint32(res[len(res)-4:], uint32(rnd.Intn(256)))
+
+			case 5:
+				// add/sub/cmp reg, reg
+				res = append(res, 0x48, []byte{0x01, 0x29, 0x39}[rnd.Intn(3)], byte(0xC0+rnd.Intn(64)))
+
+			case 6:
+				// test eax, eax; jcc rel8
+				res = append(res, 0x85, 0xC0, byte(0x74+rnd.Intn(2)), byte(rnd.Intn(64)))
+
+			default:
+				// lea rdi, [rip+disp32]
+				res = append(res, 0x48, 0x8D, 0x3D, 0, 0, 0, 0)
+				binary.LittleEndian.PutUint32(res[len(res)-4:], uint32(codeSize-len(res)+rnd.Intn(4096)))
+			}
+		}
+
+		// Epilogue: leave; ret then padding to 16 bytes
+		res = append(res, 0xC9, 0xC3)
+
+		for len(res)&15 != 0 {
+			res = append(res, 0xCC)
+		}
+	}
+
+	// Read only data: null terminated strings and tables of addresses
+	for len(res) < size {
+		if len(functions) > 0 && rnd.Intn(3) == 0 {
+			for i := 0; i < 8; i++ {
+				res = append(res, 0, 0, 0, 0, 0, 0, 0, 0)
+				addr := 0x400000 + uint64(functions[rnd.Intn(len(functions))])
+				binary.LittleEndian.PutUint64(res[len(res)-8:], addr)
+			}
+		} else {
+			n := 1 + rnd.Intn(4)
+
+			for i := 0; i < n; i++ {
+				if i > 0 {
+					res = append(res, '_')
+				}
+
+				res = append(res, words[rnd.Intn(256)]...)
+			}
+
+			res = append(res, 0)
+		}
+	}
+
+	return res[0:size]
+}
+
+// GenerateDNA returns lines of 60 nucleotides. The sequence contains copies
+// of previous segments with point mutations (repeats) and regions with a
+// biased composition.
+func GenerateDNA(size int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	const bases = "ACGT"
+	seq := make([]byte, 0, size+1024)
+
+	// One extra line to fill the last line
+	for len(seq) < size+60 {
+		if len(seq) > 1000 && rnd.Intn(4) == 0 {
+			// Repeat with mutations
+			n := 20 + rnd.Intn(400)
+			start := rnd.Intn(len(seq) - n)
+
+			for i := 0; i < n; i++ {
+				b := seq[start+i]
+
+				if rnd.Intn(50) == 0 {
+					b = bases[rnd.Intn(4)]
+				}
+
+				seq = append(seq, b)
+			}
+		} else {
+			// GC rich or AT rich region
+			n := 50 + rnd.Intn(500)
+			gc := 30 + rnd.Intn(40)
+
+			for i := 0; i < n; i++ {
+				if rnd.Intn(100) < gc {
+					seq = append(seq, "GC"[rnd.Intn(2)])
+				} else {
+					seq = append(seq, "AT"[rnd.Intn(2)])
+				}
+			}
+		}
+	}
+
+	res := make([]byte, 0, size+size/60+1)
+
+	for i := 0; len(res) < size; i += 60 {
+		res = append(res, seq[i:i+60]...)
+		res = append(res, '\n')
+	}
+
+	return res[0:size]
+}
+
+// GenerateSparse returns a table of little endian 32 bit records (16
+// fields per row) where most fields are zero and the others are small
+// counters, flags or occasional large values
+func GenerateSparse(size int, seed int64) []byte {
+	rnd := rand.New(rand.NewSource(seed))
+	res := make([]byte, size+64)
+	used := rnd.Perm(16)[0:4] // fields often set
+	idx := 0
+
+	for row := 0; idx < size; row++ {
+		for f := 0; f < 16; f++ {
+			val := uint32(0)
+
+			switch {
+			case f == used[0]:
+				val = uint32(row)
+
+			case f == used[1] || f == used[2]:
+				if rnd.Intn(3) == 0 {
+					val = uint32(rnd.Intn(100))
+				}
+
+			case f == used[3]:
+				if rnd.Intn(20) == 0 {
+					val = rnd.Uint32()
+				}
+
+			default:
+				if rnd.Intn(200) == 0 {
+					val = 1
+				}
+			}
+
+			binary.LittleEndian.PutUint32(res[idx:], val)
+			idx += 4
+		}
+	}
+
+	return res[0:size]
+}
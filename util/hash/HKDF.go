@@ -0,0 +1,92 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hash
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// HMAC-SHA256 based key derivation functions: HKDF (RFC 5869) and PBKDF2
+// (RFC 8018, used by Scrypt)
+
+// HKDF derives a key of keyLen bytes (at most 255*32) from the secret, the
+// salt and the info (context) with HMAC-SHA256.
+func HKDF(secret, salt, info []byte, keyLen int) ([]byte, error) {
+	if keyLen < 0 || keyLen > 255*sha256.Size {
+		return nil, errors.New("HKDF: invalid key length")
+	}
+
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+
+	// Extract
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	prk := mac.Sum(nil)
+
+	// Expand
+	res := make([]byte, 0, keyLen+sha256.Size)
+	mac = hmac.New(sha256.New, prk)
+	var t []byte
+
+	for counter := byte(1); len(res) < keyLen; counter++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		t = mac.Sum(nil)
+		res = append(res, t...)
+	}
+
+	return res[0:keyLen], nil
+}
+
+// Derive a key of keyLen bytes from the password and the salt with
+// HMAC-SHA256 (PBKDF2)
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	mac := hmac.New(sha256.New, password)
+	res := make([]byte, 0, keyLen+sha256.Size)
+	var counter [4]byte
+	u := make([]byte, 0, sha256.Size)
+	t := make([]byte, sha256.Size)
+
+	for block := uint32(1); len(res) < keyLen; block++ {
+		binary.BigEndian.PutUint32(counter[:], block)
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(counter[:])
+		u = mac.Sum(u[:0])
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		res = append(res, t...)
+	}
+
+	return res[0:keyLen]
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hash
+
+import (
+	"github.com/flanglet/kanzi-go/internal/cpuinfo"
+)
+
+// Kernels hashing the stripes of the input, selected at startup based on
+// the CPU features
+var (
+	xxHash32Stripes func(data []byte, acc *[4]uint32) int
+	xxHash64Stripes func(data []byte, acc *[4]uint64) int
+)
+
+func init() {
+	cpuinfo.Register(selectKernels)
+}
+
+func selectKernels(f cpuinfo.Features) {
+	if f.UnalignedLoads == true {
+		xxHash32Stripes = xxHash32StripesWide
+		xxHash64Stripes = xxHash64StripesWide
+	} else {
+		xxHash32Stripes = xxHash32StripesDefault
+		xxHash64Stripes = xxHash64StripesDefault
+	}
+}
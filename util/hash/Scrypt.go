@@ -0,0 +1,153 @@
+/*
+Copyright 2011-2017 Frederic Langlet
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+you may obtain a copy of the License at
+
+                http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hash
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// Scrypt password based key derivation function (RFC 7914)
+// The memory usage is 128*n*r bytes.
+
+const (
+	_SCRYPT_MAX_MEMORY = 1 << 30
+)
+
+// Scrypt derives a key of keyLen bytes from the password and the salt.
+// n (CPU/memory cost) must be a power of 2 greater than 1, r is the block
+// size and p the parallelization parameter.
+func Scrypt(password, salt []byte, n, r, p, keyLen int) ([]byte, error) {
+	if n <= 1 || n&(n-1) != 0 {
+		return nil, errors.New("Scrypt: the cost parameter must be a power of 2 greater than 1")
+	}
+
+	if r <= 0 || p <= 0 || uint64(r)*uint64(p) >= 1<<30 {
+		return nil, errors.New("Scrypt: invalid block size or parallelization parameter")
+	}
+
+	if uint64(n)*uint64(r) > _SCRYPT_MAX_MEMORY/128 {
+		return nil, errors.New("Scrypt: the parameters require too much memory")
+	}
+
+	b := pbkdf2(password, salt, 1, p*128*r)
+	words := 32 * r
+	x := make([]uint32, words)
+	y := make([]uint32, words)
+	v := make([]uint32, words*n)
+
+	for i := 0; i < p; i++ {
+		scryptROMix(b[i*128*r:], r, n, v, x, y)
+	}
+
+	return pbkdf2(password, b, 1, keyLen), nil
+}
+
+func scryptROMix(b []byte, r, n int, v, x, y []uint32) {
+	words := 32 * r
+
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+
+	for i := 0; i < n; i++ {
+		copy(v[i*words:], x)
+		scryptBlockMix(x, y, r)
+	}
+
+	for i := 0; i < n; i++ {
+		// Integerify: first word of the last 64 byte block
+		j := int(x[(2*r-1)*16] & uint32(n-1))
+		vj := v[j*words : (j+1)*words]
+
+		for k := range x {
+			x[k] ^= vj[k]
+		}
+
+		scryptBlockMix(x, y, r)
+	}
+
+	for i := range x {
+		binary.LittleEndian.PutUint32(b[4*i:], x[i])
+	}
+}
+
+// Mix the 2*r blocks of 16 words of b (y is a scratch buffer)
+func scryptBlockMix(b, y []uint32, r int) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+
+	for i := 0; i < 2*r; i++ {
+		for k := range x {
+			x[k] ^= b[i*16+k]
+		}
+
+		salsa208(&x)
+
+		// Even blocks first, then odd blocks
+		copy(y[((i&1)*r+i>>1)*16:], x[:])
+	}
+
+	copy(b, y)
+}
+
+// Salsa20/8 core
+func salsa208(b *[16]uint32) {
+	x := *b
+
+	for i := 0; i < 8; i += 2 {
+		// Columns
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		// Rows
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+
+	for i := range b {
+		b[i] += x[i]
+	}
+}
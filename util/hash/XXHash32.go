@@ -60,14 +60,9 @@ func (this *XXHash32) Hash(data []byte) uint32 {
 		v3 := this.seed
 		v4 := this.seed - _XXHASH_PRIME32_1
 
-		for n <= end16 {
-			buf := data[n : n+16]
-			v1 = xxHash32Round(v1, binary.LittleEndian.Uint32(buf[0:4]))
-			v2 = xxHash32Round(v2, binary.LittleEndian.Uint32(buf[4:8]))
-			v3 = xxHash32Round(v3, binary.LittleEndian.Uint32(buf[8:12]))
-			v4 = xxHash32Round(v4, binary.LittleEndian.Uint32(buf[12:16]))
-			n += 16
-		}
+		acc := [4]uint32{v1, v2, v3, v4}
+		n = xxHash32Stripes(data[0:end16+16], &acc)
+		v1, v2, v3, v4 = acc[0], acc[1], acc[2], acc[3]
 
 		h32 = ((v1 << 1) | (v1 >> 31)) + ((v2 << 7) | (v2 >> 25)) +
 			((v3 << 12) | (v3 >> 20)) + ((v4 << 18) | (v4 >> 14))
@@ -96,6 +91,43 @@ func (this *XXHash32) Hash(data []byte) uint32 {
 	return h32 ^ (h32 >> 16)
 }
 
+// Portable kernel: process the stripes of 16 bytes with 32 bit loads.
+// Returns the number of bytes processed.
+func xxHash32StripesDefault(data []byte, acc *[4]uint32) int {
+	n := 0
+
+	for n+16 <= len(data) {
+		buf := data[n : n+16]
+		acc[0] = xxHash32Round(acc[0], binary.LittleEndian.Uint32(buf[0:4]))
+		acc[1] = xxHash32Round(acc[1], binary.LittleEndian.Uint32(buf[4:8]))
+		acc[2] = xxHash32Round(acc[2], binary.LittleEndian.Uint32(buf[8:12]))
+		acc[3] = xxHash32Round(acc[3], binary.LittleEndian.Uint32(buf[12:16]))
+		n += 16
+	}
+
+	return n
+}
+
+// Kernel for CPUs with fast unaligned loads: one 64 bit load feeds 2 lanes
+func xxHash32StripesWide(data []byte, acc *[4]uint32) int {
+	v1, v2, v3, v4 := acc[0], acc[1], acc[2], acc[3]
+	n := 0
+
+	for n+16 <= len(data) {
+		buf := data[n : n+16]
+		lo := binary.LittleEndian.Uint64(buf[0:8])
+		hi := binary.LittleEndian.Uint64(buf[8:16])
+		v1 = xxHash32Round(v1, uint32(lo))
+		v2 = xxHash32Round(v2, uint32(lo>>32))
+		v3 = xxHash32Round(v3, uint32(hi))
+		v4 = xxHash32Round(v4, uint32(hi>>32))
+		n += 16
+	}
+
+	acc[0], acc[1], acc[2], acc[3] = v1, v2, v3, v4
+	return n
+}
+
 func xxHash32Round(acc, val uint32) uint32 {
 	acc += (val * _XXHASH_PRIME32_2)
 	return ((acc << 13) | (acc >> 19)) * _XXHASH_PRIME32_1
@@ -60,14 +60,9 @@ func (this *XXHash64) Hash(data []byte) uint64 {
 		v3 := this.seed
 		v4 := this.seed - _XXHASH_PRIME64_1
 
-		for n <= end32 {
-			buf := data[n : n+32]
-			v1 = xxHash64Round(v1, binary.LittleEndian.Uint64(buf[0:8]))
-			v2 = xxHash64Round(v2, binary.LittleEndian.Uint64(buf[8:16]))
-			v3 = xxHash64Round(v3, binary.LittleEndian.Uint64(buf[16:24]))
-			v4 = xxHash64Round(v4, binary.LittleEndian.Uint64(buf[24:32]))
-			n += 32
-		}
+		acc := [4]uint64{v1, v2, v3, v4}
+		n = xxHash64Stripes(data[0:end32+32], &acc)
+		v1, v2, v3, v4 = acc[0], acc[1], acc[2], acc[3]
 
 		h64 = ((v1 << 1) | (v1 >> 31)) + ((v2 << 7) | (v2 >> 25)) +
 			((v3 << 12) | (v3 >> 20)) + ((v4 << 18) | (v4 >> 14))
@@ -107,6 +102,46 @@ func (this *XXHash64) Hash(data []byte) uint64 {
 	return h64 ^ (h64 >> 32)
 }
 
+// Portable kernel: process one stripe of 32 bytes per iteration.
+// Returns the number of bytes processed.
+func xxHash64StripesDefault(data []byte, acc *[4]uint64) int {
+	n := 0
+
+	for n+32 <= len(data) {
+		buf := data[n : n+32]
+		acc[0] = xxHash64Round(acc[0], binary.LittleEndian.Uint64(buf[0:8]))
+		acc[1] = xxHash64Round(acc[1], binary.LittleEndian.Uint64(buf[8:16]))
+		acc[2] = xxHash64Round(acc[2], binary.LittleEndian.Uint64(buf[16:24]))
+		acc[3] = xxHash64Round(acc[3], binary.LittleEndian.Uint64(buf[24:32]))
+		n += 32
+	}
+
+	return n
+}
+
+// Kernel for CPUs with fast unaligned loads: process 2 stripes per iteration
+// in registers (one bounds check per 64 bytes)
+func xxHash64StripesWide(data []byte, acc *[4]uint64) int {
+	v1, v2, v3, v4 := acc[0], acc[1], acc[2], acc[3]
+	n := 0
+
+	for n+64 <= len(data) {
+		buf := data[n : n+64]
+		v1 = xxHash64Round(v1, binary.LittleEndian.Uint64(buf[0:8]))
+		v2 = xxHash64Round(v2, binary.LittleEndian.Uint64(buf[8:16]))
+		v3 = xxHash64Round(v3, binary.LittleEndian.Uint64(buf[16:24]))
+		v4 = xxHash64Round(v4, binary.LittleEndian.Uint64(buf[24:32]))
+		v1 = xxHash64Round(v1, binary.LittleEndian.Uint64(buf[32:40]))
+		v2 = xxHash64Round(v2, binary.LittleEndian.Uint64(buf[40:48]))
+		v3 = xxHash64Round(v3, binary.LittleEndian.Uint64(buf[48:56]))
+		v4 = xxHash64Round(v4, binary.LittleEndian.Uint64(buf[56:64]))
+		n += 64
+	}
+
+	acc[0], acc[1], acc[2], acc[3] = v1, v2, v3, v4
+	return n + xxHash64StripesDefault(data[n:], acc)
+}
+
 func xxHash64Round(acc, val uint64) uint64 {
 	acc += (val * _XXHASH_PRIME64_2)
 	return ((acc << 31) | (acc >> 33)) * _XXHASH_PRIME64_1